@@ -2,14 +2,15 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/url"
 	"sync"
 
 	"go.uber.org/zap"
 
+	"github.com/andydunstall/piko/pkg/bufpool"
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/websocket"
 )
@@ -26,11 +27,21 @@ const (
 // Client manages registering listeners with Piko.
 //
 // The client establishes an outbound-only connection to the server for each
-// listener. Proxied connections for the listener are then multiplexed over
-// that outbound connection. Therefore the client never exposes a port.
+// listener, or a single shared connection for all listeners if configured
+// with [WithMultiplex]. Proxied connections for the listener are then
+// multiplexed over that outbound connection. Therefore the client never
+// exposes a port.
 type Client struct {
 	options options
-	logger  log.Logger
+
+	// mux is the shared session when multiplexing is enabled, or nil if
+	// there are no open listeners.
+	mux *muxSession
+
+	// muxMu protects mux.
+	muxMu sync.Mutex
+
+	logger log.Logger
 }
 
 func New(opts ...Option) *Client {
@@ -56,6 +67,9 @@ func New(opts ...Option) *Client {
 //
 // The returned [Listener] is a [net.Listener].
 func (c *Client) Listen(ctx context.Context, endpointID string) (Listener, error) {
+	if c.options.multiplex {
+		return c.listenMux(ctx, endpointID)
+	}
 	return listen(ctx, endpointID, c.options, c.logger)
 }
 
@@ -64,7 +78,7 @@ func (c *Client) Listen(ctx context.Context, endpointID string) (Listener, error
 func (c *Client) ListenAndForward(
 	ctx context.Context, endpointID string, addr string,
 ) error {
-	ln, err := listen(ctx, endpointID, c.options, c.logger)
+	ln, err := c.Listen(ctx, endpointID)
 	if err != nil {
 		return fmt.Errorf("listen: %w", err)
 	}
@@ -80,10 +94,119 @@ func (c *Client) ListenAndForward(
 	}
 }
 
+// listenMux registers the endpoint on the shared session, connecting the
+// session if there isn't one.
+func (c *Client) listenMux(ctx context.Context, endpointID string) (Listener, error) {
+	for {
+		mux, err := c.muxSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ln, err := mux.listen(ctx, endpointID)
+		if errors.Is(err, errMuxClosed) {
+			// The session closed after the last listener closed, so
+			// connect a new session.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return ln, nil
+	}
+}
+
+func (c *Client) muxSession(ctx context.Context) (*muxSession, error) {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+
+	if c.mux != nil {
+		return c.mux, nil
+	}
+
+	mux, err := connectMux(ctx, c.options, c.onMuxClose, c.logger)
+	if err != nil {
+		return nil, err
+	}
+	c.mux = mux
+	return mux, nil
+}
+
+func (c *Client) onMuxClose(mux *muxSession) {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+
+	if c.mux == mux {
+		c.mux = nil
+	}
+}
+
 // Dial opens a TCP connection to an upstream listening on the given endpoint
 // ID via Piko.
+//
+// If a token is configured, it is sent as a proxy token in the
+// 'x-piko-authorization' header.
 func (c *Client) Dial(ctx context.Context, endpointID string) (net.Conn, error) {
-	return websocket.Dial(ctx, proxyTCPURL(c.options.proxyURL, endpointID))
+	token, err := c.options.loadToken()
+	if err != nil {
+		return nil, fmt.Errorf("load token: %w", err)
+	}
+
+	opts := c.options.dialOptions()
+	if token != "" {
+		opts = append(opts, websocket.WithHeader(
+			"x-piko-authorization", "Bearer "+token,
+		))
+	}
+
+	if c.options.resolver != nil {
+		conn, ok := c.dialResolved(ctx, endpointID, opts)
+		if ok {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	return websocket.Dial(ctx, proxyTCPURL(c.options.proxyURL, endpointID), opts...)
+}
+
+// dialResolved dials the nodes returned by the resolver in order until a
+// connection succeeds. Returns false if the endpoint couldn't be resolved or
+// all nodes failed, in which case the caller falls back to the proxy URL.
+func (c *Client) dialResolved(
+	ctx context.Context,
+	endpointID string,
+	opts []websocket.DialOption,
+) (net.Conn, bool) {
+	nodes, err := c.options.resolver.Resolve(ctx, endpointID)
+	if err != nil {
+		c.logger.Debug(
+			"failed to resolve endpoint; using proxy url",
+			zap.String("endpoint-id", endpointID),
+			zap.Error(err),
+		)
+		return nil, false
+	}
+
+	for _, node := range nodes {
+		url := proxyTCPURL(nodeProxyURL(c.options.proxyURL, node.ProxyAddr), endpointID)
+		conn, err := websocket.Dial(ctx, url, opts...)
+		if err == nil {
+			return conn, true
+		}
+		if ctx.Err() != nil {
+			return nil, false
+		}
+
+		c.logger.Debug(
+			"failed to dial node; trying next node",
+			zap.String("endpoint-id", endpointID),
+			zap.String("node-id", node.ID),
+			zap.Error(err),
+		)
+	}
+	return nil, false
 }
 
 func (c *Client) forwardConn(ctx context.Context, conn net.Conn, addr string) {
@@ -106,17 +229,26 @@ func (c *Client) forwardConn(ctx context.Context, conn net.Conn, addr string) {
 		defer g.Done()
 		defer conn.Close()
 		// nolint
-		io.Copy(conn, upstream)
+		bufpool.Copy(conn, upstream)
 	}()
 	go func() {
 		defer g.Done()
 		defer upstream.Close()
 		// nolint
-		io.Copy(upstream, conn)
+		bufpool.Copy(upstream, conn)
 	}()
 	g.Wait()
 }
 
+// nodeProxyURL returns the proxy URL with the host replaced by the given node
+// proxy address.
+func nodeProxyURL(urlStr string, proxyAddr string) string {
+	// Already verified URL in Config.Validate.
+	u, _ := url.Parse(urlStr)
+	u.Host = proxyAddr
+	return u.String()
+}
+
 func proxyTCPURL(urlStr, endpointID string) string {
 	// Already verified URL in Config.Validate.
 	u, _ := url.Parse(urlStr)
@@ -2,17 +2,23 @@ package client
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/yamux"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/pkg/backoff"
+	"github.com/andydunstall/piko/pkg/keepalive"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/tunnel"
 	"github.com/andydunstall/piko/pkg/websocket"
 )
 
@@ -21,6 +27,35 @@ const (
 	maxReconnectBackoff = time.Second * 15
 )
 
+const (
+	// tokenRefreshTimeout is the timeout waiting for the server to respond
+	// to a token refresh. Servers that don't support refreshing tokens never
+	// respond, so the listener reconnects instead.
+	tokenRefreshTimeout = time.Second * 10
+
+	// sessionDrainTimeout is the duration to keep serving the previous
+	// session after reconnecting with a rotated token, so connections opened
+	// by the server before it registers the new session are still accepted.
+	sessionDrainTimeout = time.Second * 30
+
+	// disconnectBackoff is the minimum backoff before reconnecting when the
+	// server closes the connection with a reason that requires backoff,
+	// such as the server shedding load.
+	disconnectBackoff = time.Second * 5
+)
+
+const (
+	// resumeTokenHeader contains the token returned by the server when the
+	// listener connects, which is sent when reconnecting so the server can
+	// identify the listener as resuming its previous connection.
+	resumeTokenHeader = "x-piko-resume-token"
+
+	// maxStreamsHeader contains the maximum number of concurrent connections
+	// the listener accepts, so the server can spill over connections to
+	// other upstreams.
+	maxStreamsHeader = "x-piko-max-streams"
+)
+
 type pikoAddr struct {
 	endpointID string
 }
@@ -40,15 +75,68 @@ func (a *pikoAddr) String() string {
 type Listener interface {
 	net.Listener
 
+	// AcceptWithContext accepts a proxied connection for the endpoint,
+	// returning early if the context is cancelled.
+	AcceptWithContext(ctx context.Context) (net.Conn, error)
+
 	// EndpointID returns the ID of the endpoint this is listening for
 	// connections on.
 	EndpointID() string
 }
 
+// DisconnectError is returned by Accept when the server closed the listeners
+// connection with a reason indicating the listener shouldn't reconnect, such
+// as the listener is no longer authorized.
+type DisconnectError struct {
+	Reason tunnel.DisconnectReason
+}
+
+func (e *DisconnectError) Error() string {
+	return fmt.Sprintf("disconnected by server: %s", e.Reason)
+}
+
+// session is a multiplexed session with the server, along with the
+// underlying WebSocket connection.
+type session struct {
+	*yamux.Session
+
+	conn *websocket.Conn
+}
+
+// disconnectReason returns the reason the server closed the session, or
+// false if the server didn't send a reason.
+func (s *session) disconnectReason() (tunnel.DisconnectReason, bool) {
+	frame, ok := s.conn.RemoteClose()
+	if !ok {
+		return 0, false
+	}
+	return tunnel.ParseDisconnectReason(frame.Code)
+}
+
 type listener struct {
 	endpointID string
 
-	sess *yamux.Session
+	// acceptCh receives connections accepted from the listeners sessions.
+	acceptCh chan net.Conn
+
+	// errCh receives an error if the listener fails to reconnect.
+	errCh chan error
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// sess is the active session.
+	sess *session
+
+	// token is the token used to authenticate the active session.
+	token string
+
+	// resumeToken is the token returned by the server on the last
+	// connection.
+	resumeToken string
+
+	// streams is the number of accepted connections that are still open.
+	streams atomic.Int64
 
 	options options
 
@@ -67,132 +155,448 @@ func listen(
 	closeCtx, closeCancel := context.WithCancel(context.Background())
 	ln := &listener{
 		endpointID:  endpointID,
+		acceptCh:    make(chan net.Conn),
+		errCh:       make(chan error, 1),
 		options:     options,
 		closeCtx:    closeCtx,
 		closeCancel: closeCancel,
 		logger:      logger,
 	}
-	sess, err := ln.connect(ctx)
+	sess, token, err := ln.connect(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("connect: %w", err)
 	}
 	ln.sess = sess
+	ln.token = token
+
+	go ln.serve(sess)
+	if options.tokenFile != nil {
+		go ln.rotateToken()
+	}
 
 	return ln, nil
 }
 
 // Accept accepts a proxied connection for the endpoint.
 func (l *listener) Accept() (net.Conn, error) {
+	return l.AcceptWithContext(context.Background())
+}
+
+func (l *listener) AcceptWithContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-l.acceptCh:
+		return conn, nil
+	case err := <-l.errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.closeCtx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Addr() net.Addr {
+	return &pikoAddr{endpointID: l.endpointID}
+}
+
+func (l *listener) Close() error {
+	l.closeCancel()
+
+	l.mu.Lock()
+	sess := l.sess
+	l.mu.Unlock()
+
+	return sess.Close()
+}
+
+func (l *listener) EndpointID() string {
+	return l.endpointID
+}
+
+// serve accepts connections from the session and passes them to Accept.
+//
+// If the active session fails, the listener reconnects and serves the new
+// session. Sessions that were replaced after rotating the token are served
+// until they are closed.
+func (l *listener) serve(sess *session) {
 	for {
-		conn, err := l.sess.Accept()
+		stream, err := sess.AcceptStream()
 		if err == nil {
-			return conn, nil
+			var conn net.Conn = stream
+			if l.options.maxStreams > 0 {
+				if l.streams.Inc() > int64(l.options.maxStreams) {
+					l.streams.Dec()
+					l.logger.Warn(
+						"max streams exceeded; closing conn",
+						zap.String("endpoint-id", l.endpointID),
+						zap.Int("max-streams", l.options.maxStreams),
+					)
+					stream.Close()
+					continue
+				}
+				conn = &streamConn{
+					Stream:  stream,
+					streams: &l.streams,
+					closed:  atomic.NewBool(false),
+				}
+			}
+
+			select {
+			case l.acceptCh <- conn:
+			case <-l.closeCtx.Done():
+				conn.Close()
+				return
+			}
+			continue
 		}
 
 		if l.closeCtx.Err() != nil {
-			return nil, err
+			return
+		}
+		if !l.active(sess) {
+			// The session was replaced so the new session is served
+			// separately.
+			return
 		}
 
-		l.logger.Warn("failed to accept conn", zap.Error(err))
+		if reason, ok := sess.disconnectReason(); ok {
+			l.logger.Info(
+				"disconnected by server",
+				zap.String("endpoint-id", l.endpointID),
+				zap.String("reason", reason.String()),
+			)
 
-		sess, err := l.connect(l.closeCtx)
-		if err != nil {
-			return nil, err
+			switch reason.Reconnect() {
+			case tunnel.ReconnectNever:
+				l.errCh <- &DisconnectError{Reason: reason}
+				return
+			case tunnel.ReconnectBackoff:
+				backoff := backoff.New(0, disconnectBackoff, maxReconnectBackoff)
+				if !backoff.Wait(l.closeCtx) {
+					return
+				}
+			}
+		} else {
+			l.logger.Warn("failed to accept conn", zap.Error(err))
 		}
 
-		l.sess = sess
+		newSess, token, err := l.connect(l.closeCtx)
+		if err != nil {
+			if l.closeCtx.Err() == nil {
+				l.errCh <- err
+			}
+			return
+		}
+		if !l.replace(sess, newSess, token) {
+			// The session was replaced while reconnecting.
+			newSess.Close()
+			return
+		}
+		sess = newSess
 	}
 }
 
-func (l *listener) AcceptWithContext(ctx context.Context) (net.Conn, error) {
+// rotateToken polls the token file, and when the token changes connects a
+// new session using the new token to replace the active session.
+//
+// The new session is connected before the previous session is closed, so the
+// endpoint stays registered while the listener re-authenticates.
+func (l *listener) rotateToken() {
+	ticker := time.NewTicker(l.options.tokenFile.pollInterval)
+	defer ticker.Stop()
+
 	for {
-		conn, err := l.sess.AcceptStreamWithContext(ctx)
-		if err == nil {
-			return conn, nil
+		select {
+		case <-ticker.C:
+		case <-l.closeCtx.Done():
+			return
 		}
 
-		if ctx.Err() != nil {
-			return nil, err
+		token, err := l.options.tokenFile.Token()
+		if err != nil {
+			l.logger.Warn("failed to load token", zap.Error(err))
+			continue
 		}
-		if l.closeCtx.Err() != nil {
-			return nil, err
+
+		l.mu.Lock()
+		sess := l.sess
+		rotated := token != l.token
+		l.mu.Unlock()
+
+		if !rotated {
+			continue
+		}
+
+		// Attempt to refresh the token on the active session, which
+		// extends the connection expiry without reconnecting. If the server
+		// doesn't support refreshing tokens, fallback to reconnecting with
+		// the new token.
+		err = l.refreshToken(sess, token)
+		if err == nil {
+			l.mu.Lock()
+			if l.sess == sess {
+				l.token = token
+			}
+			l.mu.Unlock()
+
+			l.logger.Info(
+				"token rotated; refreshed",
+				zap.String("endpoint-id", l.endpointID),
+			)
+			continue
 		}
 
-		l.logger.Warn("failed to accept conn", zap.Error(err))
+		l.logger.Warn(
+			"failed to refresh token; reconnecting",
+			zap.String("endpoint-id", l.endpointID),
+			zap.Error(err),
+		)
 
-		sess, err := l.connect(l.closeCtx)
+		newSess, newToken, err := l.connect(l.closeCtx)
 		if err != nil {
-			return nil, err
+			// If the listener is closed this is expected, otherwise connect
+			// only fails with a non-retryable error which is logged.
+			continue
+		}
+		if !l.replace(sess, newSess, newToken) {
+			// The active session failed and reconnected, which already
+			// uses the latest token.
+			newSess.Close()
+			continue
 		}
 
-		l.sess = sess
+		go l.serve(newSess)
+		go l.drain(sess)
 	}
 }
 
-func (l *listener) Addr() net.Addr {
-	return &pikoAddr{endpointID: l.endpointID}
+// refreshToken sends the token to the server on the given session to
+// re-authenticate the connection.
+func (l *listener) refreshToken(sess *session, token string) error {
+	stream, err := sess.OpenStream()
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := stream.SetDeadline(time.Now().Add(tokenRefreshTimeout)); err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	if err := json.NewEncoder(stream).Encode(tunnel.TokenRefreshRequest{
+		Token: token,
+	}); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	var resp tunnel.TokenRefreshResponse
+	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("rejected: %s", resp.Error)
+	}
+	return nil
 }
 
-func (l *listener) Close() error {
-	l.closeCancel()
+// drain closes the replaced session after the drain timeout.
+func (l *listener) drain(sess *session) {
+	timer := time.NewTimer(sessionDrainTimeout)
+	defer timer.Stop()
 
-	return l.sess.Close()
+	select {
+	case <-timer.C:
+	case <-sess.CloseChan():
+	case <-l.closeCtx.Done():
+	}
+	sess.Close()
 }
 
-func (l *listener) EndpointID() string {
-	return l.endpointID
+// active returns whether the session is the active session.
+func (l *listener) active(sess *session) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.sess == sess
 }
 
-func (l *listener) connect(ctx context.Context) (*yamux.Session, error) {
+// replace replaces the active session with the new session if the active
+// session is still prev. Returns false if the active session has already
+// been replaced.
+func (l *listener) replace(prev *session, sess *session, token string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sess != prev {
+		return false
+	}
+	l.sess = sess
+	l.token = token
+	return true
+}
+
+// connect connects a new session to the server, returning the session and
+// the token used to authenticate.
+func (l *listener) connect(ctx context.Context) (*session, string, error) {
+	l.mu.Lock()
+	resumeToken := l.resumeToken
+	l.mu.Unlock()
+
+	sess, token, resumeToken, err := connectSession(
+		ctx,
+		upstreamURL(l.options.upstreamURL, l.endpointID),
+		resumeToken,
+		l.options,
+		l.logger,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	l.mu.Lock()
+	l.resumeToken = resumeToken
+	l.mu.Unlock()
+
+	go l.monitor(sess)
+
+	return sess, token, nil
+}
+
+// connectSession connects a new session to the server at the given URL,
+// retrying until the context is cancelled or a non-retryable error.
+//
+// Returns the session, the token used to authenticate and the resume token
+// returned by the server.
+func connectSession(
+	ctx context.Context,
+	url string,
+	resumeToken string,
+	options options,
+	logger log.Logger,
+) (*session, string, string, error) {
 	backoff := backoff.New(0, minReconnectBackoff, maxReconnectBackoff)
 	for {
-		conn, err := websocket.Dial(
-			ctx,
-			upstreamURL(l.options.upstreamURL, l.endpointID),
-			websocket.WithToken(l.options.token),
-			websocket.WithTLSConfig(l.options.tlsConfig),
-		)
+		token, err := options.loadToken()
+		if err != nil {
+			logger.Warn(
+				"failed to load token; retrying",
+				zap.Error(err),
+			)
+
+			if !backoff.Wait(ctx) {
+				return nil, "", "", ctx.Err()
+			}
+			continue
+		}
+
+		opts := []websocket.DialOption{
+			websocket.WithToken(token),
+			websocket.WithTLSConfig(options.tlsConfig),
+		}
+		opts = append(opts, options.dialOptions()...)
+		if resumeToken != "" {
+			opts = append(opts, websocket.WithHeader(resumeTokenHeader, resumeToken))
+		}
+		if options.maxStreams > 0 {
+			opts = append(opts, websocket.WithHeader(
+				maxStreamsHeader, strconv.Itoa(options.maxStreams),
+			))
+		}
+		conn, err := websocket.Dial(ctx, url, opts...)
 		if err == nil {
-			l.logger.Debug(
+			logger.Debug(
 				"listener connected",
-				zap.String("url", upstreamURL(l.options.upstreamURL, l.endpointID)),
+				zap.String("url", url),
 			)
 
 			muxConfig := yamux.DefaultConfig()
-			muxConfig.Logger = l.logger.StdLogger(zap.WarnLevel)
+			muxConfig.Logger = logger.StdLogger(zap.WarnLevel)
 			muxConfig.LogOutput = nil
-			sess, err := yamux.Client(conn, muxConfig)
+			if options.keepalive.Enabled() {
+				// Replace the yamux keepalive with our own which supports
+				// configuring the number of missed pings.
+				muxConfig.EnableKeepAlive = false
+			}
+			muxSess, err := yamux.Client(conn, muxConfig)
 			if err != nil {
 				// Will not happen.
 				panic("yamux client: " + err.Error())
 			}
-			return sess, nil
+			sess := &session{
+				Session: muxSess,
+				conn:    conn,
+			}
+			return sess, token, conn.ResponseHeader().Get(resumeTokenHeader), nil
 		}
 
 		var retryableError *websocket.RetryableError
 		if !errors.As(err, &retryableError) {
-			l.logger.Error(
+			logger.Error(
 				"failed to connect to server; non-retryable",
-				zap.String("url", upstreamURL(l.options.upstreamURL, l.endpointID)),
+				zap.String("url", url),
 				zap.Error(err),
 			)
-			return nil, err
+			return nil, "", "", err
 		}
 
-		l.logger.Warn(
+		if retryableError.RetryAfter > 0 {
+			// The server is rate limiting connections, such as when many
+			// agents reconnect at once, so wait at least the requested
+			// duration.
+			logger.Warn(
+				"failed to connect to server; retrying after server requested delay",
+				zap.String("url", url),
+				zap.Duration("retry-after", retryableError.RetryAfter),
+				zap.Error(err),
+			)
+
+			if !backoff.WaitAtLeast(ctx, retryableError.RetryAfter) {
+				return nil, "", "", ctx.Err()
+			}
+			continue
+		}
+
+		logger.Warn(
 			"failed to connect to server; retrying",
-			zap.String("url", upstreamURL(l.options.upstreamURL, l.endpointID)),
+			zap.String("url", url),
 			zap.Error(err),
 		)
 
 		if !backoff.Wait(ctx) {
-			return nil, ctx.Err()
+			return nil, "", "", ctx.Err()
 		}
 	}
 }
 
+// monitor closes the session if the server stops responding to pings, which
+// causes Accept to reconnect.
+func (l *listener) monitor(sess *session) {
+	if err := keepalive.Monitor(l.closeCtx, sess, l.options.keepalive); err != nil {
+		l.logger.Warn(
+			"server keepalive failed; reconnecting",
+			zap.String("endpoint-id", l.endpointID),
+			zap.Error(err),
+		)
+	}
+}
+
 var _ Listener = &listener{}
 
+// streamConn is a connection accepted by a listener with a stream limit,
+// which releases the stream when closed.
+type streamConn struct {
+	*yamux.Stream
+
+	streams *atomic.Int64
+	closed  *atomic.Bool
+}
+
+func (c *streamConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.streams.Dec()
+	}
+	return c.Stream.Close()
+}
+
 func upstreamURL(urlStr, endpointID string) string {
 	// Already verified URL in Config.Validate.
 	u, _ := url.Parse(urlStr)
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gorillaws "github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/tunnel"
+	"github.com/andydunstall/piko/pkg/websocket"
+)
+
+type fakeUpstreamConn struct {
+	token string
+	conn  *websocket.Conn
+	sess  *yamux.Session
+}
+
+// fakeUpstreamServer accepts upstream listener connections and passes each
+// connection to connCh. Token refresh requests are handled by refresh.
+func fakeUpstreamServer(
+	t *testing.T,
+	connCh chan<- fakeUpstreamConn,
+	refresh func(token string) tunnel.TokenRefreshResponse,
+) *httptest.Server {
+	upgrader := &gorillaws.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			wsConn, err := upgrader.Upgrade(w, r, nil)
+			require.NoError(t, err)
+
+			conn := websocket.New(wsConn)
+			sess, err := yamux.Server(conn, yamux.DefaultConfig())
+			require.NoError(t, err)
+
+			go func() {
+				for {
+					stream, err := sess.AcceptStream()
+					if err != nil {
+						return
+					}
+
+					var req tunnel.TokenRefreshRequest
+					assert.NoError(t, json.NewDecoder(stream).Decode(&req))
+					assert.NoError(t, json.NewEncoder(stream).Encode(refresh(req.Token)))
+					stream.Close()
+				}
+			}()
+
+			connCh <- fakeUpstreamConn{
+				token: r.Header.Get("Authorization"),
+				conn:  conn,
+				sess:  sess,
+			}
+		},
+	))
+}
+
+func writeToken(t *testing.T, path string, token string, modTime time.Time) {
+	require.NoError(t, os.WriteFile(path, []byte(token), 0o600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+// acceptAndRead accepts a connection from the listener and returns the
+// data read from the connection.
+func acceptAndRead(t *testing.T, ln Listener) string {
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(b)
+}
+
+// openAndWrite opens a connection to the listener and writes the data.
+func openAndWrite(t *testing.T, sess *yamux.Session, data string) {
+	stream, err := sess.OpenStream()
+	require.NoError(t, err)
+	defer stream.Close()
+
+	_, err = stream.Write([]byte(data))
+	require.NoError(t, err)
+}
+
+func TestListener_TokenRotation(t *testing.T) {
+	// Tests the listener refreshes its token on the existing connection.
+	t.Run("refresh", func(t *testing.T) {
+		connCh := make(chan fakeUpstreamConn, 2)
+		refreshCh := make(chan string, 1)
+		server := fakeUpstreamServer(t, connCh, func(token string) tunnel.TokenRefreshResponse {
+			refreshCh <- token
+			return tunnel.TokenRefreshResponse{}
+		})
+		defer server.Close()
+
+		path := filepath.Join(t.TempDir(), "token")
+		writeToken(t, path, "token-1", time.Now())
+
+		tokenFile := newTokenFile(path)
+		tokenFile.pollInterval = time.Millisecond * 10
+
+		ln, err := listen(context.Background(), "my-endpoint", options{
+			tokenFile:   tokenFile,
+			upstreamURL: server.URL,
+		}, log.NewNopLogger())
+		require.NoError(t, err)
+		defer ln.Close()
+
+		conn := <-connCh
+		assert.Equal(t, "Bearer token-1", conn.token)
+
+		writeToken(t, path, "token-2", time.Now().Add(time.Second))
+		assert.Equal(t, "token-2", <-refreshCh)
+
+		// The listener should continue using the existing connection.
+		openAndWrite(t, conn.sess, "foo")
+		assert.Equal(t, "foo", acceptAndRead(t, ln))
+		assert.Len(t, connCh, 0)
+	})
+
+	// Tests the listener reconnects with the new token when the server
+	// rejects the refresh.
+	t.Run("reconnect", func(t *testing.T) {
+		connCh := make(chan fakeUpstreamConn, 2)
+		server := fakeUpstreamServer(t, connCh, func(_ string) tunnel.TokenRefreshResponse {
+			return tunnel.TokenRefreshResponse{
+				Error: "unsupported",
+			}
+		})
+		defer server.Close()
+
+		path := filepath.Join(t.TempDir(), "token")
+		writeToken(t, path, "token-1", time.Now())
+
+		tokenFile := newTokenFile(path)
+		tokenFile.pollInterval = time.Millisecond * 10
+
+		ln, err := listen(context.Background(), "my-endpoint", options{
+			tokenFile:   tokenFile,
+			upstreamURL: server.URL,
+		}, log.NewNopLogger())
+		require.NoError(t, err)
+		defer ln.Close()
+
+		conn1 := <-connCh
+		assert.Equal(t, "Bearer token-1", conn1.token)
+
+		openAndWrite(t, conn1.sess, "foo")
+		assert.Equal(t, "foo", acceptAndRead(t, ln))
+
+		writeToken(t, path, "token-2", time.Now().Add(time.Second))
+
+		// The listener should reconnect with the new token.
+		conn2 := <-connCh
+		assert.Equal(t, "Bearer token-2", conn2.token)
+
+		// Connections on both the new and previous sessions are accepted.
+		openAndWrite(t, conn2.sess, "bar")
+		assert.Equal(t, "bar", acceptAndRead(t, ln))
+		openAndWrite(t, conn1.sess, "car")
+		assert.Equal(t, "car", acceptAndRead(t, ln))
+	})
+}
+
+func TestListener_DisconnectReason(t *testing.T) {
+	// Tests the listener reconnects immediately when the server shuts down.
+	t.Run("reconnect", func(t *testing.T) {
+		connCh := make(chan fakeUpstreamConn, 2)
+		server := fakeUpstreamServer(t, connCh, func(_ string) tunnel.TokenRefreshResponse {
+			return tunnel.TokenRefreshResponse{}
+		})
+		defer server.Close()
+
+		ln, err := listen(context.Background(), "my-endpoint", options{
+			upstreamURL: server.URL,
+		}, log.NewNopLogger())
+		require.NoError(t, err)
+		defer ln.Close()
+
+		conn1 := <-connCh
+		require.NoError(t, conn1.conn.CloseWithFrame(
+			int(tunnel.DisconnectReasonShutdown), "shutdown",
+		))
+
+		conn2 := <-connCh
+		openAndWrite(t, conn2.sess, "foo")
+		assert.Equal(t, "foo", acceptAndRead(t, ln))
+	})
+
+	// Tests the listener stops reconnecting when the server disconnects the
+	// listener as unauthorized.
+	t.Run("stop", func(t *testing.T) {
+		connCh := make(chan fakeUpstreamConn, 2)
+		server := fakeUpstreamServer(t, connCh, func(_ string) tunnel.TokenRefreshResponse {
+			return tunnel.TokenRefreshResponse{}
+		})
+		defer server.Close()
+
+		ln, err := listen(context.Background(), "my-endpoint", options{
+			upstreamURL: server.URL,
+		}, log.NewNopLogger())
+		require.NoError(t, err)
+		defer ln.Close()
+
+		conn := <-connCh
+		require.NoError(t, conn.conn.CloseWithFrame(
+			int(tunnel.DisconnectReasonUnauthorized), "unauthorized",
+		))
+
+		_, err = ln.Accept()
+		var disconnectErr *DisconnectError
+		require.ErrorAs(t, err, &disconnectErr)
+		assert.Equal(t, tunnel.DisconnectReasonUnauthorized, disconnectErr.Reason)
+		assert.Len(t, connCh, 0)
+	})
+}
@@ -0,0 +1,571 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/backoff"
+	"github.com/andydunstall/piko/pkg/keepalive"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/tunnel"
+)
+
+const (
+	// muxRequestTimeout is the timeout waiting for the server to respond to
+	// a request on a multiplexed session.
+	muxRequestTimeout = time.Second * 10
+)
+
+var (
+	errMuxClosed = errors.New("session closed")
+)
+
+// muxSession is a single connection to the server that multiple listeners
+// register their endpoints on.
+//
+// If the connection fails, the session reconnects and re-registers the
+// endpoints of all open listeners.
+type muxSession struct {
+	// onClose is called when the session closes, so the client connects a
+	// new session for the next listener.
+	onClose func(m *muxSession)
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// sess is the active session.
+	sess *session
+
+	// token is the token used to authenticate the active session.
+	token string
+
+	// resumeToken is the token returned by the server on the last
+	// connection.
+	resumeToken string
+
+	// listeners contains the open listeners, keyed by the normalized
+	// endpoint ID.
+	listeners map[string]*muxListener
+
+	closed bool
+
+	options options
+
+	closeCtx    context.Context
+	closeCancel func()
+
+	logger log.Logger
+}
+
+func connectMux(
+	ctx context.Context,
+	options options,
+	onClose func(m *muxSession),
+	logger log.Logger,
+) (*muxSession, error) {
+	closeCtx, closeCancel := context.WithCancel(context.Background())
+	m := &muxSession{
+		onClose:     onClose,
+		listeners:   make(map[string]*muxListener),
+		options:     options,
+		closeCtx:    closeCtx,
+		closeCancel: closeCancel,
+		logger:      logger,
+	}
+	sess, token, err := m.connect(ctx)
+	if err != nil {
+		closeCancel()
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	m.sess = sess
+	m.token = token
+
+	go m.serve(sess)
+	if options.tokenFile != nil {
+		go m.rotateToken()
+	}
+
+	return m, nil
+}
+
+// listen registers the endpoint on the session.
+//
+// Returns errMuxClosed if the session has closed.
+func (m *muxSession) listen(ctx context.Context, endpointID string) (*muxListener, error) {
+	key := normalizeEndpointID(endpointID)
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, errMuxClosed
+	}
+	if _, ok := m.listeners[key]; ok {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("endpoint already registered: %s", endpointID)
+	}
+	closeCtx, closeCancel := context.WithCancel(context.Background())
+	ln := &muxListener{
+		endpointID:  endpointID,
+		mux:         m,
+		acceptCh:    make(chan net.Conn),
+		errCh:       make(chan error, 1),
+		closeCtx:    closeCtx,
+		closeCancel: closeCancel,
+	}
+	m.listeners[key] = ln
+	sess := m.sess
+	m.mu.Unlock()
+
+	if err := m.register(ctx, sess, endpointID); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("register: %w", err)
+	}
+	return ln, nil
+}
+
+// remove removes the listener and unregisters its endpoint. If it was the
+// last listener the session is closed.
+func (m *muxSession) remove(ln *muxListener) {
+	key := normalizeEndpointID(ln.endpointID)
+
+	m.mu.Lock()
+	if m.listeners[key] != ln {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.listeners, key)
+	last := len(m.listeners) == 0
+	sess := m.sess
+	m.mu.Unlock()
+
+	if last {
+		m.close()
+		return
+	}
+
+	var resp tunnel.UnregisterResponse
+	if err := m.request(context.Background(), sess, tunnel.Request{
+		Unregister: &tunnel.UnregisterRequest{EndpointID: ln.endpointID},
+	}, &resp); err != nil {
+		m.logger.Warn(
+			"failed to unregister endpoint",
+			zap.String("endpoint-id", ln.endpointID),
+			zap.Error(err),
+		)
+	} else if resp.Error != "" {
+		m.logger.Warn(
+			"failed to unregister endpoint",
+			zap.String("endpoint-id", ln.endpointID),
+			zap.String("reason", resp.Error),
+		)
+	}
+}
+
+func (m *muxSession) close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	sess := m.sess
+	m.mu.Unlock()
+
+	m.closeCancel()
+	sess.Close()
+
+	m.onClose(m)
+}
+
+// serve accepts connections from the session and passes them to the
+// listener for the endpoint.
+//
+// If the session fails, the session reconnects and re-registers the
+// endpoints of the open listeners.
+func (m *muxSession) serve(sess *session) {
+	for {
+		stream, err := sess.AcceptStream()
+		if err == nil {
+			go m.dispatch(stream)
+			continue
+		}
+
+		if m.closeCtx.Err() != nil {
+			return
+		}
+
+		if reason, ok := sess.disconnectReason(); ok {
+			m.logger.Info(
+				"disconnected by server",
+				zap.String("reason", reason.String()),
+			)
+
+			switch reason.Reconnect() {
+			case tunnel.ReconnectNever:
+				m.fail(&DisconnectError{Reason: reason})
+				return
+			case tunnel.ReconnectBackoff:
+				backoff := backoff.New(0, disconnectBackoff, maxReconnectBackoff)
+				if !backoff.Wait(m.closeCtx) {
+					return
+				}
+			}
+		} else {
+			m.logger.Warn("failed to accept conn", zap.Error(err))
+		}
+
+		newSess, token, err := m.connect(m.closeCtx)
+		if err != nil {
+			if m.closeCtx.Err() == nil {
+				m.fail(err)
+			}
+			return
+		}
+
+		m.mu.Lock()
+		m.sess = newSess
+		m.token = token
+		listeners := make([]*muxListener, 0, len(m.listeners))
+		for _, ln := range m.listeners {
+			listeners = append(listeners, ln)
+		}
+		m.mu.Unlock()
+
+		for _, ln := range listeners {
+			if err := m.register(m.closeCtx, newSess, ln.endpointID); err != nil {
+				ln.fail(fmt.Errorf("register: %w", err))
+			}
+		}
+
+		sess = newSess
+	}
+}
+
+// dispatch reads the stream header to find the endpoint of the proxied
+// connection, then passes the connection to the endpoints listener.
+func (m *muxSession) dispatch(stream net.Conn) {
+	if err := stream.SetReadDeadline(time.Now().Add(muxRequestTimeout)); err != nil {
+		stream.Close()
+		return
+	}
+	endpointID, err := tunnel.ReadStreamHeader(stream)
+	if err != nil {
+		m.logger.Warn("failed to read stream header", zap.Error(err))
+		stream.Close()
+		return
+	}
+	if err := stream.SetReadDeadline(time.Time{}); err != nil {
+		stream.Close()
+		return
+	}
+
+	m.mu.Lock()
+	ln, ok := m.listeners[normalizeEndpointID(endpointID)]
+	m.mu.Unlock()
+
+	if !ok {
+		m.logger.Warn(
+			"conn for unknown endpoint; closing",
+			zap.String("endpoint-id", endpointID),
+		)
+		stream.Close()
+		return
+	}
+	ln.accept(stream)
+}
+
+// fail passes the error to all open listeners and closes the session.
+func (m *muxSession) fail(err error) {
+	m.mu.Lock()
+	listeners := make([]*muxListener, 0, len(m.listeners))
+	for _, ln := range m.listeners {
+		listeners = append(listeners, ln)
+	}
+	m.mu.Unlock()
+
+	for _, ln := range listeners {
+		ln.fail(err)
+	}
+	m.close()
+}
+
+// rotateToken polls the token file, and when the token changes refreshes
+// the token on the active session.
+//
+// If the server rejects the refresh, the session is closed so it reconnects
+// with the new token, which re-registers all endpoints.
+func (m *muxSession) rotateToken() {
+	ticker := time.NewTicker(m.options.tokenFile.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.closeCtx.Done():
+			return
+		}
+
+		token, err := m.options.tokenFile.Token()
+		if err != nil {
+			m.logger.Warn("failed to load token", zap.Error(err))
+			continue
+		}
+
+		m.mu.Lock()
+		sess := m.sess
+		rotated := token != m.token
+		m.mu.Unlock()
+
+		if !rotated {
+			continue
+		}
+
+		var resp tunnel.TokenRefreshResponse
+		err = m.request(m.closeCtx, sess, tunnel.Request{
+			TokenRefresh: &tunnel.TokenRefreshRequest{Token: token},
+		}, &resp)
+		if err == nil && resp.Error != "" {
+			err = fmt.Errorf("rejected: %s", resp.Error)
+		}
+		if err != nil {
+			m.logger.Warn(
+				"failed to refresh token; reconnecting",
+				zap.Error(err),
+			)
+			sess.Close()
+			continue
+		}
+
+		m.mu.Lock()
+		if m.sess == sess {
+			m.token = token
+		}
+		m.mu.Unlock()
+
+		m.logger.Info("token rotated; refreshed")
+	}
+}
+
+func (m *muxSession) register(
+	ctx context.Context,
+	sess *session,
+	endpointID string,
+) error {
+	var resp tunnel.RegisterResponse
+	if err := m.request(ctx, sess, tunnel.Request{
+		Register: &tunnel.RegisterRequest{EndpointID: endpointID},
+	}, &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("rejected: %s", resp.Error)
+	}
+
+	m.logger.Debug(
+		"endpoint registered",
+		zap.String("endpoint-id", endpointID),
+	)
+	return nil
+}
+
+// request sends the request to the server on the given session and decodes
+// the response into resp.
+func (m *muxSession) request(
+	ctx context.Context,
+	sess *session,
+	req tunnel.Request,
+	resp any,
+) error {
+	stream, err := sess.OpenStream()
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	defer stream.Close()
+
+	deadline := time.Now().Add(muxRequestTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := stream.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	if err := json.NewEncoder(stream).Encode(req); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := json.NewDecoder(stream).Decode(resp); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	return nil
+}
+
+// connect connects a new session to the server, returning the session and
+// the token used to authenticate.
+func (m *muxSession) connect(ctx context.Context) (*session, string, error) {
+	m.mu.Lock()
+	resumeToken := m.resumeToken
+	m.mu.Unlock()
+
+	sess, token, resumeToken, err := connectSession(
+		ctx,
+		muxUpstreamURL(m.options.upstreamURL),
+		resumeToken,
+		m.options,
+		m.logger,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.mu.Lock()
+	m.resumeToken = resumeToken
+	m.mu.Unlock()
+
+	go m.monitor(sess)
+
+	return sess, token, nil
+}
+
+// monitor closes the session if the server stops responding to pings, which
+// causes the session to reconnect.
+func (m *muxSession) monitor(sess *session) {
+	if err := keepalive.Monitor(m.closeCtx, sess, m.options.keepalive); err != nil {
+		m.logger.Warn(
+			"server keepalive failed; reconnecting",
+			zap.Error(err),
+		)
+	}
+}
+
+// muxListener is a listener whose endpoint is registered on a multiplexed
+// session shared with other listeners.
+type muxListener struct {
+	endpointID string
+
+	mux *muxSession
+
+	// acceptCh receives connections for the endpoint from the session.
+	acceptCh chan net.Conn
+
+	// errCh receives an error if the endpoint can no longer be registered.
+	errCh chan error
+
+	// streams is the number of accepted connections that are still open.
+	streams atomic.Int64
+
+	closeCtx    context.Context
+	closeCancel func()
+}
+
+// Accept accepts a proxied connection for the endpoint.
+func (l *muxListener) Accept() (net.Conn, error) {
+	return l.AcceptWithContext(context.Background())
+}
+
+func (l *muxListener) AcceptWithContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-l.acceptCh:
+		return conn, nil
+	case err := <-l.errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.closeCtx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return &pikoAddr{endpointID: l.endpointID}
+}
+
+func (l *muxListener) Close() error {
+	l.closeCancel()
+	l.mux.remove(l)
+	return nil
+}
+
+func (l *muxListener) EndpointID() string {
+	return l.endpointID
+}
+
+func (l *muxListener) accept(stream net.Conn) {
+	conn := stream
+	if maxStreams := l.mux.options.maxStreams; maxStreams > 0 {
+		if l.streams.Inc() > int64(maxStreams) {
+			l.streams.Dec()
+			l.mux.logger.Warn(
+				"max streams exceeded; closing conn",
+				zap.String("endpoint-id", l.endpointID),
+				zap.Int("max-streams", maxStreams),
+			)
+			stream.Close()
+			return
+		}
+		conn = &muxStreamConn{
+			Conn:    stream,
+			streams: &l.streams,
+			closed:  atomic.NewBool(false),
+		}
+	}
+
+	select {
+	case l.acceptCh <- conn:
+	case <-l.closeCtx.Done():
+		conn.Close()
+	}
+}
+
+func (l *muxListener) fail(err error) {
+	select {
+	case l.errCh <- err:
+	default:
+	}
+}
+
+var _ Listener = &muxListener{}
+
+// muxStreamConn is a connection accepted by a multiplexed listener with a
+// stream limit, which releases the stream when closed.
+type muxStreamConn struct {
+	net.Conn
+
+	streams *atomic.Int64
+	closed  *atomic.Bool
+}
+
+func (c *muxStreamConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.streams.Dec()
+	}
+	return c.Conn.Close()
+}
+
+// normalizeEndpointID returns the endpoint ID as normalized by the server,
+// which treats endpoint IDs as case insensitive.
+func normalizeEndpointID(endpointID string) string {
+	return strings.ToLower(endpointID)
+}
+
+func muxUpstreamURL(urlStr string) string {
+	// Already verified URL in Config.Validate.
+	u, _ := url.Parse(urlStr)
+	u.Path += "/piko/v1/upstream"
+	if u.Scheme == "http" {
+		u.Scheme = "ws"
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	}
+	return u.String()
+}
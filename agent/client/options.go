@@ -2,16 +2,50 @@ package client
 
 import (
 	"crypto/tls"
+	"time"
 
+	"github.com/andydunstall/piko/pkg/keepalive"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/websocket"
 )
 
 type options struct {
 	token       string
+	tokenFile   *tokenFile
 	proxyURL    string
 	upstreamURL string
 	tlsConfig   *tls.Config
-	logger      log.Logger
+	keepalive   keepalive.Config
+	maxStreams  int
+
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+
+	multiplex bool
+	resolver  *Resolver
+	logger    log.Logger
+}
+
+// dialOptions returns the options to dial WebSocket connections to the
+// server.
+func (o *options) dialOptions() []websocket.DialOption {
+	var opts []websocket.DialOption
+	if o.dialTimeout != 0 {
+		opts = append(opts, websocket.WithDialTimeout(o.dialTimeout))
+	}
+	if o.handshakeTimeout != 0 {
+		opts = append(opts, websocket.WithHandshakeTimeout(o.handshakeTimeout))
+	}
+	return opts
+}
+
+// loadToken returns the token to authenticate the client, loading the token
+// from the token file if configured.
+func (o *options) loadToken() (string, error) {
+	if o.tokenFile != nil {
+		return o.tokenFile.Token()
+	}
+	return o.token, nil
 }
 
 type Option interface {
@@ -29,6 +63,23 @@ func WithToken(key string) Option {
 	return tokenOption(key)
 }
 
+type tokenFileOption string
+
+func (o tokenFileOption) apply(opts *options) {
+	opts.tokenFile = newTokenFile(string(o))
+}
+
+// WithTokenFile configures a file containing the API key to authenticate the
+// client, which overrides [WithToken].
+//
+// The file is polled for changes, such as a rotated Kubernetes projected
+// service account token. When the token changes, listeners reconnect with the
+// new token before closing their existing connections, so they re-authenticate
+// before the previous token expires.
+func WithTokenFile(path string) Option {
+	return tokenFileOption(path)
+}
+
 type upstreamURLOption string
 
 func (o upstreamURLOption) apply(opts *options) {
@@ -66,6 +117,101 @@ func WithTLSConfig(config *tls.Config) Option {
 	return tlsConfigOption{TLSConfig: config}
 }
 
+type keepaliveOption struct {
+	Keepalive keepalive.Config
+}
+
+func (o keepaliveOption) apply(opts *options) {
+	opts.keepalive = o.Keepalive
+}
+
+// WithKeepalive configures pings to detect dead connections to the server.
+// When the server misses the configured number of pings the listener
+// reconnects.
+func WithKeepalive(config keepalive.Config) Option {
+	return keepaliveOption{Keepalive: config}
+}
+
+type maxStreamsOption int
+
+func (o maxStreamsOption) apply(opts *options) {
+	opts.maxStreams = int(o)
+}
+
+// WithMaxStreams configures the maximum number of concurrent connections
+// each listener accepts from the server. The limit is sent to the server
+// when connecting, so the server spills over connections to other upstreams
+// once the limit is reached. Connections that exceed the limit are closed.
+//
+// Defaults to no limit.
+func WithMaxStreams(n int) Option {
+	return maxStreamsOption(n)
+}
+
+type dialTimeoutOption time.Duration
+
+func (o dialTimeoutOption) apply(opts *options) {
+	opts.dialTimeout = time.Duration(o)
+}
+
+// WithDialTimeout configures the timeout to open a TCP connection to the
+// server. Attempts that time out are retried with backoff.
+//
+// Defaults to no timeout, other than the handshake timeout.
+func WithDialTimeout(timeout time.Duration) Option {
+	return dialTimeoutOption(timeout)
+}
+
+type handshakeTimeoutOption time.Duration
+
+func (o handshakeTimeoutOption) apply(opts *options) {
+	opts.handshakeTimeout = time.Duration(o)
+}
+
+// WithHandshakeTimeout configures the timeout to complete the WebSocket
+// handshake with the server, including opening the TCP connection. Attempts
+// that time out are retried with backoff.
+//
+// Defaults to 60 seconds.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return handshakeTimeoutOption(timeout)
+}
+
+type multiplexOption bool
+
+func (o multiplexOption) apply(opts *options) {
+	opts.multiplex = bool(o)
+}
+
+// WithMultiplex configures listeners to share a single connection to the
+// server, rather than each listener opening its own connection. Each
+// listener registers its endpoint over the shared connection.
+//
+// Requires a server that supports multiplexed connections.
+//
+// Defaults to false.
+func WithMultiplex(enabled bool) Option {
+	return multiplexOption(enabled)
+}
+
+type resolverOption struct {
+	Resolver *Resolver
+}
+
+func (o resolverOption) apply(opts *options) {
+	opts.resolver = o.Resolver
+}
+
+// WithResolver configures a resolver to discover the healthy nodes to dial
+// for each endpoint. [Client.Dial] connects to the resolved nodes directly,
+// trying the next node if a node is unreachable, and falls back to the proxy
+// URL if the endpoint can't be resolved.
+//
+// Defaults to always dialing the proxy URL.
+func WithResolver(resolver *Resolver) Option {
+	return resolverOption{Resolver: resolver}
+}
+
 type loggerOption struct {
 	Logger log.Logger
 }
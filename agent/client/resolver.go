@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultResolverTTL is the default duration to cache resolved nodes.
+	defaultResolverTTL = time.Second * 5
+)
+
+// ErrEndpointNotFound is returned by [Resolver.Resolve] when the endpoint
+// has no upstreams connected to any node.
+var ErrEndpointNotFound = errors.New("endpoint not found")
+
+var errNotFound = errors.New("not found")
+
+// Node is a Piko server node that can proxy connections to an endpoint.
+type Node struct {
+	// ID is the node ID.
+	ID string `json:"id"`
+
+	// ProxyAddr is the address of the node's proxy port.
+	ProxyAddr string `json:"proxy_addr"`
+
+	// Upstreams is the number of upstreams for the endpoint connected to
+	// the node. Connections to nodes without upstreams are forwarded to
+	// another node.
+	Upstreams int `json:"upstreams"`
+}
+
+type resolved struct {
+	nodes      []Node
+	resolvedAt time.Time
+}
+
+// Resolver resolves the Piko server nodes to connect to for an endpoint, by
+// querying the status API on a server's admin port.
+//
+// Rather than relying on DNS round-robin to the proxy port, the client can
+// connect directly to the healthy nodes with upstreams for the endpoint,
+// avoiding forwarding, and retry on another node if a node is unreachable.
+//
+// Resolved nodes are cached for a short duration, so the admin port isn't
+// queried for every connection.
+type Resolver struct {
+	adminURL *url.URL
+
+	ttl time.Duration
+
+	httpClient *http.Client
+
+	cache map[string]resolved
+
+	mu sync.Mutex
+}
+
+// NewResolver creates a resolver that queries the admin port at the given
+// URL, such as 'http://piko.example.com:8002'.
+func NewResolver(adminURL string) (*Resolver, error) {
+	u, err := url.Parse(adminURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid admin url: unsupported scheme: %s", u.Scheme)
+	}
+	return &Resolver{
+		adminURL: u,
+		ttl:      defaultResolverTTL,
+		httpClient: &http.Client{
+			Timeout: time.Second * 5,
+		},
+		cache: make(map[string]resolved),
+	}, nil
+}
+
+// SetTTL sets the duration to cache resolved nodes. Defaults to 5 seconds.
+func (r *Resolver) SetTTL(ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ttl = ttl
+}
+
+// Resolve returns the healthy nodes to connect to for the endpoint with the
+// given ID.
+//
+// Nodes with upstreams for the endpoint are returned first, weighted
+// randomly by their number of upstreams, followed by the other healthy nodes
+// in a random order, which can forward connections to a node with an
+// upstream.
+func (r *Resolver) Resolve(ctx context.Context, endpointID string) ([]Node, error) {
+	r.mu.Lock()
+	cached, ok := r.cache[endpointID]
+	ttl := r.ttl
+	r.mu.Unlock()
+
+	var nodes []Node
+	if ok && time.Since(cached.resolvedAt) < ttl {
+		nodes = cached.nodes
+	} else {
+		var err error
+		nodes, err = r.resolve(ctx, endpointID)
+		if err != nil {
+			return nil, err
+		}
+
+		r.mu.Lock()
+		r.cache[endpointID] = resolved{
+			nodes:      nodes,
+			resolvedAt: time.Now(),
+		}
+		r.mu.Unlock()
+	}
+
+	return orderNodes(nodes), nil
+}
+
+type resolverNode struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	ProxyAddr string `json:"proxy_addr"`
+}
+
+type resolverEndpoint struct {
+	Nodes map[string]int `json:"nodes"`
+}
+
+func (r *Resolver) resolve(ctx context.Context, endpointID string) ([]Node, error) {
+	var endpoint resolverEndpoint
+	err := r.request(ctx, "/status/catalogue/endpoints/"+endpointID, &endpoint)
+	if errors.Is(err, errNotFound) {
+		return nil, ErrEndpointNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("endpoint: %w", err)
+	}
+	if len(endpoint.Nodes) == 0 {
+		return nil, ErrEndpointNotFound
+	}
+
+	var clusterNodes []resolverNode
+	if err := r.request(ctx, "/status/cluster/nodes", &clusterNodes); err != nil {
+		return nil, fmt.Errorf("nodes: %w", err)
+	}
+
+	var nodes []Node
+	for _, n := range clusterNodes {
+		// Only return nodes that are active, since unreachable and left
+		// nodes may not accept connections.
+		if n.Status != "active" || n.ProxyAddr == "" {
+			continue
+		}
+		nodes = append(nodes, Node{
+			ID:        n.ID,
+			ProxyAddr: n.ProxyAddr,
+			Upstreams: endpoint.Nodes[n.ID],
+		})
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no healthy nodes")
+	}
+	return nodes, nil
+}
+
+func (r *Resolver) request(ctx context.Context, path string, v interface{}) error {
+	u := r.adminURL.JoinPath(path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request: bad status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// orderNodes returns a copy of the nodes ordered to connect to, where nodes
+// with upstreams come first weighted randomly by their number of upstreams,
+// then nodes without upstreams in a random order.
+func orderNodes(nodes []Node) []Node {
+	type weighted struct {
+		node  Node
+		score float64
+	}
+	candidates := make([]weighted, 0, len(nodes))
+	for _, node := range nodes {
+		// Weighted random ordering using an exponential score, where a
+		// node with N upstreams is N times as likely to be first as a node
+		// with one upstream.
+		score := rand.ExpFloat64()
+		if node.Upstreams > 0 {
+			score /= float64(node.Upstreams)
+		}
+		candidates = append(candidates, weighted{node: node, score: score})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		hasI := candidates[i].node.Upstreams > 0
+		hasJ := candidates[j].node.Upstreams > 0
+		if hasI != hasJ {
+			return hasI
+		}
+		return candidates[i].score < candidates[j].score
+	})
+
+	ordered := make([]Node, 0, len(candidates))
+	for _, c := range candidates {
+		ordered = append(ordered, c.node)
+	}
+	return ordered
+}
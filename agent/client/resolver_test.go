@@ -0,0 +1,196 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gorillaws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAdminServer serves the status API routes used by the resolver.
+func fakeAdminServer(
+	t *testing.T,
+	nodes []resolverNode,
+	endpoints map[string]map[string]int,
+) (*httptest.Server, *int) {
+	requests := 0
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+
+			if r.URL.Path == "/status/cluster/nodes" {
+				assert.NoError(t, json.NewEncoder(w).Encode(nodes))
+				return
+			}
+
+			endpointID := strings.TrimPrefix(r.URL.Path, "/status/catalogue/endpoints/")
+			endpointNodes, ok := endpoints[endpointID]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			assert.NoError(t, json.NewEncoder(w).Encode(resolverEndpoint{
+				Nodes: endpointNodes,
+			}))
+		},
+	)), &requests
+}
+
+func TestResolver(t *testing.T) {
+	nodes := []resolverNode{
+		{ID: "node-1", Status: "active", ProxyAddr: "10.26.104.1:8000"},
+		{ID: "node-2", Status: "active", ProxyAddr: "10.26.104.2:8000"},
+		{ID: "node-3", Status: "unreachable", ProxyAddr: "10.26.104.3:8000"},
+		{ID: "node-4", Status: "active", ProxyAddr: "10.26.104.4:8000"},
+	}
+	endpoints := map[string]map[string]int{
+		"my-endpoint": {"node-2": 2, "node-3": 1},
+	}
+
+	t.Run("resolve", func(t *testing.T) {
+		server, _ := fakeAdminServer(t, nodes, endpoints)
+		defer server.Close()
+
+		resolver, err := NewResolver(server.URL)
+		require.NoError(t, err)
+
+		resolved, err := resolver.Resolve(context.TODO(), "my-endpoint")
+		require.NoError(t, err)
+
+		// The node with upstreams must be first, and the unreachable node
+		// excluded.
+		require.Len(t, resolved, 3)
+		assert.Equal(t, Node{
+			ID:        "node-2",
+			ProxyAddr: "10.26.104.2:8000",
+			Upstreams: 2,
+		}, resolved[0])
+		assert.ElementsMatch(t, []string{"node-1", "node-4"}, []string{
+			resolved[1].ID, resolved[2].ID,
+		})
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		server, requests := fakeAdminServer(t, nodes, endpoints)
+		defer server.Close()
+
+		resolver, err := NewResolver(server.URL)
+		require.NoError(t, err)
+
+		_, err = resolver.Resolve(context.TODO(), "my-endpoint")
+		require.NoError(t, err)
+		_, err = resolver.Resolve(context.TODO(), "my-endpoint")
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, *requests)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		server, _ := fakeAdminServer(t, nodes, endpoints)
+		defer server.Close()
+
+		resolver, err := NewResolver(server.URL)
+		require.NoError(t, err)
+
+		_, err = resolver.Resolve(context.TODO(), "unknown")
+		assert.ErrorIs(t, err, ErrEndpointNotFound)
+	})
+
+	t.Run("invalid url", func(t *testing.T) {
+		_, err := NewResolver("ws://localhost:8002")
+		assert.ErrorContains(t, err, "unsupported scheme")
+	})
+}
+
+func TestOrderNodes(t *testing.T) {
+	nodes := []Node{
+		{ID: "node-1", Upstreams: 1},
+		{ID: "node-2", Upstreams: 0},
+		{ID: "node-3", Upstreams: 3},
+	}
+
+	first := make(map[string]int)
+	for i := 0; i != 1000; i++ {
+		ordered := orderNodes(nodes)
+		require.Len(t, ordered, 3)
+		// Nodes without upstreams must be last.
+		assert.Equal(t, "node-2", ordered[2].ID)
+		first[ordered[0].ID]++
+	}
+
+	// node-3 has 3 of the 4 upstreams so expect it to be first ~750 times.
+	assert.Greater(t, first["node-3"], 600)
+	assert.Less(t, first["node-3"], 900)
+}
+
+func TestClient_DialResolver(t *testing.T) {
+	// Accept dialed connections to the upstream.
+	upgrader := &gorillaws.Upgrader{}
+	proxyServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/_piko/v1/tcp/my-endpoint", r.URL.Path)
+			conn, err := upgrader.Upgrade(w, r, nil)
+			require.NoError(t, err)
+			conn.Close()
+		},
+	))
+	defer proxyServer.Close()
+	proxyAddr := proxyServer.Listener.Addr().String()
+
+	// Reserve an address with nothing listening.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachableAddr := ln.Addr().String()
+	ln.Close()
+
+	t.Run("resolved", func(t *testing.T) {
+		adminServer, _ := fakeAdminServer(t, []resolverNode{
+			{ID: "node-1", Status: "active", ProxyAddr: proxyAddr},
+		}, map[string]map[string]int{
+			"my-endpoint": {"node-1": 1},
+		})
+		defer adminServer.Close()
+
+		resolver, err := NewResolver(adminServer.URL)
+		require.NoError(t, err)
+
+		// The proxy URL is unreachable so the client must dial the
+		// resolved node.
+		client := New(
+			WithProxyURL("http://"+unreachableAddr),
+			WithResolver(resolver),
+		)
+		conn, err := client.Dial(context.TODO(), "my-endpoint")
+		require.NoError(t, err)
+		conn.Close()
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		adminServer, _ := fakeAdminServer(t, []resolverNode{
+			{ID: "node-1", Status: "active", ProxyAddr: unreachableAddr},
+		}, map[string]map[string]int{
+			"my-endpoint": {"node-1": 1},
+		})
+		defer adminServer.Close()
+
+		resolver, err := NewResolver(adminServer.URL)
+		require.NoError(t, err)
+
+		// The resolved node is unreachable so the client must fall back to
+		// the proxy URL.
+		client := New(
+			WithProxyURL(proxyServer.URL),
+			WithResolver(resolver),
+		)
+		conn, err := client.Dial(context.TODO(), "my-endpoint")
+		require.NoError(t, err)
+		conn.Close()
+	})
+}
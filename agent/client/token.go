@@ -0,0 +1,69 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenFilePollInterval is the interval to check the token file for
+	// changes.
+	tokenFilePollInterval = time.Second * 10
+)
+
+// tokenFile loads the token to authenticate the client from a file.
+//
+// The file is re-read when its modification time or size changes, so the
+// token can be rotated without restarting the client, such as a Kubernetes
+// projected service account token.
+type tokenFile struct {
+	path string
+
+	// pollInterval is the interval to check the file for changes.
+	pollInterval time.Duration
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+func newTokenFile(path string) *tokenFile {
+	return &tokenFile{
+		path:         path,
+		pollInterval: tokenFilePollInterval,
+	}
+}
+
+// Token returns the current token in the file.
+func (f *tokenFile) Token() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Note stat follows symlinks, so detects Kubernetes updating the mounted
+	// volume by swapping the '..data' symlink.
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", fmt.Errorf("stat: %s: %w", f.path, err)
+	}
+	if f.token != "" && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.token, nil
+	}
+
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("read: %s: %w", f.path, err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("read: %s: empty token", f.path)
+	}
+
+	f.token = token
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return token, nil
+}
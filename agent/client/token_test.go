@@ -0,0 +1,76 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenFile(t *testing.T) {
+	t.Run("reload", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(path, []byte("token-1\n"), 0o600))
+
+		f := newTokenFile(path)
+
+		token, err := f.Token()
+		require.NoError(t, err)
+		assert.Equal(t, "token-1", token)
+
+		require.NoError(t, os.WriteFile(path, []byte("token-2\n"), 0o600))
+		// Ensure the modification time changes.
+		modTime := time.Now().Add(time.Second)
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+
+		token, err = f.Token()
+		require.NoError(t, err)
+		assert.Equal(t, "token-2", token)
+	})
+
+	// Tests loading the token when the mounted volume is updated by swapping
+	// a symlink, as Kubernetes does for projected tokens.
+	t.Run("symlink", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(
+			filepath.Join(dir, "token-1"), []byte("token-1"), 0o600,
+		))
+		require.NoError(t, os.WriteFile(
+			filepath.Join(dir, "token-2"), []byte("token-2"), 0o600,
+		))
+
+		path := filepath.Join(dir, "token")
+		require.NoError(t, os.Symlink(filepath.Join(dir, "token-1"), path))
+
+		f := newTokenFile(path)
+
+		token, err := f.Token()
+		require.NoError(t, err)
+		assert.Equal(t, "token-1", token)
+
+		require.NoError(t, os.Remove(path))
+		require.NoError(t, os.Symlink(filepath.Join(dir, "token-2"), path))
+		modTime := time.Now().Add(time.Second)
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+
+		token, err = f.Token()
+		require.NoError(t, err)
+		assert.Equal(t, "token-2", token)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(path, []byte("\n"), 0o600))
+
+		_, err := newTokenFile(path).Token()
+		assert.Error(t, err)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := newTokenFile(filepath.Join(t.TempDir(), "token")).Token()
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	pikoconfig "github.com/andydunstall/piko/pkg/config"
+)
+
+// Check fully validates the configuration without starting the agent, such
+// as to verify a configuration in CI before deploying.
+//
+// As well as Validate, this loads the TLS root CAs and token file, and checks
+// the server bind address and each listener and forward address can be
+// resolved. If
+// Validate fails only the validation error is returned, otherwise all issues
+// found are returned.
+func (c *Config) Check() []pikoconfig.Issue {
+	if err := c.Validate(); err != nil {
+		return []pikoconfig.Issue{{Message: err.Error()}}
+	}
+
+	var issues []pikoconfig.Issue
+	addIssue := func(field string, err error) {
+		if err != nil {
+			issues = append(issues, pikoconfig.Issue{
+				Field:   field,
+				Message: err.Error(),
+			})
+		}
+	}
+
+	for i, listener := range c.Listeners {
+		field := fmt.Sprintf("listeners[%d].addr", i)
+		if listener.Protocol == ListenerProtocolTCP {
+			host, _ := listener.Host()
+			addIssue(field, pikoconfig.CheckAddr(host))
+			continue
+		}
+
+		u, _ := listener.URL()
+		addIssue(field, pikoconfig.CheckAddr(urlHost(u)))
+	}
+
+	for i, forward := range c.Forwards {
+		host, _ := forward.Host()
+		addIssue(fmt.Sprintf("forwards[%d].addr", i), pikoconfig.CheckAddr(host))
+	}
+
+	// Validate already checked the URL parses.
+	u, _ := url.Parse(c.Connect.URL)
+	addIssue("connect.url", pikoconfig.CheckAddr(urlHost(u)))
+
+	if c.Connect.ProxyURL != "" {
+		u, _ := url.Parse(c.Connect.ProxyURL)
+		addIssue("connect.proxy_url", pikoconfig.CheckAddr(urlHost(u)))
+	}
+
+	_, err := c.Connect.TLS.Load()
+	addIssue("connect.tls", err)
+
+	if c.Connect.TokenFile != "" {
+		b, err := os.ReadFile(c.Connect.TokenFile)
+		if err == nil && strings.TrimSpace(string(b)) == "" {
+			err = fmt.Errorf("empty token: %s", c.Connect.TokenFile)
+		}
+		addIssue("connect.token_file", err)
+	}
+
+	addIssue("server.bind_addr", pikoconfig.CheckAddr(c.Server.BindAddr))
+
+	return issues
+}
+
+// urlHost returns the 'host:port' address of the given URL, using the
+// default port for the scheme if the URL doesn't include a port.
+func urlHost(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return u.Host + ":" + u.Scheme
+}
@@ -12,7 +12,10 @@ import (
 
 	"github.com/spf13/pflag"
 
+	forwardconfig "github.com/andydunstall/piko/forward/config"
+	"github.com/andydunstall/piko/pkg/keepalive"
 	"github.com/andydunstall/piko/pkg/log"
+	pikoruntime "github.com/andydunstall/piko/pkg/runtime"
 )
 
 type ListenerProtocol string
@@ -22,6 +25,62 @@ const (
 	ListenerProtocolTCP  ListenerProtocol = "tcp"
 )
 
+// HTTPVersion is the HTTP version used to forward requests to the upstream.
+type HTTPVersion string
+
+const (
+	// HTTPVersionAuto uses HTTP/2 when the upstream supports it over TLS,
+	// otherwise HTTP/1.1.
+	HTTPVersionAuto HTTPVersion = "auto"
+	// HTTPVersionHTTP1 always uses HTTP/1.1.
+	HTTPVersionHTTP1 HTTPVersion = "http1"
+	// HTTPVersionHTTP2 always uses HTTP/2, including cleartext HTTP/2
+	// (h2c) for 'http' upstreams.
+	HTTPVersionHTTP2 HTTPVersion = "h2"
+)
+
+// TransportConfig configures the connections used to forward requests from
+// a HTTP listener to the upstream.
+type TransportConfig struct {
+	// HTTPVersion is the HTTP version to forward requests with. Defaults to
+	// "auto".
+	HTTPVersion HTTPVersion `json:"http_version" yaml:"http_version"`
+
+	// MaxConnsPerHost is the maximum number of connections to the upstream,
+	// including connections in use and idle connections. Requests wait for a
+	// connection once the limit is reached. If zero there is no limit.
+	//
+	// Only applies to HTTP/1.1 and HTTP/2 negotiated with "auto", since
+	// "h2" multiplexes requests over as few connections as possible.
+	MaxConnsPerHost int `json:"max_conns_per_host" yaml:"max_conns_per_host"`
+
+	// MaxIdleConnsPerHost is the maximum number of idle connections to keep
+	// open to the upstream. If zero defaults to 2.
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host" yaml:"max_idle_conns_per_host"`
+
+	// IdleConnTimeout is the duration to keep an idle connection to the
+	// upstream open before closing it. If zero defaults to 90 seconds.
+	IdleConnTimeout time.Duration `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
+}
+
+func (c *TransportConfig) Validate() error {
+	switch c.HTTPVersion {
+	case "", HTTPVersionAuto, HTTPVersionHTTP1, HTTPVersionHTTP2:
+	default:
+		return fmt.Errorf("unsupported http version: %s", c.HTTPVersion)
+	}
+	if c.MaxConnsPerHost < 0 {
+		return fmt.Errorf("max conns per host cannot be negative")
+	}
+	if c.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("max idle conns per host cannot be negative")
+	}
+	if c.IdleConnTimeout < 0 {
+		return fmt.Errorf("idle conn timeout cannot be negative")
+	}
+	return nil
+}
+
 type ListenerConfig struct {
 	// EndpointID is the endpoint ID to register.
 	EndpointID string `json:"endpoint_id" yaml:"endpoint_id"`
@@ -39,6 +98,15 @@ type ListenerConfig struct {
 
 	// Timeout is the timeout to forward incoming requests to the upstream.
 	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+
+	// RegisterTimeout is the deadline to register the listener with the
+	// Piko server on boot, including retries. If zero defaults to the
+	// connect timeout.
+	RegisterTimeout time.Duration `json:"register_timeout" yaml:"register_timeout"`
+
+	// Transport configures the connections to the upstream. Only supported
+	// by HTTP listeners.
+	Transport TransportConfig `json:"transport" yaml:"transport"`
 }
 
 // Host parses the given upstream address into a host and port. Return false if
@@ -93,6 +161,15 @@ func (c *ListenerConfig) URL() (*url.URL, bool) {
 	return nil, false
 }
 
+// RegistrationTimeout returns the deadline to register the listener, given
+// the connect timeout used if the listener doesn't override it.
+func (c *ListenerConfig) RegistrationTimeout(connectTimeout time.Duration) time.Duration {
+	if c.RegisterTimeout != 0 {
+		return c.RegisterTimeout
+	}
+	return connectTimeout
+}
+
 func (c *ListenerConfig) Validate() error {
 	if c.EndpointID == "" {
 		return fmt.Errorf("missing endpoint id")
@@ -104,7 +181,7 @@ func (c *ListenerConfig) Validate() error {
 		if _, ok := c.URL(); !ok {
 			return fmt.Errorf("invalid addr")
 		}
-	} else if c.Protocol != ListenerProtocolTCP {
+	} else if c.Protocol == ListenerProtocolTCP {
 		if _, ok := c.Host(); !ok {
 			return fmt.Errorf("invalid addr")
 		}
@@ -114,6 +191,12 @@ func (c *ListenerConfig) Validate() error {
 	if c.Timeout == 0 {
 		return fmt.Errorf("missing timeout")
 	}
+	if c.RegisterTimeout < 0 {
+		return fmt.Errorf("register timeout cannot be negative")
+	}
+	if err := c.Transport.Validate(); err != nil {
+		return fmt.Errorf("transport: %w", err)
+	}
 	return nil
 }
 
@@ -167,10 +250,43 @@ type ConnectConfig struct {
 	// Token is a token to authenticate with the Piko server.
 	Token string
 
-	// Timeout is the timeout attempting to connect to the Piko server on
-	// boot.
+	// TokenFile is a path to a file containing the token to authenticate
+	// with the Piko server. The file is reloaded when it changes.
+	TokenFile string `json:"token_file" yaml:"token_file"`
+
+	// Timeout is the deadline to register each listener with the Piko
+	// server on boot, including retries. Can be overridden per listener.
 	Timeout time.Duration `json:"timeout" yaml:"timeout"`
 
+	// DialTimeout is the timeout to open a TCP connection to the Piko
+	// server. Attempts that time out are retried until the registration
+	// deadline.
+	DialTimeout time.Duration `json:"dial_timeout" yaml:"dial_timeout"`
+
+	// HandshakeTimeout is the timeout to complete the WebSocket handshake
+	// with the Piko server, including opening the TCP connection. Attempts
+	// that time out are retried until the registration deadline.
+	HandshakeTimeout time.Duration `json:"handshake_timeout" yaml:"handshake_timeout"`
+
+	// Keepalive configures pings to detect dead connections to the server.
+	Keepalive keepalive.Config `json:"keepalive" yaml:"keepalive"`
+
+	// MaxStreams is the maximum number of concurrent connections each
+	// listener accepts from the server. If zero there is no limit.
+	MaxStreams int `json:"max_streams" yaml:"max_streams"`
+
+	// Multiplex indicates whether listeners share a single connection to the
+	// server, rather than each listener opening its own connection.
+	Multiplex bool `json:"multiplex" yaml:"multiplex"`
+
+	// ProxyURL is the Piko server proxy URL to forward connections from
+	// local ports to. Only required when forwarding ports.
+	ProxyURL string `json:"proxy_url" yaml:"proxy_url"`
+
+	// ProxyToken is a token to authenticate forwarded connections with the
+	// Piko server.
+	ProxyToken string `json:"proxy_token" yaml:"proxy_token"`
+
 	TLS TLSConfig `json:"tls" yaml:"tls"`
 }
 
@@ -181,9 +297,29 @@ func (c *ConnectConfig) Validate() error {
 	if _, err := url.Parse(c.URL); err != nil {
 		return fmt.Errorf("invalid url: %w", err)
 	}
+	if c.Token != "" && c.TokenFile != "" {
+		return fmt.Errorf("token and token file cannot both be set")
+	}
 	if c.Timeout == 0 {
 		return fmt.Errorf("missing timeout")
 	}
+	if c.DialTimeout < 0 {
+		return fmt.Errorf("dial timeout cannot be negative")
+	}
+	if c.HandshakeTimeout < 0 {
+		return fmt.Errorf("handshake timeout cannot be negative")
+	}
+	if err := c.Keepalive.Validate(); err != nil {
+		return fmt.Errorf("keepalive: %w", err)
+	}
+	if c.MaxStreams < 0 {
+		return fmt.Errorf("max streams cannot be negative")
+	}
+	if c.ProxyURL != "" {
+		if _, err := url.Parse(c.ProxyURL); err != nil {
+			return fmt.Errorf("invalid proxy url: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -205,14 +341,100 @@ Piko server 'upstream' port.`,
 Token is a token to authenticate with the Piko server.`,
 	)
 
+	fs.StringVar(
+		&c.TokenFile,
+		"connect.token-file",
+		c.TokenFile,
+		`
+A path to a file containing the token to authenticate with the Piko server,
+as an alternative to '--connect.token'.
+
+The file is checked for changes and the token reloaded, such as a Kubernetes
+projected service account token that is rotated. When the token changes, the
+agent reconnects to the server with the new token before closing its existing
+connections, so it re-authenticates before the previous token expires.`,
+	)
+
 	fs.DurationVar(
 		&c.Timeout,
 		"connect.timeout",
 		c.Timeout,
 		`
-Timeout attempting to connect to the Piko server on boot. Note if the agent
-is disconnected after the initial connection succeeds it will keep trying to
-reconnect.`,
+Deadline to register each listener with the Piko server on boot, including
+retries. Note if the agent is disconnected after the initial connection
+succeeds it will keep trying to reconnect.
+
+Can be overridden per listener with 'register_timeout'.`,
+	)
+
+	fs.DurationVar(
+		&c.DialTimeout,
+		"connect.dial-timeout",
+		c.DialTimeout,
+		`
+Timeout opening a TCP connection to the Piko server. Attempts that time out
+are retried with backoff.`,
+	)
+
+	fs.DurationVar(
+		&c.HandshakeTimeout,
+		"connect.handshake-timeout",
+		c.HandshakeTimeout,
+		`
+Timeout completing the WebSocket handshake with the Piko server, including
+opening the TCP connection and the TLS handshake. Attempts that time out are
+retried with backoff.`,
+	)
+
+	c.Keepalive.RegisterFlags(fs, "connect")
+
+	fs.IntVar(
+		&c.MaxStreams,
+		"connect.max-streams",
+		c.MaxStreams,
+		`
+Maximum number of concurrent connections each listener accepts from the
+server.
+
+The limit is sent to the server when the listener connects, so once the limit
+is reached the server spills over requests to other upstreams for the
+endpoint. This protects the agent from being overwhelmed when it's the only
+upstream for an endpoint connected to a node.
+
+Set to 0 to disable.`,
+	)
+
+	fs.BoolVar(
+		&c.Multiplex,
+		"connect.multiplex",
+		c.Multiplex,
+		`
+Whether listeners share a single connection to the server, rather than each
+listener opening its own connection.
+
+This reduces the number of connections when the agent registers many
+endpoints. Requires all Piko server nodes to support multiplexed connections.`,
+	)
+
+	fs.StringVar(
+		&c.ProxyURL,
+		"connect.proxy-url",
+		c.ProxyURL,
+		`
+The Piko server URL to forward connections from local ports to. Note this
+must be configured to use the Piko server 'proxy' port.
+
+Only required when forwarding ports. This may be a different Piko cluster to
+the cluster listeners connect to, such as to link two sites.`,
+	)
+
+	fs.StringVar(
+		&c.ProxyToken,
+		"connect.proxy-token",
+		c.ProxyToken,
+		`
+Token is a proxy token to authenticate forwarded connections with the Piko
+server, which is required when the server authenticates proxy requests.`,
 	)
 
 	c.TLS.RegisterFlags(fs, "connect")
@@ -243,13 +465,144 @@ If the host is unspecified it defaults to all listeners, such as
 	)
 }
 
+// ProvenanceConfig configures signing responses, so the Piko server can
+// verify responses were sent by an agent for the endpoint.
+type ProvenanceConfig struct {
+	// Key is the path of the PEM encoded Ed25519 private key used to sign
+	// responses. If empty, responses aren't signed.
+	Key string `json:"key" yaml:"key"`
+}
+
+func (c *ProvenanceConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.Key,
+		"provenance.key",
+		c.Key,
+		`
+Path to a PEM encoded Ed25519 private key used to sign HTTP responses, so
+the Piko server can verify responses were sent by an agent for the endpoint
+rather than injected by another node.
+
+The server must be configured with the matching public key for each
+endpoint in 'proxy.provenance.endpoints'. Generate a key with
+'openssl genpkey -algorithm ed25519 -out agent.key', and the public key
+with 'openssl pkey -in agent.key -pubout -out agent.pub'.
+
+If not set, responses aren't signed.`,
+	)
+}
+
+// DockerConfig configures discovering listeners from the labels of
+// containers running on the local Docker daemon.
+type DockerConfig struct {
+	// Enabled indicates whether to discover listeners from Docker containers.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// Host is the address of the Docker daemon.
+	Host string `json:"host" yaml:"host"`
+
+	// Network is the Docker network used to connect to containers. If empty
+	// the first network the container is attached to is used.
+	Network string `json:"network" yaml:"network"`
+
+	// AccessLog indicates whether to log all incoming connections and requests
+	// for discovered listeners.
+	AccessLog bool `json:"access_log" yaml:"access_log"`
+
+	// Timeout is the timeout to forward incoming requests to discovered
+	// containers.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func (c *DockerConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if _, err := url.Parse(c.Host); err != nil {
+		return fmt.Errorf("invalid host: %w", err)
+	}
+	if c.Timeout == 0 {
+		return fmt.Errorf("missing timeout")
+	}
+	return nil
+}
+
+func (c *DockerConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(
+		&c.Enabled,
+		"docker.enabled",
+		c.Enabled,
+		`
+Whether to discover listeners from containers running on the local Docker
+daemon.
+
+When enabled, the agent watches for containers with labels 'piko.endpoint'
+and 'piko.port', and registers a listener for each container that forwards
+to the containers port. An optional 'piko.protocol' label may be used to
+select the listener protocol ('http' or 'tcp'), which defaults to 'http'.
+
+Listeners are removed when their containers stop.`,
+	)
+
+	fs.StringVar(
+		&c.Host,
+		"docker.host",
+		c.Host,
+		`
+Address of the Docker daemon. This may be a unix socket, such as
+'unix:///var/run/docker.sock', or a TCP address, such as
+'tcp://localhost:2375'.`,
+	)
+
+	fs.StringVar(
+		&c.Network,
+		"docker.network",
+		c.Network,
+		`
+Docker network to use when connecting to discovered containers.
+
+If empty the first network the container is attached to is used.`,
+	)
+
+	fs.BoolVar(
+		&c.AccessLog,
+		"docker.access-log",
+		c.AccessLog,
+		`
+Whether to log all incoming connections and requests for discovered
+listeners.`,
+	)
+
+	fs.DurationVar(
+		&c.Timeout,
+		"docker.timeout",
+		c.Timeout,
+		`
+Timeout forwarding incoming requests to discovered containers.`,
+	)
+}
+
 type Config struct {
 	Listeners []ListenerConfig `json:"listeners" yaml:"listeners"`
 
+	// Forwards contains local ports that forward connections to an
+	// endpoint, such as an endpoint registered by an agent at another site,
+	// the reverse of listeners.
+	Forwards []forwardconfig.PortConfig `json:"forwards" yaml:"forwards"`
+
 	Connect ConnectConfig `json:"connect" yaml:"connect"`
 
 	Server ServerConfig `json:"server" yaml:"server"`
 
+	Docker DockerConfig `json:"docker" yaml:"docker"`
+
+	Provenance ProvenanceConfig `json:"provenance" yaml:"provenance"`
+
+	Runtime pikoruntime.Config `json:"runtime" yaml:"runtime"`
+
 	Log log.Config `json:"log" yaml:"log"`
 
 	// GracePeriod is the duration to gracefully shutdown the agent. During
@@ -261,14 +614,28 @@ type Config struct {
 func Default() *Config {
 	return &Config{
 		Connect: ConnectConfig{
-			URL:     "http://localhost:8001",
-			Timeout: time.Second * 30,
+			URL:              "http://localhost:8001",
+			Timeout:          time.Second * 30,
+			DialTimeout:      time.Second * 10,
+			HandshakeTimeout: time.Second * 30,
+			Keepalive: keepalive.Config{
+				Interval:  time.Second * 10,
+				MaxMissed: 3,
+			},
 		},
 		Server: ServerConfig{
 			BindAddr: ":5000",
 		},
+		Docker: DockerConfig{
+			Host:      "unix:///var/run/docker.sock",
+			AccessLog: true,
+			Timeout:   time.Second * 10,
+		},
 		Log: log.Config{
 			Level: "info",
+			Sampling: log.SamplingConfig{
+				Interval: time.Minute,
+			},
 		},
 		GracePeriod: time.Minute,
 	}
@@ -286,14 +653,34 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	for _, e := range c.Forwards {
+		if err := e.Validate(); err != nil {
+			if e.EndpointID != "" {
+				return fmt.Errorf("forward: %s: %w", e.EndpointID, err)
+			}
+			return fmt.Errorf("forward: %w", err)
+		}
+	}
+
 	if err := c.Connect.Validate(); err != nil {
 		return fmt.Errorf("connect: %w", err)
 	}
+	if len(c.Forwards) > 0 && c.Connect.ProxyURL == "" {
+		return fmt.Errorf("connect: missing proxy url")
+	}
 
 	if err := c.Server.Validate(); err != nil {
 		return fmt.Errorf("server: %w", err)
 	}
 
+	if err := c.Docker.Validate(); err != nil {
+		return fmt.Errorf("docker: %w", err)
+	}
+
+	if err := c.Runtime.Validate(); err != nil {
+		return fmt.Errorf("runtime: %w", err)
+	}
+
 	if err := c.Log.Validate(); err != nil {
 		return fmt.Errorf("log: %w", err)
 	}
@@ -308,6 +695,9 @@ func (c *Config) Validate() error {
 func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
 	c.Connect.RegisterFlags(fs)
 	c.Server.RegisterFlags(fs)
+	c.Docker.RegisterFlags(fs)
+	c.Provenance.RegisterFlags(fs)
+	c.Runtime.RegisterFlags(fs)
 	c.Log.RegisterFlags(fs)
 
 	fs.DurationVar(
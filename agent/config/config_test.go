@@ -2,9 +2,14 @@ package config
 
 import (
 	"net/url"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	forwardconfig "github.com/andydunstall/piko/forward/config"
 )
 
 // Tests the default configuration is valid.
@@ -59,3 +64,161 @@ func TestListenerConfig_URL(t *testing.T) {
 		})
 	}
 }
+
+func TestListenerConfig_Validate(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		conf := &ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       "localhost:5432",
+			Protocol:   ListenerProtocolTCP,
+			Timeout:    time.Second,
+		}
+		assert.NoError(t, conf.Validate())
+	})
+
+	t.Run("unsupported protocol", func(t *testing.T) {
+		conf := &ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       "localhost:5432",
+			Protocol:   "udp",
+			Timeout:    time.Second,
+		}
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("transport", func(t *testing.T) {
+		conf := &ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       "localhost:3000",
+			Protocol:   ListenerProtocolHTTP,
+			Timeout:    time.Second,
+			Transport: TransportConfig{
+				HTTPVersion:     HTTPVersionHTTP2,
+				MaxConnsPerHost: 10,
+			},
+		}
+		assert.NoError(t, conf.Validate())
+
+		conf.Transport.HTTPVersion = "h3"
+		assert.EqualError(t, conf.Validate(), "transport: unsupported http version: h3")
+
+		conf.Transport.HTTPVersion = HTTPVersionHTTP1
+		conf.Transport.MaxConnsPerHost = -1
+		assert.EqualError(t, conf.Validate(), "transport: max conns per host cannot be negative")
+	})
+}
+
+func TestConnectConfig_Validate(t *testing.T) {
+	t.Run("token file", func(t *testing.T) {
+		conf := Default().Connect
+		conf.TokenFile = "/var/run/secrets/piko/token"
+		assert.NoError(t, conf.Validate())
+	})
+
+	t.Run("token and token file", func(t *testing.T) {
+		conf := Default().Connect
+		conf.Token = "my-token"
+		conf.TokenFile = "/var/run/secrets/piko/token"
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("negative dial timeout", func(t *testing.T) {
+		conf := Default().Connect
+		conf.DialTimeout = -time.Second
+		assert.EqualError(t, conf.Validate(), "dial timeout cannot be negative")
+	})
+
+	t.Run("negative handshake timeout", func(t *testing.T) {
+		conf := Default().Connect
+		conf.HandshakeTimeout = -time.Second
+		assert.EqualError(t, conf.Validate(), "handshake timeout cannot be negative")
+	})
+}
+
+func TestListenerConfig_RegistrationTimeout(t *testing.T) {
+	conf := &ListenerConfig{}
+	assert.Equal(t, time.Second*30, conf.RegistrationTimeout(time.Second*30))
+
+	conf.RegisterTimeout = time.Minute
+	assert.Equal(t, time.Minute, conf.RegistrationTimeout(time.Second*30))
+}
+
+func TestConfig_Forwards(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		conf := Default()
+		conf.Forwards = []forwardconfig.PortConfig{
+			{Addr: "6000", EndpointID: "remote-endpoint"},
+		}
+		conf.Connect.ProxyURL = "http://remote-site:8000"
+		assert.NoError(t, conf.Validate())
+	})
+
+	t.Run("missing proxy url", func(t *testing.T) {
+		conf := Default()
+		conf.Forwards = []forwardconfig.PortConfig{
+			{Addr: "6000", EndpointID: "remote-endpoint"},
+		}
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("invalid addr", func(t *testing.T) {
+		conf := Default()
+		conf.Forwards = []forwardconfig.PortConfig{
+			{Addr: "invalid", EndpointID: "remote-endpoint"},
+		}
+		conf.Connect.ProxyURL = "http://remote-site:8000"
+		assert.Error(t, conf.Validate())
+	})
+}
+
+func TestDockerConfig_Validate(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		conf := &DockerConfig{}
+		assert.NoError(t, conf.Validate())
+	})
+
+	t.Run("missing host", func(t *testing.T) {
+		conf := &DockerConfig{
+			Enabled: true,
+			Timeout: time.Second,
+		}
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		conf := &DockerConfig{
+			Enabled: true,
+			Host:    "unix:///var/run/docker.sock",
+			Timeout: time.Second,
+		}
+		assert.NoError(t, conf.Validate())
+	})
+}
+
+func TestConfig_Check(t *testing.T) {
+	conf := Default()
+	conf.Listeners = []ListenerConfig{
+		{
+			EndpointID: "my-endpoint",
+			Addr:       "3000",
+			Protocol:   ListenerProtocolHTTP,
+			Timeout:    time.Second,
+		},
+	}
+	assert.Empty(t, conf.Check())
+
+	conf.Listeners = append(conf.Listeners, ListenerConfig{
+		EndpointID: "my-tcp-endpoint",
+		Addr:       "unknown.invalid:3000",
+		Protocol:   ListenerProtocolTCP,
+		Timeout:    time.Second,
+	})
+	conf.Connect.TokenFile = filepath.Join(t.TempDir(), "missing")
+	conf.Connect.TLS.RootCAs = filepath.Join(t.TempDir(), "missing.pem")
+
+	issues := conf.Check()
+	require.Len(t, issues, 3)
+	assert.Equal(t, "listeners[1].addr", issues[0].Field)
+	assert.Equal(t, "connect.tls", issues[1].Field)
+	assert.Equal(t, "connect.token_file", issues[2].Field)
+}
@@ -0,0 +1,169 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Container contains the fields of a Docker container used for discovery.
+type Container struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	State           string            `json:"State"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]Network `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// Network contains a container's address on a Docker network.
+type Network struct {
+	IPAddress string `json:"IPAddress"`
+}
+
+// Name returns the container name without the leading slash, or the ID if
+// the container has no name.
+func (c *Container) Name() string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// Event is a Docker daemon event.
+type Event struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID string `json:"ID"`
+	} `json:"Actor"`
+}
+
+// Client is a minimal client for the Docker Engine API, supporting only the
+// requests needed to discover containers.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+}
+
+// NewClient creates a client for the Docker daemon at the given host.
+//
+// The host may be either a unix socket such as 'unix:///var/run/docker.sock'
+// or a TCP address such as 'tcp://localhost:2375'.
+func NewClient(host string) (*Client, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host: %s: %w", host, err)
+	}
+
+	transport := &http.Transport{}
+	var baseURL string
+	switch u.Scheme {
+	case "unix":
+		socketPath := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+		// The host is ignored when dialing a unix socket.
+		baseURL = "http://docker"
+	case "tcp", "http":
+		baseURL = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported host scheme: %s", u.Scheme)
+	}
+
+	return &Client{
+		httpClient: &http.Client{
+			Transport: transport,
+		},
+		baseURL: baseURL,
+	}, nil
+}
+
+// ListContainers returns the running containers that have the given label.
+func (c *Client) ListContainers(ctx context.Context, label string) ([]Container, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	defer cancel()
+
+	filters, _ := json.Marshal(map[string][]string{
+		"label":  {label},
+		"status": {"running"},
+	})
+	path := "/containers/json?filters=" + url.QueryEscape(string(filters))
+
+	resp, err := c.get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var containers []Container
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return containers, nil
+}
+
+// Events streams container events until the context is cancelled or the
+// connection to the daemon is closed.
+//
+// onConnect is called once the event stream is connected, before any events
+// are received. May be nil.
+func (c *Client) Events(
+	ctx context.Context,
+	onConnect func(),
+	f func(e Event),
+) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type": {"container"},
+	})
+	path := "/events?filters=" + url.QueryEscape(string(filters))
+
+	resp, err := c.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if onConnect != nil {
+		onConnect()
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var e Event
+		if err := decoder.Decode(&e); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("event stream closed")
+			}
+			return fmt.Errorf("decode event: %w", err)
+		}
+		f(e)
+	}
+}
+
+func (c *Client) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, c.baseURL+path, nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("request: bad status: %d", resp.StatusCode)
+	}
+	return resp, nil
+}
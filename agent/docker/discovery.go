@@ -0,0 +1,270 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/backoff"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+const (
+	// EndpointLabel is the container label containing the endpoint ID to
+	// register.
+	EndpointLabel = "piko.endpoint"
+	// PortLabel is the container label containing the container port to
+	// forward to.
+	PortLabel = "piko.port"
+	// ProtocolLabel is an optional container label containing the listener
+	// protocol. Defaults to 'http'.
+	ProtocolLabel = "piko.protocol"
+
+	resyncInterval = time.Second * 30
+)
+
+// Manager manages the listeners for discovered containers.
+type Manager interface {
+	// AddListener adds a listener for the container with the given ID.
+	AddListener(containerID string, conf config.ListenerConfig) error
+
+	// RemoveListener removes the listener for the container with the given ID.
+	RemoveListener(containerID string)
+}
+
+// Discovery watches the local Docker daemon for containers labelled with
+// 'piko.endpoint' and 'piko.port', and adds a listener for each container
+// that forwards to the container port. When a container stops its listener
+// is removed.
+type Discovery struct {
+	client *Client
+
+	conf config.DockerConfig
+
+	manager Manager
+
+	// containers contains the listener config for each container with an
+	// active listener, keyed by container ID.
+	containers map[string]config.ListenerConfig
+
+	// mu protects the above fields.
+	mu sync.Mutex
+
+	logger log.Logger
+}
+
+func NewDiscovery(
+	conf config.DockerConfig,
+	manager Manager,
+	logger log.Logger,
+) (*Discovery, error) {
+	client, err := NewClient(conf.Host)
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	return &Discovery{
+		client:     client,
+		conf:       conf,
+		manager:    manager,
+		containers: make(map[string]config.ListenerConfig),
+		logger:     logger.WithSubsystem("docker"),
+	}, nil
+}
+
+// Run watches the Docker daemon until the context is cancelled.
+func (d *Discovery) Run(ctx context.Context) error {
+	d.logger.Info(
+		"starting docker discovery",
+		zap.String("host", d.conf.Host),
+	)
+
+	go d.resync(ctx)
+
+	backoff := backoff.New(0, time.Second, time.Second*30)
+	for {
+		// Sync before watching for events so we don't miss containers that
+		// were started while we were disconnected.
+		if err := d.Sync(ctx); err != nil {
+			d.logger.Warn("failed to sync containers", zap.Error(err))
+		}
+
+		// Reset the backoff once connected, so a stream that closes after
+		// being connected for a while reconnects quickly rather than
+		// waiting for the backoff of earlier failed attempts.
+		err := d.client.Events(ctx, backoff.Reset, func(e Event) {
+			switch e.Action {
+			case "start", "unpause", "die", "stop", "kill", "pause", "destroy":
+				d.logger.Debug(
+					"container event",
+					zap.String("container-id", e.Actor.ID),
+					zap.String("action", e.Action),
+				)
+				if err := d.Sync(ctx); err != nil {
+					d.logger.Warn("failed to sync containers", zap.Error(err))
+				}
+			}
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		d.logger.Warn("docker event stream closed; reconnecting", zap.Error(err))
+
+		if !backoff.Wait(ctx) {
+			return nil
+		}
+	}
+}
+
+// Sync lists the labelled containers and reconciles the active listeners,
+// adding listeners for new containers and removing listeners for containers
+// that have stopped.
+func (d *Discovery) Sync(ctx context.Context) error {
+	containers, err := d.client.ListContainers(ctx, EndpointLabel)
+	if err != nil {
+		return fmt.Errorf("list containers: %w", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	running := make(map[string]struct{})
+	for _, container := range containers {
+		conf, err := d.listenerConfig(container)
+		if err != nil {
+			d.logger.Warn(
+				"invalid container labels",
+				zap.String("container", container.Name()),
+				zap.Error(err),
+			)
+			continue
+		}
+		running[container.ID] = struct{}{}
+
+		existing, ok := d.containers[container.ID]
+		if ok && existing == conf {
+			continue
+		}
+		if ok {
+			// If the container config changed, replace the listener.
+			d.manager.RemoveListener(container.ID)
+			delete(d.containers, container.ID)
+		}
+
+		if err := d.manager.AddListener(container.ID, conf); err != nil {
+			d.logger.Warn(
+				"failed to add listener",
+				zap.String("container", container.Name()),
+				zap.String("endpoint-id", conf.EndpointID),
+				zap.Error(err),
+			)
+			continue
+		}
+		d.containers[container.ID] = conf
+
+		d.logger.Info(
+			"added container listener",
+			zap.String("container", container.Name()),
+			zap.String("endpoint-id", conf.EndpointID),
+			zap.String("addr", conf.Addr),
+		)
+	}
+
+	for id, conf := range d.containers {
+		if _, ok := running[id]; ok {
+			continue
+		}
+		d.manager.RemoveListener(id)
+		delete(d.containers, id)
+
+		d.logger.Info(
+			"removed container listener",
+			zap.String("container-id", id),
+			zap.String("endpoint-id", conf.EndpointID),
+		)
+	}
+
+	return nil
+}
+
+// resync periodically syncs the containers in case any events were missed.
+func (d *Discovery) resync(ctx context.Context) {
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.Sync(ctx); err != nil {
+				d.logger.Warn("failed to sync containers", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *Discovery) listenerConfig(container Container) (config.ListenerConfig, error) {
+	endpointID := container.Labels[EndpointLabel]
+	if endpointID == "" {
+		return config.ListenerConfig{}, fmt.Errorf("missing %s label", EndpointLabel)
+	}
+	port := container.Labels[PortLabel]
+	if port == "" {
+		return config.ListenerConfig{}, fmt.Errorf("missing %s label", PortLabel)
+	}
+
+	protocol := config.ListenerProtocol(container.Labels[ProtocolLabel])
+	if protocol == "" {
+		protocol = config.ListenerProtocolHTTP
+	}
+
+	ip, err := d.containerIP(container)
+	if err != nil {
+		return config.ListenerConfig{}, err
+	}
+
+	conf := config.ListenerConfig{
+		EndpointID: endpointID,
+		Addr:       net.JoinHostPort(ip, port),
+		Protocol:   protocol,
+		AccessLog:  d.conf.AccessLog,
+		Timeout:    d.conf.Timeout,
+	}
+	if err := conf.Validate(); err != nil {
+		return config.ListenerConfig{}, err
+	}
+	return conf, nil
+}
+
+// containerIP returns the IP address of the container on the configured
+// network. If no network is configured, uses the first network (ordered by
+// name) with an IP address.
+func (d *Discovery) containerIP(container Container) (string, error) {
+	networks := container.NetworkSettings.Networks
+	if d.conf.Network != "" {
+		network, ok := networks[d.conf.Network]
+		if !ok || network.IPAddress == "" {
+			return "", fmt.Errorf("container not attached to network: %s", d.conf.Network)
+		}
+		return network.IPAddress, nil
+	}
+
+	// Sort by network name so the selected network is deterministic.
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ip := networks[name].IPAddress; ip != "" {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("container has no ip address")
+}
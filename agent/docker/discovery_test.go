@@ -0,0 +1,267 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+type fakeManager struct {
+	listeners map[string]config.ListenerConfig
+	mu        sync.Mutex
+}
+
+func newFakeManager() *fakeManager {
+	return &fakeManager{
+		listeners: make(map[string]config.ListenerConfig),
+	}
+}
+
+func (m *fakeManager) AddListener(containerID string, conf config.ListenerConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.listeners[containerID] = conf
+	return nil
+}
+
+func (m *fakeManager) RemoveListener(containerID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.listeners, containerID)
+}
+
+func (m *fakeManager) Listeners() map[string]config.ListenerConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	listeners := make(map[string]config.ListenerConfig)
+	for id, conf := range m.listeners {
+		listeners[id] = conf
+	}
+	return listeners
+}
+
+type fakeDocker struct {
+	containers []Container
+	mu         sync.Mutex
+}
+
+func (d *fakeDocker) SetContainers(containers []Container) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.containers = containers
+}
+
+func (d *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/containers/json") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// nolint
+	json.NewEncoder(w).Encode(d.containers)
+}
+
+func newContainer(id string, labels map[string]string, ip string) Container {
+	c := Container{
+		ID:     id,
+		Names:  []string{"/" + id},
+		State:  "running",
+		Labels: labels,
+	}
+	c.NetworkSettings.Networks = map[string]Network{
+		"bridge": {IPAddress: ip},
+	}
+	return c
+}
+
+func TestDiscovery_Sync(t *testing.T) {
+	t.Run("add and remove containers", func(t *testing.T) {
+		docker := &fakeDocker{}
+		server := httptest.NewServer(docker)
+		defer server.Close()
+
+		manager := newFakeManager()
+		discovery, err := NewDiscovery(config.DockerConfig{
+			Enabled:   true,
+			Host:      "tcp://" + server.Listener.Addr().String(),
+			AccessLog: true,
+			Timeout:   time.Second,
+		}, manager, log.NewNopLogger())
+		require.NoError(t, err)
+
+		docker.SetContainers([]Container{
+			newContainer("c1", map[string]string{
+				EndpointLabel: "my-endpoint",
+				PortLabel:     "8080",
+			}, "172.17.0.2"),
+			newContainer("c2", map[string]string{
+				EndpointLabel: "my-tcp-endpoint",
+				PortLabel:     "5432",
+				ProtocolLabel: "tcp",
+			}, "172.17.0.3"),
+		})
+		assert.NoError(t, discovery.Sync(context.Background()))
+
+		assert.Equal(t, map[string]config.ListenerConfig{
+			"c1": {
+				EndpointID: "my-endpoint",
+				Addr:       "172.17.0.2:8080",
+				Protocol:   config.ListenerProtocolHTTP,
+				AccessLog:  true,
+				Timeout:    time.Second,
+			},
+			"c2": {
+				EndpointID: "my-tcp-endpoint",
+				Addr:       "172.17.0.3:5432",
+				Protocol:   config.ListenerProtocolTCP,
+				AccessLog:  true,
+				Timeout:    time.Second,
+			},
+		}, manager.Listeners())
+
+		// Stop c1 and update the port of c2.
+		docker.SetContainers([]Container{
+			newContainer("c2", map[string]string{
+				EndpointLabel: "my-tcp-endpoint",
+				PortLabel:     "5433",
+				ProtocolLabel: "tcp",
+			}, "172.17.0.3"),
+		})
+		assert.NoError(t, discovery.Sync(context.Background()))
+
+		assert.Equal(t, map[string]config.ListenerConfig{
+			"c2": {
+				EndpointID: "my-tcp-endpoint",
+				Addr:       "172.17.0.3:5433",
+				Protocol:   config.ListenerProtocolTCP,
+				AccessLog:  true,
+				Timeout:    time.Second,
+			},
+		}, manager.Listeners())
+	})
+
+	t.Run("invalid labels", func(t *testing.T) {
+		docker := &fakeDocker{}
+		server := httptest.NewServer(docker)
+		defer server.Close()
+
+		manager := newFakeManager()
+		discovery, err := NewDiscovery(config.DockerConfig{
+			Enabled: true,
+			Host:    "tcp://" + server.Listener.Addr().String(),
+			Timeout: time.Second,
+		}, manager, log.NewNopLogger())
+		require.NoError(t, err)
+
+		docker.SetContainers([]Container{
+			// Missing port.
+			newContainer("c1", map[string]string{
+				EndpointLabel: "my-endpoint",
+			}, "172.17.0.2"),
+			// Unsupported protocol.
+			newContainer("c2", map[string]string{
+				EndpointLabel: "my-endpoint",
+				PortLabel:     "8080",
+				ProtocolLabel: "udp",
+			}, "172.17.0.3"),
+			// Missing IP.
+			newContainer("c3", map[string]string{
+				EndpointLabel: "my-endpoint",
+				PortLabel:     "8080",
+			}, ""),
+		})
+		assert.NoError(t, discovery.Sync(context.Background()))
+
+		assert.Empty(t, manager.Listeners())
+	})
+
+	t.Run("network", func(t *testing.T) {
+		docker := &fakeDocker{}
+		server := httptest.NewServer(docker)
+		defer server.Close()
+
+		manager := newFakeManager()
+		discovery, err := NewDiscovery(config.DockerConfig{
+			Enabled: true,
+			Host:    "tcp://" + server.Listener.Addr().String(),
+			Network: "my-network",
+			Timeout: time.Second,
+		}, manager, log.NewNopLogger())
+		require.NoError(t, err)
+
+		container := newContainer("c1", map[string]string{
+			EndpointLabel: "my-endpoint",
+			PortLabel:     "8080",
+		}, "172.17.0.2")
+		container.NetworkSettings.Networks["my-network"] = Network{
+			IPAddress: "10.0.0.2",
+		}
+		docker.SetContainers([]Container{container})
+		assert.NoError(t, discovery.Sync(context.Background()))
+
+		assert.Equal(t, "10.0.0.2:8080", manager.Listeners()["c1"].Addr)
+	})
+}
+
+func TestClient_Events(t *testing.T) {
+	t.Run("connected", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// nolint
+			json.NewEncoder(w).Encode(Event{Action: "start"})
+		}))
+		defer server.Close()
+
+		client, err := NewClient("tcp://" + server.Listener.Addr().String())
+		require.NoError(t, err)
+
+		var connected bool
+		var events []Event
+		err = client.Events(context.Background(), func() {
+			// Called before any events are received.
+			assert.Empty(t, events)
+			connected = true
+		}, func(e Event) {
+			events = append(events, e)
+		})
+		assert.EqualError(t, err, "event stream closed")
+		assert.True(t, connected)
+		assert.Len(t, events, 1)
+	})
+
+	t.Run("connect failed", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		client, err := NewClient("tcp://" + server.Listener.Addr().String())
+		require.NoError(t, err)
+
+		// onConnect isn't called if the stream never connected, so the
+		// discovery backoff isn't reset.
+		var connected bool
+		err = client.Events(context.Background(), func() {
+			connected = true
+		}, func(e Event) {})
+		assert.Error(t, err)
+		assert.False(t, connected)
+	})
+}
@@ -0,0 +1,47 @@
+package reverseproxy
+
+import (
+	"crypto/ed25519"
+	"net/http"
+)
+
+// Middleware wraps the reverse proxy handler, such as to add custom
+// authentication, metrics or modify requests before they're forwarded to the
+// upstream.
+type Middleware func(next http.Handler) http.Handler
+
+type options struct {
+	middleware    []Middleware
+	provenanceKey ed25519.PrivateKey
+}
+
+type Option interface {
+	apply(*options)
+}
+
+type middlewareOption []Middleware
+
+func (o middlewareOption) apply(opts *options) {
+	opts.middleware = append(opts.middleware, o...)
+}
+
+// WithMiddleware adds middleware to wrap the reverse proxy handler.
+//
+// Middleware runs in the order given, so the first middleware is the
+// outermost handler. Middleware runs after the servers access log and
+// metrics, so requests rejected by middleware are still logged and recorded.
+func WithMiddleware(middleware ...Middleware) Option {
+	return middlewareOption(middleware)
+}
+
+type provenanceKeyOption ed25519.PrivateKey
+
+func (o provenanceKeyOption) apply(opts *options) {
+	opts.provenanceKey = ed25519.PrivateKey(o)
+}
+
+// WithProvenanceKey signs responses with the given key, so the Piko server
+// can verify responses were sent by an agent for the endpoint.
+func WithProvenanceKey(key ed25519.PrivateKey) Option {
+	return provenanceKeyOption(key)
+}
@@ -2,24 +2,41 @@ package reverseproxy
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
+	"hash"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/bufpool"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/provenance"
+)
+
+const (
+	// timeoutHeader contains the remaining time in milliseconds before the
+	// Piko server times out the request.
+	timeoutHeader = "x-piko-timeout"
 )
 
 type ReverseProxy struct {
 	proxy *httputil.ReverseProxy
 
+	endpointID string
+
 	timeout time.Duration
 
+	// provenanceKey signs responses to requests with a provenance nonce, or
+	// is nil if responses aren't signed.
+	provenanceKey ed25519.PrivateKey
+
 	logger log.Logger
 }
 
@@ -32,19 +49,49 @@ func NewReverseProxy(conf config.ListenerConfig, logger log.Logger) *ReverseProx
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = newTransport(conf.Transport, u.Scheme)
 	proxy.ErrorLog = logger.StdLogger(zapcore.WarnLevel)
+	// Reuse buffers to copy response bodies rather than allocating a buffer
+	// for each request.
+	proxy.BufferPool = bufpool.Default()
 	rp := &ReverseProxy{
-		proxy:   proxy,
-		timeout: conf.Timeout,
-		logger:  logger,
+		proxy:      proxy,
+		endpointID: conf.EndpointID,
+		timeout:    conf.Timeout,
+		logger:     logger,
 	}
 	proxy.ErrorHandler = rp.errorHandler
 	return rp
 }
 
 func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if p.timeout != 0 {
-		ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+	timeout := p.timeout
+	// If the server will time out the request before the agent, use the
+	// server timeout so the upstream request is cancelled once the client
+	// has received an error.
+	if t, ok := parseTimeoutHeader(r.Header.Get(timeoutHeader)); ok {
+		if timeout == 0 || t < timeout {
+			timeout = t
+		}
+	}
+	r.Header.Del(timeoutHeader)
+
+	nonce := r.Header.Get(provenance.NonceHeader)
+	r.Header.Del(provenance.NonceHeader)
+	if p.provenanceKey != nil && nonce != "" {
+		sw := &signingWriter{
+			ResponseWriter: w,
+			key:            p.provenanceKey,
+			endpointID:     p.endpointID,
+			nonce:          nonce,
+			head:           r.Method == http.MethodHead,
+		}
+		defer sw.signBody()
+		w = sw
+	}
+
+	if timeout != 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
 		defer cancel()
 
 		r = r.WithContext(ctx)
@@ -63,6 +110,104 @@ func (p *ReverseProxy) errorHandler(w http.ResponseWriter, _ *http.Request, err
 	_ = errorResponse(w, http.StatusBadGateway, "upstream unreachable")
 }
 
+// parseTimeoutHeader parses the timeout header, returning false if the header
+// is missing or invalid.
+func parseTimeoutHeader(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// signingWriter adds the provenance signature of the response status and
+// headers to the response headers, and the signature of the response body to
+// the response trailers.
+type signingWriter struct {
+	http.ResponseWriter
+
+	key        ed25519.PrivateKey
+	endpointID string
+	nonce      string
+
+	// head indicates whether the request is a HEAD request, so the response
+	// has no body.
+	head bool
+
+	wroteHeader bool
+
+	// body hashes the written response body, or is nil if the response has
+	// no body to sign in a trailer.
+	body hash.Hash
+}
+
+func (w *signingWriter) WriteHeader(code int) {
+	// Informational responses, except switching protocols, are followed by
+	// the final response.
+	final := code >= http.StatusOK || code == http.StatusSwitchingProtocols
+	if final && !w.wroteHeader {
+		w.wroteHeader = true
+
+		h := w.Header()
+		if _, ok := h["Content-Type"]; !ok {
+			// Don't sniff the content type after the headers are signed.
+			// The node that returns the response to the client sniffs the
+			// content type instead.
+			h["Content-Type"] = nil
+		}
+		h.Set(provenance.SignatureHeader, provenance.Sign(
+			w.key, w.endpointID, w.nonce, code, h,
+		))
+		switch {
+		case code == http.StatusSwitchingProtocols:
+			// The connection is upgraded so there is no body to sign.
+		case w.head || code == http.StatusNoContent || code == http.StatusNotModified:
+			// The response has no body, so can't include trailers.
+			h.Set(provenance.BodySignatureHeader, provenance.SignBody(
+				w.key, w.endpointID, w.nonce, provenance.NewBodyHash().Sum(nil),
+			))
+		default:
+			// Remove the content length so the body is chunked, as the
+			// trailers are dropped from responses with a content length.
+			h.Del("Content-Length")
+			h.Add("Trailer", provenance.BodySignatureHeader)
+			w.body = provenance.NewBodyHash()
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *signingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if w.body != nil {
+		w.body.Write(b[:n])
+	}
+	return n, err
+}
+
+// signBody adds the signature of the written body to the trailers. Must be
+// called once the response body is written.
+func (w *signingWriter) signBody() {
+	if w.body == nil {
+		return
+	}
+	w.Header().Set(provenance.BodySignatureHeader, provenance.SignBody(
+		w.key, w.endpointID, w.nonce, w.body.Sum(nil),
+	))
+}
+
+// Unwrap returns the underlying writer, so the reverse proxy can flush and
+// hijack the connection.
+func (w *signingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 type errorMessage struct {
 	Error string `json:"error"`
 }
@@ -2,6 +2,8 @@ package reverseproxy
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -11,9 +13,11 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/andydunstall/piko/agent/config"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/provenance"
 )
 
 func TestReverseProxy_Forward(t *testing.T) {
@@ -87,6 +91,37 @@ func TestReverseProxy_Forward(t *testing.T) {
 		assert.Equal(t, "upstream timeout", m.Error)
 	})
 
+	t.Run("server timeout", func(t *testing.T) {
+		blockCh := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				// The timeout header isn't forwarded to the upstream.
+				assert.Equal(t, "", r.Header.Get("x-piko-timeout"))
+				<-blockCh
+			},
+		))
+		defer upstream.Close()
+		defer close(blockCh)
+
+		// Use the server timeout since it's shorter than the agent timeout.
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			Timeout:    time.Minute,
+		}, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-timeout", "5")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	})
+
 	t.Run("upstream unreachable", func(t *testing.T) {
 		proxy := NewReverseProxy(config.ListenerConfig{
 			EndpointID: "my-endpoint",
@@ -108,3 +143,86 @@ func TestReverseProxy_Forward(t *testing.T) {
 		assert.Equal(t, "upstream unreachable", m.Error)
 	})
 }
+
+func TestReverseProxy_Provenance(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The nonce isn't forwarded to the upstream.
+			assert.Equal(t, "", r.Header.Get(provenance.NonceHeader))
+
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte("foo"))
+		},
+	))
+	defer upstream.Close()
+
+	proxy := NewReverseProxy(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+	}, log.NewNopLogger())
+	proxy.provenanceKey = privateKey
+
+	t.Run("signed", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(provenance.NonceHeader, "my-nonce")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.True(t, provenance.Verify(
+			publicKey,
+			"my-endpoint",
+			"my-nonce",
+			http.StatusCreated,
+			resp.Header,
+			resp.Header.Get(provenance.SignatureHeader),
+		))
+
+		// The body signature is sent as a trailer.
+		body := provenance.NewBodyHash()
+		_, err := io.Copy(body, resp.Body)
+		require.NoError(t, err)
+		assert.True(t, provenance.VerifyBody(
+			publicKey,
+			"my-endpoint",
+			"my-nonce",
+			body.Sum(nil),
+			resp.Trailer.Get(provenance.BodySignatureHeader),
+		))
+	})
+
+	t.Run("head", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodHead, "/", nil)
+		r.Header.Set(provenance.NonceHeader, "my-nonce")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		// The response has no body so the body signature is a header.
+		assert.True(t, provenance.VerifyBody(
+			publicKey,
+			"my-endpoint",
+			"my-nonce",
+			provenance.NewBodyHash().Sum(nil),
+			w.Header().Get(provenance.BodySignatureHeader),
+		))
+	})
+
+	t.Run("no nonce", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "", w.Header().Get(provenance.SignatureHeader))
+	})
+}
@@ -7,7 +7,6 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
@@ -19,6 +18,9 @@ import (
 type Server struct {
 	proxy *ReverseProxy
 
+	// handler is the proxy wrapped by any configured middleware.
+	handler http.Handler
+
 	router *gin.Engine
 
 	httpServer *http.Server
@@ -26,18 +28,39 @@ type Server struct {
 	logger log.Logger
 }
 
+// NewServer creates a reverse proxy server for the given listener.
+//
+// The metrics may be shared by multiple listeners, or nil to disable
+// metrics.
+//
+// When embedding the agent, use WithMiddleware to wrap the reverse proxy
+// handler for the listener.
 func NewServer(
 	conf config.ListenerConfig,
-	registry *prometheus.Registry,
+	metrics *middleware.Metrics,
 	logger log.Logger,
+	opts ...Option,
 ) *Server {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	logger = logger.WithSubsystem("proxy.http")
 	logger = logger.With(zap.String("endpoint-id", conf.EndpointID))
 
+	proxy := NewReverseProxy(conf, logger)
+	proxy.provenanceKey = options.provenanceKey
+	var handler http.Handler = proxy
+	for i := len(options.middleware) - 1; i >= 0; i-- {
+		handler = options.middleware[i](handler)
+	}
+
 	router := gin.New()
 	s := &Server{
-		proxy:  NewReverseProxy(conf, logger),
-		router: router,
+		proxy:   proxy,
+		handler: handler,
+		router:  router,
 		httpServer: &http.Server{
 			Handler:  router,
 			ErrorLog: logger.StdLogger(zapcore.WarnLevel),
@@ -50,11 +73,9 @@ func NewServer(
 
 	s.router.Use(middleware.NewLogger(conf.AccessLog, logger))
 
-	metrics := middleware.NewMetrics("agent")
-	if registry != nil {
-		metrics.Register(registry)
+	if metrics != nil {
+		router.Use(metrics.Handler())
 	}
-	router.Use(metrics.Handler())
 
 	s.router.NoRoute(s.proxyRoute)
 
@@ -75,7 +96,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 }
 
 func (s *Server) proxyRoute(c *gin.Context) {
-	s.proxy.ServeHTTP(c.Writer, c.Request)
+	s.handler.ServeHTTP(c.Writer, c.Request)
 }
 
 func (s *Server) panicRoute(c *gin.Context, err any) {
@@ -0,0 +1,90 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+
+	"github.com/andydunstall/piko/agent/config"
+)
+
+// newTransport returns the transport to forward requests to the upstream
+// with the given URL scheme.
+func newTransport(conf config.TransportConfig, scheme string) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = conf.MaxConnsPerHost
+	if conf.MaxIdleConnsPerHost != 0 {
+		transport.MaxIdleConnsPerHost = conf.MaxIdleConnsPerHost
+	}
+	if conf.IdleConnTimeout != 0 {
+		transport.IdleConnTimeout = conf.IdleConnTimeout
+	}
+
+	switch conf.HTTPVersion {
+	case config.HTTPVersionHTTP1:
+		return newHTTP1Transport(transport)
+	case config.HTTPVersionHTTP2:
+		h2 := &http2.Transport{
+			IdleConnTimeout: transport.IdleConnTimeout,
+		}
+		if scheme == "http" {
+			// Use cleartext HTTP/2 (h2c) with prior knowledge, since
+			// there is no TLS handshake to negotiate HTTP/2.
+			h2.AllowHTTP = true
+			h2.DialTLSContext = func(
+				ctx context.Context, network, addr string, _ *tls.Config,
+			) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			}
+		}
+		return &h2Transport{
+			h2: h2,
+			h1: newHTTP1Transport(transport),
+		}
+	default:
+		// The default transport negotiates HTTP/2 when the upstream
+		// supports it over TLS, otherwise uses HTTP/1.1.
+		return transport
+	}
+}
+
+// newHTTP1Transport returns the given transport with HTTP/2 disabled.
+func newHTTP1Transport(transport *http.Transport) *http.Transport {
+	transport.ForceAttemptHTTP2 = false
+	// A non-nil empty map disables HTTP/2.
+	transport.TLSNextProto = make(
+		map[string]func(string, *tls.Conn) http.RoundTripper,
+	)
+	return transport
+}
+
+// h2Transport forwards requests using HTTP/2, except for upgrade requests
+// (such as WebSockets) which require HTTP/1.1.
+type h2Transport struct {
+	h2 http.RoundTripper
+	h1 http.RoundTripper
+}
+
+func (t *h2Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if isUpgrade(r) {
+		return t.h1.RoundTrip(r)
+	}
+	return t.h2.RoundTrip(r)
+}
+
+// isUpgrade returns whether the request is a HTTP/1.1 upgrade request.
+func isUpgrade(r *http.Request) bool {
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
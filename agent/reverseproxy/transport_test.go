@@ -0,0 +1,66 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestReverseProxy_HTTPVersion(t *testing.T) {
+	// Returns the protocol of the request received by the upstream.
+	protoHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-proto", r.Proto)
+	})
+
+	forward := func(addr string, version config.HTTPVersion) string {
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       addr,
+			Transport: config.TransportConfig{
+				HTTPVersion: version,
+			},
+		}, log.NewNopLogger())
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Header().Get("x-proto")
+	}
+
+	t.Run("cleartext", func(t *testing.T) {
+		upstream := httptest.NewServer(h2c.NewHandler(protoHandler, &http2.Server{}))
+		defer upstream.Close()
+
+		assert.Equal(t, "HTTP/1.1", forward(upstream.URL, config.HTTPVersionAuto))
+		assert.Equal(t, "HTTP/1.1", forward(upstream.URL, config.HTTPVersionHTTP1))
+		assert.Equal(t, "HTTP/2.0", forward(upstream.URL, config.HTTPVersionHTTP2))
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		upstream := httptest.NewServer(h2c.NewHandler(protoHandler, &http2.Server{}))
+		defer upstream.Close()
+
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			Transport: config.TransportConfig{
+				HTTPVersion: config.HTTPVersionHTTP2,
+			},
+		}, log.NewNopLogger())
+
+		// Upgrade requests are forwarded using HTTP/1.1.
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, "HTTP/1.1", w.Header().Get("x-proto"))
+	})
+}
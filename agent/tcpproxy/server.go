@@ -2,13 +2,13 @@ package tcpproxy
 
 import (
 	"fmt"
-	"io"
 	"net"
 	"sync"
 
 	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/bufpool"
 	"github.com/andydunstall/piko/pkg/log"
 )
 
@@ -136,13 +136,13 @@ func forward(conn1 net.Conn, conn2 net.Conn) {
 		defer wg.Done()
 		defer conn1.Close()
 		// nolint
-		io.Copy(conn1, conn2)
+		bufpool.Copy(conn1, conn2)
 	}()
 	go func() {
 		defer wg.Done()
 		defer conn2.Close()
 		// nolint
-		io.Copy(conn2, conn1)
+		bufpool.Copy(conn2, conn1)
 	}()
 	wg.Wait()
 }
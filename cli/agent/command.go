@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	rungroup "github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
@@ -15,12 +16,17 @@ import (
 
 	"github.com/andydunstall/piko/agent/client"
 	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/docker"
 	"github.com/andydunstall/piko/agent/reverseproxy"
 	"github.com/andydunstall/piko/agent/server"
 	"github.com/andydunstall/piko/agent/tcpproxy"
+	"github.com/andydunstall/piko/forward"
 	"github.com/andydunstall/piko/pkg/build"
 	pikoconfig "github.com/andydunstall/piko/pkg/config"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/provenance"
+	pikoruntime "github.com/andydunstall/piko/pkg/runtime"
 )
 
 func NewCommand() *cobra.Command {
@@ -59,6 +65,9 @@ Examples:
 
   # Start all listeners configured in agent.yaml.
   piko agent start --config.file ./agent.yaml
+
+  # Validate the configuration in agent.yaml without starting the agent.
+  piko agent start --config.file ./agent.yaml --validate-config
 `,
 	}
 
@@ -69,18 +78,31 @@ Examples:
 	conf.RegisterFlags(cmd.PersistentFlags())
 	loadConf.RegisterFlags(cmd.PersistentFlags())
 
+	var validateConfig bool
+	cmd.PersistentFlags().BoolVar(
+		&validateConfig,
+		"validate-config",
+		false,
+		`
+Validate the configuration then exit without starting the agent.
+
+As well as validating the YAML configuration and flags, this loads the TLS
+root CAs and token file, and checks the server URL, listener addresses and
+server bind address can be resolved. The result is written to stdout as JSON,
+and the command exits with a non-zero status if the configuration is invalid.`,
+	)
+
 	cmd.PersistentPreRun = func(_ *cobra.Command, _ []string) {
+		if validateConfig {
+			checkConfig(conf, &loadConf)
+		}
+
 		if err := loadConf.Load(conf); err != nil {
 			fmt.Println(err.Error())
 			os.Exit(1)
 		}
 
-		// Listener protocol defaults to HTTP.
-		for _, listener := range conf.Listeners {
-			if listener.Protocol == "" {
-				listener.Protocol = config.ListenerProtocolHTTP
-			}
-		}
+		setListenerDefaults(conf)
 
 		if err := conf.Validate(); err != nil {
 			fmt.Printf("config: %s\n", err.Error())
@@ -91,82 +113,173 @@ Examples:
 	cmd.AddCommand(newStartCommand(conf))
 	cmd.AddCommand(newHTTPCommand(conf))
 	cmd.AddCommand(newTCPCommand(conf))
+	cmd.AddCommand(newServiceCommand(conf))
 
 	return cmd
 }
 
-func runAgent(conf *config.Config, logger log.Logger) error {
+// checkConfig fully validates the configuration and writes the result to
+// stdout, then exits.
+func checkConfig(conf *config.Config, loadConf *pikoconfig.Config) {
+	var issues []pikoconfig.Issue
+	if err := loadConf.Load(conf); err != nil {
+		issues = append(issues, pikoconfig.Issue{Message: err.Error()})
+	} else {
+		setListenerDefaults(conf)
+		issues = conf.Check()
+	}
+
+	report := pikoconfig.NewReport(issues)
+	if err := report.Write(os.Stdout); err != nil {
+		fmt.Printf("failed to write report: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if !report.Valid {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func setListenerDefaults(conf *config.Config) {
+	// Listener protocol defaults to HTTP.
+	for i := range conf.Listeners {
+		if conf.Listeners[i].Protocol == "" {
+			conf.Listeners[i].Protocol = config.ListenerProtocolHTTP
+		}
+	}
+}
+
+// runAgent runs the agent until either a shutdown signal is received or
+// the given context is cancelled. The context is used when running as a
+// service, where shutdown is requested by the service manager rather than a
+// signal.
+func runAgent(ctx context.Context, conf *config.Config, logger log.Logger) error {
 	logger.Info(
 		"starting piko agent",
 		zap.String("version", build.Version),
 	)
 	logger.Debug("piko config", zap.Any("config", conf))
 
+	pikoruntime.Apply(conf.Runtime, logger)
+
 	connectTLSConfig, err := conf.Connect.TLS.Load()
 	if err != nil {
 		return fmt.Errorf("connect tls: %w", err)
 	}
 
-	client := client.New(
+	clientOpts := []client.Option{
 		client.WithToken(conf.Connect.Token),
 		client.WithUpstreamURL(conf.Connect.URL),
 		client.WithTLSConfig(connectTLSConfig),
+		client.WithKeepalive(conf.Connect.Keepalive),
+		client.WithDialTimeout(conf.Connect.DialTimeout),
+		client.WithHandshakeTimeout(conf.Connect.HandshakeTimeout),
+		client.WithMaxStreams(conf.Connect.MaxStreams),
+		client.WithMultiplex(conf.Connect.Multiplex),
 		client.WithLogger(logger.WithSubsystem("client")),
-	)
+	}
+	if conf.Connect.TokenFile != "" {
+		clientOpts = append(clientOpts, client.WithTokenFile(conf.Connect.TokenFile))
+	}
+	pikoClient := client.New(clientOpts...)
+
+	var proxyOpts []reverseproxy.Option
+	if conf.Provenance.Key != "" {
+		provenanceKey, err := provenance.LoadPrivateKey(conf.Provenance.Key)
+		if err != nil {
+			return fmt.Errorf("provenance: %w", err)
+		}
+		proxyOpts = append(proxyOpts, reverseproxy.WithProvenanceKey(provenanceKey))
+	}
 
 	registry := prometheus.NewRegistry()
 
+	metrics := middleware.NewMetrics("agent")
+	metrics.Register(registry)
+
 	var group rungroup.Group
 
 	for _, listenerConfig := range conf.Listeners {
 		connectCtx, connectCancel := context.WithTimeout(
 			context.Background(),
-			conf.Connect.Timeout,
+			listenerConfig.RegistrationTimeout(conf.Connect.Timeout),
 		)
 		defer connectCancel()
 
-		ln, err := client.Listen(connectCtx, listenerConfig.EndpointID)
+		ln, err := pikoClient.Listen(connectCtx, listenerConfig.EndpointID)
 		if err != nil {
 			return fmt.Errorf("listen: %s: %w", listenerConfig.EndpointID, err)
 		}
 		defer ln.Close()
 
-		if listenerConfig.Protocol == config.ListenerProtocolHTTP {
-			server := reverseproxy.NewServer(listenerConfig, registry, logger)
+		serve, shutdown := newListenerServer(
+			ln, listenerConfig, metrics, conf.GracePeriod, logger, proxyOpts...,
+		)
 
-			// Listener handler.
-			group.Add(func() error {
-				if err := server.Serve(ln); err != nil {
-					return fmt.Errorf("serve: %w", err)
-				}
-				return nil
-			}, func(error) {
-				shutdownCtx, cancel := context.WithTimeout(
-					context.Background(), conf.GracePeriod,
-				)
-				defer cancel()
+		// Listener handler.
+		group.Add(serve, func(error) {
+			shutdown()
+		})
+	}
 
-				if err := server.Shutdown(shutdownCtx); err != nil {
-					logger.Warn("failed to gracefully shutdown listener", zap.Error(err))
-				}
-			})
-		} else if listenerConfig.Protocol == config.ListenerProtocolTCP {
-			server := tcpproxy.NewServer(listenerConfig, logger)
+	// Forwarded ports.
+	if len(conf.Forwards) > 0 {
+		proxyClient := client.New(
+			client.WithProxyURL(conf.Connect.ProxyURL),
+			client.WithToken(conf.Connect.ProxyToken),
+			client.WithTLSConfig(connectTLSConfig),
+			client.WithDialTimeout(conf.Connect.DialTimeout),
+			client.WithHandshakeTimeout(conf.Connect.HandshakeTimeout),
+			client.WithLogger(logger.WithSubsystem("client")),
+		)
+
+		for _, portConfig := range conf.Forwards {
+			host, _ := portConfig.Host()
+			ln, err := net.Listen("tcp", host)
+			if err != nil {
+				return fmt.Errorf("forward listen: %s: %w", host, err)
+			}
+
+			forwarder := forward.NewForwarder(
+				portConfig.EndpointID, proxyClient, logger.WithSubsystem("forwarder"),
+			)
 
-			// Listener handler.
+			// Forwarder handler.
 			group.Add(func() error {
-				if err := server.Serve(ln); err != nil {
-					return fmt.Errorf("serve: %w", err)
+				if err := forwarder.Forward(ln); err != nil {
+					return fmt.Errorf("forward: %s: %w", portConfig.EndpointID, err)
 				}
 				return nil
 			}, func(error) {
-				if err := server.Close(); err != nil {
-					logger.Warn("failed to close listener", zap.Error(err))
+				if err := forwarder.Close(); err != nil {
+					logger.Warn("failed to close forwarder", zap.Error(err))
 				}
 			})
 		}
 	}
 
+	// Docker discovery.
+	if conf.Docker.Enabled {
+		listeners := newDynamicListeners(
+			pikoClient, conf, metrics, proxyOpts, logger,
+		)
+		discovery, err := docker.NewDiscovery(conf.Docker, listeners, logger)
+		if err != nil {
+			return fmt.Errorf("docker: %w", err)
+		}
+
+		discoveryCtx, discoveryCancel := context.WithCancel(context.Background())
+		group.Add(func() error {
+			if err := discovery.Run(discoveryCtx); err != nil {
+				return fmt.Errorf("docker discovery: %w", err)
+			}
+			return nil
+		}, func(error) {
+			discoveryCancel()
+			listeners.Close()
+		})
+	}
+
 	// Agent server.
 	serverLn, err := net.Listen("tcp", conf.Server.BindAddr)
 	if err != nil {
@@ -191,7 +304,10 @@ func runAgent(conf *config.Config, logger log.Logger) error {
 	})
 
 	// Termination handler.
-	signalCtx, signalCancel := context.WithCancel(context.Background())
+	//
+	// Note on Windows, Ctrl+C and Ctrl+Break are delivered as SIGINT, and
+	// closing the console window is delivered as SIGTERM.
+	signalCtx, signalCancel := context.WithCancel(ctx)
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
 	group.Add(func() error {
@@ -203,6 +319,9 @@ func runAgent(conf *config.Config, logger log.Logger) error {
 			)
 			return nil
 		case <-signalCtx.Done():
+			if ctx.Err() != nil {
+				logger.Info("received shutdown request")
+			}
 			return nil
 		}
 	}, func(error) {
@@ -211,3 +330,46 @@ func runAgent(conf *config.Config, logger log.Logger) error {
 
 	return group.Run()
 }
+
+// newListenerServer creates a server to handle connections for the given
+// listener. Returns a function to serve the listener, which blocks until the
+// listener is closed, and a function to shutdown the server.
+func newListenerServer(
+	ln client.Listener,
+	listenerConfig config.ListenerConfig,
+	metrics *middleware.Metrics,
+	gracePeriod time.Duration,
+	logger log.Logger,
+	opts ...reverseproxy.Option,
+) (func() error, func()) {
+	if listenerConfig.Protocol == config.ListenerProtocolTCP {
+		server := tcpproxy.NewServer(listenerConfig, logger)
+		return func() error {
+				if err := server.Serve(ln); err != nil {
+					return fmt.Errorf("serve: %w", err)
+				}
+				return nil
+			}, func() {
+				if err := server.Close(); err != nil {
+					logger.Warn("failed to close listener", zap.Error(err))
+				}
+			}
+	}
+
+	server := reverseproxy.NewServer(listenerConfig, metrics, logger, opts...)
+	return func() error {
+			if err := server.Serve(ln); err != nil {
+				return fmt.Errorf("serve: %w", err)
+			}
+			return nil
+		}, func() {
+			shutdownCtx, cancel := context.WithTimeout(
+				context.Background(), gracePeriod,
+			)
+			defer cancel()
+
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				logger.Warn("failed to gracefully shutdown listener", zap.Error(err))
+			}
+		}
+}
@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/client"
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/docker"
+	"github.com/andydunstall/piko/agent/reverseproxy"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+)
+
+type dynamicListener struct {
+	ln       client.Listener
+	shutdown func()
+}
+
+// dynamicListeners manages listeners that are added and removed at runtime,
+// such as listeners for discovered Docker containers.
+type dynamicListeners struct {
+	client *client.Client
+
+	conf *config.Config
+
+	metrics *middleware.Metrics
+
+	// proxyOpts are the options for each listener's reverse proxy.
+	proxyOpts []reverseproxy.Option
+
+	listeners map[string]*dynamicListener
+
+	// mu protects the above fields.
+	mu sync.Mutex
+
+	logger log.Logger
+}
+
+func newDynamicListeners(
+	client *client.Client,
+	conf *config.Config,
+	metrics *middleware.Metrics,
+	proxyOpts []reverseproxy.Option,
+	logger log.Logger,
+) *dynamicListeners {
+	return &dynamicListeners{
+		client:    client,
+		conf:      conf,
+		metrics:   metrics,
+		proxyOpts: proxyOpts,
+		listeners: make(map[string]*dynamicListener),
+		logger:    logger,
+	}
+}
+
+// AddListener registers a listener with the given ID.
+func (l *dynamicListeners) AddListener(id string, listenerConfig config.ListenerConfig) error {
+	connectCtx, connectCancel := context.WithTimeout(
+		context.Background(),
+		listenerConfig.RegistrationTimeout(l.conf.Connect.Timeout),
+	)
+	defer connectCancel()
+
+	ln, err := l.client.Listen(connectCtx, listenerConfig.EndpointID)
+	if err != nil {
+		return fmt.Errorf("listen: %s: %w", listenerConfig.EndpointID, err)
+	}
+
+	serve, shutdown := newListenerServer(
+		ln, listenerConfig, l.metrics, l.conf.GracePeriod, l.logger,
+		l.proxyOpts...,
+	)
+	go func() {
+		if err := serve(); err != nil {
+			l.logger.Debug(
+				"listener closed",
+				zap.String("endpoint-id", listenerConfig.EndpointID),
+				zap.Error(err),
+			)
+		}
+	}()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if existing, ok := l.listeners[id]; ok {
+		go l.closeListener(existing)
+	}
+	l.listeners[id] = &dynamicListener{
+		ln:       ln,
+		shutdown: shutdown,
+	}
+	return nil
+}
+
+// RemoveListener gracefully shuts down the listener with the given ID.
+func (l *dynamicListeners) RemoveListener(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	listener, ok := l.listeners[id]
+	if !ok {
+		return
+	}
+	delete(l.listeners, id)
+
+	// Shutdown in the background as this blocks for up to the grace period.
+	go l.closeListener(listener)
+}
+
+// Close shuts down all listeners.
+func (l *dynamicListeners) Close() {
+	l.mu.Lock()
+	listeners := l.listeners
+	l.listeners = make(map[string]*dynamicListener)
+	l.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener *dynamicListener) {
+			defer wg.Done()
+			l.closeListener(listener)
+		}(listener)
+	}
+	wg.Wait()
+}
+
+func (l *dynamicListeners) closeListener(listener *dynamicListener) {
+	listener.shutdown()
+	if err := listener.ln.Close(); err != nil {
+		l.logger.Debug("failed to close listener", zap.Error(err))
+	}
+}
+
+var _ docker.Manager = &dynamicListeners{}
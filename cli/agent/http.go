@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -53,6 +54,27 @@ Whether to log all incoming HTTP requests and responses as 'info' logs.`,
 Timeout forwarding incoming HTTP requests to the upstream.`,
 	)
 
+	var httpVersion string
+	cmd.Flags().StringVar(
+		&httpVersion,
+		"http-version",
+		string(config.HTTPVersionAuto),
+		`
+HTTP version to forward requests to the upstream with. Supports 'auto', which
+uses HTTP/2 when the upstream supports it over TLS (otherwise HTTP/1.1),
+'http1' to always use HTTP/1.1, and 'h2' to always use HTTP/2, including
+cleartext HTTP/2 (h2c) for 'http' upstreams.`,
+	)
+
+	var maxConnsPerHost int
+	cmd.Flags().IntVar(
+		&maxConnsPerHost,
+		"max-conns-per-host",
+		0,
+		`
+Maximum number of connections to the upstream. If zero there is no limit.`,
+	)
+
 	var logger log.Logger
 
 	cmd.PreRun = func(_ *cobra.Command, args []string) {
@@ -64,10 +86,18 @@ Timeout forwarding incoming HTTP requests to the upstream.`,
 			Protocol:   config.ListenerProtocolHTTP,
 			AccessLog:  accessLog,
 			Timeout:    timeout,
+			Transport: config.TransportConfig{
+				HTTPVersion:     config.HTTPVersion(httpVersion),
+				MaxConnsPerHost: maxConnsPerHost,
+			},
 		}}
 
 		var err error
-		logger, err = log.NewLogger(conf.Log.Level, conf.Log.Subsystems)
+		logger, err = log.NewLogger(
+			conf.Log.Level,
+			conf.Log.Subsystems,
+			log.WithSampling(conf.Log.Sampling),
+		)
 		if err != nil {
 			fmt.Printf("failed to setup logger: %s\n", err.Error())
 			os.Exit(1)
@@ -75,7 +105,7 @@ Timeout forwarding incoming HTTP requests to the upstream.`,
 	}
 
 	cmd.Run = func(_ *cobra.Command, _ []string) {
-		if err := runAgent(conf, logger); err != nil {
+		if err := runAgent(context.Background(), conf, logger); err != nil {
 			logger.Error("failed to run agent", zap.Error(err))
 			os.Exit(1)
 		}
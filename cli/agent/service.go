@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+const defaultServiceName = "piko-agent"
+
+func newServiceCommand(conf *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "service [command] [flags]",
+		Short: "run the agent as a windows service",
+		Long: `Manage the agent as a Windows service.
+
+'piko agent service install' registers the agent with the Windows service
+manager using the given configuration, so the agent starts on boot and is
+restarted if it fails. The configured flags are passed to the service, so any
+'--config.path' must be accessible to the user running the service.
+
+Services are only supported on Windows.
+
+Examples:
+  # Install the agent as a service using the listeners in agent.yaml.
+  piko agent service install --config.path C:\piko\agent.yaml
+
+  # Uninstall the agent service.
+  piko agent service uninstall
+`,
+	}
+
+	var name string
+	cmd.PersistentFlags().StringVar(
+		&name,
+		"service.name",
+		defaultServiceName,
+		`
+The name of the Windows service.`,
+	)
+
+	cmd.AddCommand(newServiceInstallCommand(conf, &name))
+	cmd.AddCommand(newServiceUninstallCommand(&name))
+	cmd.AddCommand(newServiceRunCommand(conf, &name))
+
+	return cmd
+}
+
+func newServiceInstallCommand(conf *config.Config, name *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "install [flags]",
+		Short: "install the agent as a windows service",
+		Long: `Installs the agent as a Windows service.
+
+The service is configured to start automatically and runs the agent with the
+same flags given to this command.
+
+Examples:
+  # Install the agent as a service using the listeners in agent.yaml.
+  piko agent service install --config.path C:\piko\agent.yaml
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		if len(conf.Listeners) == 0 && !conf.Docker.Enabled {
+			fmt.Printf("no listeners configured\n")
+			os.Exit(1)
+		}
+
+		args, ok := serviceRunArgs(os.Args[1:])
+		if !ok {
+			fmt.Printf("failed to parse service arguments\n")
+			os.Exit(1)
+		}
+
+		if err := installService(*name, args); err != nil {
+			fmt.Printf("failed to install service: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("installed service: %s\n", *name)
+	}
+
+	return cmd
+}
+
+func newServiceUninstallCommand(name *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "uninstall [flags]",
+		Short: "uninstall the agent windows service",
+		Long: `Uninstalls the agent Windows service.
+
+Examples:
+  # Uninstall the agent service.
+  piko agent service uninstall
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		if err := uninstallService(*name); err != nil {
+			fmt.Printf("failed to uninstall service: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("uninstalled service: %s\n", *name)
+	}
+
+	return cmd
+}
+
+func newServiceRunCommand(conf *config.Config, name *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:    "run [flags]",
+		Short:  "run the agent as a windows service",
+		Hidden: true,
+		Long: `Runs the agent under the Windows service manager.
+
+This is invoked by the Windows service manager after installing the service
+with 'piko agent service install' and should not be run directly.
+`,
+	}
+
+	var logger log.Logger
+
+	cmd.PreRun = func(_ *cobra.Command, _ []string) {
+		var err error
+		logger, err = log.NewLogger(
+			conf.Log.Level,
+			conf.Log.Subsystems,
+			log.WithSampling(conf.Log.Sampling),
+		)
+		if err != nil {
+			fmt.Printf("failed to setup logger: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		if err := runService(*name, conf, logger); err != nil {
+			logger.Error("failed to run service", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+
+	return cmd
+}
+
+// serviceRunArgs returns the arguments to run the service with, given the
+// arguments to 'piko agent service install'. The 'install' command is
+// replaced with 'run' and the config path is made absolute, since the service
+// doesn't run from the current working directory.
+func serviceRunArgs(args []string) ([]string, bool) {
+	runArgs := make([]string, 0, len(args))
+	replaced := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if !replaced && arg == "install" && i > 0 && args[i-1] == "service" {
+			runArgs = append(runArgs, "run")
+			replaced = true
+			continue
+		}
+
+		if arg == "--config.path" && i+1 < len(args) {
+			path, err := filepath.Abs(args[i+1])
+			if err != nil {
+				return nil, false
+			}
+			runArgs = append(runArgs, arg, path)
+			i++
+			continue
+		}
+		if strings.HasPrefix(arg, "--config.path=") {
+			path, err := filepath.Abs(strings.TrimPrefix(arg, "--config.path="))
+			if err != nil {
+				return nil, false
+			}
+			runArgs = append(runArgs, "--config.path="+path)
+			continue
+		}
+
+		runArgs = append(runArgs, arg)
+	}
+	return runArgs, replaced
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package agent
+
+import (
+	"errors"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+var errServiceUnsupported = errors.New("services are only supported on windows")
+
+func installService(_ string, _ []string) error {
+	return errServiceUnsupported
+}
+
+func uninstallService(_ string) error {
+	return errServiceUnsupported
+}
+
+func runService(_ string, _ *config.Config, _ log.Logger) error {
+	return errServiceUnsupported
+}
@@ -0,0 +1,144 @@
+//go:build windows
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func installService(name string, args []string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("executable: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("service already exists")
+	}
+
+	s, err = m.CreateService(name, exePath, mgr.Config{
+		DisplayName: "Piko Agent",
+		Description: "Registers endpoints with Piko and forwards incoming connections to upstream services.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("create service: %w", err)
+	}
+	defer s.Close()
+
+	// Restart the agent if it exits with an error, such as failing to
+	// connect to Piko on boot.
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: time.Second * 5},
+	}, uint32((time.Hour * 24).Seconds())); err != nil {
+		return fmt.Errorf("set recovery actions: %w", err)
+	}
+
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("open service: %w", err)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("delete service: %w", err)
+	}
+	return nil
+}
+
+func runService(name string, conf *config.Config, logger log.Logger) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return fmt.Errorf("check windows service: %w", err)
+	}
+	if !isService {
+		return fmt.Errorf("not running as a windows service; use 'piko agent start'")
+	}
+
+	return svc.Run(name, &agentService{
+		conf:   conf,
+		logger: logger,
+	})
+}
+
+// agentService runs the agent under the Windows service manager, reporting
+// the service status and shutting down the agent when requested.
+type agentService struct {
+	conf   *config.Config
+	logger log.Logger
+}
+
+func (s *agentService) Execute(
+	_ []string,
+	requests <-chan svc.ChangeRequest,
+	status chan<- svc.Status,
+) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runAgent(ctx, s.conf, s.logger)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{
+					State:    svc.StopPending,
+					WaitHint: uint32(s.conf.GracePeriod.Milliseconds()),
+				}
+				cancel()
+				return s.exitCode(<-errCh)
+			}
+		case err := <-errCh:
+			return s.exitCode(err)
+		}
+	}
+}
+
+func (s *agentService) exitCode(err error) (bool, uint32) {
+	if err != nil {
+		s.logger.Error("failed to run agent", zap.Error(err))
+		return false, 1
+	}
+	return false, 0
+}
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -18,9 +19,16 @@ func newStartCommand(conf *config.Config) *cobra.Command {
 		Long: `Registers the configured listeners with Piko and forwards
 incoming connections for each listener to your upstream services.
 
+Any configured forwards open a local port that forwards connections to an
+endpoint, so a single agent can both expose local services and connect to
+services at another site.
+
 Examples:
   # Start all listeners configured in agent.yaml.
   piko agent start --config.file ./agent.yaml
+
+  # Discover listeners from the labels of local Docker containers.
+  piko agent start --docker.enabled
 `,
 	}
 
@@ -28,20 +36,24 @@ Examples:
 
 	cmd.PreRun = func(_ *cobra.Command, _ []string) {
 		var err error
-		logger, err = log.NewLogger(conf.Log.Level, conf.Log.Subsystems)
+		logger, err = log.NewLogger(
+			conf.Log.Level,
+			conf.Log.Subsystems,
+			log.WithSampling(conf.Log.Sampling),
+		)
 		if err != nil {
 			fmt.Printf("failed to setup logger: %s\n", err.Error())
 			os.Exit(1)
 		}
 
-		if len(conf.Listeners) == 0 {
+		if len(conf.Listeners) == 0 && len(conf.Forwards) == 0 && !conf.Docker.Enabled {
 			fmt.Printf("no listeners configured\n")
 			os.Exit(1)
 		}
 	}
 
 	cmd.Run = func(_ *cobra.Command, _ []string) {
-		if err := runAgent(conf, logger); err != nil {
+		if err := runAgent(context.Background(), conf, logger); err != nil {
 			logger.Error("failed to run agent", zap.Error(err))
 			os.Exit(1)
 		}
@@ -6,6 +6,7 @@ import (
 	"github.com/andydunstall/piko/cli/agent"
 	"github.com/andydunstall/piko/cli/forward"
 	"github.com/andydunstall/piko/cli/server"
+	"github.com/andydunstall/piko/cli/token"
 	"github.com/andydunstall/piko/cli/workload"
 	workloadv2 "github.com/andydunstall/piko/cli/workloadv2"
 )
@@ -14,9 +15,6 @@ func NewCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:          "piko [command] (flags)",
 		SilenceUsage: true,
-		CompletionOptions: cobra.CompletionOptions{
-			DisableDefaultCmd: true,
-		},
 		Long: `Piko is a reverse proxy that allows you to expose an endpoint
 that isn’t publicly routable (known as tunnelling).
 
@@ -56,12 +54,18 @@ to an upstream listener via Piko. Such as to forward port 3000 to endpoint
 
   $ piko forward tcp 3000 my-endpoint
 
+To generate a shell completion script, use 'piko completion', such as to load
+completions for bash:
+
+  $ source <(piko completion bash)
+
 `,
 	}
 
 	cmd.AddCommand(server.NewCommand())
 	cmd.AddCommand(agent.NewCommand())
 	cmd.AddCommand(forward.NewCommand())
+	cmd.AddCommand(token.NewCommand())
 	cmd.AddCommand(workload.NewCommand())
 	cmd.AddCommand(workloadv2.NewCommand())
 
@@ -13,7 +13,9 @@ import (
 	"github.com/andydunstall/piko/cli/server/status"
 	pikoconfig "github.com/andydunstall/piko/pkg/config"
 	"github.com/andydunstall/piko/pkg/log"
+	pikoruntime "github.com/andydunstall/piko/pkg/runtime"
 	"github.com/andydunstall/piko/server"
+	"github.com/andydunstall/piko/server/auth"
 	"github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/server/config"
 )
@@ -43,6 +45,9 @@ The server supports both YAML configuration and command line flags. Configure
 a YAML file using '--config.path'. When enabling '--config.expand-env', Piko
 will expand environment variables in the loaded YAML configuration.
 
+Send the server a SIGHUP to reload the auth configuration from the YAML
+files without restarting, such as to rotate the token keys.
+
 Examples:
   # Start a Piko server node.
   piko server
@@ -50,6 +55,12 @@ Examples:
   # Load configuration from YAML.
   piko server --config.path ./server.yaml
 
+  # Load a base configuration with environment specific overrides.
+  piko server --config.path ./server.yaml --config.path ./prod.yaml
+
+  # Validate the configuration without starting the server.
+  piko server --config.path ./server.yaml --validate-config
+
   # Start a Piko server and join an existing cluster by specifying each member.
   piko server --cluster.join 10.26.104.14,10.26.104.75
 
@@ -67,9 +78,33 @@ Examples:
 	conf.RegisterFlags(cmd.Flags())
 	loadConf.RegisterFlags(cmd.Flags())
 
+	var validateConfig bool
+	cmd.Flags().BoolVar(
+		&validateConfig,
+		"validate-config",
+		false,
+		`
+Validate the configuration then exit without starting the server.
+
+As well as validating the YAML configuration and flags, this loads the TLS
+certificates, parses the auth keys, and checks each listen and advertise
+address can be resolved. The result is written to stdout as JSON, and the
+command exits with a non-zero status if the configuration is invalid.`,
+	)
+
 	var logger log.Logger
 
+	// flagAuthConf is the auth configuration from flags, before loading the
+	// YAML configuration, which is used as the base when reloading.
+	var flagAuthConf auth.Config
+
 	cmd.PreRun = func(_ *cobra.Command, _ []string) {
+		if validateConfig {
+			checkConfig(conf, &loadConf)
+		}
+
+		flagAuthConf = conf.Auth
+
 		if err := loadConf.Load(conf); err != nil {
 			fmt.Println(err.Error())
 			os.Exit(1)
@@ -89,7 +124,11 @@ Examples:
 		}
 
 		var err error
-		logger, err = log.NewLogger(conf.Log.Level, conf.Log.Subsystems)
+		logger, err = log.NewLogger(
+			conf.Log.Level,
+			conf.Log.Subsystems,
+			log.WithSampling(conf.Log.Sampling),
+		)
 		if err != nil {
 			fmt.Printf("failed to setup logger: %s\n", err.Error())
 			os.Exit(1)
@@ -97,7 +136,17 @@ Examples:
 	}
 
 	cmd.Run = func(_ *cobra.Command, _ []string) {
-		if err := runServer(conf, logger); err != nil {
+		loadConfig := func() (*config.Config, error) {
+			// Only the auth configuration is reloaded, so only the auth
+			// flags are needed as the base.
+			reloadConf := config.Default()
+			reloadConf.Auth = flagAuthConf
+			if err := loadConf.Load(reloadConf); err != nil {
+				return nil, err
+			}
+			return reloadConf, nil
+		}
+		if err := runServer(conf, loadConfig, logger); err != nil {
 			logger.Error("failed to run server", zap.Error(err))
 			os.Exit(1)
 		}
@@ -108,16 +157,86 @@ Examples:
 	return cmd
 }
 
-func runServer(conf *config.Config, logger log.Logger) error {
-	ctx, cancel := signal.NotifyContext(
-		context.Background(), syscall.SIGINT, syscall.SIGTERM,
-	)
+// checkConfig fully validates the configuration and writes the result to
+// stdout, then exits.
+func checkConfig(conf *config.Config, loadConf *pikoconfig.Config) {
+	var issues []pikoconfig.Issue
+	if err := loadConf.Load(conf); err != nil {
+		issues = append(issues, pikoconfig.Issue{Message: err.Error()})
+	} else {
+		// The node ID is generated on startup if not configured.
+		if conf.Cluster.NodeID == "" {
+			conf.Cluster.NodeID = cluster.GenerateNodeID()
+		}
+		issues = conf.Check()
+	}
+
+	report := pikoconfig.NewReport(issues)
+	if err := report.Write(os.Stdout); err != nil {
+		fmt.Printf("failed to write report: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if !report.Valid {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func runServer(
+	conf *config.Config,
+	loadConfig func() (*config.Config, error),
+	logger log.Logger,
+) error {
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	pikoruntime.Apply(conf.Runtime, logger)
+
 	server, err := server.NewServer(conf, logger)
 	if err != nil {
 		return err
 	}
+	server.SetConfigLoader(loadConfig)
+
+	// The first SIGTERM or SIGINT gracefully shuts down the server with the
+	// configured grace period, and a second signal forces an immediate
+	// shutdown.
+	signalCh := make(chan os.Signal, 2)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalCh)
+	go func() {
+		sig := <-signalCh
+		logger.Info(
+			"received shutdown signal",
+			zap.String("signal", sig.String()),
+		)
+		cancel()
+
+		sig = <-signalCh
+		logger.Info(
+			"received second shutdown signal; forcing shutdown",
+			zap.String("signal", sig.String()),
+		)
+		server.RequestShutdown(0)
+	}()
+
+	// Reload the configuration on SIGHUP.
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+	go func() {
+		for {
+			select {
+			case <-hupCh:
+				logger.Info("received sighup; reloading config")
+				if err := server.Reload(); err != nil {
+					logger.Warn("failed to reload config", zap.Error(err))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
 	if err := server.Start(); err != nil {
 		return err
@@ -0,0 +1,244 @@
+package status
+
+import (
+	"fmt"
+	"os"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/spf13/cobra"
+
+	"github.com/andydunstall/piko/server/capture"
+	"github.com/andydunstall/piko/server/status/client"
+)
+
+func newCaptureCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "capture",
+		Short: "capture proxied requests",
+		Long: `Capture proxied requests.
+
+Records the requests and responses proxied to an endpoint, to help debug
+requests that behave differently when sent through Piko.
+
+Requests are captured by the node connected to the upstream, so use
+'--forward' to capture requests on another node in the cluster.
+
+Examples:
+  # Capture requests to endpoint my-endpoint.
+  piko server status capture enable my-endpoint
+
+  # Inspect the captured requests.
+  piko server status capture records my-endpoint
+
+  # Stop capturing and discard the captured requests.
+  piko server status capture disable my-endpoint
+`,
+	}
+
+	cmd.AddCommand(newCaptureEndpointsCommand(c))
+	cmd.AddCommand(newCaptureEnableCommand(c))
+	cmd.AddCommand(newCaptureDisableCommand(c))
+	cmd.AddCommand(newCaptureRecordsCommand(c))
+
+	return cmd
+}
+
+func newCaptureEndpointsCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "endpoints",
+		Short: "inspect captured endpoints",
+		Long: `Inspect captured endpoints.
+
+Queries the server for the endpoints with capturing enabled, including the
+capture configuration and number of captured requests.
+
+Examples:
+  piko server status capture endpoints
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		showCaptureEndpoints(c)
+	}
+
+	return cmd
+}
+
+type captureEndpointsOutput struct {
+	Endpoints []capture.Session `json:"endpoints"`
+}
+
+func showCaptureEndpoints(c *client.Client) {
+	capture := client.NewCapture(c)
+
+	sessions, err := capture.Sessions()
+	if err != nil {
+		fmt.Printf("failed to get captured endpoints: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	output := captureEndpointsOutput{
+		Endpoints: sessions,
+	}
+	b, _ := yaml.Marshal(output)
+	fmt.Print(string(b))
+}
+
+func newCaptureEnableCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "enable",
+		Args:  cobra.ExactArgs(1),
+		Short: "enable capturing requests to an endpoint",
+		Long: `Enable capturing requests to an endpoint.
+
+Requests to the endpoint with the given ID are sampled and recorded, including
+the request and response headers and bodies, to a fixed size buffer on the
+server. Once the buffer is full the oldest requests are discarded. Bodies are
+truncated to '--max-body-size'.
+
+Sensitive headers, such as 'Authorization' and 'Cookie', are redacted. Use
+'--redact-header' to redact additional headers. Note bodies are not redacted.
+
+Capturing is disabled after '--duration'. Enabling an endpoint that is
+already being captured replaces its configuration and discards its captured
+requests.
+
+Examples:
+  # Capture all requests to my-endpoint for 10 minutes.
+  piko server status capture enable my-endpoint
+
+  # Capture 10% of requests for an hour, redacting the 'x-api-key' header.
+  piko server status capture enable my-endpoint \
+    --sample-rate 0.1 --duration 1h --redact-header x-api-key
+`,
+	}
+
+	var conf capture.Config
+	cmd.Flags().Float64Var(
+		&conf.SampleRate,
+		"sample-rate",
+		1,
+		`
+Fraction of requests to capture, between 0 and 1.`,
+	)
+	cmd.Flags().IntVar(
+		&conf.Size,
+		"size",
+		100,
+		`
+Maximum number of captured requests to keep.`,
+	)
+	cmd.Flags().IntVar(
+		&conf.MaxBodySize,
+		"max-body-size",
+		4096,
+		`
+Maximum number of bytes of each request and response body to capture.`,
+	)
+	cmd.Flags().StringVar(
+		&conf.Duration,
+		"duration",
+		"10m",
+		`
+How long to capture requests for.`,
+	)
+	cmd.Flags().StringSliceVar(
+		&conf.RedactHeaders,
+		"redact-header",
+		nil,
+		`
+Additional headers to redact. May be given multiple times.`,
+	)
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		enableCapture(args[0], conf, c)
+	}
+
+	return cmd
+}
+
+func enableCapture(endpointID string, conf capture.Config, c *client.Client) {
+	capture := client.NewCapture(c)
+
+	session, err := capture.Enable(endpointID, conf)
+	if err != nil {
+		fmt.Printf("failed to enable capture: %s: %s\n", endpointID, err.Error())
+		os.Exit(1)
+	}
+
+	b, _ := yaml.Marshal(session)
+	fmt.Print(string(b))
+}
+
+func newCaptureDisableCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "disable",
+		Args:  cobra.ExactArgs(1),
+		Short: "disable capturing requests to an endpoint",
+		Long: `Disable capturing requests to an endpoint.
+
+Stops capturing requests to the endpoint with the given ID and discards its
+captured requests.
+
+Examples:
+  piko server status capture disable my-endpoint
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		disableCapture(args[0], c)
+	}
+
+	return cmd
+}
+
+func disableCapture(endpointID string, c *client.Client) {
+	capture := client.NewCapture(c)
+
+	if err := capture.Disable(endpointID); err != nil {
+		fmt.Printf("failed to disable capture: %s: %s\n", endpointID, err.Error())
+		os.Exit(1)
+	}
+}
+
+func newCaptureRecordsCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "records",
+		Args:  cobra.ExactArgs(1),
+		Short: "inspect captured requests",
+		Long: `Inspect captured requests.
+
+Queries the server for the captured requests to the endpoint with the given
+ID, from oldest to newest.
+
+Examples:
+  piko server status capture records my-endpoint
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		showCaptureRecords(args[0], c)
+	}
+
+	return cmd
+}
+
+type captureRecordsOutput struct {
+	Records []capture.Record `json:"records"`
+}
+
+func showCaptureRecords(endpointID string, c *client.Client) {
+	capture := client.NewCapture(c)
+
+	records, err := capture.Records(endpointID)
+	if err != nil {
+		fmt.Printf("failed to get captured requests: %s: %s\n", endpointID, err.Error())
+		os.Exit(1)
+	}
+
+	output := captureRecordsOutput{
+		Records: records,
+	}
+	b, _ := yaml.Marshal(output)
+	fmt.Print(string(b))
+}
@@ -0,0 +1,103 @@
+package status
+
+import (
+	"fmt"
+	"os"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/spf13/cobra"
+
+	"github.com/andydunstall/piko/server/catalogue"
+	"github.com/andydunstall/piko/server/status/client"
+)
+
+func newCatalogueCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "catalogue",
+		Short: "inspect endpoint catalogue",
+	}
+
+	cmd.AddCommand(newCatalogueEndpointsCommand(c))
+	cmd.AddCommand(newCatalogueEndpointCommand(c))
+
+	return cmd
+}
+
+func newCatalogueEndpointsCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "endpoints",
+		Short: "inspect catalogue endpoints",
+		Long: `Inspect catalogue endpoints.
+
+Queries the server for each endpoint that either has an entry in the endpoint
+catalogue or has connected upstreams. The output contains the catalogue
+metadata for each endpoint, such as its description and owner, along with
+the number of connected upstreams.
+
+Examples:
+  piko server status catalogue endpoints
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		showCatalogueEndpoints(c)
+	}
+
+	return cmd
+}
+
+type catalogueEndpointsOutput struct {
+	Endpoints []*catalogue.EndpointStatus `json:"endpoints"`
+}
+
+func showCatalogueEndpoints(c *client.Client) {
+	catalogue := client.NewCatalogue(c)
+
+	endpoints, err := catalogue.Endpoints()
+	if err != nil {
+		fmt.Printf("failed to get catalogue endpoints: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	output := catalogueEndpointsOutput{
+		Endpoints: endpoints,
+	}
+	b, _ := yaml.Marshal(output)
+	fmt.Print(string(b))
+}
+
+func newCatalogueEndpointCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "endpoint",
+		Args:  cobra.ExactArgs(1),
+		Short: "inspect catalogue endpoint",
+		Long: `Inspect a catalogue endpoint.
+
+Queries the server for the catalogue metadata and availability of the endpoint
+with the given ID.
+
+Examples:
+  # Inspect endpoint payments-cb-1.
+  piko server status catalogue endpoint payments-cb-1
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		showCatalogueEndpoint(args[0], c)
+	}
+
+	return cmd
+}
+
+func showCatalogueEndpoint(endpointID string, c *client.Client) {
+	catalogue := client.NewCatalogue(c)
+
+	endpoint, err := catalogue.Endpoint(endpointID)
+	if err != nil {
+		fmt.Printf("failed to get catalogue endpoint: %s: %s\n", endpointID, err.Error())
+		os.Exit(1)
+	}
+
+	b, _ := yaml.Marshal(endpoint)
+	fmt.Print(string(b))
+}
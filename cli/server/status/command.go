@@ -22,6 +22,7 @@ can be used to answer questions such as:
 * What upstream listeners are attached to each node?
 * What cluster state does this node know?
 * What is the gossip state of each known node?
+* What is an endpoint and who owns it?
 
 See 'piko server status --help' for the available commands.
 
@@ -48,11 +49,15 @@ Examples:
 		url, _ := url.Parse(conf.Server.URL)
 		c.SetURL(url)
 		c.SetForward(conf.Forward)
+		c.SetToken(conf.Server.Token)
 	}
 
 	cmd.AddCommand(newUpstreamCommand(c))
+	cmd.AddCommand(newProxyCommand(c))
 	cmd.AddCommand(newClusterCommand(c))
 	cmd.AddCommand(newGossipCommand(c))
+	cmd.AddCommand(newCatalogueCommand(c))
+	cmd.AddCommand(newCaptureCommand(c))
 
 	return cmd
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/andydunstall/piko/pkg/gossip"
+	servergossip "github.com/andydunstall/piko/server/gossip"
 	"github.com/andydunstall/piko/server/status/client"
 )
 
@@ -20,6 +21,10 @@ func newGossipCommand(c *client.Client) *cobra.Command {
 
 	cmd.AddCommand(newGossipNodesCommand(c))
 	cmd.AddCommand(newGossipNodeCommand(c))
+	cmd.AddCommand(newGossipPendingCommand(c))
+	cmd.AddCommand(newGossipConflictsCommand(c))
+	cmd.AddCommand(newGossipSkewCommand(c))
+	cmd.AddCommand(newGossipCompactCommand(c))
 
 	return cmd
 }
@@ -103,3 +108,182 @@ func showGossipNode(nodeID string, c *client.Client) {
 	b, _ := yaml.Marshal(node)
 	fmt.Println(string(b))
 }
+
+func newGossipPendingCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pending",
+		Short: "inspect pending gossip nodes",
+		Long: `Inspect pending gossip nodes.
+
+Queries the server for nodes that have joined but haven't yet propagated the
+state required to add them to the cluster, including which fields are
+missing. Nodes that stay pending for over 10 minutes are discarded.
+
+Examples:
+  piko server status gossip pending
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		showGossipPending(c)
+	}
+
+	return cmd
+}
+
+type gossipPendingOutput struct {
+	Nodes []servergossip.PendingNode `json:"nodes"`
+}
+
+func showGossipPending(c *client.Client) {
+	gossip := client.NewGossip(c)
+
+	nodes, err := gossip.Pending()
+	if err != nil {
+		fmt.Printf("failed to get pending gossip nodes: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	output := gossipPendingOutput{
+		Nodes: nodes,
+	}
+	b, _ := yaml.Marshal(output)
+	fmt.Println(string(b))
+}
+
+func newGossipConflictsCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "conflicts",
+		Short: "inspect node id conflicts",
+		Long: `Inspect node ID conflicts.
+
+Queries the server for detected conflicts where multiple nodes are using the
+same node ID. Conflicting nodes are refused from joining the cluster, so
+should be restarted with a unique '--cluster.node-id'.
+
+Examples:
+  piko server status gossip conflicts
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		showGossipConflicts(c)
+	}
+
+	return cmd
+}
+
+type gossipConflictsOutput struct {
+	Conflicts []gossip.NodeConflict `json:"conflicts"`
+}
+
+func showGossipConflicts(c *client.Client) {
+	gossip := client.NewGossip(c)
+
+	conflicts, err := gossip.Conflicts()
+	if err != nil {
+		fmt.Printf("failed to get gossip conflicts: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	output := gossipConflictsOutput{
+		Conflicts: conflicts,
+	}
+	b, _ := yaml.Marshal(output)
+	fmt.Println(string(b))
+}
+
+func newGossipSkewCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "skew",
+		Short: "inspect clock skew between nodes",
+		Long: `Inspect clock skew between nodes.
+
+Queries the server for the estimated clock skew of each known node relative
+to the server. Skew is estimated from the send time of gossip messages, so
+includes the network latency between the nodes.
+
+Nodes whose skew exceeds '--gossip.clock-skew-threshold' are marked as
+exceeded.
+
+Examples:
+  piko server status gossip skew
+
+  # Inspect the skew as seen by node 'bbc69214'.
+  piko server status gossip skew --forward bbc69214
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		showGossipSkew(c)
+	}
+
+	return cmd
+}
+
+type gossipSkewOutput struct {
+	Nodes []gossip.NodeClockSkew `json:"nodes"`
+}
+
+func showGossipSkew(c *client.Client) {
+	gossip := client.NewGossip(c)
+
+	skews, err := gossip.ClockSkew()
+	if err != nil {
+		fmt.Printf("failed to get gossip clock skew: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	output := gossipSkewOutput{
+		Nodes: skews,
+	}
+	b, _ := yaml.Marshal(output)
+	fmt.Println(string(b))
+}
+
+func newGossipCompactCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "compact",
+		Short: "compact the local gossip state",
+		Long: `Compact the local gossip state.
+
+Requests the server compacts its local gossip state to discard deleted
+entries, regardless of the configured '--gossip.compact-threshold'. This can
+be useful when a node has accumulated lots of endpoint churn.
+
+Use '--forward' to compact the state of another node in the cluster.
+
+Examples:
+  piko server status gossip compact
+
+  # Compact the state of node 'bbc69214'.
+  piko server status gossip compact --forward bbc69214
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		compactGossip(c)
+	}
+
+	return cmd
+}
+
+type gossipCompactOutput struct {
+	Discarded int `json:"discarded"`
+}
+
+func compactGossip(c *client.Client) {
+	gossip := client.NewGossip(c)
+
+	discarded, err := gossip.Compact()
+	if err != nil {
+		fmt.Printf("failed to compact gossip state: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	output := gossipCompactOutput{
+		Discarded: discarded,
+	}
+	b, _ := yaml.Marshal(output)
+	fmt.Println(string(b))
+}
@@ -0,0 +1,139 @@
+package status
+
+import (
+	"fmt"
+	"os"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/spf13/cobra"
+
+	"github.com/andydunstall/piko/server/status/client"
+)
+
+func newProxyCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "inspect proxied requests",
+	}
+
+	cmd.AddCommand(newProxyLatencyCommand(c))
+	cmd.AddCommand(newProxyHealthCommand(c))
+
+	return cmd
+}
+
+func newProxyLatencyCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "latency [endpoint]",
+		Args:  cobra.MaximumNArgs(1),
+		Short: "inspect endpoint latency",
+		Long: `Inspect endpoint latency.
+
+Queries the server for the p50, p95 and p99 latency of recent requests
+proxied to each endpoint, along with the endpoint's target latency if it
+has a latency SLO (configured with '--upstream.slo.latency').
+
+Examples:
+  # Inspect the latency of all endpoints.
+  piko server status proxy latency
+
+  # Inspect the latency of endpoint my-endpoint.
+  piko server status proxy latency my-endpoint
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		if len(args) == 1 {
+			showProxyEndpointLatency(args[0], c)
+			return
+		}
+		showProxyLatency(c)
+	}
+
+	return cmd
+}
+
+func showProxyLatency(c *client.Client) {
+	proxy := client.NewProxy(c)
+
+	endpoints, err := proxy.Latency()
+	if err != nil {
+		fmt.Printf("failed to get proxy latency: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	b, _ := yaml.Marshal(endpoints)
+	fmt.Print(string(b))
+}
+
+func showProxyEndpointLatency(endpointID string, c *client.Client) {
+	proxy := client.NewProxy(c)
+
+	endpoint, err := proxy.EndpointLatency(endpointID)
+	if err != nil {
+		fmt.Printf("failed to get proxy latency: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	b, _ := yaml.Marshal(endpoint)
+	fmt.Print(string(b))
+}
+
+func newProxyHealthCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "health [endpoint]",
+		Args:  cobra.MaximumNArgs(1),
+		Short: "inspect endpoint health",
+		Long: `Inspect endpoint health.
+
+Queries the server for the health score of each endpoint with upstreams or
+recent requests, from 0 to 100. An endpoint with no upstreams in the
+cluster scores 0, otherwise the score is reduced by the error rate of
+recent requests and by the p99 latency exceeding the endpoint's target
+latency.
+
+Examples:
+  # Inspect the health of all endpoints.
+  piko server status proxy health
+
+  # Inspect the health of endpoint my-endpoint.
+  piko server status proxy health my-endpoint
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		if len(args) == 1 {
+			showProxyEndpointHealth(args[0], c)
+			return
+		}
+		showProxyHealth(c)
+	}
+
+	return cmd
+}
+
+func showProxyHealth(c *client.Client) {
+	proxy := client.NewProxy(c)
+
+	endpoints, err := proxy.Health()
+	if err != nil {
+		fmt.Printf("failed to get proxy health: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	b, _ := yaml.Marshal(endpoints)
+	fmt.Print(string(b))
+}
+
+func showProxyEndpointHealth(endpointID string, c *client.Client) {
+	proxy := client.NewProxy(c)
+
+	endpoint, err := proxy.EndpointHealth(endpointID)
+	if err != nil {
+		fmt.Printf("failed to get proxy health: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	b, _ := yaml.Marshal(endpoint)
+	fmt.Print(string(b))
+}
@@ -17,6 +17,7 @@ func newUpstreamCommand(c *client.Client) *cobra.Command {
 	}
 
 	cmd.AddCommand(newUpstreamEndpointsCommand(c))
+	cmd.AddCommand(newUpstreamLatencyCommand(c))
 
 	return cmd
 }
@@ -53,3 +54,38 @@ func showUpstreamEndpoints(c *client.Client) {
 	b, _ := yaml.Marshal(endpoints)
 	fmt.Print(string(b))
 }
+
+func newUpstreamLatencyCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "latency",
+		Short: "inspect upstream latency",
+		Long: `Inspect upstream latency.
+
+Queries the server for the latency of each upstream connection with a
+latency SLO (configured with '--upstream.slo.latency'), including whether
+the upstream is degraded due to consistently exceeding its target latency.
+
+Examples:
+  piko server status upstream latency
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		showUpstreamLatency(c)
+	}
+
+	return cmd
+}
+
+func showUpstreamLatency(c *client.Client) {
+	upstream := client.NewUpstream(c)
+
+	upstreams, err := upstream.Latency()
+	if err != nil {
+		fmt.Printf("failed to get upstream latency: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	b, _ := yaml.Marshal(upstreams)
+	fmt.Print(string(b))
+}
@@ -0,0 +1,31 @@
+package token
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "token [command] [flags]",
+		Short: "create and inspect tokens",
+		Long: `Create and inspect JWTs to authenticate with the Piko server.
+
+Tokens include the Piko specific 'piko.type' claim, which restricts the
+listeners the token can be used with, and 'piko.endpoints' claim, which
+restricts the endpoints the token is permitted to access.
+
+Examples:
+  # Create a token permitted to register endpoints 'e1' and 'e2' that expires
+  # in 24 hours.
+  piko token create --endpoints e1,e2 --ttl 24h --hmac-key my-secret-key
+
+  # Inspect the claims of a token.
+  piko token inspect eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9...
+`,
+	}
+
+	cmd.AddCommand(newCreateCommand())
+	cmd.AddCommand(newInspectCommand())
+
+	return cmd
+}
@@ -0,0 +1,291 @@
+package token
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/cobra"
+
+	"github.com/andydunstall/piko/server/auth"
+)
+
+type createOptions struct {
+	tokenType string
+	endpoints []string
+	ttl       time.Duration
+	subject   string
+	audience  string
+	issuer    string
+
+	hmacKey      string
+	rsaKeyPath   string
+	ecdsaKeyPath string
+	algorithm    string
+	format       string
+	envName      string
+	outputPath   string
+}
+
+func newCreateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create [flags]",
+		Short: "create a token",
+		Long: `Create a JWT to authenticate with the Piko server.
+
+The token is signed with either a HMAC secret key ('--hmac-key'), a PEM
+encoded RSA private key ('--rsa-key') or a PEM encoded ECDSA private key
+('--ecdsa-key'). The Piko server must be configured with the matching secret
+or public key, such as '--auth.token-hmac-secret-key'.
+
+By default the token is written to stdout. Use '--format env' to output as
+an environment variable assignment, and '--output' to write to a file.
+
+Examples:
+  # Create a token permitted to register endpoints 'e1' and 'e2' that expires
+  # in 24 hours.
+  piko token create --endpoints e1,e2 --ttl 24h --hmac-key my-secret-key
+
+  # Create a token signed with an RSA private key.
+  piko token create --endpoints e1 --rsa-key ./private.pem
+
+  # Write the token to a file as an environment variable.
+  piko token create --hmac-key my-secret-key --format env --output ./piko.env
+`,
+	}
+
+	var opts createOptions
+
+	cmd.Flags().StringVar(
+		&opts.tokenType,
+		"type",
+		string(auth.TokenTypeUpstream),
+		`
+Token type ('piko.type' claim), either 'upstream' to register endpoints,
+'proxy' to send proxy requests, or 'admin' to identify admin requests.
+
+Typed tokens can only be used with the matching Piko server listener.`,
+	)
+	cmd.Flags().StringSliceVar(
+		&opts.endpoints,
+		"endpoints",
+		nil,
+		`
+Endpoint IDs the token is permitted to register. If empty the token is
+permitted to register any endpoint.`,
+	)
+	cmd.Flags().DurationVar(
+		&opts.ttl,
+		"ttl",
+		time.Hour*24,
+		`
+Duration until the token expires. Set to 0 for a token that doesn't expire.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.subject,
+		"subject",
+		"",
+		`
+Subject ('sub' claim) identifying the token holder.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.audience,
+		"audience",
+		"",
+		`
+Audience ('aud' claim) of the token.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.issuer,
+		"issuer",
+		"",
+		`
+Issuer ('iss' claim) of the token.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.hmacKey,
+		"hmac-key",
+		"",
+		`
+HMAC secret key to sign the token.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.rsaKeyPath,
+		"rsa-key",
+		"",
+		`
+Path to a PEM encoded RSA private key to sign the token.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.ecdsaKeyPath,
+		"ecdsa-key",
+		"",
+		`
+Path to a PEM encoded ECDSA private key to sign the token.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.algorithm,
+		"algorithm",
+		"",
+		`
+Signing algorithm, such as 'HS512' or 'RS384'. Must match the key type.
+
+Defaults to HS256, RS256 or ES256 depending on the key type.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.format,
+		"format",
+		"token",
+		`
+Output format, either 'token' to output the raw token or 'env' to output an
+environment variable assignment (see '--env-name').`,
+	)
+	cmd.Flags().StringVar(
+		&opts.envName,
+		"env-name",
+		"PIKO_TOKEN",
+		`
+Name of the environment variable when using '--format env'.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.outputPath,
+		"output",
+		"",
+		`
+Path of a file to write the token to. If empty the token is written to
+stdout.`,
+	)
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		if err := runCreate(opts); err != nil {
+			fmt.Printf("failed to create token: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	return cmd
+}
+
+func runCreate(opts createOptions) error {
+	tokenType := auth.TokenType(opts.tokenType)
+	if err := tokenType.Validate(); err != nil {
+		return err
+	}
+
+	method, key, err := loadSigningKey(opts)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	claims := auth.JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:  opts.subject,
+			Issuer:   opts.issuer,
+			IssuedAt: jwt.NewNumericDate(now),
+		},
+		Piko: auth.PikoClaims{
+			Type:      tokenType,
+			Endpoints: opts.endpoints,
+		},
+	}
+	if opts.ttl != 0 {
+		claims.ExpiresAt = jwt.NewNumericDate(now.Add(opts.ttl))
+	}
+	if opts.audience != "" {
+		claims.Audience = jwt.ClaimStrings{opts.audience}
+	}
+
+	tokenString, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		return fmt.Errorf("sign: %w", err)
+	}
+
+	var output string
+	switch opts.format {
+	case "token":
+		output = tokenString + "\n"
+	case "env":
+		output = fmt.Sprintf("%s=%s\n", opts.envName, tokenString)
+	default:
+		return fmt.Errorf("unsupported format: %s", opts.format)
+	}
+
+	if opts.outputPath == "" {
+		fmt.Print(output)
+		return nil
+	}
+	if err := os.WriteFile(opts.outputPath, []byte(output), 0o600); err != nil {
+		return fmt.Errorf("write output: %w", err)
+	}
+	return nil
+}
+
+// loadSigningKey loads the configured signing key and returns the signing
+// method to use with the key.
+func loadSigningKey(opts createOptions) (jwt.SigningMethod, any, error) {
+	var configured int
+	for _, k := range []string{opts.hmacKey, opts.rsaKeyPath, opts.ecdsaKeyPath} {
+		if k != "" {
+			configured++
+		}
+	}
+	if configured == 0 {
+		return nil, nil, fmt.Errorf("missing key: must configure one of --hmac-key, --rsa-key or --ecdsa-key")
+	}
+	if configured > 1 {
+		return nil, nil, fmt.Errorf("multiple keys: must configure only one of --hmac-key, --rsa-key or --ecdsa-key")
+	}
+
+	switch {
+	case opts.hmacKey != "":
+		method, err := signingMethod(opts.algorithm, "HS256", "HS")
+		if err != nil {
+			return nil, nil, err
+		}
+		return method, []byte(opts.hmacKey), nil
+	case opts.rsaKeyPath != "":
+		method, err := signingMethod(opts.algorithm, "RS256", "RS")
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := os.ReadFile(opts.rsaKeyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read rsa key: %w", err)
+		}
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse rsa key: %w", err)
+		}
+		return method, key, nil
+	default:
+		method, err := signingMethod(opts.algorithm, "ES256", "ES")
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := os.ReadFile(opts.ecdsaKeyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read ecdsa key: %w", err)
+		}
+		key, err := jwt.ParseECPrivateKeyFromPEM(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse ecdsa key: %w", err)
+		}
+		return method, key, nil
+	}
+}
+
+// signingMethod returns the signing method for the given algorithm, or the
+// default algorithm if empty. The algorithm must have the given prefix to
+// match the key type.
+func signingMethod(alg string, defaultAlg string, prefix string) (jwt.SigningMethod, error) {
+	if alg == "" {
+		alg = defaultAlg
+	}
+	method := jwt.GetSigningMethod(alg)
+	if method == nil || alg[:2] != prefix {
+		return nil, fmt.Errorf("unsupported algorithm for key: %s", alg)
+	}
+	return method, nil
+}
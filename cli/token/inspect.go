@@ -0,0 +1,211 @@
+package token
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/cobra"
+
+	"github.com/andydunstall/piko/server/auth"
+)
+
+type inspectOptions struct {
+	hmacKey            string
+	rsaPublicKeyPath   string
+	ecdsaPublicKeyPath string
+	audience           string
+	issuer             string
+}
+
+// tokenInfo is the inspected token output.
+type tokenInfo struct {
+	Algorithm string     `json:"algorithm"`
+	Type      string     `json:"type,omitempty"`
+	Subject   string     `json:"subject,omitempty"`
+	Issuer    string     `json:"issuer,omitempty"`
+	Audience  []string   `json:"audience,omitempty"`
+	IssuedAt  *time.Time `json:"issued_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Expired   bool       `json:"expired"`
+	Endpoints []string   `json:"endpoints,omitempty"`
+
+	// Verified is set if a key was given to verify the token.
+	Verified *bool `json:"verified,omitempty"`
+}
+
+func newInspectCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect [token] [flags]",
+		Args:  cobra.MaximumNArgs(1),
+		Short: "inspect a token",
+		Long: `Inspect the claims of a JWT.
+
+If no token is given as an argument, the token is read from stdin.
+
+By default the token signature isn't verified. To verify the token, configure
+the key the Piko server uses to verify tokens, such as '--hmac-key'. If
+verification fails the command exits with a non-zero status.
+
+Examples:
+  # Inspect the claims of a token.
+  piko token inspect eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9...
+
+  # Inspect and verify a token read from stdin.
+  cat token.txt | piko token inspect --hmac-key my-secret-key
+`,
+	}
+
+	var opts inspectOptions
+
+	cmd.Flags().StringVar(
+		&opts.hmacKey,
+		"hmac-key",
+		"",
+		`
+HMAC secret key to verify the token.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.rsaPublicKeyPath,
+		"rsa-public-key",
+		"",
+		`
+Path to a PEM encoded RSA public key to verify the token.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.ecdsaPublicKeyPath,
+		"ecdsa-public-key",
+		"",
+		`
+Path to a PEM encoded ECDSA public key to verify the token.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.audience,
+		"audience",
+		"",
+		`
+Audience the token must have when verifying.`,
+	)
+	cmd.Flags().StringVar(
+		&opts.issuer,
+		"issuer",
+		"",
+		`
+Issuer the token must have when verifying.`,
+	)
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		var tokenString string
+		if len(args) == 1 {
+			tokenString = args[0]
+		} else {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				fmt.Printf("failed to read token: %s\n", err.Error())
+				os.Exit(1)
+			}
+			tokenString = line
+		}
+
+		if err := runInspect(strings.TrimSpace(tokenString), opts); err != nil {
+			fmt.Printf("failed to inspect token: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	return cmd
+}
+
+func runInspect(tokenString string, opts inspectOptions) error {
+	claims := &auth.JWTClaims{}
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, claims)
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	info := tokenInfo{
+		Algorithm: token.Method.Alg(),
+		Type:      string(claims.Piko.Type),
+		Subject:   claims.Subject,
+		Issuer:    claims.Issuer,
+		Audience:  claims.Audience,
+		Endpoints: claims.Piko.Endpoints,
+	}
+	if claims.IssuedAt != nil {
+		info.IssuedAt = &claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		info.ExpiresAt = &claims.ExpiresAt.Time
+		info.Expired = claims.ExpiresAt.Before(time.Now())
+	}
+
+	var verifyErr error
+	verifier, err := loadVerifier(opts)
+	if err != nil {
+		return err
+	}
+	if verifier != nil {
+		// Verify the token as its own type. Tokens without a type are
+		// verified as upstream tokens.
+		tokenType := claims.Piko.Type
+		if tokenType == "" {
+			tokenType = auth.TokenTypeUpstream
+		}
+		_, verifyErr = verifier.VerifyEndpointToken(tokenString, tokenType)
+		verified := verifyErr == nil
+		info.Verified = &verified
+	}
+
+	b, _ := yaml.Marshal(info)
+	fmt.Print(string(b))
+
+	if verifyErr != nil {
+		if errors.Is(verifyErr, auth.ErrExpiredToken) {
+			return fmt.Errorf("verify: token expired")
+		}
+		return fmt.Errorf("verify: %w", verifyErr)
+	}
+	return nil
+}
+
+// loadVerifier returns a verifier using the configured keys, or nil if no
+// keys are configured.
+func loadVerifier(opts inspectOptions) (auth.Verifier, error) {
+	if opts.hmacKey == "" && opts.rsaPublicKeyPath == "" && opts.ecdsaPublicKeyPath == "" {
+		return nil, nil
+	}
+
+	conf := auth.JWTVerifierConfig{
+		HMACSecretKey: []byte(opts.hmacKey),
+		Audience:      opts.audience,
+		Issuer:        opts.issuer,
+	}
+	if opts.rsaPublicKeyPath != "" {
+		b, err := os.ReadFile(opts.rsaPublicKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("read rsa public key: %w", err)
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(b)
+		if err != nil {
+			return nil, fmt.Errorf("parse rsa public key: %w", err)
+		}
+		conf.RSAPublicKey = key
+	}
+	if opts.ecdsaPublicKeyPath != "" {
+		b, err := os.ReadFile(opts.ecdsaPublicKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("read ecdsa public key: %w", err)
+		}
+		key, err := jwt.ParseECPublicKeyFromPEM(b)
+		if err != nil {
+			return nil, fmt.Errorf("parse ecdsa public key: %w", err)
+		}
+		conf.ECDSAPublicKey = key
+	}
+	return auth.NewJWTVerifier(conf), nil
+}
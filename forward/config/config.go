@@ -103,6 +103,9 @@ type ConnectConfig struct {
 	// URL is the Piko server URL to connect to.
 	URL string
 
+	// Token is a token to authenticate with the Piko server.
+	Token string `json:"token" yaml:"token"`
+
 	// Timeout is the timeout attempting to connect to the Piko server.
 	Timeout time.Duration `json:"timeout" yaml:"timeout"`
 
@@ -132,6 +135,15 @@ The Piko server URL to connect to. Note this must be configured to use the
 Piko server 'proxy' port.`,
 	)
 
+	fs.StringVar(
+		&c.Token,
+		"connect.token",
+		c.Token,
+		`
+Token is a proxy token to authenticate with the Piko server, which is required
+when the server authenticates proxy requests.`,
+	)
+
 	fs.DurationVar(
 		&c.Timeout,
 		"connect.timeout",
@@ -159,6 +171,9 @@ func Default() *Config {
 		},
 		Log: log.Config{
 			Level: "info",
+			Sampling: log.SamplingConfig{
+				Interval: time.Minute,
+			},
 		},
 	}
 }
@@ -4,13 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"sync"
 
 	"go.uber.org/zap"
 
 	piko "github.com/andydunstall/piko/agent/client"
+	"github.com/andydunstall/piko/pkg/bufpool"
 	"github.com/andydunstall/piko/pkg/log"
 )
 
@@ -88,13 +88,13 @@ func (f *Forwarder) forwardConn(conn net.Conn) {
 		defer g.Done()
 		defer conn.Close()
 		// nolint
-		io.Copy(conn, upstream)
+		bufpool.Copy(conn, upstream)
 	}()
 	go func() {
 		defer g.Done()
 		defer upstream.Close()
 		// nolint
-		io.Copy(upstream, conn)
+		bufpool.Copy(upstream, conn)
 	}()
 	g.Wait()
 }
@@ -0,0 +1,19 @@
+// Package pikotest provides helpers to write integration tests against Piko
+// without running the Piko binaries.
+//
+// NewServer starts an in-process server node listening on random local
+// ports, NewUpstream registers an in-process upstream for an endpoint that
+// serves requests using a handler that can be replaced while the test runs,
+// and Tokens issues JWTs to authenticate with a server.
+//
+// Such as to test a service is reachable via Piko:
+//
+//	server := pikotest.NewServer(t)
+//	pikotest.NewUpstream(t, server, "my-endpoint", handler)
+//
+//	resp, err := http.DefaultClient.Do(
+//		server.NewRequest(http.MethodGet, "my-endpoint", "/", nil),
+//	)
+//
+// Servers and upstreams are closed when the test completes.
+package pikotest
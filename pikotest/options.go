@@ -0,0 +1,95 @@
+package pikotest
+
+import (
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+)
+
+type serverOptions struct {
+	join      []string
+	tokens    *Tokens
+	configure []func(conf *config.Config)
+	logger    log.Logger
+}
+
+type joinOption struct {
+	servers []*Server
+}
+
+func (o joinOption) apply(opts *serverOptions) {
+	for _, s := range o.servers {
+		opts.join = append(opts.join, s.GossipAddr())
+	}
+}
+
+// WithJoin configures the server to join a cluster with the given servers.
+func WithJoin(servers ...*Server) ServerOption {
+	return joinOption{servers: servers}
+}
+
+type tokensOption struct {
+	tokens *Tokens
+}
+
+func (o tokensOption) apply(opts *serverOptions) {
+	opts.tokens = o.tokens
+}
+
+// WithTokens configures the server to authenticate connections using
+// tokens issued by the given issuer.
+func WithTokens(tokens *Tokens) ServerOption {
+	return tokensOption{tokens: tokens}
+}
+
+type configOption struct {
+	configure func(conf *config.Config)
+}
+
+func (o configOption) apply(opts *serverOptions) {
+	opts.configure = append(opts.configure, o.configure)
+}
+
+// WithConfig configures the server using the given function, which is
+// called with the server configuration before the server starts.
+//
+// Listen addresses default to random local ports, so changing them is
+// usually not needed.
+func WithConfig(configure func(conf *config.Config)) ServerOption {
+	return configOption{configure: configure}
+}
+
+type loggerOption struct {
+	logger log.Logger
+}
+
+func (o loggerOption) apply(opts *serverOptions) {
+	opts.logger = o.logger
+}
+
+// WithLogger configures the server logger. Defaults to no output.
+func WithLogger(logger log.Logger) ServerOption {
+	return loggerOption{logger: logger}
+}
+
+type ServerOption interface {
+	apply(*serverOptions)
+}
+
+type upstreamOptions struct {
+	token string
+}
+
+type tokenOption string
+
+func (o tokenOption) apply(opts *upstreamOptions) {
+	opts.token = string(o)
+}
+
+// WithToken configures the token the upstream uses to authenticate.
+func WithToken(token string) UpstreamOption {
+	return tokenOption(token)
+}
+
+type UpstreamOption interface {
+	apply(*upstreamOptions)
+}
@@ -0,0 +1,104 @@
+package pikotest
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestUpstream(t *testing.T) {
+	server := NewServer(t)
+
+	upstream := NewUpstream(t, server, "my-endpoint", http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("foo"))
+		},
+	))
+	assert.Equal(t, "my-endpoint", upstream.EndpointID())
+
+	resp, err := http.DefaultClient.Do(
+		server.NewRequest(http.MethodGet, "my-endpoint", "/", nil),
+	)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "foo", string(body))
+
+	upstream.SetHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	))
+
+	resp, err = http.DefaultClient.Do(
+		server.NewRequest(http.MethodGet, "my-endpoint", "/", nil),
+	)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	// Once the upstream is closed, the endpoint has no upstreams.
+	upstream.Close()
+
+	resp, err = http.DefaultClient.Do(
+		server.NewRequest(http.MethodGet, "my-endpoint", "/", nil),
+	)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestServer_Tokens(t *testing.T) {
+	tokens := NewTokens()
+	server := NewServer(t, WithTokens(tokens), WithConfig(func(conf *config.Config) {
+		conf.Auth.AuthenticateProxy = true
+	}))
+
+	NewUpstream(t, server, "my-endpoint", http.HandlerFunc(
+		func(http.ResponseWriter, *http.Request) {},
+	), WithToken(tokens.Token(t, auth.TokenTypeUpstream, "my-endpoint")))
+
+	r := server.NewRequest(http.MethodGet, "my-endpoint", "/", nil)
+	resp, err := http.DefaultClient.Do(r)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	r = server.NewRequest(http.MethodGet, "my-endpoint", "/", nil)
+	r.Header.Set(
+		"x-piko-authorization",
+		"Bearer "+tokens.Token(t, auth.TokenTypeProxy, "my-endpoint"),
+	)
+	resp, err = http.DefaultClient.Do(r)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_Join(t *testing.T) {
+	server1 := NewServer(t)
+	server2 := NewServer(t, WithJoin(server1))
+
+	NewUpstream(t, server1, "my-endpoint", http.HandlerFunc(
+		func(http.ResponseWriter, *http.Request) {},
+	))
+
+	// Requests to server2 are forwarded to server1 once it learns about the
+	// upstream.
+	server2.WaitForEndpoint(t, "my-endpoint", time.Second*5)
+
+	resp, err := http.DefaultClient.Do(
+		server2.NewRequest(http.MethodGet, "my-endpoint", "/", nil),
+	)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,144 @@
+package pikotest
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+// Server is an in-process Piko server node.
+type Server struct {
+	server *server.Server
+
+	closeOnce sync.Once
+}
+
+// NewServer starts a server node listening on random local ports.
+//
+// The server is closed when the test completes.
+func NewServer(t testing.TB, opts ...ServerOption) *Server {
+	t.Helper()
+
+	options := serverOptions{
+		logger: log.NewNopLogger(),
+	}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
+	conf := config.Default()
+	conf.Cluster.NodeID = cluster.GenerateNodeID()
+	conf.Cluster.Join = options.join
+	conf.Proxy.BindAddr = "127.0.0.1:0"
+	conf.Upstream.BindAddr = "127.0.0.1:0"
+	conf.Admin.BindAddr = "127.0.0.1:0"
+	conf.Gossip.BindAddr = "127.0.0.1:0"
+	conf.Gossip.Interval = time.Millisecond * 10
+	conf.Usage.Disable = true
+	if options.tokens != nil {
+		conf.Auth = options.tokens.AuthConfig()
+	}
+	for _, configure := range options.configure {
+		configure(conf)
+	}
+
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("pikotest: invalid config: %s", err)
+	}
+
+	srv, err := server.NewServer(conf, options.logger)
+	if err != nil {
+		t.Fatalf("pikotest: server: %s", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("pikotest: start server: %s", err)
+	}
+
+	s := &Server{
+		server: srv,
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// ProxyURL returns the URL of the proxy port, such as
+// 'http://127.0.0.1:43215'.
+func (s *Server) ProxyURL() string {
+	return "http://" + s.server.Config().Proxy.AdvertiseAddr
+}
+
+// UpstreamURL returns the URL of the upstream port.
+func (s *Server) UpstreamURL() string {
+	return "http://" + s.server.Config().Upstream.AdvertiseAddr
+}
+
+// AdminURL returns the URL of the admin port.
+func (s *Server) AdminURL() string {
+	return "http://" + s.server.Config().Admin.AdvertiseAddr
+}
+
+// GossipAddr returns the address of the gossip port.
+func (s *Server) GossipAddr() string {
+	return s.server.Config().Gossip.AdvertiseAddr
+}
+
+// Config returns the server configuration.
+func (s *Server) Config() *config.Config {
+	return s.server.Config()
+}
+
+// NewRequest returns a request to send to the given endpoint via the proxy
+// port.
+//
+// As with httptest.NewRequest, NewRequest panics on error.
+func (s *Server) NewRequest(
+	method string,
+	endpointID string,
+	path string,
+	body io.Reader,
+) *http.Request {
+	r, err := http.NewRequest(method, s.ProxyURL()+path, body)
+	if err != nil {
+		panic("pikotest: new request: " + err.Error())
+	}
+	r.Header.Set("x-piko-endpoint", endpointID)
+	return r
+}
+
+// WaitForEndpoint waits until the server has an upstream for the given
+// endpoint, either connected to the server or another node in the cluster.
+//
+// Fails the test if the endpoint has no upstream after the timeout.
+func (s *Server) WaitForEndpoint(
+	t testing.TB,
+	endpointID string,
+	timeout time.Duration,
+) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, ok := s.server.ClusterState().LookupEndpoint(endpointID); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pikotest: endpoint not found: %s", endpointID)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// Close shuts down the server. Close is called when the test completes, so
+// only needs to be called to test behaviour when a node leaves.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		s.server.Shutdown()
+	})
+}
@@ -0,0 +1,77 @@
+package pikotest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/andydunstall/piko/server/auth"
+)
+
+// Tokens issues JWTs signed with a random HMAC secret key.
+//
+// Use WithTokens to configure a server to authenticate tokens issued by
+// Tokens.
+type Tokens struct {
+	secretKey []byte
+}
+
+func NewTokens() *Tokens {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("pikotest: generate secret key: " + err.Error())
+	}
+	return &Tokens{
+		secretKey: []byte(hex.EncodeToString(b)),
+	}
+}
+
+// AuthConfig returns the server auth configuration to verify tokens issued
+// by Tokens.
+func (t *Tokens) AuthConfig() auth.Config {
+	return auth.Config{
+		TokenHMACSecretKey: string(t.secretKey),
+	}
+}
+
+// Token returns a token of the given type, which expires after an hour,
+// permitted to access the given endpoints. If no endpoints are given the
+// token is permitted to access all endpoints.
+//
+// If tokenType is empty the token can be used with any listener.
+func (t *Tokens) Token(
+	tb testing.TB,
+	tokenType auth.TokenType,
+	endpoints ...string,
+) string {
+	tb.Helper()
+
+	now := time.Now()
+	return t.Sign(tb, auth.JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+		Piko: auth.PikoClaims{
+			Type:      tokenType,
+			Endpoints: endpoints,
+		},
+	})
+}
+
+// Sign returns a token with the given claims, such as to test tokens that
+// have expired or have an invalid audience.
+func (t *Tokens) Sign(tb testing.TB, claims auth.JWTClaims) string {
+	tb.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(
+		t.secretKey,
+	)
+	if err != nil {
+		tb.Fatalf("pikotest: sign token: %s", err)
+	}
+	return token
+}
@@ -0,0 +1,102 @@
+package pikotest
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	piko "github.com/andydunstall/piko/agent/client"
+)
+
+// Upstream is an in-process upstream registered with a server for an
+// endpoint, which serves proxied requests using a handler.
+type Upstream struct {
+	handler http.Handler
+	mu      sync.Mutex
+
+	ln         piko.Listener
+	httpServer *http.Server
+
+	closeOnce sync.Once
+}
+
+// NewUpstream registers an upstream for the given endpoint with the server,
+// which serves requests using the given handler. NewUpstream blocks until
+// the upstream is registered.
+//
+// The upstream is closed when the test completes.
+func NewUpstream(
+	t testing.TB,
+	server *Server,
+	endpointID string,
+	handler http.Handler,
+	opts ...UpstreamOption,
+) *Upstream {
+	t.Helper()
+
+	options := upstreamOptions{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
+	client := piko.New(
+		piko.WithUpstreamURL(server.UpstreamURL()),
+		piko.WithToken(options.token),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	ln, err := client.Listen(ctx, endpointID)
+	if err != nil {
+		t.Fatalf("pikotest: listen: %s", err)
+	}
+
+	u := &Upstream{
+		handler: handler,
+		ln:      ln,
+	}
+	u.httpServer = &http.Server{
+		Handler: http.HandlerFunc(u.serveHTTP),
+	}
+	go func() {
+		_ = u.httpServer.Serve(ln)
+	}()
+
+	t.Cleanup(u.Close)
+	return u
+}
+
+// SetHandler replaces the handler used to serve requests, such as to test
+// how a client handles the upstream failing.
+func (u *Upstream) SetHandler(handler http.Handler) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.handler = handler
+}
+
+// EndpointID returns the ID of the endpoint the upstream is registered for.
+func (u *Upstream) EndpointID() string {
+	return u.ln.EndpointID()
+}
+
+// Close unregisters the upstream. Close is called when the test completes,
+// so only needs to be called to test behaviour when the upstream
+// disconnects.
+func (u *Upstream) Close() {
+	u.closeOnce.Do(func() {
+		_ = u.httpServer.Close()
+		_ = u.ln.Close()
+	})
+}
+
+func (u *Upstream) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	handler := u.handler
+	u.mu.Unlock()
+
+	handler.ServeHTTP(w, r)
+}
@@ -41,12 +41,34 @@ func (b *Backoff) Wait(ctx context.Context) bool {
 	backoff := b.nextWait()
 	b.lastBackoff = backoff
 
-	select {
-	case <-time.After(b.lastBackoff):
-		return true
-	case <-ctx.Done():
+	return sleep(ctx, backoff)
+}
+
+// WaitAtLeast blocks until the next retry like Wait, though waits at least
+// the given duration, such as the 'Retry-After' duration requested by a
+// server.
+//
+// Up to 50% jitter is added to the duration, so clients rejected at the same
+// time don't all retry at the same time.
+func (b *Backoff) WaitAtLeast(ctx context.Context, d time.Duration) bool {
+	if b.retries != 0 && b.attempts > b.retries {
 		return false
 	}
+	b.attempts++
+
+	backoff := b.nextWait()
+	b.lastBackoff = backoff
+
+	jitterMultipler := 1.0 + (rand.Float64() * 0.5)
+	return sleep(ctx, max(backoff, time.Duration(float64(d)*jitterMultipler)))
+}
+
+// Reset resets the backoff to the minimum, such as once the client
+// successfully reconnects, so the next failure doesn't wait for the backoff
+// of earlier failures.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+	b.lastBackoff = 0
 }
 
 func (b *Backoff) nextWait() time.Duration {
@@ -60,3 +82,12 @@ func (b *Backoff) nextWait() time.Duration {
 	jitterMultipler := 1.0 + (rand.Float64() * 0.1)
 	return time.Duration(float64(backoff) * jitterMultipler)
 }
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
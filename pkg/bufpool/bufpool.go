@@ -0,0 +1,68 @@
+// Package bufpool provides pooled buffers for copying proxied request and
+// response bodies and TCP connections, to reduce allocations under high
+// throughput.
+package bufpool
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultSize is the size of the buffers in the default pool, which
+	// matches the buffer size used by io.Copy.
+	DefaultSize = 32 * 1024
+)
+
+var defaultPool = New(DefaultSize)
+
+// Pool is a pool of fixed size buffers.
+//
+// Pool implements httputil.BufferPool so can be used by a reverse proxy to
+// copy response bodies.
+type Pool struct {
+	size int
+	pool sync.Pool
+}
+
+// New creates a pool of buffers with the given size.
+func New(size int) *Pool {
+	p := &Pool{
+		size: size,
+	}
+	p.pool.New = func() any {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// Default returns the default pool of DefaultSize buffers.
+func Default() *Pool {
+	return defaultPool
+}
+
+// Get returns a buffer from the pool, or allocates a new buffer if the pool
+// is empty.
+func (p *Pool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Put returns the buffer to the pool. Buffers of the wrong size are
+// discarded.
+func (p *Pool) Put(b []byte) {
+	if cap(b) != p.size {
+		return
+	}
+	b = b[:p.size]
+	p.pool.Put(&b)
+}
+
+// Copy copies from src to dst like io.Copy, though uses a buffer from the
+// default pool rather than allocating a new buffer.
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := defaultPool.Get()
+	defer defaultPool.Put(buf)
+
+	return io.CopyBuffer(dst, src, buf)
+}
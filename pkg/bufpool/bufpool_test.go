@@ -0,0 +1,67 @@
+package bufpool
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reader and writer hide any io.WriterTo and io.ReaderFrom implementations
+// so copies use a buffer.
+type reader struct {
+	io.Reader
+}
+
+type writer struct {
+	io.Writer
+}
+
+func TestPool(t *testing.T) {
+	p := New(16)
+
+	b := p.Get()
+	assert.Len(t, b, 16)
+	p.Put(b[:4])
+
+	// Returned buffers are reset to the full size.
+	assert.Len(t, p.Get(), 16)
+
+	// Buffers of the wrong size are discarded.
+	p.Put(make([]byte, 8))
+	assert.Len(t, p.Get(), 16)
+}
+
+func TestCopy(t *testing.T) {
+	data := bytes.Repeat([]byte("foo"), DefaultSize)
+
+	var dst bytes.Buffer
+	n, err := Copy(&writer{&dst}, &reader{bytes.NewReader(data)})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, dst.Bytes())
+}
+
+// BenchmarkCopy compares the allocations of copying using io.Copy and a
+// pooled buffer.
+func BenchmarkCopy(b *testing.B) {
+	data := bytes.Repeat([]byte("a"), 64*1024)
+
+	b.Run("io.Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i != b.N; i++ {
+			// nolint
+			io.Copy(&writer{io.Discard}, &reader{bytes.NewReader(data)})
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i != b.N; i++ {
+			// nolint
+			Copy(&writer{io.Discard}, &reader{bytes.NewReader(data)})
+		}
+	})
+}
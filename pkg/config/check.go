@@ -0,0 +1,113 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Issue is a problem found when checking a configuration.
+type Issue struct {
+	// Field is the configuration field with the issue, such as 'proxy.tls'.
+	//
+	// May be empty if the issue isn't specific to a field, such as the
+	// configuration file failing to parse.
+	Field string `json:"field,omitempty"`
+
+	// Message describes the issue.
+	Message string `json:"message"`
+}
+
+// Report is the machine readable result of checking a configuration.
+type Report struct {
+	Valid  bool    `json:"valid"`
+	Issues []Issue `json:"issues"`
+}
+
+func NewReport(issues []Issue) *Report {
+	if issues == nil {
+		issues = []Issue{}
+	}
+	return &Report{
+		Valid:  len(issues) == 0,
+		Issues: issues,
+	}
+}
+
+// Write writes the report to w as JSON.
+func (r *Report) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// CheckAddr checks the given 'host:port' address is valid and its host can be
+// resolved.
+//
+// An empty host is valid, such as ':8000' to listen on all interfaces.
+func CheckAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("invalid port: %s", port)
+	}
+	if host == "" {
+		return nil
+	}
+	if _, err := net.LookupHost(host); err != nil {
+		return fmt.Errorf("resolve host: %w", err)
+	}
+	return nil
+}
+
+// ValidateAdvertiseAddr validates the given advertise address is a
+// 'host:port' address, where the host may be an IP or a DNS name.
+//
+// Unlike CheckAddr the host isn't resolved, since other nodes resolve the
+// host each time they connect, so the name may not resolve when the node
+// starts or may resolve to different IPs over time.
+func ValidateAdvertiseAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if err := ValidateHost(host); err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port: %s", port)
+	}
+	return nil
+}
+
+// ValidateHost validates the given host is an IP or a valid DNS name.
+func ValidateHost(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if len(host) > 253 {
+		return fmt.Errorf("invalid host: %s", host)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 ||
+			label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid host: %s", host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') &&
+				!(c >= '0' && c <= '9') && c != '-' && c != '_' {
+				return fmt.Errorf("invalid host: %s", host)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAddr(t *testing.T) {
+	assert.NoError(t, CheckAddr(":8000"))
+	assert.NoError(t, CheckAddr("127.0.0.1:8000"))
+	assert.NoError(t, CheckAddr("localhost:8000"))
+
+	assert.Error(t, CheckAddr("8000"))
+	assert.Error(t, CheckAddr("127.0.0.1:foo"))
+	assert.Error(t, CheckAddr("unknown.invalid:8000"))
+}
+
+func TestValidateAdvertiseAddr(t *testing.T) {
+	assert.NoError(t, ValidateAdvertiseAddr("10.26.104.45:8000"))
+	assert.NoError(t, ValidateAdvertiseAddr("[::1]:8000"))
+	assert.NoError(t, ValidateAdvertiseAddr("node1.internal:8000"))
+	// DNS names aren't resolved.
+	assert.NoError(t, ValidateAdvertiseAddr("unknown.invalid:8000"))
+
+	assert.EqualError(t, ValidateAdvertiseAddr(":8000"), "missing host")
+	assert.EqualError(
+		t, ValidateAdvertiseAddr("node1.internal:foo"), "invalid port: foo",
+	)
+	assert.EqualError(
+		t, ValidateAdvertiseAddr("node1..internal:8000"),
+		"invalid host: node1..internal",
+	)
+	assert.EqualError(
+		t, ValidateAdvertiseAddr("-node1:8000"), "invalid host: -node1",
+	)
+	assert.Error(t, ValidateAdvertiseAddr("node1.internal"))
+}
+
+func TestReport(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, NewReport(nil).Write(&buf))
+	assert.JSONEq(t, `{"valid": true, "issues": []}`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, NewReport([]Issue{
+		{Field: "proxy.tls", Message: "load key pair: missing file"},
+	}).Write(&buf))
+	assert.JSONEq(t, `{
+		"valid": false,
+		"issues": [{"field": "proxy.tls", "message": "load key pair: missing file"}]
+	}`, buf.String())
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/pflag"
@@ -11,17 +12,27 @@ import (
 )
 
 type Config struct {
-	Path      string `json:"path" yaml:"path"`
-	ExpandEnv bool   `json:"expand_env" yaml:"expand_env"`
+	// Paths are the YAML config file paths. Files are loaded in order, so
+	// later files override earlier files.
+	Paths     []string `json:"paths" yaml:"paths"`
+	ExpandEnv bool     `json:"expand_env" yaml:"expand_env"`
 }
 
 func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
-	fs.StringVar(
-		&c.Path,
+	fs.StringArrayVar(
+		&c.Paths,
 		"config.path",
-		"",
+		nil,
 		`
-YAML config file path.`,
+YAML config file path.
+
+May be given multiple times to load multiple files, where later files
+override earlier files. Mappings are merged recursively, and any other
+value, including lists, replaces the value from earlier files.
+
+A file may also include other files using a top-level 'include' list of
+paths, relative to the including file. Included files are loaded before the
+including file, so the including file overrides its includes.`,
 	)
 
 	fs.BoolVar(
@@ -39,31 +50,93 @@ default value can be given using form ${VAR:default}.`,
 	)
 }
 
-// Load load the YAML configuration from the file at the given path.
+// Load loads the YAML configuration from the files at the configured paths.
 func (c *Config) Load(conf interface{}) error {
-	if c.Path == "" {
-		return nil
+	for _, path := range c.Paths {
+		if err := c.loadFile(path, conf, nil); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	buf, err := os.ReadFile(c.Path)
+// loadFile loads the YAML configuration from the file at the given path,
+// after loading any files it includes.
+//
+// Decoding into conf only overrides the fields set in the file, so loading
+// multiple files merges them.
+func (c *Config) loadFile(path string, conf interface{}, loading []string) error {
+	for _, p := range loading {
+		if p == path {
+			return fmt.Errorf("include cycle: %s", path)
+		}
+	}
+	loading = append(loading, path)
+
+	buf, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("read file: %s: %w", c.Path, err)
+		return fmt.Errorf("read file: %s: %w", path, err)
 	}
 
 	if c.ExpandEnv {
 		buf = []byte(expandEnv(string(buf)))
 	}
 
+	includes, buf, err := parseIncludes(buf)
+	if err != nil {
+		return fmt.Errorf("parse config: %s: %w", path, err)
+	}
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		if err := c.loadFile(include, conf, loading); err != nil {
+			return err
+		}
+	}
+
 	dec := yaml.NewDecoder(bytes.NewReader(buf))
 	dec.KnownFields(true)
 
 	if err := dec.Decode(conf); err != nil {
-		return fmt.Errorf("parse config: %s: %w", c.Path, err)
+		return fmt.Errorf("parse config: %s: %w", path, err)
 	}
 
 	return nil
 }
 
+// parseIncludes removes the top-level 'include' list from the given YAML
+// document, returning the included paths and the remaining document.
+func parseIncludes(buf []byte) ([]string, []byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		return nil, nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, buf, nil
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "include" {
+			continue
+		}
+
+		var includes []string
+		if err := root.Content[i+1].Decode(&includes); err != nil {
+			return nil, nil, fmt.Errorf("include: %w", err)
+		}
+
+		root.Content = append(root.Content[:i], root.Content[i+2:]...)
+		buf, err := yaml.Marshal(&doc)
+		if err != nil {
+			return nil, nil, err
+		}
+		return includes, buf, nil
+	}
+	return nil, buf, nil
+}
+
 // expandEnv replaces ${VAR} or $VAR in the given string with the corresponding
 // environment variable. The replacement is case-sensitive.
 //
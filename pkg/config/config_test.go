@@ -2,9 +2,11 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type fakeConfig struct {
@@ -14,7 +16,15 @@ type fakeConfig struct {
 }
 
 type fakeSubConfig struct {
-	Car int `yaml:"car"`
+	Car int               `yaml:"car"`
+	Dar []string          `yaml:"dar"`
+	Ear map[string]string `yaml:"ear"`
+}
+
+func writeConfig(t *testing.T, dir string, name string, contents string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
 }
 
 func TestLoad(t *testing.T) {
@@ -31,7 +41,7 @@ sub:
 		var conf fakeConfig
 
 		loadConfig := &Config{
-			Path:      f.Name(),
+			Paths:     []string{f.Name()},
 			ExpandEnv: false,
 		}
 		assert.NoError(t, loadConfig.Load(&conf))
@@ -57,7 +67,7 @@ sub:
 		var conf fakeConfig
 
 		loadConfig := &Config{
-			Path:      f.Name(),
+			Paths:     []string{f.Name()},
 			ExpandEnv: true,
 		}
 		assert.NoError(t, loadConfig.Load(&conf))
@@ -77,7 +87,7 @@ sub:
 		var conf fakeConfig
 
 		loadConfig := &Config{
-			Path:      f.Name(),
+			Paths:     []string{f.Name()},
 			ExpandEnv: false,
 		}
 		assert.Error(t, loadConfig.Load(&conf))
@@ -86,9 +96,88 @@ sub:
 	t.Run("not found", func(t *testing.T) {
 		var conf fakeConfig
 		loadConfig := &Config{
-			Path:      "/a/b/c/notfound",
+			Paths:     []string{"/a/b/c/notfound"},
 			ExpandEnv: false,
 		}
 		assert.Error(t, loadConfig.Load(&conf))
 	})
+	t.Run("multiple files", func(t *testing.T) {
+		dir := t.TempDir()
+		base := writeConfig(t, dir, "base.yaml", `foo: val1
+bar: val2
+sub:
+  car: 5
+  dar: [a, b]
+  ear:
+    a: "1"
+    b: "2"`)
+		override := writeConfig(t, dir, "override.yaml", `bar: val3
+sub:
+  dar: [c]
+  ear:
+    b: "3"`)
+
+		var conf fakeConfig
+
+		loadConfig := &Config{
+			Paths: []string{base, override},
+		}
+		assert.NoError(t, loadConfig.Load(&conf))
+
+		assert.Equal(t, "val1", conf.Foo)
+		assert.Equal(t, "val3", conf.Bar)
+		assert.Equal(t, 5, conf.Sub.Car)
+		// Lists are replaced.
+		assert.Equal(t, []string{"c"}, conf.Sub.Dar)
+		// Mappings are merged.
+		assert.Equal(t, map[string]string{"a": "1", "b": "3"}, conf.Sub.Ear)
+	})
+
+	t.Run("include", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(dir, "common"), 0o700))
+		writeConfig(t, dir, "common/base.yaml", `foo: val1
+bar: val2`)
+		path := writeConfig(t, dir, "server.yaml", `include:
+  - common/base.yaml
+bar: val3
+sub:
+  car: 5`)
+
+		var conf fakeConfig
+
+		loadConfig := &Config{
+			Paths: []string{path},
+		}
+		assert.NoError(t, loadConfig.Load(&conf))
+
+		assert.Equal(t, "val1", conf.Foo)
+		assert.Equal(t, "val3", conf.Bar)
+		assert.Equal(t, 5, conf.Sub.Car)
+	})
+
+	t.Run("include cycle", func(t *testing.T) {
+		dir := t.TempDir()
+		writeConfig(t, dir, "a.yaml", `include: [b.yaml]`)
+		path := writeConfig(t, dir, "b.yaml", `include: [a.yaml]`)
+
+		var conf fakeConfig
+
+		loadConfig := &Config{
+			Paths: []string{path},
+		}
+		assert.ErrorContains(t, loadConfig.Load(&conf), "include cycle")
+	})
+
+	t.Run("include not found", func(t *testing.T) {
+		dir := t.TempDir()
+		path := writeConfig(t, dir, "server.yaml", `include: [notfound.yaml]`)
+
+		var conf fakeConfig
+
+		loadConfig := &Config{
+			Paths: []string{path},
+		}
+		assert.Error(t, loadConfig.Load(&conf))
+	})
 }
@@ -2,11 +2,35 @@ package gossip
 
 import (
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/spf13/pflag"
+
+	"github.com/andydunstall/piko/pkg/config"
+)
+
+// Compression is the algorithm used to compress stream messages.
+type Compression string
+
+const (
+	// CompressionNone sends stream messages uncompressed.
+	CompressionNone Compression = "none"
+	// CompressionGzip compresses stream messages with gzip.
+	CompressionGzip Compression = "gzip"
+	// CompressionDeflate compresses stream messages with deflate.
+	CompressionDeflate Compression = "deflate"
 )
 
+func (c Compression) Validate() error {
+	switch c {
+	case "", CompressionNone, CompressionGzip, CompressionDeflate:
+		return nil
+	default:
+		return fmt.Errorf("unsupported compression: %s", c)
+	}
+}
+
 type Config struct {
 	// BindAddr is the address to bind to listen for gossip traffic.
 	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
@@ -17,20 +41,65 @@ type Config struct {
 	// Interval is the rate to initiate a gossip round.
 	Interval time.Duration `json:"interval" yaml:"interval"`
 
+	// Fanout is the number of live nodes to gossip with each round.
+	Fanout int `json:"fanout" yaml:"fanout"`
+
+	// AdaptiveFanout indicates whether to increase the fanout with the
+	// cluster size, to gossip with at least log2(N) nodes each round, where
+	// N is the number of nodes in the cluster.
+	AdaptiveFanout bool `json:"adaptive_fanout" yaml:"adaptive_fanout"`
+
 	// MaxPacketSize is the maximum size of any packet sent.
 	MaxPacketSize int `json:"max_packet_size" yaml:"max_packet_size"`
+
+	// CompactThreshold is the number of deleted entries in the local node
+	// state before the state is compacted.
+	CompactThreshold int `json:"compact_threshold" yaml:"compact_threshold"`
+
+	// StreamCompression is the algorithm used to compress the messages of
+	// join and leave streams sent by the node. Defaults to 'none'.
+	StreamCompression Compression `json:"stream_compression" yaml:"stream_compression"`
+
+	// ClockSkewThreshold is the estimated clock skew of another node before
+	// logging a warning. If zero, skew is still estimated but never logged.
+	ClockSkewThreshold time.Duration `json:"clock_skew_threshold" yaml:"clock_skew_threshold"`
+
+	// LegacyProtocol indicates whether to gossip with nodes that only
+	// support the legacy protocol version, which has no checksums, such as
+	// during a rolling upgrade from an earlier release. Defaults to false.
+	LegacyProtocol bool `json:"legacy_protocol" yaml:"legacy_protocol"`
 }
 
 func (c *Config) Validate() error {
 	if c.BindAddr == "" {
 		return fmt.Errorf("missing bind addr")
 	}
+	if c.AdvertiseAddr != "" {
+		if err := config.ValidateAdvertiseAddr(c.AdvertiseAddr); err != nil {
+			return fmt.Errorf("invalid advertise addr: %w", err)
+		}
+	}
 	if c.Interval == 0 {
 		return fmt.Errorf("missing interval")
 	}
+	if c.Fanout <= 0 {
+		return fmt.Errorf("missing fanout")
+	}
 	if c.MaxPacketSize == 0 {
 		return fmt.Errorf("missing max packet size")
 	}
+	if c.CompactThreshold == 0 {
+		return fmt.Errorf("missing compact threshold")
+	}
+	if c.CompactThreshold < 0 {
+		return fmt.Errorf("invalid compact threshold: %d", c.CompactThreshold)
+	}
+	if err := c.StreamCompression.Validate(); err != nil {
+		return err
+	}
+	if c.ClockSkewThreshold < 0 {
+		return fmt.Errorf("invalid clock skew threshold: %s", c.ClockSkewThreshold)
+	}
 	return nil
 }
 
@@ -70,7 +139,32 @@ advertise address of '10.26.104.14:8003'.`,
 		`
 The interval to initiate rounds of gossip.
 
-Each gossip round selects another known node to synchronize with.`,
+Each gossip round selects '--gossip.fanout' other known nodes to synchronize
+with.`,
+	)
+
+	fs.IntVar(
+		&c.Fanout,
+		"gossip.fanout",
+		c.Fanout,
+		`
+The number of live nodes to gossip with each round.
+
+Increasing the fanout speeds up convergence in large clusters, at the cost of
+more gossip traffic. Each round also gossips with a random unreachable node,
+if any, regardless of the fanout.`,
+	)
+
+	fs.BoolVar(
+		&c.AdaptiveFanout,
+		"gossip.adaptive-fanout",
+		c.AdaptiveFanout,
+		`
+Whether to increase the fanout with the cluster size.
+
+If enabled, each round gossips with at least log2(N) live nodes, where N is
+the number of nodes in the cluster, so convergence time grows slowly as the
+cluster grows. '--gossip.fanout' is used as the minimum fanout.`,
 	)
 
 	fs.IntVar(
@@ -83,4 +177,84 @@ The maximum size of any packet sent.
 Depending on your networks MTU you may be able to increase to include more data
 in each packet.`,
 	)
+
+	fs.IntVar(
+		&c.CompactThreshold,
+		"gossip.compact-threshold",
+		c.CompactThreshold,
+		`
+The number of deleted entries in the nodes local state before the state is
+compacted.
+
+Deleted entries are kept so the deletes propagate to the other nodes in the
+cluster. Compaction discards deleted entries and re-versions the remaining
+entries. A lower threshold reduces the size of the local state, though
+requires other nodes to re-sync the nodes state more often.
+
+Compaction can also be triggered on demand using the admin API with
+'POST /status/gossip/compact'.`,
+	)
+
+	fs.StringVar(
+		(*string)(&c.StreamCompression),
+		"gossip.stream-compression",
+		string(c.StreamCompression),
+		`
+The algorithm used to compress join and leave stream messages sent by the
+node, which is one of 'none', 'gzip' or 'deflate'.
+
+When a node joins or leaves the cluster, it exchanges its full known state
+with another node over a stream. In large clusters compressing the stream
+reduces the sync time over slow links, such as between regions, at the cost
+of more CPU.
+
+The node receiving the stream responds using the same compression, so only
+enable compression once all nodes in the cluster support it.`,
+	)
+
+	fs.DurationVar(
+		&c.ClockSkewThreshold,
+		"gossip.clock-skew-threshold",
+		c.ClockSkewThreshold,
+		`
+The estimated clock skew between the node and another node in the cluster
+before logging a warning.
+
+Skew is estimated from the send time of gossip messages received from each
+node, so includes the network latency between the nodes. The estimated skew
+of each node is exposed in the 'piko_gossip_clock_skew_seconds' metric and
+with 'GET /status/gossip/skew' on the admin API.
+
+Set to 0 to disable warnings.`,
+	)
+
+	fs.BoolVar(
+		&c.LegacyProtocol,
+		"gossip.legacy-protocol",
+		c.LegacyProtocol,
+		`
+Whether to gossip with nodes running an earlier release of Piko, which send
+gossip messages without checksums.
+
+If enabled, the node accepts messages without checksums, replies to nodes
+using the earlier format, and retries a join using the earlier format if the
+joined node closes the stream on reading the version. Checking whether the
+joined node closes the stream delays each join by up to 500ms.
+
+Since these messages aren't checked for corruption, only enable during a
+rolling upgrade from an earlier release, then disable once all nodes have
+been upgraded.`,
+	)
+}
+
+// fanoutFor returns the number of live nodes to gossip with in a round, given
+// the number of known live nodes (excluding the local node).
+func (c *Config) fanoutFor(liveNodes int) int {
+	fanout := max(c.Fanout, 1)
+	if c.AdaptiveFanout {
+		// Include the local node in the cluster size.
+		adaptive := int(math.Ceil(math.Log2(float64(liveNodes + 1))))
+		fanout = max(fanout, adaptive)
+	}
+	return min(fanout, liveNodes)
 }
@@ -0,0 +1,56 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	newConfig := func() *Config {
+		return &Config{
+			BindAddr:         ":8003",
+			Interval:         time.Millisecond * 100,
+			Fanout:           1,
+			MaxPacketSize:    1400,
+			CompactThreshold: 100,
+		}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		assert.NoError(t, newConfig().Validate())
+	})
+
+	t.Run("missing compact threshold", func(t *testing.T) {
+		conf := newConfig()
+		conf.CompactThreshold = 0
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("negative compact threshold", func(t *testing.T) {
+		conf := newConfig()
+		conf.CompactThreshold = -1
+		assert.Error(t, conf.Validate())
+	})
+}
+
+func TestConfig_FanoutFor(t *testing.T) {
+	t.Run("fixed", func(t *testing.T) {
+		conf := &Config{Fanout: 3}
+		assert.Equal(t, 0, conf.fanoutFor(0))
+		// Limited by the number of live nodes.
+		assert.Equal(t, 2, conf.fanoutFor(2))
+		assert.Equal(t, 3, conf.fanoutFor(100))
+	})
+
+	t.Run("adaptive", func(t *testing.T) {
+		conf := &Config{Fanout: 2, AdaptiveFanout: true}
+		// The fanout is used as the minimum.
+		assert.Equal(t, 2, conf.fanoutFor(3))
+		// log2(16) = 4.
+		assert.Equal(t, 4, conf.fanoutFor(15))
+		// log2(1000) = 9.97.
+		assert.Equal(t, 10, conf.fanoutFor(999))
+	})
+}
@@ -0,0 +1,307 @@
+package gossip
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+type simNode struct {
+	id       string
+	addr     string
+	state    *clusterState
+	listener *packetListener
+}
+
+// simCluster simulates a cluster of nodes gossiping over a memNetwork.
+//
+// Each node has its own clusterState and packetListener, though rather than
+// running the gossip scheduler each round is triggered explicitly so the
+// simulation is deterministic.
+type simCluster struct {
+	network *memNetwork
+	nodes   []*simNode
+	rand    *rand.Rand
+
+	// config configures the gossip fanout.
+	config *Config
+}
+
+func newSimCluster(seed int64) *simCluster {
+	return &simCluster{
+		network: newMemNetwork(seed),
+		rand:    rand.New(rand.NewSource(seed)),
+		config: &Config{
+			Fanout: 1,
+		},
+	}
+}
+
+func (c *simCluster) AddNode() *simNode {
+	id := fmt.Sprintf("node-%d", len(c.nodes))
+	addr := fmt.Sprintf("10.0.0.%d:8003", len(c.nodes))
+
+	metrics := newMetrics()
+	state := newClusterState(
+		id, addr, &fakeFailureDetector{}, metrics, newNopWatcher(),
+	)
+	listener := newPacketListener(
+		c.network.Transport(addr),
+		state,
+		&fakeFailureDetector{},
+		1400,
+		0,
+		false,
+		metrics,
+		log.NewNopLogger(),
+	)
+	c.network.Handle(addr, func(b []byte) {
+		// Ignore errors as packets may be dropped or duplicated.
+		_ = listener.handlePacket(b)
+	})
+
+	node := &simNode{
+		id:       id,
+		addr:     addr,
+		state:    state,
+		listener: listener,
+	}
+	c.nodes = append(c.nodes, node)
+	return node
+}
+
+// Round runs a gossip round where each node sends its digest to random known
+// live nodes (given the configured fanout), then advances the network one
+// tick.
+//
+// Nodes that don't know any other nodes gossip with the first node, which
+// acts as the seed node to join.
+func (c *simCluster) Round() {
+	for _, node := range c.nodes {
+		nodes := node.state.LiveNodes()
+		if len(nodes) == 0 {
+			if node != c.nodes[0] {
+				_ = node.listener.sendDigest(
+					node.state.Digest(), c.nodes[0].addr, true, supportedVersion,
+				)
+			}
+			continue
+		}
+
+		// Sort since the nodes are returned in a random order.
+		sort.Slice(nodes, func(i, j int) bool {
+			return nodes[i].ID < nodes[j].ID
+		})
+		fanout := c.config.fanoutFor(len(nodes))
+		for _, i := range c.rand.Perm(len(nodes))[:fanout] {
+			_ = node.listener.sendDigest(
+				node.state.Digest(), nodes[i].Addr, true, supportedVersion,
+			)
+		}
+	}
+
+	c.network.Step()
+}
+
+// Churn applies a random update to the cluster. Such as adding a node,
+// upserting or deleting a key, or compacting a nodes state.
+func (c *simCluster) Churn(maxNodes int) {
+	switch n := c.rand.Intn(10); {
+	case n == 0 && len(c.nodes) < maxNodes:
+		c.AddNode()
+	case n < 6:
+		node := c.nodes[c.rand.Intn(len(c.nodes))]
+		key := fmt.Sprintf("k%d", c.rand.Intn(10))
+		value := fmt.Sprintf("v%d", c.rand.Int())
+		node.state.UpsertLocal(key, value)
+	case n < 9:
+		node := c.nodes[c.rand.Intn(len(c.nodes))]
+		key := fmt.Sprintf("k%d", c.rand.Intn(10))
+		node.state.DeleteLocal(key)
+	default:
+		node := c.nodes[c.rand.Intn(len(c.nodes))]
+		node.state.CompactLocal(2)
+	}
+}
+
+// Converged returns whether every node has the same view of every other
+// node as that nodes local state.
+func (c *simCluster) Converged() bool {
+	for _, owner := range c.nodes {
+		expected := owner.state.LocalNode()
+		for _, node := range c.nodes {
+			if node == owner {
+				continue
+			}
+
+			state, ok := node.state.Node(owner.id)
+			if !ok {
+				return false
+			}
+			if state.Version != expected.Version {
+				return false
+			}
+			if !assert.ObjectsAreEqual(expected.Entries, state.Entries) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// AssertConsistent asserts that no node has a view of another node that is
+// ahead of, or conflicts with, that nodes local state.
+func (c *simCluster) AssertConsistent(t *testing.T) {
+	for _, owner := range c.nodes {
+		expected := owner.state.LocalNode()
+		expectedEntries := make(map[string]Entry)
+		for _, entry := range expected.Entries {
+			expectedEntries[entry.Key] = entry
+		}
+
+		for _, node := range c.nodes {
+			if node == owner {
+				continue
+			}
+
+			state, ok := node.state.Node(owner.id)
+			if !ok {
+				continue
+			}
+			// Avoid testify in this loop as it's called after every round.
+			if state.Version > expected.Version {
+				t.Fatalf(
+					"%s: node %s version ahead: %d > %d",
+					node.id, owner.id, state.Version, expected.Version,
+				)
+			}
+
+			for _, entry := range state.Entries {
+				if entry.Version > state.Version {
+					t.Fatalf(
+						"%s: node %s entry ahead of version: %d > %d",
+						node.id, owner.id, entry.Version, state.Version,
+					)
+				}
+
+				expectedEntry, ok := expectedEntries[entry.Key]
+				if !ok || expectedEntry.Version != entry.Version {
+					// The entry may have been since updated or compacted.
+					continue
+				}
+				if expectedEntry != entry {
+					t.Fatalf(
+						"%s: node %s entry conflict: %+v != %+v",
+						node.id, owner.id, entry, expectedEntry,
+					)
+				}
+			}
+		}
+	}
+}
+
+// Tests the cluster state converges despite packet loss, duplication and
+// reordering while nodes join and update their state.
+func TestClusterState_Convergence(t *testing.T) {
+	tests := []struct {
+		name          string
+		dropRate      float64
+		duplicateRate float64
+		maxDelay      int
+	}{
+		{
+			name: "reliable",
+		},
+		{
+			name:     "drop",
+			dropRate: 0.3,
+		},
+		{
+			name:          "duplicate",
+			duplicateRate: 0.3,
+		},
+		{
+			name:     "reorder",
+			maxDelay: 5,
+		},
+		{
+			name:          "unreliable",
+			dropRate:      0.3,
+			duplicateRate: 0.2,
+			maxDelay:      5,
+		},
+	}
+
+	for _, tt := range tests {
+		for seed := int64(0); seed != 5; seed++ {
+			t.Run(fmt.Sprintf("%s/seed-%d", tt.name, seed), func(t *testing.T) {
+				cluster := newSimCluster(seed)
+				cluster.network.dropRate = tt.dropRate
+				cluster.network.duplicateRate = tt.duplicateRate
+				cluster.network.maxDelay = tt.maxDelay
+
+				for i := 0; i != 3; i++ {
+					cluster.AddNode()
+				}
+
+				for round := 0; round != 100; round++ {
+					cluster.Churn(8)
+					cluster.Round()
+
+					cluster.AssertConsistent(t)
+				}
+
+				// Once the churn stops and the network heals, the cluster
+				// must converge.
+				cluster.network.Heal()
+				for round := 0; round != 200 && !cluster.Converged(); round++ {
+					cluster.Round()
+
+					cluster.AssertConsistent(t)
+				}
+				assert.True(t, cluster.Converged())
+			})
+		}
+	}
+}
+
+// Tests a larger fanout converges in fewer rounds.
+func TestClusterState_ConvergenceFanout(t *testing.T) {
+	// roundsToConverge returns the number of rounds for the cluster to
+	// converge after each node updates its state.
+	roundsToConverge := func(config *Config) int {
+		cluster := newSimCluster(0)
+		cluster.config = config
+		for i := 0; i != 32; i++ {
+			cluster.AddNode()
+		}
+		// Wait for all nodes to discover one another.
+		for round := 0; round != 1000 && !cluster.Converged(); round++ {
+			cluster.Round()
+		}
+
+		for _, node := range cluster.nodes {
+			node.state.UpsertLocal("k", "v")
+		}
+		for round := 0; round != 1000; round++ {
+			if cluster.Converged() {
+				return round
+			}
+			cluster.Round()
+		}
+		assert.Fail(t, "cluster did not converge")
+		return 0
+	}
+
+	fanout1 := roundsToConverge(&Config{Fanout: 1})
+	fanout4 := roundsToConverge(&Config{Fanout: 4})
+	adaptive := roundsToConverge(&Config{Fanout: 1, AdaptiveFanout: true})
+
+	assert.Less(t, fanout4, fanout1)
+	assert.Less(t, adaptive, fanout1)
+}
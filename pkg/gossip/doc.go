@@ -4,4 +4,33 @@
 // At the gossip layer, a nodes state is represented as string key-value pairs
 // which will be gossiped to the other nodes in the cluster. Therefore each
 // node will have an eventually consistent view of the other nodes state.
+//
+// Nodes exchange state using a StreamTransport, to sync the full state when
+// joining and leaving, and a PacketTransport, to exchange digests and deltas
+// each gossip round. TCPTransport and UDPTransport gossip over the network.
+//
+// Packets end with a CRC32 checksum, and stream messages are sent as frames
+// containing the payload length and checksum, so truncated or corrupted
+// messages are dropped before being applied. For one release, if
+// Config.LegacyProtocol is enabled, nodes also accept messages using the
+// legacy version without checksums, and reply to legacy nodes using the
+// legacy version, so a cluster can be upgraded one node at a time.
+//
+// # Usage
+//
+// Create a node with New, configuring the transports and a Watcher to be
+// notified when the remote node state changes, then Join the cluster using
+// the addresses of existing nodes. Update the local node state with
+// UpsertLocal and DeleteLocal.
+//
+// When the node shuts down, call Leave to notify the cluster that the node
+// is leaving, followed by Close.
+//
+// # Compatibility
+//
+// The exported API of this package is stable: exported identifiers won't be
+// removed or have their signatures changed within a major version. Fields may
+// be added to Options and Config, so construct them using keyed fields. The
+// wire protocol is internal and may change between versions, so all nodes in
+// a cluster should run the same version.
 package gossip
@@ -0,0 +1,94 @@
+package gossip_test
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/andydunstall/piko/pkg/gossip"
+)
+
+type keyWatcher struct {
+	upsertCh chan string
+}
+
+func (w *keyWatcher) OnJoin(string) {}
+
+func (w *keyWatcher) OnLeave(string) {}
+
+func (w *keyWatcher) OnReachable(string) {}
+
+func (w *keyWatcher) OnUnreachable(string) {}
+
+func (w *keyWatcher) OnUpsertKey(nodeID, key, value string) {
+	// Watcher must not block, so drop the notification if the channel is
+	// full.
+	select {
+	case w.upsertCh <- fmt.Sprintf("%s: %s=%s", nodeID, key, value):
+	default:
+	}
+}
+
+func (w *keyWatcher) OnDeleteKey(string, string) {}
+
+func (w *keyWatcher) OnExpired(string) {}
+
+func newNode(nodeID string, watcher gossip.Watcher) (*gossip.Gossip, error) {
+	streamLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	packetLn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP:   streamLn.Addr().(*net.TCPAddr).IP,
+		Port: streamLn.Addr().(*net.TCPAddr).Port,
+	})
+	if err != nil {
+		streamLn.Close()
+		return nil, err
+	}
+
+	return gossip.New(gossip.Options{
+		NodeID: nodeID,
+		Config: &gossip.Config{
+			BindAddr:         streamLn.Addr().String(),
+			AdvertiseAddr:    streamLn.Addr().String(),
+			Interval:         time.Millisecond * 100,
+			Fanout:           1,
+			MaxPacketSize:    1400,
+			CompactThreshold: 100,
+		},
+		StreamTransport: gossip.NewTCPTransport(streamLn),
+		PacketTransport: gossip.NewUDPTransport(packetLn),
+		Watcher:         watcher,
+	})
+}
+
+func Example() {
+	node1, err := newNode("node-1", nil)
+	if err != nil {
+		panic(err)
+	}
+	defer node1.Close()
+
+	watcher := &keyWatcher{
+		upsertCh: make(chan string, 16),
+	}
+	node2, err := newNode("node-2", watcher)
+	if err != nil {
+		panic(err)
+	}
+	defer node2.Close()
+
+	node1.UpsertLocal("foo", "bar")
+
+	joined, err := node2.Join([]string{node1.LocalNode().Addr})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("joined", joined)
+	fmt.Println(<-watcher.upsertCh)
+
+	// Output:
+	// joined [node-1]
+	// node-1: foo=bar
+}
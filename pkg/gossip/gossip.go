@@ -2,11 +2,12 @@ package gossip
 
 import (
 	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"os"
 	"strings"
 	"time"
 
@@ -19,10 +20,41 @@ import (
 const (
 	streamTimeout = time.Second * 10
 
+	// legacyProbeTimeout is the time to wait for a node to reject a join
+	// stream using the current protocol version before sending the join, when
+	// Config.LegacyProtocol is enabled.
+	legacyProbeTimeout = time.Millisecond * 500
+
 	suspicionThreshold = 20
-	compactThreshold   = 100
+
+	// failureLogInterval is the minimum interval between logging repeated
+	// failures, such as failed gossip rounds while a node is down.
+	failureLogInterval = time.Minute
 )
 
+var (
+	// ErrNodeIDConflict is returned when a join is refused as another node
+	// in the cluster is using the same node ID.
+	ErrNodeIDConflict = errors.New("node id conflict")
+
+	// ErrInvalidOptions is returned by New when the given options are
+	// invalid.
+	ErrInvalidOptions = errors.New("invalid options")
+
+	// ErrClosed is returned when calling Join or Leave after the node has
+	// been closed.
+	ErrClosed = errors.New("gossip closed")
+)
+
+// errStreamRejected is returned when a node cleanly closes a stream after
+// reading the protocol version, since the node doesn't support the version.
+var errStreamRejected = errors.New("stream rejected")
+
+// Gossip is a node in a gossip cluster, which propagates the local node
+// state to the other nodes in the cluster and maintains an eventually
+// consistent view of the remote node state.
+//
+// Gossip is safe for concurrent use.
 type Gossip struct {
 	state *clusterState
 
@@ -31,25 +63,101 @@ type Gossip struct {
 	streamListener *streamListener
 	packetListener *packetListener
 
-	dialer     *net.Dialer
-	packetConn net.PacketConn
+	streamTransport StreamTransport
+	packetTransport PacketTransport
 
 	metrics *Metrics
 
+	// failureLogger logs repeated failures.
+	failureLogger log.Logger
+
 	logger log.Logger
 
 	closed     *atomic.Bool
 	shutdownCh chan struct{}
 }
 
-func New(
-	nodeID string,
-	config *Config,
-	streamLn net.Listener,
-	packetLn net.PacketConn,
-	watcher Watcher,
-	logger log.Logger,
-) *Gossip {
+// Options configures a gossip node.
+//
+// Fields may be added to Options in future releases, so construct Options
+// using keyed fields.
+type Options struct {
+	// NodeID is the unique ID of the local node in the cluster.
+	//
+	// Required.
+	NodeID string
+
+	// Config configures the gossip protocol.
+	//
+	// Required.
+	Config *Config
+
+	// StreamTransport is used to sync the full node state when joining and
+	// leaving.
+	//
+	// Required.
+	StreamTransport StreamTransport
+
+	// PacketTransport is used to exchange digests and deltas each gossip
+	// round.
+	//
+	// Required.
+	PacketTransport PacketTransport
+
+	// Watcher is notified when the known remote node state changes.
+	//
+	// Optional. If nil notifications are discarded.
+	Watcher Watcher
+
+	// Logger is the logger to use.
+	//
+	// Optional. If nil logs are discarded.
+	Logger log.Logger
+}
+
+func (o *Options) validate() error {
+	if o.NodeID == "" {
+		return fmt.Errorf("missing node id")
+	}
+	if o.Config == nil {
+		return fmt.Errorf("missing config")
+	}
+	if err := o.Config.Validate(); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if o.StreamTransport == nil {
+		return fmt.Errorf("missing stream transport")
+	}
+	if o.PacketTransport == nil {
+		return fmt.Errorf("missing packet transport")
+	}
+	return nil
+}
+
+// New creates a gossip node which exchanges state with other nodes using the
+// configured transports.
+//
+// Use NewTCPTransport and NewUDPTransport to gossip over the network.
+//
+// Returns an error wrapping ErrInvalidOptions if the options are invalid.
+func New(opts Options) (*Gossip, error) {
+	if err := opts.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOptions, err)
+	}
+
+	nodeID := opts.NodeID
+	config := opts.Config
+	streamTransport := opts.StreamTransport
+	packetTransport := opts.PacketTransport
+	watcher := opts.Watcher
+	if watcher == nil {
+		watcher = newNopWatcher()
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
 	logger = logger.WithSubsystem("gossip")
 
 	logger.Info(
@@ -73,31 +181,37 @@ func New(
 	)
 
 	streamListener := newStreamListener(
-		streamLn, state, streamTimeout, metrics, logger,
+		streamTransport, state, streamTimeout, config.LegacyProtocol, metrics, logger,
 	)
 	go streamListener.Serve()
 
 	packetListener := newPacketListener(
-		packetLn, state, failureDetector, config.MaxPacketSize, metrics, logger,
+		packetTransport,
+		state,
+		failureDetector,
+		config.MaxPacketSize,
+		config.ClockSkewThreshold,
+		config.LegacyProtocol,
+		metrics,
+		logger,
 	)
 	go packetListener.Serve()
 
 	gossip := &Gossip{
-		state:          state,
-		config:         config,
-		streamListener: streamListener,
-		packetListener: packetListener,
-		dialer: &net.Dialer{
-			Timeout: streamTimeout,
-		},
-		packetConn: packetLn,
-		metrics:    metrics,
-		logger:     logger,
-		closed:     atomic.NewBool(false),
-		shutdownCh: make(chan struct{}),
+		state:           state,
+		config:          config,
+		streamListener:  streamListener,
+		packetListener:  packetListener,
+		streamTransport: streamTransport,
+		packetTransport: packetTransport,
+		metrics:         metrics,
+		failureLogger:   newFailureLogger(logger),
+		logger:          logger,
+		closed:          atomic.NewBool(false),
+		shutdownCh:      make(chan struct{}),
 	}
 	gossip.schedule()
-	return gossip
+	return gossip, nil
 }
 
 // UpsertLocal updates the local node state entry with the given key.
@@ -134,16 +248,31 @@ func (g *Gossip) Nodes() []NodeMetadata {
 // attempt to gossip with any unknown nodes. If the port is omitted the
 // default bind port is used.
 //
+// Each joined node responds with its full known state. If fewer than three
+// nodes were joined, Join also syncs with nodes discovered from the joined
+// nodes, then cross-checks the state received from each node and logs any
+// inconsistencies, such as nodes with a split view of the cluster.
+//
 // Returns the IDs of joined nodes. Or if addresses were provided by no
 // nodes could be joined an error is returned. Note if a domain was provided
 // that only resolved to the current node then Join will return nil.
+//
+// If another node in the cluster has the same ID as the local node, the
+// returned error wraps ErrNodeIDConflict. Returns ErrClosed if the node has
+// been closed.
 func (g *Gossip) Join(addrs []string) ([]string, error) {
+	if g.closed.Load() {
+		return nil, ErrClosed
+	}
 	if len(addrs) == 0 {
 		return nil, nil
 	}
 
 	var joined []string
 	var lastJoinErr error
+	// views contains the view of the cluster received from each joined
+	// node.
+	views := make(map[string]clusterView)
 	for _, unresolvedAddr := range addrs {
 		unresolvedAddr = g.ensurePort(unresolvedAddr)
 		resolvedAddrs, err := resolveAddr(unresolvedAddr)
@@ -163,17 +292,13 @@ func (g *Gossip) Join(addrs []string) ([]string, error) {
 		}
 
 		for _, addr := range resolvedAddrs {
-			nodeID, err := g.join(addr)
+			nodeID, view, err := g.join(addr)
 			if err != nil {
 				lastJoinErr = err
-
-				g.logger.Warn(
-					"failed to join node",
-					zap.String("addr", addr),
-					zap.Error(err),
-				)
+				g.logJoinFailure(addr, err)
 			} else {
 				joined = append(joined, nodeID)
+				views[nodeID] = view
 			}
 		}
 	}
@@ -183,9 +308,75 @@ func (g *Gossip) Join(addrs []string) ([]string, error) {
 	if len(joined) == 0 && lastJoinErr != nil {
 		return nil, lastJoinErr
 	}
+
+	// If fewer than joinSyncPeers nodes were joined, such as when joining
+	// via a single seed node, sync with other nodes discovered from the
+	// joined nodes so their views can be cross-checked.
+	joined = append(joined, g.joinDiscovered(views)...)
+	g.checkViews(views)
+
 	return joined, nil
 }
 
+// joinDiscovered syncs with known live nodes that weren't joined, until
+// views contains joinSyncPeers nodes.
+//
+// Returns the IDs of the joined nodes.
+func (g *Gossip) joinDiscovered(views map[string]clusterView) []string {
+	nodes := g.state.LiveNodes()
+	rand.Shuffle(len(nodes), func(i, j int) {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	})
+
+	var joined []string
+	for _, node := range nodes {
+		if len(views) >= joinSyncPeers {
+			break
+		}
+		if _, ok := views[node.ID]; ok {
+			continue
+		}
+
+		nodeID, view, err := g.join(node.Addr)
+		if err != nil {
+			g.logJoinFailure(node.Addr, err)
+			continue
+		}
+		joined = append(joined, nodeID)
+		views[nodeID] = view
+	}
+	return joined
+}
+
+// checkViews cross-checks the views of the cluster received from each joined
+// node and logs any inconsistencies.
+func (g *Gossip) checkViews(views map[string]clusterView) {
+	for _, inconsistency := range compareViews(views, g.state.LocalNodeMetadata().ID) {
+		g.metrics.JoinInconsistencies.Inc()
+		g.logger.Warn(
+			"join: inconsistent cluster views between peers",
+			zap.String("node-id", inconsistency.NodeID),
+			zap.Strings("missing", inconsistency.Missing()),
+			zap.Any("views", inconsistency.Views),
+		)
+	}
+}
+
+func (g *Gossip) logJoinFailure(addr string, err error) {
+	if errors.Is(err, errCorrupted) {
+		g.metrics.CorruptedMessages.WithLabelValues("stream").Inc()
+	}
+	if errors.Is(err, errLimitExceeded) {
+		g.metrics.RejectedMessages.WithLabelValues("stream").Inc()
+	}
+
+	g.logger.Warn(
+		"failed to join node",
+		zap.String("addr", addr),
+		zap.Error(err),
+	)
+}
+
 // Leave gracefully leaves the cluster.
 //
 // This block while it attempts to notify upto 3 nodes in the cluster that the
@@ -193,8 +384,13 @@ func (g *Gossip) Join(addrs []string) ([]string, error) {
 //
 // After the node has left it's state should not be updated again.
 //
-// Returns an error if no nodes could be notified.
+// Returns an error if no nodes could be notified, or ErrClosed if the node
+// has been closed.
 func (g *Gossip) Leave() error {
+	if g.closed.Load() {
+		return ErrClosed
+	}
+
 	g.state.LeaveLocal()
 
 	knownNodes := g.state.Nodes()
@@ -216,7 +412,13 @@ func (g *Gossip) Leave() error {
 			continue
 		}
 
-		if err := g.leave(node.Addr); err != nil {
+		if err := g.leave(node.Addr, g.state.NodeVersion(node.ID)); err != nil {
+			if errors.Is(err, errCorrupted) {
+				g.metrics.CorruptedMessages.WithLabelValues("stream").Inc()
+			}
+			if errors.Is(err, errLimitExceeded) {
+				g.metrics.RejectedMessages.WithLabelValues("stream").Inc()
+			}
 			g.logger.Warn(
 				"failed to send leave to node",
 				zap.String("node-id", node.ID),
@@ -246,6 +448,29 @@ func (g *Gossip) Leave() error {
 	return lastLeaveErr
 }
 
+// Conflicts returns the detected conflicts where multiple nodes are using the
+// same node ID.
+func (g *Gossip) Conflicts() []NodeConflict {
+	return g.state.Conflicts()
+}
+
+// ClockSkew returns the estimated clock skew of each known remote node
+// relative to the local node.
+func (g *Gossip) ClockSkew() []NodeClockSkew {
+	return g.state.ClockSkew()
+}
+
+// CompactLocal compacts the local node state to discard any deleted entries,
+// regardless of the configured compaction threshold.
+//
+// Returns the number of discarded entries, or 0 if there were no deleted
+// entries so the state wasn't compacted.
+func (g *Gossip) CompactLocal() int {
+	return g.state.CompactLocal(1)
+}
+
+// Metrics returns the gossip metrics, which must be registered by the caller
+// to be exported.
 func (g *Gossip) Metrics() *Metrics {
 	return g.metrics
 }
@@ -275,15 +500,19 @@ func (g *Gossip) Close() error {
 // schedule gossips at the configured rate.
 func (g *Gossip) schedule() {
 	go g.scheduleFunc(g.config.Interval, func() {
+		start := time.Now()
 		if err := g.gossipRound(); err != nil {
-			g.logger.Warn("gossip round failed", zap.Error(err))
+			g.metrics.RoundFailures.Inc()
+			g.failureLogger.Warn("gossip round failed", zap.Error(err))
 		}
+		g.metrics.RoundDuration.Observe(time.Since(start).Seconds())
 	})
 	go g.scheduleFunc(g.config.Interval, func() {
 		g.state.UpdateLiveness(float64(suspicionThreshold))
+		g.state.UpdateSyncMetrics()
 	})
 	go g.scheduleFunc(g.config.Interval*10, func() {
-		g.state.CompactLocal(compactThreshold)
+		g.state.CompactLocal(g.config.CompactThreshold)
 	})
 	go g.scheduleFunc(g.config.Interval*10, func() {
 		g.state.RemoveExpired()
@@ -314,12 +543,19 @@ func (g *Gossip) scheduleFunc(interval time.Duration, f func()) {
 
 // gossipRound initiates a round of gossip.
 func (g *Gossip) gossipRound() error {
-	// Select a random live node to gossip with.
+	// Select random live nodes to gossip with.
 	nodes := g.state.LiveNodes()
-	if len(nodes) > 0 {
-		node := nodes[rand.Int()%len(nodes)]
+	rand.Shuffle(len(nodes), func(i, j int) {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	})
+	fanout := g.config.fanoutFor(len(nodes))
+	g.metrics.Fanout.Set(float64(fanout))
+
+	var errs error
+	for _, node := range nodes[:fanout] {
+		// Continue gossiping with the remaining nodes if one fails.
 		if err := g.gossip(node); err != nil {
-			return fmt.Errorf("gossip: %s: %w", node.ID, err)
+			errs = errors.Join(errs, fmt.Errorf("gossip: %s: %w", node.ID, err))
 		}
 	}
 
@@ -332,75 +568,76 @@ func (g *Gossip) gossipRound() error {
 	if len(nodes) > 0 {
 		node := nodes[rand.Int()%len(nodes)]
 		if err := g.gossip(node); err != nil {
-			return fmt.Errorf("gossip: %s: %w", node.ID, err)
+			errs = errors.Join(errs, fmt.Errorf("gossip: %s: %w", node.ID, err))
 		}
 	}
 
-	return nil
+	return errs
 }
 
 func (g *Gossip) gossip(node NodeMetadata) error {
-	var buf bytes.Buffer
-	_ = buf.WriteByte(uint8(messageTypeDigest))
-	_ = buf.WriteByte(supportedVersion)
-
-	encoder := newEncoder(&buf)
+	digest := g.state.Digest()
+	// Shuffle since we may not be able to send all digest entries.
+	rand.Shuffle(len(digest), func(i, j int) {
+		digest[i], digest[j] = digest[j], digest[i]
+	})
 
 	localMeta := g.state.LocalNodeMetadata()
-	if err := encoder.Encode(&digestHeader{
+	b, err := encodeDigest(digestHeader{
 		NodeID:  localMeta.ID,
 		Addr:    localMeta.Addr,
 		Request: true,
-	}); err != nil {
+		SentAt:  time.Now().UnixNano(),
+	}, digest, g.config.MaxPacketSize, g.state.NodeVersion(node.ID))
+	if err != nil {
 		return fmt.Errorf("encode: %w", err)
 	}
 
-	if buf.Len() > g.config.MaxPacketSize {
-		return fmt.Errorf(
-			"max packet size too small for header: %d < %d",
-			g.config.MaxPacketSize, buf.Len(),
-		)
+	if err := g.packetTransport.WriteTo(b, node.Addr); err != nil {
+		return err
 	}
 
-	digest := g.state.Digest()
-	// Shuffle since we may not be able to send all digest entries.
-	rand.Shuffle(len(digest), func(i, j int) {
-		digest[i], digest[j] = digest[j], digest[i]
-	})
+	g.metrics.PacketBytesOutbound.Add(float64(len(b)))
 
-	// Keep appending digest entries until we exceed the max packet size.
-	// bufLen contains the number of bytes to send (which may be less than
-	// buf.Len() if we exceed the packet limit).
-	bufLen := buf.Len()
-	for _, entry := range digest {
-		if err := encoder.Encode(&entry); err != nil {
-			return fmt.Errorf("encode: %w", err)
-		}
+	return nil
+}
 
-		if buf.Len() > g.config.MaxPacketSize {
-			break
-		}
-		bufLen = buf.Len()
+// join attempts to synchronise with the node at the given address.
+//
+// Nodes that don't support the protocol version close the stream as soon as
+// they read the version. So if Config.LegacyProtocol is enabled and the node
+// rejects the stream twice in a row, the join is retried using the legacy
+// version. The first rejection is retried with the current version, in case
+// the stream was closed for another reason such as the node shutting down.
+//
+// Returns the ID of the joined node and its full view of the cluster.
+func (g *Gossip) join(addr string) (string, clusterView, error) {
+	nodeID, view, err := g.joinVersion(addr, supportedVersion)
+	if !g.config.LegacyProtocol || !errors.Is(err, errStreamRejected) {
+		return nodeID, view, err
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", node.Addr)
-	if err != nil {
-		return fmt.Errorf("resolve udp: %s: %w", node.Addr, err)
-	}
-	if _, err = g.packetConn.WriteTo(buf.Bytes()[:bufLen], udpAddr); err != nil {
-		return fmt.Errorf("write packet: %s: %w", node.Addr, err)
+	nodeID, view, err = g.joinVersion(addr, supportedVersion)
+	if !errors.Is(err, errStreamRejected) {
+		return nodeID, view, err
 	}
 
-	g.metrics.PacketBytesOutbound.Add(float64(bufLen))
-
-	return nil
+	g.logger.Info(
+		"join: stream rejected; retrying with legacy version",
+		zap.String("addr", addr),
+	)
+	return g.joinVersion(addr, legacyVersion)
 }
 
-// join attempts to synchronise with the node at the given address.
-func (g *Gossip) join(addr string) (string, error) {
-	conn, err := g.dialer.Dial("tcp", addr)
+// joinVersion attempts to synchronise with the node at the given address
+// using the given protocol version.
+func (g *Gossip) joinVersion(
+	addr string,
+	version uint8,
+) (string, clusterView, error) {
+	conn, err := g.streamTransport.Dial(addr, streamTimeout)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	defer conn.Close()
 
@@ -421,55 +658,105 @@ func (g *Gossip) join(addr string) (string, error) {
 	r := bufio.NewReader(trackedReader)
 	w := bufio.NewWriter(trackedWriter)
 
+	compression := newStreamCompression(g.config.StreamCompression)
+	if version == legacyVersion {
+		compression = streamCompressionNone
+	}
 	if err := w.WriteByte(byte(messageTypeJoin)); err != nil {
-		return "", fmt.Errorf("write: %w", err)
+		return "", nil, fmt.Errorf("write: %w", err)
 	}
-	if err := w.WriteByte(supportedVersion); err != nil {
-		return "", fmt.Errorf("write: %w", err)
+	if err := w.WriteByte(encodeStreamVersion(version, compression)); err != nil {
+		return "", nil, fmt.Errorf("write: %w", err)
 	}
 
-	encoder := newEncoder(w)
+	if g.config.LegacyProtocol && version != legacyVersion {
+		if err := probeStreamVersion(conn, r, w); err != nil {
+			return "", nil, err
+		}
+	}
+
+	encoder := newStreamEncoder(w, version, compression)
 
 	localMeta := g.state.LocalNodeMetadata()
 	if err := encoder.Encode(&joinHeader{
 		NodeID: localMeta.ID,
 		Addr:   localMeta.Addr,
+		Epoch:  localMeta.Epoch,
 	}); err != nil {
-		return "", fmt.Errorf("encode: %w", err)
+		return "", nil, fmt.Errorf("encode: %w", err)
 	}
 
 	if err := encoder.Encode(g.state.LocalDelta()); err != nil {
-		return "", fmt.Errorf("encode: %w", err)
+		return "", nil, fmt.Errorf("encode: %w", err)
 	}
 
-	if err := encoder.Encode(g.state.Digest()); err != nil {
-		return "", fmt.Errorf("encode: %w", err)
+	// Only send the local node in the digest so the node responds with its
+	// full known state, which is cross-checked against other nodes.
+	if err := encoder.Encode(g.state.LocalDigest()); err != nil {
+		return "", nil, fmt.Errorf("encode: %w", err)
 	}
 
 	if err := w.Flush(); err != nil {
-		return "", fmt.Errorf("flush: %w", err)
+		return "", nil, fmt.Errorf("flush: %w", err)
 	}
 
-	decoder := newDecoder(r)
+	decoder := newStreamDecoder(r, version, compression)
 
 	var header joinHeader
 	if err := decoder.Decode(&header); err != nil {
-		return "", fmt.Errorf("decode: %w", err)
+		return "", nil, fmt.Errorf("decode: %w", err)
+	}
+
+	if header.Conflict {
+		g.logger.Error(
+			"join refused; another node is using the local node id",
+			zap.String("node-id", localMeta.ID),
+			zap.String("addr", addr),
+		)
+		return "", nil, fmt.Errorf("%w: %s", ErrNodeIDConflict, localMeta.ID)
 	}
 
 	var delta delta
 	if err := decoder.Decode(&delta); err != nil {
-		return "", fmt.Errorf("decode: %w", err)
+		return "", nil, fmt.Errorf("decode: %w", err)
 	}
 
-	g.state.ApplyDelta(delta)
+	logConflicts(g.state.ApplyDelta(delta), g.logger)
+	g.state.ReportSync(header.NodeID)
 
-	return header.NodeID, nil
+	return header.NodeID, newClusterView(delta), nil
 }
 
-// leave attempts to send our local state to the node at the given address.
-func (g *Gossip) leave(addr string) error {
-	conn, err := g.dialer.Dial("tcp", addr)
+// probeStreamVersion sends the stream header written to w, then waits for
+// the node to reject the protocol version.
+//
+// Nodes that support the version wait for the rest of the stream, whereas
+// nodes that don't close the stream after reading the version. Since only
+// the header has been sent, the node has read everything sent and closes the
+// stream cleanly, so the read fails with io.EOF. Any other error, such as the
+// connection being reset, is a transport error rather than a rejection.
+func probeStreamVersion(conn net.Conn, r *bufio.Reader, w *bufio.Writer) error {
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(legacyProbeTimeout))
+	_, err := r.Peek(1)
+	_ = conn.SetReadDeadline(time.Now().Add(streamTimeout))
+
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("probe: %w: %w", errStreamRejected, err)
+	}
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("probe: %w", err)
+	}
+	return nil
+}
+
+// leave attempts to send our local state to the node at the given address
+// using the given protocol version.
+func (g *Gossip) leave(addr string, version uint8) error {
+	conn, err := g.streamTransport.Dial(addr, streamTimeout)
 	if err != nil {
 		return err
 	}
@@ -492,14 +779,18 @@ func (g *Gossip) leave(addr string) error {
 	r := bufio.NewReader(trackedReader)
 	w := bufio.NewWriter(trackedWriter)
 
+	compression := newStreamCompression(g.config.StreamCompression)
+	if version == legacyVersion {
+		compression = streamCompressionNone
+	}
 	if err := w.WriteByte(byte(messageTypeLeave)); err != nil {
 		return fmt.Errorf("write: %w", err)
 	}
-	if err := w.WriteByte(supportedVersion); err != nil {
+	if err := w.WriteByte(encodeStreamVersion(version, compression)); err != nil {
 		return fmt.Errorf("write: %w", err)
 	}
 
-	encoder := newEncoder(w)
+	encoder := newStreamEncoder(w, version, compression)
 
 	localMeta := g.state.LocalNodeMetadata()
 	if err := encoder.Encode(&joinHeader{
@@ -517,7 +808,7 @@ func (g *Gossip) leave(addr string) error {
 		return fmt.Errorf("flush: %w", err)
 	}
 
-	decoder := newDecoder(r)
+	decoder := newStreamDecoder(r, version, compression)
 
 	// Wait for a header as an acknowledgement.
 	var header leaveHeader
@@ -528,6 +819,25 @@ func (g *Gossip) leave(addr string) error {
 	return nil
 }
 
+// logConflicts logs newly detected node ID conflicts.
+func logConflicts(conflicts []NodeConflict, logger log.Logger) {
+	for _, conflict := range conflicts {
+		msg := "node id conflict; multiple nodes using the same id"
+		if conflict.Local {
+			msg = "node id conflict; another node is using the local node id"
+		}
+		logger.Error(
+			msg,
+			zap.String("node-id", conflict.NodeID),
+			zap.String("addr", conflict.Addr),
+			zap.Uint64("epoch", conflict.Epoch),
+			zap.String("existing-addr", conflict.ExistingAddr),
+			zap.Uint64("existing-epoch", conflict.ExistingEpoch),
+			zap.Bool("younger", conflict.Younger()),
+		)
+	}
+}
+
 // ensurePort adds the configured bind port to addr if addr doesn't already
 // have a port.
 func (g *Gossip) ensurePort(addr string) string {
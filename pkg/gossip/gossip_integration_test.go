@@ -5,8 +5,10 @@ package gossip
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -46,8 +48,8 @@ func TestGossip_Join(t *testing.T) {
 			assert.Equal(
 				t,
 				[]NodeMetadata{
-					{"node-1", node1.LocalNode().Addr, uint64(3), false, false, time.Time{}},
-					{"node-2", node2.LocalNode().Addr, uint64(3), false, false, time.Time{}},
+					{"node-1", node1.LocalNode().Addr, node1.LocalNode().Epoch, 0, uint64(3), false, false, time.Time{}},
+					{"node-2", node2.LocalNode().Addr, node2.LocalNode().Epoch, 0, uint64(3), false, false, time.Time{}},
 				},
 				nodes,
 			)
@@ -64,6 +66,45 @@ func TestGossip_Join(t *testing.T) {
 		_, err := node.Join([]string{"127.1.1.1"})
 		assert.Error(t, err)
 	})
+
+	t.Run("node id conflict", func(t *testing.T) {
+		node1 := testNode("node-1", t)
+		defer node1.Close()
+
+		// Add a second node with the same ID.
+		node2 := testNode("node-1", t)
+		defer node2.Close()
+
+		_, err := node2.Join([]string{node1.LocalNode().Addr})
+		assert.ErrorIs(t, err, ErrNodeIDConflict)
+
+		conflicts := node1.Conflicts()
+		require.Equal(t, 1, len(conflicts))
+		assert.Equal(t, "node-1", conflicts[0].NodeID)
+		assert.Equal(t, node2.LocalNode().Addr, conflicts[0].Addr)
+		assert.True(t, conflicts[0].Local)
+		assert.True(t, conflicts[0].Younger())
+	})
+
+	t.Run("sync discovered nodes", func(t *testing.T) {
+		node1 := testNode("node-1", t)
+		defer node1.Close()
+
+		node2 := testNode("node-2", t)
+		defer node2.Close()
+
+		_, err := node2.Join([]string{node1.LocalNode().Addr})
+		require.NoError(t, err)
+
+		node3 := testNode("node-3", t)
+		defer node3.Close()
+
+		// Joining via node-1 should also sync with node-2, which was
+		// discovered from node-1.
+		nodeIDs, err := node3.Join([]string{node1.LocalNode().Addr})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"node-1", "node-2"}, nodeIDs)
+	})
 }
 
 func TestGossip_Leave(t *testing.T) {
@@ -109,6 +150,18 @@ func TestGossip_Leave(t *testing.T) {
 
 		assert.Error(t, node2.Leave())
 	})
+
+	t.Run("closed", func(t *testing.T) {
+		node1 := testNode("node-1", t)
+		defer node1.Close()
+
+		node2 := testNode("node-2", t)
+		node2.Close()
+
+		_, err := node2.Join([]string{node1.LocalNode().Addr})
+		assert.ErrorIs(t, err, ErrClosed)
+		assert.ErrorIs(t, node2.Leave(), ErrClosed)
+	})
 }
 
 func TestGossip_Gossip(t *testing.T) {
@@ -181,6 +234,229 @@ func TestGossip_NodeUnreachable(t *testing.T) {
 	})
 }
 
+// Tests gossiping with nodes that only support the legacy protocol version,
+// such as during a rolling upgrade.
+func TestGossip_LegacyVersion(t *testing.T) {
+	legacyConfig := testConfig()
+	legacyConfig.LegacyProtocol = true
+
+	// legacyJoin joins the node at addr using the legacy version, where
+	// messages are encoded directly to the stream.
+	legacyJoin := func(addr string, legacyAddr string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte{byte(messageTypeJoin), legacyVersion})
+		require.NoError(t, err)
+		encoder := newEncoder(conn)
+		require.NoError(t, encoder.Encode(&joinHeader{
+			NodeID: "legacy",
+			Addr:   legacyAddr,
+		}))
+		require.NoError(t, encoder.Encode(delta{
+			{
+				ID:   "legacy",
+				Addr: legacyAddr,
+				Entries: []Entry{
+					{"k1", "v1", 1, false, false},
+				},
+			},
+		}))
+		require.NoError(t, encoder.Encode(digest{}))
+
+		var header joinHeader
+		if err := newLegacyDecoder(conn, maxFrameSize).Decode(&header); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	t.Run("legacy node joins", func(t *testing.T) {
+		node1 := testNodeWithConfig("node-1", legacyConfig, newNopWatcher(), t)
+		defer node1.Close()
+
+		legacyStreamLn, legacyPacketLn := testListen(t)
+		defer legacyStreamLn.Close()
+		defer legacyPacketLn.Close()
+
+		conn, err := legacyJoin(
+			node1.LocalNode().Addr, legacyStreamLn.Addr().String(),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		state, ok := node1.Node("legacy")
+		require.True(t, ok)
+		assert.Equal(t, "v1", state.Entries[0].Value)
+
+		// The node must gossip with the legacy node using legacy packets.
+		_ = legacyPacketLn.SetReadDeadline(time.Now().Add(time.Second * 10))
+		buf := make([]byte, 1400)
+		n, _, err := legacyPacketLn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, legacyVersion, buf[1])
+		packetHeader, _, err := decodeDigest(buf[:n], true)
+		require.NoError(t, err)
+		assert.Equal(t, "node-1", packetHeader.NodeID)
+	})
+
+	t.Run("legacy node joins disabled", func(t *testing.T) {
+		node1 := testNode("node-1", t)
+		defer node1.Close()
+
+		// The node closes legacy streams without responding.
+		_, err := legacyJoin(node1.LocalNode().Addr, "127.0.0.1:1")
+		assert.ErrorIs(t, err, io.EOF)
+
+		_, ok := node1.Node("legacy")
+		assert.False(t, ok)
+	})
+
+	t.Run("join legacy node", func(t *testing.T) {
+		node1 := testNodeWithConfig("node-1", legacyConfig, newNopWatcher(), t)
+		defer node1.Close()
+
+		legacy := newLegacyJoinServer(t, false)
+		defer legacy.Close()
+
+		nodeIDs, err := node1.Join([]string{legacy.Addr()})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"legacy"}, nodeIDs)
+
+		// The join is retried once with the current version before
+		// falling back to the legacy version.
+		assert.Equal(t, []uint8{
+			supportedVersion, supportedVersion, legacyVersion,
+		}, legacy.Versions())
+
+		// The version of the node isn't recorded from the join, and is
+		// only updated once the node gossips with the local node.
+		assert.Equal(t, supportedVersion, node1.state.NodeVersion("legacy"))
+	})
+
+	t.Run("join legacy node disabled", func(t *testing.T) {
+		node1 := testNode("node-1", t)
+		defer node1.Close()
+
+		legacy := newLegacyJoinServer(t, false)
+		defer legacy.Close()
+
+		_, err := node1.Join([]string{legacy.Addr()})
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, errStreamRejected)
+
+		// Never falls back to the legacy version.
+		assert.Equal(t, []uint8{supportedVersion}, legacy.Versions())
+	})
+
+	t.Run("join connection reset", func(t *testing.T) {
+		node1 := testNodeWithConfig("node-1", legacyConfig, newNopWatcher(), t)
+		defer node1.Close()
+
+		legacy := newLegacyJoinServer(t, true)
+		defer legacy.Close()
+
+		_, err := node1.Join([]string{legacy.Addr()})
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, errStreamRejected)
+
+		// A reset connection is a transport error, so doesn't fall back to
+		// the legacy version.
+		assert.Equal(t, []uint8{supportedVersion}, legacy.Versions())
+	})
+}
+
+// legacyJoinServer handles join streams like a node that only supports the
+// legacy protocol version, so closes streams using any other version.
+type legacyJoinServer struct {
+	ln net.Listener
+
+	// reset indicates whether to reset rejected connections rather than
+	// closing them cleanly.
+	reset bool
+
+	versions []uint8
+	mu       sync.Mutex
+}
+
+func newLegacyJoinServer(t *testing.T, reset bool) *legacyJoinServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &legacyJoinServer{
+		ln:    ln,
+		reset: reset,
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *legacyJoinServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Versions returns the version of each received stream.
+func (s *legacyJoinServer) Versions() []uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint8(nil), s.versions...)
+}
+
+func (s *legacyJoinServer) Close() {
+	s.ln.Close()
+}
+
+func (s *legacyJoinServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.versions = append(s.versions, b[1])
+	s.mu.Unlock()
+
+	if b[1] != legacyVersion {
+		if s.reset {
+			_ = conn.(*net.TCPConn).SetLinger(0)
+		}
+		return
+	}
+
+	decoder := newLegacyDecoder(conn, maxFrameSize)
+	var header joinHeader
+	var joinDelta delta
+	var joinDigest digest
+	if decoder.Decode(&header) != nil ||
+		decoder.Decode(&joinDelta) != nil ||
+		decoder.Decode(&joinDigest) != nil {
+		return
+	}
+
+	encoder := newEncoder(conn)
+	_ = encoder.Encode(&joinHeader{
+		NodeID: "legacy",
+		Addr:   conn.LocalAddr().String(),
+	})
+	_ = encoder.Encode(delta{
+		{
+			ID:   "legacy",
+			Addr: conn.LocalAddr().String(),
+		},
+	})
+}
+
 type updateEvent struct {
 	NodeID string
 	Key    string
@@ -282,17 +558,28 @@ func testNode(nodeID string, t *testing.T) *Gossip {
 }
 
 func testNodeWithWatcher(nodeID string, w Watcher, t *testing.T) *Gossip {
+	return testNodeWithConfig(nodeID, testConfig(), w, t)
+}
+
+func testNodeWithConfig(
+	nodeID string,
+	conf *Config,
+	w Watcher,
+	t *testing.T,
+) *Gossip {
 	streamLn, packetLn := testListen(t)
-	nodeConfig := testConfig()
+	nodeConfig := *conf
 	nodeConfig.AdvertiseAddr = streamLn.Addr().String()
-	return New(
-		nodeID,
-		nodeConfig,
-		streamLn,
-		packetLn,
-		w,
-		log.NewNopLogger(),
-	)
+	gossip, err := New(Options{
+		NodeID:          nodeID,
+		Config:          &nodeConfig,
+		StreamTransport: NewTCPTransport(streamLn),
+		PacketTransport: NewUDPTransport(packetLn),
+		Watcher:         w,
+		Logger:          log.NewNopLogger(),
+	})
+	require.NoError(t, err)
+	return gossip
 }
 
 func testListen(t *testing.T) (net.Listener, net.PacketConn) {
@@ -310,8 +597,10 @@ func testListen(t *testing.T) (net.Listener, net.PacketConn) {
 
 func testConfig() *Config {
 	return &Config{
-		BindAddr:      "127.0.0.1:0",
-		Interval:      time.Millisecond * 10,
-		MaxPacketSize: 1400,
+		BindAddr:         "127.0.0.1:0",
+		Interval:         time.Millisecond * 10,
+		Fanout:           1,
+		MaxPacketSize:    1400,
+		CompactThreshold: 100,
 	}
 }
@@ -0,0 +1,74 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew_InvalidOptions(t *testing.T) {
+	network := newMemStreamNetwork()
+	packetNetwork := newMemNetwork(0)
+	conf := &Config{
+		BindAddr:         "10.0.0.1:8003",
+		AdvertiseAddr:    "10.0.0.1:8003",
+		Interval:         time.Hour,
+		Fanout:           1,
+		MaxPacketSize:    1400,
+		CompactThreshold: 100,
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{
+			name: "missing node id",
+			opts: Options{
+				Config:          conf,
+				StreamTransport: network.Transport("10.0.0.1:8003"),
+				PacketTransport: packetNetwork.Transport("10.0.0.1:8003"),
+			},
+		},
+		{
+			name: "missing config",
+			opts: Options{
+				NodeID:          "node-1",
+				StreamTransport: network.Transport("10.0.0.1:8003"),
+				PacketTransport: packetNetwork.Transport("10.0.0.1:8003"),
+			},
+		},
+		{
+			name: "invalid config",
+			opts: Options{
+				NodeID:          "node-1",
+				Config:          &Config{},
+				StreamTransport: network.Transport("10.0.0.1:8003"),
+				PacketTransport: packetNetwork.Transport("10.0.0.1:8003"),
+			},
+		},
+		{
+			name: "missing stream transport",
+			opts: Options{
+				NodeID:          "node-1",
+				Config:          conf,
+				PacketTransport: packetNetwork.Transport("10.0.0.1:8003"),
+			},
+		},
+		{
+			name: "missing packet transport",
+			opts: Options{
+				NodeID:          "node-1",
+				Config:          conf,
+				StreamTransport: network.Transport("10.0.0.1:8003"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.opts)
+			assert.ErrorIs(t, err, ErrInvalidOptions)
+		})
+	}
+}
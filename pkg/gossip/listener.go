@@ -17,42 +17,53 @@ import (
 // streamListener listens for incoming stream connections and reads messages
 // from those connections.
 type streamListener struct {
-	ln net.Listener
+	transport StreamTransport
 
 	state *clusterState
 
 	streamTimeout time.Duration
 
+	// legacyProtocol indicates whether to accept streams using the legacy
+	// protocol version.
+	legacyProtocol bool
+
 	metrics *Metrics
 
+	// failureLogger logs repeated failures.
+	failureLogger log.Logger
+
 	logger log.Logger
 }
 
 func newStreamListener(
-	ln net.Listener,
+	transport StreamTransport,
 	state *clusterState,
 	streamTimeout time.Duration,
+	legacyProtocol bool,
 	metrics *Metrics,
 	logger log.Logger,
 ) *streamListener {
 	return &streamListener{
-		ln:            ln,
-		state:         state,
-		streamTimeout: streamTimeout,
-		metrics:       metrics,
-		logger:        logger,
+		transport:      transport,
+		state:          state,
+		streamTimeout:  streamTimeout,
+		legacyProtocol: legacyProtocol,
+		metrics:        metrics,
+		failureLogger:  newFailureLogger(logger),
+		logger:         logger,
 	}
 }
 
 // Serve will accept connections until listener is closed.
 func (l *streamListener) Serve() {
 	for {
-		conn, err := l.ln.Accept()
+		conn, err := l.transport.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
-			l.logger.Warn("failed to accept connection", zap.Error(err))
+			l.metrics.StreamFailures.Inc()
+			l.failureLogger.Warn("failed to accept connection", zap.Error(err))
 			continue
 		}
 
@@ -65,7 +76,14 @@ func (l *streamListener) Serve() {
 
 		go func() {
 			if err := l.handleConn(conn); err != nil {
-				l.logger.Warn(
+				l.metrics.StreamFailures.Inc()
+				if errors.Is(err, errCorrupted) {
+					l.metrics.CorruptedMessages.WithLabelValues("stream").Inc()
+				}
+				if errors.Is(err, errLimitExceeded) {
+					l.metrics.RejectedMessages.WithLabelValues("stream").Inc()
+				}
+				l.failureLogger.Warn(
 					"failed to handle connection",
 					zap.String("addr", conn.RemoteAddr().String()),
 					zap.Error(err),
@@ -76,7 +94,7 @@ func (l *streamListener) Serve() {
 }
 
 func (l *streamListener) Close() error {
-	return l.ln.Close()
+	return l.transport.Close()
 }
 
 func (l *streamListener) handleConn(conn net.Conn) error {
@@ -107,22 +125,30 @@ func (l *streamListener) handleConn(conn net.Conn) error {
 	if err != nil {
 		return fmt.Errorf("read: %w", err)
 	}
-	if version != supportedVersion {
-		return fmt.Errorf("unsupported version: %d", version)
+	// Respond using the same version and compression as the node that
+	// opened the stream.
+	version, compression, err := decodeStreamVersion(version, l.legacyProtocol)
+	if err != nil {
+		return err
 	}
 
 	switch messageType {
 	case messageTypeJoin:
-		return l.join(r, w)
+		return l.join(r, w, version, compression)
 	case messageTypeLeave:
-		return l.leave(r, w)
+		return l.leave(r, w, version, compression)
 	default:
 		return fmt.Errorf("unsupported message type: %d", version)
 	}
 }
 
-func (l *streamListener) join(r io.Reader, w *bufio.Writer) error {
-	decoder := newDecoder(r)
+func (l *streamListener) join(
+	r io.Reader,
+	w *bufio.Writer,
+	version uint8,
+	compression streamCompression,
+) error {
+	decoder := newStreamDecoder(r, version, compression)
 	var header joinHeader
 	if err := decoder.Decode(&header); err != nil {
 		return fmt.Errorf("decode: %w", err)
@@ -136,17 +162,49 @@ func (l *streamListener) join(r io.Reader, w *bufio.Writer) error {
 		return fmt.Errorf("decode: %w", err)
 	}
 
+	localMeta := l.state.LocalNodeMetadata()
+	encoder := newStreamEncoder(w, version, compression)
+
+	accept, conflict := l.state.CheckJoin(
+		header.NodeID, header.Addr, header.Epoch,
+	)
+	if conflict != nil {
+		logConflicts([]NodeConflict{*conflict}, l.logger)
+	}
+	if !accept {
+		l.logger.Error(
+			"refused join; node id conflict",
+			zap.String("node-id", header.NodeID),
+			zap.String("addr", header.Addr),
+		)
+
+		// Respond with a conflict rather than exchanging state, since we
+		// can't merge the state of two nodes with the same ID.
+		if err := encoder.Encode(&joinHeader{
+			NodeID:   localMeta.ID,
+			Addr:     localMeta.Addr,
+			Epoch:    localMeta.Epoch,
+			Conflict: true,
+		}); err != nil {
+			return fmt.Errorf("encode: %w", err)
+		}
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("flush: %w", err)
+		}
+		return nil
+	}
+
 	// Apply unknown state from the delta.
-	l.state.ApplyDelta(delta)
+	logConflicts(l.state.ApplyDelta(delta), l.logger)
+	l.state.ReportVersion(header.NodeID, version)
 
 	// Discover any unknown nodes from the digest.
-	l.state.ApplyDigest(digest)
+	logConflicts(l.state.ApplyDigest(digest), l.logger)
 
-	localMeta := l.state.LocalNodeMetadata()
-	encoder := newEncoder(w)
 	if err := encoder.Encode(&joinHeader{
 		NodeID: localMeta.ID,
 		Addr:   localMeta.Addr,
+		Epoch:  localMeta.Epoch,
 	}); err != nil {
 		return fmt.Errorf("encode: %w", err)
 	}
@@ -164,8 +222,13 @@ func (l *streamListener) join(r io.Reader, w *bufio.Writer) error {
 	return nil
 }
 
-func (l *streamListener) leave(r io.Reader, w *bufio.Writer) error {
-	decoder := newDecoder(r)
+func (l *streamListener) leave(
+	r io.Reader,
+	w *bufio.Writer,
+	version uint8,
+	compression streamCompression,
+) error {
+	decoder := newStreamDecoder(r, version, compression)
 	var header leaveHeader
 	if err := decoder.Decode(&header); err != nil {
 		return fmt.Errorf("decode: %w", err)
@@ -176,11 +239,11 @@ func (l *streamListener) leave(r io.Reader, w *bufio.Writer) error {
 	}
 
 	// Apply unknown state from the delta.
-	l.state.ApplyDelta(delta)
+	logConflicts(l.state.ApplyDelta(delta), l.logger)
 
 	// Send our own header as an acknowledgement.
 	localMeta := l.state.LocalNodeMetadata()
-	encoder := newEncoder(w)
+	encoder := newStreamEncoder(w, version, compression)
 	if err := encoder.Encode(&leaveHeader{
 		NodeID: localMeta.ID,
 		Addr:   localMeta.Addr,
@@ -197,7 +260,7 @@ func (l *streamListener) leave(r io.Reader, w *bufio.Writer) error {
 
 // packetListener listens for and handles incoming packets.
 type packetListener struct {
-	ln net.PacketConn
+	transport PacketTransport
 
 	state *clusterState
 
@@ -207,38 +270,55 @@ type packetListener struct {
 
 	maxPacketSize int
 
+	// clockSkewThreshold is the clock skew of a remote node to log a
+	// warning, or zero to disable.
+	clockSkewThreshold time.Duration
+
+	// legacyProtocol indicates whether to accept packets using the legacy
+	// protocol version.
+	legacyProtocol bool
+
 	metrics *Metrics
 
+	// failureLogger logs repeated failures.
+	failureLogger log.Logger
+
 	logger log.Logger
 }
 
 func newPacketListener(
-	ln net.PacketConn,
+	transport PacketTransport,
 	state *clusterState,
 	failureDetector failureDetector,
 	maxPacketSize int,
+	clockSkewThreshold time.Duration,
+	legacyProtocol bool,
 	metrics *Metrics,
 	logger log.Logger,
 ) *packetListener {
 	return &packetListener{
-		ln:              ln,
-		state:           state,
-		failureDetector: failureDetector,
-		readBuf:         make([]byte, maxPacketSize),
-		maxPacketSize:   maxPacketSize,
-		metrics:         metrics,
-		logger:          logger,
+		transport:          transport,
+		state:              state,
+		failureDetector:    failureDetector,
+		readBuf:            make([]byte, maxPacketSize),
+		maxPacketSize:      maxPacketSize,
+		clockSkewThreshold: clockSkewThreshold,
+		legacyProtocol:     legacyProtocol,
+		metrics:            metrics,
+		failureLogger:      newFailureLogger(logger),
+		logger:             logger,
 	}
 }
 
 func (l *packetListener) Serve() {
 	for {
-		n, addr, err := l.ln.ReadFrom(l.readBuf)
+		n, addr, err := l.transport.ReadFrom(l.readBuf)
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
-			l.logger.Warn("failed to read packet", zap.Error(err))
+			l.metrics.PacketFailures.Inc()
+			l.failureLogger.Warn("failed to read packet", zap.Error(err))
 			continue
 		}
 
@@ -246,9 +326,16 @@ func (l *packetListener) Serve() {
 
 		buf := l.readBuf[:n]
 		if err = l.handlePacket(buf); err != nil {
-			l.logger.Warn(
+			l.metrics.PacketFailures.Inc()
+			if errors.Is(err, errCorrupted) {
+				l.metrics.CorruptedMessages.WithLabelValues("packet").Inc()
+			}
+			if errors.Is(err, errLimitExceeded) {
+				l.metrics.RejectedMessages.WithLabelValues("packet").Inc()
+			}
+			l.failureLogger.Warn(
 				"failed to handle packet",
-				zap.String("addr", addr.String()),
+				zap.String("addr", addr),
 				zap.Error(err),
 			)
 		}
@@ -256,7 +343,7 @@ func (l *packetListener) Serve() {
 }
 
 func (l *packetListener) Close() error {
-	return l.ln.Close()
+	return l.transport.Close()
 }
 
 func (l *packetListener) handlePacket(b []byte) error {
@@ -266,13 +353,13 @@ func (l *packetListener) handlePacket(b []byte) error {
 
 	messageType := messageType(b[0])
 	version := b[1]
-	if version != supportedVersion {
+	if version != supportedVersion && (!l.legacyProtocol || version != legacyVersion) {
 		return fmt.Errorf("unsupported version: %d", version)
 	}
 
 	switch messageType {
 	case messageTypeDigest:
-		return l.digest(b)
+		return l.digest(b, version)
 	case messageTypeDelta:
 		return l.delta(b)
 	default:
@@ -280,26 +367,55 @@ func (l *packetListener) handlePacket(b []byte) error {
 	}
 }
 
-func (l *packetListener) digest(b []byte) error {
-	header, digest, err := decodeDigest(b)
+// digest handles a digest packet, responding using the same protocol version
+// as the sender.
+func (l *packetListener) digest(b []byte, version uint8) error {
+	header, digest, err := decodeDigest(b, l.legacyProtocol)
 	if err != nil {
 		return fmt.Errorf("decode: %w", err)
 	}
+	receivedAt := time.Now()
+
+	incarnation := l.state.LocalNodeMetadata().Incarnation
 
 	// Discover any unknown nodes from the digest.
-	l.state.ApplyDigest(digest)
+	logConflicts(l.state.ApplyDigest(digest), l.logger)
+	// Only record the version of digests the sender initiated. Responses use
+	// the version of our own request, so recording them would keep a node
+	// that was sent a legacy request on the legacy version.
+	if header.Request {
+		l.state.ReportVersion(header.NodeID, version)
+	}
+
+	if header.SentAt != 0 {
+		l.reportClockSkew(header.NodeID, time.Unix(0, header.SentAt), receivedAt)
+	}
+
+	// If the sender suspects the local node is unreachable, we'll have
+	// incremented our incarnation to refute the suspicion.
+	refuted := l.state.LocalNodeMetadata().Incarnation > incarnation
+	if refuted {
+		l.logger.Info(
+			"refuted suspicion",
+			zap.String("node-id", header.NodeID),
+			zap.Uint64("incarnation", l.state.LocalNodeMetadata().Incarnation),
+		)
+	}
 
 	delta := l.state.Delta(digest, false)
-	if err := l.sendDelta(delta, header.Addr); err != nil {
+	if err := l.sendDelta(delta, header.Addr, version); err != nil {
 		return fmt.Errorf("send delta: %w", err)
 	}
 
-	// If the digest was a request, send our own digest response.
-	if header.Request {
+	// If the digest was a request, send our own digest response. Or if we
+	// refuted a suspicion, send our digest so the sender learns our new
+	// incarnation immediately.
+	if header.Request || refuted {
 		if err := l.sendDigest(
 			l.state.Digest(),
 			header.Addr,
 			false,
+			version,
 		); err != nil {
 			return fmt.Errorf("send digest: %w", err)
 		}
@@ -308,38 +424,65 @@ func (l *packetListener) digest(b []byte) error {
 	return nil
 }
 
+// reportClockSkew updates the estimated clock skew of the node with the given
+// ID, and logs when the skew crosses the configured threshold.
+func (l *packetListener) reportClockSkew(
+	nodeID string,
+	sentAt time.Time,
+	receivedAt time.Time,
+) {
+	skew, crossed := l.state.ReportClockSkew(
+		nodeID, sentAt, receivedAt, l.clockSkewThreshold,
+	)
+	if !crossed {
+		return
+	}
+	if skew.Exceeded {
+		l.logger.Warn(
+			"clock skew exceeded threshold",
+			zap.String("node-id", nodeID),
+			zap.Duration("skew", skew.Skew),
+			zap.Duration("threshold", l.clockSkewThreshold),
+		)
+	} else {
+		l.logger.Info(
+			"clock skew recovered",
+			zap.String("node-id", nodeID),
+			zap.Duration("skew", skew.Skew),
+			zap.Duration("threshold", l.clockSkewThreshold),
+		)
+	}
+}
+
 func (l *packetListener) delta(b []byte) error {
-	header, delta, err := decodeDelta(b)
+	header, delta, err := decodeDelta(b, l.legacyProtocol)
 	if err != nil {
 		return fmt.Errorf("decode: %w", err)
 	}
 
 	l.failureDetector.Report(header.NodeID)
 
-	l.state.ApplyDelta(delta)
+	logConflicts(l.state.ApplyDelta(delta), l.logger)
+	l.state.ReportSync(header.NodeID)
 
 	return nil
 }
 
 // sendDelta writes entries from the given delta upto the packet size limit.
-func (l *packetListener) sendDelta(delta delta, addr string) error {
+func (l *packetListener) sendDelta(delta delta, addr string, version uint8) error {
 	localMeta := l.state.LocalNodeMetadata()
 
 	header := deltaHeader{
 		NodeID: localMeta.ID,
 		Addr:   localMeta.Addr,
 	}
-	b, err := encodeDelta(header, delta, l.maxPacketSize)
+	b, err := encodeDelta(header, delta, l.maxPacketSize, version)
 	if err != nil {
 		return fmt.Errorf("encode: %w", err)
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return fmt.Errorf("resolve udp: %s: %w", addr, err)
-	}
-	if _, err = l.ln.WriteTo(b, udpAddr); err != nil {
-		return fmt.Errorf("write packet: %s: %w", addr, err)
+	if err = l.transport.WriteTo(b, addr); err != nil {
+		return err
 	}
 
 	l.metrics.PacketBytesOutbound.Add(float64(len(b)))
@@ -351,6 +494,7 @@ func (l *packetListener) sendDigest(
 	digest digest,
 	addr string,
 	request bool,
+	version uint8,
 ) error {
 	// Shuffle since we may not be able to send all digest entries.
 	rand.Shuffle(len(digest), func(i, j int) {
@@ -362,18 +506,15 @@ func (l *packetListener) sendDigest(
 		NodeID:  localMeta.ID,
 		Addr:    localMeta.Addr,
 		Request: request,
+		SentAt:  time.Now().UnixNano(),
 	}
-	b, err := encodeDigest(header, digest, l.maxPacketSize)
+	b, err := encodeDigest(header, digest, l.maxPacketSize, version)
 	if err != nil {
 		return fmt.Errorf("encode: %w", err)
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return fmt.Errorf("resolve udp: %s: %w", addr, err)
-	}
-	if _, err = l.ln.WriteTo(b, udpAddr); err != nil {
-		return fmt.Errorf("write packet: %s: %w", addr, err)
+	if err = l.transport.WriteTo(b, addr); err != nil {
+		return err
 	}
 
 	l.metrics.PacketBytesOutbound.Add(float64(len(b)))
@@ -0,0 +1,19 @@
+package gossip
+
+import (
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// newFailureLogger returns a logger that deduplicates repeated failures.
+//
+// The first occurrence of a message is logged, then any repeated messages
+// within failureLogInterval are suppressed and the number suppressed is
+// logged at the end of the interval. So when a failure persists, such as a
+// node being down, the message is logged at most once per interval rather
+// than every gossip round.
+func newFailureLogger(logger log.Logger) log.Logger {
+	return log.NewSampledLogger(logger, log.SamplingConfig{
+		Limit:    1,
+		Interval: failureLogInterval,
+	})
+}
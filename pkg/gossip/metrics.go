@@ -30,6 +30,70 @@ type Metrics struct {
 	// Entries is the number of entries labelled by node_id, deleted and
 	// internal.
 	Entries *prometheus.GaugeVec
+
+	// RoundDuration is the duration of each gossip round.
+	RoundDuration prometheus.Histogram
+
+	// RoundFailures is the total number of failed gossip rounds.
+	RoundFailures prometheus.Counter
+
+	// StreamFailures is the total number of incoming stream connections
+	// that failed to be accepted or handled.
+	StreamFailures prometheus.Counter
+
+	// PacketFailures is the total number of incoming packets that failed to
+	// be read or handled.
+	PacketFailures prometheus.Counter
+
+	// CorruptedMessages is the total number of received messages that were
+	// dropped as they were truncated or didn't match their checksum,
+	// labelled by transport ('packet' or 'stream').
+	CorruptedMessages *prometheus.CounterVec
+
+	// RejectedMessages is the total number of received messages that were
+	// dropped as they exceeded the decode limits, labelled by transport
+	// ('packet' or 'stream').
+	RejectedMessages *prometheus.CounterVec
+
+	// Compactions is the total number of local state compactions.
+	Compactions prometheus.Counter
+
+	// CompactedEntries is the total number of entries discarded by local
+	// state compactions.
+	CompactedEntries prometheus.Counter
+
+	// NodeConflicts is the total number of detected node ID conflicts.
+	NodeConflicts prometheus.Counter
+
+	// Refutations is the total number of suspicions the local node refuted.
+	Refutations prometheus.Counter
+
+	// JoinInconsistencies is the total number of nodes whose state differed
+	// between the peers synced with when joining.
+	JoinInconsistencies prometheus.Counter
+
+	// Fanout is the number of live nodes gossiped with in the last round.
+	Fanout prometheus.Gauge
+
+	// ConvergenceLag is the maximum version delta between the local state
+	// and the last digest received, across all nodes in the digest.
+	ConvergenceLag prometheus.Gauge
+
+	// DigestVersionDelta is the maximum version delta between the local
+	// state and each received digest.
+	DigestVersionDelta prometheus.Histogram
+
+	// PeerSyncAge is the number of seconds since each node last synced with
+	// the local node, labelled by node_id.
+	PeerSyncAge *prometheus.GaugeVec
+
+	// ClockSkew is the estimated clock skew in seconds of each node relative
+	// to the local node, labelled by node_id.
+	ClockSkew *prometheus.GaugeVec
+
+	// UnacknowledgedUpdateAge is the age in seconds of the oldest local
+	// update that no other node has acknowledged.
+	UnacknowledgedUpdateAge prometheus.Gauge
 }
 
 func newMetrics() *Metrics {
@@ -91,6 +155,148 @@ func newMetrics() *Metrics {
 			},
 			[]string{"node_id", "deleted", "internal"},
 		),
+		RoundDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "round_duration_seconds",
+				Help:      "Gossip round duration",
+				Buckets:   []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+			},
+		),
+		RoundFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "round_failures_total",
+				Help:      "Total number of failed gossip rounds",
+			},
+		),
+		StreamFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "stream_failures_total",
+				Help:      "Total number of incoming stream connections that failed",
+			},
+		),
+		PacketFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "packet_failures_total",
+				Help:      "Total number of incoming packets that failed",
+			},
+		),
+		CorruptedMessages: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "corrupted_messages_total",
+				Help:      "Total number of received messages dropped as truncated or corrupted",
+			},
+			[]string{"transport"},
+		),
+		RejectedMessages: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "rejected_messages_total",
+				Help:      "Total number of received messages dropped as they exceeded the decode limits",
+			},
+			[]string{"transport"},
+		),
+		Compactions: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "compactions_total",
+				Help:      "Total number of local state compactions",
+			},
+		),
+		CompactedEntries: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "compacted_entries_total",
+				Help:      "Total number of entries discarded by local state compactions",
+			},
+		),
+		NodeConflicts: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "node_conflicts_total",
+				Help:      "Total number of detected node ID conflicts",
+			},
+		),
+		Refutations: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "refutations_total",
+				Help:      "Total number of suspicions refuted by the local node",
+			},
+		),
+		JoinInconsistencies: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "join_inconsistencies_total",
+				Help:      "Total number of nodes whose state differed between peers when joining",
+			},
+		),
+		Fanout: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "fanout",
+				Help:      "Number of live nodes gossiped with in the last round",
+			},
+		),
+		ConvergenceLag: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "convergence_lag",
+				Help:      "Maximum version delta between the local state and the last received digest",
+			},
+		),
+		DigestVersionDelta: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "digest_version_delta",
+				Help:      "Maximum version delta between the local state and each received digest",
+				Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+			},
+		),
+		PeerSyncAge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "peer_sync_age_seconds",
+				Help:      "Number of seconds since each node last synced with the local node",
+			},
+			[]string{"node_id"},
+		),
+		ClockSkew: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "clock_skew_seconds",
+				Help:      "Estimated clock skew in seconds of each node relative to the local node",
+			},
+			[]string{"node_id"},
+		),
+		UnacknowledgedUpdateAge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "unacknowledged_update_age_seconds",
+				Help:      "Age of the oldest local update not acknowledged by another node",
+			},
+		),
 	}
 }
 
@@ -103,5 +309,22 @@ func (m *Metrics) Register(reg *prometheus.Registry) {
 		m.StreamBytesOutbound,
 		m.PacketBytesOutbound,
 		m.Entries,
+		m.RoundDuration,
+		m.RoundFailures,
+		m.StreamFailures,
+		m.PacketFailures,
+		m.CorruptedMessages,
+		m.RejectedMessages,
+		m.Compactions,
+		m.CompactedEntries,
+		m.NodeConflicts,
+		m.Refutations,
+		m.JoinInconsistencies,
+		m.Fanout,
+		m.ConvergenceLag,
+		m.DigestVersionDelta,
+		m.PeerSyncAge,
+		m.ClockSkew,
+		m.UnacknowledgedUpdateAge,
 	)
 }
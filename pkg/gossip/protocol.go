@@ -2,8 +2,12 @@ package gossip
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 
 	"github.com/ugorji/go/codec"
@@ -34,9 +38,214 @@ func (t messageType) String() string {
 }
 
 const (
-	supportedVersion uint8 = 0
+	// supportedVersion is the protocol version. Version 1 added checksums to
+	// packets and stream frames.
+	supportedVersion uint8 = 1
+
+	// legacyVersion is the protocol version before checksums were added,
+	// where packets have no checksum and stream messages are encoded
+	// directly to the stream without frames or compression.
+	//
+	// If Config.LegacyProtocol is enabled, messages using the legacy version
+	// are accepted and legacy nodes are sent legacy messages, so a cluster can
+	// be upgraded one node at a time. Support for the legacy version will be
+	// removed in the next release.
+	legacyVersion uint8 = 0
+
+	// versionMask is the bits of the stream version byte containing the
+	// protocol version. The remaining bits contain flags negotiating
+	// optional stream features.
+	versionMask uint8 = 0x0f
+
+	// compressionMask is the flag bits of the stream version byte
+	// containing the compression of the stream messages.
+	compressionMask uint8 = 0x30
 )
 
+// streamCompression is the compression of stream message payloads, encoded
+// in the flag bits of the stream version byte.
+type streamCompression uint8
+
+const (
+	streamCompressionNone    streamCompression = 0x00
+	streamCompressionGzip    streamCompression = 0x10
+	streamCompressionDeflate streamCompression = 0x20
+)
+
+func newStreamCompression(c Compression) streamCompression {
+	switch c {
+	case CompressionGzip:
+		return streamCompressionGzip
+	case CompressionDeflate:
+		return streamCompressionDeflate
+	default:
+		return streamCompressionNone
+	}
+}
+
+func (c streamCompression) String() string {
+	switch c {
+	case streamCompressionNone:
+		return string(CompressionNone)
+	case streamCompressionGzip:
+		return string(CompressionGzip)
+	case streamCompressionDeflate:
+		return string(CompressionDeflate)
+	default:
+		return "unknown"
+	}
+}
+
+// encodeStreamVersion returns the version byte sent at the start of a
+// stream, containing the protocol version and the compression of the stream
+// messages.
+//
+// Legacy streams don't support compression, so the compression is ignored
+// for the legacy version.
+func encodeStreamVersion(version uint8, compression streamCompression) uint8 {
+	if version == legacyVersion {
+		return legacyVersion
+	}
+	return version | uint8(compression)
+}
+
+// decodeStreamVersion decodes the version byte sent at the start of a
+// stream, returning the protocol version and the compression of the stream
+// messages. legacy indicates whether to accept the legacy version.
+//
+// Nodes that don't support compression reject streams with compression
+// flags as an unsupported version.
+func decodeStreamVersion(b uint8, legacy bool) (uint8, streamCompression, error) {
+	version := b & versionMask
+	if version != supportedVersion && (!legacy || version != legacyVersion) {
+		return 0, 0, fmt.Errorf("unsupported version: %d", version)
+	}
+	flags := b &^ versionMask
+	if version == legacyVersion && flags != 0 {
+		// Legacy streams don't support compression so never set flags.
+		return 0, 0, fmt.Errorf("unsupported legacy flags: %#x", flags)
+	}
+	if flags&^compressionMask != 0 {
+		return 0, 0, fmt.Errorf("unsupported flags: %#x", flags)
+	}
+
+	compression := streamCompression(flags)
+	switch compression {
+	case streamCompressionNone, streamCompressionGzip, streamCompressionDeflate:
+		return version, compression, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported compression: %#x", uint8(compression))
+	}
+}
+
+// compress compresses the stream message payload b.
+func compress(b []byte, compression streamCompression) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case streamCompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case streamCompressionDeflate:
+		// Only fails if the level is invalid.
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		return b, nil
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress decompresses the stream message payload b.
+//
+// The decompressed payload is limited to the maximum frame size, so a small
+// corrupted or malicious payload can't allocate a huge buffer.
+func decompress(b []byte, compression streamCompression) ([]byte, error) {
+	var r io.ReadCloser
+	switch compression {
+	case streamCompressionGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("%w: gzip: %w", errCorrupted, err)
+		}
+		r = gzipReader
+	case streamCompressionDeflate:
+		r = flate.NewReader(bytes.NewReader(b))
+	default:
+		return b, nil
+	}
+	defer r.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(r, maxFrameSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: decompress: %w", errCorrupted, err)
+	}
+	if len(payload) > maxFrameSize {
+		return nil, fmt.Errorf(
+			"%w: decompressed frame too large: > %d", errCorrupted, maxFrameSize,
+		)
+	}
+	return payload, nil
+}
+
+const (
+	// checksumSize is the size of the CRC32 checksum appended to each packet.
+	checksumSize = 4
+
+	// frameHeaderSize is the size of the stream frame header, containing the
+	// payload length and payload checksum.
+	frameHeaderSize = 8
+
+	// maxFrameSize is the maximum size of a stream frame payload. This
+	// guards against allocating huge buffers when the length is corrupted.
+	maxFrameSize = 64 << 20
+)
+
+// errCorrupted is returned when a received message is truncated or doesn't
+// match its checksum.
+var errCorrupted = errors.New("corrupted message")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// appendChecksum appends the checksum of b to b.
+func appendChecksum(b []byte) []byte {
+	return binary.BigEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+}
+
+// verifyChecksum verifies the checksum appended to b, and returns b without
+// the checksum.
+func verifyChecksum(b []byte) ([]byte, error) {
+	if len(b) < checksumSize {
+		return nil, fmt.Errorf("%w: packet too small: %d", errCorrupted, len(b))
+	}
+
+	payload := b[:len(b)-checksumSize]
+	expected := binary.BigEndian.Uint32(b[len(b)-checksumSize:])
+	if crc32.Checksum(payload, crcTable) != expected {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorrupted)
+	}
+	return payload, nil
+}
+
+// verifyPacket verifies the checksum of the packet b, and returns b without
+// the checksum.
+//
+// If legacy is true, legacy packets are accepted, which have no checksum so
+// are returned unchanged. Note this means a packet whose version is
+// corrupted to the legacy version isn't detected as corrupted, so legacy
+// packets are only accepted when Config.LegacyProtocol is enabled.
+func verifyPacket(b []byte, legacy bool) ([]byte, error) {
+	if legacy && len(b) >= 2 && b[1] == legacyVersion {
+		return b, nil
+	}
+	return verifyChecksum(b)
+}
+
 // trackedWriter is a wrapper for the underlying writer that counts the number
 // of bytes written.
 type trackedWriter struct {
@@ -103,11 +312,23 @@ func (e *encoder) Encode(v interface{}) error {
 	return e.encoder.Encode(v)
 }
 
-func encodeDigest(header digestHeader, digest digest, maxPacketSize int) ([]byte, error) {
+// encodeDigest encodes the digest using the given protocol version, which
+// is either the supported version or the legacy version.
+func encodeDigest(
+	header digestHeader,
+	digest digest,
+	maxPacketSize int,
+	version uint8,
+) ([]byte, error) {
+	if version != legacyVersion {
+		// Reserve space for the checksum.
+		maxPacketSize -= checksumSize
+	}
+
 	// Add fixed header.
 	var buf bytes.Buffer
 	_ = buf.WriteByte(uint8(messageTypeDigest))
-	_ = buf.WriteByte(supportedVersion)
+	_ = buf.WriteByte(version)
 
 	encoder := newEncoder(&buf)
 
@@ -137,14 +358,29 @@ func encodeDigest(header digestHeader, digest digest, maxPacketSize int) ([]byte
 		bufLen = buf.Len()
 	}
 
-	return buf.Bytes()[:bufLen], nil
+	if version == legacyVersion {
+		return buf.Bytes()[:bufLen], nil
+	}
+	return appendChecksum(buf.Bytes()[:bufLen]), nil
 }
 
-func encodeDelta(header deltaHeader, delta delta, maxPacketSize int) ([]byte, error) {
+// encodeDelta encodes the delta using the given protocol version, which
+// is either the supported version or the legacy version.
+func encodeDelta(
+	header deltaHeader,
+	delta delta,
+	maxPacketSize int,
+	version uint8,
+) ([]byte, error) {
+	if version != legacyVersion {
+		// Reserve space for the checksum.
+		maxPacketSize -= checksumSize
+	}
+
 	// Add fixed header.
 	var buf bytes.Buffer
 	_ = buf.WriteByte(uint8(messageTypeDelta))
-	_ = buf.WriteByte(supportedVersion)
+	_ = buf.WriteByte(version)
 
 	encoder := newEncoder(&buf)
 
@@ -166,9 +402,11 @@ func encodeDelta(header deltaHeader, delta delta, maxPacketSize int) ([]byte, er
 	entriesSent := 0
 	for _, deltaEntry := range delta {
 		if err := encoder.Encode(&deltaHeader{
-			NodeID:  deltaEntry.ID,
-			Addr:    deltaEntry.Addr,
-			Entries: len(deltaEntry.Entries),
+			NodeID:      deltaEntry.ID,
+			Addr:        deltaEntry.Addr,
+			Epoch:       deltaEntry.Epoch,
+			Incarnation: deltaEntry.Incarnation,
+			Entries:     len(deltaEntry.Entries),
 		}); err != nil {
 			return nil, fmt.Errorf("encode: %w", err)
 		}
@@ -191,17 +429,54 @@ func encodeDelta(header deltaHeader, delta delta, maxPacketSize int) ([]byte, er
 		}
 	}
 
-	return buf.Bytes()[:bufLen], nil
+	if version == legacyVersion {
+		return buf.Bytes()[:bufLen], nil
+	}
+	return appendChecksum(buf.Bytes()[:bufLen]), nil
 }
 
+const (
+	// maxMessageEntries is the maximum number of digest entries, or
+	// key/value entries, in a received message. Every entry must be
+	// allocated and applied, so this limits the work a single message can
+	// cause.
+	maxMessageEntries = 1 << 20
+
+	// maxKeySize is the maximum size of a received entry key.
+	maxKeySize = 1 << 10
+
+	// maxValueSize is the maximum size of a received entry value.
+	maxValueSize = 1 << 16
+
+	// maxDecodeInitLen is the maximum length the decoder allocates upfront
+	// for a decoded slice. Longer slices are grown as elements are decoded,
+	// so a message can't claim a huge length to allocate a huge slice.
+	maxDecodeInitLen = 1024
+)
+
+// errLimitExceeded is returned when a received message exceeds the decode
+// limits.
+var errLimitExceeded = errors.New("message exceeds limits")
+
 type decoder struct {
 	decoder *codec.Decoder
+
+	size int
 }
 
-func newDecoder(reader io.Reader) *decoder {
-	var handle codec.MsgpackHandle
+// newDecoder returns a decoder for the message b.
+//
+// The message is decoded from the buffer rather than a reader, so strings
+// reference the buffer and a string claiming to be larger than the message
+// fails rather than allocating the claimed size. Therefore the total size of
+// the decoded message is limited by the size of b, which is limited by the
+// packet or frame size.
+func newDecoder(b []byte) *decoder {
+	handle := codec.MsgpackHandle{}
+	handle.MaxInitLen = maxDecodeInitLen
 	return &decoder{
-		decoder: codec.NewDecoder(reader, &handle),
+		decoder: codec.NewDecoderBytes(b, &handle),
+		size:    len(b),
 	}
 }
 
@@ -209,39 +484,97 @@ func (d *decoder) Decode(v interface{}) error {
 	return d.decoder.Decode(v)
 }
 
-func decodeDigest(b []byte) (digestHeader, digest, error) {
-	r := bytes.NewBuffer(b)
+// More returns whether there is more of the message to decode.
+func (d *decoder) More() bool {
+	return d.decoder.NumBytesRead() < d.size
+}
+
+// validateEntry returns an error if the entry exceeds the decode limits.
+func validateEntry(entry *Entry) error {
+	if len(entry.Key) > maxKeySize {
+		return fmt.Errorf(
+			"%w: key too large: %d > %d", errLimitExceeded, len(entry.Key), maxKeySize,
+		)
+	}
+	if len(entry.Value) > maxValueSize {
+		return fmt.Errorf(
+			"%w: value too large: %d > %d",
+			errLimitExceeded, len(entry.Value), maxValueSize,
+		)
+	}
+	return nil
+}
 
-	firstByte, err := r.ReadByte()
+// validate returns an error if the delta exceeds the decode limits.
+func (d delta) validate() error {
+	entries := 0
+	for _, deltaEntry := range d {
+		entries += len(deltaEntry.Entries) + 1
+		if entries > maxMessageEntries {
+			return fmt.Errorf(
+				"%w: too many entries: > %d", errLimitExceeded, maxMessageEntries,
+			)
+		}
+		for i := range deltaEntry.Entries {
+			if err := validateEntry(&deltaEntry.Entries[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate returns an error if the digest exceeds the decode limits.
+func (d digest) validate() error {
+	if len(d) > maxMessageEntries {
+		return fmt.Errorf(
+			"%w: too many entries: %d > %d",
+			errLimitExceeded, len(d), maxMessageEntries,
+		)
+	}
+	return nil
+}
+
+// decodeDigest decodes the digest packet b. legacy indicates whether to
+// accept packets using the legacy version.
+func decodeDigest(b []byte, legacy bool) (digestHeader, digest, error) {
+	b, err := verifyPacket(b, legacy)
 	if err != nil {
-		return digestHeader{}, nil, fmt.Errorf("read: %w", err)
+		return digestHeader{}, nil, err
 	}
-	messageType := messageType(firstByte)
+
+	if len(b) < 1 {
+		return digestHeader{}, nil, fmt.Errorf("read: %w", io.EOF)
+	}
+	messageType := messageType(b[0])
 	if messageType != messageTypeDigest {
 		return digestHeader{}, nil, fmt.Errorf("incorrect message type: %s", messageType)
 	}
-	version, err := r.ReadByte()
-	if err != nil {
-		return digestHeader{}, nil, fmt.Errorf("read: %w", err)
+	if len(b) < 2 {
+		return digestHeader{}, nil, fmt.Errorf("read: %w", io.EOF)
 	}
-	if version != supportedVersion {
+	version := b[1]
+	if version != supportedVersion && (!legacy || version != legacyVersion) {
 		return digestHeader{}, nil, fmt.Errorf("unsupported version: %d", version)
 	}
 
-	decoder := newDecoder(r)
+	decoder := newDecoder(b[2:])
 	var header digestHeader
 	if err := decoder.Decode(&header); err != nil {
 		return digestHeader{}, nil, fmt.Errorf("decode: %w", err)
 	}
 
 	var digest digest
-	for {
-		// Read digest entries until EOF.
+	for decoder.More() {
+		// Read digest entries until the end of the message.
+		if len(digest) == maxMessageEntries {
+			return digestHeader{}, nil, fmt.Errorf(
+				"%w: too many entries: > %d", errLimitExceeded, maxMessageEntries,
+			)
+		}
+
 		var entry digestEntry
 		if err := decoder.Decode(&entry); err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
 			return digestHeader{}, nil, fmt.Errorf("decode: %w", err)
 		}
 		digest = append(digest, entry)
@@ -250,59 +583,76 @@ func decodeDigest(b []byte) (digestHeader, digest, error) {
 	return header, digest, nil
 }
 
-func decodeDelta(b []byte) (deltaHeader, delta, error) {
-	r := bytes.NewBuffer(b)
-
-	firstByte, err := r.ReadByte()
+// decodeDelta decodes the delta packet b. legacy indicates whether to
+// accept packets using the legacy version.
+func decodeDelta(b []byte, legacy bool) (deltaHeader, delta, error) {
+	b, err := verifyPacket(b, legacy)
 	if err != nil {
-		return deltaHeader{}, nil, fmt.Errorf("read: %w", err)
+		return deltaHeader{}, nil, err
+	}
+
+	if len(b) < 1 {
+		return deltaHeader{}, nil, fmt.Errorf("read: %w", io.EOF)
 	}
-	messageType := messageType(firstByte)
+	messageType := messageType(b[0])
 	if messageType != messageTypeDelta {
 		return deltaHeader{}, nil, fmt.Errorf("incorrect message type: %s", messageType)
 	}
-	version, err := r.ReadByte()
-	if err != nil {
-		return deltaHeader{}, nil, fmt.Errorf("read: %w", err)
+	if len(b) < 2 {
+		return deltaHeader{}, nil, fmt.Errorf("read: %w", io.EOF)
 	}
-	if version != supportedVersion {
+	version := b[1]
+	if version != supportedVersion && (!legacy || version != legacyVersion) {
 		return deltaHeader{}, nil, fmt.Errorf("unsupported version: %d", version)
 	}
 
-	decoder := newDecoder(r)
+	decoder := newDecoder(b[2:])
 	var header deltaHeader
 	if err := decoder.Decode(&header); err != nil {
 		return deltaHeader{}, nil, fmt.Errorf("decode: %w", err)
 	}
 
 	var delta delta
-	for {
-		// Read delta entries until EOF.
+	// entries is the number of decoded node and key/value entries.
+	entries := 0
+	for decoder.More() {
+		// Read delta entries until the end of the message.
 		var entryHeader deltaHeader
 		if err := decoder.Decode(&entryHeader); err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
 			return deltaHeader{}, nil, fmt.Errorf("decode: %w", err)
 		}
 
+		// The number of entries is set by the sender so can't be trusted.
+		// Since the sender truncates the entries at the packet size limit,
+		// fewer entries than the header may be decoded.
+		if entryHeader.Entries < 0 ||
+			entryHeader.Entries > maxMessageEntries-entries-1 {
+			return deltaHeader{}, nil, fmt.Errorf(
+				"%w: too many entries: > %d", errLimitExceeded, maxMessageEntries,
+			)
+		}
+		entries++
+
 		deltaEntry := deltaEntry{
-			ID:   entryHeader.NodeID,
-			Addr: entryHeader.Addr,
+			ID:          entryHeader.NodeID,
+			Addr:        entryHeader.Addr,
+			Epoch:       entryHeader.Epoch,
+			Incarnation: entryHeader.Incarnation,
 		}
 
 		// Read entries until we hit the number of entries from the header
-		// or EOF.
-		for i := 0; i != entryHeader.Entries; i++ {
+		// or the end of the message.
+		for i := 0; i != entryHeader.Entries && decoder.More(); i++ {
 			var entry Entry
 			if err := decoder.Decode(&entry); err != nil {
-				if errors.Is(err, io.EOF) {
-					break
-				}
 				return deltaHeader{}, nil, fmt.Errorf("decode: %w", err)
 			}
+			if err := validateEntry(&entry); err != nil {
+				return deltaHeader{}, nil, err
+			}
 
 			deltaEntry.Entries = append(deltaEntry.Entries, entry)
+			entries++
 		}
 
 		delta = append(delta, deltaEntry)
@@ -311,21 +661,203 @@ func decodeDelta(b []byte) (deltaHeader, delta, error) {
 	return header, delta, nil
 }
 
+// frameEncoder encodes stream messages as frames, where each frame contains
+// the payload length, the payload checksum, then the encoded payload.
+//
+// If the stream is compressed, each payload is compressed separately, and
+// the length and checksum are of the compressed payload.
+type frameEncoder struct {
+	w           io.Writer
+	compression streamCompression
+}
+
+func newFrameEncoder(w io.Writer, compression streamCompression) *frameEncoder {
+	return &frameEncoder{
+		w:           w,
+		compression: compression,
+	}
+}
+
+func (e *frameEncoder) Encode(v interface{}) error {
+	var buf bytes.Buffer
+	if err := newEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	payload, err := compress(buf.Bytes(), e.compression)
+	if err != nil {
+		return fmt.Errorf("compress: %w", err)
+	}
+
+	header := make([]byte, 0, frameHeaderSize)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(payload)))
+	header = binary.BigEndian.AppendUint32(
+		header, crc32.Checksum(payload, crcTable),
+	)
+	if _, err := e.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(payload); err != nil {
+		return err
+	}
+	return nil
+}
+
+// frameDecoder decodes stream messages encoded by frameEncoder.
+//
+// The payload is only decoded once the full frame has been read and the
+// checksum verified, so a truncated or corrupted frame is rejected before any
+// of its contents are applied.
+type frameDecoder struct {
+	r           io.Reader
+	compression streamCompression
+}
+
+func newFrameDecoder(r io.Reader, compression streamCompression) *frameDecoder {
+	return &frameDecoder{
+		r:           r,
+		compression: compression,
+	}
+}
+
+func (d *frameDecoder) Decode(v interface{}) error {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: truncated frame header", errCorrupted)
+		}
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(header[:4])
+	if size > maxFrameSize {
+		return fmt.Errorf("%w: frame too large: %d", errCorrupted, size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(d.r, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: truncated frame", errCorrupted)
+		}
+		return err
+	}
+
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return fmt.Errorf("%w: checksum mismatch", errCorrupted)
+	}
+
+	payload, err := decompress(payload, d.compression)
+	if err != nil {
+		return err
+	}
+	if err := newDecoder(payload).Decode(v); err != nil {
+		return err
+	}
+	if v, ok := v.(validator); ok {
+		return v.validate()
+	}
+	return nil
+}
+
+// streamEncoder encodes stream messages.
+type streamEncoder interface {
+	Encode(v interface{}) error
+}
+
+// streamDecoder decodes stream messages.
+type streamDecoder interface {
+	Decode(v interface{}) error
+}
+
+// newStreamEncoder returns an encoder for the stream messages of the given
+// protocol version. Legacy streams are encoded directly to the stream, and
+// otherwise messages are encoded as frames.
+func newStreamEncoder(
+	w io.Writer,
+	version uint8,
+	compression streamCompression,
+) streamEncoder {
+	if version == legacyVersion {
+		return newEncoder(w)
+	}
+	return newFrameEncoder(w, compression)
+}
+
+// newStreamDecoder returns a decoder for the stream messages of the given
+// protocol version.
+func newStreamDecoder(
+	r io.Reader,
+	version uint8,
+	compression streamCompression,
+) streamDecoder {
+	if version == legacyVersion {
+		return newLegacyDecoder(r, maxFrameSize)
+	}
+	return newFrameDecoder(r, compression)
+}
+
+// legacyDecoder decodes legacy stream messages, which are decoded directly
+// from the stream rather than from frames.
+//
+// Since there are no frames, a legacy message has no checksum or length, so
+// instead the total size of the stream is limited.
+type legacyDecoder struct {
+	decoder *codec.Decoder
+}
+
+// newLegacyDecoder returns a decoder for the stream r, which fails once limit
+// bytes have been read.
+func newLegacyDecoder(r io.Reader, limit int64) *legacyDecoder {
+	handle := codec.MsgpackHandle{}
+	handle.MaxInitLen = maxDecodeInitLen
+	return &legacyDecoder{
+		decoder: codec.NewDecoder(io.LimitReader(r, limit), &handle),
+	}
+}
+
+func (d *legacyDecoder) Decode(v interface{}) error {
+	if err := d.decoder.Decode(v); err != nil {
+		return err
+	}
+	if v, ok := v.(validator); ok {
+		return v.validate()
+	}
+	return nil
+}
+
+// validator is implemented by stream messages that must be validated against
+// the decode limits once decoded.
+type validator interface {
+	validate() error
+}
+
 type digestHeader struct {
 	NodeID  string `codec:"node_id"`
 	Addr    string `codec:"addr"`
 	Request bool   `codec:"request"`
+
+	// SentAt is the time the digest was sent in Unix nanoseconds, used to
+	// estimate the clock skew between nodes. Zero if the sender doesn't
+	// include a send time.
+	SentAt int64 `codec:"sent_at"`
 }
 
 type deltaHeader struct {
 	NodeID  string `codec:"node_id"`
 	Addr    string `codec:"addr"`
+	Epoch   uint64 `codec:"epoch"`
 	Entries int    `codec:"entries"`
+
+	Incarnation uint64 `codec:"incarnation"`
 }
 
 type joinHeader struct {
 	NodeID string `codec:"node_id"`
 	Addr   string `codec:"addr"`
+	Epoch  uint64 `codec:"epoch"`
+
+	// Conflict is set in the join response when the join was refused as the
+	// joining node uses the same ID as another node in the cluster.
+	Conflict bool `codec:"conflict"`
 }
 
 type leaveHeader struct {
@@ -1,9 +1,15 @@
 package gossip
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCodec_Digest(t *testing.T) {
@@ -12,17 +18,18 @@ func TestCodec_Digest(t *testing.T) {
 			NodeID:  "my-node",
 			Addr:    "1.2.3.4",
 			Request: true,
+			SentAt:  1700000000000000000,
 		}
 		sentDigest := digest{
-			{"node-1", "1.1.1.1", 4, false},
-			{"node-2", "2.2.2.2", 8, false},
-			{"node-3", "3.3.3.3", 13, false},
+			{"node-1", "1.1.1.1", 1, 4, false, 0, false},
+			{"node-2", "2.2.2.2", 1, 8, false, 0, false},
+			{"node-3", "3.3.3.3", 1, 13, false, 0, false},
 		}
 
-		b, err := encodeDigest(sentHeader, sentDigest, 1000)
+		b, err := encodeDigest(sentHeader, sentDigest, 1000, supportedVersion)
 		assert.NoError(t, err)
 
-		receivedHeader, receivedDigest, err := decodeDigest(b)
+		receivedHeader, receivedDigest, err := decodeDigest(b, false)
 		assert.NoError(t, err)
 
 		assert.Equal(t, sentHeader, receivedHeader)
@@ -38,22 +45,23 @@ func TestCodec_Digest(t *testing.T) {
 			Request: true,
 		}
 		sentDigest := digest{
-			{"node-1", "1.1.1.1", 4, false},
-			{"node-2", "2.2.2.2", 8, false},
-			{"node-3", "3.3.3.3", 13, false},
+			{"node-1", "1.1.1.1", 1, 4, false, 0, false},
+			{"node-2", "2.2.2.2", 1, 8, false, 0, false},
+			{"node-3", "3.3.3.3", 1, 13, false, 0, false},
 		}
 
-		b, err := encodeDigest(sentHeader, sentDigest, 125)
+		b, err := encodeDigest(sentHeader, sentDigest, 200, supportedVersion)
 		assert.NoError(t, err)
-		assert.Equal(t, 119, len(b))
+		// Includes the checksum.
+		assert.Equal(t, 194, len(b))
 
-		receivedHeader, receivedDigest, err := decodeDigest(b)
+		receivedHeader, receivedDigest, err := decodeDigest(b, false)
 		assert.NoError(t, err)
 
 		assert.Equal(t, sentHeader, receivedHeader)
 		assert.Equal(t, digest{
-			{"node-1", "1.1.1.1", 4, false},
-			{"node-2", "2.2.2.2", 8, false},
+			{"node-1", "1.1.1.1", 1, 4, false, 0, false},
+			{"node-2", "2.2.2.2", 1, 8, false, 0, false},
 		}, receivedDigest)
 	})
 }
@@ -84,10 +92,10 @@ func TestCodec_Delta(t *testing.T) {
 				},
 			},
 		}
-		b, err := encodeDelta(sentHeader, sentDelta, 1000)
+		b, err := encodeDelta(sentHeader, sentDelta, 1000, supportedVersion)
 		assert.NoError(t, err)
 
-		receivedHeader, receivedDelta, err := decodeDelta(b)
+		receivedHeader, receivedDelta, err := decodeDelta(b, false)
 		assert.NoError(t, err)
 
 		assert.Equal(t, sentHeader, receivedHeader)
@@ -121,11 +129,12 @@ func TestCodec_Delta(t *testing.T) {
 				},
 			},
 		}
-		b, err := encodeDelta(sentHeader, sentDelta, 325)
+		b, err := encodeDelta(sentHeader, sentDelta, 380, supportedVersion)
 		assert.NoError(t, err)
-		assert.Equal(t, 297, len(b))
+		// Includes the checksum.
+		assert.Equal(t, 361, len(b))
 
-		receivedHeader, receivedDelta, err := decodeDelta(b)
+		receivedHeader, receivedDelta, err := decodeDelta(b, false)
 		assert.NoError(t, err)
 
 		assert.Equal(t, sentHeader, receivedHeader)
@@ -149,3 +158,495 @@ func TestCodec_Delta(t *testing.T) {
 		}, receivedDelta)
 	})
 }
+
+func TestCodec_Corrupted(t *testing.T) {
+	b, err := encodeDelta(deltaHeader{
+		NodeID: "my-node",
+		Addr:   "1.2.3.4",
+	}, delta{
+		{
+			ID:   "node-1",
+			Addr: "1.1.1.1",
+			Entries: []Entry{
+				{"k1", "v1", 1, false, false},
+			},
+		},
+	}, 1000, supportedVersion)
+	require.NoError(t, err)
+
+	t.Run("corrupted", func(t *testing.T) {
+		corrupted := bytes.Clone(b)
+		corrupted[len(corrupted)/2] ^= 0xff
+
+		_, _, err := decodeDelta(corrupted, false)
+		assert.ErrorIs(t, err, errCorrupted)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		_, _, err := decodeDelta(b[:len(b)-1], false)
+		assert.ErrorIs(t, err, errCorrupted)
+
+		_, _, err = decodeDelta(b[:2], false)
+		assert.ErrorIs(t, err, errCorrupted)
+	})
+}
+
+func TestCodec_Limits(t *testing.T) {
+	// encodePacket encodes the values as a packet of the given type without
+	// the limits enforced by the encoders.
+	encodePacket := func(t *testing.T, messageType messageType, vs ...interface{}) []byte {
+		var buf bytes.Buffer
+		_ = buf.WriteByte(uint8(messageType))
+		_ = buf.WriteByte(supportedVersion)
+		encoder := newEncoder(&buf)
+		for _, v := range vs {
+			require.NoError(t, encoder.Encode(v))
+		}
+		return appendChecksum(buf.Bytes())
+	}
+
+	t.Run("delta too many entries", func(t *testing.T) {
+		b := encodePacket(t, messageTypeDelta, &deltaHeader{}, &deltaHeader{
+			NodeID:  "node-1",
+			Entries: maxMessageEntries,
+		})
+		_, _, err := decodeDelta(b, false)
+		assert.ErrorIs(t, err, errLimitExceeded)
+	})
+
+	t.Run("delta negative entries", func(t *testing.T) {
+		b := encodePacket(t, messageTypeDelta, &deltaHeader{}, &deltaHeader{
+			NodeID:  "node-1",
+			Entries: -1,
+		})
+		_, _, err := decodeDelta(b, false)
+		assert.ErrorIs(t, err, errLimitExceeded)
+	})
+
+	t.Run("delta key too large", func(t *testing.T) {
+		b := encodePacket(
+			t,
+			messageTypeDelta,
+			&deltaHeader{},
+			&deltaHeader{NodeID: "node-1", Entries: 1},
+			&Entry{Key: strings.Repeat("k", maxKeySize+1)},
+		)
+		_, _, err := decodeDelta(b, false)
+		assert.ErrorIs(t, err, errLimitExceeded)
+	})
+
+	t.Run("delta value too large", func(t *testing.T) {
+		b := encodePacket(
+			t,
+			messageTypeDelta,
+			&deltaHeader{},
+			&deltaHeader{NodeID: "node-1", Entries: 1},
+			&Entry{Key: "k1", Value: strings.Repeat("v", maxValueSize+1)},
+		)
+		_, _, err := decodeDelta(b, false)
+		assert.ErrorIs(t, err, errLimitExceeded)
+	})
+
+	t.Run("string larger than message", func(t *testing.T) {
+		// A map with a 'node_id' string claiming to be 4GB.
+		var buf bytes.Buffer
+		_ = buf.WriteByte(uint8(messageTypeDigest))
+		_ = buf.WriteByte(supportedVersion)
+		buf.Write([]byte{0x81, 0xa7})
+		buf.WriteString("node_id")
+		buf.Write([]byte{0xdb, 0xff, 0xff, 0xff, 0xf0})
+
+		_, _, err := decodeDigest(appendChecksum(buf.Bytes()), false)
+		assert.Error(t, err)
+	})
+
+	t.Run("stream delta value too large", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, newFrameEncoder(&buf, streamCompressionNone).Encode(delta{
+			{
+				ID: "node-1",
+				Entries: []Entry{
+					{Key: "k1", Value: strings.Repeat("v", maxValueSize+1)},
+				},
+			},
+		}))
+
+		var decoded delta
+		err := newFrameDecoder(&buf, streamCompressionNone).Decode(&decoded)
+		assert.ErrorIs(t, err, errLimitExceeded)
+	})
+}
+
+func TestFrameCodec(t *testing.T) {
+	header := joinHeader{
+		NodeID: "my-node",
+		Addr:   "1.2.3.4",
+		Epoch:  5,
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		var buf bytes.Buffer
+		encoder := newFrameEncoder(&buf, streamCompressionNone)
+		require.NoError(t, encoder.Encode(&header))
+		require.NoError(t, encoder.Encode(&header))
+
+		decoder := newFrameDecoder(&buf, streamCompressionNone)
+
+		var decoded joinHeader
+		require.NoError(t, decoder.Decode(&decoded))
+		assert.Equal(t, header, decoded)
+		require.NoError(t, decoder.Decode(&decoded))
+		assert.Equal(t, header, decoded)
+
+		// Returns EOF when there are no more frames.
+		assert.True(t, errors.Is(decoder.Decode(&decoded), io.EOF))
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, newFrameEncoder(&buf, streamCompressionNone).Encode(&header))
+
+		b := buf.Bytes()
+		b[len(b)-1] ^= 0xff
+
+		var decoded joinHeader
+		err := newFrameDecoder(bytes.NewReader(b), streamCompressionNone).Decode(&decoded)
+		assert.ErrorIs(t, err, errCorrupted)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, newFrameEncoder(&buf, streamCompressionNone).Encode(&header))
+
+		b := buf.Bytes()
+
+		var decoded joinHeader
+		err := newFrameDecoder(bytes.NewReader(b[:len(b)-1]), streamCompressionNone).Decode(&decoded)
+		assert.ErrorIs(t, err, errCorrupted)
+
+		// Truncated header.
+		err = newFrameDecoder(bytes.NewReader(b[:3]), streamCompressionNone).Decode(&decoded)
+		assert.ErrorIs(t, err, errCorrupted)
+	})
+
+	t.Run("frame too large", func(t *testing.T) {
+		b := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+
+		var decoded joinHeader
+		err := newFrameDecoder(bytes.NewReader(b), streamCompressionNone).Decode(&decoded)
+		assert.ErrorIs(t, err, errCorrupted)
+	})
+}
+
+func TestFrameCodec_Compression(t *testing.T) {
+	// Use a repetitive payload so it compresses well.
+	var sent delta
+	for i := 0; i != 100; i++ {
+		sent = append(sent, deltaEntry{
+			ID:   fmt.Sprintf("node-%d", i),
+			Addr: "10.0.0.1:8003",
+			Entries: []Entry{
+				{"endpoint:my-endpoint", "1", 1, false, false},
+			},
+		})
+	}
+
+	var uncompressed bytes.Buffer
+	require.NoError(t, newFrameEncoder(&uncompressed, streamCompressionNone).Encode(sent))
+
+	for _, compression := range []streamCompression{
+		streamCompressionGzip, streamCompressionDeflate,
+	} {
+		t.Run(compression.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			encoder := newFrameEncoder(&buf, compression)
+			require.NoError(t, encoder.Encode(sent))
+			assert.Less(t, buf.Len(), uncompressed.Len())
+
+			var decoded delta
+			decoder := newFrameDecoder(bytes.NewReader(buf.Bytes()), compression)
+			require.NoError(t, decoder.Decode(&decoded))
+			assert.Equal(t, len(sent), len(decoded))
+
+			// Decoding with the wrong compression fails.
+			decoder = newFrameDecoder(bytes.NewReader(uncompressed.Bytes()), compression)
+			assert.ErrorIs(t, decoder.Decode(&decoded), errCorrupted)
+		})
+	}
+
+	t.Run("decompressed too large", func(t *testing.T) {
+		payload, err := compress(make([]byte, maxFrameSize+1), streamCompressionGzip)
+		require.NoError(t, err)
+
+		_, err = decompress(payload, streamCompressionGzip)
+		assert.ErrorIs(t, err, errCorrupted)
+	})
+}
+
+func TestDecodeStreamVersion(t *testing.T) {
+	version, compression, err := decodeStreamVersion(supportedVersion, false)
+	require.NoError(t, err)
+	assert.Equal(t, supportedVersion, version)
+	assert.Equal(t, streamCompressionNone, compression)
+
+	for _, c := range []streamCompression{
+		streamCompressionNone, streamCompressionGzip, streamCompressionDeflate,
+	} {
+		version, compression, err := decodeStreamVersion(
+			encodeStreamVersion(supportedVersion, c), false,
+		)
+		require.NoError(t, err)
+		assert.Equal(t, supportedVersion, version)
+		assert.Equal(t, c, compression)
+	}
+
+	// Legacy streams are never compressed.
+	assert.Equal(
+		t, legacyVersion, encodeStreamVersion(legacyVersion, streamCompressionGzip),
+	)
+	version, compression, err = decodeStreamVersion(legacyVersion, true)
+	require.NoError(t, err)
+	assert.Equal(t, legacyVersion, version)
+	assert.Equal(t, streamCompressionNone, compression)
+
+	// The legacy version is rejected unless enabled.
+	_, _, err = decodeStreamVersion(legacyVersion, false)
+	assert.EqualError(t, err, "unsupported version: 0")
+
+	_, _, err = decodeStreamVersion(2, false)
+	assert.EqualError(t, err, "unsupported version: 2")
+
+	_, _, err = decodeStreamVersion(supportedVersion|0x40, false)
+	assert.EqualError(t, err, "unsupported flags: 0x40")
+
+	_, _, err = decodeStreamVersion(supportedVersion|0x30, false)
+	assert.EqualError(t, err, "unsupported compression: 0x30")
+
+	_, _, err = decodeStreamVersion(legacyVersion|0x10, true)
+	assert.EqualError(t, err, "unsupported legacy flags: 0x10")
+}
+
+// Tests encoding and decoding messages using the legacy version, which have
+// no checksums and aren't framed.
+func TestCodec_Legacy(t *testing.T) {
+	t.Run("digest", func(t *testing.T) {
+		sentHeader := digestHeader{
+			NodeID:  "my-node",
+			Addr:    "1.2.3.4",
+			Request: true,
+		}
+		sentDigest := digest{
+			{"node-1", "1.1.1.1", 1, 4, false, 0, false},
+		}
+
+		b, err := encodeDigest(sentHeader, sentDigest, 1000, legacyVersion)
+		require.NoError(t, err)
+		assert.Equal(t, legacyVersion, b[1])
+
+		// Legacy packets have no checksum, so the payload is exactly the
+		// encoded header and entries.
+		var buf bytes.Buffer
+		encoder := newEncoder(&buf)
+		require.NoError(t, encoder.Encode(&sentHeader))
+		require.NoError(t, encoder.Encode(&sentDigest[0]))
+		assert.Equal(t, buf.Bytes(), b[2:])
+
+		receivedHeader, receivedDigest, err := decodeDigest(b, true)
+		require.NoError(t, err)
+		assert.Equal(t, sentHeader, receivedHeader)
+		assert.Equal(t, sentDigest, receivedDigest)
+
+		// Legacy packets are rejected unless enabled.
+		_, _, err = decodeDigest(b, false)
+		assert.Error(t, err)
+	})
+
+	t.Run("delta", func(t *testing.T) {
+		sentHeader := deltaHeader{
+			NodeID: "my-node",
+			Addr:   "1.2.3.4",
+		}
+		sentDelta := delta{
+			{
+				ID:   "node-1",
+				Addr: "1.1.1.1",
+				Entries: []Entry{
+					{"k1", "v1", 1, false, false},
+				},
+			},
+		}
+
+		b, err := encodeDelta(sentHeader, sentDelta, 1000, legacyVersion)
+		require.NoError(t, err)
+		assert.Equal(t, legacyVersion, b[1])
+
+		receivedHeader, receivedDelta, err := decodeDelta(b, true)
+		require.NoError(t, err)
+		assert.Equal(t, sentHeader, receivedHeader)
+		assert.Equal(t, sentDelta, receivedDelta)
+
+		_, _, err = decodeDelta(b, false)
+		assert.Error(t, err)
+	})
+
+	t.Run("corrupted to legacy", func(t *testing.T) {
+		b, err := encodeDigest(digestHeader{
+			NodeID: "my-node",
+			Addr:   "1.2.3.4",
+		}, digest{
+			{"node-1", "1.1.1.1", 1, 4, false, 0, false},
+		}, 1000, supportedVersion)
+		require.NoError(t, err)
+
+		// A packet whose version is corrupted to the legacy version skips
+		// the checksum, so must be rejected unless legacy is enabled.
+		b[1] = legacyVersion
+		_, _, err = decodeDigest(b, false)
+		assert.EqualError(t, err, "corrupted message: checksum mismatch")
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		sent := delta{
+			{
+				ID:   "node-1",
+				Addr: "1.1.1.1",
+				Entries: []Entry{
+					{"k1", "v1", 1, false, false},
+				},
+			},
+		}
+
+		var buf bytes.Buffer
+		encoder := newStreamEncoder(&buf, legacyVersion, streamCompressionNone)
+		require.NoError(t, encoder.Encode(&joinHeader{NodeID: "my-node"}))
+		require.NoError(t, encoder.Encode(sent))
+
+		// Legacy messages are encoded directly to the stream.
+		var expected bytes.Buffer
+		require.NoError(t, newEncoder(&expected).Encode(&joinHeader{NodeID: "my-node"}))
+		assert.Equal(t, expected.Bytes(), buf.Bytes()[:expected.Len()])
+
+		decoder := newStreamDecoder(&buf, legacyVersion, streamCompressionNone)
+		var header joinHeader
+		require.NoError(t, decoder.Decode(&header))
+		assert.Equal(t, "my-node", header.NodeID)
+		var received delta
+		require.NoError(t, decoder.Decode(&received))
+		assert.Equal(t, sent, received)
+	})
+
+	t.Run("stream too large", func(t *testing.T) {
+		var buf bytes.Buffer
+		encoder := newStreamEncoder(&buf, legacyVersion, streamCompressionNone)
+		require.NoError(t, encoder.Encode(&joinHeader{NodeID: "my-node"}))
+		require.NoError(t, encoder.Encode(delta{
+			{
+				ID:   "node-1",
+				Addr: "1.1.1.1",
+				Entries: []Entry{
+					{"k1", strings.Repeat("v", 1024), 1, false, false},
+				},
+			},
+		}))
+
+		// Legacy streams have no frames so the total stream size is limited
+		// instead.
+		decoder := newLegacyDecoder(&buf, 512)
+		var header joinHeader
+		require.NoError(t, decoder.Decode(&header))
+		var received delta
+		assert.Error(t, decoder.Decode(&received))
+	})
+}
+
+func FuzzDecodeDigest(f *testing.F) {
+	b, err := encodeDigest(digestHeader{
+		NodeID:  "my-node",
+		Addr:    "1.2.3.4",
+		Request: true,
+	}, digest{
+		{"node-1", "1.1.1.1", 1, 4, false, 0, false},
+		{"node-2", "2.2.2.2", 1, 8, true, 0, false},
+	}, 1000, supportedVersion)
+	assert.NoError(f, err)
+	f.Add(b)
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		header, digest, err := decodeDigest(b, false)
+		if err != nil {
+			return
+		}
+
+		// Any decoded digest must re-encode and decode to the same digest.
+		encoded, err := encodeDigest(header, digest, len(b)*2+100, supportedVersion)
+		assert.NoError(t, err)
+
+		decodedHeader, decodedDigest, err := decodeDigest(encoded, false)
+		assert.NoError(t, err)
+		assert.Equal(t, header, decodedHeader)
+		assert.Equal(t, len(digest), len(decodedDigest))
+	})
+}
+
+func FuzzDecodeDelta(f *testing.F) {
+	b, err := encodeDelta(deltaHeader{
+		NodeID: "my-node",
+		Addr:   "1.2.3.4",
+	}, delta{
+		{
+			ID:   "node-1",
+			Addr: "1.1.1.1",
+			Entries: []Entry{
+				{"k1", "v1", 1, false, false},
+				{"k2", "", 2, false, true},
+			},
+		},
+	}, 1000, supportedVersion)
+	assert.NoError(f, err)
+	f.Add(b)
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		header, delta, err := decodeDelta(b, false)
+		if err != nil {
+			return
+		}
+
+		// Any decoded delta must be within the decode limits.
+		assert.NoError(t, delta.validate())
+		assert.LessOrEqual(t, len(delta), len(b))
+
+		// Any decoded delta must re-encode and decode to the same delta.
+		encoded, err := encodeDelta(header, delta, len(b)*2+100, supportedVersion)
+		assert.NoError(t, err)
+
+		decodedHeader, decodedDelta, err := decodeDelta(encoded, false)
+		assert.NoError(t, err)
+		assert.Equal(t, header.NodeID, decodedHeader.NodeID)
+		assert.Equal(t, len(delta), len(decodedDelta))
+	})
+}
+
+func FuzzFrameDecoder(f *testing.F) {
+	var buf bytes.Buffer
+	require.NoError(f, newFrameEncoder(&buf, streamCompressionNone).Encode(delta{
+		{
+			ID:   "node-1",
+			Addr: "1.1.1.1",
+			Entries: []Entry{
+				{"k1", "v1", 1, false, false},
+				{"k2", "", 2, false, true},
+			},
+		},
+	}))
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var decoded delta
+		if err := newFrameDecoder(bytes.NewReader(b), streamCompressionNone).Decode(&decoded); err != nil {
+			return
+		}
+
+		// Any decoded delta must be within the decode limits.
+		assert.NoError(t, decoded.validate())
+	})
+}
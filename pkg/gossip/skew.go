@@ -0,0 +1,92 @@
+package gossip
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// clockSkewSmoothing is the weight given to each new clock skew sample.
+	// Samples include the one-way network latency and scheduling delays, so
+	// are smoothed to avoid reporting transient spikes as skew.
+	clockSkewSmoothing = 0.2
+)
+
+// NodeClockSkew is the estimated clock skew between a remote node and the
+// local node.
+type NodeClockSkew struct {
+	// NodeID is the ID of the remote node.
+	NodeID string `json:"node_id"`
+
+	// Skew is the estimated offset of the remote node's clock from the local
+	// clock, which is positive if the remote node is ahead.
+	//
+	// The skew is estimated from the send time of the digests received from
+	// the node, so includes the one-way network latency.
+	Skew time.Duration `json:"skew"`
+
+	// Exceeded indicates whether the skew exceeds the configured threshold.
+	Exceeded bool `json:"exceeded"`
+
+	// UpdatedAt is the last time the skew was sampled.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ReportClockSkew records a digest from the node with the given ID that was
+// sent at sentAt and received at receivedAt.
+//
+// Returns the updated estimate and whether the estimate crossed the
+// threshold, either exceeding it or recovering. A threshold of zero never
+// exceeds. Unknown nodes are ignored.
+func (s *clusterState) ReportClockSkew(
+	nodeID string,
+	sentAt time.Time,
+	receivedAt time.Time,
+	threshold time.Duration,
+) (NodeClockSkew, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.nodes[nodeID]; !ok || nodeID == s.localID {
+		return NodeClockSkew{}, false
+	}
+
+	sample := sentAt.Sub(receivedAt)
+	skew, ok := s.clockSkew[nodeID]
+	if !ok {
+		skew = &NodeClockSkew{
+			NodeID: nodeID,
+			Skew:   sample,
+		}
+		s.clockSkew[nodeID] = skew
+	} else {
+		skew.Skew += time.Duration(
+			clockSkewSmoothing * float64(sample-skew.Skew),
+		)
+	}
+	skew.UpdatedAt = receivedAt
+
+	exceeded := threshold > 0 && skew.Skew.Abs() > threshold
+	crossed := exceeded != skew.Exceeded
+	skew.Exceeded = exceeded
+
+	s.metrics.ClockSkew.WithLabelValues(nodeID).Set(skew.Skew.Seconds())
+
+	return *skew, crossed
+}
+
+// ClockSkew returns the estimated clock skew of each remote node, ordered by
+// node ID.
+func (s *clusterState) ClockSkew() []NodeClockSkew {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	skews := make([]NodeClockSkew, 0, len(s.clockSkew))
+	for _, skew := range s.clockSkew {
+		skews = append(skews, *skew)
+	}
+	sort.Slice(skews, func(i, j int) bool {
+		return skews[i].NodeID < skews[j].NodeID
+	})
+	return skews
+}
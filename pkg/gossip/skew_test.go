@@ -0,0 +1,125 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterState_ClockSkew(t *testing.T) {
+	t.Run("estimate", func(t *testing.T) {
+		metrics := newMetrics()
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, metrics, newNopWatcher(),
+		)
+		clusterState.ApplyDigest(digest{
+			{"node-2", "2.2.2.2", 0, 0, false, 0, false},
+			{"node-3", "3.3.3.3", 0, 0, false, 0, false},
+		})
+
+		receivedAt := time.Now()
+
+		// The first sample is used as the estimate.
+		skew, crossed := clusterState.ReportClockSkew(
+			"node-2", receivedAt.Add(time.Second), receivedAt, 0,
+		)
+		assert.Equal(t, time.Second, skew.Skew)
+		assert.False(t, crossed)
+
+		// Later samples are smoothed.
+		skew, _ = clusterState.ReportClockSkew(
+			"node-2", receivedAt.Add(time.Second*6), receivedAt, 0,
+		)
+		assert.Equal(t, time.Second*2, skew.Skew)
+
+		clusterState.ReportClockSkew(
+			"node-3", receivedAt.Add(-time.Millisecond*500), receivedAt, 0,
+		)
+
+		// Unknown nodes are ignored.
+		clusterState.ReportClockSkew("node-4", receivedAt, receivedAt, 0)
+
+		assert.Equal(t, []NodeClockSkew{
+			{NodeID: "node-2", Skew: time.Second * 2, UpdatedAt: receivedAt},
+			{NodeID: "node-3", Skew: -time.Millisecond * 500, UpdatedAt: receivedAt},
+		}, clusterState.ClockSkew())
+
+		assert.Equal(t, 2.0, testutil.ToFloat64(
+			metrics.ClockSkew.WithLabelValues("node-2"),
+		))
+		assert.Equal(t, -0.5, testutil.ToFloat64(
+			metrics.ClockSkew.WithLabelValues("node-3"),
+		))
+		assert.Equal(t, 2, testutil.CollectAndCount(metrics.ClockSkew))
+	})
+
+	t.Run("threshold", func(t *testing.T) {
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), newNopWatcher(),
+		)
+		clusterState.ApplyDigest(digest{
+			{"node-2", "2.2.2.2", 0, 0, false, 0, false},
+		})
+
+		receivedAt := time.Now()
+		threshold := time.Second
+
+		skew, crossed := clusterState.ReportClockSkew(
+			"node-2", receivedAt.Add(-time.Second*5), receivedAt, threshold,
+		)
+		assert.True(t, skew.Exceeded)
+		assert.True(t, crossed)
+
+		// Still exceeded so doesn't cross the threshold again.
+		skew, crossed = clusterState.ReportClockSkew(
+			"node-2", receivedAt, receivedAt, threshold,
+		)
+		assert.True(t, skew.Exceeded)
+		assert.False(t, crossed)
+
+		// Recovers once the estimate is within the threshold.
+		for crossed = false; !crossed; {
+			skew, crossed = clusterState.ReportClockSkew(
+				"node-2", receivedAt, receivedAt, threshold,
+			)
+		}
+		assert.False(t, skew.Exceeded)
+		assert.LessOrEqual(t, skew.Skew.Abs(), threshold)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		metrics := newMetrics()
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, metrics, newNopWatcher(),
+		)
+		clusterState.ApplyDelta(delta{
+			{
+				ID:   "node-2",
+				Addr: "2.2.2.2",
+			},
+		})
+
+		receivedAt := time.Now()
+		clusterState.ReportClockSkew(
+			"node-2", receivedAt.Add(time.Second), receivedAt, 0,
+		)
+		assert.Equal(t, 1, len(clusterState.ClockSkew()))
+
+		// Leave.
+		clusterState.ApplyDelta(delta{
+			{
+				ID:   "node-2",
+				Addr: "2.2.2.2",
+				Entries: []Entry{
+					{leftKey, "", 1, true, false},
+				},
+			},
+		})
+		clusterState.RemoveExpiredAt(time.Now().Add(nodeExpiry * 2))
+
+		assert.Equal(t, 0, len(clusterState.ClockSkew()))
+		assert.Equal(t, 0, testutil.CollectAndCount(metrics.ClockSkew))
+	})
+}
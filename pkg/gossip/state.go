@@ -20,6 +20,11 @@ const (
 	// nodeExpiry is the duration a left or unreachable node is stored until it
 	// is is removed.
 	nodeExpiry = time.Minute
+
+	// maxPendingUpdates is the maximum number of unacknowledged local
+	// updates to track. Once exceeded, new updates are merged into the most
+	// recent pending update.
+	maxPendingUpdates = 1024
 )
 
 // Entry represents a versioned key-value pair state.
@@ -42,6 +47,15 @@ type NodeMetadata struct {
 	// Addr is the gossip address of the node.
 	Addr string `json:"addr"`
 
+	// Epoch identifies the instance of the node using the ID, which is the
+	// time the node started in nanoseconds. This is used to distinguish a
+	// node that restarted from multiple nodes using the same ID.
+	Epoch uint64 `json:"epoch"`
+
+	// Incarnation is incremented by the node to refute suspicions from other
+	// nodes that it is unreachable.
+	Incarnation uint64 `json:"incarnation"`
+
 	// Version is the latest known version of the node.
 	Version uint64 `json:"version"`
 
@@ -56,6 +70,39 @@ type NodeMetadata struct {
 	Expiry time.Time `json:"expiry"`
 }
 
+// NodeConflict describes a node found using the same ID as another node.
+type NodeConflict struct {
+	// NodeID is the ID used by both nodes.
+	NodeID string `json:"node_id"`
+
+	// Addr and Epoch identify the node whose state was refused.
+	Addr  string `json:"addr"`
+	Epoch uint64 `json:"epoch"`
+
+	// ExistingAddr and ExistingEpoch identify the node already known with
+	// the ID.
+	ExistingAddr  string `json:"existing_addr"`
+	ExistingEpoch uint64 `json:"existing_epoch"`
+
+	// Local indicates whether the conflict is with the local node.
+	Local bool `json:"local"`
+
+	// LastSeen is the last time the conflict was detected.
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Younger returns whether the node whose state was refused started after the
+// existing node.
+func (c *NodeConflict) Younger() bool {
+	return c.Epoch > c.ExistingEpoch
+}
+
+type conflictKey struct {
+	nodeID string
+	addr   string
+	epoch  uint64
+}
+
 // NodeState contains the known state for the node.
 type NodeState struct {
 	NodeMetadata
@@ -66,8 +113,13 @@ type NodeState struct {
 type digestEntry struct {
 	ID      string `codec:"id"`
 	Addr    string `codec:"addr"`
+	Epoch   uint64 `codec:"epoch"`
 	Version uint64 `codec:"version"`
 	Left    bool   `json:"left"`
+
+	Incarnation uint64 `codec:"incarnation"`
+	// Suspected indicates whether the sender considers the node unreachable.
+	Suspected bool `codec:"suspected"`
 }
 
 type digest []digestEntry
@@ -75,11 +127,20 @@ type digest []digestEntry
 type deltaEntry struct {
 	ID      string  `codec:"id"`
 	Addr    string  `codec:"addr"`
+	Epoch   uint64  `codec:"epoch"`
 	Entries []Entry `codec:"entries"`
+
+	Incarnation uint64 `codec:"incarnation"`
 }
 
 type delta []deltaEntry
 
+// pendingUpdate is a local update that no other node has acknowledged yet.
+type pendingUpdate struct {
+	version   uint64
+	timestamp time.Time
+}
+
 type nodeState struct {
 	NodeMetadata
 
@@ -110,6 +171,24 @@ type clusterState struct {
 	localID string
 	nodes   map[string]*nodeState
 
+	// conflicts contains the detected node ID conflicts.
+	conflicts map[conflictKey]*NodeConflict
+
+	// lastSync contains the last time each remote node synced with the local
+	// node.
+	lastSync map[string]time.Time
+
+	// clockSkew contains the estimated clock skew of each remote node.
+	clockSkew map[string]*NodeClockSkew
+
+	// legacyNodes contains the IDs of remote nodes whose last message used
+	// the legacy protocol version.
+	legacyNodes map[string]struct{}
+
+	// pending contains local updates that haven't been acknowledged by any
+	// other node, ordered by version.
+	pending []pendingUpdate
+
 	// mu protects the above fields.
 	mu sync.Mutex
 
@@ -133,6 +212,7 @@ func newClusterState(
 		NodeMetadata: NodeMetadata{
 			ID:      localID,
 			Addr:    localAddr,
+			Epoch:   uint64(time.Now().UnixNano()),
 			Version: 0,
 		},
 		Entries: make(map[string]Entry),
@@ -141,6 +221,10 @@ func newClusterState(
 	return &clusterState{
 		localID:         localID,
 		nodes:           nodes,
+		conflicts:       make(map[conflictKey]*NodeConflict),
+		lastSync:        make(map[string]time.Time),
+		clockSkew:       make(map[string]*NodeClockSkew),
+		legacyNodes:     make(map[string]struct{}),
 		failureDetector: failureDetector,
 		metrics:         metrics,
 		watcher:         watcher,
@@ -201,6 +285,24 @@ func (s *clusterState) LiveNodes() []NodeMetadata {
 	return metadata
 }
 
+// Conflicts returns the detected node ID conflicts, sorted by node ID.
+func (s *clusterState) Conflicts() []NodeConflict {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var conflicts []NodeConflict
+	for _, conflict := range s.conflicts {
+		conflicts = append(conflicts, *conflict)
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].NodeID != conflicts[j].NodeID {
+			return conflicts[i].NodeID < conflicts[j].NodeID
+		}
+		return conflicts[i].Epoch < conflicts[j].Epoch
+	})
+	return conflicts
+}
+
 // UnreachableNodes returns the known remote nodes that are considered
 // unreachable.
 func (s *clusterState) UnreachableNodes() []NodeMetadata {
@@ -239,6 +341,7 @@ func (s *clusterState) UpsertLocal(key, value string) {
 		Value:   value,
 		Version: state.Version,
 	}
+	s.addPendingLocked(state.Version)
 
 	s.metricsUpsertEntry(state.ID, state.Entries[key], existing)
 }
@@ -268,6 +371,7 @@ func (s *clusterState) DeleteLocal(key string) {
 		Internal: existing.Internal,
 		Deleted:  true,
 	}
+	s.addPendingLocked(state.Version)
 
 	s.metricsUpsertEntry(state.ID, state.Entries[key], existing)
 }
@@ -292,6 +396,7 @@ func (s *clusterState) LeaveLocal() {
 		Version:  state.Version,
 		Internal: true,
 	}
+	s.addPendingLocked(state.Version)
 
 	s.metricsAddEntry(state.ID, state.Entries[leftKey])
 }
@@ -301,7 +406,10 @@ func (s *clusterState) LeaveLocal() {
 //
 // This will re-version all non-deleted keys, then add a special key to remove
 // all entries prior to the reversioning.
-func (s *clusterState) CompactLocal(threshold int) {
+//
+// Returns the number of discarded entries, or 0 if the state wasn't
+// compacted.
+func (s *clusterState) CompactLocal(threshold int) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -315,7 +423,7 @@ func (s *clusterState) CompactLocal(threshold int) {
 		}
 	}
 	if deleted < threshold {
-		return
+		return 0
 	}
 
 	var entries []Entry
@@ -337,13 +445,16 @@ func (s *clusterState) CompactLocal(threshold int) {
 		"node_id": state.ID,
 	})
 
+	discarded := 0
 	for _, entry := range entries {
 		if entry.Deleted {
 			// Discard deleted entries.
+			discarded++
 			continue
 		}
 		if entry.Internal && entry.Key == compactKey {
 			// Discard overridden compaction entries.
+			discarded++
 			continue
 		}
 
@@ -363,6 +474,11 @@ func (s *clusterState) CompactLocal(threshold int) {
 	}
 
 	s.metricsAddEntry(state.ID, state.Entries[compactKey])
+
+	s.metrics.Compactions.Inc()
+	s.metrics.CompactedEntries.Add(float64(discarded))
+
+	return discarded
 }
 
 func (s *clusterState) Digest() digest {
@@ -372,15 +488,35 @@ func (s *clusterState) Digest() digest {
 	var digest digest
 	for _, state := range s.nodes {
 		digest = append(digest, digestEntry{
-			ID:      state.ID,
-			Addr:    state.Addr,
-			Version: state.Version,
-			Left:    state.Left,
+			ID:          state.ID,
+			Addr:        state.Addr,
+			Epoch:       state.Epoch,
+			Version:     state.Version,
+			Left:        state.Left,
+			Incarnation: state.Incarnation,
+			Suspected:   state.Unreachable,
 		})
 	}
 	return digest
 }
 
+// LocalDigest returns a digest containing only the local member, so the
+// receiver responds with its full known state.
+func (s *clusterState) LocalDigest() digest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.nodes[s.localID]
+	return digest{{
+		ID:          state.ID,
+		Addr:        state.Addr,
+		Epoch:       state.Epoch,
+		Version:     state.Version,
+		Left:        state.Left,
+		Incarnation: state.Incarnation,
+	}}
+}
+
 // Delta returns a delta for the given digest. If fullDigest is true
 // we assume the digest contains the full remote nodes known state so can
 // include any nodes that is doesn't contain.
@@ -395,12 +531,21 @@ func (s *clusterState) Delta(digest digest, fullDigest bool) delta {
 	for _, entry := range digest {
 		digestNodes[entry.ID] = struct{}{}
 
-		if _, ok := s.nodes[entry.ID]; !ok {
+		state, ok := s.nodes[entry.ID]
+		if !ok {
 			// We have no state for this member.
 			continue
 		}
 
-		deltaEntry := s.deltaEntry(entry.ID, entry.Version)
+		fromVersion := entry.Version
+		if entry.Epoch != 0 && entry.Epoch < state.Epoch {
+			// If the sender knows an earlier epoch of the node, such as
+			// from before the node restarted, its version doesn't apply to
+			// our state so send the full node state.
+			fromVersion = 0
+		}
+
+		deltaEntry := s.deltaEntry(entry.ID, fromVersion)
 		// If we don't have any state on the member the sender doesn't,
 		// don't include the member delta.
 		if len(deltaEntry.Entries) > 0 {
@@ -433,13 +578,36 @@ func (s *clusterState) LocalDelta() delta {
 
 // ApplyDigest discovers any nodes we don't yet know about from the given
 // digest and adds them to our local state with a version of 0.
-func (s *clusterState) ApplyDigest(digest digest) {
+//
+// Returns any newly detected node ID conflicts.
+func (s *clusterState) ApplyDigest(digest digest) []NodeConflict {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	var conflicts []NodeConflict
+	// lag is the maximum version delta between the digest and the local
+	// state, to track how far nodes views of the cluster diverge.
+	var lag uint64
 	for _, entry := range digest {
-		// If we already know about the member theres nothing to do.
+		// The senders view of the local node acknowledges the local
+		// updates it has received.
+		if entry.ID == s.localID && entry.Epoch == s.nodes[s.localID].Epoch {
+			s.ackPendingLocked(entry.Version)
+		}
+
+		// If we already know about the member, only check the digest is
+		// for the same instance of the node and apply its incarnation.
 		if _, ok := s.nodes[entry.ID]; ok {
+			accept, conflict := s.checkEpoch(
+				entry.ID, entry.Addr, entry.Epoch,
+			)
+			if conflict != nil {
+				conflicts = append(conflicts, *conflict)
+			}
+			if accept {
+				s.applyIncarnation(entry.ID, entry.Incarnation, entry.Suspected)
+				lag = max(lag, versionDelta(s.nodes[entry.ID].Version, entry.Version))
+			}
 			continue
 		}
 		// If we a node has left the cluster and we don't know about it
@@ -451,33 +619,75 @@ func (s *clusterState) ApplyDigest(digest digest) {
 
 		s.nodes[entry.ID] = &nodeState{
 			NodeMetadata: NodeMetadata{
-				ID:      entry.ID,
-				Addr:    entry.Addr,
-				Version: 0,
+				ID:          entry.ID,
+				Addr:        entry.Addr,
+				Epoch:       entry.Epoch,
+				Incarnation: entry.Incarnation,
+				Version:     0,
 			},
 			Entries: make(map[string]Entry),
 		}
 
 		s.watcher.OnJoin(entry.ID)
 	}
+
+	s.metrics.ConvergenceLag.Set(float64(lag))
+	s.metrics.DigestVersionDelta.Observe(float64(lag))
+
+	return conflicts
+}
+
+// versionDelta returns the absolute difference between two versions.
+func versionDelta(a uint64, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
 }
 
 // ApplyDelta updates the state of remote nodes given the delta state.
-func (s *clusterState) ApplyDelta(delta delta) {
+//
+// Returns any newly detected node ID conflicts.
+func (s *clusterState) ApplyDelta(delta delta) []NodeConflict {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	var conflicts []NodeConflict
 	for _, entry := range delta {
-		s.applyDeltaEntry(entry)
+		if conflict := s.applyDeltaEntry(entry); conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
 	}
+	return conflicts
+}
+
+// CheckJoin checks whether the node with the given ID, address and epoch
+// may join the cluster.
+//
+// A node is refused if another node is already using the same ID. If the
+// node is a known node that restarted, its existing state is replaced.
+//
+// Returns true if the node may join, and the conflict if a new conflict was
+// detected.
+func (s *clusterState) CheckJoin(
+	id string,
+	addr string,
+	epoch uint64,
+) (bool, *NodeConflict) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.checkEpoch(id, addr, epoch)
 }
 
 func (s *clusterState) deltaEntry(nodeID string, fromVersion uint64) deltaEntry {
 	state := s.nodes[nodeID]
 
 	deltaEntry := deltaEntry{
-		ID:   state.ID,
-		Addr: state.Addr,
+		ID:          state.ID,
+		Addr:        state.Addr,
+		Epoch:       state.Epoch,
+		Incarnation: state.Incarnation,
 	}
 
 	for _, entry := range state.Entries {
@@ -496,24 +706,37 @@ func (s *clusterState) deltaEntry(nodeID string, fromVersion uint64) deltaEntry
 	return deltaEntry
 }
 
-func (s *clusterState) applyDeltaEntry(entry deltaEntry) {
+func (s *clusterState) applyDeltaEntry(entry deltaEntry) *NodeConflict {
 	if entry.ID == s.localID {
-		// Discard updates about local node.
-		return
+		// Discard updates about local node, though check the update isn't
+		// from another node using the local node ID.
+		_, conflict := s.checkEpoch(entry.ID, entry.Addr, entry.Epoch)
+		return conflict
 	}
 
 	state, ok := s.nodes[entry.ID]
 	if !ok {
 		s.nodes[entry.ID] = &nodeState{
 			NodeMetadata: NodeMetadata{
-				ID:   entry.ID,
-				Addr: entry.Addr,
+				ID:          entry.ID,
+				Addr:        entry.Addr,
+				Epoch:       entry.Epoch,
+				Incarnation: entry.Incarnation,
 			},
 			Entries: make(map[string]Entry),
 		}
 		state = s.nodes[entry.ID]
 
 		s.watcher.OnJoin(entry.ID)
+	} else {
+		accept, conflict := s.checkEpoch(entry.ID, entry.Addr, entry.Epoch)
+		if !accept {
+			return conflict
+		}
+		// The node state may have been replaced if the node restarted.
+		state = s.nodes[entry.ID]
+
+		s.applyIncarnation(entry.ID, entry.Incarnation, false)
 	}
 
 	for _, e := range entry.Entries {
@@ -539,7 +762,7 @@ func (s *clusterState) applyDeltaEntry(entry deltaEntry) {
 				// prior to the value.
 				compactVersion, err := strconv.ParseUint(e.Value, 10, 64)
 				if err != nil {
-					return
+					return nil
 				}
 				for _, e := range state.Entries {
 					if e.Version <= compactVersion {
@@ -562,6 +785,159 @@ func (s *clusterState) applyDeltaEntry(entry deltaEntry) {
 			}
 		}
 	}
+
+	return nil
+}
+
+// checkEpoch checks whether state received about the node with the given ID,
+// address and epoch is for the instance of the node we know.
+//
+// If the epoch doesn't match, the state is either from a node that restarted
+// with the same ID, or from another node using the same ID. If the node
+// restarted, the existing node state is replaced. Otherwise, if the known
+// node is still live, the state is refused and the conflict is recorded.
+//
+// Returns true if the state should be accepted, and the conflict if a new
+// conflict was detected.
+func (s *clusterState) checkEpoch(
+	id string,
+	addr string,
+	epoch uint64,
+) (bool, *NodeConflict) {
+	if epoch == 0 {
+		// The epoch is unknown so can't be checked.
+		return true, nil
+	}
+
+	state, ok := s.nodes[id]
+	if !ok || state.Epoch == epoch {
+		return true, nil
+	}
+	if state.Epoch == 0 {
+		// We discovered the node before we knew its epoch.
+		state.Epoch = epoch
+		return true, nil
+	}
+
+	if id == s.localID {
+		return false, s.addConflict(id, addr, epoch, state)
+	}
+
+	if !state.Left && !state.Unreachable && addr != state.Addr {
+		// Another node is using the same ID as a node that is still live.
+		return false, s.addConflict(id, addr, epoch, state)
+	}
+
+	if epoch < state.Epoch {
+		// Discard state from before the node restarted.
+		return false, nil
+	}
+
+	s.resetNode(state, addr, epoch)
+	return true, nil
+}
+
+// applyIncarnation applies the incarnation of the node with the given ID
+// received from another node.
+//
+// If the local node is suspected of being unreachable, it refutes the
+// suspicion by incrementing its incarnation, which then propagates to the
+// rest of the cluster. If a remote node has a higher incarnation than we
+// know, it has recently refuted a suspicion so is considered reachable.
+//
+// Returns true if the local node refuted a suspicion.
+func (s *clusterState) applyIncarnation(
+	id string,
+	incarnation uint64,
+	suspected bool,
+) bool {
+	state := s.nodes[id]
+
+	if id == s.localID {
+		// Ignore suspicions that were already refuted.
+		if !suspected || incarnation < state.Incarnation {
+			return false
+		}
+		state.Incarnation = incarnation + 1
+		s.metrics.Refutations.Inc()
+		return true
+	}
+
+	if incarnation <= state.Incarnation {
+		return false
+	}
+	state.Incarnation = incarnation
+
+	if state.Unreachable && !state.Left {
+		state.Unreachable = false
+		state.Expiry = time.Time{}
+		// Discard the previous arrival intervals, otherwise the node would
+		// be immediately considered unreachable again.
+		s.failureDetector.Remove(state.ID)
+		s.watcher.OnReachable(state.ID)
+	}
+	return false
+}
+
+// addConflict records a conflict between the node with the given address and
+// epoch and the existing node state with the same ID.
+//
+// Returns the conflict if it is newly detected, or nil if it is already
+// known.
+func (s *clusterState) addConflict(
+	id string,
+	addr string,
+	epoch uint64,
+	existing *nodeState,
+) *NodeConflict {
+	key := conflictKey{
+		nodeID: id,
+		addr:   addr,
+		epoch:  epoch,
+	}
+	if conflict, ok := s.conflicts[key]; ok {
+		conflict.LastSeen = time.Now()
+		return nil
+	}
+
+	conflict := &NodeConflict{
+		NodeID:        id,
+		Addr:          addr,
+		Epoch:         epoch,
+		ExistingAddr:  existing.Addr,
+		ExistingEpoch: existing.Epoch,
+		Local:         id == s.localID,
+		LastSeen:      time.Now(),
+	}
+	s.conflicts[key] = conflict
+
+	s.metrics.NodeConflicts.Inc()
+
+	c := *conflict
+	return &c
+}
+
+// resetNode replaces the state of a node that restarted with the same ID.
+func (s *clusterState) resetNode(state *nodeState, addr string, epoch uint64) {
+	s.metrics.Entries.DeletePartialMatch(prometheus.Labels{
+		"node_id": state.ID,
+	})
+	s.failureDetector.Remove(state.ID)
+
+	// Notify the watcher the previous instance of the node has been removed
+	// before adding the new instance.
+	s.watcher.OnExpired(state.ID)
+
+	s.nodes[state.ID] = &nodeState{
+		NodeMetadata: NodeMetadata{
+			ID:    state.ID,
+			Addr:  addr,
+			Epoch: epoch,
+		},
+		Entries: make(map[string]Entry),
+	}
+
+	s.watcher.OnJoin(state.ID)
 }
 
 // RemoveExpiredAt removes all expired node state.
@@ -582,14 +958,25 @@ func (s *clusterState) RemoveExpiredAt(t time.Time) {
 
 	for _, id := range nodeIDs {
 		delete(s.nodes, id)
+		delete(s.lastSync, id)
+		delete(s.clockSkew, id)
+		delete(s.legacyNodes, id)
 
 		s.metrics.Entries.DeletePartialMatch(prometheus.Labels{
 			"node_id": id,
 		})
+		s.metrics.PeerSyncAge.DeleteLabelValues(id)
+		s.metrics.ClockSkew.DeleteLabelValues(id)
 
 		s.watcher.OnExpired(id)
 		s.failureDetector.Remove(id)
 	}
+
+	for key, conflict := range s.conflicts {
+		if t.After(conflict.LastSeen.Add(nodeExpiry)) {
+			delete(s.conflicts, key)
+		}
+	}
 }
 
 func (s *clusterState) UpdateLiveness(suspicionThreshold float64) {
@@ -618,6 +1005,83 @@ func (s *clusterState) UpdateLiveness(suspicionThreshold float64) {
 	}
 }
 
+// ReportSync records that the node with the given ID synced with the local
+// node.
+func (s *clusterState) ReportSync(nodeID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.nodes[nodeID]; !ok {
+		return
+	}
+	s.lastSync[nodeID] = time.Now()
+}
+
+// UpdateSyncMetrics updates the time since each node last synced and the
+// age of the oldest unacknowledged local update.
+func (s *clusterState) UpdateSyncMetrics() {
+	s.UpdateSyncMetricsAt(time.Now())
+}
+
+func (s *clusterState) UpdateSyncMetricsAt(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	live := false
+	for _, node := range s.nodes {
+		if node.ID == s.localID || node.Left {
+			continue
+		}
+		if !node.Unreachable {
+			live = true
+		}
+
+		lastSync, ok := s.lastSync[node.ID]
+		if !ok {
+			continue
+		}
+		s.metrics.PeerSyncAge.WithLabelValues(node.ID).Set(
+			t.Sub(lastSync).Seconds(),
+		)
+	}
+
+	// If there are no live nodes, there are no nodes to acknowledge our
+	// updates, so discard them rather than reporting a growing age.
+	if !live {
+		s.pending = nil
+	}
+
+	var age time.Duration
+	if len(s.pending) > 0 {
+		age = t.Sub(s.pending[0].timestamp)
+	}
+	s.metrics.UnacknowledgedUpdateAge.Set(age.Seconds())
+}
+
+// addPendingLocked records an unacknowledged local update with the given
+// version.
+func (s *clusterState) addPendingLocked(version uint64) {
+	if len(s.pending) >= maxPendingUpdates {
+		// Merge into the most recent pending update, keeping its timestamp,
+		// so the oldest update age is never underestimated.
+		s.pending[len(s.pending)-1].version = version
+		return
+	}
+	s.pending = append(s.pending, pendingUpdate{
+		version:   version,
+		timestamp: time.Now(),
+	})
+}
+
+// ackPendingLocked discards pending local updates upto the given version.
+func (s *clusterState) ackPendingLocked(version uint64) {
+	n := 0
+	for n < len(s.pending) && s.pending[n].version <= version {
+		n++
+	}
+	s.pending = s.pending[n:]
+}
+
 func (s *clusterState) metricsAddEntry(nodeID string, newEntry Entry) {
 	s.metrics.Entries.With(prometheus.Labels{
 		"node_id":  nodeID,
@@ -5,7 +5,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestClusterState_LocalState(t *testing.T) {
@@ -74,11 +76,12 @@ func TestClusterState_ApplyDigest(t *testing.T) {
 		clusterState := newClusterState(
 			"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), newNopWatcher(),
 		)
+		localEpoch := clusterState.LocalNodeMetadata().Epoch
 
 		clusterState.ApplyDigest(digest{
-			{"node-2", "2.2.2.2", 5, false},
-			{"node-3", "3.3.3.3", 12, false},
-			{"node-4", "4.4.4.4", 2, false},
+			{"node-2", "2.2.2.2", 0, 5, false, 0, false},
+			{"node-3", "3.3.3.3", 0, 12, false, 0, false},
+			{"node-4", "4.4.4.4", 0, 2, false, 0, false},
 		})
 
 		nodes := clusterState.Nodes()
@@ -90,10 +93,10 @@ func TestClusterState_ApplyDigest(t *testing.T) {
 		assert.Equal(
 			t,
 			[]NodeMetadata{
-				{"node-1", "1.1.1.1", uint64(0), false, false, time.Time{}},
-				{"node-2", "2.2.2.2", uint64(0), false, false, time.Time{}},
-				{"node-3", "3.3.3.3", uint64(0), false, false, time.Time{}},
-				{"node-4", "4.4.4.4", uint64(0), false, false, time.Time{}},
+				{"node-1", "1.1.1.1", localEpoch, 0, uint64(0), false, false, time.Time{}},
+				{"node-2", "2.2.2.2", 0, 0, uint64(0), false, false, time.Time{}},
+				{"node-3", "3.3.3.3", 0, 0, uint64(0), false, false, time.Time{}},
+				{"node-4", "4.4.4.4", 0, 0, uint64(0), false, false, time.Time{}},
 			},
 			nodes,
 		)
@@ -103,12 +106,13 @@ func TestClusterState_ApplyDigest(t *testing.T) {
 		clusterState := newClusterState(
 			"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), newNopWatcher(),
 		)
+		localEpoch := clusterState.LocalNodeMetadata().Epoch
 
 		// Apply should ignore left nodes.
 		clusterState.ApplyDigest(digest{
-			{"node-2", "2.2.2.2", 5, true},
-			{"node-3", "3.3.3.3", 12, true},
-			{"node-4", "4.4.4.4", 2, false},
+			{"node-2", "2.2.2.2", 0, 5, true, 0, false},
+			{"node-3", "3.3.3.3", 0, 12, true, 0, false},
+			{"node-4", "4.4.4.4", 0, 2, false, 0, false},
 		})
 
 		nodes := clusterState.Nodes()
@@ -120,8 +124,8 @@ func TestClusterState_ApplyDigest(t *testing.T) {
 		assert.Equal(
 			t,
 			[]NodeMetadata{
-				{"node-1", "1.1.1.1", uint64(0), false, false, time.Time{}},
-				{"node-4", "4.4.4.4", uint64(0), false, false, time.Time{}},
+				{"node-1", "1.1.1.1", localEpoch, 0, uint64(0), false, false, time.Time{}},
+				{"node-4", "4.4.4.4", 0, 0, uint64(0), false, false, time.Time{}},
 			},
 			nodes,
 		)
@@ -134,9 +138,9 @@ func TestClusterState_ApplyDigest(t *testing.T) {
 		)
 
 		clusterState.ApplyDigest(digest{
-			{"node-2", "2.2.2.2", 5, false},
-			{"node-3", "3.3.3.3", 12, true},
-			{"node-4", "4.4.4.4", 2, false},
+			{"node-2", "2.2.2.2", 0, 5, false, 0, false},
+			{"node-3", "3.3.3.3", 0, 12, true, 0, false},
+			{"node-4", "4.4.4.4", 0, 2, false, 0, false},
 		})
 
 		assert.Equal(t, []string{
@@ -151,6 +155,7 @@ func TestClusterState_ApplyDelta(t *testing.T) {
 		clusterState := newClusterState(
 			"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), newNopWatcher(),
 		)
+		localEpoch := clusterState.LocalNodeMetadata().Epoch
 
 		clusterState.ApplyDelta(delta{
 			{
@@ -182,9 +187,9 @@ func TestClusterState_ApplyDelta(t *testing.T) {
 		assert.Equal(
 			t,
 			[]NodeMetadata{
-				{"node-1", "1.1.1.1", uint64(0), false, false, time.Time{}},
-				{"node-2", "2.2.2.2", uint64(8), false, false, time.Time{}},
-				{"node-3", "3.3.3.3", uint64(13), false, false, time.Time{}},
+				{"node-1", "1.1.1.1", localEpoch, 0, uint64(0), false, false, time.Time{}},
+				{"node-2", "2.2.2.2", 0, 0, uint64(8), false, false, time.Time{}},
+				{"node-3", "3.3.3.3", 0, 0, uint64(13), false, false, time.Time{}},
 			},
 			nodes,
 		)
@@ -300,6 +305,7 @@ func TestClusterState_Digest(t *testing.T) {
 	clusterState := newClusterState(
 		"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), newNopWatcher(),
 	)
+	localEpoch := clusterState.LocalNodeMetadata().Epoch
 	clusterState.UpsertLocal("k1", "v1")
 	clusterState.UpsertLocal("k2", "v2")
 	clusterState.UpsertLocal("k3", "v3")
@@ -331,9 +337,9 @@ func TestClusterState_Digest(t *testing.T) {
 		return stateDigest[i].ID < stateDigest[j].ID
 	})
 	assert.Equal(t, digest{
-		{"node-1", "1.1.1.1", 4, false},
-		{"node-2", "2.2.2.2", 8, false},
-		{"node-3", "3.3.3.3", 13, false},
+		{"node-1", "1.1.1.1", localEpoch, 4, false, 0, false},
+		{"node-2", "2.2.2.2", 0, 8, false, 0, false},
+		{"node-3", "3.3.3.3", 0, 13, false, 0, false},
 	}, stateDigest)
 }
 
@@ -341,6 +347,7 @@ func TestClusterState_Delta(t *testing.T) {
 	clusterState := newClusterState(
 		"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), newNopWatcher(),
 	)
+	localEpoch := clusterState.LocalNodeMetadata().Epoch
 	clusterState.UpsertLocal("k1", "v1")
 	clusterState.UpsertLocal("k2", "v2")
 	clusterState.UpsertLocal("k3", "v3")
@@ -374,8 +381,9 @@ func TestClusterState_Delta(t *testing.T) {
 	})
 	assert.Equal(t, delta{
 		{
-			ID:   "node-1",
-			Addr: "1.1.1.1",
+			ID:    "node-1",
+			Addr:  "1.1.1.1",
+			Epoch: localEpoch,
 			Entries: []Entry{
 				{"k1", "v1", 1, false, false},
 				{"k3", "v3", 3, false, false},
@@ -408,16 +416,17 @@ func TestClusterState_Delta(t *testing.T) {
 
 	// Get an partial delta.
 	stateDelta = clusterState.Delta(digest{
-		{"node-1", "1.1.1.1", 2, false},
-		{"node-2", "2.2.2.2", 4, false},
+		{"node-1", "1.1.1.1", localEpoch, 2, false, 0, false},
+		{"node-2", "2.2.2.2", 0, 4, false, 0, false},
 	}, false)
 	sort.Slice(stateDelta, func(i, j int) bool {
 		return stateDelta[i].ID < stateDelta[j].ID
 	})
 	assert.Equal(t, delta{
 		{
-			ID:   "node-1",
-			Addr: "1.1.1.1",
+			ID:    "node-1",
+			Addr:  "1.1.1.1",
+			Epoch: localEpoch,
 			Entries: []Entry{
 				{"k3", "v3", 3, false, false},
 				{"k2", "", 4, false, true},
@@ -434,6 +443,315 @@ func TestClusterState_Delta(t *testing.T) {
 	}, stateDelta)
 }
 
+func TestClusterState_Conflict(t *testing.T) {
+	t.Run("local conflict", func(t *testing.T) {
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), newNopWatcher(),
+		)
+		localEpoch := clusterState.LocalNodeMetadata().Epoch
+
+		conflicts := clusterState.ApplyDigest(digest{
+			{"node-1", "2.2.2.2", localEpoch + 1, 5, false, 0, false},
+		})
+		assert.Equal(t, 1, len(conflicts))
+		assert.Equal(t, "node-1", conflicts[0].NodeID)
+		assert.Equal(t, "2.2.2.2", conflicts[0].Addr)
+		assert.Equal(t, localEpoch+1, conflicts[0].Epoch)
+		assert.Equal(t, "1.1.1.1", conflicts[0].ExistingAddr)
+		assert.Equal(t, localEpoch, conflicts[0].ExistingEpoch)
+		assert.True(t, conflicts[0].Local)
+		assert.True(t, conflicts[0].Younger())
+
+		// Detecting the same conflict again should not return a new conflict.
+		conflicts = clusterState.ApplyDelta(delta{
+			{
+				ID:    "node-1",
+				Addr:  "2.2.2.2",
+				Epoch: localEpoch + 1,
+			},
+		})
+		assert.Equal(t, 0, len(conflicts))
+
+		assert.Equal(t, 1, len(clusterState.Conflicts()))
+
+		// The local node should refuse the join.
+		accept, _ := clusterState.CheckJoin("node-1", "2.2.2.2", localEpoch+1)
+		assert.False(t, accept)
+
+		// Conflicts should expire.
+		clusterState.RemoveExpiredAt(time.Now().Add(nodeExpiry * 2))
+		assert.Equal(t, 0, len(clusterState.Conflicts()))
+	})
+
+	t.Run("remote conflict", func(t *testing.T) {
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), newNopWatcher(),
+		)
+
+		clusterState.ApplyDelta(delta{
+			{
+				ID:    "node-2",
+				Addr:  "2.2.2.2",
+				Epoch: 10,
+				Entries: []Entry{
+					{"k1", "v1", 1, false, false},
+				},
+			},
+		})
+
+		// Another node with the same ID at a different address.
+		conflicts := clusterState.ApplyDelta(delta{
+			{
+				ID:    "node-2",
+				Addr:  "3.3.3.3",
+				Epoch: 20,
+				Entries: []Entry{
+					{"k2", "v2", 1, false, false},
+				},
+			},
+		})
+		assert.Equal(t, 1, len(conflicts))
+		assert.Equal(t, "node-2", conflicts[0].NodeID)
+		assert.Equal(t, "3.3.3.3", conflicts[0].Addr)
+		assert.Equal(t, "2.2.2.2", conflicts[0].ExistingAddr)
+		assert.False(t, conflicts[0].Local)
+
+		// The state of the conflicting node should be discarded.
+		state, ok := clusterState.Node("node-2")
+		require.True(t, ok)
+		assert.Equal(t, "2.2.2.2", state.Addr)
+		assert.Equal(t, uint64(10), state.Epoch)
+		assert.Equal(t, []Entry{{"k1", "v1", 1, false, false}}, state.Entries)
+
+		accept, _ := clusterState.CheckJoin("node-2", "3.3.3.3", 20)
+		assert.False(t, accept)
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		watcher := &fakeWatcher{}
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), watcher,
+		)
+
+		clusterState.ApplyDelta(delta{
+			{
+				ID:    "node-2",
+				Addr:  "2.2.2.2",
+				Epoch: 10,
+				Entries: []Entry{
+					{"k1", "v1", 1, false, false},
+					{"k2", "v2", 2, false, false},
+				},
+			},
+		})
+
+		// The node restarts with the same ID and address.
+		accept, conflict := clusterState.CheckJoin("node-2", "2.2.2.2", 20)
+		assert.True(t, accept)
+		assert.Nil(t, conflict)
+
+		conflicts := clusterState.ApplyDelta(delta{
+			{
+				ID:    "node-2",
+				Addr:  "2.2.2.2",
+				Epoch: 20,
+				Entries: []Entry{
+					{"k3", "v3", 1, false, false},
+				},
+			},
+		})
+		assert.Equal(t, 0, len(conflicts))
+
+		// The previous node state should be replaced.
+		state, ok := clusterState.Node("node-2")
+		require.True(t, ok)
+		assert.Equal(t, uint64(20), state.Epoch)
+		assert.Equal(t, []Entry{{"k3", "v3", 1, false, false}}, state.Entries)
+
+		assert.Equal(t, []string{"node-2", "node-2"}, watcher.joins)
+		assert.Equal(t, []string{"node-2"}, watcher.expires)
+
+		// State from the previous node should be discarded.
+		clusterState.ApplyDelta(delta{
+			{
+				ID:    "node-2",
+				Addr:  "2.2.2.2",
+				Epoch: 10,
+				Entries: []Entry{
+					{"k4", "v4", 5, false, false},
+				},
+			},
+		})
+		state, ok = clusterState.Node("node-2")
+		require.True(t, ok)
+		assert.Equal(t, []Entry{{"k3", "v3", 1, false, false}}, state.Entries)
+
+		assert.Equal(t, 0, len(clusterState.Conflicts()))
+	})
+}
+
+func TestClusterState_Incarnation(t *testing.T) {
+	t.Run("refute suspicion", func(t *testing.T) {
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), newNopWatcher(),
+		)
+		localEpoch := clusterState.LocalNodeMetadata().Epoch
+
+		// A digest that doesn't suspect the node should be ignored.
+		clusterState.ApplyDigest(digest{
+			{"node-1", "1.1.1.1", localEpoch, 0, false, 0, false},
+		})
+		assert.Equal(t, uint64(0), clusterState.LocalNodeMetadata().Incarnation)
+
+		clusterState.ApplyDigest(digest{
+			{"node-1", "1.1.1.1", localEpoch, 0, false, 0, true},
+		})
+		assert.Equal(t, uint64(1), clusterState.LocalNodeMetadata().Incarnation)
+
+		// A suspicion that was already refuted should be ignored.
+		clusterState.ApplyDigest(digest{
+			{"node-1", "1.1.1.1", localEpoch, 0, false, 0, true},
+		})
+		assert.Equal(t, uint64(1), clusterState.LocalNodeMetadata().Incarnation)
+	})
+
+	t.Run("remote refuted suspicion", func(t *testing.T) {
+		watcher := &fakeWatcher{}
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{
+				map[string]float64{
+					"node-2": 25.0,
+				},
+			}, newMetrics(), watcher,
+		)
+		clusterState.ApplyDelta(delta{
+			{
+				ID:   "node-2",
+				Addr: "2.2.2.2",
+			},
+		})
+
+		clusterState.UpdateLiveness(20.0)
+		node, _ := clusterState.Node("node-2")
+		assert.True(t, node.Unreachable)
+
+		// The digest should include the suspicion.
+		for _, entry := range clusterState.Digest() {
+			assert.Equal(t, entry.ID == "node-2", entry.Suspected)
+		}
+
+		// Receiving a higher incarnation should mark the node reachable.
+		clusterState.ApplyDigest(digest{
+			{"node-2", "2.2.2.2", 0, 0, false, 1, false},
+		})
+
+		node, _ = clusterState.Node("node-2")
+		assert.False(t, node.Unreachable)
+		assert.Equal(t, uint64(1), node.Incarnation)
+		assert.Equal(t, []string{"node-2"}, watcher.reachables)
+	})
+}
+
+func TestClusterState_ConvergenceLag(t *testing.T) {
+	metrics := newMetrics()
+	clusterState := newClusterState(
+		"node-1", "1.1.1.1", &fakeFailureDetector{}, metrics, newNopWatcher(),
+	)
+	localEpoch := clusterState.LocalNodeMetadata().Epoch
+
+	clusterState.UpsertLocal("k1", "v1")
+	clusterState.UpsertLocal("k2", "v2")
+	clusterState.ApplyDelta(delta{
+		{
+			ID:   "node-2",
+			Addr: "2.2.2.2",
+			Entries: []Entry{
+				{"k1", "v1", 3, false, false},
+			},
+		},
+	})
+
+	localVersion := clusterState.LocalNodeMetadata().Version
+	node, _ := clusterState.Node("node-2")
+	assert.Equal(t, uint64(3), node.Version)
+
+	// The digest is 2 versions behind the local node, and 4 versions ahead
+	// of node-2.
+	clusterState.ApplyDigest(digest{
+		{"node-1", "1.1.1.1", localEpoch, localVersion - 2, false, 0, false},
+		{"node-2", "2.2.2.2", 0, 7, false, 0, false},
+	})
+	assert.Equal(t, 4.0, testutil.ToFloat64(metrics.ConvergenceLag))
+
+	// Once converged there is no lag.
+	clusterState.ApplyDigest(digest{
+		{"node-1", "1.1.1.1", localEpoch, localVersion, false, 0, false},
+		{"node-2", "2.2.2.2", 0, 3, false, 0, false},
+	})
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.ConvergenceLag))
+}
+
+func TestClusterState_SyncMetrics(t *testing.T) {
+	t.Run("peer sync age", func(t *testing.T) {
+		metrics := newMetrics()
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, metrics, newNopWatcher(),
+		)
+		clusterState.ApplyDigest(digest{
+			{"node-2", "2.2.2.2", 0, 0, false, 0, false},
+			{"node-3", "3.3.3.3", 0, 0, false, 0, false},
+		})
+
+		clusterState.ReportSync("node-2")
+		// Unknown nodes are ignored.
+		clusterState.ReportSync("node-4")
+
+		clusterState.UpdateSyncMetricsAt(time.Now().Add(time.Minute))
+		assert.GreaterOrEqual(t, testutil.ToFloat64(
+			metrics.PeerSyncAge.WithLabelValues("node-2"),
+		), 60.0)
+		// node-3 has never synced, and node-4 is unknown.
+		assert.Equal(t, 1, testutil.CollectAndCount(metrics.PeerSyncAge))
+	})
+
+	t.Run("unacknowledged update age", func(t *testing.T) {
+		metrics := newMetrics()
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, metrics, newNopWatcher(),
+		)
+		localEpoch := clusterState.LocalNodeMetadata().Epoch
+		clusterState.ApplyDigest(digest{
+			{"node-2", "2.2.2.2", 0, 0, false, 0, false},
+		})
+
+		clusterState.UpsertLocal("k1", "v1")
+		clusterState.UpsertLocal("k2", "v2")
+
+		clusterState.UpdateSyncMetricsAt(time.Now().Add(time.Minute))
+		assert.GreaterOrEqual(t, testutil.ToFloat64(metrics.UnacknowledgedUpdateAge), 60.0)
+
+		// Acknowledge both updates.
+		clusterState.ApplyDigest(digest{
+			{"node-1", "1.1.1.1", localEpoch, 2, false, 0, false},
+		})
+		clusterState.UpdateSyncMetricsAt(time.Now().Add(time.Minute))
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.UnacknowledgedUpdateAge))
+	})
+
+	t.Run("no live nodes", func(t *testing.T) {
+		metrics := newMetrics()
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, metrics, newNopWatcher(),
+		)
+		clusterState.UpsertLocal("k1", "v1")
+
+		// With no other nodes to acknowledge updates, there are no pending
+		// updates.
+		clusterState.UpdateSyncMetricsAt(time.Now().Add(time.Minute))
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.UnacknowledgedUpdateAge))
+	})
+}
+
 func TestClusterState_Leave(t *testing.T) {
 	t.Run("leave local", func(t *testing.T) {
 		clusterState := newClusterState(
@@ -582,7 +900,7 @@ func TestClusterState_Compact(t *testing.T) {
 
 		// The number of deleted keys is less than the threshold so this should
 		// do nothing.
-		clusterState.CompactLocal(10)
+		assert.Equal(t, 0, clusterState.CompactLocal(10))
 
 		node := clusterState.LocalNode()
 		assert.Equal(
@@ -598,7 +916,7 @@ func TestClusterState_Compact(t *testing.T) {
 
 		// The number of deleted keys is greater than the threshold so this
 		// should compact.
-		clusterState.CompactLocal(1)
+		assert.Equal(t, 2, clusterState.CompactLocal(1))
 
 		node = clusterState.LocalNode()
 		assert.Equal(
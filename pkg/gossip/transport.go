@@ -0,0 +1,105 @@
+package gossip
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// StreamTransport is a reliable connection based transport, used to exchange
+// the full cluster state when joining and leaving the cluster.
+//
+// Addresses are the gossip addresses advertised by each node, which lets the
+// transport be replaced without changing the gossip protocol, such as to wrap
+// connections with TLS or use an in-memory transport in tests.
+type StreamTransport interface {
+	// Accept waits for and returns the next incoming connection. Once the
+	// transport is closed returns net.ErrClosed.
+	Accept() (net.Conn, error)
+
+	// Dial opens a connection to the node at the given address.
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+
+	Close() error
+}
+
+// PacketTransport is an unreliable packet based transport, used to exchange
+// digests and deltas each gossip round.
+//
+// Packets may be dropped, duplicated or reordered, so the gossip protocol
+// doesn't depend on delivery.
+type PacketTransport interface {
+	// ReadFrom reads a packet into b, returning the number of bytes read and
+	// the address of the sender. Once the transport is closed returns
+	// net.ErrClosed.
+	ReadFrom(b []byte) (int, string, error)
+
+	// WriteTo writes a packet to the node at the given address.
+	WriteTo(b []byte, addr string) error
+
+	Close() error
+}
+
+// TCPTransport is a StreamTransport using TCP.
+type TCPTransport struct {
+	ln net.Listener
+}
+
+// NewTCPTransport returns a transport that accepts connections from the
+// given listener.
+func NewTCPTransport(ln net.Listener) *TCPTransport {
+	return &TCPTransport{
+		ln: ln,
+	}
+}
+
+func (t *TCPTransport) Accept() (net.Conn, error) {
+	return t.ln.Accept()
+}
+
+func (t *TCPTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func (t *TCPTransport) Close() error {
+	return t.ln.Close()
+}
+
+// UDPTransport is a PacketTransport using UDP.
+type UDPTransport struct {
+	conn net.PacketConn
+}
+
+// NewUDPTransport returns a transport that sends and receives packets using
+// the given connection.
+func NewUDPTransport(conn net.PacketConn) *UDPTransport {
+	return &UDPTransport{
+		conn: conn,
+	}
+}
+
+func (t *UDPTransport) ReadFrom(b []byte) (int, string, error) {
+	n, addr, err := t.conn.ReadFrom(b)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, addr.String(), nil
+}
+
+func (t *UDPTransport) WriteTo(b []byte, addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("resolve udp: %s: %w", addr, err)
+	}
+	if _, err = t.conn.WriteTo(b, udpAddr); err != nil {
+		return fmt.Errorf("write packet: %s: %w", addr, err)
+	}
+	return nil
+}
+
+func (t *UDPTransport) Close() error {
+	return t.conn.Close()
+}
+
+var _ StreamTransport = &TCPTransport{}
+var _ PacketTransport = &UDPTransport{}
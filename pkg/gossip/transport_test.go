@@ -0,0 +1,401 @@
+package gossip
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+type memPacket struct {
+	from      string
+	to        string
+	b         []byte
+	deliverAt int
+}
+
+// memNetwork is a deterministic in-memory network that delivers packets
+// between memTransports.
+//
+// The network can drop, duplicate, delay and reorder packets, using a seeded
+// random source so failures can be reproduced. Time is simulated using ticks,
+// where each call to Step advances the network by one tick.
+type memNetwork struct {
+	rand *rand.Rand
+
+	// dropRate is the probability a packet is dropped.
+	dropRate float64
+	// duplicateRate is the probability a packet is duplicated.
+	duplicateRate float64
+	// maxDelay is the maximum number of ticks a packet is delayed. Since each
+	// packet has a random delay, packets are also reordered.
+	maxDelay int
+
+	tick    int
+	pending []memPacket
+
+	// handlers contains the handler for packets sent to each address.
+	handlers map[string]func(b []byte)
+}
+
+func newMemNetwork(seed int64) *memNetwork {
+	return &memNetwork{
+		rand:     rand.New(rand.NewSource(seed)),
+		handlers: make(map[string]func(b []byte)),
+	}
+}
+
+// Transport returns a transport for the node at the given address.
+func (n *memNetwork) Transport(addr string) *memTransport {
+	return &memTransport{
+		addr:    addr,
+		network: n,
+	}
+}
+
+// Handle registers the handler for packets sent to the given address.
+func (n *memNetwork) Handle(addr string, handler func(b []byte)) {
+	n.handlers[addr] = handler
+}
+
+// Heal stops the network dropping, duplicating or delaying packets.
+func (n *memNetwork) Heal() {
+	n.dropRate = 0
+	n.duplicateRate = 0
+	n.maxDelay = 0
+}
+
+// Step advances the network one tick and delivers any due packets. Packets
+// sent while handling a packet are never delivered in the same tick.
+func (n *memNetwork) Step() {
+	n.tick++
+
+	// Shuffle before a stable sort so packets due in the same tick are
+	// delivered in a random order.
+	n.rand.Shuffle(len(n.pending), func(i, j int) {
+		n.pending[i], n.pending[j] = n.pending[j], n.pending[i]
+	})
+	sort.SliceStable(n.pending, func(i, j int) bool {
+		return n.pending[i].deliverAt < n.pending[j].deliverAt
+	})
+
+	var due []memPacket
+	var remaining []memPacket
+	for _, p := range n.pending {
+		if p.deliverAt <= n.tick {
+			due = append(due, p)
+		} else {
+			remaining = append(remaining, p)
+		}
+	}
+	n.pending = remaining
+
+	for _, p := range due {
+		handler, ok := n.handlers[p.to]
+		if !ok {
+			continue
+		}
+		handler(p.b)
+	}
+}
+
+// Pending returns the number of undelivered packets.
+func (n *memNetwork) Pending() int {
+	return len(n.pending)
+}
+
+func (n *memNetwork) send(from string, to string, b []byte) {
+	if n.rand.Float64() < n.dropRate {
+		return
+	}
+
+	copies := 1
+	if n.rand.Float64() < n.duplicateRate {
+		copies = 2
+	}
+	for i := 0; i != copies; i++ {
+		delay := 1
+		if n.maxDelay > 1 {
+			delay += n.rand.Intn(n.maxDelay)
+		}
+		// Copy since the sender may reuse the buffer.
+		p := memPacket{
+			from:      from,
+			to:        to,
+			b:         append([]byte(nil), b...),
+			deliverAt: n.tick + delay,
+		}
+		n.pending = append(n.pending, p)
+	}
+}
+
+// memTransport is a PacketTransport that sends packets via a memNetwork.
+//
+// Packets are delivered by the network calling the registered handler
+// directly rather than via ReadFrom, so delivery is deterministic.
+type memTransport struct {
+	addr    string
+	network *memNetwork
+}
+
+func (t *memTransport) ReadFrom(_ []byte) (int, string, error) {
+	return 0, "", net.ErrClosed
+}
+
+func (t *memTransport) WriteTo(b []byte, addr string) error {
+	t.network.send(t.addr, addr, b)
+	return nil
+}
+
+func (t *memTransport) Close() error {
+	return nil
+}
+
+// memStreamNetwork is an in-memory network that connects
+// memStreamTransports using net.Pipe.
+type memStreamNetwork struct {
+	transports map[string]*memStreamTransport
+	mu         sync.Mutex
+}
+
+func newMemStreamNetwork() *memStreamNetwork {
+	return &memStreamNetwork{
+		transports: make(map[string]*memStreamTransport),
+	}
+}
+
+// Transport returns a transport for the node at the given address.
+func (n *memStreamNetwork) Transport(addr string) *memStreamTransport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	t := &memStreamTransport{
+		network: n,
+		connCh:  make(chan net.Conn),
+		closeCh: make(chan struct{}),
+	}
+	n.transports[addr] = t
+	return t
+}
+
+func (n *memStreamNetwork) transport(addr string) (*memStreamTransport, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	t, ok := n.transports[addr]
+	return t, ok
+}
+
+// memStreamTransport is a StreamTransport that connects to other transports
+// in a memStreamNetwork.
+type memStreamTransport struct {
+	network *memStreamNetwork
+
+	connCh    chan net.Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *memStreamTransport) Accept() (net.Conn, error) {
+	select {
+	case conn := <-t.connCh:
+		return conn, nil
+	case <-t.closeCh:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *memStreamTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	remote, ok := t.network.transport(addr)
+	if !ok {
+		return nil, fmt.Errorf("unknown addr: %s", addr)
+	}
+
+	local, accepted := net.Pipe()
+	select {
+	case remote.connCh <- accepted:
+		return local, nil
+	case <-remote.closeCh:
+		return nil, fmt.Errorf("connection refused: %s", addr)
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("dial timeout: %s", addr)
+	}
+}
+
+func (t *memStreamTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closeCh)
+	})
+	return nil
+}
+
+var _ PacketTransport = &memTransport{}
+var _ StreamTransport = &memStreamTransport{}
+
+// Tests gossip nodes can join using in-memory transports.
+func TestGossip_MemoryTransport(t *testing.T) {
+	streamNetwork := newMemStreamNetwork()
+	packetNetwork := newMemNetwork(0)
+
+	newNode := func(id string, addr string) *Gossip {
+		gossip, err := New(Options{
+			NodeID: id,
+			Config: &Config{
+				BindAddr:      addr,
+				AdvertiseAddr: addr,
+				// Use a long interval so rounds are only triggered by the
+				// test.
+				Interval:         time.Hour,
+				Fanout:           1,
+				MaxPacketSize:    1400,
+				CompactThreshold: 100,
+			},
+			StreamTransport: streamNetwork.Transport(addr),
+			PacketTransport: packetNetwork.Transport(addr),
+			Logger:          log.NewNopLogger(),
+		})
+		require.NoError(t, err)
+		return gossip
+	}
+
+	node1 := newNode("node-1", "10.0.0.1:8003")
+	defer node1.Close()
+	node1.UpsertLocal("k1", "v1")
+
+	node2 := newNode("node-2", "10.0.0.2:8003")
+	defer node2.Close()
+	node2.UpsertLocal("k2", "v2")
+
+	joined, err := node2.Join([]string{"10.0.0.1:8003"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"node-1"}, joined)
+
+	// Joining exchanges the full state of both nodes.
+	state, ok := node2.Node("node-1")
+	require.True(t, ok)
+	assert.Equal(t, []Entry{{"k1", "v1", 1, false, false}}, state.Entries)
+
+	state, ok = node1.Node("node-2")
+	require.True(t, ok)
+	assert.Equal(t, []Entry{{"k2", "v2", 1, false, false}}, state.Entries)
+}
+
+func TestGossip_StreamCompression(t *testing.T) {
+	for _, compression := range []Compression{
+		CompressionNone, CompressionGzip, CompressionDeflate,
+	} {
+		t.Run(string(compression), func(t *testing.T) {
+			streamNetwork := newMemStreamNetwork()
+			packetNetwork := newMemNetwork(0)
+
+			newNode := func(id string, addr string, compression Compression) *Gossip {
+				gossip, err := New(Options{
+					NodeID: id,
+					Config: &Config{
+						BindAddr:          addr,
+						AdvertiseAddr:     addr,
+						Interval:          time.Hour,
+						Fanout:            1,
+						MaxPacketSize:     1400,
+						CompactThreshold:  100,
+						StreamCompression: compression,
+					},
+					StreamTransport: streamNetwork.Transport(addr),
+					PacketTransport: packetNetwork.Transport(addr),
+					Logger:          log.NewNopLogger(),
+				})
+				require.NoError(t, err)
+				return gossip
+			}
+
+			// The node receiving the stream responds with the compression
+			// of the joining node, regardless of its own configuration.
+			node1 := newNode("node-1", "10.0.0.1:8003", CompressionNone)
+			defer node1.Close()
+			node1.UpsertLocal("k1", "v1")
+
+			node2 := newNode("node-2", "10.0.0.2:8003", compression)
+			defer node2.Close()
+			node2.UpsertLocal("k2", "v2")
+
+			joined, err := node2.Join([]string{"10.0.0.1:8003"})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"node-1"}, joined)
+
+			state, ok := node2.Node("node-1")
+			require.True(t, ok)
+			assert.Equal(t, []Entry{{"k1", "v1", 1, false, false}}, state.Entries)
+
+			state, ok = node1.Node("node-2")
+			require.True(t, ok)
+			assert.Equal(t, []Entry{{"k2", "v2", 1, false, false}}, state.Entries)
+
+			require.NoError(t, node2.Leave())
+			state, ok = node1.Node("node-2")
+			require.True(t, ok)
+			assert.True(t, state.Left)
+		})
+	}
+}
+
+func FuzzPacketListener_HandlePacket(f *testing.F) {
+	digestPacket, err := encodeDigest(digestHeader{
+		NodeID:  "node-2",
+		Addr:    "10.0.0.2:8003",
+		Request: true,
+	}, digest{
+		{"node-2", "10.0.0.2:8003", 1, 4, false, 0, false},
+	}, 1400, supportedVersion)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(digestPacket)
+
+	deltaPacket, err := encodeDelta(deltaHeader{
+		NodeID: "node-2",
+		Addr:   "10.0.0.2:8003",
+	}, delta{
+		{
+			ID:   "node-2",
+			Addr: "10.0.0.2:8003",
+			Entries: []Entry{
+				{"k1", "v1", 1, false, false},
+				{compactKey, "1", 2, true, false},
+				{leftKey, "", 3, true, false},
+			},
+		},
+	}, 1400, supportedVersion)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(deltaPacket)
+
+	f.Fuzz(func(_ *testing.T, b []byte) {
+		network := newMemNetwork(0)
+		metrics := newMetrics()
+		state := newClusterState(
+			"node-1", "10.0.0.1:8003", &fakeFailureDetector{}, metrics, newNopWatcher(),
+		)
+		listener := newPacketListener(
+			network.Transport("10.0.0.1:8003"),
+			state,
+			&fakeFailureDetector{},
+			1400,
+			0,
+			false,
+			metrics,
+			log.NewNopLogger(),
+		)
+
+		// Only checks handling arbitrary packets doesn't panic.
+		_ = listener.handlePacket(b)
+	})
+}
@@ -0,0 +1,34 @@
+package gossip
+
+// ReportVersion records the protocol version of a message received from the
+// node with the given ID, so later messages to the node use the same
+// version. Unknown nodes are ignored.
+func (s *clusterState) ReportVersion(nodeID string, version uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.nodes[nodeID]; !ok || nodeID == s.localID {
+		return
+	}
+
+	if version == legacyVersion {
+		s.legacyNodes[nodeID] = struct{}{}
+	} else {
+		delete(s.legacyNodes, nodeID)
+	}
+}
+
+// NodeVersion returns the protocol version to use when sending messages to
+// the node with the given ID.
+//
+// Returns the legacy version if the last message received from the node
+// used the legacy version, otherwise the supported version.
+func (s *clusterState) NodeVersion(nodeID string) uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.legacyNodes[nodeID]; ok {
+		return legacyVersion
+	}
+	return supportedVersion
+}
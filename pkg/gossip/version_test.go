@@ -0,0 +1,129 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestClusterState_Version(t *testing.T) {
+	t.Run("report", func(t *testing.T) {
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), newNopWatcher(),
+		)
+		clusterState.ApplyDigest(digest{
+			{"node-2", "2.2.2.2", 0, 0, false, 0, false},
+		})
+
+		assert.Equal(t, supportedVersion, clusterState.NodeVersion("node-2"))
+
+		clusterState.ReportVersion("node-2", legacyVersion)
+		assert.Equal(t, legacyVersion, clusterState.NodeVersion("node-2"))
+
+		// Once upgraded the node uses the supported version.
+		clusterState.ReportVersion("node-2", supportedVersion)
+		assert.Equal(t, supportedVersion, clusterState.NodeVersion("node-2"))
+
+		// Unknown nodes are ignored.
+		clusterState.ReportVersion("node-3", legacyVersion)
+		assert.Equal(t, supportedVersion, clusterState.NodeVersion("node-3"))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		clusterState := newClusterState(
+			"node-1", "1.1.1.1", &fakeFailureDetector{}, newMetrics(), newNopWatcher(),
+		)
+		clusterState.ApplyDelta(delta{
+			{
+				ID:   "node-2",
+				Addr: "2.2.2.2",
+			},
+		})
+		clusterState.ReportVersion("node-2", legacyVersion)
+
+		// Leave.
+		clusterState.ApplyDelta(delta{
+			{
+				ID:   "node-2",
+				Addr: "2.2.2.2",
+				Entries: []Entry{
+					{leftKey, "", 1, true, false},
+				},
+			},
+		})
+		clusterState.RemoveExpiredAt(time.Now().Add(nodeExpiry * 2))
+
+		assert.Empty(t, clusterState.legacyNodes)
+	})
+}
+
+func TestPacketListener_Version(t *testing.T) {
+	newListener := func(network *memNetwork, legacyProtocol bool) *packetListener {
+		metrics := newMetrics()
+		state := newClusterState(
+			"node-1", "10.0.0.1:8003", &fakeFailureDetector{}, metrics, newNopWatcher(),
+		)
+		return newPacketListener(
+			network.Transport("10.0.0.1:8003"),
+			state,
+			&fakeFailureDetector{},
+			1400,
+			0,
+			legacyProtocol,
+			metrics,
+			log.NewNopLogger(),
+		)
+	}
+	legacyDigest := func(request bool) []byte {
+		b, err := encodeDigest(digestHeader{
+			NodeID:  "node-2",
+			Addr:    "10.0.0.2:8003",
+			Request: request,
+		}, digest{
+			{"node-2", "10.0.0.2:8003", 1, 4, false, 0, false},
+		}, 1400, legacyVersion)
+		require.NoError(t, err)
+		return b
+	}
+
+	t.Run("legacy request", func(t *testing.T) {
+		network := newMemNetwork(0)
+		listener := newListener(network, true)
+
+		require.NoError(t, listener.handlePacket(legacyDigest(true)))
+
+		// Responds using the legacy version and records the sender as a
+		// legacy node.
+		require.NotEmpty(t, network.pending)
+		for _, packet := range network.pending {
+			assert.Equal(t, legacyVersion, packet.b[1])
+		}
+		assert.Equal(t, legacyVersion, listener.state.NodeVersion("node-2"))
+	})
+
+	t.Run("legacy response", func(t *testing.T) {
+		network := newMemNetwork(0)
+		listener := newListener(network, true)
+
+		// Responses use the version of our own request, so don't change the
+		// version of the sender.
+		require.NoError(t, listener.handlePacket(legacyDigest(false)))
+		assert.Equal(t, supportedVersion, listener.state.NodeVersion("node-2"))
+	})
+
+	t.Run("legacy disabled", func(t *testing.T) {
+		network := newMemNetwork(0)
+		listener := newListener(network, false)
+
+		err := listener.handlePacket(legacyDigest(true))
+		assert.EqualError(t, err, "unsupported version: 0")
+		assert.Empty(t, network.pending)
+
+		_, ok := listener.state.Node("node-2")
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,127 @@
+package gossip
+
+import (
+	"sort"
+)
+
+const (
+	// joinSyncPeers is the number of peers to request the full cluster state
+	// from when joining, so the views of the peers can be cross-checked
+	// rather than trusting a single peer.
+	joinSyncPeers = 3
+)
+
+// nodeView is a peers view of a node in the cluster.
+type nodeView struct {
+	Addr  string `json:"addr"`
+	Epoch uint64 `json:"epoch"`
+	Left  bool   `json:"left"`
+}
+
+// clusterView is a peers view of the cluster, containing the nodes the peer
+// knows about, keyed by node ID.
+type clusterView map[string]nodeView
+
+// newClusterView returns the view of the cluster from a full delta received
+// from a peer.
+func newClusterView(delta delta) clusterView {
+	view := make(clusterView)
+	for _, entry := range delta {
+		node := nodeView{
+			Addr:  entry.Addr,
+			Epoch: entry.Epoch,
+		}
+		for _, e := range entry.Entries {
+			if e.Key == leftKey {
+				node.Left = true
+			}
+		}
+		view[entry.ID] = node
+	}
+	return view
+}
+
+// viewInconsistency is a node whose state differs between the views of the
+// peers synced with when joining, such as when the peers have a split view
+// of the cluster.
+type viewInconsistency struct {
+	NodeID string
+
+	// Views contains each peers view of the node, keyed by peer ID. If a
+	// peer doesn't know about the node its view is nil.
+	Views map[string]*nodeView
+}
+
+// Missing returns the IDs of the peers that don't know about the node,
+// sorted by ID.
+func (i viewInconsistency) Missing() []string {
+	var missing []string
+	for peerID, view := range i.Views {
+		if view == nil {
+			missing = append(missing, peerID)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// compareViews cross-checks the views of the cluster received from each peer,
+// keyed by peer ID, and returns the nodes whose state differs between peers,
+// sorted by node ID.
+//
+// The local node is excluded since its state is owned by the local node.
+//
+// Note the versions of each node are not compared, since peers are expected
+// to lag behind each other briefly as updates propagate. Only differences in
+// which nodes are known, and which instance of each node is known, are
+// considered inconsistent.
+func compareViews(views map[string]clusterView, localID string) []viewInconsistency {
+	if len(views) < 2 {
+		return nil
+	}
+
+	nodeIDs := make(map[string]struct{})
+	for _, view := range views {
+		for nodeID := range view {
+			if nodeID == localID {
+				continue
+			}
+			nodeIDs[nodeID] = struct{}{}
+		}
+	}
+
+	var inconsistencies []viewInconsistency
+	for nodeID := range nodeIDs {
+		inconsistency := viewInconsistency{
+			NodeID: nodeID,
+			Views:  make(map[string]*nodeView),
+		}
+
+		consistent := true
+		var first *nodeView
+		for peerID, view := range views {
+			node, ok := view[nodeID]
+			if !ok {
+				inconsistency.Views[peerID] = nil
+				consistent = false
+				continue
+			}
+			inconsistency.Views[peerID] = &node
+
+			if first == nil {
+				first = &node
+			} else if *first != node {
+				consistent = false
+			}
+		}
+
+		if !consistent {
+			inconsistencies = append(inconsistencies, inconsistency)
+		}
+	}
+
+	sort.Slice(inconsistencies, func(i, j int) bool {
+		return inconsistencies[i].NodeID < inconsistencies[j].NodeID
+	})
+	return inconsistencies
+}
@@ -0,0 +1,113 @@
+package gossip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClusterView(t *testing.T) {
+	view := newClusterView(delta{
+		{
+			ID:    "node-1",
+			Addr:  "10.26.104.1:8003",
+			Epoch: 1,
+			Entries: []Entry{
+				{Key: "k1", Value: "v1", Version: 1},
+			},
+		},
+		{
+			ID:    "node-2",
+			Addr:  "10.26.104.2:8003",
+			Epoch: 2,
+			Entries: []Entry{
+				{Key: leftKey, Version: 5, Internal: true},
+			},
+		},
+	})
+	assert.Equal(t, clusterView{
+		"node-1": {Addr: "10.26.104.1:8003", Epoch: 1},
+		"node-2": {Addr: "10.26.104.2:8003", Epoch: 2, Left: true},
+	}, view)
+}
+
+func TestCompareViews(t *testing.T) {
+	t.Run("consistent", func(t *testing.T) {
+		views := map[string]clusterView{
+			"node-1": {
+				"node-1": {Addr: "10.26.104.1:8003", Epoch: 1},
+				"node-2": {Addr: "10.26.104.2:8003", Epoch: 2},
+			},
+			"node-2": {
+				"node-1": {Addr: "10.26.104.1:8003", Epoch: 1},
+				"node-2": {Addr: "10.26.104.2:8003", Epoch: 2},
+			},
+		}
+		assert.Empty(t, compareViews(views, "local"))
+	})
+
+	t.Run("single view", func(t *testing.T) {
+		views := map[string]clusterView{
+			"node-1": {
+				"node-1": {Addr: "10.26.104.1:8003", Epoch: 1},
+			},
+		}
+		assert.Empty(t, compareViews(views, "local"))
+	})
+
+	t.Run("split view", func(t *testing.T) {
+		views := map[string]clusterView{
+			"node-1": {
+				"node-1": {Addr: "10.26.104.1:8003", Epoch: 1},
+				"node-2": {Addr: "10.26.104.2:8003", Epoch: 2},
+			},
+			"node-2": {
+				"node-1": {Addr: "10.26.104.1:8003", Epoch: 1},
+				"node-2": {Addr: "10.26.104.2:8003", Epoch: 2},
+				"node-3": {Addr: "10.26.104.3:8003", Epoch: 3},
+			},
+		}
+		inconsistencies := compareViews(views, "local")
+		require.Len(t, inconsistencies, 1)
+		assert.Equal(t, "node-3", inconsistencies[0].NodeID)
+		assert.Equal(t, []string{"node-1"}, inconsistencies[0].Missing())
+	})
+
+	t.Run("mismatched state", func(t *testing.T) {
+		views := map[string]clusterView{
+			"node-1": {
+				"node-1": {Addr: "10.26.104.1:8003", Epoch: 1},
+				"node-2": {Addr: "10.26.104.2:8003", Epoch: 2},
+				"node-3": {Addr: "10.26.104.3:8003", Epoch: 3},
+			},
+			"node-2": {
+				"node-1": {Addr: "10.26.104.1:8003", Epoch: 1},
+				"node-2": {Addr: "10.26.104.2:8003", Epoch: 2},
+				// node-2 knows an earlier instance of node-3 that left.
+				"node-3": {Addr: "10.26.104.3:8003", Epoch: 1, Left: true},
+			},
+		}
+		inconsistencies := compareViews(views, "local")
+		require.Len(t, inconsistencies, 1)
+		assert.Equal(t, "node-3", inconsistencies[0].NodeID)
+		assert.Empty(t, inconsistencies[0].Missing())
+		assert.Equal(t, map[string]*nodeView{
+			"node-1": {Addr: "10.26.104.3:8003", Epoch: 3},
+			"node-2": {Addr: "10.26.104.3:8003", Epoch: 1, Left: true},
+		}, inconsistencies[0].Views)
+	})
+
+	t.Run("ignore local node", func(t *testing.T) {
+		views := map[string]clusterView{
+			"node-1": {
+				"local":  {Addr: "10.26.104.4:8003", Epoch: 1},
+				"node-1": {Addr: "10.26.104.1:8003", Epoch: 1},
+			},
+			"node-2": {
+				"node-1": {Addr: "10.26.104.1:8003", Epoch: 1},
+			},
+		}
+		assert.Empty(t, compareViews(views, "local"))
+	})
+}
@@ -3,8 +3,16 @@ package gossip
 // Watcher is used to receive notifications when the known remote node state
 // changes.
 //
-// The implementations of Watcher must not block. Watcher is also called with
-// the state mutex held so should not call back to Gossip.
+// Watcher is only notified about remote nodes, never the local node.
+// Notifications are delivered in the order the changes are applied, and a
+// node is always notified with OnJoin before any other notification for that
+// node. If a node restarts with the same ID, the previous instance is
+// notified with OnExpired before the new instance is notified with OnJoin.
+//
+// Watcher is called synchronously from the goroutine applying the update,
+// with the state mutex held. Therefore implementations must not block and
+// must not call back to Gossip, otherwise they will deadlock. To process
+// notifications asynchronously, the implementation should queue them.
 type Watcher interface {
 	// OnJoin notifies that a new node joined the cluster.
 	OnJoin(nodeID string)
@@ -0,0 +1,137 @@
+// Package keepalive detects dead peers on multiplexed sessions.
+//
+// Connections between agents and the server may be silently dropped, such
+// as by a NAT expiring the connection mapping, in which case neither side
+// detects the connection closed until TCP times out. Sending application
+// level pings lets each side detect the peer is unreachable and close the
+// session quickly.
+package keepalive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	// ErrDeadPeer is returned when the peer didn't respond to the configured
+	// number of consecutive pings.
+	ErrDeadPeer = errors.New("dead peer")
+)
+
+type Config struct {
+	// Interval is the interval to send pings to the peer. If zero keepalive
+	// pings are disabled.
+	Interval time.Duration `json:"interval" yaml:"interval"`
+
+	// MaxMissed is the number of consecutive pings that must fail before
+	// the peer is considered dead.
+	MaxMissed int `json:"max_missed" yaml:"max_missed"`
+}
+
+func (c *Config) Enabled() bool {
+	return c.Interval != 0
+}
+
+func (c *Config) Validate() error {
+	if c.Interval != 0 && c.MaxMissed == 0 {
+		return fmt.Errorf("missing max missed")
+	}
+	return nil
+}
+
+func (c *Config) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".keepalive."
+
+	fs.DurationVar(
+		&c.Interval,
+		prefix+"interval",
+		c.Interval,
+		`
+The interval to send keepalive pings to the peer.
+
+Pings detect connections that were silently dropped, such as by a NAT, so
+they can be closed and cleaned up quickly.
+
+Set to 0 to disable keepalive pings.`,
+	)
+
+	fs.IntVar(
+		&c.MaxMissed,
+		prefix+"max-missed",
+		c.MaxMissed,
+		`
+The number of consecutive keepalive pings that must fail before the
+connection is considered dead and closed.`,
+	)
+}
+
+// Session is a multiplexed session that supports pings, such as a
+// [yamux.Session].
+type Session interface {
+	// Ping sends a ping to the peer and waits for a response.
+	Ping() (time.Duration, error)
+
+	// CloseChan returns a channel that is closed when the session is closed.
+	CloseChan() <-chan struct{}
+
+	Close() error
+}
+
+// Monitor pings the peer at the configured interval until either the context
+// is cancelled or the session closes.
+//
+// If MaxMissed consecutive pings fail, the session is closed and returns
+// ErrDeadPeer.
+func Monitor(ctx context.Context, sess Session, conf Config) error {
+	if !conf.Enabled() {
+		return nil
+	}
+
+	ticker := time.NewTicker(conf.Interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-sess.CloseChan():
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+
+		if ping(sess, conf.Interval) {
+			missed = 0
+			continue
+		}
+
+		missed++
+		if missed >= conf.MaxMissed {
+			sess.Close()
+			return ErrDeadPeer
+		}
+	}
+}
+
+// ping sends a ping and returns true if a response is received within the
+// timeout.
+func ping(sess Session, timeout time.Duration) bool {
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := sess.Ping()
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	case <-sess.CloseChan():
+		return false
+	}
+}
@@ -0,0 +1,120 @@
+package keepalive
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSession struct {
+	pingErr error
+	pings   int
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex
+}
+
+func newFakeSession(pingErr error) *fakeSession {
+	return &fakeSession{
+		pingErr: pingErr,
+		closeCh: make(chan struct{}),
+	}
+}
+
+func (s *fakeSession) Ping() (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pings++
+	return time.Millisecond, s.pingErr
+}
+
+func (s *fakeSession) Pings() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pings
+}
+
+func (s *fakeSession) CloseChan() <-chan struct{} {
+	return s.closeCh
+}
+
+func (s *fakeSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+	return nil
+}
+
+func TestMonitor(t *testing.T) {
+	t.Run("dead peer", func(t *testing.T) {
+		sess := newFakeSession(errors.New("timeout"))
+
+		err := Monitor(context.Background(), sess, Config{
+			Interval:  time.Millisecond,
+			MaxMissed: 3,
+		})
+		assert.ErrorIs(t, err, ErrDeadPeer)
+		assert.Equal(t, 3, sess.Pings())
+
+		// The session should be closed.
+		select {
+		case <-sess.CloseChan():
+		default:
+			t.Error("session not closed")
+		}
+	})
+
+	t.Run("healthy peer", func(t *testing.T) {
+		sess := newFakeSession(nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- Monitor(ctx, sess, Config{
+				Interval:  time.Millisecond * 10,
+				MaxMissed: 3,
+			})
+		}()
+
+		assert.Eventually(t, func() bool {
+			return sess.Pings() > 5
+		}, time.Second, time.Millisecond)
+
+		cancel()
+		assert.NoError(t, <-errCh)
+
+		// The session should not be closed.
+		select {
+		case <-sess.CloseChan():
+			t.Error("session closed")
+		default:
+		}
+	})
+
+	t.Run("session closed", func(t *testing.T) {
+		sess := newFakeSession(nil)
+		sess.Close()
+
+		err := Monitor(context.Background(), sess, Config{
+			Interval:  time.Millisecond,
+			MaxMissed: 3,
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		sess := newFakeSession(nil)
+
+		err := Monitor(context.Background(), sess, Config{})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, sess.Pings())
+	})
+}
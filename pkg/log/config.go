@@ -2,10 +2,54 @@ package log
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/pflag"
 )
 
+type SamplingConfig struct {
+	// Limit is the maximum number of identical records each subsystem logs
+	// per interval. Records are identical if they have the same level and
+	// message.
+	//
+	// Zero disables sampling.
+	Limit int `json:"limit" yaml:"limit"`
+
+	// Subsystems overrides the limit for the given subsystems.
+	Subsystems map[string]int `json:"subsystems" yaml:"subsystems"`
+
+	// Interval is the interval to limit identical records over.
+	Interval time.Duration `json:"interval" yaml:"interval"`
+}
+
+// Enabled returns whether sampling is enabled for any subsystem.
+func (c *SamplingConfig) Enabled() bool {
+	if c.Limit > 0 {
+		return true
+	}
+	for _, limit := range c.Subsystems {
+		if limit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *SamplingConfig) Validate() error {
+	if c.Limit < 0 {
+		return fmt.Errorf("limit cannot be negative")
+	}
+	for subsystem, limit := range c.Subsystems {
+		if limit < 0 {
+			return fmt.Errorf("subsystem %s: limit cannot be negative", subsystem)
+		}
+	}
+	if c.Enabled() && c.Interval == 0 {
+		return fmt.Errorf("missing interval")
+	}
+	return nil
+}
+
 type Config struct {
 	// Level is the minimum record level to log. Either 'debug', 'info', 'warn'
 	// or 'error'.
@@ -14,6 +58,9 @@ type Config struct {
 	// Subsystems enables debug logging on log records whose 'subsystem'
 	// matches one of the given values (overrides `Level`).
 	Subsystems []string `json:"subsystems" yaml:"subsystems"`
+
+	// Sampling limits the number of identical records logged.
+	Sampling SamplingConfig `json:"sampling" yaml:"sampling"`
 }
 
 func (c *Config) Validate() error {
@@ -23,6 +70,9 @@ func (c *Config) Validate() error {
 	if _, err := zapLevelFromString(c.Level); err != nil {
 		return err
 	}
+	if err := c.Sampling.Validate(); err != nil {
+		return fmt.Errorf("sampling: %w", err)
+	}
 	return nil
 }
 
@@ -49,4 +99,35 @@ debug logs.
 
 Such as you can enable 'gossip' logs with '--log.subsystems gossip'.`,
 	)
+	fs.IntVar(
+		&c.Sampling.Limit,
+		"log.sampling.limit",
+		c.Sampling.Limit,
+		`
+Maximum number of identical records each subsystem logs per
+'--log.sampling.interval', where records are identical if they have the same
+level and message.
+
+This keeps log volume under control when the same record is logged
+repeatedly, such as during an incident. Suppressed records are counted and
+at the end of the interval the record is logged again with the count in its
+'suppressed' field.
+
+Zero disables sampling.`,
+	)
+	fs.StringToIntVar(
+		&c.Sampling.Subsystems,
+		"log.sampling.subsystems",
+		c.Sampling.Subsystems,
+		`
+Overrides '--log.sampling.limit' for the given subsystems, such as
+'--log.sampling.subsystems gossip=5,proxy=100'.`,
+	)
+	fs.DurationVar(
+		&c.Sampling.Interval,
+		"log.sampling.interval",
+		c.Sampling.Interval,
+		`
+Interval to limit identical records over.`,
+	)
 }
@@ -0,0 +1,181 @@
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// LevelsState is a snapshot of the configured log levels.
+type LevelsState struct {
+	// Level is the minimum level to log for subsystems without an override.
+	Level string `json:"level"`
+
+	// Subsystems contains the minimum level to log for each overridden
+	// subsystem.
+	Subsystems map[string]string `json:"subsystems,omitempty"`
+
+	// UpdatedAt is the time the levels were last updated in milliseconds
+	// since the Unix epoch.
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+type levels struct {
+	level      zapcore.Level
+	subsystems map[string]zapcore.Level
+	updatedAt  time.Time
+}
+
+// Levels contains the minimum log level and per-subsystem overrides, which
+// can be updated at runtime.
+//
+// Levels is shared by a logger and all loggers derived from it, so updates
+// apply to all subsystems.
+type Levels struct {
+	levels atomic.Pointer[levels]
+
+	// mu serialises updates.
+	mu sync.Mutex
+}
+
+// NewLevels creates the log levels, where the given subsystems log all
+// levels.
+func NewLevels(lvl string, enabledSubsystems []string) (*Levels, error) {
+	zapLevel, err := zapLevelFromString(lvl)
+	if err != nil {
+		return nil, err
+	}
+
+	subsystems := make(map[string]zapcore.Level)
+	for _, s := range enabledSubsystems {
+		subsystems[s] = zapcore.DebugLevel
+	}
+
+	l := &Levels{}
+	l.levels.Store(&levels{
+		level:      zapLevel,
+		subsystems: subsystems,
+		updatedAt:  time.Now(),
+	})
+	return l, nil
+}
+
+// Level returns the minimum level to log for subsystems without an override.
+func (l *Levels) Level() string {
+	return l.levels.Load().level.String()
+}
+
+// SetLevel updates the minimum level to log for subsystems without an
+// override.
+func (l *Levels) SetLevel(lvl string) error {
+	zapLevel, err := zapLevelFromString(lvl)
+	if err != nil {
+		return err
+	}
+
+	l.update(func(levels *levels) {
+		levels.level = zapLevel
+	})
+	return nil
+}
+
+// SetSubsystemLevel overrides the minimum level to log for the given
+// subsystem.
+func (l *Levels) SetSubsystemLevel(subsystem string, lvl string) error {
+	zapLevel, err := zapLevelFromString(lvl)
+	if err != nil {
+		return err
+	}
+
+	l.update(func(levels *levels) {
+		levels.subsystems[subsystem] = zapLevel
+	})
+	return nil
+}
+
+// ResetSubsystemLevel removes the override for the given subsystem.
+func (l *Levels) ResetSubsystemLevel(subsystem string) {
+	l.update(func(levels *levels) {
+		delete(levels.subsystems, subsystem)
+	})
+}
+
+// State returns a snapshot of the configured levels.
+func (l *Levels) State() LevelsState {
+	levels := l.levels.Load()
+
+	state := LevelsState{
+		Level:     levels.level.String(),
+		UpdatedAt: levels.updatedAt.UnixMilli(),
+	}
+	if len(levels.subsystems) > 0 {
+		state.Subsystems = make(map[string]string)
+		for s, lvl := range levels.subsystems {
+			state.Subsystems[s] = lvl.String()
+		}
+	}
+	return state
+}
+
+// Apply replaces the configured levels with the given state if the state is
+// newer than the last update.
+//
+// Returns whether the levels were updated.
+func (l *Levels) Apply(state LevelsState) (bool, error) {
+	zapLevel, err := zapLevelFromString(state.Level)
+	if err != nil {
+		return false, err
+	}
+	subsystems := make(map[string]zapcore.Level)
+	for s, lvl := range state.Subsystems {
+		zapLevel, err := zapLevelFromString(lvl)
+		if err != nil {
+			return false, err
+		}
+		subsystems[s] = zapLevel
+	}
+
+	updatedAt := time.UnixMilli(state.UpdatedAt)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !updatedAt.After(l.levels.Load().updatedAt) {
+		return false, nil
+	}
+
+	l.levels.Store(&levels{
+		level:      zapLevel,
+		subsystems: subsystems,
+		updatedAt:  updatedAt,
+	})
+	return true, nil
+}
+
+func (l *Levels) enabled(subsystem string, lvl zapcore.Level) bool {
+	levels := l.levels.Load()
+	if subsystemLevel, ok := levels.subsystems[subsystem]; ok {
+		return lvl >= subsystemLevel
+	}
+	return lvl >= levels.level
+}
+
+func (l *Levels) update(f func(levels *levels)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current := l.levels.Load()
+	updated := &levels{
+		level:      current.level,
+		subsystems: make(map[string]zapcore.Level),
+		updatedAt:  time.Now(),
+	}
+	for s, lvl := range current.subsystems {
+		updated.subsystems[s] = lvl
+	}
+	f(updated)
+
+	l.levels.Store(updated)
+}
@@ -25,8 +25,8 @@ func (l *loggerWriter) Write(p []byte) (int, error) {
 // as JSON.
 //
 // Logs can be filtered by level, where only logs whose level exceeds the
-// configured minimum level are logged. The log level can be overridden to
-// include all logs matching the enabled subsystems.
+// configured minimum level are logged. The log level can be overridden for
+// each subsystem, and the levels can be updated at runtime using Levels.
 //
 // Logger is a simplified zap.Logger (which uses zapcore). zap.Logger had to
 // be reimplemented to support overriding the log level filter.
@@ -40,6 +40,10 @@ type Logger interface {
 	Warn(msg string, fields ...zap.Field)
 	Error(msg string, fields ...zap.Field)
 	Sync() error
+	// Levels returns the levels used to filter records, which are shared by
+	// all loggers derived from this logger. Returns nil if the logger doesn't
+	// support updating levels.
+	Levels() *Levels
 	// StdLogger returns a standard library log.Logger that logs records using
 	// with the given level.
 	StdLogger(level zapcore.Level) *stdlog.Logger
@@ -48,17 +52,29 @@ type Logger interface {
 type logger struct {
 	core zapcore.Core
 
-	subsystem         string
-	subsystemEnabled  bool
-	enabledSubsystems []string
+	subsystem string
+
+	levels *Levels
+
+	// sampler limits identical records. May be nil.
+	sampler *Sampler
 
 	errorOutput zapcore.WriteSyncer
 }
 
 // NewLogger creates a new logger filtering using the given log level and
 // enabled subsystems.
-func NewLogger(lvl string, enabledSubsystems []string) (Logger, error) {
-	zapLevel, err := zapLevelFromString(lvl)
+func NewLogger(
+	lvl string,
+	enabledSubsystems []string,
+	opts ...Option,
+) (Logger, error) {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
+	levels, err := NewLevels(lvl, enabledSubsystems)
 	if err != nil {
 		return nil, err
 	}
@@ -75,17 +91,22 @@ func NewLogger(lvl string, enabledSubsystems []string) (Logger, error) {
 	if err != nil {
 		return nil, fmt.Errorf("open sync: %w", err)
 	}
+	// Records are filtered by levels rather than the core so the levels can
+	// be updated at runtime.
 	core := &core{core: zapcore.NewCore(
-		enc, sink, zap.NewAtomicLevelAt(zapLevel),
+		enc, sink, zap.NewAtomicLevelAt(zap.DebugLevel),
 	)}
-	return &logger{
+	l := &logger{
 		core: core,
 		// Use 'main' as default subsystem.
-		subsystem:         "main",
-		subsystemEnabled:  subsystemMatch("main", enabledSubsystems),
-		enabledSubsystems: enabledSubsystems,
-		errorOutput:       zapcore.Lock(os.Stderr),
-	}, nil
+		subsystem:   "main",
+		levels:      levels,
+		errorOutput: zapcore.Lock(os.Stderr),
+	}
+	if options.sampling.Enabled() {
+		l.sampler = NewSampler(options.sampling, l.writeSampled)
+	}
+	return l, nil
 }
 
 func (l *logger) Subsystem() string {
@@ -99,7 +120,6 @@ func (l *logger) WithSubsystem(s string) Logger {
 
 	clone := l.clone()
 	clone.subsystem = s
-	clone.subsystemEnabled = subsystemMatch(s, clone.enabledSubsystems)
 	return clone
 }
 
@@ -141,6 +161,10 @@ func (l *logger) Sync() error {
 	return l.core.Sync()
 }
 
+func (l *logger) Levels() *Levels {
+	return l.levels
+}
+
 func (l *logger) StdLogger(level zapcore.Level) *stdlog.Logger {
 	return stdlog.New(&loggerWriter{
 		logFunc: func(msg string, fields ...zap.Field) {
@@ -157,22 +181,32 @@ func (l *logger) clone() *logger {
 }
 
 func (l *logger) check(lvl zapcore.Level, msg string) *zapcore.CheckedEntry {
-	// Only filter by log level if the subsystem isn't enabled.
-	if !l.subsystemEnabled {
-		if lvl < zapcore.DPanicLevel && !l.core.Enabled(lvl) {
+	if lvl < zapcore.DPanicLevel && !l.levels.enabled(l.subsystem, lvl) {
+		return nil
+	}
+
+	now := time.Now()
+
+	core := l.core
+	if l.sampler != nil {
+		ok, suppressed := l.sampler.Sample(l.subsystem, lvl, msg, now)
+		if !ok {
 			return nil
 		}
+		if suppressed > 0 {
+			core = core.With([]zap.Field{zap.Int("suppressed", suppressed)})
+		}
 	}
 
 	ent := zapcore.Entry{
 		// Use the logger name for subsystem. This is configured above to log
 		// as a 'subsystem' field.
 		LoggerName: l.subsystem,
-		Time:       time.Now(),
+		Time:       now,
 		Level:      lvl,
 		Message:    msg,
 	}
-	ce := l.core.Check(ent, nil)
+	ce := core.Check(ent, nil)
 	if ce == nil {
 		return ce
 	}
@@ -183,6 +217,22 @@ func (l *logger) check(lvl zapcore.Level, msg string) *zapcore.CheckedEntry {
 	return ce
 }
 
+// writeSampled logs the number of records the sampler suppressed.
+func (l *logger) writeSampled(record SampledRecord) {
+	ent := zapcore.Entry{
+		LoggerName: record.Subsystem,
+		Time:       time.Now(),
+		Level:      record.Level,
+		Message:    record.Message,
+	}
+	ce := l.core.Check(ent, nil)
+	if ce == nil {
+		return
+	}
+	ce.ErrorOutput = l.errorOutput
+	ce.Write(zap.Int("suppressed", record.Suppressed))
+}
+
 type nopLogger struct {
 }
 
@@ -218,6 +268,10 @@ func (l *nopLogger) Sync() error {
 	return nil
 }
 
+func (l *nopLogger) Levels() *Levels {
+	return nil
+}
+
 func (l *nopLogger) StdLogger(_ zapcore.Level) *stdlog.Logger {
 	return stdlog.New(&loggerWriter{
 		logFunc: func(_ string, _ ...zap.Field) {
@@ -225,15 +279,6 @@ func (l *nopLogger) StdLogger(_ zapcore.Level) *stdlog.Logger {
 	}, "", 0)
 }
 
-func subsystemMatch(subsystem string, enabled []string) bool {
-	for _, s := range enabled {
-		if subsystem == s {
-			return true
-		}
-	}
-	return false
-}
-
 func zapLevelFromString(s string) (zapcore.Level, error) {
 	switch s {
 	case "debug":
@@ -250,8 +295,7 @@ func zapLevelFromString(s string) (zapcore.Level, error) {
 }
 
 // core is a wrapper for another core, except `Check()` will not filter by
-// log level. This is required to log records matching the a configured
-// subsystem.
+// log level. This is required to filter records using the subsystem levels.
 type core struct {
 	core zapcore.Core
 }
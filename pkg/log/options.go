@@ -0,0 +1,21 @@
+package log
+
+type options struct {
+	sampling SamplingConfig
+}
+
+type Option interface {
+	apply(*options)
+}
+
+type samplingOption SamplingConfig
+
+func (o samplingOption) apply(opts *options) {
+	opts.sampling = SamplingConfig(o)
+}
+
+// WithSampling configures the logger to limit the number of identical records
+// logged per subsystem.
+func WithSampling(conf SamplingConfig) Option {
+	return samplingOption(conf)
+}
@@ -0,0 +1,296 @@
+package log
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type samplerKey struct {
+	subsystem string
+	level     zapcore.Level
+	message   string
+}
+
+type samplerCounter struct {
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+// SampledRecord is a record that was suppressed by a sampler.
+type SampledRecord struct {
+	Subsystem string
+	Level     zapcore.Level
+	Message   string
+
+	// Suppressed is the number of identical records suppressed in the
+	// interval.
+	Suppressed int
+}
+
+// Sampler limits the number of identical records logged by each subsystem
+// per interval.
+//
+// Records are identical if they have the same subsystem, level and message.
+// Once a record exceeds the limit, identical records are suppressed until the
+// end of the interval. At the end of the interval the number of suppressed
+// records is flushed, so a summary is logged even if the record isn't logged
+// again, such as when a repeated failure stops.
+type Sampler struct {
+	limit      int
+	subsystems map[string]int
+	interval   time.Duration
+
+	// onFlush is called with each suppressed record at the end of its
+	// interval. May be nil.
+	onFlush func(record SampledRecord)
+
+	counters map[samplerKey]*samplerCounter
+
+	// flushTimer flushes the suppressed records at the end of the earliest
+	// interval, or is nil if there are no suppressed records.
+	flushTimer *time.Timer
+
+	// mu protects the above fields.
+	mu sync.Mutex
+}
+
+// NewSampler creates a sampler with the given configuration, which calls
+// onFlush with the suppressed records at the end of each interval. onFlush
+// may be nil to flush suppressed records with Flush instead.
+func NewSampler(conf SamplingConfig, onFlush func(record SampledRecord)) *Sampler {
+	return &Sampler{
+		limit:      conf.Limit,
+		subsystems: conf.Subsystems,
+		interval:   conf.Interval,
+		onFlush:    onFlush,
+		counters:   make(map[samplerKey]*samplerCounter),
+	}
+}
+
+// Sample returns whether the record should be logged, and if so the number of
+// identical records that were suppressed in the previous interval and not
+// yet flushed.
+func (s *Sampler) Sample(
+	subsystem string,
+	lvl zapcore.Level,
+	msg string,
+	now time.Time,
+) (bool, int) {
+	limit, ok := s.subsystems[subsystem]
+	if !ok {
+		limit = s.limit
+	}
+	if limit <= 0 {
+		return true, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := samplerKey{
+		subsystem: subsystem,
+		level:     lvl,
+		message:   msg,
+	}
+	counter, ok := s.counters[key]
+	if !ok {
+		counter = &samplerCounter{
+			windowStart: now,
+		}
+		s.counters[key] = counter
+	}
+
+	var suppressed int
+	if now.Sub(counter.windowStart) >= s.interval {
+		suppressed = counter.suppressed
+		counter.windowStart = now
+		counter.count = 0
+		counter.suppressed = 0
+	}
+
+	if counter.count >= limit {
+		counter.suppressed++
+		s.scheduleFlushLocked(now)
+		return false, 0
+	}
+	counter.count++
+	return true, suppressed
+}
+
+// Flush returns the records suppressed in intervals that ended by now, sorted
+// by subsystem, level and message. Flushed records aren't returned by Sample
+// or flushed again.
+func (s *Sampler) Flush(now time.Time) []SampledRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flushLocked(now)
+}
+
+func (s *Sampler) flushLocked(now time.Time) []SampledRecord {
+	var records []SampledRecord
+	for key, counter := range s.counters {
+		if now.Sub(counter.windowStart) < s.interval {
+			continue
+		}
+		if counter.suppressed > 0 {
+			records = append(records, SampledRecord{
+				Subsystem:  key.subsystem,
+				Level:      key.level,
+				Message:    key.message,
+				Suppressed: counter.suppressed,
+			})
+		}
+		// Remove the counter so the next identical record starts a new
+		// interval.
+		delete(s.counters, key)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Subsystem != records[j].Subsystem {
+			return records[i].Subsystem < records[j].Subsystem
+		}
+		if records[i].Level != records[j].Level {
+			return records[i].Level < records[j].Level
+		}
+		return records[i].Message < records[j].Message
+	})
+	return records
+}
+
+// onFlushTimer flushes the suppressed records whose interval ended, then
+// schedules the next flush if there are still suppressed records.
+func (s *Sampler) onFlushTimer() {
+	s.mu.Lock()
+	now := time.Now()
+	records := s.flushLocked(now)
+	s.flushTimer = nil
+	s.scheduleFlushLocked(now)
+	s.mu.Unlock()
+
+	for _, record := range records {
+		s.onFlush(record)
+	}
+}
+
+// scheduleFlushLocked schedules a flush at the end of the earliest interval
+// with suppressed records, unless a flush is already scheduled.
+func (s *Sampler) scheduleFlushLocked(now time.Time) {
+	if s.onFlush == nil || s.flushTimer != nil {
+		return
+	}
+
+	var next time.Time
+	for _, counter := range s.counters {
+		if counter.suppressed == 0 {
+			continue
+		}
+		end := counter.windowStart.Add(s.interval)
+		if next.IsZero() || end.Before(next) {
+			next = end
+		}
+	}
+	if next.IsZero() {
+		return
+	}
+	s.flushTimer = time.AfterFunc(next.Sub(now), s.onFlushTimer)
+}
+
+type sampledLogger struct {
+	Logger
+
+	// root is the logger the sampler was created with, used to log
+	// flushed records.
+	root Logger
+
+	sampler *Sampler
+}
+
+// NewSampledLogger returns a logger that limits the number of identical
+// records logged by the given logger, such as to avoid logging a repeated
+// failure on every retry.
+//
+// Loggers derived from the returned logger share the same sampler.
+func NewSampledLogger(logger Logger, conf SamplingConfig) Logger {
+	l := &sampledLogger{
+		Logger: logger,
+		root:   logger,
+	}
+	l.sampler = NewSampler(conf, l.writeSampled)
+	return l
+}
+
+func (l *sampledLogger) WithSubsystem(s string) Logger {
+	return &sampledLogger{
+		Logger:  l.Logger.WithSubsystem(s),
+		root:    l.root,
+		sampler: l.sampler,
+	}
+}
+
+func (l *sampledLogger) With(fields ...zap.Field) Logger {
+	return &sampledLogger{
+		Logger:  l.Logger.With(fields...),
+		root:    l.root,
+		sampler: l.sampler,
+	}
+}
+
+func (l *sampledLogger) Debug(msg string, fields ...zap.Field) {
+	if fields, ok := l.sample(zapcore.DebugLevel, msg, fields); ok {
+		l.Logger.Debug(msg, fields...)
+	}
+}
+
+func (l *sampledLogger) Info(msg string, fields ...zap.Field) {
+	if fields, ok := l.sample(zapcore.InfoLevel, msg, fields); ok {
+		l.Logger.Info(msg, fields...)
+	}
+}
+
+func (l *sampledLogger) Warn(msg string, fields ...zap.Field) {
+	if fields, ok := l.sample(zapcore.WarnLevel, msg, fields); ok {
+		l.Logger.Warn(msg, fields...)
+	}
+}
+
+func (l *sampledLogger) Error(msg string, fields ...zap.Field) {
+	if fields, ok := l.sample(zapcore.ErrorLevel, msg, fields); ok {
+		l.Logger.Error(msg, fields...)
+	}
+}
+
+func (l *sampledLogger) sample(
+	lvl zapcore.Level,
+	msg string,
+	fields []zap.Field,
+) ([]zap.Field, bool) {
+	ok, suppressed := l.sampler.Sample(l.Subsystem(), lvl, msg, time.Now())
+	if !ok {
+		return nil, false
+	}
+	if suppressed > 0 {
+		fields = append(fields, zap.Int("suppressed", suppressed))
+	}
+	return fields, true
+}
+
+// writeSampled logs the number of records the sampler suppressed.
+func (l *sampledLogger) writeSampled(record SampledRecord) {
+	logger := l.root.WithSubsystem(record.Subsystem)
+	field := zap.Int("suppressed", record.Suppressed)
+	switch record.Level {
+	case zapcore.DebugLevel:
+		logger.Debug(record.Message, field)
+	case zapcore.InfoLevel:
+		logger.Info(record.Message, field)
+	case zapcore.WarnLevel:
+		logger.Warn(record.Message, field)
+	default:
+		logger.Error(record.Message, field)
+	}
+}
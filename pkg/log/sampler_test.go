@@ -0,0 +1,202 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestSampler(t *testing.T) {
+	t.Run("limit", func(t *testing.T) {
+		s := NewSampler(SamplingConfig{
+			Limit:    2,
+			Interval: time.Minute,
+		}, nil)
+
+		now := time.Now()
+		for i := 0; i != 2; i++ {
+			ok, _ := s.Sample("proxy", zapcore.WarnLevel, "foo", now)
+			assert.True(t, ok)
+		}
+		for i := 0; i != 3; i++ {
+			ok, _ := s.Sample("proxy", zapcore.WarnLevel, "foo", now)
+			assert.False(t, ok)
+		}
+
+		// Different messages, levels and subsystems are not identical.
+		ok, _ := s.Sample("proxy", zapcore.WarnLevel, "bar", now)
+		assert.True(t, ok)
+		ok, _ = s.Sample("proxy", zapcore.InfoLevel, "foo", now)
+		assert.True(t, ok)
+		ok, _ = s.Sample("gossip", zapcore.WarnLevel, "foo", now)
+		assert.True(t, ok)
+
+		// The next interval should include the suppressed records.
+		ok, suppressed := s.Sample(
+			"proxy", zapcore.WarnLevel, "foo", now.Add(time.Minute),
+		)
+		assert.True(t, ok)
+		assert.Equal(t, 3, suppressed)
+
+		ok, suppressed = s.Sample(
+			"proxy", zapcore.WarnLevel, "foo", now.Add(time.Minute),
+		)
+		assert.True(t, ok)
+		assert.Equal(t, 0, suppressed)
+	})
+
+	t.Run("subsystem override", func(t *testing.T) {
+		s := NewSampler(SamplingConfig{
+			Subsystems: map[string]int{"gossip": 1},
+			Interval:   time.Minute,
+		}, nil)
+
+		now := time.Now()
+		ok, _ := s.Sample("gossip", zapcore.WarnLevel, "foo", now)
+		assert.True(t, ok)
+		ok, _ = s.Sample("gossip", zapcore.WarnLevel, "foo", now)
+		assert.False(t, ok)
+
+		// Subsystems without an override aren't sampled.
+		for i := 0; i != 10; i++ {
+			ok, _ := s.Sample("proxy", zapcore.WarnLevel, "foo", now)
+			assert.True(t, ok)
+		}
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		s := NewSampler(SamplingConfig{
+			Limit:    1,
+			Interval: time.Minute,
+		}, nil)
+
+		now := time.Now()
+		ok, _ := s.Sample("gossip", zapcore.WarnLevel, "foo", now)
+		assert.True(t, ok)
+		for i := 0; i != 3; i++ {
+			ok, _ := s.Sample("gossip", zapcore.WarnLevel, "foo", now)
+			assert.False(t, ok)
+		}
+
+		// Records aren't flushed until the end of the interval.
+		assert.Empty(t, s.Flush(now.Add(time.Second)))
+
+		assert.Equal(t, []SampledRecord{
+			{
+				Subsystem:  "gossip",
+				Level:      zapcore.WarnLevel,
+				Message:    "foo",
+				Suppressed: 3,
+			},
+		}, s.Flush(now.Add(time.Minute)))
+
+		// Flushed records aren't included in the next record.
+		ok, suppressed := s.Sample(
+			"gossip", zapcore.WarnLevel, "foo", now.Add(time.Minute),
+		)
+		assert.True(t, ok)
+		assert.Equal(t, 0, suppressed)
+	})
+
+	// Tests suppressed records are flushed at the end of the interval even
+	// if the record isn't logged again.
+	t.Run("flush timer", func(t *testing.T) {
+		flushed := make(chan SampledRecord, 1)
+		s := NewSampler(SamplingConfig{
+			Limit:    1,
+			Interval: time.Millisecond * 10,
+		}, func(record SampledRecord) {
+			flushed <- record
+		})
+
+		now := time.Now()
+		ok, _ := s.Sample("gossip", zapcore.WarnLevel, "foo", now)
+		assert.True(t, ok)
+		ok, _ = s.Sample("gossip", zapcore.WarnLevel, "foo", now)
+		assert.False(t, ok)
+
+		select {
+		case record := <-flushed:
+			assert.Equal(t, "foo", record.Message)
+			assert.Equal(t, 1, record.Suppressed)
+		case <-time.After(time.Second):
+			t.Fatal("not flushed")
+		}
+	})
+}
+
+type recordedEntry struct {
+	subsystem  string
+	message    string
+	suppressed int64
+}
+
+type recordingLogger struct {
+	Logger
+
+	subsystem string
+
+	entries chan recordedEntry
+}
+
+func (l *recordingLogger) Subsystem() string {
+	return l.subsystem
+}
+
+func (l *recordingLogger) WithSubsystem(s string) Logger {
+	return &recordingLogger{
+		Logger:    l.Logger,
+		subsystem: s,
+		entries:   l.entries,
+	}
+}
+
+func (l *recordingLogger) Warn(msg string, fields ...zap.Field) {
+	entry := recordedEntry{
+		subsystem: l.subsystem,
+		message:   msg,
+	}
+	for _, f := range fields {
+		if f.Key == "suppressed" {
+			entry.suppressed = f.Integer
+		}
+	}
+	l.entries <- entry
+}
+
+func TestSampledLogger(t *testing.T) {
+	entries := make(chan recordedEntry, 10)
+	logger := NewSampledLogger(&recordingLogger{
+		Logger:    NewNopLogger(),
+		subsystem: "gossip",
+		entries:   entries,
+	}, SamplingConfig{
+		Limit:    1,
+		Interval: time.Millisecond * 10,
+	})
+
+	for i := 0; i != 5; i++ {
+		logger.Warn("foo")
+	}
+	assert.Equal(t, recordedEntry{
+		subsystem: "gossip",
+		message:   "foo",
+	}, <-entries)
+
+	// The suppressed records are logged at the end of the interval without
+	// logging the record again.
+	select {
+	case entry := <-entries:
+		assert.Equal(t, recordedEntry{
+			subsystem:  "gossip",
+			message:    "foo",
+			suppressed: 4,
+		}, entry)
+	case <-time.After(time.Second):
+		t.Fatal("suppressed records not logged")
+	}
+	assert.Empty(t, entries)
+}
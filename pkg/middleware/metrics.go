@@ -12,9 +12,11 @@ import (
 type Metrics struct {
 	RequestsInFlight prometheus.Gauge
 	RequestsTotal    *prometheus.CounterVec
-	RequestLatency   *prometheus.HistogramVec
-	RequestSize      prometheus.Histogram
-	ResponseSize     prometheus.Histogram
+	// RequestLatency may be nil if the server records request latency
+	// itself.
+	RequestLatency *prometheus.HistogramVec
+	RequestSize    prometheus.Histogram
+	ResponseSize   prometheus.Histogram
 }
 
 func NewMetrics(subsystem string) *Metrics {
@@ -82,10 +84,12 @@ func (m *Metrics) Handler() gin.HandlerFunc {
 			"status": strconv.Itoa(c.Writer.Status()),
 			"method": c.Request.Method,
 		}).Inc()
-		m.RequestLatency.With(prometheus.Labels{
-			"status": strconv.Itoa(c.Writer.Status()),
-			"method": c.Request.Method,
-		}).Observe(float64(time.Since(start).Milliseconds()) / 1000)
+		if m.RequestLatency != nil {
+			m.RequestLatency.With(prometheus.Labels{
+				"status": strconv.Itoa(c.Writer.Status()),
+				"method": c.Request.Method,
+			}).Observe(float64(time.Since(start).Milliseconds()) / 1000)
+		}
 		m.RequestSize.Observe(float64(computeApproximateRequestSize(c.Request)))
 		m.ResponseSize.Observe(float64(c.Writer.Size()))
 	}
@@ -95,10 +99,12 @@ func (m *Metrics) Register(registry *prometheus.Registry) {
 	registry.MustRegister(
 		m.RequestsInFlight,
 		m.RequestsTotal,
-		m.RequestLatency,
 		m.RequestSize,
 		m.ResponseSize,
 	)
+	if m.RequestLatency != nil {
+		registry.MustRegister(m.RequestLatency)
+	}
 }
 
 func computeApproximateRequestSize(r *http.Request) int {
@@ -0,0 +1,220 @@
+// Package provenance signs and verifies the provenance of proxied responses.
+//
+// The node that receives a request from the client adds a random nonce to the
+// request, and the agent signs the endpoint ID, nonce, response status and
+// response headers with its Ed25519 private key. Once the response body is
+// written, the agent signs the digest of the body and sends the signature as
+// a trailer. The node then verifies the signatures with the agent's public
+// key, so a node that doesn't host the endpoint can't inject or modify
+// responses for it, even if it's compromised, since it doesn't have the
+// agent's private key.
+package provenance
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// NonceHeader contains the nonce the agent signs, added to the request
+	// by the node that received the request from the client.
+	NonceHeader = "x-piko-provenance-nonce"
+
+	// SignatureHeader contains the agent's signature of the response status
+	// and headers.
+	SignatureHeader = "x-piko-provenance"
+
+	// BodySignatureHeader contains the agent's signature of the response
+	// body. The body must be written before it can be signed, so the
+	// signature is sent as a trailer, or as a header if the response has no
+	// body.
+	BodySignatureHeader = "x-piko-provenance-body"
+)
+
+// signedHeaders contains the response headers included in the signature.
+//
+// Headers that proxies may rewrite, such as 'Content-Length' and 'Date', are
+// excluded. The body digest covers the body length.
+var signedHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Type",
+	"Location",
+	"Set-Cookie",
+}
+
+// Sign returns the signature of the status and headers of a response to a
+// request to the endpoint with the given nonce.
+func Sign(
+	key ed25519.PrivateKey,
+	endpointID string,
+	nonce string,
+	status int,
+	header http.Header,
+) string {
+	return sign(key, message(endpointID, nonce, status, header))
+}
+
+// Verify returns whether the signature is a valid signature of the status
+// and headers of a response to a request to the endpoint with the given
+// nonce.
+func Verify(
+	key ed25519.PublicKey,
+	endpointID string,
+	nonce string,
+	status int,
+	header http.Header,
+	signature string,
+) bool {
+	return verify(key, message(endpointID, nonce, status, header), signature)
+}
+
+// NewBodyHash returns the hash used to digest response bodies.
+func NewBodyHash() hash.Hash {
+	return sha256.New()
+}
+
+// SignBody returns the signature of the body of a response to a request to
+// the endpoint with the given nonce, where digest is the sum of the body
+// hash (see NewBodyHash).
+func SignBody(
+	key ed25519.PrivateKey,
+	endpointID string,
+	nonce string,
+	digest []byte,
+) string {
+	return sign(key, bodyMessage(endpointID, nonce, digest))
+}
+
+// VerifyBody returns whether the signature is a valid signature of the body
+// of a response to a request to the endpoint with the given nonce.
+func VerifyBody(
+	key ed25519.PublicKey,
+	endpointID string,
+	nonce string,
+	digest []byte,
+	signature string,
+) bool {
+	return verify(key, bodyMessage(endpointID, nonce, digest), signature)
+}
+
+// NewNonce returns a random nonce.
+func NewNonce() string {
+	b := make([]byte, 16)
+	// rand.Read never returns an error.
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LoadPrivateKey loads a PEM encoded PKCS #8 Ed25519 private key, such as
+// generated with 'openssl genpkey -algorithm ed25519'.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse key: %w", err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("parse key: not an ed25519 key")
+	}
+	return privateKey, nil
+}
+
+// LoadPublicKey loads a PEM encoded PKIX Ed25519 public key, such as
+// generated with 'openssl pkey -pubout'.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse key: %w", err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("parse key: not an ed25519 key")
+	}
+	return publicKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("parse key: no pem data")
+	}
+	return block, nil
+}
+
+func sign(key ed25519.PrivateKey, message []byte) string {
+	return base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, message))
+}
+
+func verify(key ed25519.PublicKey, message []byte, signature string) bool {
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, message, sig)
+}
+
+// message returns the signed message of the response status and headers.
+// Endpoint IDs are case insensitive so the endpoint ID is normalized to lower
+// case.
+func message(
+	endpointID string,
+	nonce string,
+	status int,
+	header http.Header,
+) []byte {
+	return []byte(
+		"piko-provenance-v2\n" +
+			strings.ToLower(endpointID) + "\n" +
+			nonce + "\n" +
+			strconv.Itoa(status) + "\n" +
+			headerDigest(header),
+	)
+}
+
+// bodyMessage returns the signed message of the response body.
+func bodyMessage(endpointID string, nonce string, digest []byte) []byte {
+	return []byte(
+		"piko-provenance-body-v1\n" +
+			strings.ToLower(endpointID) + "\n" +
+			nonce + "\n" +
+			hex.EncodeToString(digest),
+	)
+}
+
+// headerDigest returns the hex encoded digest of the signed headers. The
+// order of values of each header is significant, such as for 'Set-Cookie'.
+func headerDigest(header http.Header) string {
+	h := sha256.New()
+	for _, name := range signedHeaders {
+		for _, value := range header.Values(name) {
+			h.Write([]byte(strings.ToLower(name) + ": " + value + "\n"))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,123 @@
+package provenance
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSign(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	header := http.Header{
+		"Content-Type": []string{"application/json"},
+		"Set-Cookie":   []string{"a=1", "b=2"},
+		"Date":         []string{"Wed, 14 Oct 2026 14:00:00 GMT"},
+	}
+
+	nonce := NewNonce()
+	sig := Sign(privateKey, "my-endpoint", nonce, http.StatusOK, header)
+
+	assert.True(t, Verify(publicKey, "my-endpoint", nonce, http.StatusOK, header, sig))
+	// Endpoint IDs are case insensitive.
+	assert.True(t, Verify(publicKey, "My-Endpoint", nonce, http.StatusOK, header, sig))
+
+	assert.False(t, Verify(publicKey, "other-endpoint", nonce, http.StatusOK, header, sig))
+	assert.False(t, Verify(publicKey, "my-endpoint", NewNonce(), http.StatusOK, header, sig))
+	assert.False(t, Verify(
+		publicKey, "my-endpoint", nonce, http.StatusInternalServerError, header, sig,
+	))
+	assert.False(t, Verify(publicKey, "my-endpoint", nonce, http.StatusOK, header, "invalid"))
+
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	assert.False(t, Verify(otherKey, "my-endpoint", nonce, http.StatusOK, header, sig))
+
+	// Unsigned headers may be rewritten.
+	rewritten := header.Clone()
+	rewritten.Set("Date", "Wed, 14 Oct 2026 14:00:01 GMT")
+	assert.True(t, Verify(publicKey, "my-endpoint", nonce, http.StatusOK, rewritten, sig))
+
+	tampered := header.Clone()
+	tampered.Set("Content-Type", "text/html")
+	assert.False(t, Verify(publicKey, "my-endpoint", nonce, http.StatusOK, tampered, sig))
+
+	injected := header.Clone()
+	injected.Set("Location", "https://example.com")
+	assert.False(t, Verify(publicKey, "my-endpoint", nonce, http.StatusOK, injected, sig))
+
+	reordered := header.Clone()
+	reordered["Set-Cookie"] = []string{"b=2", "a=1"}
+	assert.False(t, Verify(publicKey, "my-endpoint", nonce, http.StatusOK, reordered, sig))
+}
+
+func TestSignBody(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	digest := func(body string) []byte {
+		h := NewBodyHash()
+		h.Write([]byte(body))
+		return h.Sum(nil)
+	}
+
+	nonce := NewNonce()
+	sig := SignBody(privateKey, "my-endpoint", nonce, digest("foo"))
+
+	assert.True(t, VerifyBody(publicKey, "my-endpoint", nonce, digest("foo"), sig))
+
+	assert.False(t, VerifyBody(publicKey, "my-endpoint", nonce, digest("bar"), sig))
+	assert.False(t, VerifyBody(publicKey, "my-endpoint", NewNonce(), digest("foo"), sig))
+	assert.False(t, VerifyBody(publicKey, "other-endpoint", nonce, digest("foo"), sig))
+
+	// The header signature can't be used as a body signature.
+	headerSig := Sign(privateKey, "my-endpoint", nonce, http.StatusOK, nil)
+	assert.False(t, VerifyBody(publicKey, "my-endpoint", nonce, digest(""), headerSig))
+}
+
+func TestLoadKey(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+
+	privateBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(
+		filepath.Join(dir, "agent.key"),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateBytes}),
+		0o600,
+	))
+
+	publicBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(
+		filepath.Join(dir, "agent.pub"),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes}),
+		0o600,
+	))
+
+	loadedPrivate, err := LoadPrivateKey(filepath.Join(dir, "agent.key"))
+	require.NoError(t, err)
+	assert.Equal(t, privateKey, loadedPrivate)
+
+	loadedPublic, err := LoadPublicKey(filepath.Join(dir, "agent.pub"))
+	require.NoError(t, err)
+	assert.Equal(t, publicKey, loadedPublic)
+
+	// The public key isn't a private key.
+	_, err = LoadPrivateKey(filepath.Join(dir, "agent.pub"))
+	assert.Error(t, err)
+
+	_, err = LoadPublicKey(filepath.Join(dir, "unknown.pub"))
+	assert.Error(t, err)
+}
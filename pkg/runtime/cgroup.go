@@ -0,0 +1,107 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cgroupRoot is the path cgroups are mounted.
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+// cpuQuota returns the CPU quota of the cgroup mounted at root, as the
+// number of CPUs the process may use. Returns false if there is no quota,
+// such as when not running in a container or the container has no CPU limit.
+//
+// Supports both cgroup v2 and v1.
+func cpuQuota(root string) (float64, bool, error) {
+	quota, ok, err := cpuQuotaV2(root)
+	if err != nil || ok {
+		return quota, ok, err
+	}
+
+	// The cgroup v1 CPU controller may be mounted with the cpuacct
+	// controller.
+	for _, dir := range []string{"cpu", "cpu,cpuacct"} {
+		quota, ok, err := cpuQuotaV1(filepath.Join(root, dir))
+		if err != nil || ok {
+			return quota, ok, err
+		}
+	}
+	return 0, false, nil
+}
+
+// cpuQuotaV2 returns the CPU quota from the cgroup v2 'cpu.max' file, which
+// contains the quota and period, such as '200000 100000', or 'max' if there
+// is no quota.
+func cpuQuotaV2(root string) (float64, bool, error) {
+	b, err := os.ReadFile(filepath.Join(root, "cpu.max"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("read cpu.max: %w", err)
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, false, fmt.Errorf("invalid cpu.max: %q", string(b))
+	}
+	if fields[0] == "max" {
+		return 0, false, nil
+	}
+
+	quota, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid cpu.max quota: %w", err)
+	}
+	// The period defaults to 100ms if not set.
+	period := int64(100000)
+	if len(fields) == 2 {
+		period, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid cpu.max period: %w", err)
+		}
+	}
+	if quota <= 0 || period <= 0 {
+		return 0, false, nil
+	}
+	return float64(quota) / float64(period), true, nil
+}
+
+// cpuQuotaV1 returns the CPU quota from the cgroup v1 'cpu.cfs_quota_us' and
+// 'cpu.cfs_period_us' files in dir. A quota of -1 means there is no quota.
+func cpuQuotaV1(dir string) (float64, bool, error) {
+	quota, ok, err := readInt(filepath.Join(dir, "cpu.cfs_quota_us"))
+	if err != nil || !ok || quota <= 0 {
+		return 0, false, err
+	}
+	period, ok, err := readInt(filepath.Join(dir, "cpu.cfs_period_us"))
+	if err != nil || !ok || period <= 0 {
+		return 0, false, err
+	}
+	return float64(quota) / float64(period), true, nil
+}
+
+// readInt reads the integer in the file at path. Returns false if the file
+// doesn't exist.
+func readInt(path string) (int64, bool, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("read %s: %w", filepath.Base(path), err)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s: %w", filepath.Base(path), err)
+	}
+	return n, true, nil
+}
@@ -0,0 +1,71 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path string, contents string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+}
+
+func TestCPUQuota(t *testing.T) {
+	t.Run("v2", func(t *testing.T) {
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "cpu.max"), "250000 100000\n")
+
+		quota, ok, err := cpuQuota(root)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 2.5, quota)
+	})
+
+	t.Run("v2 no quota", func(t *testing.T) {
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "cpu.max"), "max 100000\n")
+
+		_, ok, err := cpuQuota(root)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("v2 invalid", func(t *testing.T) {
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "cpu.max"), "foo 100000\n")
+
+		_, _, err := cpuQuota(root)
+		assert.Error(t, err)
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "cpu,cpuacct", "cpu.cfs_quota_us"), "50000\n")
+		writeFile(t, filepath.Join(root, "cpu,cpuacct", "cpu.cfs_period_us"), "100000\n")
+
+		quota, ok, err := cpuQuota(root)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 0.5, quota)
+	})
+
+	t.Run("v1 no quota", func(t *testing.T) {
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "cpu", "cpu.cfs_quota_us"), "-1\n")
+		writeFile(t, filepath.Join(root, "cpu", "cpu.cfs_period_us"), "100000\n")
+
+		_, ok, err := cpuQuota(root)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, ok, err := cpuQuota(t.TempDir())
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,61 @@
+package runtime
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+)
+
+type Config struct {
+	// MaxProcs is the maximum number of CPUs that can execute Go code
+	// simultaneously (GOMAXPROCS).
+	//
+	// If zero, defaults to the CPU quota of the container if set, otherwise
+	// the number of CPUs. The 'GOMAXPROCS' environment variable overrides the
+	// container CPU quota.
+	MaxProcs int `json:"max_procs" yaml:"max_procs"`
+
+	// GCPercent is the garbage collection target percentage (GOGC). If zero,
+	// the Go default is used, or the 'GOGC' environment variable if set. A
+	// negative value disables garbage collection.
+	GCPercent int `json:"gc_percent" yaml:"gc_percent"`
+}
+
+func (c *Config) Validate() error {
+	if c.MaxProcs < 0 {
+		return fmt.Errorf("invalid max procs: %d", c.MaxProcs)
+	}
+	return nil
+}
+
+func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
+	fs.IntVar(
+		&c.MaxProcs,
+		"runtime.max-procs",
+		c.MaxProcs,
+		`
+The maximum number of CPUs that can execute Go code simultaneously
+(GOMAXPROCS).
+
+If zero, defaults to the CPU quota of the container (using cgroups) when
+running in a container with a CPU limit, otherwise the number of CPUs. Setting
+the 'GOMAXPROCS' environment variable overrides the container CPU quota.
+
+Running with more procs than the container CPU quota causes the process to be
+throttled, which increases latency.`,
+	)
+	fs.IntVar(
+		&c.GCPercent,
+		"runtime.gc-percent",
+		c.GCPercent,
+		`
+The garbage collection target percentage (GOGC). A collection is triggered
+when the heap grows by this percentage since the previous collection.
+
+Increasing the percentage reduces the CPU spent on garbage collection at the
+cost of using more memory.
+
+If zero, the Go default of 100 is used, or the 'GOGC' environment variable if
+set. A negative value disables garbage collection.`,
+	)
+}
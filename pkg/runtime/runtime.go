@@ -0,0 +1,73 @@
+// Package runtime tunes the Go runtime for the environment Piko is running
+// in.
+//
+// By default Go uses all CPUs on the host, even when running in a container
+// with a CPU limit, which causes the process to be throttled. Therefore
+// GOMAXPROCS is limited to the CPU quota of the container.
+package runtime
+
+import (
+	"math"
+	"os"
+	goruntime "runtime"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// Apply configures the Go runtime.
+//
+// This should be called on startup before any work is started.
+func Apply(conf Config, logger log.Logger) {
+	logger = logger.WithSubsystem("runtime")
+
+	procs, source := maxProcs(conf, cgroupRoot, logger)
+	if procs > 0 {
+		goruntime.GOMAXPROCS(procs)
+	}
+	logger.Info(
+		"gomaxprocs",
+		zap.Int("procs", goruntime.GOMAXPROCS(0)),
+		zap.String("source", source),
+	)
+
+	if conf.GCPercent != 0 {
+		debug.SetGCPercent(conf.GCPercent)
+		logger.Info("gc percent", zap.Int("percent", conf.GCPercent))
+	}
+}
+
+// maxProcs returns the GOMAXPROCS to use and where it came from, or zero if
+// GOMAXPROCS should be left unchanged.
+func maxProcs(conf Config, root string, logger log.Logger) (int, string) {
+	if conf.MaxProcs > 0 {
+		return conf.MaxProcs, "config"
+	}
+
+	// The Go runtime already applies the environment variable.
+	if _, ok := os.LookupEnv("GOMAXPROCS"); ok {
+		return 0, "env"
+	}
+
+	quota, ok, err := cpuQuota(root)
+	if err != nil {
+		logger.Warn("failed to read cpu quota", zap.Error(err))
+		return 0, "default"
+	}
+	if !ok {
+		return 0, "default"
+	}
+
+	// Round down as using more procs than the quota leads to throttling,
+	// though always use at least one proc.
+	procs := int(math.Floor(quota))
+	if procs < 1 {
+		procs = 1
+	}
+	if cpus := goruntime.NumCPU(); procs > cpus {
+		procs = cpus
+	}
+	return procs, "cgroup"
+}
@@ -0,0 +1,57 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestMaxProcs(t *testing.T) {
+	t.Run("config", func(t *testing.T) {
+		procs, source := maxProcs(Config{MaxProcs: 3}, t.TempDir(), log.NewNopLogger())
+		assert.Equal(t, 3, procs)
+		assert.Equal(t, "config", source)
+	})
+
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("GOMAXPROCS", "3")
+
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "cpu.max"), "100000 100000\n")
+
+		procs, source := maxProcs(Config{}, root, log.NewNopLogger())
+		assert.Equal(t, 0, procs)
+		assert.Equal(t, "env", source)
+	})
+
+	t.Run("cgroup", func(t *testing.T) {
+		unsetEnv(t, "GOMAXPROCS")
+
+		root := t.TempDir()
+		// Quotas less than one CPU still use one proc.
+		writeFile(t, filepath.Join(root, "cpu.max"), "50000 100000\n")
+
+		procs, source := maxProcs(Config{}, root, log.NewNopLogger())
+		assert.Equal(t, 1, procs)
+		assert.Equal(t, "cgroup", source)
+	})
+
+	t.Run("no quota", func(t *testing.T) {
+		unsetEnv(t, "GOMAXPROCS")
+
+		procs, source := maxProcs(Config{}, t.TempDir(), log.NewNopLogger())
+		assert.Equal(t, 0, procs)
+		assert.Equal(t, "default", source)
+	})
+}
+
+// unsetEnv unsets the environment variable for the duration of the test.
+func unsetEnv(t *testing.T, key string) {
+	// Use Setenv to restore the value after the test.
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
@@ -26,7 +26,9 @@ func LocalTLSServerCert() (*x509.CertPool, tls.Certificate, error) {
 	// CA certificate.
 	rootTemplate.IsCA = true
 	rootTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
-	rootTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	rootTemplate.ExtKeyUsage = []x509.ExtKeyUsage{
+		x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+	}
 
 	_, rootCert, err := cert(
 		rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey,
@@ -44,7 +46,11 @@ func LocalTLSServerCert() (*x509.CertPool, tls.Certificate, error) {
 		return nil, tls.Certificate{}, fmt.Errorf("server cert template: %w", err)
 	}
 	serverTemplate.KeyUsage = x509.KeyUsageDigitalSignature
-	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	// Also allow client authentication so the certificate can be used for
+	// mutual TLS.
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{
+		x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+	}
 	serverTemplate.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
 
 	// Sign the cert using the root CA.
@@ -73,6 +79,35 @@ func LocalTLSServerCert() (*x509.CertPool, tls.Certificate, error) {
 	return rootCACertPool, serverTLSCert, nil
 }
 
+// SelfSignedCert creates a PEM encoded self-signed certificate and key for
+// the given DNS names.
+func SelfSignedCert(dnsNames ...string) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate key: %w", err)
+	}
+	template, err := certTemplate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cert template: %w", err)
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	template.DNSNames = dnsNames
+
+	certDER, _, err := cert(template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cert: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: certDER,
+	})
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	return certPEM, keyPEM, nil
+}
+
 func cert(
 	template *x509.Certificate,
 	parent *x509.Certificate,
@@ -0,0 +1,88 @@
+package tunnel
+
+import (
+	"fmt"
+)
+
+// DisconnectReason is a machine-readable reason the server closed an upstream
+// connection.
+//
+// The reason is sent as the status code of the WebSocket close frame, using
+// the range reserved for applications (4000-4999), so upstreams can
+// distinguish the server closing the connection from a network error.
+type DisconnectReason int
+
+const (
+	// DisconnectReasonShutdown indicates the server node is shutting down.
+	// The upstream should reconnect immediately, which will connect to
+	// another node.
+	DisconnectReasonShutdown DisconnectReason = 4000
+	// DisconnectReasonTokenExpired indicates the upstreams token expired
+	// without being refreshed. The upstream should reconnect immediately
+	// with a new token.
+	DisconnectReasonTokenExpired DisconnectReason = 4001
+	// DisconnectReasonShed indicates the server closed the connection to
+	// reduce its load. The upstream should reconnect with backoff, so it
+	// doesn't reconnect to the same overloaded node.
+	DisconnectReasonShed DisconnectReason = 4002
+	// DisconnectReasonUnauthorized indicates the upstream is no longer
+	// authorized, such as its token was revoked. The upstream should stop
+	// reconnecting.
+	DisconnectReasonUnauthorized DisconnectReason = 4003
+)
+
+// ReconnectPolicy describes how an upstream should respond after the server
+// closes its connection.
+type ReconnectPolicy int
+
+const (
+	// ReconnectImmediately reconnects without waiting.
+	ReconnectImmediately ReconnectPolicy = iota
+	// ReconnectBackoff reconnects after waiting a backoff.
+	ReconnectBackoff
+	// ReconnectNever stops reconnecting.
+	ReconnectNever
+)
+
+// ParseDisconnectReason returns the reason with the given WebSocket close
+// code, or false if the code isn't a known reason.
+func ParseDisconnectReason(code int) (DisconnectReason, bool) {
+	reason := DisconnectReason(code)
+	switch reason {
+	case DisconnectReasonShutdown,
+		DisconnectReasonTokenExpired,
+		DisconnectReasonShed,
+		DisconnectReasonUnauthorized:
+		return reason, true
+	default:
+		return 0, false
+	}
+}
+
+// Reconnect returns how the upstream should respond to being disconnected
+// with the reason.
+func (r DisconnectReason) Reconnect() ReconnectPolicy {
+	switch r {
+	case DisconnectReasonShutdown, DisconnectReasonTokenExpired:
+		return ReconnectImmediately
+	case DisconnectReasonUnauthorized:
+		return ReconnectNever
+	default:
+		return ReconnectBackoff
+	}
+}
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectReasonShutdown:
+		return "shutdown"
+	case DisconnectReasonTokenExpired:
+		return "token_expired"
+	case DisconnectReasonShed:
+		return "shed"
+	case DisconnectReasonUnauthorized:
+		return "unauthorized"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(r))
+	}
+}
@@ -0,0 +1,40 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// WriteStreamHeader writes the header of a proxied connection on a
+// multiplexed session, which contains the ID of the endpoint the connection
+// is for.
+//
+// The header is the length of the endpoint ID as a big endian uint16
+// followed by the endpoint ID, so the upstream can read the header without
+// consuming any of the proxied data.
+func WriteStreamHeader(w io.Writer, endpointID string) error {
+	if len(endpointID) > math.MaxUint16 {
+		return fmt.Errorf("endpoint id too long")
+	}
+	b := make([]byte, 2+len(endpointID))
+	binary.BigEndian.PutUint16(b, uint16(len(endpointID)))
+	copy(b[2:], endpointID)
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadStreamHeader reads the header of a proxied connection on a multiplexed
+// session, returning the endpoint ID.
+func ReadStreamHeader(r io.Reader) (string, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,25 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamHeader(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteStreamHeader(&buf, "my-endpoint"))
+	buf.WriteString("data")
+
+	endpointID, err := ReadStreamHeader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "my-endpoint", endpointID)
+
+	// The proxied data isn't consumed.
+	data, err := io.ReadAll(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
@@ -0,0 +1,66 @@
+// Package tunnel defines the control messages exchanged between upstreams
+// and the server over the upstream tunnel.
+//
+// The tunnel is a multiplexed session, where the server opens a stream for
+// each proxied connection. Upstreams open streams to send control requests,
+// where each stream contains a single JSON encoded request from the upstream
+// followed by a JSON encoded response from the server.
+//
+// An upstream may also connect a multiplexed session, which registers
+// multiple endpoints over a single connection. Each control request on a
+// multiplexed session is a JSON encoded [Request], and each proxied
+// connection opened by the server starts with a stream header identifying
+// the endpoint (see [WriteStreamHeader]).
+package tunnel
+
+import (
+	"time"
+)
+
+// TokenRefreshRequest replaces the token used to authenticate the upstream
+// connection, such as when the previous token is about to expire.
+type TokenRefreshRequest struct {
+	// Token is the new token to authenticate the upstream.
+	Token string `json:"token"`
+}
+
+type TokenRefreshResponse struct {
+	// Expiry is the time the new token expires, which is zero if the token
+	// has no expiry.
+	Expiry time.Time `json:"expiry"`
+
+	// Error contains the reason the token was rejected, or is empty if the
+	// token was accepted.
+	Error string `json:"error,omitempty"`
+}
+
+// Request is a control request sent by an upstream on a multiplexed session.
+// Exactly one field is set.
+type Request struct {
+	Register     *RegisterRequest     `json:"register,omitempty"`
+	Unregister   *UnregisterRequest   `json:"unregister,omitempty"`
+	TokenRefresh *TokenRefreshRequest `json:"token_refresh,omitempty"`
+}
+
+// RegisterRequest registers the endpoint on a multiplexed session, so the
+// server proxies connections for the endpoint to the upstream.
+type RegisterRequest struct {
+	EndpointID string `json:"endpoint_id"`
+}
+
+type RegisterResponse struct {
+	// Error contains the reason the endpoint was rejected, or is empty if the
+	// endpoint was registered.
+	Error string `json:"error,omitempty"`
+}
+
+// UnregisterRequest unregisters the endpoint from a multiplexed session.
+type UnregisterRequest struct {
+	EndpointID string `json:"endpoint_id"`
+}
+
+type UnregisterResponse struct {
+	// Error contains the reason the endpoint couldn't be unregistered, or is
+	// empty if the endpoint was unregistered.
+	Error string `json:"error,omitempty"`
+}
@@ -9,7 +9,9 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -32,11 +34,15 @@ type errorMessage struct {
 
 // RetryableError indicates a error is retryable.
 type RetryableError struct {
+	// RetryAfter is the duration the server requested the client waits
+	// before retrying, or zero if the server didn't request a duration.
+	RetryAfter time.Duration
+
 	err error
 }
 
 func NewRetryableError(err error) *RetryableError {
-	return &RetryableError{err}
+	return &RetryableError{err: err}
 }
 
 func (e *RetryableError) Unwrap() error {
@@ -48,8 +54,11 @@ func (e *RetryableError) Error() string {
 }
 
 type dialOptions struct {
-	token     string
-	tlsConfig *tls.Config
+	token            string
+	header           http.Header
+	tlsConfig        *tls.Config
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
 }
 
 type DialOption interface {
@@ -66,6 +75,23 @@ func WithToken(token string) DialOption {
 	return tokenOption(token)
 }
 
+type headerOption struct {
+	key   string
+	value string
+}
+
+func (o headerOption) apply(opts *dialOptions) {
+	if opts.header == nil {
+		opts.header = make(http.Header)
+	}
+	opts.header.Set(o.key, o.value)
+}
+
+// WithHeader adds a header to the WebSocket handshake request.
+func WithHeader(key string, value string) DialOption {
+	return headerOption{key: key, value: value}
+}
+
 type tlsConfigOption struct {
 	TLSConfig *tls.Config
 }
@@ -78,6 +104,40 @@ func WithTLSConfig(config *tls.Config) DialOption {
 	return tlsConfigOption{TLSConfig: config}
 }
 
+type dialTimeoutOption time.Duration
+
+func (o dialTimeoutOption) apply(opts *dialOptions) {
+	opts.dialTimeout = time.Duration(o)
+}
+
+// WithDialTimeout configures the timeout to open the TCP connection.
+// Defaults to no timeout, other than the handshake timeout.
+func WithDialTimeout(timeout time.Duration) DialOption {
+	return dialTimeoutOption(timeout)
+}
+
+type handshakeTimeoutOption time.Duration
+
+func (o handshakeTimeoutOption) apply(opts *dialOptions) {
+	opts.handshakeTimeout = time.Duration(o)
+}
+
+// WithHandshakeTimeout configures the timeout to complete the WebSocket
+// handshake, including opening the TCP connection and the TLS handshake.
+// Defaults to 60 seconds.
+func WithHandshakeTimeout(timeout time.Duration) DialOption {
+	return handshakeTimeoutOption(timeout)
+}
+
+// closeTimeout is the timeout writing a close frame.
+const closeTimeout = time.Second
+
+// CloseFrame contains the status code and text of a WebSocket close frame.
+type CloseFrame struct {
+	Code int
+	Text string
+}
+
 // Conn implements a [net.Conn] using WebSockets as the underlying transport.
 //
 // This adds a small amount of overhead compared to using TCP directly, though
@@ -85,6 +145,14 @@ func WithTLSConfig(config *tls.Config) DialOption {
 type Conn struct {
 	wsConn *websocket.Conn
 
+	// header contains the handshake response headers if the connection was
+	// dialed.
+	header http.Header
+
+	// remoteClose contains the close frame received from the peer, or nil
+	// if no close frame was received.
+	remoteClose atomic.Pointer[CloseFrame]
+
 	reader io.Reader
 }
 
@@ -104,12 +172,23 @@ func Dial(ctx context.Context, url string, opts ...DialOption) (*Conn, error) {
 	dialer := &websocket.Dialer{
 		HandshakeTimeout: 60 * time.Second,
 	}
+	if options.handshakeTimeout != 0 {
+		dialer.HandshakeTimeout = options.handshakeTimeout
+	}
+	if options.dialTimeout != 0 {
+		dialer.NetDialContext = (&net.Dialer{
+			Timeout: options.dialTimeout,
+		}).DialContext
+	}
 
 	if options.tlsConfig != nil {
 		dialer.TLSClientConfig = options.tlsConfig
 	}
 
 	header := make(http.Header)
+	for key, values := range options.header {
+		header[key] = values
+	}
 	if options.token != "" {
 		header.Set("Authorization", "Bearer "+options.token)
 	}
@@ -118,7 +197,9 @@ func Dial(ctx context.Context, url string, opts ...DialOption) (*Conn, error) {
 		ctx, url, header,
 	)
 	if err == nil {
-		return New(wsConn), nil
+		conn := New(wsConn)
+		conn.header = resp.Header
+		return conn, nil
 	}
 	if resp == nil {
 		return nil, NewRetryableError(err)
@@ -135,11 +216,29 @@ func Dial(ctx context.Context, url string, opts ...DialOption) (*Conn, error) {
 
 	err = fmt.Errorf("%d: %w", resp.StatusCode, err)
 	if _, ok := retryableStatusCodes[resp.StatusCode]; ok {
-		return nil, NewRetryableError(err)
+		retryableErr := NewRetryableError(err)
+		retryableErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		return nil, retryableErr
 	}
 	return nil, err
 }
 
+// parseRetryAfter parses a 'Retry-After' header containing a number of
+// seconds. Returns zero if the header is missing or invalid.
+func parseRetryAfter(s string) time.Duration {
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// ResponseHeader returns the WebSocket handshake response headers, or nil if
+// the connection wasn't dialed.
+func (c *Conn) ResponseHeader() http.Header {
+	return c.header
+}
+
 func (c *Conn) Read(b []byte) (int, error) {
 	for {
 		if c.reader == nil {
@@ -147,6 +246,7 @@ func (c *Conn) Read(b []byte) (int, error) {
 			if err != nil {
 				var closeErr *websocket.CloseError
 				if errors.As(err, &closeErr) {
+					c.onRemoteClose(closeErr)
 					return 0, net.ErrClosed
 				}
 				return 0, err
@@ -170,6 +270,7 @@ func (c *Conn) Read(b []byte) (int, error) {
 		if err != io.EOF {
 			var closeErr *websocket.CloseError
 			if errors.As(err, &closeErr) {
+				c.onRemoteClose(closeErr)
 				return 0, net.ErrClosed
 			}
 			return 0, err
@@ -195,6 +296,36 @@ func (c *Conn) Close() error {
 	return c.wsConn.Close()
 }
 
+// CloseWithFrame sends a close frame with the given status code and text to
+// the peer, then closes the connection.
+func (c *Conn) CloseWithFrame(code int, text string) error {
+	// Attempt to send the close frame, though close the connection
+	// regardless.
+	_ = c.wsConn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text),
+		time.Now().Add(closeTimeout),
+	)
+	return c.wsConn.Close()
+}
+
+// RemoteClose returns the close frame received from the peer, or false if
+// the peer didn't send a close frame.
+func (c *Conn) RemoteClose() (CloseFrame, bool) {
+	frame := c.remoteClose.Load()
+	if frame == nil {
+		return CloseFrame{}, false
+	}
+	return *frame, true
+}
+
+func (c *Conn) onRemoteClose(err *websocket.CloseError) {
+	c.remoteClose.CompareAndSwap(nil, &CloseFrame{
+		Code: err.Code,
+		Text: err.Text,
+	})
+}
+
 func (c *Conn) LocalAddr() net.Addr {
 	return c.wsConn.LocalAddr()
 }
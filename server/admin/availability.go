@@ -0,0 +1,33 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+type endpointAvailabilityResponse struct {
+	cluster.Endpoint
+
+	// History contains the number of upstreams connected for each minute in
+	// the last hour, oldest first.
+	History []cluster.AvailabilitySample `json:"history"`
+}
+
+// endpointAvailabilityRoute returns the current availability of an endpoint
+// across the cluster, along with the number of upstreams connected for each
+// minute in the last hour.
+//
+// History is kept in memory, so only covers the time since the node
+// started.
+func (s *Server) endpointAvailabilityRoute(c *gin.Context) {
+	endpointID := upstream.NormalizeEndpointID(c.Param("id"))
+
+	c.JSON(http.StatusOK, endpointAvailabilityResponse{
+		Endpoint: *s.clusterState.Endpoint(endpointID),
+		History:  s.clusterState.EndpointHistory(endpointID),
+	})
+}
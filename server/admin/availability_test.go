@@ -0,0 +1,77 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+func TestServer_EndpointAvailability(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	clusterState := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	clusterState.AddNode(&cluster.Node{
+		ID:     "remote",
+		Status: cluster.NodeStatusActive,
+	})
+	clusterState.AddLocalEndpoint("my-endpoint")
+	clusterState.UpdateRemoteEndpoint("remote", "my-endpoint", 2)
+
+	s := NewServer(
+		clusterState,
+		prometheus.NewRegistry(),
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	go func() {
+		assert.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf(
+		"http://%s/_piko/v1/endpoints/my-endpoint/availability", ln.Addr().String(),
+	)
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var availability endpointAvailabilityResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&availability))
+
+	assert.Equal(t, cluster.Endpoint{
+		ID:        "my-endpoint",
+		Upstreams: 3,
+		Nodes:     map[string]int{"local": 1, "remote": 2},
+	}, availability.Endpoint)
+	require.Len(t, availability.History, 60)
+	assert.Equal(t, 3, availability.History[59].Max)
+
+	// Endpoint IDs are case insensitive.
+	url = fmt.Sprintf(
+		"http://%s/_piko/v1/endpoints/My-Endpoint/availability", ln.Addr().String(),
+	)
+	resp, err = http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&availability))
+	assert.Equal(t, "my-endpoint", availability.ID)
+	assert.Equal(t, 3, availability.Upstreams)
+}
@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/server/catalogue"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+// CatalogueEditor adds and removes endpoint catalogue entries.
+type CatalogueEditor interface {
+	Put(ctx context.Context, entry *catalogue.Entry) error
+	Delete(ctx context.Context, endpointID string) error
+}
+
+type putCatalogueEntryRequest struct {
+	Description string   `json:"description"`
+	Owner       string   `json:"owner"`
+	Tags        []string `json:"tags"`
+}
+
+// SetCatalogueEditor sets the editor used to modify the endpoint catalogue.
+func (s *Server) SetCatalogueEditor(editor CatalogueEditor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.catalogueEditor = editor
+}
+
+// putCatalogueEntryRoute adds or replaces the catalogue entry for the
+// endpoint.
+func (s *Server) putCatalogueEntryRoute(c *gin.Context) {
+	id, ok := catalogueEndpointID(c)
+	if !ok {
+		return
+	}
+
+	var req putCatalogueEntryRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+
+	editor, ok := s.catalogueEditorOrUnavailable(c)
+	if !ok {
+		return
+	}
+
+	entry := &catalogue.Entry{
+		ID:          id,
+		Description: req.Description,
+		Owner:       req.Owner,
+		Tags:        req.Tags,
+	}
+	if err := editor.Put(c.Request.Context(), entry); err != nil {
+		s.catalogueError(c, id, err)
+		return
+	}
+
+	s.logger.Info("updated catalogue entry", zap.String("endpoint-id", id))
+
+	c.JSON(http.StatusOK, entry)
+}
+
+// deleteCatalogueEntryRoute removes the catalogue entry for the endpoint.
+func (s *Server) deleteCatalogueEntryRoute(c *gin.Context) {
+	id, ok := catalogueEndpointID(c)
+	if !ok {
+		return
+	}
+
+	editor, ok := s.catalogueEditorOrUnavailable(c)
+	if !ok {
+		return
+	}
+
+	if err := editor.Delete(c.Request.Context(), id); err != nil {
+		s.catalogueError(c, id, err)
+		return
+	}
+
+	s.logger.Info("deleted catalogue entry", zap.String("endpoint-id", id))
+
+	c.Status(http.StatusNoContent)
+}
+
+// catalogueEndpointID returns the normalized endpoint ID from the path. Writes
+// a 400 response and returns false if the endpoint ID is invalid.
+//
+// The ID is used in the store key, so must be validated before writing to
+// the store.
+func catalogueEndpointID(c *gin.Context) (string, bool) {
+	id := c.Param("id")
+	if err := upstream.ValidateEndpointID(id); err != nil {
+		c.JSON(http.StatusBadRequest, errorMessage{Error: err.Error()})
+		return "", false
+	}
+	return upstream.NormalizeEndpointID(id), true
+}
+
+func (s *Server) catalogueEditorOrUnavailable(c *gin.Context) (CatalogueEditor, bool) {
+	s.mu.Lock()
+	editor := s.catalogueEditor
+	s.mu.Unlock()
+
+	if editor == nil {
+		c.JSON(http.StatusServiceUnavailable, errorMessage{
+			Error: "catalogue not available",
+		})
+		return nil, false
+	}
+	return editor, true
+}
+
+func (s *Server) catalogueError(c *gin.Context, endpointID string, err error) {
+	if errors.Is(err, catalogue.ErrConfigured) {
+		c.JSON(http.StatusConflict, errorMessage{
+			Error: "endpoint catalogue entry is configured",
+		})
+		return
+	}
+
+	s.logger.Warn(
+		"failed to update catalogue entry",
+		zap.String("endpoint-id", endpointID),
+		zap.Error(err),
+	)
+	c.JSON(http.StatusInternalServerError, errorMessage{Error: err.Error()})
+}
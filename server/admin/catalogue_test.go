@@ -0,0 +1,128 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/catalogue"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/storage"
+)
+
+func TestServer_Catalogue(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer(nil, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	send := func(method string, path string, body any) int {
+		var b bytes.Buffer
+		if body != nil {
+			require.NoError(t, json.NewEncoder(&b).Encode(body))
+		}
+		url := fmt.Sprintf("http://%s%s", ln.Addr().String(), path)
+		req, err := http.NewRequest(method, url, &b)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("catalogue not available", func(t *testing.T) {
+		code := send(http.MethodDelete, "/_piko/v1/catalogue/endpoints/billing", nil)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+	})
+
+	store := storage.NewMemoryStore()
+	endpointCatalogue := catalogue.New(config.CatalogueConfig{
+		Endpoints: []config.CatalogueEndpointConfig{
+			{ID: "payments-cb-1"},
+		},
+	}, store)
+	s.SetCatalogueEditor(endpointCatalogue)
+
+	t.Run("put", func(t *testing.T) {
+		code := send(http.MethodPut, "/_piko/v1/catalogue/endpoints/billing", putCatalogueEntryRequest{
+			Description: "Billing API",
+			Owner:       "billing",
+		})
+		assert.Equal(t, http.StatusOK, code)
+
+		entry, ok, err := endpointCatalogue.Entry(context.TODO(), "billing")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, &catalogue.Entry{
+			ID:          "billing",
+			Description: "Billing API",
+			Owner:       "billing",
+		}, entry)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		code := send(http.MethodDelete, "/_piko/v1/catalogue/endpoints/billing", nil)
+		assert.Equal(t, http.StatusNoContent, code)
+
+		_, ok, err := endpointCatalogue.Entry(context.TODO(), "billing")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("put mixed case", func(t *testing.T) {
+		code := send(http.MethodPut, "/_piko/v1/catalogue/endpoints/Billing", putCatalogueEntryRequest{
+			Owner: "billing",
+		})
+		assert.Equal(t, http.StatusOK, code)
+
+		// Endpoint IDs are case insensitive, so the entry is stored under the
+		// normalized ID.
+		entry, ok, err := endpointCatalogue.Entry(context.TODO(), "billing")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "billing", entry.ID)
+
+		code = send(http.MethodDelete, "/_piko/v1/catalogue/endpoints/BILLING", nil)
+		assert.Equal(t, http.StatusNoContent, code)
+
+		_, ok, err = endpointCatalogue.Entry(context.TODO(), "billing")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("invalid id", func(t *testing.T) {
+		code := send(http.MethodPut, "/_piko/v1/catalogue/endpoints/billing%20api", putCatalogueEntryRequest{
+			Owner: "billing",
+		})
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code = send(http.MethodDelete, "/_piko/v1/catalogue/endpoints/billing%20api", nil)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		entries, err := store.List(context.TODO(), "")
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		code := send(http.MethodPut, "/_piko/v1/catalogue/endpoints/payments-cb-1", putCatalogueEntryRequest{
+			Owner: "payments",
+		})
+		assert.Equal(t, http.StatusConflict, code)
+
+		code = send(http.MethodDelete, "/_piko/v1/catalogue/endpoints/payments-cb-1", nil)
+		assert.Equal(t, http.StatusConflict, code)
+	})
+}
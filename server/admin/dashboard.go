@@ -0,0 +1,22 @@
+package admin
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dashboardHTML is a single-page dashboard visualising the cluster nodes,
+// gossip health and endpoints.
+//
+// The dashboard is built entirely from the status API, which it polls to
+// auto-refresh.
+//
+//go:embed dashboard/index.html
+var dashboardHTML []byte
+
+func (s *Server) dashboardRoute(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardHTML)
+}
@@ -0,0 +1,70 @@
+package admin
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// ZoneDrainer drains all nodes in an availability zone.
+type ZoneDrainer interface {
+	DrainZone(zone string)
+}
+
+type drainZoneResponse struct {
+	Zone string `json:"zone"`
+	// Nodes contains the IDs of the known nodes in the zone.
+	Nodes []string `json:"nodes"`
+}
+
+// SetZoneDrainer sets the drainer used to drain all nodes in a zone.
+func (s *Server) SetZoneDrainer(drainer ZoneDrainer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zoneDrainer = drainer
+}
+
+// drainZoneRoute drains all nodes in the zone given by the 'zone' query.
+//
+// Draining nodes stop accepting new upstream connections, and other nodes
+// deprioritize forwarding requests to them, so the zone can be evacuated.
+func (s *Server) drainZoneRoute(c *gin.Context) {
+	zone := c.Query("zone")
+	if zone == "" {
+		c.JSON(http.StatusBadRequest, errorMessage{Error: "missing zone"})
+		return
+	}
+
+	s.mu.Lock()
+	drainer := s.zoneDrainer
+	s.mu.Unlock()
+
+	if drainer == nil {
+		c.JSON(http.StatusServiceUnavailable, errorMessage{
+			Error: "cluster not available",
+		})
+		return
+	}
+	drainer.DrainZone(zone)
+
+	nodes := []string{}
+	for _, node := range s.clusterState.Nodes() {
+		if node.Zone == zone {
+			nodes = append(nodes, node.ID)
+		}
+	}
+	sort.Strings(nodes)
+
+	s.logger.Info(
+		"draining zone",
+		zap.String("zone", zone),
+		zap.Strings("nodes", nodes),
+	)
+
+	c.JSON(http.StatusOK, drainZoneResponse{
+		Zone:  zone,
+		Nodes: nodes,
+	})
+}
@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+type fakeZoneDrainer struct {
+	zones []string
+}
+
+func (d *fakeZoneDrainer) DrainZone(zone string) {
+	d.zones = append(d.zones, zone)
+}
+
+func TestServer_DrainZone(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	clusterState := cluster.NewState(&cluster.Node{
+		ID:   "local",
+		Zone: "us-east-1a",
+	}, log.NewNopLogger())
+	clusterState.AddNode(&cluster.Node{
+		ID:     "remote-1",
+		Status: cluster.NodeStatusActive,
+		Zone:   "us-east-1a",
+	})
+	clusterState.AddNode(&cluster.Node{
+		ID:     "remote-2",
+		Status: cluster.NodeStatusActive,
+		Zone:   "us-east-1b",
+	})
+
+	s := NewServer(clusterState, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	send := func(path string) (int, drainZoneResponse) {
+		url := fmt.Sprintf("http://%s%s", ln.Addr().String(), path)
+		resp, err := http.Post(url, "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var body drainZoneResponse
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	t.Run("cluster not available", func(t *testing.T) {
+		code, _ := send("/_piko/v1/cluster/drain?zone=us-east-1a")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+	})
+
+	drainer := &fakeZoneDrainer{}
+	s.SetZoneDrainer(drainer)
+
+	t.Run("drain", func(t *testing.T) {
+		code, body := send("/_piko/v1/cluster/drain?zone=us-east-1a")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, drainZoneResponse{
+			Zone:  "us-east-1a",
+			Nodes: []string{"local", "remote-1"},
+		}, body)
+		assert.Equal(t, []string{"us-east-1a"}, drainer.zones)
+	})
+
+	t.Run("missing zone", func(t *testing.T) {
+		code, _ := send("/_piko/v1/cluster/drain")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
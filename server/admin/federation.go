@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FederationGateway exports endpoints to federated clusters.
+type FederationGateway interface {
+	// Authorized returns whether the request is from a federated cluster.
+	Authorized(r *http.Request) bool
+
+	// ExportedEndpoints returns the IDs of the exported endpoints that have
+	// an upstream connected to the local cluster.
+	ExportedEndpoints() []string
+}
+
+type federationEndpointsResponse struct {
+	Endpoints []string `json:"endpoints"`
+}
+
+// SetFederationGateway sets the gateway federated clusters poll for exported
+// endpoints.
+func (s *Server) SetFederationGateway(gateway FederationGateway) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.federationGateway = gateway
+}
+
+// federationEndpointsRoute returns the exported endpoints with an upstream
+// connected to the local cluster, which federated clusters poll to decide
+// which requests to forward to this cluster.
+func (s *Server) federationEndpointsRoute(c *gin.Context) {
+	s.mu.Lock()
+	gateway := s.federationGateway
+	s.mu.Unlock()
+
+	if gateway == nil {
+		c.JSON(http.StatusNotFound, errorMessage{
+			Error: "federation not enabled",
+		})
+		return
+	}
+	if !gateway.Authorized(c.Request) {
+		c.JSON(http.StatusUnauthorized, errorMessage{
+			Error: "invalid federation secret",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, federationEndpointsResponse{
+		Endpoints: gateway.ExportedEndpoints(),
+	})
+}
@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+type fakeFederationGateway struct {
+	endpoints []string
+}
+
+func (g *fakeFederationGateway) Authorized(r *http.Request) bool {
+	return r.Header.Get("Authorization") == "Bearer my-secret"
+}
+
+func (g *fakeFederationGateway) ExportedEndpoints() []string {
+	return g.endpoints
+}
+
+func TestServer_FederationEndpoints(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer(nil, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	send := func(secret string) (int, federationEndpointsResponse) {
+		url := fmt.Sprintf(
+			"http://%s/_piko/v1/federation/endpoints", ln.Addr().String(),
+		)
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+secret)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var body federationEndpointsResponse
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	t.Run("federation not enabled", func(t *testing.T) {
+		code, _ := send("my-secret")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	s.SetFederationGateway(&fakeFederationGateway{
+		endpoints: []string{"my-endpoint"},
+	})
+
+	t.Run("exported endpoints", func(t *testing.T) {
+		code, body := send("my-secret")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []string{"my-endpoint"}, body.Endpoints)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		code, _ := send("wrong-secret")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+}
@@ -0,0 +1,296 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/pkg/gossip"
+)
+
+const (
+	// gossipDumpInterval is the minimum interval between dumps of the gossip
+	// state on a node. Dumping copies every entry of the node so is throttled
+	// to avoid affecting the node when polled.
+	gossipDumpInterval = time.Second
+
+	// gossipNodeTimeout is the timeout to fetch the gossip state from another
+	// node.
+	gossipNodeTimeout = time.Second * 5
+)
+
+// GossipState returns the gossip state the local node holds for each known
+// node.
+type GossipState interface {
+	NodeState(id string) (*gossip.NodeState, bool)
+}
+
+// SetGossipState sets the gossip state of the local node.
+func (s *Server) SetGossipState(state GossipState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gossipState = state
+}
+
+type gossipStateResponse struct {
+	gossip.NodeMetadata
+
+	// Entries contains the key/value entries for the node, including deleted
+	// and internal entries, ordered by version.
+	Entries []gossip.Entry `json:"entries"`
+}
+
+type gossipDiffEntry struct {
+	Key string `json:"key"`
+
+	// A contains the entry in node A's view, or nil if the key is missing.
+	A *gossip.Entry `json:"a,omitempty"`
+
+	// B contains the entry in node B's view, or nil if the key is missing.
+	B *gossip.Entry `json:"b,omitempty"`
+}
+
+type gossipDiffResponse struct {
+	// NodeID is the ID of the node whose state is compared.
+	NodeID string `json:"node_id"`
+
+	A string `json:"a"`
+	B string `json:"b"`
+
+	// AVersion and BVersion contain the latest version of the node known by
+	// each view, or zero if the node is unknown.
+	AVersion uint64 `json:"a_version"`
+	BVersion uint64 `json:"b_version"`
+
+	// Entries contains the keys that differ between the views, ordered by
+	// key.
+	Entries []gossipDiffEntry `json:"entries"`
+}
+
+// gossipStateRoute returns the raw gossip entries the local node holds for
+// the node in the 'node' query, including entry versions and deleted
+// entries.
+func (s *Server) gossipStateRoute(c *gin.Context) {
+	nodeID := c.Query("node")
+	if nodeID == "" {
+		c.JSON(http.StatusBadRequest, errorMessage{Error: "missing node"})
+		return
+	}
+
+	state, ok := s.throttledGossipState(c)
+	if !ok {
+		return
+	}
+
+	nodeState, ok := state.NodeState(nodeID)
+	if !ok {
+		c.JSON(http.StatusNotFound, errorMessage{Error: "node not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, newGossipStateResponse(nodeState))
+}
+
+// gossipDiffRoute compares the gossip state two nodes hold for the node in
+// the 'node' query, and returns the entries that differ.
+//
+// The views to compare are set with the 'a' and 'b' queries. 'a' defaults to
+// the node itself, which is the owner of the state so has the latest
+// entries, and 'b' defaults to the local node.
+func (s *Server) gossipDiffRoute(c *gin.Context) {
+	nodeID := c.Query("node")
+	if nodeID == "" {
+		c.JSON(http.StatusBadRequest, errorMessage{Error: "missing node"})
+		return
+	}
+	a := c.DefaultQuery("a", nodeID)
+	b := c.DefaultQuery("b", s.clusterState.LocalID())
+
+	state, ok := s.throttledGossipState(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), gossipNodeTimeout)
+	defer cancel()
+
+	viewA, err := s.gossipView(ctx, state, a, nodeID)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, errorMessage{
+			Error: fmt.Sprintf("%s: %s", a, err.Error()),
+		})
+		return
+	}
+	viewB, err := s.gossipView(ctx, state, b, nodeID)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, errorMessage{
+			Error: fmt.Sprintf("%s: %s", b, err.Error()),
+		})
+		return
+	}
+
+	resp := gossipDiffResponse{
+		NodeID:  nodeID,
+		A:       a,
+		B:       b,
+		Entries: diffGossipEntries(viewA, viewB),
+	}
+	if viewA != nil {
+		resp.AVersion = viewA.Version
+	}
+	if viewB != nil {
+		resp.BVersion = viewB.Version
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// throttledGossipState returns the local gossip state if a dump is allowed.
+// Otherwise writes the error response and returns false.
+func (s *Server) throttledGossipState(c *gin.Context) (GossipState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.gossipState == nil {
+		c.JSON(
+			http.StatusServiceUnavailable,
+			errorMessage{Error: "gossip not available"},
+		)
+		return nil, false
+	}
+
+	now := time.Now()
+	if wait := s.lastGossipDump.Add(gossipDumpInterval).Sub(now); wait > 0 {
+		retryAfter := int((wait + time.Second - 1) / time.Second)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(
+			http.StatusTooManyRequests,
+			errorMessage{Error: "gossip state dump throttled"},
+		)
+		return nil, false
+	}
+	s.lastGossipDump = now
+
+	return s.gossipState, true
+}
+
+// gossipView returns the state of the node with ID nodeID as seen by the node
+// with ID viewID, or nil if the node is unknown to that view.
+func (s *Server) gossipView(
+	ctx context.Context,
+	local GossipState,
+	viewID string,
+	nodeID string,
+) (*gossipStateResponse, error) {
+	if viewID == s.clusterState.LocalID() {
+		nodeState, ok := local.NodeState(nodeID)
+		if !ok {
+			return nil, nil
+		}
+		resp := newGossipStateResponse(nodeState)
+		return &resp, nil
+	}
+
+	node, ok := s.clusterState.Node(viewID)
+	if !ok {
+		return nil, fmt.Errorf("node not found")
+	}
+	return fetchGossipState(ctx, node.AdminAddr, nodeID)
+}
+
+// fetchGossipState fetches the state of the node with ID nodeID from the
+// node with the given admin address. Returns nil if the node is unknown.
+func fetchGossipState(
+	ctx context.Context,
+	adminAddr string,
+	nodeID string,
+) (*gossipStateResponse, error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     adminAddr,
+		Path:     "/_piko/v1/gossip/state",
+		RawQuery: url.Values{"node": []string{nodeID}}.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+
+	var state gossipStateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return &state, nil
+}
+
+func newGossipStateResponse(state *gossip.NodeState) gossipStateResponse {
+	entries := state.Entries
+	if entries == nil {
+		entries = []gossip.Entry{}
+	}
+	return gossipStateResponse{
+		NodeMetadata: state.NodeMetadata,
+		Entries:      entries,
+	}
+}
+
+// diffGossipEntries returns the entries that are missing from either view or
+// differ between the views. A nil view has no entries.
+func diffGossipEntries(a, b *gossipStateResponse) []gossipDiffEntry {
+	entriesA := make(map[string]gossip.Entry)
+	if a != nil {
+		for _, entry := range a.Entries {
+			entriesA[entry.Key] = entry
+		}
+	}
+	entriesB := make(map[string]gossip.Entry)
+	if b != nil {
+		for _, entry := range b.Entries {
+			entriesB[entry.Key] = entry
+		}
+	}
+
+	diff := []gossipDiffEntry{}
+	for key, entryA := range entriesA {
+		entryA := entryA
+		entryB, ok := entriesB[key]
+		if !ok {
+			diff = append(diff, gossipDiffEntry{Key: key, A: &entryA})
+			continue
+		}
+		if entryA != entryB {
+			entryB := entryB
+			diff = append(diff, gossipDiffEntry{Key: key, A: &entryA, B: &entryB})
+		}
+	}
+	for key, entryB := range entriesB {
+		entryB := entryB
+		if _, ok := entriesA[key]; !ok {
+			diff = append(diff, gossipDiffEntry{Key: key, B: &entryB})
+		}
+	}
+
+	sort.Slice(diff, func(i, j int) bool {
+		return diff[i].Key < diff[j].Key
+	})
+	return diff
+}
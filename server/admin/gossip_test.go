@@ -0,0 +1,202 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/gossip"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+type fakeGossipState struct {
+	nodes map[string]*gossip.NodeState
+}
+
+func (s *fakeGossipState) NodeState(id string) (*gossip.NodeState, bool) {
+	state, ok := s.nodes[id]
+	return state, ok
+}
+
+func TestServer_GossipState(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer(cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger()), nil, nil, nil, nil, log.NewNopLogger())
+	s.SetGossipState(&fakeGossipState{
+		nodes: map[string]*gossip.NodeState{
+			"node-1": {
+				NodeMetadata: gossip.NodeMetadata{
+					ID:      "node-1",
+					Version: 3,
+				},
+				Entries: []gossip.Entry{
+					{Key: "k1", Value: "v1", Version: 2},
+					{Key: "k2", Version: 3, Deleted: true},
+				},
+			},
+		},
+	})
+	go func() {
+		assert.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf(
+		"http://%s/_piko/v1/gossip/state?node=node-1", ln.Addr().String(),
+	)
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var state gossipStateResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&state))
+	assert.Equal(t, "node-1", state.ID)
+	assert.Equal(t, uint64(3), state.Version)
+	assert.Equal(t, []gossip.Entry{
+		{Key: "k1", Value: "v1", Version: 2},
+		{Key: "k2", Version: 3, Deleted: true},
+	}, state.Entries)
+
+	// Dumps are throttled.
+	throttledResp, err := http.Get(url)
+	require.NoError(t, err)
+	defer throttledResp.Body.Close()
+
+	assert.Equal(t, http.StatusTooManyRequests, throttledResp.StatusCode)
+	assert.Equal(t, "1", throttledResp.Header.Get("Retry-After"))
+
+	// Requests without a node aren't throttled.
+	missingResp, err := http.Get(fmt.Sprintf(
+		"http://%s/_piko/v1/gossip/state", ln.Addr().String(),
+	))
+	require.NoError(t, err)
+	defer missingResp.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, missingResp.StatusCode)
+}
+
+func TestServer_GossipDiff(t *testing.T) {
+	// Start a remote node with its own view of node-1.
+	remoteLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	remote := NewServer(cluster.NewState(&cluster.Node{
+		ID: "remote",
+	}, log.NewNopLogger()), nil, nil, nil, nil, log.NewNopLogger())
+	remote.SetGossipState(&fakeGossipState{
+		nodes: map[string]*gossip.NodeState{
+			"node-1": {
+				NodeMetadata: gossip.NodeMetadata{
+					ID:      "node-1",
+					Version: 4,
+				},
+				Entries: []gossip.Entry{
+					{Key: "k1", Value: "v1", Version: 1},
+					{Key: "k2", Value: "v2", Version: 2},
+					{Key: "k3", Version: 4, Deleted: true},
+				},
+			},
+		},
+	})
+	go func() {
+		assert.NoError(t, remote.Serve(remoteLn))
+	}()
+	defer remote.Shutdown(context.TODO())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	clusterState := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	clusterState.AddNode(&cluster.Node{
+		ID:        "remote",
+		Status:    cluster.NodeStatusActive,
+		AdminAddr: remoteLn.Addr().String(),
+	})
+
+	// The local node missed the deletion of k3 and has a stale k2.
+	s := NewServer(clusterState, nil, nil, nil, nil, log.NewNopLogger())
+	s.SetGossipState(&fakeGossipState{
+		nodes: map[string]*gossip.NodeState{
+			"node-1": {
+				NodeMetadata: gossip.NodeMetadata{
+					ID:      "node-1",
+					Version: 3,
+				},
+				Entries: []gossip.Entry{
+					{Key: "k1", Value: "v1", Version: 1},
+					{Key: "k3", Value: "v3", Version: 3},
+				},
+			},
+		},
+	})
+	go func() {
+		assert.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf(
+		"http://%s/_piko/v1/gossip/diff?node=node-1&a=remote",
+		ln.Addr().String(),
+	)
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var diff gossipDiffResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&diff))
+
+	assert.Equal(t, "node-1", diff.NodeID)
+	assert.Equal(t, "remote", diff.A)
+	assert.Equal(t, "local", diff.B)
+	assert.Equal(t, uint64(4), diff.AVersion)
+	assert.Equal(t, uint64(3), diff.BVersion)
+	assert.Equal(t, []gossipDiffEntry{
+		{
+			Key: "k2",
+			A:   &gossip.Entry{Key: "k2", Value: "v2", Version: 2},
+		},
+		{
+			Key: "k3",
+			A:   &gossip.Entry{Key: "k3", Version: 4, Deleted: true},
+			B:   &gossip.Entry{Key: "k3", Value: "v3", Version: 3},
+		},
+	}, diff.Entries)
+}
+
+func TestDiffGossipEntries(t *testing.T) {
+	t.Run("unknown node", func(t *testing.T) {
+		b := &gossipStateResponse{
+			Entries: []gossip.Entry{
+				{Key: "k1", Value: "v1", Version: 1},
+			},
+		}
+		assert.Equal(t, []gossipDiffEntry{
+			{Key: "k1", B: &gossip.Entry{Key: "k1", Value: "v1", Version: 1}},
+		}, diffGossipEntries(nil, b))
+	})
+
+	t.Run("converged", func(t *testing.T) {
+		a := &gossipStateResponse{
+			Entries: []gossip.Entry{
+				{Key: "k1", Value: "v1", Version: 1},
+			},
+		}
+		assert.Equal(t, []gossipDiffEntry{}, diffGossipEntries(a, a))
+	})
+}
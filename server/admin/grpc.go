@@ -0,0 +1,248 @@
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpcstatus "google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+
+	adminv1 "github.com/andydunstall/piko/api/admin/v1"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+// GRPCServer is the gRPC admin server, which exposes the admin API using the
+// protobuf definitions in 'api/admin/v1', so tooling can integrate with a
+// typed and versioned API.
+type GRPCServer struct {
+	adminv1.UnimplementedAdminServiceServer
+
+	clusterState *cluster.State
+
+	conf *config.Config
+
+	grpcServer *grpc.Server
+
+	// shutdownCh is closed when the server is shutdown to close active
+	// watch streams.
+	shutdownCh chan struct{}
+
+	logger log.Logger
+}
+
+func NewGRPCServer(
+	clusterState *cluster.State,
+	conf *config.Config,
+	tlsConfig *tls.Config,
+	logger log.Logger,
+) *GRPCServer {
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := &GRPCServer{
+		clusterState: clusterState,
+		conf:         conf,
+		grpcServer:   grpc.NewServer(opts...),
+		shutdownCh:   make(chan struct{}),
+		logger:       logger.WithSubsystem("admin.grpc"),
+	}
+	adminv1.RegisterAdminServiceServer(server.grpcServer, server)
+	return server
+}
+
+func (s *GRPCServer) Serve(ln net.Listener) error {
+	s.logger.Info(
+		"starting grpc admin server",
+		zap.String("addr", ln.Addr().String()),
+	)
+
+	if err := s.grpcServer.Serve(ln); err != nil && err != grpc.ErrServerStopped {
+		return fmt.Errorf("grpc serve: %w", err)
+	}
+	return nil
+}
+
+// Shutdown attempts to gracefully shutdown the server by waiting for pending
+// requests to complete. Active watch streams are closed.
+//
+// If the context is cancelled before the pending requests complete, the
+// remaining connections are closed.
+func (s *GRPCServer) Shutdown(ctx context.Context) error {
+	close(s.shutdownCh)
+
+	stoppedCh := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stoppedCh)
+	}()
+
+	select {
+	case <-stoppedCh:
+		return nil
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+		return ctx.Err()
+	}
+}
+
+func (s *GRPCServer) ListNodes(
+	_ context.Context,
+	_ *adminv1.ListNodesRequest,
+) (*adminv1.ListNodesResponse, error) {
+	nodes := s.clusterState.Nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+
+	resp := &adminv1.ListNodesResponse{}
+	for _, node := range nodes {
+		resp.Nodes = append(resp.Nodes, nodeToProto(node))
+	}
+	return resp, nil
+}
+
+func (s *GRPCServer) GetNode(
+	_ context.Context,
+	req *adminv1.GetNodeRequest,
+) (*adminv1.GetNodeResponse, error) {
+	if req.Id == "" {
+		return &adminv1.GetNodeResponse{
+			Node: nodeToProto(s.clusterState.LocalNode()),
+		}, nil
+	}
+
+	node, ok := s.clusterState.Node(req.Id)
+	if !ok {
+		return nil, grpcstatus.Error(codes.NotFound, "node not found")
+	}
+	return &adminv1.GetNodeResponse{
+		Node: nodeToProto(node),
+	}, nil
+}
+
+func (s *GRPCServer) ListEndpoints(
+	_ context.Context,
+	_ *adminv1.ListEndpointsRequest,
+) (*adminv1.ListEndpointsResponse, error) {
+	resp := &adminv1.ListEndpointsResponse{}
+	for _, endpoint := range s.clusterState.Endpoints() {
+		resp.Endpoints = append(resp.Endpoints, endpointToProto(endpoint))
+	}
+	return resp, nil
+}
+
+func (s *GRPCServer) WatchEndpoints(
+	req *adminv1.WatchEndpointsRequest,
+	stream adminv1.AdminService_WatchEndpointsServer,
+) error {
+	// Start watching before sending the current availability to avoid
+	// missing updates.
+	w := s.clusterState.WatchEndpoints(req.EndpointId)
+	defer w.Close()
+
+	var endpoints []*cluster.Endpoint
+	if req.EndpointId != "" {
+		endpoints = []*cluster.Endpoint{s.clusterState.Endpoint(req.EndpointId)}
+	} else {
+		endpoints = s.clusterState.Endpoints()
+	}
+	if err := sendEndpoints(stream, endpoints); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-w.Notify():
+			if err := sendEndpoints(stream, w.Updates()); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-s.shutdownCh:
+			return grpcstatus.Error(codes.Unavailable, "server shutting down")
+		}
+	}
+}
+
+func (s *GRPCServer) GetConfig(
+	_ context.Context,
+	_ *adminv1.GetConfigRequest,
+) (*adminv1.GetConfigResponse, error) {
+	b, err := yaml.Marshal(s.conf.Redacted())
+	if err != nil {
+		return nil, grpcstatus.Errorf(codes.Internal, "encode config: %s", err)
+	}
+	return &adminv1.GetConfigResponse{
+		Config: string(b),
+	}, nil
+}
+
+func sendEndpoints(
+	stream adminv1.AdminService_WatchEndpointsServer,
+	endpoints []*cluster.Endpoint,
+) error {
+	for _, endpoint := range endpoints {
+		if err := stream.Send(&adminv1.WatchEndpointsResponse{
+			Endpoint: endpointToProto(endpoint),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nodeToProto(node *cluster.Node) *adminv1.Node {
+	var endpoints map[string]int32
+	if len(node.Endpoints) > 0 {
+		endpoints = make(map[string]int32, len(node.Endpoints))
+		for endpointID, listeners := range node.Endpoints {
+			endpoints[endpointID] = int32(listeners)
+		}
+	}
+	return &adminv1.Node{
+		Id:        node.ID,
+		Status:    nodeStatusToProto(node.Status),
+		ProxyAddr: node.ProxyAddr,
+		AdminAddr: node.AdminAddr,
+		Endpoints: endpoints,
+	}
+}
+
+func nodeStatusToProto(status cluster.NodeStatus) adminv1.NodeStatus {
+	switch status {
+	case cluster.NodeStatusActive:
+		return adminv1.NodeStatus_NODE_STATUS_ACTIVE
+	case cluster.NodeStatusUnreachable:
+		return adminv1.NodeStatus_NODE_STATUS_UNREACHABLE
+	case cluster.NodeStatusLeft:
+		return adminv1.NodeStatus_NODE_STATUS_LEFT
+	default:
+		return adminv1.NodeStatus_NODE_STATUS_UNSPECIFIED
+	}
+}
+
+func endpointToProto(endpoint *cluster.Endpoint) *adminv1.Endpoint {
+	var nodes map[string]int32
+	if len(endpoint.Nodes) > 0 {
+		nodes = make(map[string]int32, len(endpoint.Nodes))
+		for nodeID, upstreams := range endpoint.Nodes {
+			nodes[nodeID] = int32(upstreams)
+		}
+	}
+	return &adminv1.Endpoint{
+		Id:        endpoint.ID,
+		Upstreams: int32(endpoint.Upstreams),
+		Nodes:     nodes,
+	}
+}
@@ -0,0 +1,183 @@
+package admin
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcstatus "google.golang.org/grpc/status"
+
+	adminv1 "github.com/andydunstall/piko/api/admin/v1"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func newTestGRPCClient(
+	t *testing.T,
+	clusterState *cluster.State,
+	conf *config.Config,
+) adminv1.AdminServiceClient {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewGRPCServer(clusterState, conf, nil, log.NewNopLogger())
+	go func() {
+		assert.NoError(t, s.Serve(ln))
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+	})
+
+	conn, err := grpc.NewClient(
+		ln.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return adminv1.NewAdminServiceClient(conn)
+}
+
+func TestGRPCServer_Nodes(t *testing.T) {
+	clusterState := cluster.NewState(&cluster.Node{
+		ID:        "local",
+		ProxyAddr: "10.26.104.14:8000",
+		AdminAddr: "10.26.104.14:8002",
+	}, log.NewNopLogger())
+	clusterState.AddLocalEndpoint("my-endpoint")
+	clusterState.AddNode(&cluster.Node{
+		ID:     "remote",
+		Status: cluster.NodeStatusUnreachable,
+	})
+
+	client := newTestGRPCClient(t, clusterState, config.Default())
+
+	t.Run("list nodes", func(t *testing.T) {
+		resp, err := client.ListNodes(context.Background(), &adminv1.ListNodesRequest{})
+		require.NoError(t, err)
+
+		require.Len(t, resp.Nodes, 2)
+		assert.Equal(t, "local", resp.Nodes[0].Id)
+		assert.Equal(t, adminv1.NodeStatus_NODE_STATUS_ACTIVE, resp.Nodes[0].Status)
+		assert.Equal(t, "10.26.104.14:8000", resp.Nodes[0].ProxyAddr)
+		assert.Equal(t, "10.26.104.14:8002", resp.Nodes[0].AdminAddr)
+		assert.Equal(t, map[string]int32{"my-endpoint": 1}, resp.Nodes[0].Endpoints)
+		assert.Equal(t, "remote", resp.Nodes[1].Id)
+		assert.Equal(t, adminv1.NodeStatus_NODE_STATUS_UNREACHABLE, resp.Nodes[1].Status)
+	})
+
+	t.Run("get node", func(t *testing.T) {
+		resp, err := client.GetNode(context.Background(), &adminv1.GetNodeRequest{
+			Id: "remote",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "remote", resp.Node.Id)
+	})
+
+	t.Run("get local node", func(t *testing.T) {
+		resp, err := client.GetNode(context.Background(), &adminv1.GetNodeRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, "local", resp.Node.Id)
+	})
+
+	t.Run("get node not found", func(t *testing.T) {
+		_, err := client.GetNode(context.Background(), &adminv1.GetNodeRequest{
+			Id: "unknown",
+		})
+		assert.Equal(t, codes.NotFound, grpcstatus.Code(err))
+	})
+}
+
+func TestGRPCServer_Endpoints(t *testing.T) {
+	t.Run("list endpoints", func(t *testing.T) {
+		clusterState := cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger())
+		clusterState.AddLocalEndpoint("my-endpoint")
+		clusterState.AddNode(&cluster.Node{
+			ID:     "remote",
+			Status: cluster.NodeStatusActive,
+			Endpoints: map[string]int{
+				"my-endpoint": 2,
+			},
+		})
+
+		client := newTestGRPCClient(t, clusterState, config.Default())
+
+		resp, err := client.ListEndpoints(
+			context.Background(), &adminv1.ListEndpointsRequest{},
+		)
+		require.NoError(t, err)
+
+		require.Len(t, resp.Endpoints, 1)
+		assert.Equal(t, "my-endpoint", resp.Endpoints[0].Id)
+		assert.Equal(t, int32(3), resp.Endpoints[0].Upstreams)
+		assert.Equal(t, map[string]int32{
+			"local":  1,
+			"remote": 2,
+		}, resp.Endpoints[0].Nodes)
+	})
+
+	t.Run("watch endpoint", func(t *testing.T) {
+		clusterState := cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger())
+
+		client := newTestGRPCClient(t, clusterState, config.Default())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		stream, err := client.WatchEndpoints(ctx, &adminv1.WatchEndpointsRequest{
+			EndpointId: "my-endpoint",
+		})
+		require.NoError(t, err)
+
+		// The stream starts with the current availability.
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "my-endpoint", resp.Endpoint.Id)
+		assert.Equal(t, int32(0), resp.Endpoint.Upstreams)
+
+		clusterState.AddLocalEndpoint("my-endpoint")
+
+		resp, err = stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "my-endpoint", resp.Endpoint.Id)
+		assert.Equal(t, int32(1), resp.Endpoint.Upstreams)
+
+		clusterState.RemoveLocalEndpoint("my-endpoint")
+
+		resp, err = stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "my-endpoint", resp.Endpoint.Id)
+		assert.Equal(t, int32(0), resp.Endpoint.Upstreams)
+	})
+}
+
+func TestGRPCServer_GetConfig(t *testing.T) {
+	clusterState := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+
+	conf := config.Default()
+	conf.Cluster.NodeID = "local"
+	conf.Auth.TokenHMACSecretKey = "my-secret"
+
+	client := newTestGRPCClient(t, clusterState, conf)
+
+	resp, err := client.GetConfig(context.Background(), &adminv1.GetConfigRequest{})
+	require.NoError(t, err)
+
+	assert.Contains(t, resp.Config, "node_id: local")
+	assert.Contains(t, resp.Config, "token_hmac_secret_key: <redacted>")
+	assert.NotContains(t, resp.Config, "my-secret")
+}
@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// HealthServer is an unauthenticated HTTP server exposing only liveness and
+// readiness probes, so probes such as Kubernetes liveness and readiness
+// probes don't need access to the admin API.
+type HealthServer struct {
+	// ready returns whether the node is ready to accept traffic.
+	ready func() bool
+
+	httpServer *http.Server
+
+	logger log.Logger
+}
+
+func NewHealthServer(ready func() bool, logger log.Logger) *HealthServer {
+	logger = logger.WithSubsystem("admin.health")
+
+	router := gin.New()
+	server := &HealthServer{
+		ready: ready,
+		httpServer: &http.Server{
+			Handler:  router,
+			ErrorLog: logger.StdLogger(zapcore.WarnLevel),
+		},
+		logger: logger,
+	}
+
+	router.GET("/livez", server.livezRoute)
+	router.GET("/readyz", server.readyzRoute)
+
+	return server
+}
+
+func (s *HealthServer) Serve(ln net.Listener) error {
+	s.logger.Info(
+		"starting health server",
+		zap.String("addr", ln.Addr().String()),
+	)
+
+	if err := s.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("http serve: %w", err)
+	}
+	return nil
+}
+
+func (s *HealthServer) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// livezRoute responds with 200 while the server is running.
+func (s *HealthServer) livezRoute(c *gin.Context) {
+	c.Status(http.StatusOK)
+}
+
+// readyzRoute responds with 200 if the node is ready to accept traffic, or
+// 503 otherwise.
+func (s *HealthServer) readyzRoute(c *gin.Context) {
+	if !s.ready() {
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+	c.Status(http.StatusOK)
+}
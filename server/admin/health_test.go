@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestHealthServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ready := atomic.NewBool(false)
+	s := NewHealthServer(ready.Load, log.NewNopLogger())
+	go func() {
+		assert.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	get := func(path string) int {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", ln.Addr().String(), path))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get("/livez"))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+
+	ready.Store(true)
+	assert.Equal(t, http.StatusOK, get("/readyz"))
+
+	// Only the probes are exposed.
+	assert.Equal(t, http.StatusNotFound, get("/metrics"))
+	assert.Equal(t, http.StatusNotFound, get("/ready"))
+}
@@ -0,0 +1,174 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+const (
+	// historyNodeTimeout is the timeout to fetch connection history from
+	// another node.
+	historyNodeTimeout = time.Second * 5
+)
+
+// ConnHistory records upstream connect and disconnect events on the local
+// node.
+type ConnHistory interface {
+	Events(endpointID string) []upstream.ConnEvent
+}
+
+// SetConnHistory sets the history of upstream connection events on the
+// local node.
+func (s *Server) SetConnHistory(history ConnHistory) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connHistory = history
+}
+
+type endpointHistoryResponse struct {
+	ID string `json:"id"`
+
+	// Events contains the upstream connect and disconnect events for the
+	// endpoint across the cluster, oldest first.
+	Events []upstream.ConnEvent `json:"events"`
+
+	// Unreachable contains the IDs of the nodes whose events couldn't be
+	// fetched, so are missing from the events.
+	Unreachable []string `json:"unreachable,omitempty"`
+}
+
+// endpointHistoryRoute returns the recent upstream connect and disconnect
+// events for an endpoint across the cluster.
+//
+// Each node only records the events of upstreams connected to that node, so
+// the local node fetches the events from the other nodes in the cluster. Use
+// a 'local=true' query to only return the events of the local node.
+func (s *Server) endpointHistoryRoute(c *gin.Context) {
+	s.mu.Lock()
+	history := s.connHistory
+	s.mu.Unlock()
+
+	if history == nil {
+		c.JSON(
+			http.StatusServiceUnavailable,
+			errorMessage{Error: "history not available"},
+		)
+		return
+	}
+
+	endpointID := upstream.NormalizeEndpointID(c.Param("id"))
+	resp := endpointHistoryResponse{
+		ID:     endpointID,
+		Events: history.Events(endpointID),
+	}
+
+	if c.Query("local") != "true" {
+		events, unreachable := s.remoteHistory(c.Request.Context(), endpointID)
+		resp.Events = append(resp.Events, events...)
+		resp.Unreachable = unreachable
+	}
+
+	sort.SliceStable(resp.Events, func(i, j int) bool {
+		return resp.Events[i].Time.Before(resp.Events[j].Time)
+	})
+	if resp.Events == nil {
+		resp.Events = []upstream.ConnEvent{}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// remoteHistory fetches the events for the endpoint from each active remote
+// node. Returns the events and the IDs of the nodes that couldn't be
+// reached.
+func (s *Server) remoteHistory(
+	ctx context.Context,
+	endpointID string,
+) ([]upstream.ConnEvent, []string) {
+	ctx, cancel := context.WithTimeout(ctx, historyNodeTimeout)
+	defer cancel()
+
+	var events []upstream.ConnEvent
+	var unreachable []string
+	var mu sync.Mutex
+
+	var wg sync.WaitGroup
+	for _, node := range s.clusterState.Nodes() {
+		if node.ID == s.clusterState.LocalID() ||
+			node.Status != cluster.NodeStatusActive {
+			continue
+		}
+
+		wg.Add(1)
+		go func(node *cluster.Node) {
+			defer wg.Done()
+
+			nodeEvents, err := fetchHistory(ctx, node.AdminAddr, endpointID)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				s.logger.Warn(
+					"failed to fetch node history",
+					zap.String("node-id", node.ID),
+					zap.Error(err),
+				)
+				unreachable = append(unreachable, node.ID)
+				return
+			}
+			events = append(events, nodeEvents...)
+		}(node)
+	}
+	wg.Wait()
+
+	sort.Strings(unreachable)
+	return events, unreachable
+}
+
+// fetchHistory fetches the events for the endpoint recorded by the node with
+// the given admin address.
+func fetchHistory(
+	ctx context.Context,
+	adminAddr string,
+	endpointID string,
+) ([]upstream.ConnEvent, error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     adminAddr,
+		Path:     "/_piko/v1/endpoints/" + url.PathEscape(endpointID) + "/history",
+		RawQuery: "local=true",
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+
+	var history endpointHistoryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return history.Events, nil
+}
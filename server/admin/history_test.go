@@ -0,0 +1,104 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func TestServer_EndpointHistory(t *testing.T) {
+	start := time.Now()
+
+	// Start a remote node with its own history.
+	remoteLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	remoteHistory := upstream.NewConnHistory("remote")
+	remoteHistory.Record("my-endpoint", upstream.ConnEvent{
+		Time:       start.Add(time.Second),
+		Type:       upstream.ConnEventTypeConnected,
+		UpstreamID: "upstream-2",
+	})
+
+	remote := NewServer(cluster.NewState(&cluster.Node{
+		ID: "remote",
+	}, log.NewNopLogger()), nil, nil, nil, nil, log.NewNopLogger())
+	remote.SetConnHistory(remoteHistory)
+	go func() {
+		assert.NoError(t, remote.Serve(remoteLn))
+	}()
+	defer remote.Shutdown(context.TODO())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	localHistory := upstream.NewConnHistory("local")
+	localHistory.Record("my-endpoint", upstream.ConnEvent{
+		Time:       start,
+		Type:       upstream.ConnEventTypeConnected,
+		UpstreamID: "upstream-1",
+	})
+	localHistory.Record("my-endpoint", upstream.ConnEvent{
+		Time:       start.Add(time.Second * 2),
+		Type:       upstream.ConnEventTypeDisconnected,
+		UpstreamID: "upstream-1",
+		Reason:     upstream.DisconnectReasonClosed,
+	})
+
+	clusterState := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	clusterState.AddNode(&cluster.Node{
+		ID:        "remote",
+		Status:    cluster.NodeStatusActive,
+		AdminAddr: remoteLn.Addr().String(),
+	})
+	clusterState.AddNode(&cluster.Node{
+		ID:     "unreachable",
+		Status: cluster.NodeStatusActive,
+		// Nothing is listening on the discard port.
+		AdminAddr: "127.0.0.1:9",
+	})
+
+	s := NewServer(clusterState, nil, nil, nil, nil, log.NewNopLogger())
+	s.SetConnHistory(localHistory)
+	go func() {
+		assert.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf(
+		"http://%s/_piko/v1/endpoints/my-endpoint/history", ln.Addr().String(),
+	)
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var history endpointHistoryResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+
+	assert.Equal(t, "my-endpoint", history.ID)
+	assert.Equal(t, []string{"unreachable"}, history.Unreachable)
+
+	// Events from all nodes are merged, oldest first.
+	require.Len(t, history.Events, 3)
+	assert.Equal(t, "upstream-1", history.Events[0].UpstreamID)
+	assert.Equal(t, "local", history.Events[0].NodeID)
+	assert.Equal(t, "upstream-2", history.Events[1].UpstreamID)
+	assert.Equal(t, "remote", history.Events[1].NodeID)
+	assert.Equal(t, upstream.ConnEventTypeDisconnected, history.Events[2].Type)
+	assert.Equal(t, upstream.DisconnectReasonClosed, history.Events[2].Reason)
+}
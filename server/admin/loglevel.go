@@ -0,0 +1,137 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// LogLevelPropagator propagates log level updates to the rest of the cluster.
+type LogLevelPropagator interface {
+	PropagateLogLevels(state log.LevelsState)
+}
+
+type setLogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// SetLogLevelPropagator sets the propagator used to apply log level updates
+// cluster-wide when the request has a 'cluster=true' query.
+func (s *Server) SetLogLevelPropagator(propagator LogLevelPropagator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logLevelPropagator = propagator
+}
+
+func (s *Server) getLogLevelRoute(c *gin.Context) {
+	c.JSON(http.StatusOK, s.logger.Levels().State())
+}
+
+// setLogLevelRoute updates the minimum level to log for subsystems without an
+// override.
+func (s *Server) setLogLevelRoute(c *gin.Context) {
+	var req setLogLevelRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+
+	propagator, ok := s.logLevelPropagatorOrUnavailable(c)
+	if !ok {
+		return
+	}
+
+	if err := s.logger.Levels().SetLevel(req.Level); err != nil {
+		c.JSON(http.StatusBadRequest, errorMessage{Error: err.Error()})
+		return
+	}
+
+	s.logger.Info("updated log level", zap.String("level", req.Level))
+
+	s.onLogLevelsUpdate(c, propagator)
+}
+
+// setSubsystemLogLevelRoute overrides the minimum level to log for a
+// subsystem.
+func (s *Server) setSubsystemLogLevelRoute(c *gin.Context) {
+	subsystem := c.Param("subsystem")
+
+	var req setLogLevelRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+
+	propagator, ok := s.logLevelPropagatorOrUnavailable(c)
+	if !ok {
+		return
+	}
+
+	if err := s.logger.Levels().SetSubsystemLevel(subsystem, req.Level); err != nil {
+		c.JSON(http.StatusBadRequest, errorMessage{Error: err.Error()})
+		return
+	}
+
+	s.logger.Info(
+		"updated subsystem log level",
+		zap.String("log-subsystem", subsystem),
+		zap.String("level", req.Level),
+	)
+
+	s.onLogLevelsUpdate(c, propagator)
+}
+
+// resetSubsystemLogLevelRoute removes the override for a subsystem.
+func (s *Server) resetSubsystemLogLevelRoute(c *gin.Context) {
+	subsystem := c.Param("subsystem")
+
+	propagator, ok := s.logLevelPropagatorOrUnavailable(c)
+	if !ok {
+		return
+	}
+
+	s.logger.Levels().ResetSubsystemLevel(subsystem)
+
+	s.logger.Info(
+		"reset subsystem log level",
+		zap.String("log-subsystem", subsystem),
+	)
+
+	s.onLogLevelsUpdate(c, propagator)
+}
+
+// logLevelPropagatorOrUnavailable returns the propagator if the request has
+// a 'cluster=true' query, or nil if the update only applies to the local
+// node.
+//
+// This must be checked before updating any levels, so a request that fails
+// with 503 because the cluster is unavailable doesn't still update the local
+// levels.
+func (s *Server) logLevelPropagatorOrUnavailable(c *gin.Context) (LogLevelPropagator, bool) {
+	if c.Query("cluster") != "true" {
+		return nil, true
+	}
+
+	s.mu.Lock()
+	propagator := s.logLevelPropagator
+	s.mu.Unlock()
+
+	if propagator == nil {
+		c.JSON(http.StatusServiceUnavailable, errorMessage{
+			Error: "cluster not available",
+		})
+		return nil, false
+	}
+	return propagator, true
+}
+
+// onLogLevelsUpdate propagates the updated levels if the propagator is set
+// and responds with the current levels.
+func (s *Server) onLogLevelsUpdate(c *gin.Context, propagator LogLevelPropagator) {
+	state := s.logger.Levels().State()
+	if propagator != nil {
+		propagator.PropagateLogLevels(state)
+	}
+	c.JSON(http.StatusOK, state)
+}
@@ -0,0 +1,131 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+type fakeLogLevelPropagator struct {
+	states []log.LevelsState
+}
+
+func (p *fakeLogLevelPropagator) PropagateLogLevels(state log.LevelsState) {
+	p.states = append(p.states, state)
+}
+
+func TestServer_LogLevel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	logger, err := log.NewLogger("info", []string{"gossip"})
+	require.NoError(t, err)
+
+	s := NewServer(nil, nil, nil, nil, nil, logger)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	propagator := &fakeLogLevelPropagator{}
+	s.SetLogLevelPropagator(propagator)
+
+	send := func(method string, path string, body string) (int, log.LevelsState) {
+		url := fmt.Sprintf("http://%s%s", ln.Addr().String(), path)
+		req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var state log.LevelsState
+		_ = json.NewDecoder(resp.Body).Decode(&state)
+		return resp.StatusCode, state
+	}
+
+	t.Run("get", func(t *testing.T) {
+		code, state := send(http.MethodGet, "/_piko/v1/log/level", "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "info", state.Level)
+		assert.Equal(t, map[string]string{"gossip": "debug"}, state.Subsystems)
+	})
+
+	t.Run("set level", func(t *testing.T) {
+		code, state := send(
+			http.MethodPut, "/_piko/v1/log/level", `{"level": "warn"}`,
+		)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "warn", state.Level)
+		assert.Equal(t, "warn", logger.Levels().Level())
+
+		assert.Empty(t, propagator.states)
+	})
+
+	t.Run("set invalid level", func(t *testing.T) {
+		code, _ := send(
+			http.MethodPut, "/_piko/v1/log/level", `{"level": "unknown"}`,
+		)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, "warn", logger.Levels().Level())
+	})
+
+	t.Run("set subsystem level", func(t *testing.T) {
+		code, state := send(
+			http.MethodPut, "/_piko/v1/log/level/proxy", `{"level": "debug"}`,
+		)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, map[string]string{
+			"gossip": "debug",
+			"proxy":  "debug",
+		}, state.Subsystems)
+	})
+
+	t.Run("reset subsystem level", func(t *testing.T) {
+		code, state := send(
+			http.MethodDelete, "/_piko/v1/log/level/gossip", "",
+		)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, map[string]string{"proxy": "debug"}, state.Subsystems)
+	})
+
+	t.Run("propagate", func(t *testing.T) {
+		code, state := send(
+			http.MethodPut, "/_piko/v1/log/level?cluster=true", `{"level": "error"}`,
+		)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []log.LevelsState{state}, propagator.states)
+	})
+
+	t.Run("cluster not available", func(t *testing.T) {
+		s.SetLogLevelPropagator(nil)
+		defer s.SetLogLevelPropagator(propagator)
+
+		before := logger.Levels().State()
+
+		code, _ := send(
+			http.MethodPut, "/_piko/v1/log/level?cluster=true", `{"level": "debug"}`,
+		)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		code, _ = send(
+			http.MethodPut, "/_piko/v1/log/level/proxy?cluster=true", `{"level": "warn"}`,
+		)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		code, _ = send(
+			http.MethodDelete, "/_piko/v1/log/level/proxy?cluster=true", "",
+		)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+
+		// The levels must be unchanged when the update couldn't be
+		// propagated.
+		assert.Equal(t, before, logger.Levels().State())
+	})
+}
@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// MetricsServer is a HTTP server exposing only '/metrics', so Prometheus can
+// scrape metrics using its own listener, TLS and authentication independent
+// of the admin API.
+type MetricsServer struct {
+	httpServer *http.Server
+
+	logger log.Logger
+}
+
+// NewMetricsServer creates a metrics server for the given registry.
+//
+// If username is set, requests must authenticate using HTTP basic
+// authentication with the given username and password.
+func NewMetricsServer(
+	registry *prometheus.Registry,
+	username string,
+	password string,
+	tlsConfig *tls.Config,
+	logger log.Logger,
+) *MetricsServer {
+	logger = logger.WithSubsystem("admin.metrics")
+
+	router := gin.New()
+	server := &MetricsServer{
+		httpServer: &http.Server{
+			Handler:   router,
+			TLSConfig: tlsConfig,
+			ErrorLog:  logger.StdLogger(zapcore.WarnLevel),
+		},
+		logger: logger,
+	}
+
+	if username != "" {
+		router.Use(gin.BasicAuthForRealm(gin.Accounts{
+			username: password,
+		}, "piko"))
+	}
+
+	h := promhttp.HandlerFor(
+		registry,
+		promhttp.HandlerOpts{
+			Registry: registry,
+			// Exemplars are only exposed in the OpenMetrics format.
+			EnableOpenMetrics: true,
+		},
+	)
+	router.GET("/metrics", gin.WrapH(h))
+
+	return server
+}
+
+func (s *MetricsServer) Serve(ln net.Listener) error {
+	s.logger.Info(
+		"starting metrics server",
+		zap.String("addr", ln.Addr().String()),
+	)
+
+	var err error
+	if s.httpServer.TLSConfig != nil {
+		err = s.httpServer.ServeTLS(ln, "", "")
+	} else {
+		err = s.httpServer.Serve(ln)
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("http serve: %w", err)
+	}
+	return nil
+}
+
+func (s *MetricsServer) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestMetricsServer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "test_total",
+	})
+	registry.MustRegister(counter)
+
+	serve := func(t *testing.T, username, password string) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewMetricsServer(registry, username, password, nil, log.NewNopLogger())
+		go func() {
+			assert.NoError(t, s.Serve(ln))
+		}()
+		t.Cleanup(func() {
+			_ = s.Shutdown(context.TODO())
+		})
+
+		return fmt.Sprintf("http://%s", ln.Addr().String())
+	}
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		addr := serve(t, "", "")
+
+		resp, err := http.Get(addr + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// Only metrics are exposed.
+		resp, err = http.Get(addr + "/status/cluster/nodes")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("basic auth", func(t *testing.T) {
+		addr := serve(t, "prometheus", "my-password")
+
+		resp, err := http.Get(addr + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		req, err := http.NewRequest(http.MethodGet, addr+"/metrics", nil)
+		require.NoError(t, err)
+		req.SetBasicAuth("prometheus", "wrong")
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		req.SetBasicAuth("prometheus", "my-password")
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
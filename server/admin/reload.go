@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Reloader reloads the node configuration.
+type Reloader interface {
+	Reload() error
+}
+
+// SetReloader sets the reloader used to reload the node configuration.
+func (s *Server) SetReloader(reloader Reloader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloader = reloader
+}
+
+// reloadConfigRoute reloads the node configuration. Only configuration that
+// supports reloading is applied, such as the auth configuration.
+func (s *Server) reloadConfigRoute(c *gin.Context) {
+	s.mu.Lock()
+	reloader := s.reloader
+	s.mu.Unlock()
+
+	if reloader == nil {
+		c.JSON(
+			http.StatusServiceUnavailable,
+			errorMessage{Error: "reload not supported"},
+		)
+		return
+	}
+
+	if err := reloader.Reload(); err != nil {
+		s.logger.Warn("failed to reload config", zap.Error(err))
+		c.JSON(http.StatusBadRequest, errorMessage{Error: err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
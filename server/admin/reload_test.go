@@ -0,0 +1,63 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+type fakeReloader struct {
+	err     error
+	reloads int
+}
+
+func (r *fakeReloader) Reload() error {
+	r.reloads++
+	return r.err
+}
+
+func TestServer_ReloadConfig(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer(nil, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	reload := func() int {
+		url := fmt.Sprintf("http://%s/_piko/v1/config/reload", ln.Addr().String())
+		resp, err := http.Post(url, "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("no reloader", func(t *testing.T) {
+		assert.Equal(t, http.StatusServiceUnavailable, reload())
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		reloader := &fakeReloader{}
+		s.SetReloader(reloader)
+
+		assert.Equal(t, http.StatusOK, reload())
+		assert.Equal(t, 1, reloader.reloads)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		reloader := &fakeReloader{err: errors.New("invalid config")}
+		s.SetReloader(reloader)
+
+		assert.Equal(t, http.StatusBadRequest, reload())
+	})
+}
@@ -0,0 +1,49 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+// RouteResolver resolves the upstream requests to an endpoint would be
+// routed to.
+type RouteResolver interface {
+	Resolve(endpointID string) *upstream.Route
+}
+
+// SetRouteResolver sets the resolver used to debug request routing.
+func (s *Server) SetRouteResolver(resolver RouteResolver) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routeResolver = resolver
+}
+
+// resolveRouteRoute returns the upstream a request to the endpoint given by
+// the 'endpoint' query would be routed to right now, along with the
+// candidates that were considered and why candidates were excluded.
+//
+// This is a dry run, so doesn't send a request or affect load balancing.
+func (s *Server) resolveRouteRoute(c *gin.Context) {
+	s.mu.Lock()
+	resolver := s.routeResolver
+	s.mu.Unlock()
+
+	if resolver == nil {
+		c.JSON(
+			http.StatusServiceUnavailable,
+			errorMessage{Error: "routing not available"},
+		)
+		return
+	}
+
+	endpointID := upstream.NormalizeEndpointID(c.Query("endpoint"))
+	if endpointID == "" {
+		c.JSON(http.StatusBadRequest, errorMessage{Error: "missing endpoint"})
+		return
+	}
+
+	c.JSON(http.StatusOK, resolver.Resolve(endpointID))
+}
@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+type fakeRouteResolver struct {
+}
+
+func (r *fakeRouteResolver) Resolve(endpointID string) *upstream.Route {
+	return &upstream.Route{
+		EndpointID: endpointID,
+		Reason:     "no upstream available",
+	}
+}
+
+func TestServer_ResolveRoute(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer(nil, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	resolve := func(query string) *http.Response {
+		url := fmt.Sprintf("http://%s/_piko/v1/routing/resolve%s", ln.Addr().String(), query)
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("no resolver", func(t *testing.T) {
+		resp := resolve("?endpoint=my-endpoint")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	})
+
+	s.SetRouteResolver(&fakeRouteResolver{})
+
+	t.Run("ok", func(t *testing.T) {
+		resp := resolve("?endpoint=my-endpoint")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var route upstream.Route
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&route))
+		assert.Equal(t, "my-endpoint", route.EndpointID)
+		assert.Equal(t, "no upstream available", route.Reason)
+	})
+
+	t.Run("missing endpoint", func(t *testing.T) {
+		resp := resolve("")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
@@ -3,10 +3,14 @@ package admin
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,10 +20,20 @@ import (
 	"go.uber.org/zap/zapcore"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/audit"
+	"github.com/andydunstall/piko/server/auth"
 	"github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/server/status"
 )
 
+var (
+	errMissingAuthorization = errors.New("missing authorization")
+	errUnsupportedAuthType  = errors.New("unsupported auth type")
+	errInvalidToken         = errors.New("invalid token")
+	errInvalidTokenType     = errors.New("invalid token type")
+	errExpiredToken         = errors.New("expired token")
+)
+
 // Server is the admin HTTP server, which exposes endpoints for metrics, health
 // and inspecting the node status.
 type Server struct {
@@ -29,18 +43,70 @@ type Server struct {
 
 	registry *prometheus.Registry
 
+	// verifier verifies the admin token required for the dashboard and
+	// mutating requests, and identifies the actor of audited requests. May
+	// be nil to disable authentication.
+	verifier auth.Verifier
+
+	// auditor records mutating admin requests. May be nil.
+	auditor audit.Auditor
+
 	proxy *ReverseProxy
 
+	// logLevelPropagator propagates log level updates cluster-wide. May be
+	// nil.
+	logLevelPropagator LogLevelPropagator
+
+	// reloader reloads the node configuration. May be nil.
+	reloader Reloader
+
+	// zoneDrainer drains the nodes in a zone cluster-wide. May be nil.
+	zoneDrainer ZoneDrainer
+
+	// catalogueEditor modifies the endpoint catalogue. May be nil.
+	catalogueEditor CatalogueEditor
+
+	// shutdowner shuts down the node. May be nil.
+	shutdowner Shutdowner
+
+	// routeResolver resolves how requests to an endpoint are routed. May be
+	// nil.
+	routeResolver RouteResolver
+
+	// federationGateway exports endpoints to federated clusters. May be
+	// nil.
+	federationGateway FederationGateway
+
+	// connHistory records upstream connection events on the local node. May
+	// be nil.
+	connHistory ConnHistory
+
+	// gossipState contains the gossip state of the local node. May be nil.
+	gossipState GossipState
+
+	// lastGossipDump is the time the gossip state was last dumped, used to
+	// throttle dumps.
+	lastGossipDump time.Time
+
+	// mu protects the above fields.
+	mu sync.Mutex
+
 	httpServer *http.Server
 
 	router *gin.Engine
 
+	// shutdownCh is closed when the server is shutdown to close active
+	// watch streams.
+	shutdownCh chan struct{}
+
 	logger log.Logger
 }
 
 func NewServer(
 	clusterState *cluster.State,
 	registry *prometheus.Registry,
+	verifier auth.Verifier,
+	auditor audit.Auditor,
 	tlsConfig *tls.Config,
 	logger log.Logger,
 ) *Server {
@@ -51,14 +117,17 @@ func NewServer(
 		clusterState: clusterState,
 		ready:        atomic.NewBool(false),
 		registry:     registry,
+		verifier:     verifier,
+		auditor:      auditor,
 		proxy:        NewReverseProxy(logger),
 		httpServer: &http.Server{
 			Handler:   router,
 			TLSConfig: tlsConfig,
 			ErrorLog:  logger.StdLogger(zapcore.WarnLevel),
 		},
-		router: router,
-		logger: logger,
+		router:     router,
+		shutdownCh: make(chan struct{}),
+		logger:     logger,
 	}
 
 	// Recover from panics.
@@ -68,6 +137,15 @@ func NewServer(
 		router.Use(server.forwardInterceptor)
 	}
 
+	// Authenticate and audit after forwarding so requests are only
+	// authenticated and audited by the node that handles them.
+	if verifier != nil {
+		router.Use(server.authenticateRequest)
+	}
+	if auditor != nil {
+		router.Use(server.auditRequest)
+	}
+
 	server.registerRoutes(router)
 
 	return server
@@ -95,6 +173,7 @@ func (s *Server) Serve(ln net.Listener) error {
 // Shutdown attempts to gracefully shutdown the server by waiting for pending
 // requests to complete.
 func (s *Server) Shutdown(ctx context.Context) error {
+	close(s.shutdownCh)
 	return s.httpServer.Shutdown(ctx)
 }
 
@@ -107,14 +186,44 @@ func (s *Server) SetReady(ready bool) {
 	s.ready.Store(ready)
 }
 
+// Ready returns whether the node is ready to accept traffic.
+func (s *Server) Ready() bool {
+	return s.ready.Load()
+}
+
 func (s *Server) registerRoutes(router *gin.Engine) {
 	router.GET("/health", s.healthRoute)
 	router.GET("/ready", s.readyRoute)
+	router.GET("/dashboard", s.dashboardRoute)
 
 	if s.registry != nil {
 		router.GET("/metrics", s.metricsHandler())
 	}
 
+	if s.clusterState != nil {
+		router.GET("/_piko/v1/endpoints/:id/watch", s.watchEndpointRoute)
+		router.GET("/_piko/v1/endpoints/:id/availability", s.endpointAvailabilityRoute)
+		router.GET("/_piko/v1/endpoints/:id/history", s.endpointHistoryRoute)
+		router.POST("/_piko/v1/cluster/drain", s.drainZoneRoute)
+		router.GET("/_piko/v1/gossip/state", s.gossipStateRoute)
+		router.GET("/_piko/v1/gossip/diff", s.gossipDiffRoute)
+	}
+
+	router.POST("/_piko/v1/config/reload", s.reloadConfigRoute)
+	router.POST("/_piko/v1/shutdown", s.shutdownRoute)
+	router.GET("/_piko/v1/shutdown", s.shutdownProgressRoute)
+	router.GET("/_piko/v1/routing/resolve", s.resolveRouteRoute)
+	router.GET("/_piko/v1/federation/endpoints", s.federationEndpointsRoute)
+	router.PUT("/_piko/v1/catalogue/endpoints/:id", s.putCatalogueEntryRoute)
+	router.DELETE("/_piko/v1/catalogue/endpoints/:id", s.deleteCatalogueEntryRoute)
+
+	if s.logger.Levels() != nil {
+		router.GET("/_piko/v1/log/level", s.getLogLevelRoute)
+		router.PUT("/_piko/v1/log/level", s.setLogLevelRoute)
+		router.PUT("/_piko/v1/log/level/:subsystem", s.setSubsystemLogLevelRoute)
+		router.DELETE("/_piko/v1/log/level/:subsystem", s.resetSubsystemLogLevelRoute)
+	}
+
 	// From https://github.com/gin-contrib/pprof/blob/934af36b21728278339704005bcef2eec1375091/pprof.go#L32.
 	pprofGroup := s.router.Group("/debug/pprof")
 	pprofGroup.GET("/", gin.WrapF(pprof.Index))
@@ -168,6 +277,100 @@ func (s *Server) forwardInterceptor(c *gin.Context) {
 	c.Abort()
 }
 
+// auditRequest records an audit event for each mutating admin request.
+func (s *Server) auditRequest(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+
+	c.Next()
+
+	s.auditor.Record(audit.Event{
+		Type:       audit.EventTypeAdmin,
+		Listener:   "admin",
+		Action:     c.Request.Method + " " + c.Request.URL.Path,
+		Actor:      s.actor(c.Request),
+		RemoteAddr: c.Request.RemoteAddr,
+		Status:     c.Writer.Status(),
+	})
+}
+
+// authenticateRequest requires a valid admin token for the dashboard and
+// mutating admin requests. Other requests, such as health checks, metrics
+// and the status API, don't require a token.
+func (s *Server) authenticateRequest(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		if c.Request.URL.Path != "/dashboard" {
+			c.Next()
+			return
+		}
+	}
+
+	if _, err := s.verifyToken(c.Request); err != nil {
+		s.logger.Warn(
+			"admin auth failed",
+			zap.String("path", c.Request.URL.Path),
+			zap.Error(err),
+		)
+		if s.auditor != nil {
+			s.auditor.Record(audit.Event{
+				Type:       audit.EventTypeAuthFailure,
+				Listener:   "admin",
+				Action:     c.Request.Method + " " + c.Request.URL.Path,
+				RemoteAddr: c.Request.RemoteAddr,
+				Status:     http.StatusUnauthorized,
+				Reason:     err.Error(),
+			})
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, errorMessage{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	c.Next()
+}
+
+// actor returns the subject of the requests bearer token, or an empty string
+// if the request doesn't include a valid admin token.
+func (s *Server) actor(r *http.Request) string {
+	if s.verifier == nil {
+		return ""
+	}
+
+	token, err := s.verifyToken(r)
+	if err != nil {
+		return ""
+	}
+	return token.Subject
+}
+
+// verifyToken verifies the requests bearer token is a valid admin token.
+func (s *Server) verifyToken(r *http.Request) (auth.EndpointToken, error) {
+	authType, tokenString, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok {
+		return auth.EndpointToken{}, errMissingAuthorization
+	}
+	if authType != "Bearer" {
+		return auth.EndpointToken{}, errUnsupportedAuthType
+	}
+	token, err := s.verifier.VerifyEndpointToken(tokenString, auth.TokenTypeAdmin)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrInvalidTokenType):
+			return auth.EndpointToken{}, errInvalidTokenType
+		case errors.Is(err, auth.ErrExpiredToken):
+			return auth.EndpointToken{}, errExpiredToken
+		default:
+			return auth.EndpointToken{}, errInvalidToken
+		}
+	}
+	return token, nil
+}
+
 func (s *Server) panicRoute(c *gin.Context, err any) {
 	s.logger.Error(
 		"handler panic",
@@ -180,7 +383,11 @@ func (s *Server) panicRoute(c *gin.Context, err any) {
 func (s *Server) metricsHandler() gin.HandlerFunc {
 	h := promhttp.HandlerFor(
 		s.registry,
-		promhttp.HandlerOpts{Registry: s.registry},
+		promhttp.HandlerOpts{
+			Registry: s.registry,
+			// Exemplars are only exposed in the OpenMetrics format.
+			EnableOpenMetrics: true,
+		},
 	)
 	return func(c *gin.Context) {
 		h.ServeHTTP(c.Writer, c.Request)
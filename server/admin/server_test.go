@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,6 +18,8 @@ import (
 
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/testutil"
+	"github.com/andydunstall/piko/server/audit"
+	"github.com/andydunstall/piko/server/auth"
 	"github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/server/status"
 )
@@ -25,6 +29,7 @@ type fakeStatus struct {
 
 func (s *fakeStatus) Register(group *gin.RouterGroup) {
 	group.GET("/foo", s.fooRoute)
+	group.POST("/foo", s.fooRoute)
 }
 
 func (s *fakeStatus) fooRoute(c *gin.Context) {
@@ -33,6 +38,40 @@ func (s *fakeStatus) fooRoute(c *gin.Context) {
 
 var _ status.Handler = &fakeStatus{}
 
+type fakeVerifier struct {
+}
+
+func (v *fakeVerifier) VerifyEndpointToken(
+	token string,
+	tokenType auth.TokenType,
+) (auth.EndpointToken, error) {
+	if token != "123" || tokenType != auth.TokenTypeAdmin {
+		return auth.EndpointToken{}, auth.ErrInvalidToken
+	}
+	return auth.EndpointToken{Subject: "alice"}, nil
+}
+
+type fakeAuditor struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (a *fakeAuditor) Record(event audit.Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, event)
+}
+
+func (a *fakeAuditor) Events() []audit.Event {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.events
+}
+
+func (a *fakeAuditor) Close() error {
+	return nil
+}
+
 func TestServer_AdminRoutes(t *testing.T) {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
@@ -41,6 +80,8 @@ func TestServer_AdminRoutes(t *testing.T) {
 		nil,
 		prometheus.NewRegistry(),
 		nil,
+		nil,
+		nil,
 		log.NewNopLogger(),
 	)
 	go func() {
@@ -90,6 +131,16 @@ func TestServer_AdminRoutes(t *testing.T) {
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 	})
 
+	t.Run("dashboard", func(t *testing.T) {
+		url := fmt.Sprintf("http://%s/dashboard", ln.Addr().String())
+		resp, err := http.Get(url)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	})
+
 	t.Run("not found", func(t *testing.T) {
 		url := fmt.Sprintf("http://%s/foo", ln.Addr().String())
 		resp, err := http.Get(url)
@@ -108,6 +159,8 @@ func TestServer_StatusRoutes(t *testing.T) {
 		nil,
 		prometheus.NewRegistry(),
 		nil,
+		nil,
+		nil,
 		log.NewNopLogger(),
 	)
 	s.AddStatus("/mystatus", &fakeStatus{})
@@ -141,6 +194,125 @@ func TestServer_StatusRoutes(t *testing.T) {
 	})
 }
 
+func TestServer_Audit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	auditor := &fakeAuditor{}
+	s := NewServer(
+		nil,
+		prometheus.NewRegistry(),
+		&fakeVerifier{},
+		auditor,
+		nil,
+		log.NewNopLogger(),
+	)
+	s.AddStatus("/mystatus", &fakeStatus{})
+
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf("http://%s/status/mystatus/foo", ln.Addr().String())
+
+	// Non-mutating requests aren't audited.
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Empty(t, auditor.Events())
+
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer 123")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Post(url, "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// Events are recorded after the response is written.
+	require.Eventually(t, func() bool {
+		return len(auditor.Events()) == 2
+	}, time.Second, time.Millisecond)
+	events := auditor.Events()
+
+	assert.Equal(t, audit.EventTypeAdmin, events[0].Type)
+	assert.Equal(t, "admin", events[0].Listener)
+	assert.Equal(t, "POST /status/mystatus/foo", events[0].Action)
+	assert.Equal(t, "alice", events[0].Actor)
+	assert.Equal(t, http.StatusOK, events[0].Status)
+
+	// Mutating requests without a valid token are rejected.
+	assert.Equal(t, audit.EventTypeAuthFailure, events[1].Type)
+	assert.Equal(t, "admin", events[1].Listener)
+	assert.Equal(t, "", events[1].Actor)
+	assert.Equal(t, http.StatusUnauthorized, events[1].Status)
+	assert.Equal(t, "missing authorization", events[1].Reason)
+}
+
+func TestServer_Auth(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer(
+		nil,
+		prometheus.NewRegistry(),
+		&fakeVerifier{},
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	s.AddStatus("/mystatus", &fakeStatus{})
+
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	send := func(method string, path string, token string) int {
+		url := fmt.Sprintf("http://%s%s", ln.Addr().String(), path)
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("dashboard", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send(http.MethodGet, "/dashboard", "123"))
+	})
+
+	t.Run("dashboard unauthenticated", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/dashboard", ""))
+	})
+
+	t.Run("dashboard invalid token", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/dashboard", "456"))
+	})
+
+	t.Run("mutating", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send(http.MethodPost, "/status/mystatus/foo", "123"))
+	})
+
+	t.Run("mutating unauthenticated", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "/status/mystatus/foo", ""))
+		assert.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "/_piko/v1/shutdown", ""))
+	})
+
+	// Non-mutating requests don't require a token.
+	t.Run("status", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send(http.MethodGet, "/status/mystatus/foo", ""))
+		assert.Equal(t, http.StatusOK, send(http.MethodGet, "/health", ""))
+	})
+}
+
 // TestServer_Forward tests forwarding an admin request to another node
 // in the cluster.
 func TestServer_Forward(t *testing.T) {
@@ -156,6 +328,8 @@ func TestServer_Forward(t *testing.T) {
 		state1,
 		prometheus.NewRegistry(),
 		nil,
+		nil,
+		nil,
 		log.NewNopLogger(),
 	)
 	// Note only node 1 registers the status route.
@@ -182,6 +356,8 @@ func TestServer_Forward(t *testing.T) {
 		state2,
 		prometheus.NewRegistry(),
 		nil,
+		nil,
+		nil,
 		log.NewNopLogger(),
 	)
 
@@ -227,6 +403,8 @@ func TestServer_TLS(t *testing.T) {
 	s := NewServer(
 		nil,
 		prometheus.NewRegistry(),
+		nil,
+		nil,
 		tlsConfig,
 		log.NewNopLogger(),
 	)
@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Shutdowner shuts down the node.
+type Shutdowner interface {
+	// RequestShutdown gracefully shuts down the node with the given grace
+	// period. If the node is already shutting down, the remaining grace
+	// period is shortened to the given grace period.
+	RequestShutdown(grace time.Duration)
+
+	// ShutdownProgress returns the progress of the active shutdown.
+	ShutdownProgress() *ShutdownProgress
+}
+
+// ShutdownProgress describes the progress of draining the node during a
+// graceful shutdown, so an orchestrator can distinguish a healthy drain from
+// a hung one before the grace period expires.
+type ShutdownProgress struct {
+	// ShuttingDown indicates whether the node is shutting down. If false,
+	// the other fields are unset.
+	ShuttingDown bool `json:"shutting_down"`
+
+	// Phase is the current step of the shutdown.
+	Phase string `json:"phase,omitempty"`
+
+	// Started is when the shutdown started.
+	Started *time.Time `json:"started,omitempty"`
+
+	// Deadline is when the grace period expires.
+	Deadline *time.Time `json:"deadline,omitempty"`
+
+	// Upstreams is the number of upstream connections that haven't yet
+	// been closed.
+	Upstreams int `json:"upstreams"`
+
+	// InflightRequests is the number of in-flight proxy requests.
+	InflightRequests int64 `json:"inflight_requests"`
+
+	// TCPConns is the number of open proxied TCP connections.
+	TCPConns int64 `json:"tcp_conns"`
+
+	// EstimatedCompletion is when the remaining upstreams, requests and
+	// connections are expected to be drained, based on the rate they've
+	// drained since the shutdown started, or nil if the rate is unknown.
+	EstimatedCompletion *time.Time `json:"estimated_completion,omitempty"`
+}
+
+type shutdownResponse struct {
+	// Grace is the grace period of the shutdown.
+	Grace string `json:"grace"`
+}
+
+// SetShutdowner sets the shutdowner used to shutdown the node.
+func (s *Server) SetShutdowner(shutdowner Shutdowner) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdowner = shutdowner
+}
+
+// shutdownRoute initiates a graceful shutdown of the node, with the grace
+// period given by the 'grace' query, such as '10s'.
+//
+// The shutdown happens in the background, so the route responds once the
+// shutdown is requested rather than waiting for the node to shutdown.
+func (s *Server) shutdownRoute(c *gin.Context) {
+	s.mu.Lock()
+	shutdowner := s.shutdowner
+	s.mu.Unlock()
+
+	if shutdowner == nil {
+		c.JSON(
+			http.StatusServiceUnavailable,
+			errorMessage{Error: "shutdown not supported"},
+		)
+		return
+	}
+
+	graceParam := c.Query("grace")
+	if graceParam == "" {
+		c.JSON(
+			http.StatusBadRequest,
+			errorMessage{Error: "missing grace"},
+		)
+		return
+	}
+	grace, err := time.ParseDuration(graceParam)
+	if err != nil || grace < 0 {
+		c.JSON(
+			http.StatusBadRequest,
+			errorMessage{Error: "invalid grace"},
+		)
+		return
+	}
+
+	s.logger.Info("shutdown requested", zap.Duration("grace", grace))
+
+	// The admin server is shutdown last, so the response is sent before the
+	// node stops accepting admin requests.
+	shutdowner.RequestShutdown(grace)
+
+	c.JSON(http.StatusAccepted, shutdownResponse{Grace: grace.String()})
+}
+
+// shutdownProgressRoute returns the progress of the active shutdown.
+func (s *Server) shutdownProgressRoute(c *gin.Context) {
+	s.mu.Lock()
+	shutdowner := s.shutdowner
+	s.mu.Unlock()
+
+	if shutdowner == nil {
+		c.JSON(
+			http.StatusServiceUnavailable,
+			errorMessage{Error: "shutdown not supported"},
+		)
+		return
+	}
+
+	c.JSON(http.StatusOK, shutdowner.ShutdownProgress())
+}
@@ -0,0 +1,135 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+type fakeShutdowner struct {
+	graces   []time.Duration
+	progress *ShutdownProgress
+}
+
+func (s *fakeShutdowner) RequestShutdown(grace time.Duration) {
+	s.graces = append(s.graces, grace)
+}
+
+func (s *fakeShutdowner) ShutdownProgress() *ShutdownProgress {
+	if s.progress == nil {
+		return &ShutdownProgress{}
+	}
+	return s.progress
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer(nil, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	shutdown := func(query string) int {
+		url := fmt.Sprintf("http://%s/_piko/v1/shutdown%s", ln.Addr().String(), query)
+		resp, err := http.Post(url, "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("no shutdowner", func(t *testing.T) {
+		assert.Equal(t, http.StatusServiceUnavailable, shutdown("?grace=10s"))
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		shutdowner := &fakeShutdowner{}
+		s.SetShutdowner(shutdowner)
+
+		assert.Equal(t, http.StatusAccepted, shutdown("?grace=10s"))
+		assert.Equal(t, http.StatusAccepted, shutdown("?grace=0s"))
+		assert.Equal(t, []time.Duration{time.Second * 10, 0}, shutdowner.graces)
+	})
+
+	t.Run("invalid grace", func(t *testing.T) {
+		shutdowner := &fakeShutdowner{}
+		s.SetShutdowner(shutdowner)
+
+		assert.Equal(t, http.StatusBadRequest, shutdown(""))
+		assert.Equal(t, http.StatusBadRequest, shutdown("?grace=foo"))
+		assert.Equal(t, http.StatusBadRequest, shutdown("?grace=-1s"))
+		assert.Empty(t, shutdowner.graces)
+	})
+}
+
+func TestServer_ShutdownProgress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer(nil, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	progress := func() (int, *ShutdownProgress) {
+		url := fmt.Sprintf("http://%s/_piko/v1/shutdown", ln.Addr().String())
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var progress ShutdownProgress
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&progress))
+		return resp.StatusCode, &progress
+	}
+
+	t.Run("no shutdowner", func(t *testing.T) {
+		status, _ := progress()
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+	})
+
+	t.Run("not shutting down", func(t *testing.T) {
+		s.SetShutdowner(&fakeShutdowner{})
+
+		status, p := progress()
+		assert.Equal(t, http.StatusOK, status)
+		assert.False(t, p.ShuttingDown)
+		assert.Nil(t, p.Started)
+	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		started := time.Now().Add(-time.Second).UTC().Truncate(time.Second)
+		deadline := started.Add(time.Minute)
+		s.SetShutdowner(&fakeShutdowner{
+			progress: &ShutdownProgress{
+				ShuttingDown:     true,
+				Phase:            "closing upstreams",
+				Started:          &started,
+				Deadline:         &deadline,
+				Upstreams:        3,
+				InflightRequests: 5,
+			},
+		})
+
+		status, p := progress()
+		assert.Equal(t, http.StatusOK, status)
+		assert.True(t, p.ShuttingDown)
+		assert.Equal(t, "closing upstreams", p.Phase)
+		assert.Equal(t, started, p.Started.UTC())
+		assert.Equal(t, deadline, p.Deadline.UTC())
+		assert.Equal(t, 3, p.Upstreams)
+		assert.Equal(t, int64(5), p.InflightRequests)
+		assert.Nil(t, p.EstimatedCompletion)
+	})
+}
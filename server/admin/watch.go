@@ -0,0 +1,108 @@
+package admin
+
+import (
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+const (
+	// watchKeepaliveInterval is the interval to send keepalive comments on
+	// watch streams, to avoid idle connections being closed by proxies and
+	// load balancers.
+	watchKeepaliveInterval = time.Second * 15
+)
+
+const (
+	// endpointEventAvailable is sent when the endpoint becomes available
+	// (upstreams 0→N).
+	endpointEventAvailable = "available"
+	// endpointEventUnavailable is sent when the endpoint becomes unavailable
+	// (upstreams N→0).
+	endpointEventUnavailable = "unavailable"
+	// endpointEventUpdate is sent when an available endpoint's upstreams
+	// change, such as the number of upstreams or the nodes the upstreams are
+	// connected to.
+	endpointEventUpdate = "update"
+)
+
+// watchEndpointRoute streams the availability of an endpoint across the
+// cluster as server-sent events.
+//
+// The stream starts with an 'available' or 'unavailable' event containing the
+// current availability, then sends an event for each availability
+// transition. Each event contains the endpoint encoded as JSON.
+func (s *Server) watchEndpointRoute(c *gin.Context) {
+	endpointID := upstream.NormalizeEndpointID(c.Param("id"))
+
+	// Start watching before getting the current availability to avoid
+	// missing updates.
+	w := s.clusterState.WatchEndpoints(endpointID)
+	defer w.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	var last *cluster.Endpoint
+	send := func(endpoint *cluster.Endpoint) {
+		event, ok := endpointTransition(last, endpoint)
+		if !ok {
+			return
+		}
+		c.SSEvent(event, endpoint)
+		last = endpoint
+	}
+
+	send(s.clusterState.Endpoint(endpointID))
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(watchKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.Notify():
+			for _, endpoint := range w.Updates() {
+				send(endpoint)
+			}
+			c.Writer.Flush()
+		case <-ticker.C:
+			if _, err := c.Writer.WriteString(": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// endpointTransition returns the event to send when the endpoint availability
+// changes from prev to next, or false if there is no change to send.
+//
+// prev is nil if no event has been sent yet.
+func endpointTransition(prev *cluster.Endpoint, next *cluster.Endpoint) (string, bool) {
+	switch {
+	case prev == nil && next.Available():
+		return endpointEventAvailable, true
+	case prev == nil:
+		return endpointEventUnavailable, true
+	case !prev.Available() && next.Available():
+		return endpointEventAvailable, true
+	case prev.Available() && !next.Available():
+		return endpointEventUnavailable, true
+	case next.Available() && !maps.Equal(prev.Nodes, next.Nodes):
+		return endpointEventUpdate, true
+	default:
+		return "", false
+	}
+}
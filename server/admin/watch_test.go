@@ -0,0 +1,165 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+type endpointEvent struct {
+	Event    string
+	Endpoint cluster.Endpoint
+}
+
+// readEndpointEvent reads the next server-sent event from the stream.
+func readEndpointEvent(t *testing.T, r *bufio.Reader) endpointEvent {
+	var event endpointEvent
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if event.Event != "" {
+				return event
+			}
+		case strings.HasPrefix(line, "event:"):
+			event.Event = strings.TrimPrefix(line, "event:")
+		case strings.HasPrefix(line, "data:"):
+			require.NoError(t, json.Unmarshal(
+				[]byte(strings.TrimPrefix(line, "data:")), &event.Endpoint,
+			))
+		}
+	}
+}
+
+func TestServer_WatchEndpoint(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	clusterState := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	clusterState.AddNode(&cluster.Node{
+		ID:     "remote",
+		Status: cluster.NodeStatusActive,
+	})
+
+	s := NewServer(
+		clusterState,
+		prometheus.NewRegistry(),
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	go func() {
+		assert.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf(
+		"http://%s/_piko/v1/endpoints/my-endpoint/watch", ln.Addr().String(),
+	)
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+
+	// The stream starts with the current availability.
+	assert.Equal(t, endpointEvent{
+		Event: "unavailable",
+		Endpoint: cluster.Endpoint{
+			ID: "my-endpoint",
+		},
+	}, readEndpointEvent(t, r))
+
+	clusterState.AddLocalEndpoint("my-endpoint")
+	assert.Equal(t, endpointEvent{
+		Event: "available",
+		Endpoint: cluster.Endpoint{
+			ID:        "my-endpoint",
+			Upstreams: 1,
+			Nodes:     map[string]int{"local": 1},
+		},
+	}, readEndpointEvent(t, r))
+
+	// Updates on other endpoints are ignored.
+	clusterState.AddLocalEndpoint("other-endpoint")
+
+	clusterState.UpdateRemoteEndpoint("remote", "my-endpoint", 2)
+	assert.Equal(t, endpointEvent{
+		Event: "update",
+		Endpoint: cluster.Endpoint{
+			ID:        "my-endpoint",
+			Upstreams: 3,
+			Nodes:     map[string]int{"local": 1, "remote": 2},
+		},
+	}, readEndpointEvent(t, r))
+
+	clusterState.RemoveRemoteEndpoint("remote", "my-endpoint")
+	clusterState.RemoveLocalEndpoint("my-endpoint")
+	// The update and unavailable transitions may be coalesced, so skip
+	// any update.
+	event := readEndpointEvent(t, r)
+	if event.Event == "update" {
+		event = readEndpointEvent(t, r)
+	}
+	assert.Equal(t, endpointEvent{
+		Event: "unavailable",
+		Endpoint: cluster.Endpoint{
+			ID: "my-endpoint",
+		},
+	}, event)
+}
+
+func TestEndpointTransition(t *testing.T) {
+	unavailable := &cluster.Endpoint{ID: "my-endpoint"}
+	available := &cluster.Endpoint{
+		ID:        "my-endpoint",
+		Upstreams: 1,
+		Nodes:     map[string]int{"node-1": 1},
+	}
+	moved := &cluster.Endpoint{
+		ID:        "my-endpoint",
+		Upstreams: 1,
+		Nodes:     map[string]int{"node-2": 1},
+	}
+
+	tests := []struct {
+		prev  *cluster.Endpoint
+		next  *cluster.Endpoint
+		event string
+		ok    bool
+	}{
+		{nil, unavailable, "unavailable", true},
+		{nil, available, "available", true},
+		{unavailable, available, "available", true},
+		{available, unavailable, "unavailable", true},
+		{available, moved, "update", true},
+		{available, available, "", false},
+		{unavailable, unavailable, "", false},
+	}
+	for _, tt := range tests {
+		event, ok := endpointTransition(tt.prev, tt.next)
+		assert.Equal(t, tt.event, event)
+		assert.Equal(t, tt.ok, ok)
+	}
+}
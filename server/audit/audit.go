@@ -0,0 +1,120 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+const (
+	// EventTypeAdmin is the event type of a mutating admin API request.
+	EventTypeAdmin = "admin"
+
+	// EventTypeAuthFailure is the event type of a failed authentication.
+	EventTypeAuthFailure = "auth_failure"
+)
+
+// Event is an audit event.
+type Event struct {
+	Time time.Time `json:"time"`
+
+	// Type is the event type, either 'admin' or 'auth_failure'.
+	Type string `json:"type"`
+
+	// NodeID is the ID of the node that recorded the event.
+	NodeID string `json:"node_id"`
+
+	// Listener is the listener that received the request, such as 'admin'
+	// or 'upstream'.
+	Listener string `json:"listener"`
+
+	// Action describes the request, such as 'POST /status/gossip/compact'.
+	Action string `json:"action"`
+
+	// Actor is the subject of the verified token that made the request, or
+	// empty if the request wasn't authenticated.
+	Actor string `json:"actor,omitempty"`
+
+	// RemoteAddr is the address of the client that made the request.
+	RemoteAddr string `json:"remote_addr"`
+
+	// Status is the HTTP status code of the response.
+	Status int `json:"status,omitempty"`
+
+	// Reason describes why authentication failed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Auditor records audit events.
+type Auditor interface {
+	// Record records the given event. The event time and node ID are set
+	// by the auditor.
+	Record(event Event)
+
+	// Close flushes any pending events.
+	Close() error
+}
+
+// New returns an auditor that records events to the configured file and
+// webhook, or nil if auditing is disabled.
+func New(conf Config, nodeID string, logger log.Logger) (Auditor, error) {
+	if !conf.Enabled() {
+		return nil, nil
+	}
+
+	logger = logger.WithSubsystem("audit")
+
+	var auditors multiAuditor
+	if conf.Path != "" {
+		fileAuditor, err := NewFileAuditor(conf.Path)
+		if err != nil {
+			return nil, fmt.Errorf("file: %w", err)
+		}
+		auditors = append(auditors, fileAuditor)
+	}
+	if conf.WebhookURL != "" {
+		auditors = append(auditors, NewWebhookAuditor(
+			conf.WebhookURL, conf.WebhookTimeout, logger,
+		))
+	}
+	return &nodeAuditor{
+		nodeID:  nodeID,
+		auditor: auditors,
+	}, nil
+}
+
+// nodeAuditor sets the time and node ID of each event.
+type nodeAuditor struct {
+	nodeID  string
+	auditor Auditor
+}
+
+func (a *nodeAuditor) Record(event Event) {
+	event.Time = time.Now()
+	event.NodeID = a.nodeID
+	a.auditor.Record(event)
+}
+
+func (a *nodeAuditor) Close() error {
+	return a.auditor.Close()
+}
+
+type multiAuditor []Auditor
+
+func (a multiAuditor) Record(event Event) {
+	for _, auditor := range a {
+		auditor.Record(event)
+	}
+}
+
+func (a multiAuditor) Close() error {
+	var errs []error
+	for _, auditor := range a {
+		if err := auditor.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
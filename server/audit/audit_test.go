@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestAuditor_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// Write an existing event to verify the auditor appends to the file.
+	require.NoError(t, os.WriteFile(path, []byte(`{"type":"admin"}`+"\n"), 0o600))
+
+	auditor, err := New(Config{Path: path}, "my-node", log.NewNopLogger())
+	require.NoError(t, err)
+
+	auditor.Record(Event{
+		Type:       EventTypeAuthFailure,
+		Listener:   "upstream",
+		Action:     "GET /piko/v1/upstream/my-endpoint",
+		RemoteAddr: "10.26.104.56:5000",
+		Status:     http.StatusUnauthorized,
+		Reason:     "invalid token",
+	})
+	require.NoError(t, auditor.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	require.Len(t, events, 2)
+
+	assert.Equal(t, EventTypeAdmin, events[0].Type)
+
+	assert.Equal(t, EventTypeAuthFailure, events[1].Type)
+	assert.Equal(t, "my-node", events[1].NodeID)
+	assert.Equal(t, "invalid token", events[1].Reason)
+	assert.False(t, events[1].Time.IsZero())
+}
+
+func TestAuditor_Webhook(t *testing.T) {
+	eventCh := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodPost, r.Method)
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+			var event Event
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+			eventCh <- event
+		},
+	))
+	defer server.Close()
+
+	auditor, err := New(Config{
+		WebhookURL:     server.URL,
+		WebhookTimeout: time.Second,
+	}, "my-node", log.NewNopLogger())
+	require.NoError(t, err)
+
+	auditor.Record(Event{
+		Type:     EventTypeAdmin,
+		Listener: "admin",
+		Action:   "POST /status/gossip/compact",
+		Actor:    "alice",
+		Status:   http.StatusOK,
+	})
+	// Close waits for pending events to be sent.
+	require.NoError(t, auditor.Close())
+
+	event := <-eventCh
+	assert.Equal(t, EventTypeAdmin, event.Type)
+	assert.Equal(t, "my-node", event.NodeID)
+	assert.Equal(t, "POST /status/gossip/compact", event.Action)
+	assert.Equal(t, "alice", event.Actor)
+}
+
+func TestAuditor_Disabled(t *testing.T) {
+	auditor, err := New(Config{}, "my-node", log.NewNopLogger())
+	require.NoError(t, err)
+	assert.Nil(t, auditor)
+}
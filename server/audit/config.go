@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+type Config struct {
+	// Path is the path of the file to append audit events to.
+	//
+	// If empty, audit events are not written to a file.
+	Path string `json:"path" yaml:"path"`
+
+	// WebhookURL is the URL to POST audit events to.
+	//
+	// If empty, audit events are not sent to a webhook.
+	WebhookURL string `json:"webhook_url" yaml:"webhook_url"`
+
+	// WebhookTimeout is the timeout when sending an event to the webhook.
+	WebhookTimeout time.Duration `json:"webhook_timeout" yaml:"webhook_timeout"`
+}
+
+func (c *Config) Enabled() bool {
+	return c.Path != "" || c.WebhookURL != ""
+}
+
+func (c *Config) Validate() error {
+	if c.WebhookURL != "" && c.WebhookTimeout == 0 {
+		return fmt.Errorf("missing webhook timeout")
+	}
+	return nil
+}
+
+func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.Path,
+		"audit.path",
+		c.Path,
+		`
+Path of the file to append audit events to, formatted as JSON lines.
+
+Audit events include all mutating admin API requests and authentication
+failures on any listener.
+
+If empty, audit events are not written to a file.`,
+	)
+	fs.StringVar(
+		&c.WebhookURL,
+		"audit.webhook-url",
+		c.WebhookURL,
+		`
+URL to send audit events to. Each event is sent as a JSON encoded POST
+request.
+
+If empty, audit events are not sent to a webhook.`,
+	)
+	fs.DurationVar(
+		&c.WebhookTimeout,
+		"audit.webhook-timeout",
+		c.WebhookTimeout,
+		`
+Timeout when sending an audit event to the webhook.`,
+	)
+}
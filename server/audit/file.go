@@ -0,0 +1,52 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileAuditor appends events to a file, where each event is a JSON encoded
+// line.
+type FileAuditor struct {
+	f *os.File
+
+	mu sync.Mutex
+}
+
+func NewFileAuditor(path string) (*FileAuditor, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	return &FileAuditor{
+		f: f,
+	}, nil
+}
+
+func (a *FileAuditor) Record(event Event) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		// Event only contains JSON safe types.
+		panic("marshal event: " + err.Error())
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Write errors are ignored since there's nothing we can do. Given each
+	// event is written in a single write, a failed write won't corrupt
+	// other events.
+	_, _ = a.f.Write(b)
+}
+
+func (a *FileAuditor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.f.Close()
+}
+
+var _ Auditor = &FileAuditor{}
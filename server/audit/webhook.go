@@ -0,0 +1,115 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+const (
+	// webhookQueueSize is the maximum number of events pending to be sent to
+	// the webhook. If the queue is full new events are dropped.
+	webhookQueueSize = 1024
+)
+
+// WebhookAuditor sends each event to a webhook as a JSON encoded POST
+// request.
+//
+// Events are sent in the background to avoid blocking requests.
+type WebhookAuditor struct {
+	url string
+
+	client *http.Client
+
+	queue chan Event
+	done  chan struct{}
+
+	logger log.Logger
+}
+
+func NewWebhookAuditor(
+	url string,
+	timeout time.Duration,
+	logger log.Logger,
+) *WebhookAuditor {
+	a := &WebhookAuditor{
+		url: url,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		queue:  make(chan Event, webhookQueueSize),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+	go a.run()
+	return a
+}
+
+func (a *WebhookAuditor) Record(event Event) {
+	select {
+	case a.queue <- event:
+	default:
+		a.logger.Warn(
+			"audit webhook queue full; dropping event",
+			zap.String("type", event.Type),
+			zap.String("action", event.Action),
+		)
+	}
+}
+
+// Close sends any queued events then stops the auditor.
+func (a *WebhookAuditor) Close() error {
+	close(a.queue)
+	<-a.done
+	return nil
+}
+
+func (a *WebhookAuditor) run() {
+	defer close(a.done)
+
+	for event := range a.queue {
+		if err := a.send(event); err != nil {
+			a.logger.Warn(
+				"failed to send audit event to webhook",
+				zap.String("type", event.Type),
+				zap.String("action", event.Action),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func (a *WebhookAuditor) send(event Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(
+		context.Background(), http.MethodPost, a.url, bytes.NewReader(b),
+	)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+var _ Auditor = &WebhookAuditor{}
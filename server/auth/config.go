@@ -1,6 +1,9 @@
 package auth
 
 import (
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/spf13/pflag"
 )
 
@@ -26,12 +29,65 @@ type Config struct {
 	//
 	// If not given the 'iss' claim will be ignored.
 	TokenIssuer string `json:"token_issuer" yaml:"token_issuer"`
+
+	// RequireTokenType indicates whether tokens must include a 'piko.type'
+	// claim of 'upstream', 'proxy' or 'admin'.
+	//
+	// If false, tokens without a type can be used with any listener.
+	RequireTokenType bool `json:"require_token_type" yaml:"require_token_type"`
+
+	// AuthenticateProxy indicates whether to authenticate proxy requests.
+	//
+	// If true, proxy requests must include a token in the
+	// 'x-piko-authorization' header that can be used as a proxy token.
+	AuthenticateProxy bool `json:"authenticate_proxy" yaml:"authenticate_proxy"`
 }
 
 func (c *Config) AuthEnabled() bool {
 	return c.TokenHMACSecretKey != "" || c.TokenRSAPublicKey != "" || c.TokenECDSAPublicKey != ""
 }
 
+func (c *Config) Validate() error {
+	if c.AuthenticateProxy && !c.AuthEnabled() {
+		return fmt.Errorf("authenticate proxy requires a token key")
+	}
+	return nil
+}
+
+// Load returns a verifier using the configured keys, or nil if auth is
+// disabled.
+func (c *Config) Load() (*JWTVerifier, error) {
+	if !c.AuthEnabled() {
+		return nil, nil
+	}
+
+	verifierConf := JWTVerifierConfig{
+		HMACSecretKey:    []byte(c.TokenHMACSecretKey),
+		Audience:         c.TokenAudience,
+		Issuer:           c.TokenIssuer,
+		RequireTokenType: c.RequireTokenType,
+	}
+	if c.TokenRSAPublicKey != "" {
+		rsaPublicKey, err := jwt.ParseRSAPublicKeyFromPEM(
+			[]byte(c.TokenRSAPublicKey),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("parse rsa public key: %w", err)
+		}
+		verifierConf.RSAPublicKey = rsaPublicKey
+	}
+	if c.TokenECDSAPublicKey != "" {
+		ecdsaPublicKey, err := jwt.ParseECPublicKeyFromPEM(
+			[]byte(c.TokenECDSAPublicKey),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("parse ecdsa public key: %w", err)
+		}
+		verifierConf.ECDSAPublicKey = ecdsaPublicKey
+	}
+	return NewJWTVerifier(verifierConf), nil
+}
+
 func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
 	fs.StringVar(
 		&c.TokenHMACSecretKey,
@@ -74,4 +130,27 @@ Issuer of endpoint connection JWT token to verify.
 If given the JWT 'iss' claim must match the given issuer. Otherwise it
 is ignored.`,
 	)
+	fs.BoolVar(
+		&c.RequireTokenType,
+		"auth.require-token-type",
+		c.RequireTokenType,
+		`
+Whether tokens must include a 'piko.type' claim of 'upstream', 'proxy' or
+'admin'.
+
+Tokens with a type can only be used with the matching listener, such as an
+upstream token can't be used to send proxy requests. If false, tokens
+without a type can be used with any listener.`,
+	)
+	fs.BoolVar(
+		&c.AuthenticateProxy,
+		"auth.authenticate-proxy",
+		c.AuthenticateProxy,
+		`
+Whether to authenticate proxy requests.
+
+If enabled, proxy requests must include a token in the 'x-piko-authorization'
+header, such as 'x-piko-authorization: Bearer <token>'. The token must be
+permitted to access the requested endpoint.`,
+	)
 }
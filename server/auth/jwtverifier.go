@@ -10,13 +10,22 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-type pikoEndpointClaims struct {
-	Endpoints []string `json:"endpoints"`
+// PikoClaims contains the Piko specific JWT claims.
+type PikoClaims struct {
+	// Type is the type of token, which restricts which listeners the token
+	// can be used with. If empty the token can be used with any listener,
+	// unless the verifier requires a token type.
+	Type TokenType `json:"type,omitempty"`
+
+	// Endpoints contains the list of endpoint IDs the token is permitted to
+	// register. If empty then all endpoints are allowed.
+	Endpoints []string `json:"endpoints,omitempty"`
 }
 
-type endpointJWTClaims struct {
+// JWTClaims contains the claims of a Piko JWT.
+type JWTClaims struct {
 	jwt.RegisteredClaims
-	Piko pikoEndpointClaims `json:"piko"`
+	Piko PikoClaims `json:"piko"`
 }
 
 type JWTVerifierConfig struct {
@@ -25,6 +34,10 @@ type JWTVerifierConfig struct {
 	ECDSAPublicKey *ecdsa.PublicKey
 	Audience       string
 	Issuer         string
+
+	// RequireTokenType indicates whether tokens must include a 'piko.type'
+	// claim. Otherwise tokens without a type can be used with any listener.
+	RequireTokenType bool
 }
 
 type JWTVerifier struct {
@@ -35,14 +48,17 @@ type JWTVerifier struct {
 	audience string
 	issuer   string
 
+	requireTokenType bool
+
 	// methods contains the valid JWT methods.
 	methods []string
 }
 
 func NewJWTVerifier(conf JWTVerifierConfig) *JWTVerifier {
 	v := &JWTVerifier{
-		audience: conf.Audience,
-		issuer:   conf.Issuer,
+		audience:         conf.Audience,
+		issuer:           conf.Issuer,
+		requireTokenType: conf.RequireTokenType,
 	}
 
 	if len(conf.HMACSecretKey) > 0 {
@@ -60,8 +76,11 @@ func NewJWTVerifier(conf JWTVerifierConfig) *JWTVerifier {
 	return v
 }
 
-func (v *JWTVerifier) VerifyEndpointToken(tokenString string) (EndpointToken, error) {
-	claims := &endpointJWTClaims{}
+func (v *JWTVerifier) VerifyEndpointToken(
+	tokenString string,
+	tokenType TokenType,
+) (EndpointToken, error) {
+	claims := &JWTClaims{}
 
 	opts := []jwt.ParserOption{
 		jwt.WithValidMethods(v.methods),
@@ -111,11 +130,24 @@ func (v *JWTVerifier) VerifyEndpointToken(tokenString string) (EndpointToken, er
 		return EndpointToken{}, ErrInvalidToken
 	}
 
+	// Tokens must not be used with a listener for another token type, such
+	// as using an upstream token to send proxy requests.
+	if claims.Piko.Type == "" && v.requireTokenType {
+		return EndpointToken{}, fmt.Errorf("%w: missing type", ErrInvalidTokenType)
+	}
+	if claims.Piko.Type != "" && claims.Piko.Type != tokenType {
+		return EndpointToken{}, fmt.Errorf(
+			"%w: %s token not permitted", ErrInvalidTokenType, claims.Piko.Type,
+		)
+	}
+
 	var expiry time.Time
 	if claims.ExpiresAt != nil {
 		expiry = claims.ExpiresAt.Time
 	}
 	return EndpointToken{
+		Type:      claims.Piko.Type,
+		Subject:   claims.Subject,
 		Expiry:    expiry,
 		Endpoints: claims.Piko.Endpoints,
 	}, nil
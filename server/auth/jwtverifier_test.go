@@ -16,11 +16,12 @@ import (
 func TestJWTVerifier_HS(t *testing.T) {
 	secretKey := generateTestHSKey(t)
 
-	endpointClaims := endpointJWTClaims{
+	endpointClaims := JWTClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "my-agent",
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
 		},
-		Piko: pikoEndpointClaims{
+		Piko: PikoClaims{
 			Endpoints: []string{"my-endpoint"},
 		},
 	}
@@ -40,9 +41,10 @@ func TestJWTVerifier_HS(t *testing.T) {
 				verifier := NewJWTVerifier(JWTVerifierConfig{
 					HMACSecretKey: secretKey,
 				})
-				parsedToken, err := verifier.VerifyEndpointToken(tokenString)
+				parsedToken, err := verifier.VerifyEndpointToken(tokenString, TokenTypeUpstream)
 				assert.NoError(t, err)
 
+				assert.Equal(t, "my-agent", parsedToken.Subject)
 				assert.Equal(t, []string{"my-endpoint"}, parsedToken.Endpoints)
 				assert.Equal(t, endpointClaims.ExpiresAt.Unix(), parsedToken.Expiry.Unix())
 			})
@@ -58,17 +60,17 @@ func TestJWTVerifier_HS(t *testing.T) {
 			HMACSecretKey: []byte("invalid key"),
 		})
 		assert.NoError(t, err)
-		_, err = verifier.VerifyEndpointToken(tokenString)
+		_, err = verifier.VerifyEndpointToken(tokenString, TokenTypeUpstream)
 		assert.Equal(t, ErrInvalidToken, err)
 	})
 }
 
 func TestJWTVerifier_RS(t *testing.T) {
-	endpointClaims := endpointJWTClaims{
+	endpointClaims := JWTClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
 		},
-		Piko: pikoEndpointClaims{
+		Piko: PikoClaims{
 			Endpoints: []string{"my-endpoint"},
 		},
 	}
@@ -89,7 +91,7 @@ func TestJWTVerifier_RS(t *testing.T) {
 				verifier := NewJWTVerifier(JWTVerifierConfig{
 					RSAPublicKey: publicKey,
 				})
-				parsedToken, err := verifier.VerifyEndpointToken(tokenString)
+				parsedToken, err := verifier.VerifyEndpointToken(tokenString, TokenTypeUpstream)
 				assert.NoError(t, err)
 
 				assert.Equal(t, []string{"my-endpoint"}, parsedToken.Endpoints)
@@ -109,17 +111,17 @@ func TestJWTVerifier_RS(t *testing.T) {
 			RSAPublicKey: publicKey,
 		})
 		assert.NoError(t, err)
-		_, err = verifier.VerifyEndpointToken(tokenString)
+		_, err = verifier.VerifyEndpointToken(tokenString, TokenTypeUpstream)
 		assert.Equal(t, ErrInvalidToken, err)
 	})
 }
 
 func TestJWTVerifier_EC(t *testing.T) {
-	endpointClaims := endpointJWTClaims{
+	endpointClaims := JWTClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
 		},
-		Piko: pikoEndpointClaims{
+		Piko: PikoClaims{
 			Endpoints: []string{"my-endpoint"},
 		},
 	}
@@ -153,7 +155,7 @@ func TestJWTVerifier_EC(t *testing.T) {
 				verifier := NewJWTVerifier(JWTVerifierConfig{
 					ECDSAPublicKey: publicKey,
 				})
-				parsedToken, err := verifier.VerifyEndpointToken(tokenString)
+				parsedToken, err := verifier.VerifyEndpointToken(tokenString, TokenTypeUpstream)
 				assert.NoError(t, err)
 
 				assert.Equal(t, []string{"my-endpoint"}, parsedToken.Endpoints)
@@ -174,7 +176,7 @@ func TestJWTVerifier_EC(t *testing.T) {
 			ECDSAPublicKey: publicKey,
 		})
 		assert.NoError(t, err)
-		_, err = verifier.VerifyEndpointToken(tokenString)
+		_, err = verifier.VerifyEndpointToken(tokenString, TokenTypeUpstream)
 		assert.Equal(t, ErrInvalidToken, err)
 	})
 }
@@ -183,12 +185,12 @@ func TestJWTVerifier_Invalid(t *testing.T) {
 	t.Run("expired", func(t *testing.T) {
 		secretKey := generateTestHSKey(t)
 
-		endpointClaims := endpointJWTClaims{
+		endpointClaims := JWTClaims{
 			RegisteredClaims: jwt.RegisteredClaims{
 				// Expires in the past.
 				ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
 			},
-			Piko: pikoEndpointClaims{
+			Piko: PikoClaims{
 				Endpoints: []string{"my-endpoint"},
 			},
 		}
@@ -200,19 +202,19 @@ func TestJWTVerifier_Invalid(t *testing.T) {
 		verifier := NewJWTVerifier(JWTVerifierConfig{
 			HMACSecretKey: secretKey,
 		})
-		_, err = verifier.VerifyEndpointToken(tokenString)
+		_, err = verifier.VerifyEndpointToken(tokenString, TokenTypeUpstream)
 		assert.Error(t, err)
 	})
 
 	t.Run("audience", func(t *testing.T) {
 		secretKey := generateTestHSKey(t)
 
-		endpointClaims := endpointJWTClaims{
+		endpointClaims := JWTClaims{
 			RegisteredClaims: jwt.RegisteredClaims{
 				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
 				Audience:  jwt.ClaimStrings([]string{"bar"}),
 			},
-			Piko: pikoEndpointClaims{
+			Piko: PikoClaims{
 				Endpoints: []string{"my-endpoint"},
 			},
 		}
@@ -225,19 +227,19 @@ func TestJWTVerifier_Invalid(t *testing.T) {
 			HMACSecretKey: secretKey,
 			Audience:      "foo",
 		})
-		_, err = verifier.VerifyEndpointToken(tokenString)
+		_, err = verifier.VerifyEndpointToken(tokenString, TokenTypeUpstream)
 		assert.Error(t, err)
 	})
 
 	t.Run("issuer", func(t *testing.T) {
 		secretKey := generateTestHSKey(t)
 
-		endpointClaims := endpointJWTClaims{
+		endpointClaims := JWTClaims{
 			RegisteredClaims: jwt.RegisteredClaims{
 				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
 				Issuer:    "bar",
 			},
-			Piko: pikoEndpointClaims{
+			Piko: PikoClaims{
 				Endpoints: []string{"my-endpoint"},
 			},
 		}
@@ -250,11 +252,67 @@ func TestJWTVerifier_Invalid(t *testing.T) {
 			HMACSecretKey: secretKey,
 			Issuer:        "foo",
 		})
-		_, err = verifier.VerifyEndpointToken(tokenString)
+		_, err = verifier.VerifyEndpointToken(tokenString, TokenTypeUpstream)
 		assert.Error(t, err)
 	})
 }
 
+func TestJWTVerifier_TokenType(t *testing.T) {
+	secretKey := generateTestHSKey(t)
+
+	sign := func(tokenType TokenType) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+			Piko: PikoClaims{
+				Type: tokenType,
+			},
+		})
+		tokenString, err := token.SignedString([]byte(secretKey))
+		require.NoError(t, err)
+		return tokenString
+	}
+
+	t.Run("matching type", func(t *testing.T) {
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			HMACSecretKey: secretKey,
+		})
+		token, err := verifier.VerifyEndpointToken(sign(TokenTypeProxy), TokenTypeProxy)
+		assert.NoError(t, err)
+		assert.Equal(t, TokenTypeProxy, token.Type)
+	})
+
+	t.Run("mismatched type", func(t *testing.T) {
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			HMACSecretKey: secretKey,
+		})
+
+		// An upstream token must not be usable to send proxy requests and
+		// vice versa.
+		_, err := verifier.VerifyEndpointToken(sign(TokenTypeUpstream), TokenTypeProxy)
+		assert.ErrorIs(t, err, ErrInvalidTokenType)
+		_, err = verifier.VerifyEndpointToken(sign(TokenTypeProxy), TokenTypeUpstream)
+		assert.ErrorIs(t, err, ErrInvalidTokenType)
+		_, err = verifier.VerifyEndpointToken(sign(TokenTypeUpstream), TokenTypeAdmin)
+		assert.ErrorIs(t, err, ErrInvalidTokenType)
+	})
+
+	t.Run("untyped", func(t *testing.T) {
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			HMACSecretKey: secretKey,
+		})
+		_, err := verifier.VerifyEndpointToken(sign(""), TokenTypeProxy)
+		assert.NoError(t, err)
+	})
+
+	t.Run("untyped require type", func(t *testing.T) {
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			HMACSecretKey:    secretKey,
+			RequireTokenType: true,
+		})
+		_, err := verifier.VerifyEndpointToken(sign(""), TokenTypeUpstream)
+		assert.ErrorIs(t, err, ErrInvalidTokenType)
+	})
+}
+
 func generateTestHSKey(t *testing.T) []byte {
 	b := make([]byte, 10)
 	_, err := rand.Read(b)
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"sync/atomic"
+)
+
+// ReloadableVerifier is a verifier whose configuration can be replaced at
+// runtime, such as to rotate the token keys.
+//
+// Replacing the verifier only affects tokens verified afterwards. Tokens
+// already verified, such as the token of a connected upstream, remain valid
+// until they expire.
+type ReloadableVerifier struct {
+	verifier atomic.Pointer[Verifier]
+}
+
+func NewReloadableVerifier(verifier Verifier) *ReloadableVerifier {
+	v := &ReloadableVerifier{}
+	v.verifier.Store(&verifier)
+	return v
+}
+
+func (v *ReloadableVerifier) VerifyEndpointToken(
+	token string,
+	tokenType TokenType,
+) (EndpointToken, error) {
+	return (*v.verifier.Load()).VerifyEndpointToken(token, tokenType)
+}
+
+// Update replaces the verifier used for subsequent tokens.
+func (v *ReloadableVerifier) Update(verifier Verifier) {
+	v.verifier.Store(&verifier)
+}
+
+var _ Verifier = &ReloadableVerifier{}
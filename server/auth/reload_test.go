@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadableVerifier(t *testing.T) {
+	claims := JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+
+	oldKey := generateTestHSKey(t)
+	oldToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(oldKey)
+	require.NoError(t, err)
+
+	newKey := generateTestHSKey(t)
+	newToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(newKey)
+	require.NoError(t, err)
+
+	v := NewReloadableVerifier(NewJWTVerifier(JWTVerifierConfig{
+		HMACSecretKey: oldKey,
+	}))
+
+	_, err = v.VerifyEndpointToken(oldToken, TokenTypeUpstream)
+	assert.NoError(t, err)
+	_, err = v.VerifyEndpointToken(newToken, TokenTypeUpstream)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	v.Update(NewJWTVerifier(JWTVerifierConfig{
+		HMACSecretKey: newKey,
+	}))
+
+	_, err = v.VerifyEndpointToken(oldToken, TokenTypeUpstream)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = v.VerifyEndpointToken(newToken, TokenTypeUpstream)
+	assert.NoError(t, err)
+}
+
+func TestConfig_Load(t *testing.T) {
+	conf := Config{}
+	v, err := conf.Load()
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	conf.TokenRSAPublicKey = "invalid"
+	_, err = conf.Load()
+	assert.ErrorContains(t, err, "parse rsa public key")
+
+	conf = Config{TokenHMACSecretKey: "my-key"}
+	v, err = conf.Load()
+	assert.NoError(t, err)
+	assert.NotNil(t, v)
+}
@@ -2,15 +2,51 @@ package auth
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
 var (
-	ErrInvalidToken = errors.New("invalid token")
-	ErrExpiredToken = errors.New("expired token")
+	ErrInvalidToken     = errors.New("invalid token")
+	ErrExpiredToken     = errors.New("expired token")
+	ErrInvalidTokenType = errors.New("invalid token type")
 )
 
+// TokenType is the type of a token, which restricts which listeners the token
+// can be used with.
+type TokenType string
+
+const (
+	// TokenTypeUpstream is a token to register upstream endpoints on the
+	// upstream port.
+	TokenTypeUpstream TokenType = "upstream"
+
+	// TokenTypeProxy is a token to send proxy requests on the proxy port.
+	TokenTypeProxy TokenType = "proxy"
+
+	// TokenTypeAdmin is a token to identify admin API requests.
+	TokenTypeAdmin TokenType = "admin"
+)
+
+func (t TokenType) Validate() error {
+	switch t {
+	case TokenTypeUpstream, TokenTypeProxy, TokenTypeAdmin:
+		return nil
+	default:
+		return fmt.Errorf("unknown token type: %s", t)
+	}
+}
+
 type EndpointToken struct {
+	// Type contains the 'piko.type' claim of the token, or empty if not
+	// given.
+	Type TokenType
+
+	// Subject contains the 'sub' claim of the token, which identifies the
+	// token holder, or empty if not given.
+	Subject string
+
 	// Expiry contains the time the token expires, or zero if there is no
 	// expiry.
 	Expiry time.Time
@@ -28,7 +64,8 @@ func (t *EndpointToken) EndpointPermitted(endpointID string) bool {
 		return true
 	}
 	for _, id := range t.Endpoints {
-		if endpointID == id {
+		// Endpoint IDs are case insensitive.
+		if strings.EqualFold(endpointID, id) {
 			return true
 		}
 	}
@@ -36,5 +73,9 @@ func (t *EndpointToken) EndpointPermitted(endpointID string) bool {
 }
 
 type Verifier interface {
-	VerifyEndpointToken(token string) (EndpointToken, error)
+	// VerifyEndpointToken verifies the given token can be used as the given
+	// token type.
+	//
+	// Returns ErrInvalidTokenType if the token has a different type.
+	VerifyEndpointToken(token string, tokenType TokenType) (EndpointToken, error)
 }
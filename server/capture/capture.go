@@ -0,0 +1,380 @@
+// Package capture records proxied requests and responses for an endpoint,
+// to help debug requests that behave differently when sent through Piko.
+//
+// Capturing is disabled by default and enabled per endpoint using the admin
+// API. Captured requests are kept in a fixed size buffer in memory on the
+// node that proxied the request to the upstream.
+package capture
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+const (
+	defaultSize        = 100
+	maxSize            = 1000
+	defaultMaxBodySize = 4096
+	maxMaxBodySize     = 1 << 16
+	defaultDuration    = time.Minute * 10
+	maxDuration        = time.Hour * 24
+)
+
+// Config configures capturing requests to an endpoint.
+type Config struct {
+	// SampleRate is the fraction of requests to capture, between 0 and 1.
+	// Defaults to 1.
+	SampleRate float64 `json:"sample_rate"`
+
+	// Size is the maximum number of captured requests to keep. Once full,
+	// the oldest captured request is discarded. Defaults to 100.
+	Size int `json:"size"`
+
+	// MaxBodySize is the maximum number of bytes of each request and
+	// response body to capture. Larger bodies are truncated. Defaults to
+	// 4096.
+	MaxBodySize int `json:"max_body_size"`
+
+	// Duration is how long to capture requests for, such as '30m', after
+	// which capturing is disabled. Defaults to '10m'.
+	Duration string `json:"duration"`
+
+	// RedactHeaders contains additional headers whose values are redacted,
+	// on top of the headers that are always redacted such as
+	// 'Authorization' and 'Cookie'.
+	RedactHeaders []string `json:"redact_headers,omitempty"`
+}
+
+// withDefaults returns the config with defaults set and its duration
+// parsed, or an error if the config is invalid.
+func (c Config) withDefaults() (Config, time.Duration, error) {
+	if c.SampleRate == 0 {
+		c.SampleRate = 1
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return Config{}, 0, fmt.Errorf("sample rate must be between 0 and 1")
+	}
+
+	if c.Size == 0 {
+		c.Size = defaultSize
+	}
+	if c.Size < 0 || c.Size > maxSize {
+		return Config{}, 0, fmt.Errorf("size must be between 1 and %d", maxSize)
+	}
+
+	if c.MaxBodySize == 0 {
+		c.MaxBodySize = defaultMaxBodySize
+	}
+	if c.MaxBodySize < 0 || c.MaxBodySize > maxMaxBodySize {
+		return Config{}, 0, fmt.Errorf(
+			"max body size must be between 1 and %d", maxMaxBodySize,
+		)
+	}
+
+	duration := defaultDuration
+	if c.Duration != "" {
+		d, err := time.ParseDuration(c.Duration)
+		if err != nil {
+			return Config{}, 0, fmt.Errorf("invalid duration: %w", err)
+		}
+		duration = d
+	}
+	if duration <= 0 || duration > maxDuration {
+		return Config{}, 0, fmt.Errorf("duration must be between 0 and %s", maxDuration)
+	}
+	c.Duration = duration.String()
+
+	return c, duration, nil
+}
+
+// Record is a captured request and response.
+type Record struct {
+	// Time is the time the request was received.
+	Time time.Time `json:"time"`
+
+	Method string `json:"method"`
+
+	// URL is the request path and query.
+	URL string `json:"url"`
+
+	Proto string `json:"proto"`
+
+	RemoteAddr string `json:"remote_addr"`
+
+	// RequestHeader contains the request headers sent to the upstream, with
+	// secrets redacted.
+	RequestHeader http.Header `json:"request_header"`
+
+	RequestBody string `json:"request_body,omitempty"`
+
+	// RequestBodySize is the total size of the request body, which may be
+	// larger than the captured body if truncated.
+	RequestBodySize int64 `json:"request_body_size"`
+
+	// RequestBodyTruncated indicates whether the captured request body was
+	// truncated.
+	RequestBodyTruncated bool `json:"request_body_truncated,omitempty"`
+
+	// StatusCode is the response status code, which may be a Piko error
+	// such as '502 Bad Gateway' if the upstream was unreachable.
+	StatusCode int `json:"status_code"`
+
+	// ResponseHeader contains the response headers returned to the client,
+	// with secrets redacted.
+	ResponseHeader http.Header `json:"response_header"`
+
+	ResponseBody string `json:"response_body,omitempty"`
+
+	// ResponseBodySize is the total size of the response body.
+	ResponseBodySize int64 `json:"response_body_size"`
+
+	// ResponseBodyTruncated indicates whether the captured response body
+	// was truncated.
+	ResponseBodyTruncated bool `json:"response_body_truncated,omitempty"`
+
+	// Duration is the time to serve the request in milliseconds.
+	Duration int64 `json:"duration_ms"`
+}
+
+// Session describes the capture of an endpoint.
+type Session struct {
+	EndpointID string `json:"endpoint_id"`
+
+	Config Config `json:"config"`
+
+	// ExpiresAt is the time capturing is disabled.
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Records is the number of captured requests.
+	Records int `json:"records"`
+}
+
+type session struct {
+	conf      Config
+	expiresAt time.Time
+
+	// redact contains the canonical names of the headers to redact.
+	redact map[string]struct{}
+
+	// records is a ring buffer of captured requests, where next is the
+	// index to write the next record.
+	records []Record
+	next    int
+}
+
+func (s *session) add(record Record) {
+	if len(s.records) < s.conf.Size {
+		s.records = append(s.records, record)
+		return
+	}
+	s.records[s.next] = record
+	s.next = (s.next + 1) % s.conf.Size
+}
+
+// ordered returns the captured requests from oldest to newest.
+func (s *session) ordered() []Record {
+	records := make([]Record, 0, len(s.records))
+	records = append(records, s.records[s.next:]...)
+	records = append(records, s.records[:s.next]...)
+	return records
+}
+
+// Capture captures requests to the endpoints with capturing enabled.
+type Capture struct {
+	sessions map[string]*session
+
+	// active is the number of sessions, to avoid locking for every request
+	// when capturing is disabled.
+	active *atomic.Int64
+
+	mu sync.Mutex
+}
+
+func New() *Capture {
+	return &Capture{
+		sessions: make(map[string]*session),
+		active:   atomic.NewInt64(0),
+	}
+}
+
+// Enable enables capturing requests to the endpoint with the given ID,
+// replacing any existing capture of the endpoint.
+func (c *Capture) Enable(endpointID string, conf Config) (Session, error) {
+	conf, duration, err := conf.withDefaults()
+	if err != nil {
+		return Session{}, err
+	}
+
+	redact := make(map[string]struct{})
+	for _, h := range redactedHeaders {
+		redact[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
+	for _, h := range conf.RedactHeaders {
+		redact[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
+
+	s := &session{
+		conf:      conf,
+		expiresAt: time.Now().Add(duration),
+		redact:    redact,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sessions[endpointID] = s
+	c.active.Store(int64(len(c.sessions)))
+
+	return Session{
+		EndpointID: endpointID,
+		Config:     conf,
+		ExpiresAt:  s.expiresAt,
+	}, nil
+}
+
+// Disable disables capturing requests to the endpoint with the given ID and
+// discards its captured requests. Returns false if the endpoint wasn't
+// being captured.
+func (c *Capture) Disable(endpointID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.sessions[endpointID]
+	delete(c.sessions, endpointID)
+	c.active.Store(int64(len(c.sessions)))
+	return ok
+}
+
+// Sessions returns the endpoints being captured, sorted by endpoint ID.
+func (c *Capture) Sessions() []Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpiredLocked()
+
+	sessions := make([]Session, 0, len(c.sessions))
+	for endpointID, s := range c.sessions {
+		sessions = append(sessions, Session{
+			EndpointID: endpointID,
+			Config:     s.conf,
+			ExpiresAt:  s.expiresAt,
+			Records:    len(s.records),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].EndpointID < sessions[j].EndpointID
+	})
+	return sessions
+}
+
+// Records returns the captured requests to the endpoint with the given ID,
+// from oldest to newest, or false if the endpoint isn't being captured.
+func (c *Capture) Records(endpointID string) ([]Record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpiredLocked()
+
+	s, ok := c.sessions[endpointID]
+	if !ok {
+		return nil, false
+	}
+	return s.ordered(), true
+}
+
+// Start starts capturing the given request if capturing is enabled for the
+// endpoint and the request is sampled.
+//
+// Returns the wrapped response writer and request to proxy, and a function
+// to record the request once it has been served. If the request isn't
+// captured, the response writer and request are returned unchanged and the
+// function is nil.
+func (c *Capture) Start(
+	endpointID string,
+	w http.ResponseWriter,
+	r *http.Request,
+) (http.ResponseWriter, *http.Request, func()) {
+	if c.active.Load() == 0 {
+		return w, r, nil
+	}
+
+	c.mu.Lock()
+	s, ok := c.sessions[endpointID]
+	if ok && time.Now().After(s.expiresAt) {
+		c.removeExpiredLocked()
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if !ok || rand.Float64() >= s.conf.SampleRate {
+		return w, r, nil
+	}
+
+	start := time.Now()
+
+	// Copy the request headers before proxying since the proxy modifies
+	// them.
+	record := Record{
+		Time:          start,
+		Method:        r.Method,
+		URL:           r.URL.RequestURI(),
+		Proto:         r.Proto,
+		RemoteAddr:    r.RemoteAddr,
+		RequestHeader: redactHeader(r.Header, s.redact),
+	}
+
+	body := &bodyRecorder{buf: bodyBuffer{limit: s.conf.MaxBodySize}}
+	if r.Body != nil && r.Body != http.NoBody {
+		body.ReadCloser = r.Body
+		r.Body = body
+	}
+	rw := &responseRecorder{
+		ResponseWriter: w,
+		body:           bodyBuffer{limit: s.conf.MaxBodySize},
+	}
+
+	done := func() {
+		record.Duration = time.Since(start).Milliseconds()
+
+		record.RequestBody = string(body.buf.b)
+		record.RequestBodySize = body.buf.size
+		record.RequestBodyTruncated = body.buf.truncated()
+
+		record.StatusCode = rw.statusCode
+		if record.StatusCode == 0 {
+			record.StatusCode = http.StatusOK
+		}
+		record.ResponseHeader = redactHeader(w.Header(), s.redact)
+		record.ResponseBody = string(rw.body.b)
+		record.ResponseBodySize = rw.body.size
+		record.ResponseBodyTruncated = rw.body.truncated()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		// Only record if the session wasn't replaced or disabled while the
+		// request was served.
+		if c.sessions[endpointID] == s {
+			s.add(record)
+		}
+	}
+	return rw, r, done
+}
+
+// removeExpiredLocked removes sessions that have expired. The caller must
+// hold the mutex.
+func (c *Capture) removeExpiredLocked() {
+	now := time.Now()
+	for endpointID, s := range c.sessions {
+		if now.After(s.expiresAt) {
+			delete(c.sessions, endpointID)
+		}
+	}
+	c.active.Store(int64(len(c.sessions)))
+}
@@ -0,0 +1,154 @@
+package capture
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve serves a request to the endpoint through the capture.
+func serve(c *Capture, endpointID string, body string) {
+	r := httptest.NewRequest(http.MethodPost, "/foo?bar=baz", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Content-Type", "text/plain")
+
+	w, r, done := c.Start(endpointID, httptest.NewRecorder(), r)
+	if done != nil {
+		defer done()
+	}
+
+	b, _ := io.ReadAll(r.Body)
+	w.Header().Set("Set-Cookie", "session=secret")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(b)
+}
+
+func TestCapture(t *testing.T) {
+	t.Run("record", func(t *testing.T) {
+		c := New()
+		_, err := c.Enable("my-endpoint", Config{
+			RedactHeaders: []string{"x-api-key"},
+		})
+		require.NoError(t, err)
+
+		serve(c, "my-endpoint", "hello")
+
+		records, ok := c.Records("my-endpoint")
+		require.True(t, ok)
+		require.Len(t, records, 1)
+
+		record := records[0]
+		assert.Equal(t, http.MethodPost, record.Method)
+		assert.Equal(t, "/foo?bar=baz", record.URL)
+		assert.Equal(t, "REDACTED", record.RequestHeader.Get("Authorization"))
+		assert.Equal(t, "REDACTED", record.RequestHeader.Get("X-Api-Key"))
+		assert.Equal(t, "text/plain", record.RequestHeader.Get("Content-Type"))
+		assert.Equal(t, "hello", record.RequestBody)
+		assert.Equal(t, int64(5), record.RequestBodySize)
+		assert.Equal(t, http.StatusCreated, record.StatusCode)
+		assert.Equal(t, "REDACTED", record.ResponseHeader.Get("Set-Cookie"))
+		assert.Equal(t, "hello", record.ResponseBody)
+	})
+
+	t.Run("truncate body", func(t *testing.T) {
+		c := New()
+		_, err := c.Enable("my-endpoint", Config{MaxBodySize: 3})
+		require.NoError(t, err)
+
+		serve(c, "my-endpoint", "hello")
+
+		records, ok := c.Records("my-endpoint")
+		require.True(t, ok)
+		require.Len(t, records, 1)
+		assert.Equal(t, "hel", records[0].RequestBody)
+		assert.Equal(t, int64(5), records[0].RequestBodySize)
+		assert.True(t, records[0].RequestBodyTruncated)
+		assert.Equal(t, "hel", records[0].ResponseBody)
+		assert.True(t, records[0].ResponseBodyTruncated)
+	})
+
+	t.Run("ring buffer", func(t *testing.T) {
+		c := New()
+		_, err := c.Enable("my-endpoint", Config{Size: 2})
+		require.NoError(t, err)
+
+		serve(c, "my-endpoint", "1")
+		serve(c, "my-endpoint", "2")
+		serve(c, "my-endpoint", "3")
+
+		records, ok := c.Records("my-endpoint")
+		require.True(t, ok)
+		require.Len(t, records, 2)
+		assert.Equal(t, "2", records[0].RequestBody)
+		assert.Equal(t, "3", records[1].RequestBody)
+	})
+
+	t.Run("not enabled", func(t *testing.T) {
+		c := New()
+		_, err := c.Enable("my-endpoint", Config{})
+		require.NoError(t, err)
+
+		serve(c, "other-endpoint", "hello")
+
+		records, ok := c.Records("my-endpoint")
+		require.True(t, ok)
+		assert.Empty(t, records)
+
+		_, ok = c.Records("other-endpoint")
+		assert.False(t, ok)
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		c := New()
+		_, err := c.Enable("my-endpoint", Config{})
+		require.NoError(t, err)
+
+		serve(c, "my-endpoint", "hello")
+
+		assert.True(t, c.Disable("my-endpoint"))
+		assert.False(t, c.Disable("my-endpoint"))
+
+		_, ok := c.Records("my-endpoint")
+		assert.False(t, ok)
+		assert.Empty(t, c.Sessions())
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		c := New()
+		_, err := c.Enable("my-endpoint", Config{Duration: "1ns"})
+		require.NoError(t, err)
+
+		serve(c, "my-endpoint", "hello")
+
+		_, ok := c.Records("my-endpoint")
+		assert.False(t, ok)
+	})
+}
+
+func TestCapture_Enable(t *testing.T) {
+	c := New()
+
+	session, err := c.Enable("my-endpoint", Config{})
+	require.NoError(t, err)
+	assert.Equal(t, Config{
+		SampleRate:  1,
+		Size:        100,
+		MaxBodySize: 4096,
+		Duration:    "10m0s",
+	}, session.Config)
+
+	_, err = c.Enable("my-endpoint", Config{SampleRate: 2})
+	assert.EqualError(t, err, "sample rate must be between 0 and 1")
+
+	_, err = c.Enable("my-endpoint", Config{Size: 5000})
+	assert.EqualError(t, err, "size must be between 1 and 1000")
+
+	_, err = c.Enable("my-endpoint", Config{Duration: "foo"})
+	assert.ErrorContains(t, err, "invalid duration")
+}
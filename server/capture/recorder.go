@@ -0,0 +1,99 @@
+package capture
+
+import (
+	"io"
+	"net/http"
+)
+
+// redactedHeaders are the headers whose values are always redacted.
+var redactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Piko-Authorization",
+}
+
+const redacted = "REDACTED"
+
+// redactHeader returns a copy of the given header with the values of the
+// redacted headers replaced.
+func redactHeader(h http.Header, redact map[string]struct{}) http.Header {
+	redactedHeader := h.Clone()
+	for name, values := range redactedHeader {
+		if _, ok := redact[http.CanonicalHeaderKey(name)]; !ok {
+			continue
+		}
+		for i := range values {
+			values[i] = redacted
+		}
+	}
+	return redactedHeader
+}
+
+// bodyBuffer captures up to limit bytes of a body, and counts the total size.
+type bodyBuffer struct {
+	b     []byte
+	size  int64
+	limit int
+}
+
+func (b *bodyBuffer) write(p []byte) {
+	b.size += int64(len(p))
+	if remaining := b.limit - len(b.b); remaining > 0 {
+		if len(p) > remaining {
+			p = p[:remaining]
+		}
+		b.b = append(b.b, p...)
+	}
+}
+
+func (b *bodyBuffer) truncated() bool {
+	return b.size > int64(len(b.b))
+}
+
+// bodyRecorder captures the request body as it's read by the proxy.
+type bodyRecorder struct {
+	io.ReadCloser
+
+	buf bodyBuffer
+}
+
+func (r *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.write(p[:n])
+	return n, err
+}
+
+// responseRecorder captures the status code and body of the response.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	statusCode int
+	body       bodyBuffer
+}
+
+func (w *responseRecorder) WriteHeader(statusCode int) {
+	// Ignore informational responses other than switching protocols, since
+	// they're followed by the final response.
+	informational := statusCode < 200 && statusCode != http.StatusSwitchingProtocols
+	if w.statusCode == 0 && !informational {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.body.write(b[:n])
+	return n, err
+}
+
+// Unwrap returns the underlying response writer so http.ResponseController
+// can access its optional interfaces, such as http.Flusher.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
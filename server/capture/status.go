@@ -0,0 +1,106 @@
+package capture
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/status"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+type errorMessage struct {
+	Error string `json:"error"`
+}
+
+type Status struct {
+	capture *Capture
+}
+
+func NewStatus(capture *Capture) *Status {
+	return &Status{
+		capture: capture,
+	}
+}
+
+func (s *Status) Register(group *gin.RouterGroup) {
+	group.GET("/endpoints", s.listSessionsRoute)
+	group.PUT("/endpoints/:id", s.enableRoute)
+	group.DELETE("/endpoints/:id", s.disableRoute)
+	group.GET("/endpoints/:id/records", s.listRecordsRoute)
+}
+
+// listSessionsRoute returns the endpoints being captured.
+func (s *Status) listSessionsRoute(c *gin.Context) {
+	c.JSON(http.StatusOK, s.capture.Sessions())
+}
+
+// enableRoute enables capturing requests to the endpoint.
+func (s *Status) enableRoute(c *gin.Context) {
+	endpointID, ok := endpointIDParam(c)
+	if !ok {
+		return
+	}
+
+	var conf Config
+	// Allow an empty body to use the defaults.
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&conf); err != nil {
+			return
+		}
+	}
+
+	session, err := s.capture.Enable(endpointID, conf)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorMessage{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// disableRoute disables capturing requests to the endpoint and discards its
+// captured requests.
+func (s *Status) disableRoute(c *gin.Context) {
+	endpointID, ok := endpointIDParam(c)
+	if !ok {
+		return
+	}
+
+	if !s.capture.Disable(endpointID) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// listRecordsRoute returns the captured requests to the endpoint, from oldest
+// to newest.
+func (s *Status) listRecordsRoute(c *gin.Context) {
+	endpointID, ok := endpointIDParam(c)
+	if !ok {
+		return
+	}
+
+	records, ok := s.capture.Records(endpointID)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+// endpointIDParam returns the normalized endpoint ID from the path. Writes a
+// 400 response and returns false if the endpoint ID is invalid.
+//
+// Captured requests are keyed by the normalized ID, so without normalizing a
+// capture for 'API' would never record requests for the endpoint 'api'.
+func endpointIDParam(c *gin.Context) (string, bool) {
+	endpointID := c.Param("id")
+	if err := upstream.ValidateEndpointID(endpointID); err != nil {
+		c.JSON(http.StatusBadRequest, errorMessage{Error: err.Error()})
+		return "", false
+	}
+	return upstream.NormalizeEndpointID(endpointID), true
+}
+
+var _ status.Handler = &Status{}
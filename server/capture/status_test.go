@@ -0,0 +1,85 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	c := New()
+	router := gin.New()
+	NewStatus(c).Register(router.Group("/capture"))
+
+	send := func(method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+
+	w := send(http.MethodPut, "/capture/endpoints/my-endpoint", `{"size": 10}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var session Session
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	assert.Equal(t, "my-endpoint", session.EndpointID)
+	assert.Equal(t, 10, session.Config.Size)
+
+	w = send(http.MethodPut, "/capture/endpoints/my-endpoint", `{"sample_rate": 5}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	serve(c, "my-endpoint", "hello")
+
+	w = send(http.MethodGet, "/capture/endpoints", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var sessions []Session
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 1)
+	assert.Equal(t, 1, sessions[0].Records)
+
+	w = send(http.MethodGet, "/capture/endpoints/my-endpoint/records", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var records []Record
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &records))
+	require.Len(t, records, 1)
+	assert.Equal(t, "hello", records[0].RequestBody)
+
+	w = send(http.MethodDelete, "/capture/endpoints/my-endpoint", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = send(http.MethodGet, "/capture/endpoints/my-endpoint/records", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Endpoint IDs are case insensitive.
+	w = send(http.MethodPut, "/capture/endpoints/My-Endpoint", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	assert.Equal(t, "my-endpoint", session.EndpointID)
+
+	serve(c, "my-endpoint", "hello")
+
+	w = send(http.MethodGet, "/capture/endpoints/MY-ENDPOINT/records", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &records))
+	assert.Len(t, records, 1)
+
+	w = send(http.MethodDelete, "/capture/endpoints/My-Endpoint", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Invalid endpoint IDs are rejected.
+	for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodGet} {
+		path := "/capture/endpoints/my~endpoint"
+		if method == http.MethodGet {
+			path += "/records"
+		}
+		w = send(method, path, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, method)
+	}
+}
@@ -0,0 +1,151 @@
+// Package catalogue contains human readable metadata about endpoints, such as
+// a description and owner, so operators of large shared clusters can find
+// what an endpoint is and who owns it.
+package catalogue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/storage"
+)
+
+const (
+	// storePrefix is the prefix of the store keys of entries added via the
+	// admin API.
+	storePrefix = "catalogue/"
+)
+
+var (
+	// ErrConfigured is returned when modifying an entry loaded from the
+	// server configuration.
+	ErrConfigured = errors.New("entry configured")
+)
+
+// Entry describes an endpoint in the catalogue.
+type Entry struct {
+	// ID is the endpoint ID.
+	ID string `json:"id"`
+
+	Description string `json:"description,omitempty"`
+
+	Owner string `json:"owner,omitempty"`
+
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Catalogue contains the catalogue entry for each described endpoint.
+//
+// Endpoints don't need an entry to register, so the catalogue may contain
+// entries for endpoints with no upstreams, and endpoints with upstreams may
+// have no entry.
+//
+// Entries are either loaded from the server configuration, or added via the
+// admin API and kept in the store. Configured entries can't be modified via
+// the admin API, since the configuration would be reapplied on restart.
+type Catalogue struct {
+	// entries contains the configured entries.
+	entries map[string]*Entry
+
+	store storage.Store
+}
+
+// New creates a catalogue from the given configuration and the entries in
+// the store. The configuration must be validated.
+func New(conf config.CatalogueConfig, store storage.Store) *Catalogue {
+	entries := make(map[string]*Entry, len(conf.Endpoints))
+	for _, endpoint := range conf.Endpoints {
+		entries[endpoint.ID] = &Entry{
+			ID:          endpoint.ID,
+			Description: endpoint.Description,
+			Owner:       endpoint.Owner,
+			Tags:        endpoint.Tags,
+		}
+	}
+	return &Catalogue{
+		entries: entries,
+		store:   store,
+	}
+}
+
+// Entry returns the catalogue entry for the endpoint with the given ID, or
+// false if the endpoint isn't in the catalogue.
+func (c *Catalogue) Entry(ctx context.Context, endpointID string) (*Entry, bool, error) {
+	if entry, ok := c.entries[endpointID]; ok {
+		return entry, true, nil
+	}
+
+	value, err := c.store.Get(ctx, storePrefix+endpointID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("store: %w", err)
+	}
+	var entry Entry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return nil, false, fmt.Errorf("decode: %s: %w", endpointID, err)
+	}
+	return &entry, true, nil
+}
+
+// Entries returns all catalogue entries sorted by endpoint ID.
+func (c *Catalogue) Entries(ctx context.Context) ([]*Entry, error) {
+	stored, err := c.store.List(ctx, storePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+
+	entries := make([]*Entry, 0, len(c.entries)+len(stored))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	for _, e := range stored {
+		var entry Entry
+		if err := json.Unmarshal(e.Value, &entry); err != nil {
+			return nil, fmt.Errorf("decode: %s: %w", e.Key, err)
+		}
+		// Configured entries take precedence, such as if the endpoint was
+		// added to the configuration after being added via the admin API.
+		if _, ok := c.entries[entry.ID]; ok {
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+// Put adds or replaces the catalogue entry in the store, or returns
+// ErrConfigured if the endpoint is in the server configuration.
+func (c *Catalogue) Put(ctx context.Context, entry *Entry) error {
+	if _, ok := c.entries[entry.ID]; ok {
+		return ErrConfigured
+	}
+
+	// Encoding a struct of strings can't fail.
+	value, _ := json.Marshal(entry)
+	if err := c.store.Put(ctx, storePrefix+entry.ID, value); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the catalogue entry from the store, or returns
+// ErrConfigured if the endpoint is in the server configuration.
+func (c *Catalogue) Delete(ctx context.Context, endpointID string) error {
+	if _, ok := c.entries[endpointID]; ok {
+		return ErrConfigured
+	}
+
+	if err := c.store.Delete(ctx, storePrefix+endpointID); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package catalogue
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/status"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+type errorMessage struct {
+	Error string `json:"error"`
+}
+
+// EndpointStatus contains an endpoints catalogue entry along with its
+// availability in the cluster.
+type EndpointStatus struct {
+	Entry
+
+	// Catalogued indicates whether the endpoint has a catalogue entry.
+	Catalogued bool `json:"catalogued"`
+
+	// Upstreams is the number of upstreams connected for the endpoint across
+	// all active nodes.
+	Upstreams int `json:"upstreams"`
+
+	// Nodes maps the ID of each active node with upstreams for the endpoint
+	// to the number of upstreams connected to that node.
+	Nodes map[string]int `json:"nodes,omitempty"`
+}
+
+type Status struct {
+	catalogue    *Catalogue
+	clusterState *cluster.State
+}
+
+func NewStatus(catalogue *Catalogue, clusterState *cluster.State) *Status {
+	return &Status{
+		catalogue:    catalogue,
+		clusterState: clusterState,
+	}
+}
+
+func (s *Status) Register(group *gin.RouterGroup) {
+	group.GET("/endpoints", s.listEndpointsRoute)
+	group.GET("/endpoints/:id", s.getEndpointRoute)
+}
+
+// listEndpointsRoute returns the status of each endpoint that either has a
+// catalogue entry or connected upstreams, sorted by endpoint ID.
+func (s *Status) listEndpointsRoute(c *gin.Context) {
+	entries, err := s.catalogue.Entries(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorMessage{Error: err.Error()})
+		return
+	}
+
+	endpoints := make(map[string]*EndpointStatus)
+	for _, entry := range entries {
+		endpoints[entry.ID] = &EndpointStatus{
+			Entry:      *entry,
+			Catalogued: true,
+		}
+	}
+	for _, endpoint := range s.clusterState.Endpoints() {
+		status, ok := endpoints[endpoint.ID]
+		if !ok {
+			status = &EndpointStatus{
+				Entry: Entry{ID: endpoint.ID},
+			}
+			endpoints[endpoint.ID] = status
+		}
+		status.Upstreams = endpoint.Upstreams
+		status.Nodes = endpoint.Nodes
+	}
+
+	sorted := make([]*EndpointStatus, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		sorted = append(sorted, endpoint)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	c.JSON(http.StatusOK, sorted)
+}
+
+func (s *Status) getEndpointRoute(c *gin.Context) {
+	id := upstream.NormalizeEndpointID(c.Param("id"))
+
+	endpoint := s.clusterState.Endpoint(id)
+	entry, ok, err := s.catalogue.Entry(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorMessage{Error: err.Error()})
+		return
+	}
+	if !ok && !endpoint.Available() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	status := &EndpointStatus{
+		Entry: Entry{
+			ID: id,
+		},
+		Catalogued: ok,
+		Upstreams:  endpoint.Upstreams,
+		Nodes:      endpoint.Nodes,
+	}
+	if ok {
+		status.Entry = *entry
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+var _ status.Handler = &Status{}
@@ -0,0 +1,132 @@
+package catalogue
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/storage"
+)
+
+func newTestRouter(t *testing.T, clusterState *cluster.State) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	// Add an entry via the store, as if added with the admin API.
+	store := storage.NewMemoryStore()
+	catalogue := New(config.CatalogueConfig{
+		Endpoints: []config.CatalogueEndpointConfig{
+			{
+				ID:          "payments-cb-1",
+				Description: "Payments callback handler",
+				Owner:       "payments",
+				Tags:        []string{"prod"},
+			},
+			{
+				ID: "billing",
+			},
+		},
+	}, store)
+	require.NoError(t, catalogue.Put(context.TODO(), &Entry{
+		ID:    "search",
+		Owner: "search",
+	}))
+
+	router := gin.New()
+	NewStatus(catalogue, clusterState).Register(router.Group("/catalogue"))
+	return router
+}
+
+func TestStatus_Endpoints(t *testing.T) {
+	clusterState := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	clusterState.AddLocalEndpoint("payments-cb-1")
+	clusterState.AddLocalEndpoint("unknown")
+
+	router := newTestRouter(t, clusterState)
+
+	t.Run("list", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/catalogue/endpoints", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var endpoints []*EndpointStatus
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &endpoints))
+		assert.Equal(t, []*EndpointStatus{
+			{
+				Entry:      Entry{ID: "billing"},
+				Catalogued: true,
+			},
+			{
+				Entry: Entry{
+					ID:          "payments-cb-1",
+					Description: "Payments callback handler",
+					Owner:       "payments",
+					Tags:        []string{"prod"},
+				},
+				Catalogued: true,
+				Upstreams:  1,
+				Nodes:      map[string]int{"local": 1},
+			},
+			{
+				Entry:      Entry{ID: "search", Owner: "search"},
+				Catalogued: true,
+			},
+			{
+				Entry:     Entry{ID: "unknown"},
+				Upstreams: 1,
+				Nodes:     map[string]int{"local": 1},
+			},
+		}, endpoints)
+	})
+
+	t.Run("get", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/catalogue/endpoints/payments-cb-1", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var endpoint EndpointStatus
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &endpoint))
+		assert.Equal(t, "payments-cb-1", endpoint.ID)
+		assert.Equal(t, "payments", endpoint.Owner)
+		assert.True(t, endpoint.Catalogued)
+		assert.Equal(t, 1, endpoint.Upstreams)
+	})
+
+	t.Run("get uncatalogued", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/catalogue/endpoints/unknown", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var endpoint EndpointStatus
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &endpoint))
+		assert.Equal(t, "unknown", endpoint.ID)
+		assert.False(t, endpoint.Catalogued)
+	})
+
+	t.Run("get stored", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/catalogue/endpoints/search", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var endpoint EndpointStatus
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &endpoint))
+		assert.Equal(t, "search", endpoint.Owner)
+		assert.True(t, endpoint.Catalogued)
+	})
+
+	t.Run("get not found", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/catalogue/endpoints/missing", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
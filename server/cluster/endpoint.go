@@ -0,0 +1,93 @@
+package cluster
+
+import (
+	"sort"
+	"sync"
+)
+
+// Endpoint contains the availability of an endpoint across the cluster.
+type Endpoint struct {
+	// ID is the endpoint ID.
+	ID string `json:"id"`
+
+	// Upstreams is the number of upstreams connected for the endpoint across
+	// all active nodes. If zero the endpoint is unavailable.
+	Upstreams int `json:"upstreams"`
+
+	// Nodes maps the ID of each active node with upstreams for the endpoint
+	// to the number of upstreams connected to that node.
+	Nodes map[string]int `json:"nodes,omitempty"`
+}
+
+// Available returns whether the endpoint has at least one connected upstream.
+func (e *Endpoint) Available() bool {
+	return e.Upstreams > 0
+}
+
+// EndpointWatch receives changes to the availability of endpoints in the
+// cluster.
+//
+// Changes are coalesced, so if an endpoint changes multiple times before the
+// watcher reads the changes, Updates only returns the latest availability.
+type EndpointWatch struct {
+	// endpointID is the endpoint to watch. If empty all endpoints are
+	// watched.
+	endpointID string
+
+	// pending contains the IDs of endpoints that have changed since the last
+	// call to Updates.
+	pending map[string]struct{}
+
+	// mu protects the above fields.
+	mu sync.Mutex
+
+	notifyCh chan struct{}
+
+	state *State
+}
+
+// Notify returns a channel that is signalled when there are pending updates.
+func (w *EndpointWatch) Notify() <-chan struct{} {
+	return w.notifyCh
+}
+
+// Updates returns the current availability of the endpoints that have changed
+// since the last call to Updates.
+func (w *EndpointWatch) Updates() []*Endpoint {
+	w.mu.Lock()
+	endpointIDs := make([]string, 0, len(w.pending))
+	for endpointID := range w.pending {
+		endpointIDs = append(endpointIDs, endpointID)
+	}
+	w.pending = make(map[string]struct{})
+	w.mu.Unlock()
+
+	sort.Strings(endpointIDs)
+
+	endpoints := make([]*Endpoint, 0, len(endpointIDs))
+	for _, endpointID := range endpointIDs {
+		endpoints = append(endpoints, w.state.Endpoint(endpointID))
+	}
+	return endpoints
+}
+
+// Close stops watching for updates.
+func (w *EndpointWatch) Close() {
+	w.state.removeWatch(w)
+}
+
+func (w *EndpointWatch) notify(endpointID string) {
+	if w.endpointID != "" && w.endpointID != endpointID {
+		return
+	}
+
+	w.mu.Lock()
+	w.pending[endpointID] = struct{}{}
+	w.mu.Unlock()
+
+	select {
+	case w.notifyCh <- struct{}{}:
+	default:
+		// A notification is already pending.
+	}
+}
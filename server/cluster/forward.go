@@ -0,0 +1,75 @@
+package cluster
+
+import "time"
+
+const (
+	// forwardBucketInterval is the interval covered by each forward stats
+	// bucket.
+	forwardBucketInterval = time.Minute
+	// forwardBuckets is the number of buckets in the forward stats window,
+	// so stats cover the last five minutes.
+	forwardBuckets = 5
+)
+
+// ForwardStats contains the results of requests the local node forwarded to
+// a node over the last five minutes.
+type ForwardStats struct {
+	// Requests is the number of requests forwarded to the node.
+	Requests uint64 `json:"requests"`
+
+	// Errors is the number of forwarded requests where the node couldn't be
+	// reached or didn't respond.
+	Errors uint64 `json:"errors"`
+
+	// SuccessRate is the fraction of forwarded requests the node responded
+	// to, between 0 and 1.
+	SuccessRate float64 `json:"success_rate"`
+}
+
+type forwardBucket struct {
+	// start is the start time of the bucket, truncated to
+	// forwardBucketInterval.
+	start    time.Time
+	requests uint64
+	errors   uint64
+}
+
+// forwardTracker tracks the results of requests forwarded to a node in a
+// sliding window.
+type forwardTracker struct {
+	buckets [forwardBuckets]forwardBucket
+}
+
+func (t *forwardTracker) Observe(ok bool, now time.Time) {
+	start := now.Truncate(forwardBucketInterval)
+	b := &t.buckets[(start.Unix()/int64(forwardBucketInterval.Seconds()))%forwardBuckets]
+	if !b.start.Equal(start) {
+		*b = forwardBucket{start: start}
+	}
+	b.requests++
+	if !ok {
+		b.errors++
+	}
+}
+
+// Stats returns the stats for the window ending at now, or nil if no
+// requests were forwarded in the window.
+func (t *forwardTracker) Stats(now time.Time) *ForwardStats {
+	oldest := now.Truncate(forwardBucketInterval).Add(
+		-forwardBucketInterval * (forwardBuckets - 1),
+	)
+
+	stats := &ForwardStats{}
+	for _, b := range t.buckets {
+		if b.start.Before(oldest) {
+			continue
+		}
+		stats.Requests += b.requests
+		stats.Errors += b.errors
+	}
+	if stats.Requests == 0 {
+		return nil
+	}
+	stats.SuccessRate = float64(stats.Requests-stats.Errors) / float64(stats.Requests)
+	return stats
+}
@@ -0,0 +1,58 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardTracker(t *testing.T) {
+	t.Run("stats", func(t *testing.T) {
+		now := time.Now()
+
+		var tracker forwardTracker
+		tracker.Observe(true, now)
+		tracker.Observe(true, now)
+		tracker.Observe(true, now.Add(-time.Minute))
+		tracker.Observe(false, now.Add(-time.Minute*2))
+
+		stats := tracker.Stats(now)
+		require.NotNil(t, stats)
+		assert.Equal(t, uint64(4), stats.Requests)
+		assert.Equal(t, uint64(1), stats.Errors)
+		assert.Equal(t, 0.75, stats.SuccessRate)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		now := time.Now()
+
+		var tracker forwardTracker
+		tracker.Observe(false, now.Add(-time.Minute*10))
+		tracker.Observe(true, now)
+
+		stats := tracker.Stats(now)
+		require.NotNil(t, stats)
+		assert.Equal(t, uint64(1), stats.Requests)
+		assert.Equal(t, uint64(0), stats.Errors)
+		assert.Equal(t, 1.0, stats.SuccessRate)
+
+		assert.Nil(t, tracker.Stats(now.Add(time.Minute*10)))
+	})
+
+	t.Run("reuse bucket", func(t *testing.T) {
+		now := time.Now()
+
+		var tracker forwardTracker
+		tracker.Observe(false, now.Add(-time.Minute*5))
+		// Reuses the same bucket as the above request, which should be
+		// reset.
+		tracker.Observe(true, now)
+
+		stats := tracker.Stats(now)
+		require.NotNil(t, stats)
+		assert.Equal(t, uint64(1), stats.Requests)
+		assert.Equal(t, uint64(0), stats.Errors)
+	})
+}
@@ -0,0 +1,158 @@
+package cluster
+
+import (
+	"time"
+)
+
+const (
+	// historyMinutes is the number of minutes of endpoint availability
+	// history to retain.
+	historyMinutes = 60
+)
+
+// AvailabilitySample contains the number of upstreams connected for an
+// endpoint across the cluster during a minute.
+type AvailabilitySample struct {
+	// Time is the start of the minute.
+	Time time.Time `json:"time"`
+
+	// Min is the minimum number of upstreams connected during the minute.
+	Min int `json:"min"`
+
+	// Max is the maximum number of upstreams connected during the minute.
+	Max int `json:"max"`
+}
+
+// historyBucket contains the upstream counts for one minute.
+type historyBucket struct {
+	// minute is the number of minutes since the unix epoch, or zero if the
+	// bucket is unused.
+	minute int64
+	min    int
+	max    int
+}
+
+// endpointHistory is a ring buffer of the upstream counts of an endpoint for
+// each minute in the last hour.
+type endpointHistory struct {
+	buckets [historyMinutes]historyBucket
+
+	// upstreams is the latest number of upstreams.
+	upstreams int
+	// minute is the minute the upstreams count was last updated.
+	minute int64
+}
+
+func (h *endpointHistory) record(minute int64, upstreams int) {
+	if h.minute != 0 && h.minute < minute {
+		// The upstreams count didn't change in the minutes since the last
+		// update, so fill those minutes with the latest count. Since the
+		// count held until now, it is also included in this minute.
+		from := max(h.minute+1, minute-historyMinutes+1)
+		for m := from; m <= minute; m++ {
+			h.buckets[m%historyMinutes] = historyBucket{
+				minute: m,
+				min:    h.upstreams,
+				max:    h.upstreams,
+			}
+		}
+	}
+
+	b := &h.buckets[minute%historyMinutes]
+	if b.minute != minute {
+		*b = historyBucket{
+			minute: minute,
+			min:    upstreams,
+			max:    upstreams,
+		}
+	} else {
+		b.min = min(b.min, upstreams)
+		b.max = max(b.max, upstreams)
+	}
+
+	h.upstreams = upstreams
+	h.minute = minute
+}
+
+// samples returns the upstream counts for each minute in the last hour up to
+// and including the given minute, oldest first.
+func (h *endpointHistory) samples(minute int64) []AvailabilitySample {
+	samples := make([]AvailabilitySample, 0, historyMinutes)
+	for m := minute - historyMinutes + 1; m <= minute; m++ {
+		sample := AvailabilitySample{
+			Time: time.Unix(m*60, 0).UTC(),
+		}
+		if b := h.buckets[m%historyMinutes]; b.minute == m {
+			sample.Min = b.min
+			sample.Max = b.max
+		} else if h.minute != 0 && m > h.minute {
+			// No updates since the last recorded minute.
+			sample.Min = h.upstreams
+			sample.Max = h.upstreams
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// expired returns whether the endpoint has had no upstreams for the full
+// history, so can be discarded.
+func (h *endpointHistory) expired(minute int64) bool {
+	return h.upstreams == 0 && h.minute <= minute-historyMinutes
+}
+
+// availabilityHistory records the number of upstreams connected for each
+// endpoint across the cluster for each minute in the last hour.
+//
+// availabilityHistory isn't thread safe.
+type availabilityHistory struct {
+	endpoints map[string]*endpointHistory
+
+	// pruned is the minute expired endpoints were last discarded.
+	pruned int64
+}
+
+func newAvailabilityHistory() *availabilityHistory {
+	return &availabilityHistory{
+		endpoints: make(map[string]*endpointHistory),
+	}
+}
+
+// Record updates the number of upstreams connected for the endpoint.
+func (h *availabilityHistory) Record(endpointID string, upstreams int, t time.Time) {
+	minute := t.Unix() / 60
+
+	endpoint, ok := h.endpoints[endpointID]
+	if !ok {
+		endpoint = &endpointHistory{}
+		h.endpoints[endpointID] = endpoint
+	}
+	endpoint.record(minute, upstreams)
+
+	if minute > h.pruned {
+		h.prune(minute)
+	}
+}
+
+// Samples returns the upstream counts for the endpoint for each minute in
+// the last hour, oldest first.
+func (h *availabilityHistory) Samples(endpointID string, t time.Time) []AvailabilitySample {
+	minute := t.Unix() / 60
+
+	endpoint, ok := h.endpoints[endpointID]
+	if !ok {
+		endpoint = &endpointHistory{}
+	}
+	return endpoint.samples(minute)
+}
+
+// prune discards endpoints that have had no upstreams for the full history,
+// to avoid the history growing without bound.
+func (h *availabilityHistory) prune(minute int64) {
+	for endpointID, endpoint := range h.endpoints {
+		if endpoint.expired(minute) {
+			delete(h.endpoints, endpointID)
+		}
+	}
+	h.pruned = minute
+}
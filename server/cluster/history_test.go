@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestAvailabilityHistory(t *testing.T) {
+	t.Run("unknown endpoint", func(t *testing.T) {
+		h := newAvailabilityHistory()
+
+		now := time.Date(2024, 8, 1, 14, 32, 10, 0, time.UTC)
+		samples := h.Samples("my-endpoint", now)
+		require.Len(t, samples, historyMinutes)
+		assert.Equal(t, now.Truncate(time.Minute), samples[historyMinutes-1].Time)
+		assert.Equal(t, now.Truncate(time.Minute).Add(-time.Minute*59), samples[0].Time)
+		for _, sample := range samples {
+			assert.Equal(t, 0, sample.Min)
+			assert.Equal(t, 0, sample.Max)
+		}
+	})
+
+	t.Run("record", func(t *testing.T) {
+		h := newAvailabilityHistory()
+
+		start := time.Date(2024, 8, 1, 14, 0, 0, 0, time.UTC)
+		h.Record("my-endpoint", 1, start.Add(time.Second*10))
+		h.Record("my-endpoint", 2, start.Add(time.Second*20))
+		// Briefly unavailable at 14:32.
+		h.Record("my-endpoint", 0, start.Add(time.Minute*32))
+		h.Record("my-endpoint", 1, start.Add(time.Minute*32+time.Second*5))
+
+		samples := h.Samples("my-endpoint", start.Add(time.Minute*40))
+		require.Len(t, samples, historyMinutes)
+
+		byMinute := make(map[time.Time]AvailabilitySample)
+		for _, sample := range samples {
+			byMinute[sample.Time] = sample
+		}
+
+		// Before the first update.
+		assert.Equal(t, 0, byMinute[start.Add(-time.Minute)].Max)
+		// The first minute includes both updates.
+		assert.Equal(t, AvailabilitySample{
+			Time: start,
+			Min:  1,
+			Max:  2,
+		}, byMinute[start])
+		// Minutes without updates carry forward the latest count.
+		assert.Equal(t, AvailabilitySample{
+			Time: start.Add(time.Minute * 31),
+			Min:  2,
+			Max:  2,
+		}, byMinute[start.Add(time.Minute*31)])
+		assert.Equal(t, AvailabilitySample{
+			Time: start.Add(time.Minute * 32),
+			Min:  0,
+			Max:  2,
+		}, byMinute[start.Add(time.Minute*32)])
+		assert.Equal(t, AvailabilitySample{
+			Time: start.Add(time.Minute * 40),
+			Min:  1,
+			Max:  1,
+		}, byMinute[start.Add(time.Minute*40)])
+	})
+
+	t.Run("wrap", func(t *testing.T) {
+		h := newAvailabilityHistory()
+
+		start := time.Date(2024, 8, 1, 14, 0, 0, 0, time.UTC)
+		h.Record("my-endpoint", 3, start)
+		h.Record("my-endpoint", 1, start.Add(time.Hour*2))
+
+		samples := h.Samples("my-endpoint", start.Add(time.Hour*2))
+		require.Len(t, samples, historyMinutes)
+		for _, sample := range samples[:historyMinutes-1] {
+			assert.Equal(t, 3, sample.Min)
+			assert.Equal(t, 3, sample.Max)
+		}
+		assert.Equal(t, 1, samples[historyMinutes-1].Min)
+		assert.Equal(t, 3, samples[historyMinutes-1].Max)
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		h := newAvailabilityHistory()
+
+		start := time.Date(2024, 8, 1, 14, 0, 0, 0, time.UTC)
+		h.Record("endpoint-1", 1, start)
+		h.Record("endpoint-1", 0, start.Add(time.Minute))
+		h.Record("endpoint-2", 1, start.Add(time.Minute))
+
+		h.Record("endpoint-3", 1, start.Add(time.Minute*30))
+		assert.Len(t, h.endpoints, 3)
+
+		// Discards endpoint-1 once it has had no upstreams for an hour.
+		h.Record("endpoint-3", 1, start.Add(time.Minute*61))
+		assert.Len(t, h.endpoints, 2)
+		_, ok := h.endpoints["endpoint-1"]
+		assert.False(t, ok)
+	})
+}
+
+func TestState_EndpointHistory(t *testing.T) {
+	s := NewState(&Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	s.AddNode(&Node{
+		ID:     "remote",
+		Status: NodeStatusActive,
+	})
+
+	s.AddLocalEndpoint("my-endpoint")
+	s.UpdateRemoteEndpoint("remote", "my-endpoint", 2)
+
+	samples := s.EndpointHistory("my-endpoint")
+	require.Len(t, samples, historyMinutes)
+	assert.Equal(t, 3, samples[historyMinutes-1].Max)
+
+	// Upstreams on nodes that aren't active aren't counted.
+	s.UpdateRemoteStatus("remote", NodeStatusUnreachable)
+	samples = s.EndpointHistory("my-endpoint")
+	assert.Equal(t, 1, samples[historyMinutes-1].Min)
+}
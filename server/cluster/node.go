@@ -44,12 +44,38 @@ type Node struct {
 	// The address is immutable.
 	AdminAddr string `json:"admin_addr"`
 
+	// ForwardAddr is the advertised address to forward requests to over
+	// TLS, or empty if the node doesn't have a forward listener, in which
+	// case requests are forwarded to ProxyAddr.
+	//
+	// The address is immutable.
+	ForwardAddr string `json:"forward_addr,omitempty"`
+
+	// Zone is the availability zone the node is running in, or empty if the
+	// zone isn't configured.
+	//
+	// The zone is immutable.
+	Zone string `json:"zone,omitempty"`
+
+	// Draining is true if the node is draining, so it doesn't accept new
+	// upstream connections and other nodes avoid forwarding requests to it.
+	//
+	// Once draining, a node doesn't stop draining until it restarts.
+	Draining bool `json:"draining,omitempty"`
+
 	// Endpoints contains the known active endpoints on the node (endpoints
 	// with at least one upstream listener).
 	//
 	// This maps the endpoint ID to the number of known listeners for that
 	// endpoint.
 	Endpoints map[string]int `json:"endpoints"`
+
+	// Load contains the load on the nodes upstreams for each active
+	// endpoint.
+	//
+	// Nodes running an older version don't report their load, so the load
+	// for an active endpoint may be missing.
+	Load map[string]EndpointLoad `json:"load,omitempty"`
 }
 
 func (n *Node) Copy() *Node {
@@ -60,12 +86,23 @@ func (n *Node) Copy() *Node {
 			endpoints[endpointID] = listeners
 		}
 	}
+	var load map[string]EndpointLoad
+	if len(n.Load) > 0 {
+		load = make(map[string]EndpointLoad)
+		for endpointID, endpointLoad := range n.Load {
+			load[endpointID] = endpointLoad
+		}
+	}
 	return &Node{
-		ID:        n.ID,
-		Status:    n.Status,
-		ProxyAddr: n.ProxyAddr,
-		AdminAddr: n.AdminAddr,
-		Endpoints: endpoints,
+		ID:          n.ID,
+		Status:      n.Status,
+		ProxyAddr:   n.ProxyAddr,
+		AdminAddr:   n.AdminAddr,
+		ForwardAddr: n.ForwardAddr,
+		Zone:        n.Zone,
+		Draining:    n.Draining,
+		Endpoints:   endpoints,
+		Load:        load,
 	}
 }
 
@@ -75,24 +112,45 @@ func (n *Node) Metadata() *NodeMetadata {
 		upstreams += endpointUpstreams
 	}
 	return &NodeMetadata{
-		ID:        n.ID,
-		Status:    n.Status,
-		ProxyAddr: n.ProxyAddr,
-		AdminAddr: n.AdminAddr,
-		Endpoints: len(n.Endpoints),
-		Upstreams: upstreams,
+		ID:          n.ID,
+		Status:      n.Status,
+		ProxyAddr:   n.ProxyAddr,
+		AdminAddr:   n.AdminAddr,
+		ForwardAddr: n.ForwardAddr,
+		Zone:        n.Zone,
+		Draining:    n.Draining,
+		Endpoints:   len(n.Endpoints),
+		Upstreams:   upstreams,
 	}
 }
 
+// EndpointLoad contains the load on a nodes upstreams for an endpoint.
+type EndpointLoad struct {
+	// Requests is the number of active requests (or TCP connections) to the
+	// nodes upstreams for the endpoint.
+	Requests int `json:"requests"`
+
+	// Ages contains the number of upstreams for the endpoint in each
+	// connection age bucket: connected for under a minute, under an hour,
+	// and at least an hour.
+	Ages [3]int `json:"ages"`
+}
+
 // NodeMetadata contains metadata fields from Node.
 type NodeMetadata struct {
-	ID        string     `json:"id"`
-	Status    NodeStatus `json:"status"`
-	ProxyAddr string     `json:"proxy_addr"`
-	AdminAddr string     `json:"admin_addr"`
-	Endpoints int        `json:"endpoints"`
+	ID          string     `json:"id"`
+	Status      NodeStatus `json:"status"`
+	ProxyAddr   string     `json:"proxy_addr"`
+	AdminAddr   string     `json:"admin_addr"`
+	ForwardAddr string     `json:"forward_addr,omitempty"`
+	Zone        string     `json:"zone,omitempty"`
+	Draining    bool       `json:"draining,omitempty"`
+	Endpoints   int        `json:"endpoints"`
 	// Upstreams is the number of upstreams connected to this node.
 	Upstreams int `json:"upstreams"`
+	// Forwarded contains the results of requests the local node forwarded
+	// to this node, or nil if no requests were recently forwarded.
+	Forwarded *ForwardStats `json:"forwarded,omitempty"`
 }
 
 func GenerateNodeID() string {
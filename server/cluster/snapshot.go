@@ -0,0 +1,61 @@
+package cluster
+
+// snapshot is an immutable snapshot of the remote nodes in the cluster, used
+// to look up the nodes with upstreams for an endpoint without locking.
+type snapshot struct {
+	// endpoints maps each endpoint ID to the active remote nodes with at
+	// least one upstream for the endpoint.
+	//
+	// Draining nodes are deprioritized, so are only included if no
+	// non-draining nodes have an upstream for the endpoint. Nodes that
+	// aren't forwardable are excluded.
+	//
+	// The nodes are copies so are never modified once the snapshot is
+	// built.
+	endpoints map[string][]*Node
+}
+
+func newSnapshot(
+	localID string,
+	nodes map[string]*Node,
+	unforwardable map[string]struct{},
+) *snapshot {
+	snap := &snapshot{
+		endpoints: make(map[string][]*Node),
+	}
+	draining := make(map[string][]*Node)
+	for _, node := range nodes {
+		if node.ID == localID {
+			// Ignore ourselves.
+			continue
+		}
+		if node.Status != NodeStatusActive {
+			// Ignore unreachable and left nodes.
+			continue
+		}
+		if _, ok := unforwardable[node.ID]; ok {
+			// Ignore nodes failing health checks.
+			continue
+		}
+
+		nodeCopy := node.Copy()
+		for endpointID, listeners := range nodeCopy.Endpoints {
+			if listeners == 0 {
+				continue
+			}
+			if nodeCopy.Draining {
+				draining[endpointID] = append(draining[endpointID], nodeCopy)
+			} else {
+				snap.endpoints[endpointID] = append(snap.endpoints[endpointID], nodeCopy)
+			}
+		}
+	}
+	// Only fall back to draining nodes when no other nodes have an upstream
+	// for the endpoint.
+	for endpointID, nodes := range draining {
+		if _, ok := snap.endpoints[endpointID]; !ok {
+			snap.endpoints[endpointID] = nodes
+		}
+	}
+	return snap
+}
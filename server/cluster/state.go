@@ -1,9 +1,13 @@
 package cluster
 
 import (
+	"math/rand"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
 
 	"github.com/andydunstall/piko/pkg/log"
 )
@@ -18,10 +22,42 @@ type State struct {
 
 	localEndpointSubscribers  []func(endpointID string)
 	remoteEndpointSubscribers []func(nodeID string, endpointID string)
+	localResumeSubscribers    []func(endpointID string, deadline time.Time)
+	localLoadSubscribers      []func(endpointID string)
+	localDrainSubscribers     []func()
+
+	// resuming contains the deadline for endpoints whose upstreams are
+	// expected to resume after the node they were connected to restarted.
+	resuming map[string]time.Time
+
+	// watches contains the active endpoint availability watches.
+	watches map[*EndpointWatch]struct{}
+
+	// history records the availability of each endpoint over the last hour.
+	history *availabilityHistory
+
+	// unforwardable contains the IDs of remote nodes that requests must not
+	// be forwarded to, such as nodes failing health checks.
+	unforwardable map[string]struct{}
 
 	// mu protects the above fields.
 	mu sync.RWMutex
 
+	// snapshot is an immutable snapshot of the remote nodes for lock-free
+	// endpoint lookups, or nil if the state changed since the snapshot was
+	// built.
+	//
+	// Updates discard the snapshot rather than rebuilding it, so a burst of
+	// updates only rebuilds the snapshot once on the next lookup.
+	snapshot *atomic.Pointer[snapshot]
+
+	// forwards tracks the results of requests forwarded to each node.
+	//
+	// Protected by a separate mutex since it's updated for every forwarded
+	// request.
+	forwards  map[string]*forwardTracker
+	forwardMu sync.Mutex
+
 	metrics *Metrics
 
 	logger log.Logger
@@ -37,10 +73,16 @@ func NewState(
 	nodes[localNode.ID] = localNode
 
 	s := &State{
-		localID: localNode.ID,
-		nodes:   nodes,
-		metrics: NewMetrics(),
-		logger:  logger.WithSubsystem("cluster"),
+		localID:       localNode.ID,
+		nodes:         nodes,
+		watches:       make(map[*EndpointWatch]struct{}),
+		history:       newAvailabilityHistory(),
+		unforwardable: make(map[string]struct{}),
+		resuming:      make(map[string]time.Time),
+		snapshot:      atomic.NewPointer[snapshot](nil),
+		forwards:      make(map[string]*forwardTracker),
+		metrics:       NewMetrics(),
+		logger:        logger.WithSubsystem("cluster"),
 	}
 	s.addMetricsNode(localNode.Status)
 	return s
@@ -94,34 +136,129 @@ func (s *State) NodesMetadata() []*NodeMetadata {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	s.forwardMu.Lock()
+	defer s.forwardMu.Unlock()
+
+	now := time.Now()
 	nodes := make([]*NodeMetadata, 0, len(s.nodes))
 	for _, node := range s.nodes {
-		nodes = append(nodes, node.Metadata())
+		metadata := node.Metadata()
+		if tracker, ok := s.forwards[node.ID]; ok {
+			metadata.Forwarded = tracker.Stats(now)
+		}
+		nodes = append(nodes, metadata)
 	}
 	return nodes
 }
 
+// ObserveForward records the result of a request forwarded to the node with
+// the given ID. ok is true if the node responded, regardless of the response
+// status.
+func (s *State) ObserveForward(nodeID string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Ignore nodes that have been removed while the request was in
+	// progress.
+	if _, known := s.nodes[nodeID]; !known {
+		return
+	}
+
+	s.forwardMu.Lock()
+	defer s.forwardMu.Unlock()
+
+	tracker, exists := s.forwards[nodeID]
+	if !exists {
+		tracker = &forwardTracker{}
+		s.forwards[nodeID] = tracker
+	}
+	tracker.Observe(ok, time.Now())
+}
+
+// SetForwardable sets whether requests can be forwarded to the remote node
+// with the given ID. Nodes that aren't forwardable are excluded from endpoint
+// lookups, though still count towards endpoint availability.
+//
+// Returns false if the node is unknown.
+func (s *State) SetForwardable(id string, forwardable bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == s.localID {
+		s.logger.Warn("set forwardable: cannot update local node")
+		return false
+	}
+	if _, ok := s.nodes[id]; !ok {
+		return false
+	}
+
+	_, unforwardable := s.unforwardable[id]
+	if forwardable == !unforwardable {
+		return true
+	}
+	if forwardable {
+		delete(s.unforwardable, id)
+	} else {
+		s.unforwardable[id] = struct{}{}
+	}
+	s.invalidateSnapshotLocked()
+	return true
+}
+
+// Forwardable returns whether requests can be forwarded to the node with the
+// given ID.
+func (s *State) Forwardable(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, unforwardable := s.unforwardable[id]
+	return !unforwardable
+}
+
 // LookupEndpoint looks up a node that the endpoint with the given ID is active
 // on.
+//
+// If the endpoint is active on multiple nodes, this prefers nodes with idle
+// capacity. Since the reported load may be a few seconds stale, rather than
+// always selecting the least loaded node (which would send all requests to
+// the same node until its load is next reported), this picks two random
+// nodes and selects the one with the fewest active requests per upstream.
+//
+// Since this is called for every forwarded request, it reads from a
+// snapshot without locking. The returned node is shared so must not be
+// modified.
 func (s *State) LookupEndpoint(endpointID string) (*Node, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	candidates := s.loadSnapshot().endpoints[endpointID]
 
-	for _, node := range s.nodes {
-		if node.ID == s.localID {
-			// Ignore ourselves.
-			continue
-		}
-		if node.Status != NodeStatusActive {
-			// Ignore unreachable and left nodes.
-			continue
-		}
-		if listeners, ok := node.Endpoints[endpointID]; ok && listeners > 0 {
-			return node.Copy(), true
-		}
+	switch len(candidates) {
+	case 0:
+		return nil, false
+	case 1:
+		return candidates[0], true
 	}
 
-	return nil, false
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	// Compare requests per upstream (a.requests/a.listeners <
+	// b.requests/b.listeners) without dividing.
+	if b.Load[endpointID].Requests*a.Endpoints[endpointID] <
+		a.Load[endpointID].Requests*b.Endpoints[endpointID] {
+		return b, true
+	}
+	return a, true
+}
+
+// EndpointNodes returns the active remote nodes with at least one upstream
+// for the endpoint with the given ID.
+//
+// Like LookupEndpoint this reads from a snapshot without locking, so the
+// returned nodes are shared and must not be modified.
+func (s *State) EndpointNodes(endpointID string) []*Node {
+	return s.loadSnapshot().endpoints[endpointID]
 }
 
 // AddLocalEndpoint adds the active endpoint to the local node state.
@@ -138,6 +275,7 @@ func (s *State) AddLocalEndpoint(endpointID string) {
 	}
 
 	node.Endpoints[endpointID] = node.Endpoints[endpointID] + 1
+	s.notifyWatchesLocked(endpointID)
 
 	subscribers := make([]func(endpointID string), 0, len(s.localEndpointSubscribers))
 	subscribers = append(subscribers, s.localEndpointSubscribers...)
@@ -174,6 +312,7 @@ func (s *State) RemoveLocalEndpoint(endpointID string) {
 	} else {
 		delete(node.Endpoints, endpointID)
 	}
+	s.notifyWatchesLocked(endpointID)
 
 	subscribers := make([]func(endpointID string), 0, len(s.localEndpointSubscribers))
 	subscribers = append(subscribers, s.localEndpointSubscribers...)
@@ -200,6 +339,72 @@ func (s *State) LocalEndpointListeners(endpointID string) int {
 	return node.Endpoints[endpointID]
 }
 
+// LocalEndpointLoad returns the load on the local nodes upstreams for the
+// endpoint with the given ID, or false if the load is unknown.
+func (s *State) LocalEndpointLoad(endpointID string) (EndpointLoad, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, ok := s.nodes[s.localID]
+	if !ok {
+		panic("local node not in cluster")
+	}
+
+	load, ok := node.Load[endpointID]
+	return load, ok
+}
+
+// UpdateLocalLoad sets the load on the local nodes upstreams for each
+// endpoint. Endpoints missing from the given load are removed.
+//
+// Subscribers are only notified of endpoints whose load changed.
+func (s *State) UpdateLocalLoad(load map[string]EndpointLoad) {
+	s.mu.Lock()
+
+	node, ok := s.nodes[s.localID]
+	if !ok {
+		panic("local node not in cluster")
+	}
+
+	var updated []string
+	for endpointID, endpointLoad := range load {
+		if existing, ok := node.Load[endpointID]; !ok || existing != endpointLoad {
+			updated = append(updated, endpointID)
+		}
+	}
+	for endpointID := range node.Load {
+		if _, ok := load[endpointID]; !ok {
+			updated = append(updated, endpointID)
+		}
+	}
+	sort.Strings(updated)
+
+	node.Load = make(map[string]EndpointLoad, len(load))
+	for endpointID, endpointLoad := range load {
+		node.Load[endpointID] = endpointLoad
+	}
+
+	subscribers := make([]func(endpointID string), 0, len(s.localLoadSubscribers))
+	subscribers = append(subscribers, s.localLoadSubscribers...)
+
+	s.mu.Unlock()
+
+	for _, endpointID := range updated {
+		for _, f := range subscribers {
+			f(endpointID)
+		}
+	}
+}
+
+// OnLocalLoadUpdate subscribes to changes to the load on the local nodes
+// upstreams.
+func (s *State) OnLocalLoadUpdate(f func(endpointID string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.localLoadSubscribers = append(s.localLoadSubscribers, f)
+}
+
 // OnLocalEndpointUpdate subscribes to changes to the local nodes active
 // endpoints.
 //
@@ -219,6 +424,136 @@ func (s *State) OnRemoteEndpointUpdate(f func(nodeID string, endpointID string))
 	s.remoteEndpointSubscribers = append(s.remoteEndpointSubscribers, f)
 }
 
+// OnLocalEndpointResume subscribes to the local node announcing its
+// endpoints are expected to resume.
+func (s *State) OnLocalEndpointResume(f func(endpointID string, deadline time.Time)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.localResumeSubscribers = append(s.localResumeSubscribers, f)
+}
+
+// ResumeLocalEndpoints announces that the upstreams for the local node's
+// active endpoints are expected to resume by the given deadline. Such as
+// when the node is restarting, upstreams reconnect once the node (or another
+// node) is available.
+//
+// This must be called before the local upstreams disconnect.
+func (s *State) ResumeLocalEndpoints(deadline time.Time) {
+	s.mu.Lock()
+
+	node, ok := s.nodes[s.localID]
+	if !ok {
+		panic("local node not in cluster")
+	}
+
+	endpointIDs := make([]string, 0, len(node.Endpoints))
+	for endpointID, listeners := range node.Endpoints {
+		if listeners > 0 {
+			endpointIDs = append(endpointIDs, endpointID)
+		}
+	}
+	sort.Strings(endpointIDs)
+
+	subscribers := make([]func(endpointID string, deadline time.Time), 0, len(s.localResumeSubscribers))
+	subscribers = append(subscribers, s.localResumeSubscribers...)
+
+	s.mu.Unlock()
+
+	for _, endpointID := range endpointIDs {
+		for _, f := range subscribers {
+			f(endpointID, deadline)
+		}
+	}
+}
+
+// AddResumingEndpoint records that the upstreams for the endpoint with the
+// given ID are expected to resume by the given deadline.
+func (s *State) AddResumingEndpoint(endpointID string, deadline time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeExpiredResumingLocked(time.Now())
+
+	if !time.Now().Before(deadline) {
+		return
+	}
+	if existing, ok := s.resuming[endpointID]; ok && existing.After(deadline) {
+		return
+	}
+	s.resuming[endpointID] = deadline
+}
+
+// ResumingEndpoint returns the deadline for the upstreams of the endpoint
+// with the given ID to resume, or false if the endpoint isn't resuming.
+//
+// Once an upstream for the endpoint has connected to any active node the
+// endpoint is no longer resuming.
+func (s *State) ResumingEndpoint(endpointID string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadline, ok := s.resuming[endpointID]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !time.Now().Before(deadline) || s.endpointAvailableLocked(endpointID) {
+		delete(s.resuming, endpointID)
+		return time.Time{}, false
+	}
+	return deadline, true
+}
+
+// LocalDraining returns whether the local node is draining.
+func (s *State) LocalDraining() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	node, ok := s.nodes[s.localID]
+	if !ok {
+		panic("local node not in cluster")
+	}
+	return node.Draining
+}
+
+// DrainZone drains the local node if it is in the given zone. Once draining
+// the local node rejects new upstream connections and other nodes
+// deprioritize forwarding requests to it.
+//
+// Returns true if the local node started draining.
+func (s *State) DrainZone(zone string) bool {
+	s.mu.Lock()
+
+	node, ok := s.nodes[s.localID]
+	if !ok {
+		panic("local node not in cluster")
+	}
+
+	if zone == "" || node.Zone != zone || node.Draining {
+		s.mu.Unlock()
+		return false
+	}
+	node.Draining = true
+
+	subscribers := make([]func(), 0, len(s.localDrainSubscribers))
+	subscribers = append(subscribers, s.localDrainSubscribers...)
+
+	s.mu.Unlock()
+
+	for _, f := range subscribers {
+		f()
+	}
+	return true
+}
+
+// OnLocalDrain subscribes to the local node starting to drain.
+func (s *State) OnLocalDrain(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.localDrainSubscribers = append(s.localDrainSubscribers, f)
+}
+
 // AddNode adds the given node to the cluster.
 func (s *State) AddNode(node *Node) {
 	s.mu.Lock()
@@ -236,7 +571,9 @@ func (s *State) AddNode(node *Node) {
 	}
 
 	s.nodes[node.ID] = node
+	s.invalidateSnapshotLocked()
 	s.addMetricsNode(node.Status)
+	s.notifyNodeWatchesLocked(node)
 }
 
 // RemoveNode removes the node with the given ID from the cluster.
@@ -256,8 +593,15 @@ func (s *State) RemoveNode(id string) bool {
 	}
 
 	delete(s.nodes, id)
+	delete(s.unforwardable, id)
+	s.invalidateSnapshotLocked()
 	s.removeMetricsNode(node.Status)
 
+	s.forwardMu.Lock()
+	delete(s.forwards, id)
+	s.forwardMu.Unlock()
+	s.notifyNodeWatchesLocked(node)
+
 	return true
 }
 
@@ -279,7 +623,35 @@ func (s *State) UpdateRemoteStatus(id string, status NodeStatus) bool {
 
 	oldStatus := n.Status
 	n.Status = status
+	s.invalidateSnapshotLocked()
 	s.updateMetricsNode(oldStatus, status)
+	if oldStatus != status {
+		// The node's endpoints availability changes when the node becomes
+		// active or inactive.
+		s.notifyNodeWatchesLocked(n)
+	}
+	return true
+}
+
+// UpdateRemoteDraining sets whether the remote node with the given ID is
+// draining.
+func (s *State) UpdateRemoteDraining(id string, draining bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == s.localID {
+		s.logger.Warn("update remote draining: cannot update local node")
+		return false
+	}
+
+	n, ok := s.nodes[id]
+	if !ok {
+		s.logger.Warn("update remote draining: node not in cluster")
+		return false
+	}
+
+	n.Draining = draining
+	s.invalidateSnapshotLocked()
 	return true
 }
 
@@ -331,6 +703,148 @@ func (s *State) RemoveRemoteEndpoint(id string, endpointID string) bool {
 	return true
 }
 
+// UpdateRemoteLoad sets the load on the upstreams for the endpoint for the
+// node with the given ID.
+func (s *State) UpdateRemoteLoad(
+	id string,
+	endpointID string,
+	load EndpointLoad,
+) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == s.localID {
+		s.logger.Warn("update remote load: cannot update local node")
+		return false
+	}
+
+	n, ok := s.nodes[id]
+	if !ok {
+		s.logger.Warn("update remote load: node not in cluster")
+		return false
+	}
+
+	if n.Load == nil {
+		n.Load = make(map[string]EndpointLoad)
+	}
+	n.Load[endpointID] = load
+	s.invalidateSnapshotLocked()
+	return true
+}
+
+// RemoveRemoteLoad removes the load on the upstreams for the endpoint from
+// the node with the given ID.
+func (s *State) RemoveRemoteLoad(id string, endpointID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == s.localID {
+		s.logger.Warn("remove remote load: cannot update local node")
+		return false
+	}
+
+	n, ok := s.nodes[id]
+	if !ok {
+		s.logger.Warn("remove remote load: node not in cluster")
+		return false
+	}
+
+	delete(n.Load, endpointID)
+	s.invalidateSnapshotLocked()
+	return true
+}
+
+// Endpoint returns the availability of the endpoint with the given ID across
+// the active nodes in the cluster.
+func (s *State) Endpoint(endpointID string) *Endpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	endpoint := &Endpoint{
+		ID: endpointID,
+	}
+	for _, node := range s.nodes {
+		if node.Status != NodeStatusActive {
+			continue
+		}
+		if listeners := node.Endpoints[endpointID]; listeners > 0 {
+			if endpoint.Nodes == nil {
+				endpoint.Nodes = make(map[string]int)
+			}
+			endpoint.Nodes[node.ID] = listeners
+			endpoint.Upstreams += listeners
+		}
+	}
+	return endpoint
+}
+
+// Endpoints returns the availability of the endpoints with at least one
+// upstream on an active node in the cluster, sorted by endpoint ID.
+func (s *State) Endpoints() []*Endpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	endpoints := make(map[string]*Endpoint)
+	for _, node := range s.nodes {
+		if node.Status != NodeStatusActive {
+			continue
+		}
+		for endpointID, listeners := range node.Endpoints {
+			if listeners == 0 {
+				continue
+			}
+			endpoint, ok := endpoints[endpointID]
+			if !ok {
+				endpoint = &Endpoint{
+					ID:    endpointID,
+					Nodes: make(map[string]int),
+				}
+				endpoints[endpointID] = endpoint
+			}
+			endpoint.Nodes[node.ID] = listeners
+			endpoint.Upstreams += listeners
+		}
+	}
+
+	sorted := make([]*Endpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		sorted = append(sorted, endpoint)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
+
+// EndpointHistory returns the number of upstreams connected for the endpoint
+// across the active nodes in the cluster for each minute in the last hour,
+// oldest first.
+func (s *State) EndpointHistory(endpointID string) []AvailabilitySample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.history.Samples(endpointID, time.Now())
+}
+
+// WatchEndpoints watches for changes to the availability of the endpoint with
+// the given ID, or all endpoints if the ID is empty.
+//
+// The watch must be closed once it is no longer needed.
+func (s *State) WatchEndpoints(endpointID string) *EndpointWatch {
+	w := &EndpointWatch{
+		endpointID: endpointID,
+		pending:    make(map[string]struct{}),
+		notifyCh:   make(chan struct{}, 1),
+		state:      s,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.watches[w] = struct{}{}
+	return w
+}
+
 func (s *State) Metrics() *Metrics {
 	return s.metrics
 }
@@ -356,6 +870,8 @@ func (s *State) updateRemoteEndpointLocked(
 	}
 
 	n.Endpoints[endpointID] = listeners
+	s.invalidateSnapshotLocked()
+	s.notifyWatchesLocked(endpointID)
 
 	return true
 }
@@ -375,10 +891,98 @@ func (s *State) removeRemoteEndpointLocked(id string, endpointID string) bool {
 	if n.Endpoints != nil {
 		delete(n.Endpoints, endpointID)
 	}
+	s.invalidateSnapshotLocked()
+	s.notifyWatchesLocked(endpointID)
 
 	return true
 }
 
+// endpointAvailableLocked returns whether the endpoint with the given ID has
+// an upstream connected to an active node.
+func (s *State) endpointAvailableLocked(endpointID string) bool {
+	for _, node := range s.nodes {
+		if node.Status != NodeStatusActive {
+			continue
+		}
+		if node.Endpoints[endpointID] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// removeExpiredResumingLocked discards resuming endpoints whose deadline has
+// passed.
+func (s *State) removeExpiredResumingLocked(t time.Time) {
+	for endpointID, deadline := range s.resuming {
+		if !t.Before(deadline) {
+			delete(s.resuming, endpointID)
+		}
+	}
+}
+
+// loadSnapshot returns the current snapshot, building a new snapshot if the
+// state changed since the last snapshot.
+func (s *State) loadSnapshot() *snapshot {
+	if snap := s.snapshot.Load(); snap != nil {
+		return snap
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Store the snapshot with the mutex held so an update can't discard the
+	// snapshot before it's stored.
+	snap := newSnapshot(s.localID, s.nodes, s.unforwardable)
+	s.snapshot.Store(snap)
+	return snap
+}
+
+// invalidateSnapshotLocked discards the snapshot after a remote node was
+// updated.
+func (s *State) invalidateSnapshotLocked() {
+	s.snapshot.Store(nil)
+}
+
+func (s *State) removeWatch(w *EndpointWatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.watches, w)
+}
+
+// notifyWatchesLocked notifies the watches that the availability of the
+// endpoint may have changed, and records the availability in the history.
+//
+// Watches don't block, so it is safe to notify with the mutex locked.
+func (s *State) notifyWatchesLocked(endpointID string) {
+	s.history.Record(endpointID, s.endpointUpstreamsLocked(endpointID), time.Now())
+
+	for w := range s.watches {
+		w.notify(endpointID)
+	}
+}
+
+// endpointUpstreamsLocked returns the number of upstreams connected for the
+// endpoint across the active nodes in the cluster.
+func (s *State) endpointUpstreamsLocked(endpointID string) int {
+	upstreams := 0
+	for _, node := range s.nodes {
+		if node.Status == NodeStatusActive {
+			upstreams += node.Endpoints[endpointID]
+		}
+	}
+	return upstreams
+}
+
+// notifyNodeWatchesLocked notifies the watches that the availability of the
+// nodes endpoints may have changed.
+func (s *State) notifyNodeWatchesLocked(node *Node) {
+	for endpointID := range node.Endpoints {
+		s.notifyWatchesLocked(endpointID)
+	}
+}
+
 func (s *State) updateMetricsNode(oldStatus NodeStatus, newStatus NodeStatus) {
 	s.removeMetricsNode(oldStatus)
 	s.addMetricsNode(newStatus)
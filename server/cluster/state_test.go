@@ -1,10 +1,13 @@
 package cluster
 
 import (
+	"fmt"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/andydunstall/piko/pkg/log"
 )
@@ -171,6 +174,50 @@ func TestState_RemoveNode(t *testing.T) {
 	})
 }
 
+func TestState_ObserveForward(t *testing.T) {
+	t.Run("observe", func(t *testing.T) {
+		s := NewState(&Node{ID: "local"}, log.NewNopLogger())
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+
+		s.ObserveForward("remote", true)
+		s.ObserveForward("remote", false)
+
+		for _, node := range s.NodesMetadata() {
+			if node.ID == "local" {
+				assert.Nil(t, node.Forwarded)
+				continue
+			}
+			assert.Equal(t, &ForwardStats{
+				Requests:    2,
+				Errors:      1,
+				SuccessRate: 0.5,
+			}, node.Forwarded)
+		}
+	})
+
+	t.Run("unknown node", func(t *testing.T) {
+		s := NewState(&Node{ID: "local"}, log.NewNopLogger())
+
+		s.ObserveForward("remote", true)
+		assert.Empty(t, s.forwards)
+	})
+
+	t.Run("remove node", func(t *testing.T) {
+		s := NewState(&Node{ID: "local"}, log.NewNopLogger())
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+
+		s.ObserveForward("remote", true)
+		assert.True(t, s.RemoveNode("remote"))
+		assert.Empty(t, s.forwards)
+	})
+}
+
 func TestState_UpdateRemoteStatus(t *testing.T) {
 	t.Run("update status", func(t *testing.T) {
 		localNode := &Node{
@@ -291,6 +338,149 @@ func TestState_RemoveRemoteEndpoint(t *testing.T) {
 	})
 }
 
+func TestState_EndpointNodes(t *testing.T) {
+	s := NewState(&Node{
+		ID:     "local",
+		Status: NodeStatusActive,
+	}, log.NewNopLogger())
+	s.AddLocalEndpoint("my-endpoint")
+
+	s.AddNode(&Node{
+		ID:     "remote-1",
+		Status: NodeStatusActive,
+	})
+	assert.True(t, s.UpdateRemoteEndpoint("remote-1", "my-endpoint", 3))
+	s.AddNode(&Node{
+		ID:     "remote-2",
+		Status: NodeStatusUnreachable,
+	})
+	assert.True(t, s.UpdateRemoteEndpoint("remote-2", "my-endpoint", 1))
+
+	// Only includes active remote nodes.
+	nodes := s.EndpointNodes("my-endpoint")
+	require.Len(t, nodes, 1)
+	assert.Equal(t, "remote-1", nodes[0].ID)
+	assert.Equal(t, 3, nodes[0].Endpoints["my-endpoint"])
+
+	assert.Empty(t, s.EndpointNodes("unknown"))
+}
+
+func TestState_SetForwardable(t *testing.T) {
+	s := NewState(&Node{
+		ID: "local",
+	}, log.NewNopLogger())
+
+	s.AddNode(&Node{
+		ID:     "remote-1",
+		Status: NodeStatusActive,
+	})
+	assert.True(t, s.UpdateRemoteEndpoint("remote-1", "my-endpoint", 1))
+	s.AddNode(&Node{
+		ID:     "remote-2",
+		Status: NodeStatusActive,
+	})
+	assert.True(t, s.UpdateRemoteEndpoint("remote-2", "my-endpoint", 1))
+
+	// Unforwardable nodes are excluded from lookups.
+	assert.True(t, s.SetForwardable("remote-2", false))
+	assert.False(t, s.Forwardable("remote-2"))
+	nodes := s.EndpointNodes("my-endpoint")
+	require.Len(t, nodes, 1)
+	assert.Equal(t, "remote-1", nodes[0].ID)
+	for i := 0; i != 10; i++ {
+		node, ok := s.LookupEndpoint("my-endpoint")
+		require.True(t, ok)
+		assert.Equal(t, "remote-1", node.ID)
+	}
+
+	// Unforwardable nodes still count towards availability.
+	assert.Equal(t, 2, s.Endpoint("my-endpoint").Upstreams)
+
+	assert.True(t, s.SetForwardable("remote-2", true))
+	assert.True(t, s.Forwardable("remote-2"))
+	assert.Len(t, s.EndpointNodes("my-endpoint"), 2)
+
+	assert.False(t, s.SetForwardable("unknown", false))
+	assert.False(t, s.SetForwardable("local", false))
+
+	// Removing the node discards whether it's forwardable.
+	assert.True(t, s.SetForwardable("remote-2", false))
+	assert.True(t, s.RemoveNode("remote-2"))
+	assert.True(t, s.Forwardable("remote-2"))
+}
+
+func TestState_DrainZone(t *testing.T) {
+	t.Run("local zone", func(t *testing.T) {
+		s := NewState(&Node{
+			ID:   "local",
+			Zone: "us-east-1a",
+		}, log.NewNopLogger())
+
+		drained := 0
+		s.OnLocalDrain(func() {
+			drained++
+		})
+
+		assert.True(t, s.DrainZone("us-east-1a"))
+		assert.True(t, s.LocalDraining())
+		assert.Equal(t, 1, drained)
+
+		// Draining again is a no-op.
+		assert.False(t, s.DrainZone("us-east-1a"))
+		assert.Equal(t, 1, drained)
+	})
+
+	t.Run("other zone", func(t *testing.T) {
+		s := NewState(&Node{
+			ID:   "local",
+			Zone: "us-east-1a",
+		}, log.NewNopLogger())
+
+		assert.False(t, s.DrainZone("us-east-1b"))
+		assert.False(t, s.LocalDraining())
+	})
+
+	t.Run("no zone", func(t *testing.T) {
+		s := NewState(&Node{
+			ID: "local",
+		}, log.NewNopLogger())
+
+		assert.False(t, s.DrainZone(""))
+		assert.False(t, s.LocalDraining())
+	})
+}
+
+func TestState_EndpointNodesDraining(t *testing.T) {
+	s := NewState(&Node{
+		ID: "local",
+	}, log.NewNopLogger())
+
+	s.AddNode(&Node{
+		ID:     "remote-1",
+		Status: NodeStatusActive,
+	})
+	assert.True(t, s.UpdateRemoteEndpoint("remote-1", "endpoint-1", 1))
+	assert.True(t, s.UpdateRemoteEndpoint("remote-1", "endpoint-2", 1))
+	s.AddNode(&Node{
+		ID:     "remote-2",
+		Status: NodeStatusActive,
+	})
+	assert.True(t, s.UpdateRemoteEndpoint("remote-2", "endpoint-1", 1))
+	assert.True(t, s.UpdateRemoteDraining("remote-2", true))
+
+	// Draining nodes are excluded when other nodes have an upstream.
+	nodes := s.EndpointNodes("endpoint-1")
+	require.Len(t, nodes, 1)
+	assert.Equal(t, "remote-1", nodes[0].ID)
+
+	// Fall back to draining nodes if no other nodes have an upstream.
+	assert.True(t, s.UpdateRemoteDraining("remote-1", true))
+	nodes = s.EndpointNodes("endpoint-2")
+	require.Len(t, nodes, 1)
+	assert.Equal(t, "remote-1", nodes[0].ID)
+	assert.Len(t, s.EndpointNodes("endpoint-1"), 2)
+}
+
 func TestState_LookupEndpoint(t *testing.T) {
 	t.Run("found", func(t *testing.T) {
 		localNode := &Node{
@@ -364,4 +554,363 @@ func TestState_LookupEndpoint(t *testing.T) {
 		_, ok := s.LookupEndpoint("my-endpoint-2")
 		assert.False(t, ok)
 	})
+
+	t.Run("updated after lookup", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote", "my-endpoint", 1))
+
+		node, ok := s.LookupEndpoint("my-endpoint")
+		assert.True(t, ok)
+		assert.Equal(t, 1, node.Endpoints["my-endpoint"])
+
+		// Lookups must reflect updates since the last lookup.
+		assert.True(t, s.UpdateRemoteEndpoint("remote", "my-endpoint", 3))
+		node, ok = s.LookupEndpoint("my-endpoint")
+		assert.True(t, ok)
+		assert.Equal(t, 3, node.Endpoints["my-endpoint"])
+
+		assert.True(t, s.UpdateRemoteStatus("remote", NodeStatusUnreachable))
+		_, ok = s.LookupEndpoint("my-endpoint")
+		assert.False(t, ok)
+
+		assert.True(t, s.UpdateRemoteStatus("remote", NodeStatusActive))
+		assert.True(t, s.RemoveRemoteEndpoint("remote", "my-endpoint"))
+		_, ok = s.LookupEndpoint("my-endpoint")
+		assert.False(t, ok)
+	})
+
+	t.Run("prefer idle capacity", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		s.AddNode(&Node{
+			ID:     "busy",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("busy", "my-endpoint", 2))
+		assert.True(t, s.UpdateRemoteLoad("busy", "my-endpoint", EndpointLoad{
+			Requests: 10,
+		}))
+
+		s.AddNode(&Node{
+			ID:     "idle",
+			Status: NodeStatusActive,
+		})
+		// Has fewer requests per upstream.
+		assert.True(t, s.UpdateRemoteEndpoint("idle", "my-endpoint", 4))
+		assert.True(t, s.UpdateRemoteLoad("idle", "my-endpoint", EndpointLoad{
+			Requests: 12,
+		}))
+
+		// With two candidates both are always compared.
+		for i := 0; i != 10; i++ {
+			node, ok := s.LookupEndpoint("my-endpoint")
+			assert.True(t, ok)
+			assert.Equal(t, "idle", node.ID)
+		}
+	})
+}
+
+// BenchmarkState_LookupEndpoint benchmarks looking up endpoints in a large
+// cluster concurrently with updates to the remote nodes.
+func BenchmarkState_LookupEndpoint(b *testing.B) {
+	s := NewState(&Node{
+		ID:     "local",
+		Status: NodeStatusActive,
+	}, log.NewNopLogger())
+
+	const nodes = 20
+	const endpoints = 1000
+	for i := 0; i != nodes; i++ {
+		nodeID := fmt.Sprintf("node-%d", i)
+		s.AddNode(&Node{
+			ID:     nodeID,
+			Status: NodeStatusActive,
+		})
+		for j := 0; j != endpoints; j++ {
+			// Each endpoint is active on two nodes.
+			if j%(nodes/2) == i%(nodes/2) {
+				s.UpdateRemoteEndpoint(nodeID, fmt.Sprintf("endpoint-%d", j), 1)
+			}
+		}
+	}
+
+	// Update the load on the remote nodes in the background, similar to
+	// receiving load updates via gossip.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 10)
+		defer ticker.Stop()
+
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			s.UpdateRemoteLoad(
+				fmt.Sprintf("node-%d", i%nodes),
+				fmt.Sprintf("endpoint-%d", i%endpoints),
+				EndpointLoad{Requests: i % 10},
+			)
+		}
+	}()
+
+	endpointIDs := make([]string, endpoints)
+	for i := range endpointIDs {
+		endpointIDs[i] = fmt.Sprintf("endpoint-%d", i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, ok := s.LookupEndpoint(endpointIDs[i%endpoints]); !ok {
+				b.Error("endpoint not found")
+			}
+		}
+	})
+}
+
+func TestState_UpdateLocalLoad(t *testing.T) {
+	localNode := &Node{
+		ID:     "local",
+		Status: NodeStatusActive,
+	}
+	s := NewState(localNode.Copy(), log.NewNopLogger())
+
+	var updates []string
+	s.OnLocalLoadUpdate(func(endpointID string) {
+		updates = append(updates, endpointID)
+	})
+
+	s.UpdateLocalLoad(map[string]EndpointLoad{
+		"my-endpoint-1": {Requests: 1, Ages: [3]int{1, 0, 0}},
+		"my-endpoint-2": {Requests: 3, Ages: [3]int{0, 2, 0}},
+	})
+	assert.Equal(t, []string{"my-endpoint-1", "my-endpoint-2"}, updates)
+
+	load, ok := s.LocalEndpointLoad("my-endpoint-2")
+	assert.True(t, ok)
+	assert.Equal(t, EndpointLoad{Requests: 3, Ages: [3]int{0, 2, 0}}, load)
+
+	// Only changed and removed endpoints are notified.
+	updates = nil
+	s.UpdateLocalLoad(map[string]EndpointLoad{
+		"my-endpoint-1": {Requests: 1, Ages: [3]int{1, 0, 0}},
+		"my-endpoint-3": {Requests: 5, Ages: [3]int{1, 0, 0}},
+	})
+	assert.Equal(t, []string{"my-endpoint-2", "my-endpoint-3"}, updates)
+
+	_, ok = s.LocalEndpointLoad("my-endpoint-2")
+	assert.False(t, ok)
+}
+
+func TestState_Endpoints(t *testing.T) {
+	localNode := &Node{
+		ID:     "local",
+		Status: NodeStatusActive,
+	}
+	s := NewState(localNode.Copy(), log.NewNopLogger())
+
+	s.AddLocalEndpoint("endpoint-1")
+	s.AddNode(&Node{
+		ID:     "remote-1",
+		Status: NodeStatusActive,
+		Endpoints: map[string]int{
+			"endpoint-1": 2,
+			"endpoint-2": 1,
+		},
+	})
+	// Endpoints on inactive nodes are unavailable.
+	s.AddNode(&Node{
+		ID:     "remote-2",
+		Status: NodeStatusUnreachable,
+		Endpoints: map[string]int{
+			"endpoint-3": 1,
+		},
+	})
+
+	assert.Equal(t, []*Endpoint{
+		{
+			ID:        "endpoint-1",
+			Upstreams: 3,
+			Nodes:     map[string]int{"local": 1, "remote-1": 2},
+		},
+		{
+			ID:        "endpoint-2",
+			Upstreams: 1,
+			Nodes:     map[string]int{"remote-1": 1},
+		},
+	}, s.Endpoints())
+
+	assert.Equal(t, &Endpoint{
+		ID:        "endpoint-2",
+		Upstreams: 1,
+		Nodes:     map[string]int{"remote-1": 1},
+	}, s.Endpoint("endpoint-2"))
+	assert.False(t, s.Endpoint("endpoint-3").Available())
+}
+
+func TestState_WatchEndpoints(t *testing.T) {
+	t.Run("all endpoints", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		w := s.WatchEndpoints("")
+		defer w.Close()
+
+		s.AddLocalEndpoint("endpoint-1")
+		s.AddLocalEndpoint("endpoint-1")
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+			Endpoints: map[string]int{
+				"endpoint-2": 1,
+			},
+		})
+
+		<-w.Notify()
+		// Updates are coalesced.
+		assert.Equal(t, []*Endpoint{
+			{
+				ID:        "endpoint-1",
+				Upstreams: 2,
+				Nodes:     map[string]int{"local": 2},
+			},
+			{
+				ID:        "endpoint-2",
+				Upstreams: 1,
+				Nodes:     map[string]int{"remote": 1},
+			},
+		}, w.Updates())
+
+		// The remote nodes endpoints become unavailable when the node is
+		// unreachable.
+		s.UpdateRemoteStatus("remote", NodeStatusUnreachable)
+
+		<-w.Notify()
+		assert.Equal(t, []*Endpoint{
+			{
+				ID: "endpoint-2",
+			},
+		}, w.Updates())
+	})
+
+	t.Run("single endpoint", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		w := s.WatchEndpoints("endpoint-1")
+		defer w.Close()
+
+		s.AddLocalEndpoint("endpoint-2")
+		s.AddLocalEndpoint("endpoint-1")
+		s.RemoveLocalEndpoint("endpoint-1")
+
+		<-w.Notify()
+		assert.Equal(t, []*Endpoint{
+			{
+				ID: "endpoint-1",
+			},
+		}, w.Updates())
+	})
+
+	t.Run("close", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		w := s.WatchEndpoints("")
+		w.Close()
+
+		s.AddLocalEndpoint("endpoint-1")
+		assert.Empty(t, w.Updates())
+	})
+}
+
+func TestState_ResumingEndpoint(t *testing.T) {
+	t.Run("resuming", func(t *testing.T) {
+		state := NewState(&Node{
+			ID: "local",
+		}, log.NewNopLogger())
+
+		deadline := time.Now().Add(time.Minute)
+		state.AddResumingEndpoint("my-endpoint", deadline)
+
+		resumeDeadline, ok := state.ResumingEndpoint("my-endpoint")
+		assert.True(t, ok)
+		assert.Equal(t, deadline, resumeDeadline)
+
+		// An earlier deadline doesn't replace the existing deadline.
+		state.AddResumingEndpoint("my-endpoint", time.Now().Add(time.Second))
+		resumeDeadline, _ = state.ResumingEndpoint("my-endpoint")
+		assert.Equal(t, deadline, resumeDeadline)
+
+		_, ok = state.ResumingEndpoint("unknown")
+		assert.False(t, ok)
+	})
+
+	t.Run("resumed", func(t *testing.T) {
+		state := NewState(&Node{
+			ID: "local",
+		}, log.NewNopLogger())
+		state.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+
+		state.AddResumingEndpoint("my-endpoint", time.Now().Add(time.Minute))
+
+		// Once an upstream connects to any node the endpoint has resumed.
+		state.UpdateRemoteEndpoint("remote", "my-endpoint", 1)
+		_, ok := state.ResumingEndpoint("my-endpoint")
+		assert.False(t, ok)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		state := NewState(&Node{
+			ID: "local",
+		}, log.NewNopLogger())
+
+		state.AddResumingEndpoint("my-endpoint", time.Now().Add(-time.Second))
+		_, ok := state.ResumingEndpoint("my-endpoint")
+		assert.False(t, ok)
+	})
+
+	t.Run("resume local endpoints", func(t *testing.T) {
+		state := NewState(&Node{
+			ID: "local",
+		}, log.NewNopLogger())
+		state.AddLocalEndpoint("endpoint-1")
+		state.AddLocalEndpoint("endpoint-2")
+
+		var resumed []string
+		state.OnLocalEndpointResume(func(endpointID string, _ time.Time) {
+			resumed = append(resumed, endpointID)
+		})
+
+		state.ResumeLocalEndpoints(time.Now().Add(time.Minute))
+		assert.Equal(t, []string{"endpoint-1", "endpoint-2"}, resumed)
+	})
 }
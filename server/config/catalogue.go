@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+)
+
+// CatalogueEndpointConfig describes an endpoint in the endpoint catalogue.
+type CatalogueEndpointConfig struct {
+	// ID is the endpoint ID.
+	ID string `json:"id" yaml:"id"`
+
+	// Description is a human readable description of the endpoint.
+	Description string `json:"description" yaml:"description"`
+
+	// Owner identifies who owns the endpoint, such as a team or an email
+	// address.
+	Owner string `json:"owner" yaml:"owner"`
+
+	// Tags contains arbitrary tags to categorise the endpoint.
+	Tags []string `json:"tags" yaml:"tags"`
+}
+
+func (c *CatalogueEndpointConfig) Validate() error {
+	c.ID = normalizeEndpointID(c.ID)
+	if c.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+	return nil
+}
+
+// CatalogueConfig configures the endpoint catalogue, which contains
+// human readable metadata about endpoints, such as a description and owner.
+//
+// The catalogue is optional, and doesn't restrict which endpoints can
+// register.
+type CatalogueConfig struct {
+	// Endpoints contains the catalogue entry for each endpoint.
+	Endpoints []CatalogueEndpointConfig `json:"endpoints" yaml:"endpoints"`
+}
+
+func (c *CatalogueConfig) Validate() error {
+	ids := make(map[string]struct{})
+	for i := range c.Endpoints {
+		endpoint := &c.Endpoints[i]
+		if err := endpoint.Validate(); err != nil {
+			return fmt.Errorf("endpoints[%d]: %w", i, err)
+		}
+		if _, ok := ids[endpoint.ID]; ok {
+			return fmt.Errorf("endpoints[%d]: duplicate id: %s", i, endpoint.ID)
+		}
+		ids[endpoint.ID] = struct{}{}
+	}
+	return nil
+}
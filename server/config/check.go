@@ -0,0 +1,86 @@
+package config
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+
+	pikoconfig "github.com/andydunstall/piko/pkg/config"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/plugin"
+)
+
+// Check fully validates the configuration without starting the server, such
+// as to verify a configuration in CI before deploying.
+//
+// As well as Validate, this loads the TLS certificates, parses the auth keys,
+// loads the plugin filters, and checks each listen and advertise address can
+// be resolved. If Validate fails only the validation error is returned,
+// otherwise all issues found are returned.
+func (c *Config) Check() []pikoconfig.Issue {
+	if err := c.Validate(); err != nil {
+		return []pikoconfig.Issue{{Message: err.Error()}}
+	}
+
+	var issues []pikoconfig.Issue
+	addIssue := func(field string, err error) {
+		if err != nil {
+			issues = append(issues, pikoconfig.Issue{
+				Field:   field,
+				Message: err.Error(),
+			})
+		}
+	}
+
+	addrs := []struct {
+		field string
+		addr  string
+	}{
+		{"proxy.bind_addr", c.Proxy.BindAddr},
+		{"proxy.advertise_addr", c.Proxy.AdvertiseAddr},
+		{"proxy.forward.bind_addr", c.Proxy.Forward.BindAddr},
+		{"proxy.forward.advertise_addr", c.Proxy.Forward.AdvertiseAddr},
+		{"upstream.bind_addr", c.Upstream.BindAddr},
+		{"upstream.advertise_addr", c.Upstream.AdvertiseAddr},
+		{"admin.bind_addr", c.Admin.BindAddr},
+		{"admin.advertise_addr", c.Admin.AdvertiseAddr},
+		{"admin.grpc_bind_addr", c.Admin.GRPCBindAddr},
+		{"admin.health_bind_addr", c.Admin.HealthBindAddr},
+		{"metrics.bind_addr", c.Metrics.BindAddr},
+		{"gossip.bind_addr", c.Gossip.BindAddr},
+		{"gossip.advertise_addr", c.Gossip.AdvertiseAddr},
+	}
+	for _, addr := range addrs {
+		// Advertise addresses default to the bind address, and the forward,
+		// gRPC admin API, health and metrics listeners are optional.
+		if addr.addr == "" {
+			continue
+		}
+		addIssue(addr.field, pikoconfig.CheckAddr(addr.addr))
+	}
+
+	_, err := c.Proxy.TLS.Load()
+	addIssue("proxy.tls", err)
+	_, err = c.Proxy.Forward.TLS.Load()
+	addIssue("proxy.forward.tls", err)
+	_, err = c.Upstream.TLS.Load()
+	addIssue("upstream.tls", err)
+	_, err = c.Admin.TLS.Load()
+	addIssue("admin.tls", err)
+	_, err = c.Metrics.TLS.Load()
+	addIssue("metrics.tls", err)
+
+	if c.Auth.TokenRSAPublicKey != "" {
+		_, err := jwt.ParseRSAPublicKeyFromPEM([]byte(c.Auth.TokenRSAPublicKey))
+		addIssue("auth.token_rsa_public_key", err)
+	}
+	if c.Auth.TokenECDSAPublicKey != "" {
+		_, err := jwt.ParseECPublicKeyFromPEM([]byte(c.Auth.TokenECDSAPublicKey))
+		addIssue("auth.token_ecdsa_public_key", err)
+	}
+
+	if c.Plugin.Enabled() {
+		_, err := plugin.New(c.Plugin, log.NewNopLogger())
+		addIssue("plugin.filters", err)
+	}
+
+	return issues
+}
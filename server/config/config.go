@@ -6,9 +6,15 @@ import (
 
 	"github.com/spf13/pflag"
 
+	pikoconfig "github.com/andydunstall/piko/pkg/config"
 	"github.com/andydunstall/piko/pkg/gossip"
+	"github.com/andydunstall/piko/pkg/keepalive"
 	"github.com/andydunstall/piko/pkg/log"
+	pikoruntime "github.com/andydunstall/piko/pkg/runtime"
+	"github.com/andydunstall/piko/server/audit"
 	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/plugin"
+	"github.com/andydunstall/piko/server/storage"
 )
 
 type ClusterConfig struct {
@@ -27,6 +33,14 @@ type ClusterConfig struct {
 	JoinTimeout time.Duration `json:"join_timeout" yaml:"join_timeout"`
 
 	AbortIfJoinFails bool `json:"abort_if_join_fails" yaml:"abort_if_join_fails"`
+
+	// AdvertiseHost is the host, either an IP or a DNS name, to advertise to
+	// other nodes for listeners without an advertise address.
+	AdvertiseHost string `json:"advertise_host" yaml:"advertise_host"`
+
+	// Zone is the availability zone the node is running in, used to drain
+	// all nodes in a zone.
+	Zone string `json:"zone" yaml:"zone"`
 }
 
 func (c *ClusterConfig) Validate() error {
@@ -36,6 +50,11 @@ func (c *ClusterConfig) Validate() error {
 	if c.JoinTimeout == 0 {
 		return fmt.Errorf("missing join timeout")
 	}
+	if c.AdvertiseHost != "" {
+		if err := pikoconfig.ValidateHost(c.AdvertiseHost); err != nil {
+			return fmt.Errorf("invalid advertise host: %w", err)
+		}
+	}
 
 	return nil
 }
@@ -101,6 +120,39 @@ set.`,
 Whether the server node should abort if it is configured with more than one
 node to join (excluding itself) but fails to join any members.`,
 	)
+
+	fs.StringVar(
+		&c.AdvertiseHost,
+		"cluster.advertise-host",
+		c.AdvertiseHost,
+		`
+Host to advertise to other nodes in the cluster for listeners without an
+advertise address, which may be an IP or a DNS name.
+
+Each listener advertises the host with the port it's listening on, such as
+'--cluster.advertise-host node1.internal' with a proxy bind address of
+':8000' advertises the proxy address 'node1.internal:8000'. This avoids
+configuring the advertise address of each listener, such as when the node's
+private IP isn't reachable by other nodes due to NAT.
+
+Other nodes resolve DNS names when they connect to the node, and re-resolve
+them periodically, closing idle connections if the IPs the name resolves to
+change.
+
+By default the bind address IP is used if given, otherwise the node's private
+IP.`,
+	)
+
+	fs.StringVar(
+		&c.Zone,
+		"cluster.zone",
+		c.Zone,
+		`
+The availability zone the node is running in, such as 'us-east-1a'.
+
+The zone is propagated to the other nodes in the cluster, so all nodes in a
+zone can be drained using the admin API, such as to evacuate the zone.`,
+	)
 }
 
 // HTTPConfig contains generic configuration for the HTTP servers.
@@ -126,6 +178,10 @@ type HTTPConfig struct {
 	// server will read parsing the request header's keys and
 	// values, including the request line.
 	MaxHeaderBytes int `json:"max_header_bytes" yaml:"max_header_bytes"`
+
+	// MaxConcurrentStreams is the maximum number of concurrent requests
+	// each HTTP/2 client may open on a connection. If zero, defaults to 250.
+	MaxConcurrentStreams uint32 `json:"max_concurrent_streams" yaml:"max_concurrent_streams"`
 }
 
 func (c *HTTPConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
@@ -174,6 +230,15 @@ enabled.`,
 The maximum number of bytes the server will read parsing the request header's
 keys and values, including the request line.`,
 	)
+	fs.Uint32Var(
+		&c.MaxConcurrentStreams,
+		prefix+"max-concurrent-streams",
+		c.MaxConcurrentStreams,
+		`
+The maximum number of concurrent requests each HTTP/2 client may open on a
+connection, including nodes forwarding requests over HTTP/2. If zero, defaults
+to 250.`,
+	)
 }
 
 type ProxyConfig struct {
@@ -192,6 +257,42 @@ type ProxyConfig struct {
 
 	HTTP HTTPConfig `json:"http" yaml:"http"`
 
+	// Retry configures retrying requests when no upstream is connected.
+	Retry RetryConfig `json:"retry" yaml:"retry"`
+
+	// Forward configures forwarding requests to other nodes.
+	Forward ForwardConfig `json:"forward" yaml:"forward"`
+
+	// Failover configures fallback endpoints for endpoints with no
+	// upstreams.
+	Failover FailoverConfig `json:"failover" yaml:"failover"`
+
+	// Offline configures static content to serve for endpoints with no
+	// upstreams.
+	Offline OfflineConfig `json:"offline" yaml:"offline"`
+
+	// Provenance configures verifying responses were signed by the agents
+	// for an endpoint.
+	Provenance ProvenanceConfig `json:"provenance" yaml:"provenance"`
+
+	// Headers configures which internal headers are accepted from clients
+	// and forwarded to upstreams.
+	Headers HeadersConfig `json:"headers" yaml:"headers"`
+
+	// TCPAffinity configures routing TCP connections from the same client to
+	// the same upstream.
+	TCPAffinity AffinityConfig `json:"tcp_affinity" yaml:"tcp_affinity"`
+
+	// TCP configures the listener and limits for proxied TCP connections.
+	TCP ProxyTCPConfig `json:"tcp" yaml:"tcp"`
+
+	// Shedding configures shedding requests when the node is overloaded.
+	Shedding SheddingConfig `json:"shedding" yaml:"shedding"`
+
+	// HTTP3 indicates whether to also accept HTTP/3 (QUIC) connections on
+	// the UDP port matching the proxy listener port. Requires TLS.
+	HTTP3 bool `json:"http3" yaml:"http3"`
+
 	TLS TLSConfig `json:"tls" yaml:"tls"`
 }
 
@@ -199,12 +300,56 @@ func (c *ProxyConfig) Validate() error {
 	if c.BindAddr == "" {
 		return fmt.Errorf("missing bind addr")
 	}
+	if c.AdvertiseAddr != "" {
+		if err := pikoconfig.ValidateAdvertiseAddr(c.AdvertiseAddr); err != nil {
+			return fmt.Errorf("invalid advertise addr: %w", err)
+		}
+	}
 	if c.Timeout == 0 {
 		return fmt.Errorf("missing timeout")
 	}
+	if err := c.Retry.Validate(); err != nil {
+		return fmt.Errorf("retry: %w", err)
+	}
+	if err := c.Forward.Validate(); err != nil {
+		return fmt.Errorf("forward: %w", err)
+	}
+	if err := c.Failover.Validate(); err != nil {
+		return fmt.Errorf("failover: %w", err)
+	}
+	if err := c.Offline.Validate(); err != nil {
+		return fmt.Errorf("offline: %w", err)
+	}
+	if err := c.Provenance.Validate(); err != nil {
+		return fmt.Errorf("provenance: %w", err)
+	}
+	if err := c.Headers.Validate(); err != nil {
+		return fmt.Errorf("headers: %w", err)
+	}
+	if c.Headers.ClientCert != "" && !c.TLS.ClientAuthEnabled() {
+		return fmt.Errorf("headers: client cert requires tls client auth")
+	}
+	// Without a forward listener, nodes forward requests to the proxy
+	// listener, so the proxy listener couldn't distinguish the client cert
+	// header added by another node from a header forged by a client.
+	if c.Headers.ClientCert != "" && !c.Forward.Enabled() {
+		return fmt.Errorf("headers: client cert requires a forward listener")
+	}
+	if err := c.TCP.Validate(); err != nil {
+		return fmt.Errorf("tcp: %w", err)
+	}
+	if err := c.TCPAffinity.Validate(); err != nil {
+		return fmt.Errorf("tcp affinity: %w", err)
+	}
+	if err := c.Shedding.Validate(); err != nil {
+		return fmt.Errorf("shedding: %w", err)
+	}
 	if err := c.TLS.Validate(); err != nil {
 		return fmt.Errorf("tls: %w", err)
 	}
+	if c.HTTP3 && !c.TLS.Enabled {
+		return fmt.Errorf("http3 requires tls")
+	}
 	return nil
 }
 
@@ -242,7 +387,11 @@ advertise address of '10.26.104.14:8000'.`,
 		"proxy.timeout",
 		c.Timeout,
 		`
-Timeout when forwarding incoming requests to the upstream.`,
+Timeout when forwarding incoming requests to the upstream.
+
+The remaining timeout is sent to the agent, and to other nodes requests are
+forwarded to, in the 'x-piko-timeout' header, so they cancel the request
+when the proxy times out.`,
 	)
 
 	fs.BoolVar(
@@ -255,236 +404,1705 @@ Whether to log all incoming connections and requests.`,
 
 	c.HTTP.RegisterFlags(fs, "proxy")
 
+	c.Retry.RegisterFlags(fs, "proxy")
+
+	c.Forward.RegisterFlags(fs, "proxy")
+
+	c.Headers.RegisterFlags(fs, "proxy")
+
+	c.TCPAffinity.RegisterFlags(fs, "proxy")
+
+	c.TCP.RegisterFlags(fs, "proxy")
+
+	c.Shedding.RegisterFlags(fs, "proxy")
+
+	fs.BoolVar(
+		&c.HTTP3,
+		"proxy.http3",
+		c.HTTP3,
+		`
+Whether to also accept HTTP/3 (QUIC) connections on the proxy port.
+
+When enabled, the proxy listens for QUIC connections on the UDP port matching
+the proxy listener TCP port, and advertises HTTP/3 support to clients using
+the 'Alt-Svc' response header. HTTP/3 runs over QUIC, which may perform
+better than TCP on lossy networks, such as for mobile clients.
+
+Requires TLS to be enabled with '--proxy.tls.enabled'.`,
+	)
+
 	c.TLS.RegisterFlags(fs, "proxy")
 }
 
-type UpstreamConfig struct {
-	// BindAddr is the address to bind to listen for incoming HTTP connections.
+// ProxyTCPConfig configures proxying TCP connections, which clients tunnel
+// over WebSockets.
+type ProxyTCPConfig struct {
+	// BindAddr is the address of a separate listener for TCP connections.
+	// If empty, TCP connections are only accepted on the proxy listener.
 	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
 
-	// AdvertiseAddr is the address to advertise to other nodes.
-	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
+	// MaxConns is the maximum number of concurrent TCP connections. If zero,
+	// there is no limit.
+	MaxConns int `json:"max_conns" yaml:"max_conns"`
+}
 
-	TLS TLSConfig `json:"tls" yaml:"tls"`
+func (c *ProxyTCPConfig) Enabled() bool {
+	return c.BindAddr != ""
 }
 
-func (c *UpstreamConfig) Validate() error {
-	if c.BindAddr == "" {
-		return fmt.Errorf("missing bind addr")
-	}
-	if err := c.TLS.Validate(); err != nil {
-		return fmt.Errorf("tls: %w", err)
+func (c *ProxyTCPConfig) Validate() error {
+	if c.MaxConns < 0 {
+		return fmt.Errorf("invalid max conns: %d", c.MaxConns)
 	}
 	return nil
 }
 
-func (c *UpstreamConfig) RegisterFlags(fs *pflag.FlagSet) {
+func (c *ProxyTCPConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".tcp."
+
 	fs.StringVar(
 		&c.BindAddr,
-		"upstream.bind-addr",
+		prefix+"bind-addr",
 		c.BindAddr,
 		`
-The host/port to listen for incoming upstream connections.
+The host/port of a separate listener for proxied TCP connections.
+
+When set, TCP connections can be accepted on this listener with their own
+HTTP server, so long lived TCP connections don't compete with HTTP requests
+on the proxy listener. TCP connections are still accepted on the proxy
+listener, such as connections forwarded from other nodes.
 
 If the host is unspecified it defaults to all listeners, such as
-'--upstream.bind-addr :8001' will listen on '0.0.0.0:8001'`,
+'--`+prefix+`bind-addr :8007' will listen on '0.0.0.0:8007'.`,
 	)
 
-	fs.StringVar(
-		&c.AdvertiseAddr,
-		"upstream.advertise-addr",
-		c.AdvertiseAddr,
+	fs.IntVar(
+		&c.MaxConns,
+		prefix+"max-conns",
+		c.MaxConns,
 		`
-Address to advertise to other nodes in the cluster.
-
-Such as if the listen address is ':8001', the advertised address may be
-'10.26.104.45:8001' or 'node1.cluster:8001'.
+Maximum number of concurrent proxied TCP connections, across both the proxy
+and TCP listeners.
 
-By default, if the bind address includes an IP to bind to that will be used.
-If the bind address does not include an IP (such as ':8000') the nodes
-private IP will be used, such as a bind address of ':8000' may have an
-advertise address of '10.26.104.14:8000'.`,
+Connections exceeding the limit are rejected with 503, so a flood of TCP
+connections can't exhaust the node. If zero, there is no limit.`,
 	)
+}
 
-	c.TLS.RegisterFlags(fs, "upstream")
+// AffinityConfig configures routing TCP connections for an endpoint from the
+// same client to the same upstream, such as for stateful protocols that
+// should reconnect to the same backend.
+type AffinityConfig struct {
+	// Enabled indicates whether to enable affinity for all endpoints.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// Endpoints contains the IDs of the endpoints to enable affinity for,
+	// when not enabled for all endpoints.
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
 }
 
-type AdminConfig struct {
-	// BindAddr is the address to bind to listen for incoming HTTP connections.
-	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
+// Endpoint returns whether affinity is enabled for the given endpoint.
+func (c *AffinityConfig) Endpoint(endpointID string) bool {
+	if c.Enabled {
+		return true
+	}
+	endpointID = normalizeEndpointID(endpointID)
+	for _, id := range c.Endpoints {
+		if id == endpointID {
+			return true
+		}
+	}
+	return false
+}
 
-	// AdvertiseAddr is the address to advertise to other nodes.
-	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
+func (c *AffinityConfig) Validate() error {
+	for i, endpointID := range c.Endpoints {
+		c.Endpoints[i] = normalizeEndpointID(endpointID)
+		if c.Endpoints[i] == "" {
+			return fmt.Errorf("endpoints[%d]: missing id", i)
+		}
+	}
+	return nil
+}
 
-	TLS TLSConfig `json:"tls" yaml:"tls"`
+func (c *AffinityConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".tcp-affinity."
+
+	fs.BoolVar(
+		&c.Enabled,
+		prefix+"enabled",
+		c.Enabled,
+		`
+Whether to route TCP connections from the same client address to the same
+upstream, for all endpoints.
+
+Rather than load balancing, connections are routed using a consistent hash of
+the client IP among the upstreams for the endpoint connected to all nodes in
+the cluster. Therefore a client reconnects to the same upstream, whichever
+node it connects to, as long as that upstream is still connected. When
+upstreams connect or disconnect, only clients of the affected upstreams move.
+
+Note if Piko is behind a load balancer, the client address is the address of
+the load balancer.`,
+	)
+
+	fs.StringSliceVar(
+		&c.Endpoints,
+		prefix+"endpoints",
+		c.Endpoints,
+		`
+IDs of the endpoints to route TCP connections from the same client address to
+the same upstream, when not enabled for all endpoints.`,
+	)
 }
 
-func (c *AdminConfig) Validate() error {
-	if c.BindAddr == "" {
-		return fmt.Errorf("missing bind addr")
+// RetryConfig configures retrying proxy requests when there is no connected
+// upstream for the endpoint.
+//
+// Retries cover both the local node having no upstream for the endpoint, and
+// a remote node the request was forwarded to responding that it no longer
+// has an upstream, such as when the cluster state is stale during a rolling
+// restart.
+type RetryConfig struct {
+	// Retries is the number of times to retry a request with no connected
+	// upstream. If zero, requests are not retried.
+	//
+	// This can be overridden for each request with the 'x-piko-retries'
+	// header.
+	Retries int `json:"retries" yaml:"retries"`
+
+	// Backoff is the duration to wait before the first retry. The backoff
+	// doubles after each retry up to MaxBackoff.
+	Backoff time.Duration `json:"backoff" yaml:"backoff"`
+
+	// MaxBackoff is the maximum duration to wait between retries.
+	MaxBackoff time.Duration `json:"max_backoff" yaml:"max_backoff"`
+}
+
+func (c *RetryConfig) Validate() error {
+	if c.Retries < 0 {
+		return fmt.Errorf("invalid retries: %d", c.Retries)
 	}
-	if err := c.TLS.Validate(); err != nil {
-		return fmt.Errorf("tls: %w", err)
+	if c.Retries == 0 {
+		return nil
+	}
+	if c.Backoff <= 0 {
+		return fmt.Errorf("missing backoff")
+	}
+	if c.MaxBackoff < c.Backoff {
+		return fmt.Errorf("max backoff must be at least backoff")
 	}
 	return nil
 }
 
-func (c *AdminConfig) RegisterFlags(fs *pflag.FlagSet) {
-	fs.StringVar(
-		&c.BindAddr,
-		"admin.bind-addr",
-		c.BindAddr,
+func (c *RetryConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".retry."
+
+	fs.IntVar(
+		&c.Retries,
+		prefix+"retries",
+		c.Retries,
 		`
-The host/port to listen for incoming admin connections.
+Number of times to retry a proxy request when there is no connected upstream
+for the endpoint, rather than failing with '502 Bad Gateway'.
 
-If the host is unspecified it defaults to all listeners, such as
-'--admin.bind-addr :8002' will listen on '0.0.0.0:8002'`,
+Requests are retried when either the local node has no upstream for the
+endpoint, or a remote node the request was forwarded to no longer has an
+upstream (such as when the cluster state is stale during a rolling restart).
+Requests forwarded to a remote node are only retried if they have no body.
+
+Clients can override the number of retries for each request with the
+'x-piko-retries' header, up to a maximum of 10.
+
+Set to 0 to disable.`,
 	)
 
-	fs.StringVar(
-		&c.AdvertiseAddr,
-		"admin.advertise-addr",
-		c.AdvertiseAddr,
+	fs.DurationVar(
+		&c.Backoff,
+		prefix+"backoff",
+		c.Backoff,
 		`
-Admin listen address to advertise to other nodes in the cluster. This is the
-address other nodes will used to forward admin requests.
-
-Such as if the listen address is ':8002', the advertised address may be
-'10.26.104.45:8002' or 'node1.cluster:8002'.
+Duration to wait before the first retry. The backoff doubles after each
+retry up to '--`+prefix+`max-backoff'.`,
+	)
 
-By default, if the bind address includes an IP to bind to that will be used.
-If the bind address does not include an IP (such as ':8002') the nodes
-private IP will be used, such as a bind address of ':8002' may have an
-advertise address of '10.26.104.14:8002'.`,
+	fs.DurationVar(
+		&c.MaxBackoff,
+		prefix+"max-backoff",
+		c.MaxBackoff,
+		`
+Maximum duration to wait between retries.`,
 	)
-	c.TLS.RegisterFlags(fs, "admin")
 }
 
-type UsageConfig struct {
-	// Disable indicates whether to disable anonymous usage collection.
-	Disable bool `json:"disable" yaml:"disable"`
+// CircuitBreakerConfig configures a circuit breaker that stops forwarding
+// requests to a node after consecutive failures.
+type CircuitBreakerConfig struct {
+	// Threshold is the number of consecutive failed requests to a node
+	// before the circuit opens. If zero, the circuit breaker is disabled.
+	Threshold int `json:"threshold" yaml:"threshold"`
+
+	// Cooldown is the duration the circuit stays open before requests are
+	// forwarded to the node again.
+	Cooldown time.Duration `json:"cooldown" yaml:"cooldown"`
 }
 
-func (c *UsageConfig) RegisterFlags(fs *pflag.FlagSet) {
-	fs.BoolVar(
-		&c.Disable,
-		"usage.disable",
-		c.Disable,
-		`
-Whether to disable anonymous usage tracking.
+func (c *CircuitBreakerConfig) Enabled() bool {
+	return c.Threshold > 0
+}
 
-The Piko server periodically sends an anonymous report to help understand how
-Piko is being used. This report includes the Piko version, host OS, host
-architecture, requests processed and upstreams registered.`,
-	)
+func (c *CircuitBreakerConfig) Validate() error {
+	if c.Threshold < 0 {
+		return fmt.Errorf("invalid threshold: %d", c.Threshold)
+	}
+	if c.Enabled() && c.Cooldown <= 0 {
+		return fmt.Errorf("missing cooldown")
+	}
+	return nil
 }
 
-type Config struct {
-	Cluster ClusterConfig `json:"cluster" yaml:"cluster"`
+func (c *CircuitBreakerConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".circuit-breaker."
 
-	Proxy ProxyConfig `json:"proxy" yaml:"proxy"`
+	fs.IntVar(
+		&c.Threshold,
+		prefix+"threshold",
+		c.Threshold,
+		`
+Number of consecutive failed requests forwarded to a node before the circuit
+opens.
 
-	Upstream UpstreamConfig `json:"upstream" yaml:"upstream"`
+While the circuit is open, requests that would be forwarded to the node fail
+immediately with '502 Bad Gateway' rather than waiting to dial the node. Once
+'--`+prefix+`cooldown' has passed requests are forwarded again, and the next
+failure reopens the circuit.
 
-	Admin AdminConfig `json:"admin" yaml:"admin"`
+Set to 0 to disable.`,
+	)
 
-	Gossip gossip.Config `json:"gossip" yaml:"gossip"`
+	fs.DurationVar(
+		&c.Cooldown,
+		prefix+"cooldown",
+		c.Cooldown,
+		`
+Duration the circuit stays open before forwarding requests to the node again.`,
+	)
+}
 
-	Auth auth.Config `json:"auth" yaml:"auth"`
+// ForwardConfig configures the connections used to forward requests to other
+// nodes in the cluster.
+//
+// Each node keeps a pool of connections to every other node it forwards
+// requests to, rather than opening a new connection for each request.
+type ForwardConfig struct {
+	// BindAddr is the address of the internal listener for requests
+	// forwarded from other nodes over TLS. If empty, other nodes forward
+	// requests to the proxy listener without TLS.
+	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
 
-	Usage UsageConfig `json:"usage" yaml:"usage"`
+	// AdvertiseAddr is the forward address to advertise to other nodes.
+	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
 
-	Log log.Config `json:"log" yaml:"log"`
+	// TLS configures TLS for the forward listener and requests forwarded to
+	// other nodes.
+	TLS ForwardTLSConfig `json:"tls" yaml:"tls"`
+
+	// Secret is a secret shared by all nodes in the cluster, which nodes
+	// include in requests forwarded to the forward listener of other nodes.
+	//
+	// The forward listener requires either the secret or TLS client
+	// authentication, so only other nodes can forward requests.
+	Secret string `json:"secret" yaml:"secret"`
+
+	// HTTP2 indicates whether to multiplex forwarded requests over HTTP/2
+	// connections, rather than HTTP/1.1.
+	//
+	// All nodes in the cluster must support HTTP/2 forwarding.
+	HTTP2 bool `json:"http2" yaml:"http2"`
+
+	// MaxIdleConns is the maximum number of idle HTTP/1.1 connections to keep
+	// to each node. If zero, connections aren't reused.
+	MaxIdleConns int `json:"max_idle_conns" yaml:"max_idle_conns"`
+
+	// IdleTimeout is the duration an idle connection to a node is kept
+	// before being closed.
+	IdleTimeout time.Duration `json:"idle_timeout" yaml:"idle_timeout"`
 
-	// GracePeriod is the duration to gracefully shutdown the server. During
-	// the grace period, listeners and idle connections are closed, then waits
-	// for active requests to complete and closes their connections.
-	GracePeriod time.Duration `json:"grace_period" yaml:"grace_period"`
+	// DialTimeout is the timeout to connect to a node. If zero, there is no
+	// timeout besides the proxy timeout.
+	DialTimeout time.Duration `json:"dial_timeout" yaml:"dial_timeout"`
+
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker" yaml:"circuit_breaker"`
+
+	// Hedge configures hedging requests forwarded to other nodes.
+	Hedge HedgeConfig `json:"hedge" yaml:"hedge"`
+
+	// HealthCheck configures probing other nodes to stop forwarding
+	// requests to nodes that can't be reached.
+	HealthCheck HealthCheckConfig `json:"health_check" yaml:"health_check"`
 }
 
-func Default() *Config {
-	return &Config{
-		Cluster: ClusterConfig{
-			JoinTimeout:      time.Minute,
-			AbortIfJoinFails: true,
-		},
-		Proxy: ProxyConfig{
-			BindAddr:  ":8000",
-			Timeout:   time.Second * 30,
-			AccessLog: true,
-			HTTP: HTTPConfig{
-				ReadTimeout:       time.Second * 10,
-				ReadHeaderTimeout: time.Second * 10,
-				WriteTimeout:      time.Second * 10,
-				IdleTimeout:       time.Minute * 5,
-				MaxHeaderBytes:    1 << 20,
-			},
-		},
-		Upstream: UpstreamConfig{
-			BindAddr: ":8001",
-		},
-		Admin: AdminConfig{
-			BindAddr: ":8002",
-		},
-		Gossip: gossip.Config{
-			BindAddr:      ":8003",
-			Interval:      time.Millisecond * 100,
-			MaxPacketSize: 1400,
-		},
-		Log: log.Config{
-			Level: "info",
-		},
-		GracePeriod: time.Minute,
-	}
+func (c *ForwardConfig) Enabled() bool {
+	return c.BindAddr != ""
 }
 
-func (c *Config) Validate() error {
-	if err := c.Cluster.Validate(); err != nil {
-		return fmt.Errorf("cluster: %w", err)
+func (c *ForwardConfig) Validate() error {
+	if c.Enabled() {
+		if err := c.TLS.Validate(); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		if c.Secret == "" && !c.TLS.ClientAuth {
+			return fmt.Errorf("missing secret or tls client auth")
+		}
 	}
-
-	if err := c.Proxy.Validate(); err != nil {
-		return fmt.Errorf("proxy: %w", err)
+	if c.AdvertiseAddr != "" {
+		if err := pikoconfig.ValidateAdvertiseAddr(c.AdvertiseAddr); err != nil {
+			return fmt.Errorf("invalid advertise addr: %w", err)
+		}
 	}
-
-	if err := c.Upstream.Validate(); err != nil {
-		return fmt.Errorf("upstream: %w", err)
+	if c.MaxIdleConns < 0 {
+		return fmt.Errorf("invalid max idle conns: %d", c.MaxIdleConns)
 	}
-
-	if err := c.Admin.Validate(); err != nil {
-		return fmt.Errorf("admin: %w", err)
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("invalid idle timeout: %s", c.IdleTimeout)
 	}
-
-	if err := c.Gossip.Validate(); err != nil {
-		return fmt.Errorf("gossip: %w", err)
+	if c.DialTimeout < 0 {
+		return fmt.Errorf("invalid dial timeout: %s", c.DialTimeout)
 	}
-
-	if err := c.Log.Validate(); err != nil {
-		return fmt.Errorf("log: %w", err)
+	if err := c.CircuitBreaker.Validate(); err != nil {
+		return fmt.Errorf("circuit breaker: %w", err)
 	}
-
-	if c.GracePeriod == 0 {
-		return fmt.Errorf("missing grace period")
+	if err := c.Hedge.Validate(); err != nil {
+		return fmt.Errorf("hedge: %w", err)
+	}
+	if err := c.HealthCheck.Validate(); err != nil {
+		return fmt.Errorf("health check: %w", err)
 	}
-
 	return nil
 }
 
-func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
-	c.Cluster.RegisterFlags(fs)
+func (c *ForwardConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".forward"
 
-	c.Proxy.RegisterFlags(fs)
+	fs.StringVar(
+		&c.BindAddr,
+		prefix+".bind-addr",
+		c.BindAddr,
+		`
+The host/port of the internal listener for requests forwarded from other
+nodes.
 
-	c.Upstream.RegisterFlags(fs)
+When set, other nodes forward requests to this listener using TLS, rather
+than to the proxy listener without TLS, so traffic between nodes is
+encrypted. Forwarded requests bypass the proxy authentication and access
+logs, since they were already handled by the node that forwarded the request.
 
-	c.Admin.RegisterFlags(fs)
+Requires '--`+prefix+`.tls.cert' and '--`+prefix+`.tls.key', and either
+'--`+prefix+`.secret' or '--`+prefix+`.tls.client-auth' to authenticate other
+nodes.
+
+If the host is unspecified it defaults to all listeners, such as
+'--`+prefix+`.bind-addr :8006' will listen on '0.0.0.0:8006'.`,
+	)
+
+	fs.StringVar(
+		&c.AdvertiseAddr,
+		prefix+".advertise-addr",
+		c.AdvertiseAddr,
+		`
+Forward address to advertise to other nodes in the cluster.
+
+By default, if the bind address includes an IP to bind to that will be used.
+If the bind address does not include an IP (such as ':8006') the nodes
+private IP will be used.`,
+	)
+
+	c.TLS.RegisterFlags(fs, prefix)
+
+	fs.StringVar(
+		&c.Secret,
+		prefix+".secret",
+		c.Secret,
+		`
+Secret shared by all nodes in the cluster to authenticate forwarded requests.
+
+Nodes include the secret in requests forwarded to the forward listener of
+other nodes. The forward listener rejects requests without the secret.`,
+	)
+
+	fs.BoolVar(
+		&c.HTTP2,
+		prefix+".http2",
+		c.HTTP2,
+		`
+Whether to multiplex requests forwarded to other nodes over HTTP/2.
+
+By default, requests are forwarded over a pool of HTTP/1.1 connections to
+each node, so each concurrent request needs its own connection. With HTTP/2,
+concurrent requests are multiplexed over a single connection to each node.
+
+WebSocket and TCP connections are always forwarded over HTTP/1.1.
+
+All nodes in the cluster must be running a version of Piko that supports
+HTTP/2 forwarding, so when upgrading enable this after all nodes have been
+upgraded.`,
+	)
+
+	fs.IntVar(
+		&c.MaxIdleConns,
+		prefix+".max-idle-conns",
+		c.MaxIdleConns,
+		`
+Maximum number of idle HTTP/1.1 connections to keep to each node.
+
+Requests forwarded to a node reuse an idle connection if one is available.
+
+If zero, a new connection is opened for each request.`,
+	)
+
+	fs.DurationVar(
+		&c.IdleTimeout,
+		prefix+".idle-timeout",
+		c.IdleTimeout,
+		`
+Duration an idle connection to a node is kept open before being closed.
+
+If zero, idle connections are not closed.`,
+	)
+
+	fs.DurationVar(
+		&c.DialTimeout,
+		prefix+".dial-timeout",
+		c.DialTimeout,
+		`
+Timeout to connect to a node when forwarding a request.
+
+If zero, the only timeout is '--proxy.timeout'.`,
+	)
+
+	c.CircuitBreaker.RegisterFlags(fs, prefix)
+
+	c.Hedge.RegisterFlags(fs, prefix)
+
+	c.HealthCheck.RegisterFlags(fs, prefix)
+}
+
+// HedgeConfig configures hedged requests to other nodes.
+//
+// If a node a request was forwarded to doesn't respond within the hedge
+// delay, and another node has an upstream for the endpoint, a second attempt
+// is forwarded to that node and the first response is used.
+type HedgeConfig struct {
+	// Enabled indicates whether to hedge forwarded requests.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// Percentile is the percentile of the latency of recent forwarded
+	// requests to wait before hedging, such as 0.95 to hedge requests slower
+	// than 95% of recent requests.
+	Percentile float64 `json:"percentile" yaml:"percentile"`
+
+	// MinDelay is the minimum duration to wait before hedging, regardless of
+	// the latency of recent requests.
+	MinDelay time.Duration `json:"min_delay" yaml:"min_delay"`
+}
+
+func (c *HedgeConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Percentile <= 0 || c.Percentile >= 1 {
+		return fmt.Errorf("percentile must be between 0 and 1: %v", c.Percentile)
+	}
+	if c.MinDelay < 0 {
+		return fmt.Errorf("invalid min delay: %s", c.MinDelay)
+	}
+	return nil
+}
+
+func (c *HedgeConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".hedge."
+
+	fs.BoolVar(
+		&c.Enabled,
+		prefix+"enabled",
+		c.Enabled,
+		`
+Whether to hedge requests forwarded to other nodes.
+
+If the node a request was forwarded to hasn't responded within the hedge
+delay, and another node has an upstream for the endpoint, a second attempt is
+forwarded to that node and whichever node responds first is used. The other
+attempt is cancelled.
+
+Only requests with safe methods (GET, HEAD, OPTIONS and TRACE) and no body are
+hedged, since the request may be processed twice.`,
+	)
+
+	fs.Float64Var(
+		&c.Percentile,
+		prefix+"percentile",
+		c.Percentile,
+		`
+Percentile of the latency of recent forwarded requests to wait before
+hedging, such as 0.95 to hedge requests slower than 95% of recent requests.
+
+Requests aren't hedged until enough forwarded requests have completed to
+estimate the percentile.`,
+	)
+
+	fs.DurationVar(
+		&c.MinDelay,
+		prefix+"min-delay",
+		c.MinDelay,
+		`
+Minimum duration to wait before hedging a request, regardless of the latency
+of recent forwarded requests.`,
+	)
+}
+
+// HealthCheckConfig configures probing other nodes in the cluster.
+//
+// Each node periodically probes the nodes it may forward requests to, and
+// stops forwarding requests to nodes that can't be reached, rather than
+// only detecting a failed node when forwarding a request.
+type HealthCheckConfig struct {
+	// Interval is the interval between probes to each node. If zero, health
+	// checks are disabled.
+	Interval time.Duration `json:"interval" yaml:"interval"`
+
+	// Timeout is the timeout for each probe.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+
+	// Threshold is the number of consecutive failed probes before requests
+	// are no longer forwarded to the node.
+	Threshold int `json:"threshold" yaml:"threshold"`
+}
+
+func (c *HealthCheckConfig) Enabled() bool {
+	return c.Interval > 0
+}
+
+func (c *HealthCheckConfig) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid interval: %s", c.Interval)
+	}
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("missing timeout")
+	}
+	if c.Threshold < 1 {
+		return fmt.Errorf("invalid threshold: %d", c.Threshold)
+	}
+	return nil
+}
+
+func (c *HealthCheckConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".health-check."
+
+	fs.DurationVar(
+		&c.Interval,
+		prefix+"interval",
+		c.Interval,
+		`
+Interval between health check probes to each node in the cluster.
+
+Each node probes the other nodes with a 'HEAD' request, and stops forwarding
+requests to a node after '--`+prefix+`threshold' consecutive probes fail to
+reach it. Requests are forwarded to the node again once a probe succeeds.
+
+Set to 0 to disable.`,
+	)
+
+	fs.DurationVar(
+		&c.Timeout,
+		prefix+"timeout",
+		c.Timeout,
+		`
+Timeout for each health check probe.`,
+	)
+
+	fs.IntVar(
+		&c.Threshold,
+		prefix+"threshold",
+		c.Threshold,
+		`
+Number of consecutive failed health check probes before requests are no
+longer forwarded to the node.`,
+	)
+}
+
+// SLOConfig configures the latency SLO for requests to upstreams.
+type SLOConfig struct {
+	// Latency is the target latency for requests to an upstream. If zero,
+	// upstream latency is not tracked.
+	Latency time.Duration `json:"latency" yaml:"latency"`
+
+	// Endpoints overrides the target latency for specific endpoints, keyed
+	// by endpoint ID.
+	Endpoints map[string]time.Duration `json:"endpoints" yaml:"endpoints"`
+
+	// Threshold is the number of consecutive requests that must exceed the
+	// target latency before the upstream is marked as degraded. Similarly the
+	// upstream recovers after this number of consecutive requests within the
+	// target latency.
+	Threshold int `json:"threshold" yaml:"threshold"`
+
+	// Bias indicates whether to route requests away from degraded upstreams
+	// when there are other healthy upstreams for the endpoint.
+	Bias bool `json:"bias" yaml:"bias"`
+}
+
+// Target returns the target latency for the given endpoint, or 0 if there is
+// no SLO for the endpoint.
+func (c *SLOConfig) Target(endpointID string) time.Duration {
+	if latency, ok := c.Endpoints[normalizeEndpointID(endpointID)]; ok {
+		return latency
+	}
+	return c.Latency
+}
+
+func (c *SLOConfig) Enabled() bool {
+	return c.Latency != 0 || len(c.Endpoints) != 0
+}
+
+func (c *SLOConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Latency < 0 {
+		return fmt.Errorf("invalid latency: %s", c.Latency)
+	}
+	endpoints, err := normalizeEndpointMap(c.Endpoints)
+	if err != nil {
+		return err
+	}
+	c.Endpoints = endpoints
+	for endpointID, latency := range c.Endpoints {
+		if latency <= 0 {
+			return fmt.Errorf("endpoint %s: invalid latency: %s", endpointID, latency)
+		}
+	}
+	if c.Threshold <= 0 {
+		return fmt.Errorf("missing threshold")
+	}
+	return nil
+}
+
+func (c *SLOConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".slo."
+
+	fs.DurationVar(
+		&c.Latency,
+		prefix+"latency",
+		c.Latency,
+		`
+Target latency for requests to an upstream. When an upstream consistently
+exceeds the target latency it is marked as degraded.
+
+Per-endpoint targets can be configured with 'slo.endpoints' in the
+configuration file, which take precedence over this default.
+
+Set to 0 to disable.`,
+	)
+
+	fs.IntVar(
+		&c.Threshold,
+		prefix+"threshold",
+		c.Threshold,
+		`
+Number of consecutive requests exceeding the target latency before an
+upstream is marked as degraded. A degraded upstream recovers after the same
+number of consecutive requests within the target.`,
+	)
+
+	fs.BoolVar(
+		&c.Bias,
+		prefix+"bias",
+		c.Bias,
+		`
+Whether to route requests away from degraded upstreams when the endpoint has
+other healthy upstreams connected.`,
+	)
+}
+
+// HoldConfig configures holding proxy requests for an endpoint with no
+// connected upstreams, such as while an upstream reconnects after restarting.
+type HoldConfig struct {
+	// Window is the duration after an endpoint's last upstream disconnects
+	// that requests to the endpoint are held waiting for an upstream to
+	// reconnect. If zero, requests are not held.
+	Window time.Duration `json:"window" yaml:"window"`
+
+	// MaxRequests is the maximum number of requests held for each endpoint.
+	// Once exceeded, requests fail immediately.
+	MaxRequests int `json:"max_requests" yaml:"max_requests"`
+}
+
+func (c *HoldConfig) Enabled() bool {
+	return c.Window != 0
+}
+
+func (c *HoldConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Window < 0 {
+		return fmt.Errorf("invalid window: %s", c.Window)
+	}
+	if c.MaxRequests <= 0 {
+		return fmt.Errorf("missing max requests")
+	}
+	return nil
+}
+
+func (c *HoldConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".hold."
+
+	fs.DurationVar(
+		&c.Window,
+		prefix+"window",
+		c.Window,
+		`
+Duration to hold proxy requests for an endpoint after its last upstream
+disconnects, waiting for an upstream to reconnect. Such as when an upstream
+restarts during a deploy, requests are held then forwarded once it
+reconnects, rather than failing with '502 Bad Gateway'.
+
+Only upstreams connected to the local node are tracked.
+
+Set to 0 to disable.`,
+	)
+
+	fs.IntVar(
+		&c.MaxRequests,
+		prefix+"max-requests",
+		c.MaxRequests,
+		`
+Maximum number of requests to hold for each endpoint. Once exceeded, requests
+fail immediately.`,
+	)
+}
+
+// QueueConfig configures queueing requests while all upstreams for an
+// endpoint connected to the local node are at their stream limit.
+type QueueConfig struct {
+	// Timeout is the maximum duration to queue a request waiting for an
+	// upstream to have capacity. If zero, requests are not queued.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+
+	// MaxRequests is the maximum number of requests queued for each
+	// endpoint. Once exceeded, requests fail immediately.
+	MaxRequests int `json:"max_requests" yaml:"max_requests"`
+}
+
+func (c *QueueConfig) Enabled() bool {
+	return c.Timeout != 0
+}
+
+func (c *QueueConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid timeout: %s", c.Timeout)
+	}
+	if c.MaxRequests <= 0 {
+		return fmt.Errorf("missing max requests")
+	}
+	return nil
+}
+
+func (c *QueueConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".queue."
+
+	fs.DurationVar(
+		&c.Timeout,
+		prefix+"timeout",
+		c.Timeout,
+		`
+Maximum duration to queue a proxy request while all upstreams for the
+endpoint connected to the node are at their stream limit (see
+'--upstream.max-streams'), waiting for an in-flight request to complete.
+
+This protects upstreams that can't handle concurrent requests, such as
+single-threaded development servers, by queueing excess requests briefly
+rather than failing with '502 Bad Gateway'.
+
+Requests are only queued when there is no other upstream for the endpoint
+with capacity, either connected to the node or another node.
+
+Set to 0 to disable.`,
+	)
+
+	fs.IntVar(
+		&c.MaxRequests,
+		prefix+"max-requests",
+		c.MaxRequests,
+		`
+Maximum number of requests to queue for each endpoint. Once exceeded, requests
+fail immediately.`,
+	)
+}
+
+// AcceptLimitConfig configures rate limiting new upstream connections, such
+// as when thousands of upstreams reconnect at once after the cluster
+// restarts.
+type AcceptLimitConfig struct {
+	// Rate is the maximum number of new upstream connections accepted per
+	// second. If zero there is no limit.
+	Rate float64 `json:"rate" yaml:"rate"`
+
+	// Burst is the maximum number of new upstream connections accepted at
+	// once, before being limited to Rate.
+	Burst int `json:"burst" yaml:"burst"`
+}
+
+func (c *AcceptLimitConfig) Enabled() bool {
+	return c.Rate != 0
+}
+
+func (c *AcceptLimitConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Rate < 0 {
+		return fmt.Errorf("invalid rate: %f", c.Rate)
+	}
+	if c.Burst <= 0 {
+		return fmt.Errorf("missing burst")
+	}
+	return nil
+}
+
+func (c *AcceptLimitConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".accept-limit."
+
+	fs.Float64Var(
+		&c.Rate,
+		prefix+"rate",
+		c.Rate,
+		`
+Maximum number of new upstream connections the node accepts per second.
+
+After a cluster restart, thousands of upstreams may reconnect at once, where
+verifying each connection's TLS handshake and token can overload the node.
+Connections that exceed the limit are rejected with '429 Too Many Requests'
+and a 'Retry-After' header before the token is verified, and the Piko agent
+waits for the 'Retry-After' duration, plus jitter, before reconnecting.
+
+Set to 0 to disable.`,
+	)
+
+	fs.IntVar(
+		&c.Burst,
+		prefix+"burst",
+		c.Burst,
+		`
+Maximum number of new upstream connections the node accepts at once, before
+being limited to '--upstream.accept-limit.rate'.`,
+	)
+}
+
+// ReadyWaitConfig configures waiting for upstreams to reconnect after the node
+// restarts before marking the node as ready.
+type ReadyWaitConfig struct {
+	// Timeout is the maximum duration to wait for upstreams to reconnect
+	// before marking the node as ready. If zero, the node doesn't wait.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+
+	// HintPath is the path of the file the node persists the endpoints of
+	// its connected upstreams to, so it knows which upstreams to wait for
+	// after restarting.
+	HintPath string `json:"hint_path" yaml:"hint_path"`
+}
+
+func (c *ReadyWaitConfig) Enabled() bool {
+	return c.Timeout != 0
+}
+
+func (c *ReadyWaitConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid timeout: %s", c.Timeout)
+	}
+	if c.HintPath == "" {
+		return fmt.Errorf("missing hint path")
+	}
+	return nil
+}
+
+func (c *ReadyWaitConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".ready-wait."
+
+	fs.DurationVar(
+		&c.Timeout,
+		prefix+"timeout",
+		c.Timeout,
+		`
+Maximum duration to wait after the node restarts for the upstreams that were
+connected before the restart to reconnect, before marking the node as ready.
+
+This smooths traffic cutover when restarting nodes behind a load balancer, as
+the load balancer only routes proxy requests to the node once its upstreams
+have reconnected. Note the upstreams must be able to reconnect while the node
+isn't ready, so the upstream load balancer must not use '/ready'.
+
+The node marks itself as ready once an upstream has reconnected for each
+endpoint in '--upstream.ready-wait.hint-path', or the timeout expires.
+
+Set to 0 to disable.`,
+	)
+
+	fs.StringVar(
+		&c.HintPath,
+		prefix+"hint-path",
+		c.HintPath,
+		`
+Path of the file the node persists the endpoints of its connected upstreams
+to, so it knows which upstreams to wait for after restarting.
+
+The file is updated periodically and when the node shuts down, so must be
+on storage that persists across restarts.`,
+	)
+}
+
+type UpstreamConfig struct {
+	// BindAddr is the address to bind to listen for incoming HTTP connections.
+	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
+
+	// AdvertiseAddr is the address to advertise to other nodes.
+	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
+
+	// Keepalive configures pings to detect dead upstream connections.
+	Keepalive keepalive.Config `json:"keepalive" yaml:"keepalive"`
+
+	// SLO configures the latency SLO for requests to upstreams.
+	SLO SLOConfig `json:"slo" yaml:"slo"`
+
+	// Hold configures holding requests while an endpoint has no upstreams.
+	Hold HoldConfig `json:"hold" yaml:"hold"`
+
+	// Queue configures queueing requests while all upstreams for an
+	// endpoint are at their stream limit.
+	Queue QueueConfig `json:"queue" yaml:"queue"`
+
+	// AcceptLimit configures rate limiting new upstream connections.
+	AcceptLimit AcceptLimitConfig `json:"accept_limit" yaml:"accept_limit"`
+
+	// SlowStart configures ramping up requests to new upstreams.
+	SlowStart SlowStartConfig `json:"slow_start" yaml:"slow_start"`
+
+	// ResumeWindow is the duration other nodes expect the local node's
+	// upstreams to reconnect after the node shuts down. If zero, upstreams
+	// aren't expected to resume.
+	ResumeWindow time.Duration `json:"resume_window" yaml:"resume_window"`
+
+	// ResumeSecret is a secret shared by all nodes in the cluster to sign
+	// the resume tokens returned to upstreams. If empty, resume tokens
+	// aren't issued.
+	ResumeSecret string `json:"resume_secret" yaml:"resume_secret"`
+
+	// ReadyWait configures waiting for upstreams to reconnect after the node
+	// restarts before marking the node as ready.
+	ReadyWait ReadyWaitConfig `json:"ready_wait" yaml:"ready_wait"`
+
+	// Static contains upstreams the server connects to directly, which are
+	// load balanced alongside upstreams connected using the Piko agent.
+	Static []StaticUpstreamConfig `json:"static" yaml:"static"`
+
+	// MaxStreams is the maximum number of concurrent streams to each
+	// upstream connection. If zero there is no limit.
+	MaxStreams int `json:"max_streams" yaml:"max_streams"`
+
+	// Routing configures routing requests between local upstreams and
+	// upstreams connected to other nodes.
+	Routing RoutingConfig `json:"routing" yaml:"routing"`
+
+	TLS TLSConfig `json:"tls" yaml:"tls"`
+}
+
+func (c *UpstreamConfig) Validate() error {
+	if c.BindAddr == "" {
+		return fmt.Errorf("missing bind addr")
+	}
+	if c.AdvertiseAddr != "" {
+		if err := pikoconfig.ValidateAdvertiseAddr(c.AdvertiseAddr); err != nil {
+			return fmt.Errorf("invalid advertise addr: %w", err)
+		}
+	}
+	if err := c.Keepalive.Validate(); err != nil {
+		return fmt.Errorf("keepalive: %w", err)
+	}
+	if err := c.SLO.Validate(); err != nil {
+		return fmt.Errorf("slo: %w", err)
+	}
+	if err := c.Hold.Validate(); err != nil {
+		return fmt.Errorf("hold: %w", err)
+	}
+	if err := c.Queue.Validate(); err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	if err := c.AcceptLimit.Validate(); err != nil {
+		return fmt.Errorf("accept limit: %w", err)
+	}
+	if err := c.SlowStart.Validate(); err != nil {
+		return fmt.Errorf("slow start: %w", err)
+	}
+	if c.ResumeWindow < 0 {
+		return fmt.Errorf("invalid resume window: %s", c.ResumeWindow)
+	}
+	if err := c.ReadyWait.Validate(); err != nil {
+		return fmt.Errorf("ready wait: %w", err)
+	}
+	for i, static := range c.Static {
+		if err := static.Validate(); err != nil {
+			return fmt.Errorf("static[%d]: %w", i, err)
+		}
+	}
+	if c.MaxStreams < 0 {
+		return fmt.Errorf("max streams cannot be negative")
+	}
+	if err := c.Routing.Validate(); err != nil {
+		return fmt.Errorf("routing: %w", err)
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	return nil
+}
+
+func (c *UpstreamConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.BindAddr,
+		"upstream.bind-addr",
+		c.BindAddr,
+		`
+The host/port to listen for incoming upstream connections.
+
+If the host is unspecified it defaults to all listeners, such as
+'--upstream.bind-addr :8001' will listen on '0.0.0.0:8001'`,
+	)
+
+	fs.StringVar(
+		&c.AdvertiseAddr,
+		"upstream.advertise-addr",
+		c.AdvertiseAddr,
+		`
+Address to advertise to other nodes in the cluster.
+
+Such as if the listen address is ':8001', the advertised address may be
+'10.26.104.45:8001' or 'node1.cluster:8001'.
+
+By default, if the bind address includes an IP to bind to that will be used.
+If the bind address does not include an IP (such as ':8000') the nodes
+private IP will be used, such as a bind address of ':8000' may have an
+advertise address of '10.26.104.14:8000'.`,
+	)
+
+	c.Keepalive.RegisterFlags(fs, "upstream")
+
+	c.SLO.RegisterFlags(fs, "upstream")
+
+	c.Hold.RegisterFlags(fs, "upstream")
+
+	c.Queue.RegisterFlags(fs, "upstream")
+
+	c.AcceptLimit.RegisterFlags(fs, "upstream")
+
+	c.SlowStart.RegisterFlags(fs, "upstream")
+
+	fs.DurationVar(
+		&c.ResumeWindow,
+		"upstream.resume-window",
+		c.ResumeWindow,
+		`
+Duration for the node's upstreams to resume after the node shuts down.
+
+When the node shuts down, it announces to the other nodes in the cluster that
+its upstreams are expected to reconnect within the window. Until an upstream
+for the endpoint reconnects to any node, or the window expires, requests to
+the endpoint are held rather than failing with '502 Bad Gateway'. Such as
+when restarting a node during a deploy.
+
+Held requests are limited by '--upstream.hold.max-requests'.
+
+Set to 0 to disable.`,
+	)
+
+	fs.StringVar(
+		&c.ResumeSecret,
+		"upstream.resume-secret",
+		c.ResumeSecret,
+		`
+Secret shared by all nodes in the cluster to sign resume tokens.
+
+When an upstream connects, the node returns a resume token signed with the
+secret, which the upstream sends when it reconnects, such as after the node
+restarts. Upstreams that reconnect to any node with a valid token are counted
+as resumed.
+
+If empty, resume tokens aren't issued.`,
+	)
+
+	c.ReadyWait.RegisterFlags(fs, "upstream")
+
+	fs.IntVar(
+		&c.MaxStreams,
+		"upstream.max-streams",
+		c.MaxStreams,
+		`
+Maximum number of concurrent streams to each upstream connection.
+
+Each proxied request or TCP connection uses a stream on the upstream
+connection. Once an upstream reaches the limit, requests spill over to other
+upstreams for the same endpoint, or are forwarded to another node with an
+upstream for the endpoint. This protects a single small agent from being
+overwhelmed when it's the only upstream connected to the node.
+
+Agents may advertise a lower limit with '--connect.max-streams', in which
+case the lower limit is used.
+
+Set to 0 to disable.`,
+	)
+
+	c.Routing.RegisterFlags(fs, "upstream")
+
+	c.TLS.RegisterFlags(fs, "upstream")
+}
+
+type AdminConfig struct {
+	// BindAddr is the address to bind to listen for incoming HTTP connections.
+	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
+
+	// AdvertiseAddr is the address to advertise to other nodes.
+	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
+
+	// GRPCBindAddr is the address to bind to listen for incoming gRPC admin
+	// connections. If empty the gRPC admin API is disabled.
+	GRPCBindAddr string `json:"grpc_bind_addr" yaml:"grpc_bind_addr"`
+
+	// HealthBindAddr is the address to bind to listen for unauthenticated
+	// liveness and readiness probes. If empty the health listener is
+	// disabled.
+	HealthBindAddr string `json:"health_bind_addr" yaml:"health_bind_addr"`
+
+	TLS TLSConfig `json:"tls" yaml:"tls"`
+}
+
+func (c *AdminConfig) Validate() error {
+	if c.BindAddr == "" {
+		return fmt.Errorf("missing bind addr")
+	}
+	if c.AdvertiseAddr != "" {
+		if err := pikoconfig.ValidateAdvertiseAddr(c.AdvertiseAddr); err != nil {
+			return fmt.Errorf("invalid advertise addr: %w", err)
+		}
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	return nil
+}
+
+func (c *AdminConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.BindAddr,
+		"admin.bind-addr",
+		c.BindAddr,
+		`
+The host/port to listen for incoming admin connections.
+
+If the host is unspecified it defaults to all listeners, such as
+'--admin.bind-addr :8002' will listen on '0.0.0.0:8002'`,
+	)
+
+	fs.StringVar(
+		&c.AdvertiseAddr,
+		"admin.advertise-addr",
+		c.AdvertiseAddr,
+		`
+Admin listen address to advertise to other nodes in the cluster. This is the
+address other nodes will used to forward admin requests.
+
+Such as if the listen address is ':8002', the advertised address may be
+'10.26.104.45:8002' or 'node1.cluster:8002'.
+
+By default, if the bind address includes an IP to bind to that will be used.
+If the bind address does not include an IP (such as ':8002') the nodes
+private IP will be used, such as a bind address of ':8002' may have an
+advertise address of '10.26.104.14:8002'.`,
+	)
+
+	fs.StringVar(
+		&c.GRPCBindAddr,
+		"admin.grpc-bind-addr",
+		c.GRPCBindAddr,
+		`
+The host/port to listen for incoming gRPC admin connections.
+
+The gRPC admin API exposes the cluster state, endpoint availability (including
+streaming changes) and node configuration. See 'api/admin/v1/admin.proto'.
+
+The gRPC listener uses the same TLS configuration as the admin listener.
+
+If empty the gRPC admin API is disabled.`,
+	)
+
+	fs.StringVar(
+		&c.HealthBindAddr,
+		"admin.health-bind-addr",
+		c.HealthBindAddr,
+		`
+The host/port to listen for liveness and readiness probes.
+
+The health listener only exposes '/livez' and '/readyz', and doesn't require
+authentication or TLS, so can be used for Kubernetes probes without access to
+the admin API. The admin '/health' and '/ready' routes are still available.
+
+If empty the health listener is disabled.`,
+	)
+
+	c.TLS.RegisterFlags(fs, "admin")
+}
+
+// BasicAuthConfig configures HTTP basic authentication.
+type BasicAuthConfig struct {
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+func (c *BasicAuthConfig) Enabled() bool {
+	return c.Username != ""
+}
+
+func (c *BasicAuthConfig) Validate() error {
+	if c.Username == "" && c.Password != "" {
+		return fmt.Errorf("missing username")
+	}
+	if c.Username != "" && c.Password == "" {
+		return fmt.Errorf("missing password")
+	}
+	return nil
+}
+
+// MetricsConfig configures a separate listener for scraping Prometheus
+// metrics, independent of the admin listener.
+type MetricsConfig struct {
+	// BindAddr is the address to bind to listen for metrics scrape requests.
+	// If empty the metrics listener is disabled.
+	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
+
+	// BasicAuth configures HTTP basic authentication for scrape requests.
+	// If the username is empty, requests aren't authenticated.
+	BasicAuth BasicAuthConfig `json:"basic_auth" yaml:"basic_auth"`
+
+	TLS TLSConfig `json:"tls" yaml:"tls"`
+}
+
+func (c *MetricsConfig) Validate() error {
+	if err := c.BasicAuth.Validate(); err != nil {
+		return fmt.Errorf("basic auth: %w", err)
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	return nil
+}
+
+func (c *MetricsConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.BindAddr,
+		"metrics.bind-addr",
+		c.BindAddr,
+		`
+The host/port to listen for Prometheus metrics scrape requests.
+
+The metrics listener only exposes '/metrics', with its own TLS and basic
+authentication configuration independent of the admin listener. Metrics are
+still available on the admin listener.
+
+If empty the metrics listener is disabled.`,
+	)
+
+	fs.StringVar(
+		&c.BasicAuth.Username,
+		"metrics.basic-auth.username",
+		c.BasicAuth.Username,
+		`
+Username to authenticate metrics scrape requests using HTTP basic
+authentication.
+
+If empty, scrape requests aren't authenticated.`,
+	)
+
+	fs.StringVar(
+		&c.BasicAuth.Password,
+		"metrics.basic-auth.password",
+		c.BasicAuth.Password,
+		`
+Password to authenticate metrics scrape requests using HTTP basic
+authentication.`,
+	)
+
+	c.TLS.RegisterFlags(fs, "metrics")
+}
+
+type UsageConfig struct {
+	// Disable indicates whether to disable anonymous usage collection.
+	Disable bool `json:"disable" yaml:"disable"`
+
+	// Path is the path of the file to append usage reports to.
+	//
+	// If empty, usage reports are not written to a file.
+	Path string `json:"path" yaml:"path"`
+
+	// WebhookURL is the URL to POST usage reports to.
+	//
+	// If empty, usage reports are not sent to a webhook.
+	WebhookURL string `json:"webhook_url" yaml:"webhook_url"`
+
+	// WebhookTimeout is the timeout when sending a report to the webhook.
+	WebhookTimeout time.Duration `json:"webhook_timeout" yaml:"webhook_timeout"`
+}
+
+// Enabled returns whether usage reports are sent anywhere, either the
+// anonymous report or the configured file and webhook.
+func (c *UsageConfig) Enabled() bool {
+	return !c.Disable || c.Path != "" || c.WebhookURL != ""
+}
+
+func (c *UsageConfig) Validate() error {
+	if c.WebhookURL != "" && c.WebhookTimeout == 0 {
+		return fmt.Errorf("missing webhook timeout")
+	}
+	return nil
+}
+
+func (c *UsageConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(
+		&c.Disable,
+		"usage.disable",
+		c.Disable,
+		`
+Whether to disable anonymous usage tracking.
+
+The Piko server periodically sends an anonymous report to help understand how
+Piko is being used. This report includes the Piko version, host OS, host
+architecture, requests processed and upstreams registered.
+
+Disabling the anonymous report doesn't disable writing reports to
+'--usage.path' or '--usage.webhook-url'.`,
+	)
+	fs.StringVar(
+		&c.Path,
+		"usage.path",
+		c.Path,
+		`
+Path of the file to append usage reports to, formatted as JSON lines.
+
+Each report is written hourly, on startup and on shutdown, so you have a
+first-party history of usage without relying on external telemetry.
+
+If empty, usage reports are not written to a file.`,
+	)
+	fs.StringVar(
+		&c.WebhookURL,
+		"usage.webhook-url",
+		c.WebhookURL,
+		`
+URL to send usage reports to. Each report is sent as a JSON encoded POST
+request.
+
+If empty, usage reports are not sent to a webhook.`,
+	)
+	fs.DurationVar(
+		&c.WebhookTimeout,
+		"usage.webhook-timeout",
+		c.WebhookTimeout,
+		`
+Timeout when sending a usage report to the webhook.`,
+	)
+}
+
+type Config struct {
+	Cluster ClusterConfig `json:"cluster" yaml:"cluster"`
+
+	Proxy ProxyConfig `json:"proxy" yaml:"proxy"`
+
+	Upstream UpstreamConfig `json:"upstream" yaml:"upstream"`
+
+	Admin AdminConfig `json:"admin" yaml:"admin"`
+
+	Metrics MetricsConfig `json:"metrics" yaml:"metrics"`
+
+	Gossip gossip.Config `json:"gossip" yaml:"gossip"`
+
+	Auth auth.Config `json:"auth" yaml:"auth"`
+
+	Audit audit.Config `json:"audit" yaml:"audit"`
+
+	Usage UsageConfig `json:"usage" yaml:"usage"`
+
+	Catalogue CatalogueConfig `json:"catalogue" yaml:"catalogue"`
+
+	Federation FederationConfig `json:"federation" yaml:"federation"`
+
+	Storage storage.Config `json:"storage" yaml:"storage"`
+
+	Plugin plugin.Config `json:"plugin" yaml:"plugin"`
+
+	Runtime pikoruntime.Config `json:"runtime" yaml:"runtime"`
+
+	Log log.Config `json:"log" yaml:"log"`
+
+	// GracePeriod is the duration to gracefully shutdown the server. During
+	// the grace period, listeners and idle connections are closed, then waits
+	// for active requests to complete and closes their connections.
+	GracePeriod time.Duration `json:"grace_period" yaml:"grace_period"`
+}
+
+func Default() *Config {
+	return &Config{
+		Cluster: ClusterConfig{
+			JoinTimeout:      time.Minute,
+			AbortIfJoinFails: true,
+		},
+		Proxy: ProxyConfig{
+			BindAddr:  ":8000",
+			Timeout:   time.Second * 30,
+			AccessLog: true,
+			HTTP: HTTPConfig{
+				ReadTimeout:       time.Second * 10,
+				ReadHeaderTimeout: time.Second * 10,
+				WriteTimeout:      time.Second * 10,
+				IdleTimeout:       time.Minute * 5,
+				MaxHeaderBytes:    1 << 20,
+			},
+			Retry: RetryConfig{
+				Retries:    0,
+				Backoff:    time.Millisecond * 100,
+				MaxBackoff: time.Second,
+			},
+			Forward: ForwardConfig{
+				MaxIdleConns: 32,
+				IdleTimeout:  time.Second * 90,
+				DialTimeout:  time.Second * 5,
+				CircuitBreaker: CircuitBreakerConfig{
+					Threshold: 5,
+					Cooldown:  time.Second * 10,
+				},
+				Hedge: HedgeConfig{
+					Percentile: 0.95,
+					MinDelay:   time.Millisecond * 10,
+				},
+				HealthCheck: HealthCheckConfig{
+					Interval:  time.Second * 5,
+					Timeout:   time.Second * 2,
+					Threshold: 2,
+				},
+			},
+			Headers: HeadersConfig{
+				Client: []string{
+					"x-piko-endpoint",
+					"x-piko-authorization",
+					"x-piko-retries",
+				},
+				Upstream: []string{"x-piko-timeout"},
+			},
+			Shedding: SheddingConfig{
+				BestEffortThreshold: 0.8,
+				RetryAfter:          time.Second,
+			},
+		},
+		Upstream: UpstreamConfig{
+			BindAddr: ":8001",
+			Keepalive: keepalive.Config{
+				Interval:  time.Second * 10,
+				MaxMissed: 3,
+			},
+			SLO: SLOConfig{
+				Threshold: 5,
+			},
+			Hold: HoldConfig{
+				MaxRequests: 100,
+			},
+			Queue: QueueConfig{
+				MaxRequests: 100,
+			},
+			AcceptLimit: AcceptLimitConfig{
+				Burst: 100,
+			},
+			Routing: RoutingConfig{
+				Policy: RoutingPolicyLocal,
+			},
+		},
+		Admin: AdminConfig{
+			BindAddr: ":8002",
+		},
+		Gossip: gossip.Config{
+			BindAddr:           ":8003",
+			Interval:           time.Millisecond * 100,
+			Fanout:             1,
+			MaxPacketSize:      1400,
+			CompactThreshold:   100,
+			StreamCompression:  gossip.CompressionNone,
+			ClockSkewThreshold: time.Second,
+		},
+		Audit: audit.Config{
+			WebhookTimeout: time.Second * 10,
+		},
+		Usage: UsageConfig{
+			WebhookTimeout: time.Second * 10,
+		},
+		Federation: FederationConfig{
+			SyncInterval: time.Second * 5,
+		},
+		Storage: storage.Config{
+			Backend: storage.BackendMemory,
+			Etcd: storage.EtcdConfig{
+				Prefix:      "/piko/",
+				DialTimeout: time.Second * 5,
+				Timeout:     time.Second * 5,
+			},
+		},
+		Plugin: plugin.Config{
+			ReloadInterval: time.Second * 10,
+			Timeout:        time.Millisecond * 100,
+		},
+		Log: log.Config{
+			Level: "info",
+			Sampling: log.SamplingConfig{
+				Interval: time.Minute,
+			},
+		},
+		GracePeriod: time.Minute,
+	}
+}
+
+// Redacted returns a copy of the configuration with secrets removed, so it
+// can be safely exposed via the admin API.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.Auth.TokenHMACSecretKey != "" {
+		redacted.Auth.TokenHMACSecretKey = "<redacted>"
+	}
+	if redacted.Metrics.BasicAuth.Password != "" {
+		redacted.Metrics.BasicAuth.Password = "<redacted>"
+	}
+	if redacted.Proxy.Forward.Secret != "" {
+		redacted.Proxy.Forward.Secret = "<redacted>"
+	}
+	if redacted.Upstream.ResumeSecret != "" {
+		redacted.Upstream.ResumeSecret = "<redacted>"
+	}
+	if redacted.Federation.Secret != "" {
+		redacted.Federation.Secret = "<redacted>"
+	}
+	if redacted.Storage.Etcd.Password != "" {
+		redacted.Storage.Etcd.Password = "<redacted>"
+	}
+	return &redacted
+}
+
+func (c *Config) Validate() error {
+	if err := c.Cluster.Validate(); err != nil {
+		return fmt.Errorf("cluster: %w", err)
+	}
+
+	if err := c.Proxy.Validate(); err != nil {
+		return fmt.Errorf("proxy: %w", err)
+	}
+
+	if err := c.Upstream.Validate(); err != nil {
+		return fmt.Errorf("upstream: %w", err)
+	}
+
+	if err := c.Admin.Validate(); err != nil {
+		return fmt.Errorf("admin: %w", err)
+	}
+
+	if err := c.Metrics.Validate(); err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+
+	if err := c.Gossip.Validate(); err != nil {
+		return fmt.Errorf("gossip: %w", err)
+	}
+
+	if err := c.Auth.Validate(); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+
+	if err := c.Audit.Validate(); err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+
+	if err := c.Usage.Validate(); err != nil {
+		return fmt.Errorf("usage: %w", err)
+	}
+
+	if err := c.Catalogue.Validate(); err != nil {
+		return fmt.Errorf("catalogue: %w", err)
+	}
+
+	if err := c.Federation.Validate(); err != nil {
+		return fmt.Errorf("federation: %w", err)
+	}
+
+	if err := c.Storage.Validate(); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+
+	if err := c.Plugin.Validate(); err != nil {
+		return fmt.Errorf("plugin: %w", err)
+	}
+
+	if err := c.Runtime.Validate(); err != nil {
+		return fmt.Errorf("runtime: %w", err)
+	}
+
+	if err := c.Log.Validate(); err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+
+	if c.GracePeriod == 0 {
+		return fmt.Errorf("missing grace period")
+	}
+
+	return nil
+}
+
+func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
+	c.Cluster.RegisterFlags(fs)
+
+	c.Proxy.RegisterFlags(fs)
+
+	c.Upstream.RegisterFlags(fs)
+
+	c.Admin.RegisterFlags(fs)
+
+	c.Metrics.RegisterFlags(fs)
 
 	c.Gossip.RegisterFlags(fs)
 
 	c.Auth.RegisterFlags(fs)
 
+	c.Audit.RegisterFlags(fs)
+
 	c.Usage.RegisterFlags(fs)
 
+	c.Federation.RegisterFlags(fs)
+
+	c.Storage.RegisterFlags(fs)
+
+	c.Plugin.RegisterFlags(fs)
+
+	c.Runtime.RegisterFlags(fs)
+
 	c.Log.RegisterFlags(fs)
 
 	fs.DurationVar(
@@ -496,6 +2114,8 @@ Maximum duration after a shutdown signal is received (SIGTERM or
 SIGINT) to gracefully shutdown the server node before terminating.
 This includes handling in-progress HTTP requests, gracefully closing
 connections to upstream listeners and announcing to the cluster the node is
-leaving.`,
+leaving.
+
+A second SIGTERM or SIGINT forces an immediate shutdown.`,
 	)
 }
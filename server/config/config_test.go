@@ -2,8 +2,12 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pikoconfig "github.com/andydunstall/piko/pkg/config"
 )
 
 // Tests the default configuration is valid (not including node ID).
@@ -12,3 +16,551 @@ func TestConfig_Default(t *testing.T) {
 	conf.Cluster.NodeID = "my-node"
 	assert.NoError(t, conf.Validate())
 }
+
+func TestConfig_Redacted(t *testing.T) {
+	conf := Default()
+	conf.Auth.TokenHMACSecretKey = "my-secret"
+	conf.Auth.TokenRSAPublicKey = "my-public-key"
+	conf.Metrics.BasicAuth.Username = "prometheus"
+	conf.Metrics.BasicAuth.Password = "my-password"
+	conf.Proxy.Forward.Secret = "my-forward-secret"
+	conf.Upstream.ResumeSecret = "my-resume-secret"
+	conf.Federation.Secret = "my-federation-secret"
+	conf.Storage.Etcd.Password = "my-etcd-password"
+
+	redacted := conf.Redacted()
+	assert.Equal(t, "<redacted>", redacted.Auth.TokenHMACSecretKey)
+	assert.Equal(t, "my-public-key", redacted.Auth.TokenRSAPublicKey)
+	assert.Equal(t, "prometheus", redacted.Metrics.BasicAuth.Username)
+	assert.Equal(t, "<redacted>", redacted.Metrics.BasicAuth.Password)
+	assert.Equal(t, "<redacted>", redacted.Proxy.Forward.Secret)
+	assert.Equal(t, "<redacted>", redacted.Upstream.ResumeSecret)
+	assert.Equal(t, "<redacted>", redacted.Federation.Secret)
+	assert.Equal(t, "<redacted>", redacted.Storage.Etcd.Password)
+
+	// The original config is unchanged.
+	assert.Equal(t, "my-secret", conf.Auth.TokenHMACSecretKey)
+}
+
+func TestSLOConfig(t *testing.T) {
+	conf := SLOConfig{
+		Latency: time.Second,
+		Endpoints: map[string]time.Duration{
+			"my-endpoint": time.Millisecond * 100,
+		},
+		Threshold: 5,
+	}
+	assert.NoError(t, conf.Validate())
+
+	assert.Equal(t, time.Millisecond*100, conf.Target("my-endpoint"))
+	assert.Equal(t, time.Second, conf.Target("another-endpoint"))
+
+	conf.Threshold = 0
+	assert.EqualError(t, conf.Validate(), "missing threshold")
+
+	// Endpoint IDs are case insensitive.
+	conf = SLOConfig{
+		Endpoints: map[string]time.Duration{
+			"My-Endpoint": time.Millisecond * 100,
+		},
+		Threshold: 5,
+	}
+	assert.NoError(t, conf.Validate())
+	assert.Equal(t, time.Millisecond*100, conf.Target("my-endpoint"))
+	assert.Equal(t, time.Millisecond*100, conf.Target("MY-ENDPOINT"))
+
+	conf.Endpoints["my-endpoint"] = time.Second
+	conf.Endpoints["MY-ENDPOINT"] = time.Second
+	assert.EqualError(t, conf.Validate(), "duplicate endpoint: my-endpoint")
+}
+
+func TestSlowStartConfig(t *testing.T) {
+	conf := SlowStartConfig{
+		Window: time.Second * 30,
+		Endpoints: map[string]time.Duration{
+			"my-endpoint":       time.Minute,
+			"disabled-endpoint": 0,
+		},
+	}
+	assert.NoError(t, conf.Validate())
+
+	assert.Equal(t, time.Minute, conf.EndpointWindow("my-endpoint"))
+	assert.Equal(t, time.Duration(0), conf.EndpointWindow("disabled-endpoint"))
+	assert.Equal(t, time.Second*30, conf.EndpointWindow("another-endpoint"))
+
+	conf.Endpoints["my-endpoint"] = -time.Second
+	assert.EqualError(t, conf.Validate(), "endpoint my-endpoint: invalid window: -1s")
+
+	// Endpoint IDs are case insensitive.
+	conf.Endpoints = map[string]time.Duration{
+		"My-Endpoint": time.Minute,
+	}
+	assert.NoError(t, conf.Validate())
+	assert.Equal(t, time.Minute, conf.EndpointWindow("my-endpoint"))
+}
+
+func TestHoldConfig(t *testing.T) {
+	conf := HoldConfig{}
+	// Disabled so no validation.
+	assert.NoError(t, conf.Validate())
+
+	conf.Window = time.Second * 10
+	assert.EqualError(t, conf.Validate(), "missing max requests")
+
+	conf.MaxRequests = 100
+	assert.NoError(t, conf.Validate())
+}
+
+func TestRetryConfig(t *testing.T) {
+	conf := RetryConfig{}
+	// Disabled so no validation.
+	assert.NoError(t, conf.Validate())
+
+	conf.Retries = -1
+	assert.EqualError(t, conf.Validate(), "invalid retries: -1")
+
+	conf.Retries = 3
+	assert.EqualError(t, conf.Validate(), "missing backoff")
+
+	conf.Backoff = time.Millisecond * 100
+	assert.EqualError(t, conf.Validate(), "max backoff must be at least backoff")
+
+	conf.MaxBackoff = time.Second
+	assert.NoError(t, conf.Validate())
+}
+
+func TestReadyWaitConfig(t *testing.T) {
+	conf := ReadyWaitConfig{}
+	assert.NoError(t, conf.Validate())
+
+	conf.Timeout = time.Second * 30
+	assert.EqualError(t, conf.Validate(), "missing hint path")
+
+	conf.HintPath = "/var/lib/piko/ready-hint.json"
+	assert.NoError(t, conf.Validate())
+
+	conf.Timeout = -time.Second
+	assert.EqualError(t, conf.Validate(), "invalid timeout: -1s")
+}
+
+func TestProxyConfig_HTTP3(t *testing.T) {
+	conf := Default().Proxy
+	conf.HTTP3 = true
+	assert.EqualError(t, conf.Validate(), "http3 requires tls")
+
+	conf.TLS = TLSConfig{
+		Enabled: true,
+		Cert:    "/piko/cert.pem",
+		Key:     "/piko/key.pem",
+	}
+	assert.NoError(t, conf.Validate())
+}
+
+func TestProxyConfig_ClientCert(t *testing.T) {
+	conf := Default().Proxy
+	conf.Headers.ClientCert = ClientCertHash
+	assert.EqualError(
+		t, conf.Validate(), "headers: client cert requires tls client auth",
+	)
+
+	conf.TLS = TLSConfig{
+		Enabled:    true,
+		Cert:       "/piko/cert.pem",
+		Key:        "/piko/key.pem",
+		ClientCA:   "/piko/client-ca.pem",
+		ClientAuth: ClientAuthRequire,
+	}
+	// Without a forward listener clients could forge the header of
+	// forwarded requests.
+	assert.EqualError(
+		t, conf.Validate(), "headers: client cert requires a forward listener",
+	)
+
+	conf.Forward.BindAddr = ":8004"
+	conf.Forward.Secret = "my-secret"
+	conf.Forward.TLS = ForwardTLSConfig{
+		Cert: "/piko/node.pem",
+		Key:  "/piko/node-key.pem",
+	}
+	assert.NoError(t, conf.Validate())
+}
+
+func TestConfig_AdvertiseAddr(t *testing.T) {
+	conf := Default()
+	conf.Cluster.NodeID = "my-node"
+
+	// DNS names are valid without resolving.
+	conf.Cluster.AdvertiseHost = "node1.internal"
+	conf.Proxy.AdvertiseAddr = "node1.internal:8000"
+	conf.Upstream.AdvertiseAddr = "node1.invalid:8001"
+	assert.NoError(t, conf.Validate())
+
+	conf.Upstream.AdvertiseAddr = ":8001"
+	assert.EqualError(
+		t, conf.Validate(), "upstream: invalid advertise addr: missing host",
+	)
+
+	conf.Upstream.AdvertiseAddr = ""
+	conf.Cluster.AdvertiseHost = "node1..internal"
+	assert.EqualError(
+		t,
+		conf.Validate(),
+		"cluster: invalid advertise host: invalid host: node1..internal",
+	)
+}
+
+func TestMetricsConfig(t *testing.T) {
+	conf := MetricsConfig{
+		BindAddr: ":8005",
+		BasicAuth: BasicAuthConfig{
+			Username: "prometheus",
+			Password: "my-password",
+		},
+	}
+	assert.NoError(t, conf.Validate())
+
+	conf.BasicAuth.Password = ""
+	assert.EqualError(t, conf.Validate(), "basic auth: missing password")
+
+	conf.BasicAuth = BasicAuthConfig{Password: "my-password"}
+	assert.EqualError(t, conf.Validate(), "basic auth: missing username")
+}
+
+func TestCatalogueConfig(t *testing.T) {
+	conf := CatalogueConfig{}
+	assert.NoError(t, conf.Validate())
+
+	conf.Endpoints = []CatalogueEndpointConfig{
+		{ID: "payments-cb-1", Owner: "payments"},
+		{Description: "missing id"},
+	}
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: missing id")
+
+	conf.Endpoints[1].ID = "payments-cb-1"
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: duplicate id: payments-cb-1")
+
+	conf.Endpoints[1].ID = "payments-cb-2"
+	assert.NoError(t, conf.Validate())
+}
+
+func TestFederationConfig(t *testing.T) {
+	conf := Default().Federation
+	assert.NoError(t, conf.Validate())
+
+	conf.Peers = []FederationPeerConfig{
+		{
+			Name:     "eu-west-1",
+			AdminURL: "https://piko-admin.eu-west-1.internal:8002",
+			ProxyURL: "https://piko.eu-west-1.internal:8000",
+		},
+	}
+	assert.EqualError(t, conf.Validate(), "missing secret")
+
+	conf.Secret = "my-secret"
+	assert.NoError(t, conf.Validate())
+
+	conf.Peers = append(conf.Peers, FederationPeerConfig{
+		Name:     "eu-west-1",
+		AdminURL: "https://piko-admin.eu-west-2.internal:8002",
+		ProxyURL: "piko.eu-west-2.internal:8000",
+	})
+	assert.EqualError(t, conf.Validate(), "peers[1]: proxy url: invalid url: unsupported scheme: piko.eu-west-2.internal")
+
+	conf.Peers[1].ProxyURL = "https://piko.eu-west-2.internal:8000"
+	assert.EqualError(t, conf.Validate(), "peers[1]: duplicate name: eu-west-1")
+
+	conf.Peers[1].Name = "eu-west-2"
+	assert.NoError(t, conf.Validate())
+
+	conf.Export = []string{"payments-*", "orders"}
+	assert.True(t, conf.Exported("payments-api"))
+	assert.True(t, conf.Exported("orders"))
+	assert.False(t, conf.Exported("orders-api"))
+	assert.False(t, conf.Exported("users"))
+}
+
+func TestFailoverConfig(t *testing.T) {
+	conf := FailoverConfig{}
+	assert.NoError(t, conf.Validate())
+
+	conf.Endpoints = []FailoverEndpointConfig{
+		{ID: "my-endpoint", Fallback: "maintenance"},
+		{ID: "other-endpoint"},
+	}
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: missing fallback")
+
+	conf.Endpoints[1].Fallback = "other-endpoint"
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: fallback cannot be the endpoint itself")
+
+	conf.Endpoints[1] = FailoverEndpointConfig{ID: "my-endpoint", Fallback: "dr"}
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: duplicate id: my-endpoint")
+
+	conf.Endpoints[1].ID = "other-endpoint"
+	assert.NoError(t, conf.Validate())
+
+	assert.Equal(t, "maintenance", conf.Fallback("my-endpoint"))
+	assert.Equal(t, "", conf.Fallback("unknown"))
+
+	// Endpoint IDs are case insensitive.
+	conf.Endpoints = []FailoverEndpointConfig{
+		{ID: "My-Endpoint", Fallback: "Maintenance"},
+		{ID: "other-endpoint", Fallback: "OTHER-ENDPOINT"},
+	}
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: fallback cannot be the endpoint itself")
+
+	conf.Endpoints[1].ID = "MY-ENDPOINT"
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: duplicate id: my-endpoint")
+
+	conf.Endpoints = conf.Endpoints[:1]
+	assert.NoError(t, conf.Validate())
+	assert.Equal(t, "maintenance", conf.Fallback("my-endpoint"))
+	assert.Equal(t, "maintenance", conf.Fallback("MY-ENDPOINT"))
+}
+
+func TestHeadersConfig(t *testing.T) {
+	conf := Default().Proxy.Headers
+	assert.NoError(t, conf.Validate())
+
+	conf.Client = append(conf.Client, "authorization")
+	assert.EqualError(t, conf.Validate(), "client[3]: not an internal header: authorization")
+
+	conf.Client[3] = "X-Piko-Forward"
+	assert.EqualError(t, conf.Validate(), "client[3]: reserved for forwarded requests: X-Piko-Forward")
+
+	conf.Client[3] = "x-piko-custom"
+	assert.NoError(t, conf.Validate())
+
+	conf.Upstream = append(conf.Upstream, "x-piko-forward-secret")
+	assert.EqualError(t, conf.Validate(), "upstream[1]: cannot forward the forward secret: x-piko-forward-secret")
+
+	conf.Upstream[1] = "x-piko-endpoint"
+	assert.NoError(t, conf.Validate())
+}
+
+func TestRoutingConfig(t *testing.T) {
+	conf := RoutingConfig{}
+	assert.NoError(t, conf.Validate())
+	assert.Equal(t, RoutingPolicyLocal, conf.EndpointPolicy("my-endpoint"))
+
+	conf.Policy = "unknown"
+	assert.EqualError(t, conf.Validate(), "unsupported policy: unknown")
+
+	conf.Policy = RoutingPolicySpread
+	conf.Endpoints = []EndpointRoutingConfig{
+		{ID: "my-endpoint", Policy: RoutingPolicyLocal},
+		{ID: "my-endpoint", Policy: RoutingPolicySpread},
+	}
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: duplicate id: my-endpoint")
+
+	conf.Endpoints[1] = EndpointRoutingConfig{ID: "other-endpoint"}
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: unsupported policy: ")
+
+	conf.Endpoints[1].Policy = RoutingPolicySpread
+	assert.NoError(t, conf.Validate())
+
+	assert.Equal(t, RoutingPolicyLocal, conf.EndpointPolicy("my-endpoint"))
+	assert.Equal(t, RoutingPolicySpread, conf.EndpointPolicy("unknown"))
+
+	// Endpoint IDs are case insensitive.
+	conf.Endpoints = []EndpointRoutingConfig{
+		{ID: "My-Endpoint", Policy: RoutingPolicyLocal},
+	}
+	assert.NoError(t, conf.Validate())
+	assert.Equal(t, RoutingPolicyLocal, conf.EndpointPolicy("my-endpoint"))
+}
+
+func TestSheddingConfig(t *testing.T) {
+	conf := SheddingConfig{}
+	assert.False(t, conf.Enabled())
+	assert.NoError(t, conf.Validate())
+
+	conf.MaxInflight = 100
+	assert.True(t, conf.Enabled())
+	assert.EqualError(
+		t, conf.Validate(), "best effort threshold must be in (0, 1]: 0",
+	)
+
+	conf.BestEffortThreshold = 0.8
+	assert.EqualError(t, conf.Validate(), "missing retry after")
+
+	conf.RetryAfter = time.Second
+	conf.Endpoints = []EndpointSheddingConfig{
+		{ID: "my-endpoint", Priority: SheddingPriorityBestEffort},
+		{ID: "other-endpoint"},
+	}
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: unsupported priority: ")
+
+	conf.Endpoints[1].Priority = SheddingPriorityCritical
+	assert.NoError(t, conf.Validate())
+
+	assert.Equal(t, SheddingPriorityBestEffort, conf.EndpointPriority("my-endpoint"))
+	assert.Equal(t, SheddingPriorityCritical, conf.EndpointPriority("other-endpoint"))
+	assert.Equal(t, SheddingPriorityNormal, conf.EndpointPriority("unknown"))
+
+	// Endpoint IDs are case insensitive.
+	conf.Endpoints = []EndpointSheddingConfig{
+		{ID: "My-Endpoint", Priority: SheddingPriorityCritical},
+		{ID: "my-endpoint", Priority: SheddingPriorityBestEffort},
+	}
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: duplicate id: my-endpoint")
+
+	conf.Endpoints = conf.Endpoints[:1]
+	assert.NoError(t, conf.Validate())
+	assert.Equal(t, SheddingPriorityCritical, conf.EndpointPriority("my-endpoint"))
+}
+
+func TestStaticUpstreamConfig(t *testing.T) {
+	conf := StaticUpstreamConfig{URL: "http://10.26.104.56:8080"}
+	assert.EqualError(t, conf.Validate(), "missing endpoint id")
+
+	conf = StaticUpstreamConfig{EndpointID: "my-endpoint"}
+	assert.EqualError(t, conf.Validate(), "missing url")
+
+	conf.URL = "tcp://10.26.104.56:8080"
+	assert.EqualError(t, conf.Validate(), "invalid url: unsupported scheme: tcp")
+
+	conf.URL = "http://"
+	assert.EqualError(t, conf.Validate(), "invalid url: missing host")
+
+	conf.URL = "http://10.26.104.56:8080"
+	assert.NoError(t, conf.Validate())
+}
+
+func TestConfig_Check(t *testing.T) {
+	conf := Default()
+	conf.Cluster.NodeID = "my-node"
+	assert.Empty(t, conf.Check())
+
+	// Only the validation error is returned.
+	conf.GracePeriod = 0
+	assert.Equal(t, []pikoconfig.Issue{
+		{Message: "missing grace period"},
+	}, conf.Check())
+	conf.GracePeriod = time.Minute
+
+	conf.Proxy.AdvertiseAddr = "unknown.invalid:8000"
+	conf.Upstream.TLS = TLSConfig{
+		Enabled: true,
+		Cert:    "/piko/missing.crt",
+		Key:     "/piko/missing.key",
+	}
+	conf.Auth.TokenRSAPublicKey = "invalid"
+
+	issues := conf.Check()
+	require.Len(t, issues, 3)
+	assert.Equal(t, "proxy.advertise_addr", issues[0].Field)
+	assert.Equal(t, "upstream.tls", issues[1].Field)
+	assert.Equal(t, "auth.token_rsa_public_key", issues[2].Field)
+}
+
+func TestForwardConfig(t *testing.T) {
+	conf := Default().Proxy.Forward
+	assert.NoError(t, conf.Validate())
+
+	conf.MaxIdleConns = -1
+	assert.EqualError(t, conf.Validate(), "invalid max idle conns: -1")
+	conf.MaxIdleConns = 0
+
+	conf.CircuitBreaker.Cooldown = 0
+	assert.EqualError(t, conf.Validate(), "circuit breaker: missing cooldown")
+
+	// Disabling the circuit breaker skips validation.
+	conf.CircuitBreaker.Threshold = 0
+	assert.NoError(t, conf.Validate())
+
+	conf.Hedge.Enabled = true
+	assert.NoError(t, conf.Validate())
+	conf.Hedge.Percentile = 1
+	assert.EqualError(t, conf.Validate(), "hedge: percentile must be between 0 and 1: 1")
+	conf.Hedge.Percentile = 0.95
+	conf.Hedge.MinDelay = -time.Second
+	assert.EqualError(t, conf.Validate(), "hedge: invalid min delay: -1s")
+	conf.Hedge = Default().Proxy.Forward.Hedge
+
+	conf.HealthCheck.Timeout = 0
+	assert.EqualError(t, conf.Validate(), "health check: missing timeout")
+	conf.HealthCheck.Timeout = time.Second
+	conf.HealthCheck.Threshold = 0
+	assert.EqualError(t, conf.Validate(), "health check: invalid threshold: 0")
+	// Disabling health checks skips validation.
+	conf.HealthCheck.Interval = 0
+	assert.NoError(t, conf.Validate())
+	conf.HealthCheck = Default().Proxy.Forward.HealthCheck
+
+	// Enabling the forward listener requires TLS.
+	conf.BindAddr = ":8006"
+	assert.EqualError(t, conf.Validate(), "tls: missing cert")
+	conf.TLS.Cert = "/piko/cert.pem"
+	conf.TLS.Key = "/piko/key.pem"
+	// The forward listener requires nodes to authenticate.
+	assert.EqualError(t, conf.Validate(), "missing secret or tls client auth")
+	conf.Secret = "my-secret"
+	assert.NoError(t, conf.Validate())
+
+	conf.Secret = ""
+	conf.TLS.ClientAuth = true
+	assert.EqualError(t, conf.Validate(), "tls: client auth requires ca")
+	conf.TLS.CA = "/piko/ca.pem"
+	assert.NoError(t, conf.Validate())
+}
+
+func TestOfflineConfig(t *testing.T) {
+	conf := OfflineConfig{
+		Endpoints: []OfflineEndpointConfig{
+			{ID: "my-endpoint", Body: "{{.EndpointID}} is offline"},
+			{ID: "my-other-endpoint", Dir: "/var/lib/piko/offline"},
+		},
+	}
+	assert.NoError(t, conf.Validate())
+
+	conf.Endpoints[1].ID = "my-endpoint"
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: duplicate id: my-endpoint")
+
+	conf = OfflineConfig{
+		Endpoints: []OfflineEndpointConfig{
+			{ID: "my-endpoint", Body: "offline", Dir: "/var/lib/piko/offline"},
+		},
+	}
+	assert.EqualError(t, conf.Validate(), "endpoints[0]: cannot set both body and dir")
+
+	conf = OfflineConfig{
+		Endpoints: []OfflineEndpointConfig{
+			{ID: "my-endpoint", Body: "{{.EndpointID"},
+		},
+	}
+	assert.ErrorContains(t, conf.Validate(), "endpoints[0]: invalid body")
+
+	conf = OfflineConfig{
+		Endpoints: []OfflineEndpointConfig{
+			{ID: "my-endpoint", Body: "offline", Status: 1000},
+		},
+	}
+	assert.EqualError(t, conf.Validate(), "endpoints[0]: invalid status: 1000")
+}
+
+func TestProvenanceConfig(t *testing.T) {
+	conf := ProvenanceConfig{
+		Endpoints: []ProvenanceEndpointConfig{
+			{ID: "my-endpoint", PublicKey: "/etc/piko/my-endpoint.pub"},
+			{ID: "My-Endpoint", PublicKey: "/etc/piko/other.pub"},
+		},
+	}
+	// Endpoint IDs are case insensitive.
+	assert.EqualError(t, conf.Validate(), "endpoints[1]: duplicate id: my-endpoint")
+
+	conf = ProvenanceConfig{
+		Endpoints: []ProvenanceEndpointConfig{
+			{ID: "my-endpoint"},
+		},
+	}
+	assert.EqualError(t, conf.Validate(), "endpoints[0]: missing public key")
+
+	conf = ProvenanceConfig{
+		Endpoints: []ProvenanceEndpointConfig{
+			{ID: "my-endpoint", PublicKey: "/unknown.pub"},
+		},
+	}
+	assert.NoError(t, conf.Validate())
+	_, err := conf.Load()
+	assert.ErrorContains(t, err, "my-endpoint: read key")
+}
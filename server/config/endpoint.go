@@ -0,0 +1,34 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// normalizeEndpointID returns the canonical form of the endpoint ID.
+//
+// This matches upstream.NormalizeEndpointID, which can't be imported since
+// the upstream package depends on the configuration. Endpoint IDs are case
+// insensitive, so per-endpoint configuration is normalized when validated
+// and looked up, otherwise an override for 'API' would never match requests
+// for the registered endpoint 'api'.
+func normalizeEndpointID(endpointID string) string {
+	return strings.ToLower(endpointID)
+}
+
+// normalizeEndpointMap returns the given per-endpoint map with normalized
+// endpoint IDs, or an error if multiple keys normalize to the same ID.
+func normalizeEndpointMap[V any](m map[string]V) (map[string]V, error) {
+	if m == nil {
+		return nil, nil
+	}
+	normalized := make(map[string]V, len(m))
+	for endpointID, v := range m {
+		id := normalizeEndpointID(endpointID)
+		if _, ok := normalized[id]; ok {
+			return nil, fmt.Errorf("duplicate endpoint: %s", id)
+		}
+		normalized[id] = v
+	}
+	return normalized, nil
+}
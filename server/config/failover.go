@@ -0,0 +1,65 @@
+package config
+
+import (
+	"fmt"
+)
+
+// FailoverEndpointConfig configures the fallback endpoint for an endpoint.
+type FailoverEndpointConfig struct {
+	// ID is the endpoint ID.
+	ID string `json:"id" yaml:"id"`
+
+	// Fallback is the ID of the endpoint to route requests to when the
+	// endpoint has no upstreams in the cluster.
+	Fallback string `json:"fallback" yaml:"fallback"`
+}
+
+func (c *FailoverEndpointConfig) Validate() error {
+	c.ID = normalizeEndpointID(c.ID)
+	if c.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+	c.Fallback = normalizeEndpointID(c.Fallback)
+	if c.Fallback == "" {
+		return fmt.Errorf("missing fallback")
+	}
+	if c.Fallback == c.ID {
+		return fmt.Errorf("fallback cannot be the endpoint itself")
+	}
+	return nil
+}
+
+// FailoverConfig configures fallback endpoints, such as a static maintenance
+// service or an endpoint in another region, to route requests to when an
+// endpoint has no upstreams in the cluster.
+type FailoverConfig struct {
+	// Endpoints contains the fallback for each endpoint.
+	Endpoints []FailoverEndpointConfig `json:"endpoints" yaml:"endpoints"`
+}
+
+// Fallback returns the fallback endpoint ID for the given endpoint, or an
+// empty string if the endpoint has no fallback.
+func (c *FailoverConfig) Fallback(endpointID string) string {
+	endpointID = normalizeEndpointID(endpointID)
+	for _, endpoint := range c.Endpoints {
+		if endpoint.ID == endpointID {
+			return endpoint.Fallback
+		}
+	}
+	return ""
+}
+
+func (c *FailoverConfig) Validate() error {
+	ids := make(map[string]struct{})
+	for i := range c.Endpoints {
+		endpoint := &c.Endpoints[i]
+		if err := endpoint.Validate(); err != nil {
+			return fmt.Errorf("endpoints[%d]: %w", i, err)
+		}
+		if _, ok := ids[endpoint.ID]; ok {
+			return fmt.Errorf("endpoints[%d]: duplicate id: %s", i, endpoint.ID)
+		}
+		ids[endpoint.ID] = struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// FederationPeerConfig configures a federated Piko cluster.
+type FederationPeerConfig struct {
+	// Name identifies the federated cluster, such as the region it runs in.
+	Name string `json:"name" yaml:"name"`
+
+	// AdminURL is the URL of the federated cluster's admin server, which is
+	// polled for the endpoints the cluster exports, such as
+	// 'https://piko-admin.eu-west-1.internal:8002'.
+	AdminURL string `json:"admin_url" yaml:"admin_url"`
+
+	// ProxyURL is the URL of the federated cluster's proxy tier, which
+	// requests for endpoints exported by the cluster are forwarded to, such
+	// as 'https://piko.eu-west-1.internal:8000'.
+	ProxyURL string `json:"proxy_url" yaml:"proxy_url"`
+}
+
+func (c *FederationPeerConfig) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if _, err := c.ParseAdminURL(); err != nil {
+		return fmt.Errorf("admin url: %w", err)
+	}
+	if _, err := c.ParseProxyURL(); err != nil {
+		return fmt.Errorf("proxy url: %w", err)
+	}
+	return nil
+}
+
+// ParseAdminURL parses the admin URL.
+func (c *FederationPeerConfig) ParseAdminURL() (*url.URL, error) {
+	return parseFederationURL(c.AdminURL)
+}
+
+// ParseProxyURL parses the proxy URL.
+func (c *FederationPeerConfig) ParseProxyURL() (*url.URL, error) {
+	return parseFederationURL(c.ProxyURL)
+}
+
+// FederationConfig configures federation with other Piko clusters.
+//
+// Federated clusters don't share gossip membership. Instead each cluster
+// exports a subset of its endpoints, and clusters poll one another for which
+// exported endpoints have upstreams. A request for an endpoint with no
+// upstream in the local cluster is forwarded to a federated cluster that
+// has an upstream for the endpoint.
+type FederationConfig struct {
+	// Peers contains the federated clusters to forward requests to.
+	Peers []FederationPeerConfig `json:"peers" yaml:"peers"`
+
+	// Export contains the endpoints the cluster exports to federated
+	// clusters. An entry ending with '*' exports all endpoints with the
+	// given prefix.
+	Export []string `json:"export" yaml:"export"`
+
+	// Secret is the shared secret federated clusters use to authenticate
+	// when polling for exported endpoints.
+	Secret string `json:"secret" yaml:"secret"`
+
+	// SyncInterval is the interval to poll federated clusters for their
+	// exported endpoints.
+	SyncInterval time.Duration `json:"sync_interval" yaml:"sync_interval"`
+}
+
+// Enabled returns whether the cluster forwards requests to, or exports
+// endpoints to, federated clusters.
+func (c *FederationConfig) Enabled() bool {
+	return len(c.Peers) > 0 || len(c.Export) > 0
+}
+
+// Exported returns whether the endpoint is exported to federated clusters.
+func (c *FederationConfig) Exported(endpointID string) bool {
+	for _, export := range c.Export {
+		if prefix, ok := strings.CutSuffix(export, "*"); ok {
+			if strings.HasPrefix(endpointID, prefix) {
+				return true
+			}
+			continue
+		}
+		if export == endpointID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *FederationConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("missing secret")
+	}
+	if len(c.Peers) > 0 && c.SyncInterval == 0 {
+		return fmt.Errorf("missing sync interval")
+	}
+	names := make(map[string]struct{})
+	for i, peer := range c.Peers {
+		if err := peer.Validate(); err != nil {
+			return fmt.Errorf("peers[%d]: %w", i, err)
+		}
+		if _, ok := names[peer.Name]; ok {
+			return fmt.Errorf("peers[%d]: duplicate name: %s", i, peer.Name)
+		}
+		names[peer.Name] = struct{}{}
+	}
+	for i, export := range c.Export {
+		if export == "" {
+			return fmt.Errorf("export[%d]: missing endpoint", i)
+		}
+	}
+	return nil
+}
+
+func (c *FederationConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&c.Export,
+		"federation.export",
+		c.Export,
+		`
+Endpoints the cluster exports to federated clusters.
+
+Federated clusters forward requests for exported endpoints to this cluster
+when they have no upstream for the endpoint themselves. An entry ending
+with '*' exports all endpoints with the given prefix, such as 'payments-*'.
+
+Only exported endpoints with an upstream connected to the cluster are
+advertised.`,
+	)
+	fs.StringVar(
+		&c.Secret,
+		"federation.secret",
+		c.Secret,
+		`
+Shared secret federated clusters use to authenticate when polling for
+exported endpoints.
+
+Must be configured when federation is enabled, and must be the same in all
+federated clusters.`,
+	)
+	fs.DurationVar(
+		&c.SyncInterval,
+		"federation.sync-interval",
+		c.SyncInterval,
+		`
+Interval to poll federated clusters for their exported endpoints.
+
+Changes in a federated cluster are only seen after the next poll, so a
+shorter interval stops forwarding to a cluster sooner once its upstreams
+disconnect.`,
+	)
+}
+
+func parseFederationURL(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, fmt.Errorf("missing url")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid url: unsupported scheme: %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid url: missing host")
+	}
+	return u, nil
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// internalHeaderPrefix is the prefix of the internal headers used by
+	// Piko.
+	internalHeaderPrefix = "x-piko-"
+)
+
+const (
+	// ClientCertHash forwards the hash, subject and SANs of the client
+	// certificate.
+	ClientCertHash = "hash"
+	// ClientCertFull forwards the hash, subject and SANs of the client
+	// certificate, along with the PEM encoded certificate.
+	ClientCertFull = "cert"
+)
+
+var (
+	// nodeHeaders are the internal headers nodes add to requests forwarded
+	// to other nodes, so clients can never set them.
+	nodeHeaders = []string{
+		"x-piko-forward",
+		"x-piko-forward-secret",
+		"x-piko-timeout",
+		"x-piko-affinity-key",
+		"x-piko-provenance-nonce",
+	}
+)
+
+// HeadersConfig configures which internal 'x-piko-*' headers are accepted
+// from clients and forwarded to upstreams.
+type HeadersConfig struct {
+	// Client contains the internal headers clients may set on proxy
+	// requests. All other internal headers are removed from client
+	// requests.
+	Client []string `json:"client" yaml:"client"`
+
+	// Upstream contains the internal headers forwarded to upstreams. All
+	// other internal headers are removed before forwarding the request to
+	// the upstream.
+	Upstream []string `json:"upstream" yaml:"upstream"`
+
+	// ServedBy indicates whether to add the 'x-piko-served-by' header to
+	// proxied responses, identifying the node and upstream connection that
+	// served the request.
+	ServedBy bool `json:"served_by" yaml:"served_by"`
+
+	// EndpointHealth indicates whether to add the 'x-piko-endpoint-health'
+	// header to proxied error responses, containing the health score of the
+	// endpoint.
+	EndpointHealth bool `json:"endpoint_health" yaml:"endpoint_health"`
+
+	// ClientCert configures forwarding the TLS client certificate to
+	// upstreams in the 'x-forwarded-client-cert' header. Either empty to
+	// disable, 'hash' or 'cert'.
+	ClientCert string `json:"client_cert" yaml:"client_cert"`
+}
+
+func (c *HeadersConfig) Validate() error {
+	for i, header := range c.Client {
+		if err := validateInternalHeader(header); err != nil {
+			return fmt.Errorf("client[%d]: %w", i, err)
+		}
+		for _, nodeHeader := range nodeHeaders {
+			if strings.EqualFold(header, nodeHeader) {
+				return fmt.Errorf(
+					"client[%d]: reserved for forwarded requests: %s", i, header,
+				)
+			}
+		}
+	}
+	switch c.ClientCert {
+	case "", ClientCertHash, ClientCertFull:
+	default:
+		return fmt.Errorf("unknown client cert: %s", c.ClientCert)
+	}
+	for i, header := range c.Upstream {
+		if err := validateInternalHeader(header); err != nil {
+			return fmt.Errorf("upstream[%d]: %w", i, err)
+		}
+		if strings.EqualFold(header, "x-piko-forward-secret") {
+			return fmt.Errorf(
+				"upstream[%d]: cannot forward the forward secret: %s", i, header,
+			)
+		}
+	}
+	return nil
+}
+
+func (c *HeadersConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".headers."
+
+	fs.StringSliceVar(
+		&c.Client,
+		prefix+"client",
+		c.Client,
+		`
+Internal 'x-piko-*' headers clients may set on proxy requests.
+
+All other 'x-piko-*' headers are removed from client requests, so clients
+can't inject headers that Piko uses internally, such as marking a request
+as forwarded from another node.
+
+The headers nodes add when forwarding requests to other nodes
+('x-piko-forward', 'x-piko-forward-secret', 'x-piko-timeout',
+'x-piko-affinity-key' and 'x-piko-provenance-nonce') can't be allowed.`,
+	)
+
+	fs.StringSliceVar(
+		&c.Upstream,
+		prefix+"upstream",
+		c.Upstream,
+		`
+Internal 'x-piko-*' headers forwarded to upstreams.
+
+All other 'x-piko-*' headers, such as 'x-piko-endpoint' and
+'x-piko-authorization', are removed before forwarding the request to the
+upstream.
+
+By default only 'x-piko-timeout' is forwarded, which the agent uses to
+cancel requests once the proxy times out.`,
+	)
+
+	fs.BoolVar(
+		&c.ServedBy,
+		prefix+"served-by",
+		c.ServedBy,
+		`
+Whether to add the 'x-piko-served-by' header to proxied HTTP responses,
+identifying the node and upstream connection that served the request, such
+as 'x-piko-served-by: node-1/8f14e45fceea167a'.
+
+The upstream ID matches the 'upstream-id' field of the server's upstream
+connected logs, which helps debug which node and upstream served a
+request.
+
+Disabled by default as the header exposes internal node IDs to clients.`,
+	)
+
+	fs.BoolVar(
+		&c.EndpointHealth,
+		prefix+"endpoint-health",
+		c.EndpointHealth,
+		`
+Whether to add the 'x-piko-endpoint-health' header to proxied HTTP
+responses with a 5xx status, containing the health score of the endpoint
+from 0 to 100, such as 'x-piko-endpoint-health: 40'.
+
+The score is 0 when the endpoint has no upstreams, otherwise it's reduced by
+the error rate of recent requests and by the p99 latency of recent
+requests exceeding the endpoint's target latency.
+
+Disabled by default as the header exposes the endpoint health to clients.`,
+	)
+
+	fs.StringVar(
+		&c.ClientCert,
+		prefix+"client-cert",
+		c.ClientCert,
+		`
+Forward the TLS client certificate of proxy requests to upstreams in the
+'x-forwarded-client-cert' header, so upstreams can authorize clients based
+on their certificate. One of:
+- hash: Forward the SHA-256 hash, subject and URI and DNS SANs of the
+certificate
+- cert: Also forward the URL encoded PEM certificate
+
+Such as 'x-forwarded-client-cert: Hash=6bd7...;Subject="CN=client"'.
+
+Requires the proxy listener to request client certificates (see
+'--proxy.tls.client-auth') and a forward listener for requests forwarded
+between nodes (see '--proxy.forward.bind-addr'). Any
+'x-forwarded-client-cert' header sent by the client is replaced.
+
+Disabled by default.`,
+	)
+}
+
+func validateInternalHeader(header string) error {
+	if !strings.HasPrefix(strings.ToLower(header), internalHeaderPrefix) {
+		return fmt.Errorf("not an internal header: %s", header)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"text/template"
+)
+
+// OfflineEndpointConfig configures the static content to serve for an
+// endpoint when it has no upstreams.
+type OfflineEndpointConfig struct {
+	// ID is the endpoint ID.
+	ID string `json:"id" yaml:"id"`
+
+	// Body is the response body to serve, rendered as a Go template with
+	// the endpoint ID as '{{.EndpointID}}'.
+	//
+	// Only one of Body or Dir can be set.
+	Body string `json:"body" yaml:"body"`
+
+	// Dir is a local directory to serve files from. Requests for files that
+	// don't exist serve 'index.html', which is rendered as a template like
+	// Body.
+	//
+	// Only one of Body or Dir can be set.
+	Dir string `json:"dir" yaml:"dir"`
+
+	// Status is the HTTP status code of the response. Defaults to
+	// 503 Service Unavailable.
+	Status int `json:"status" yaml:"status"`
+
+	// ContentType is the content type of Body. Defaults to HTML.
+	ContentType string `json:"content_type" yaml:"content_type"`
+
+	// CacheControl is the 'Cache-Control' header of the response. Defaults
+	// to 'no-store', so clients don't keep serving the offline content once
+	// the endpoint has upstreams again.
+	CacheControl string `json:"cache_control" yaml:"cache_control"`
+}
+
+func (c *OfflineEndpointConfig) Validate() error {
+	c.ID = normalizeEndpointID(c.ID)
+	if c.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+	if c.Body == "" && c.Dir == "" {
+		return fmt.Errorf("missing body or dir")
+	}
+	if c.Body != "" && c.Dir != "" {
+		return fmt.Errorf("cannot set both body and dir")
+	}
+	if c.Body != "" {
+		if _, err := template.New(c.ID).Parse(c.Body); err != nil {
+			return fmt.Errorf("invalid body: %w", err)
+		}
+	}
+	if c.Status != 0 && (c.Status < 200 || c.Status > 599) {
+		return fmt.Errorf("invalid status: %d", c.Status)
+	}
+	return nil
+}
+
+// StatusCode returns the HTTP status code of the response.
+func (c *OfflineEndpointConfig) StatusCode() int {
+	if c.Status == 0 {
+		return http.StatusServiceUnavailable
+	}
+	return c.Status
+}
+
+// OfflineConfig configures static content, such as a branded 'service
+// offline' page, to serve for endpoints with no upstreams in the cluster
+// instead of an error.
+type OfflineConfig struct {
+	// Endpoints contains the offline content for each endpoint.
+	Endpoints []OfflineEndpointConfig `json:"endpoints" yaml:"endpoints"`
+}
+
+func (c *OfflineConfig) Validate() error {
+	ids := make(map[string]struct{})
+	for i := range c.Endpoints {
+		endpoint := &c.Endpoints[i]
+		if err := endpoint.Validate(); err != nil {
+			return fmt.Errorf("endpoints[%d]: %w", i, err)
+		}
+		if _, ok := ids[endpoint.ID]; ok {
+			return fmt.Errorf("endpoints[%d]: duplicate id: %s", i, endpoint.ID)
+		}
+		ids[endpoint.ID] = struct{}{}
+	}
+	return nil
+}
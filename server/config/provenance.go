@@ -0,0 +1,72 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/andydunstall/piko/pkg/provenance"
+)
+
+// ProvenanceEndpointConfig configures the public key used to verify
+// responses from the agents for an endpoint.
+type ProvenanceEndpointConfig struct {
+	// ID is the endpoint ID.
+	ID string `json:"id" yaml:"id"`
+
+	// PublicKey is the path of the PEM encoded Ed25519 public key of the
+	// agents for the endpoint.
+	PublicKey string `json:"public_key" yaml:"public_key"`
+}
+
+func (c *ProvenanceEndpointConfig) Validate() error {
+	c.ID = normalizeEndpointID(c.ID)
+	if c.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+	if c.PublicKey == "" {
+		return fmt.Errorf("missing public key")
+	}
+	return nil
+}
+
+// ProvenanceConfig configures verifying that responses for an endpoint were
+// signed by an agent holding the endpoint's private key, so a compromised
+// node can't inject responses for endpoints it doesn't host.
+type ProvenanceConfig struct {
+	// Endpoints contains the public key for each endpoint whose responses
+	// must be signed.
+	Endpoints []ProvenanceEndpointConfig `json:"endpoints" yaml:"endpoints"`
+}
+
+func (c *ProvenanceConfig) Validate() error {
+	ids := make(map[string]struct{})
+	for i := range c.Endpoints {
+		endpoint := &c.Endpoints[i]
+		if err := endpoint.Validate(); err != nil {
+			return fmt.Errorf("endpoints[%d]: %w", i, err)
+		}
+		if _, ok := ids[endpoint.ID]; ok {
+			return fmt.Errorf("endpoints[%d]: duplicate id: %s", i, endpoint.ID)
+		}
+		ids[endpoint.ID] = struct{}{}
+	}
+	return nil
+}
+
+// Load loads the public key of each endpoint, keyed by the normalized
+// endpoint ID.
+func (c *ProvenanceConfig) Load() (map[string]ed25519.PublicKey, error) {
+	if len(c.Endpoints) == 0 {
+		return nil, nil
+	}
+
+	keys := make(map[string]ed25519.PublicKey, len(c.Endpoints))
+	for _, endpoint := range c.Endpoints {
+		key, err := provenance.LoadPublicKey(endpoint.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", endpoint.ID, err)
+		}
+		keys[normalizeEndpointID(endpoint.ID)] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+)
+
+// RoutingPolicy is the policy for routing requests between upstreams
+// connected to the local node and upstreams connected to other nodes.
+type RoutingPolicy string
+
+const (
+	// RoutingPolicyLocal routes requests to upstreams connected to the local
+	// node, and only forwards requests to other nodes when the local node
+	// has no available upstreams for the endpoint.
+	RoutingPolicyLocal RoutingPolicy = "local"
+	// RoutingPolicySpread spreads requests among the upstreams for the
+	// endpoint connected to all nodes in the cluster, weighted by the number
+	// of upstreams connected to each node.
+	RoutingPolicySpread RoutingPolicy = "spread"
+)
+
+func (p RoutingPolicy) Validate() error {
+	switch p {
+	case RoutingPolicyLocal, RoutingPolicySpread:
+		return nil
+	default:
+		return fmt.Errorf("unsupported policy: %s", p)
+	}
+}
+
+// EndpointRoutingConfig overrides the routing policy for an endpoint.
+type EndpointRoutingConfig struct {
+	// ID is the endpoint ID.
+	ID string `json:"id" yaml:"id"`
+
+	// Policy is the routing policy for the endpoint.
+	Policy RoutingPolicy `json:"policy" yaml:"policy"`
+}
+
+func (c *EndpointRoutingConfig) Validate() error {
+	c.ID = normalizeEndpointID(c.ID)
+	if c.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+	if err := c.Policy.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RoutingConfig configures how requests are routed between upstreams
+// connected to the local node and upstreams connected to other nodes.
+type RoutingConfig struct {
+	// Policy is the routing policy for endpoints without an override.
+	// Defaults to 'local'.
+	Policy RoutingPolicy `json:"policy" yaml:"policy"`
+
+	// Endpoints overrides the routing policy for each endpoint.
+	Endpoints []EndpointRoutingConfig `json:"endpoints" yaml:"endpoints"`
+}
+
+// EndpointPolicy returns the routing policy for the given endpoint.
+func (c *RoutingConfig) EndpointPolicy(endpointID string) RoutingPolicy {
+	endpointID = normalizeEndpointID(endpointID)
+	for _, endpoint := range c.Endpoints {
+		if endpoint.ID == endpointID {
+			return endpoint.Policy
+		}
+	}
+	if c.Policy == "" {
+		return RoutingPolicyLocal
+	}
+	return c.Policy
+}
+
+func (c *RoutingConfig) Validate() error {
+	if c.Policy != "" {
+		if err := c.Policy.Validate(); err != nil {
+			return err
+		}
+	}
+	ids := make(map[string]struct{})
+	for i := range c.Endpoints {
+		endpoint := &c.Endpoints[i]
+		if err := endpoint.Validate(); err != nil {
+			return fmt.Errorf("endpoints[%d]: %w", i, err)
+		}
+		if _, ok := ids[endpoint.ID]; ok {
+			return fmt.Errorf("endpoints[%d]: duplicate id: %s", i, endpoint.ID)
+		}
+		ids[endpoint.ID] = struct{}{}
+	}
+	return nil
+}
+
+func (c *RoutingConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".routing."
+
+	fs.StringVar(
+		(*string)(&c.Policy),
+		prefix+"policy",
+		string(c.Policy),
+		`
+Policy for routing requests between upstreams connected to the local node
+and upstreams connected to other nodes. Either 'local' or 'spread'.
+
+'local' routes requests to upstreams connected to the local node, and only
+forwards requests to other nodes when the local node has no available
+upstreams for the endpoint. This avoids the latency of forwarding, such as
+when agents are co-located with specific server nodes.
+
+'spread' spreads requests among the upstreams for the endpoint connected to
+all nodes in the cluster, weighted by the number of upstreams connected to
+each node. This avoids overloading the upstreams connected to a node that
+receives most of the traffic for an endpoint.
+
+The policy can be overridden for each endpoint with 'routing.endpoints' in
+the YAML configuration.`,
+	)
+}
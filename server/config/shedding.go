@@ -0,0 +1,199 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// SheddingPriority is the priority of an endpoint when shedding load.
+type SheddingPriority string
+
+const (
+	// SheddingPriorityCritical endpoints are never shed.
+	SheddingPriorityCritical SheddingPriority = "critical"
+	// SheddingPriorityNormal endpoints are shed when the node exceeds its
+	// limits.
+	SheddingPriorityNormal SheddingPriority = "normal"
+	// SheddingPriorityBestEffort endpoints are shed first, when the node
+	// exceeds the best effort threshold of its limits.
+	SheddingPriorityBestEffort SheddingPriority = "best_effort"
+)
+
+func (p SheddingPriority) Validate() error {
+	switch p {
+	case SheddingPriorityCritical, SheddingPriorityNormal, SheddingPriorityBestEffort:
+		return nil
+	default:
+		return fmt.Errorf("unsupported priority: %s", p)
+	}
+}
+
+// EndpointSheddingConfig configures the shedding priority for an endpoint.
+type EndpointSheddingConfig struct {
+	// ID is the endpoint ID.
+	ID string `json:"id" yaml:"id"`
+
+	// Priority is the shedding priority for the endpoint.
+	Priority SheddingPriority `json:"priority" yaml:"priority"`
+}
+
+func (c *EndpointSheddingConfig) Validate() error {
+	c.ID = normalizeEndpointID(c.ID)
+	if c.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+	if err := c.Priority.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SheddingConfig configures shedding proxy requests when the node is
+// overloaded.
+//
+// Each limit is disabled if zero, and shedding is disabled if all limits
+// are disabled.
+type SheddingConfig struct {
+	// MaxInflight is the maximum number of in-flight proxy requests before
+	// shedding new requests.
+	MaxInflight int `json:"max_inflight" yaml:"max_inflight"`
+
+	// MaxHeapBytes is the maximum heap size in bytes before shedding new
+	// requests.
+	MaxHeapBytes uint64 `json:"max_heap_bytes" yaml:"max_heap_bytes"`
+
+	// MaxQueueLatency is the maximum p99 latency of goroutines waiting to be
+	// scheduled before shedding new requests.
+	MaxQueueLatency time.Duration `json:"max_queue_latency" yaml:"max_queue_latency"`
+
+	// BestEffortThreshold is the fraction of each limit at which to start
+	// shedding requests to best effort endpoints.
+	BestEffortThreshold float64 `json:"best_effort_threshold" yaml:"best_effort_threshold"`
+
+	// RetryAfter is the duration clients are asked to wait before retrying a
+	// shed request.
+	RetryAfter time.Duration `json:"retry_after" yaml:"retry_after"`
+
+	// Endpoints overrides the shedding priority for each endpoint. Endpoints
+	// without an override have 'normal' priority.
+	Endpoints []EndpointSheddingConfig `json:"endpoints" yaml:"endpoints"`
+}
+
+// Enabled returns whether any shedding limit is configured.
+func (c *SheddingConfig) Enabled() bool {
+	return c.MaxInflight > 0 || c.MaxHeapBytes > 0 || c.MaxQueueLatency > 0
+}
+
+// EndpointPriority returns the shedding priority for the given endpoint.
+func (c *SheddingConfig) EndpointPriority(endpointID string) SheddingPriority {
+	endpointID = normalizeEndpointID(endpointID)
+	for _, endpoint := range c.Endpoints {
+		if endpoint.ID == endpointID {
+			return endpoint.Priority
+		}
+	}
+	return SheddingPriorityNormal
+}
+
+func (c *SheddingConfig) Validate() error {
+	if c.MaxInflight < 0 {
+		return fmt.Errorf("invalid max inflight: %d", c.MaxInflight)
+	}
+	if c.MaxQueueLatency < 0 {
+		return fmt.Errorf("invalid max queue latency: %s", c.MaxQueueLatency)
+	}
+	if !c.Enabled() {
+		return nil
+	}
+	if c.BestEffortThreshold <= 0 || c.BestEffortThreshold > 1 {
+		return fmt.Errorf(
+			"best effort threshold must be in (0, 1]: %v", c.BestEffortThreshold,
+		)
+	}
+	if c.RetryAfter <= 0 {
+		return fmt.Errorf("missing retry after")
+	}
+	ids := make(map[string]struct{})
+	for i := range c.Endpoints {
+		endpoint := &c.Endpoints[i]
+		if err := endpoint.Validate(); err != nil {
+			return fmt.Errorf("endpoints[%d]: %w", i, err)
+		}
+		if _, ok := ids[endpoint.ID]; ok {
+			return fmt.Errorf("endpoints[%d]: duplicate id: %s", i, endpoint.ID)
+		}
+		ids[endpoint.ID] = struct{}{}
+	}
+	return nil
+}
+
+func (c *SheddingConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".shedding."
+
+	fs.IntVar(
+		&c.MaxInflight,
+		prefix+"max-inflight",
+		c.MaxInflight,
+		`
+Maximum number of in-flight proxy requests before shedding new requests.
+
+Shed requests are rejected with '503 Service Unavailable' and a
+'Retry-After' header before reading the request body. TCP and WebSocket
+connections are subject to shedding when they connect, but aren't counted
+as in-flight requests once connected.
+
+If zero the number of in-flight requests is unlimited.`,
+	)
+
+	fs.Uint64Var(
+		&c.MaxHeapBytes,
+		prefix+"max-heap-bytes",
+		c.MaxHeapBytes,
+		`
+Maximum heap size in bytes before shedding new proxy requests.
+
+The heap size is sampled every second.
+
+If zero the heap size is unlimited.`,
+	)
+
+	fs.DurationVar(
+		&c.MaxQueueLatency,
+		prefix+"max-queue-latency",
+		c.MaxQueueLatency,
+		`
+Maximum p99 latency of goroutines waiting to be scheduled before shedding
+new proxy requests, such as '50ms'.
+
+A high scheduling latency means the node doesn't have enough CPU to keep up
+with its load. The latency is sampled every second.
+
+If zero the scheduling latency is unlimited.`,
+	)
+
+	fs.Float64Var(
+		&c.BestEffortThreshold,
+		prefix+"best-effort-threshold",
+		c.BestEffortThreshold,
+		`
+Fraction of each shedding limit at which to start shedding requests to
+best effort endpoints, so they are shed before other endpoints.
+
+Such as a threshold of 0.8 with '--proxy.shedding.max-inflight 1000' sheds
+requests to best effort endpoints once there are 800 in-flight requests.
+
+Endpoint priorities are configured with 'shedding.endpoints' in the YAML
+configuration.`,
+	)
+
+	fs.DurationVar(
+		&c.RetryAfter,
+		prefix+"retry-after",
+		c.RetryAfter,
+		`
+Duration clients are asked to wait before retrying a shed request, which is
+returned in the 'Retry-After' header rounded up to the nearest second.`,
+	)
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// SlowStartConfig configures ramping up the share of requests routed to a
+// newly connected upstream, so the upstream can warm up (such as populating
+// caches) before receiving its full share of requests.
+type SlowStartConfig struct {
+	// Window is the duration to ramp up the share of requests routed to a
+	// new upstream. If zero, new upstreams immediately receive their full
+	// share.
+	Window time.Duration `json:"window" yaml:"window"`
+
+	// Endpoints overrides the window for specific endpoints, keyed by
+	// endpoint ID. A window of zero disables slow start for the endpoint.
+	Endpoints map[string]time.Duration `json:"endpoints" yaml:"endpoints"`
+}
+
+// EndpointWindow returns the slow start window for the given endpoint, or 0
+// if slow start is disabled for the endpoint.
+func (c *SlowStartConfig) EndpointWindow(endpointID string) time.Duration {
+	if window, ok := c.Endpoints[normalizeEndpointID(endpointID)]; ok {
+		return window
+	}
+	return c.Window
+}
+
+func (c *SlowStartConfig) Validate() error {
+	if c.Window < 0 {
+		return fmt.Errorf("invalid window: %s", c.Window)
+	}
+	endpoints, err := normalizeEndpointMap(c.Endpoints)
+	if err != nil {
+		return err
+	}
+	c.Endpoints = endpoints
+	for endpointID, window := range c.Endpoints {
+		if window < 0 {
+			return fmt.Errorf("endpoint %s: invalid window: %s", endpointID, window)
+		}
+	}
+	return nil
+}
+
+func (c *SlowStartConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".slow-start."
+
+	fs.DurationVar(
+		&c.Window,
+		prefix+"window",
+		c.Window,
+		`
+Duration to ramp up the share of requests routed to a newly connected
+upstream, such as to let the upstream warm its caches before receiving its
+full share of requests for an endpoint that's under heavy load.
+
+The share starts at 10% and increases linearly over the window. Upstreams
+are only ramped up when the endpoint already has other upstreams connected to
+the node, since otherwise there is no other upstream to route requests to.
+
+Per-endpoint windows can be configured with 'slow_start.endpoints' in the
+configuration file, which take precedence over this default.
+
+Set to 0 to disable.`,
+	)
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// StaticUpstreamConfig configures an upstream the server connects to
+// directly, rather than an upstream that connects to the server using the
+// Piko agent.
+type StaticUpstreamConfig struct {
+	// EndpointID is the ID of the endpoint the upstream serves.
+	EndpointID string `json:"endpoint_id" yaml:"endpoint_id"`
+
+	// URL is the URL of the upstream, which must be reachable from the
+	// server, such as 'http://10.26.104.56:8080'. Only the scheme and host
+	// are used.
+	URL string `json:"url" yaml:"url"`
+}
+
+func (c *StaticUpstreamConfig) Validate() error {
+	if c.EndpointID == "" {
+		return fmt.Errorf("missing endpoint id")
+	}
+	if c.URL == "" {
+		return fmt.Errorf("missing url")
+	}
+	if _, err := c.ParseURL(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ParseURL parses the upstream URL.
+func (c *StaticUpstreamConfig) ParseURL() (*url.URL, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid url: unsupported scheme: %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid url: missing host")
+	}
+	return u, nil
+}
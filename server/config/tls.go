@@ -2,15 +2,74 @@ package config
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/spf13/pflag"
 )
 
+const (
+	// ClientAuthNone doesn't request a client certificate.
+	ClientAuthNone = "none"
+	// ClientAuthRequest requests a client certificate, and verifies it
+	// against the client CA if the client sends one.
+	ClientAuthRequest = "request"
+	// ClientAuthRequire requires a client certificate signed by the client
+	// CA.
+	ClientAuthRequire = "require"
+)
+
+// CertConfig configures a certificate and key pair.
+type CertConfig struct {
+	Cert string `json:"cert" yaml:"cert"`
+	Key  string `json:"key" yaml:"key"`
+}
+
+func (c *CertConfig) Validate() error {
+	if c.Cert == "" {
+		return fmt.Errorf("missing cert")
+	}
+	if c.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+	return nil
+}
+
 type TLSConfig struct {
 	Enabled bool   `json:"enabled" yaml:"enabled"`
 	Cert    string `json:"cert" yaml:"cert"`
 	Key     string `json:"key" yaml:"key"`
+
+	// Certs contains additional certificates to serve. The certificate is
+	// selected using the SNI server name sent by the client, matched against
+	// the certificates DNS names.
+	//
+	// If the client doesn't send a server name, or no certificate matches,
+	// the default certificate ('cert' and 'key') is used.
+	Certs []CertConfig `json:"certs" yaml:"certs"`
+
+	// CertsDir is a directory containing additional certificates to serve,
+	// selected using SNI like Certs. Each '<name>.crt' file must have a
+	// matching '<name>.key' file.
+	CertsDir string `json:"certs_dir" yaml:"certs_dir"`
+
+	// ClientCA is the path of the PEM encoded CA certificate used to verify
+	// client certificates.
+	ClientCA string `json:"client_ca" yaml:"client_ca"`
+
+	// ClientAuth configures whether clients must present a certificate
+	// signed by the client CA. One of 'none' (the default), 'request' or
+	// 'require'.
+	ClientAuth string `json:"client_auth" yaml:"client_auth"`
+}
+
+// ClientAuthEnabled returns whether client certificates are requested.
+func (c *TLSConfig) ClientAuthEnabled() bool {
+	return c.Enabled && c.ClientAuth != "" && c.ClientAuth != ClientAuthNone
 }
 
 func (c *TLSConfig) Validate() error {
@@ -18,11 +77,29 @@ func (c *TLSConfig) Validate() error {
 		return nil
 	}
 
-	if c.Cert == "" {
-		return fmt.Errorf("missing cert")
+	// The default certificate is only optional when additional certificates
+	// are configured.
+	if c.Cert != "" || c.Key != "" || (len(c.Certs) == 0 && c.CertsDir == "") {
+		if c.Cert == "" {
+			return fmt.Errorf("missing cert")
+		}
+		if c.Key == "" {
+			return fmt.Errorf("missing key")
+		}
 	}
-	if c.Key == "" {
-		return fmt.Errorf("missing key")
+	for i, cert := range c.Certs {
+		if err := cert.Validate(); err != nil {
+			return fmt.Errorf("certs[%d]: %w", i, err)
+		}
+	}
+	switch c.ClientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthRequest, ClientAuthRequire:
+		if c.ClientCA == "" {
+			return fmt.Errorf("client auth requires client ca")
+		}
+	default:
+		return fmt.Errorf("unknown client auth: %s", c.ClientAuth)
 	}
 	return nil
 }
@@ -53,6 +130,40 @@ Path to the PEM encoded certificate file.`,
 		`
 Path to the PEM encoded key file.`,
 	)
+	fs.StringVar(
+		&c.CertsDir,
+		prefix+"certs-dir",
+		c.CertsDir,
+		`
+Path to a directory containing additional PEM encoded certificates to serve.
+
+Each '<name>.crt' file must have a matching '<name>.key' file. The certificate
+is selected using the SNI server name sent by the client, so multiple domains
+can be served from the same listener. If no certificate matches, the default
+certificate ('cert' and 'key') is used.`,
+	)
+	fs.StringVar(
+		&c.ClientCA,
+		prefix+"client-ca",
+		c.ClientCA,
+		`
+Path to the PEM encoded CA certificate file used to verify client
+certificates.`,
+	)
+	fs.StringVar(
+		&c.ClientAuth,
+		prefix+"client-auth",
+		c.ClientAuth,
+		`
+Whether clients must present a certificate signed by the client CA (mutual
+TLS). One of:
+- none: Client certificates aren't requested (the default)
+- request: Client certificates are requested, and verified against the
+client CA if the client sends one
+- require: Clients must present a certificate signed by the client CA
+
+Requires '--`+prefix+`client-ca'.`,
+	)
 }
 
 func (c *TLSConfig) Load() (*tls.Config, error) {
@@ -61,11 +172,203 @@ func (c *TLSConfig) Load() (*tls.Config, error) {
 	}
 
 	tlsConfig := &tls.Config{}
-	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+
+	// The default certificate must be first, as it's used when no other
+	// certificate matches the client's server name.
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %w", err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+
+	for _, certConfig := range c.Certs {
+		cert, err := tls.LoadX509KeyPair(certConfig.Cert, certConfig.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %s: %w", certConfig.Cert, err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+
+	if c.CertsDir != "" {
+		certs, err := loadCertsDir(c.CertsDir)
+		if err != nil {
+			return nil, fmt.Errorf("load certs dir: %w", err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, certs...)
+	}
+
+	if c.ClientAuthEnabled() {
+		caCert, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("parse client ca: no certificates")
+		}
+		tlsConfig.ClientCAs = pool
+
+		if c.ClientAuth == ClientAuthRequire {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertsDir loads each '<name>.crt' and '<name>.key' pair in the given
+// directory, ordered by name.
+func loadCertsDir(dir string) ([]tls.Certificate, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return nil, fmt.Errorf("load key pair: %w", err)
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".crt" {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(entry.Name(), ".crt"))
+	}
+	sort.Strings(names)
+
+	var certs []tls.Certificate
+	for _, name := range names {
+		cert, err := tls.LoadX509KeyPair(
+			filepath.Join(dir, name+".crt"),
+			filepath.Join(dir, name+".key"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %s: %w", name, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// ForwardTLSConfig configures TLS for requests forwarded between nodes.
+type ForwardTLSConfig struct {
+	// Cert and Key are the paths of the PEM encoded certificate and key of
+	// the node. The certificate is served on the forward listener, and
+	// presented to other nodes when they require client authentication.
+	Cert string `json:"cert" yaml:"cert"`
+	Key  string `json:"key" yaml:"key"`
+
+	// CA is the path of the PEM encoded CA certificate used to verify the
+	// certificates of other nodes. If empty, the system root CAs are used.
+	CA string `json:"ca" yaml:"ca"`
+
+	// ServerName is the name to verify the certificates of other nodes
+	// against. If empty, the host of the nodes advertised forward address is
+	// used.
+	ServerName string `json:"server_name" yaml:"server_name"`
+
+	// ClientAuth indicates whether nodes forwarding requests must present a
+	// certificate signed by the CA (mutual TLS).
+	ClientAuth bool `json:"client_auth" yaml:"client_auth"`
+}
+
+func (c *ForwardTLSConfig) Validate() error {
+	if c.Cert == "" {
+		return fmt.Errorf("missing cert")
+	}
+	if c.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+	if c.ClientAuth && c.CA == "" {
+		return fmt.Errorf("client auth requires ca")
+	}
+	return nil
+}
+
+func (c *ForwardTLSConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix += ".tls."
+
+	fs.StringVar(
+		&c.Cert,
+		prefix+"cert",
+		c.Cert,
+		`
+Path to the PEM encoded certificate file of the node.
+
+The certificate is served on the forward listener, and presented to other
+nodes when they require client authentication.`,
+	)
+	fs.StringVar(
+		&c.Key,
+		prefix+"key",
+		c.Key,
+		`
+Path to the PEM encoded key file of the node.`,
+	)
+	fs.StringVar(
+		&c.CA,
+		prefix+"ca",
+		c.CA,
+		`
+Path to the PEM encoded CA certificate file used to verify the certificates
+of other nodes.
+
+If not set, the system root CAs are used.`,
+	)
+	fs.StringVar(
+		&c.ServerName,
+		prefix+"server-name",
+		c.ServerName,
+		`
+Name to verify the certificates of other nodes against, such as when all
+nodes share a certificate for 'piko.cluster.internal'.
+
+If not set, the host of each nodes advertised forward address is used.`,
+	)
+	fs.BoolVar(
+		&c.ClientAuth,
+		prefix+"client-auth",
+		c.ClientAuth,
+		`
+Whether nodes forwarding requests must present a certificate signed by the
+CA (mutual TLS).
+
+Requires '--`+prefix+`ca'.`,
+	)
+}
+
+// Load loads the TLS configuration, which is used both to serve the forward
+// listener and to forward requests to other nodes.
+func (c *ForwardTLSConfig) Load() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: c.ServerName,
+	}
+
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.CA != "" {
+		caCert, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("parse ca: no certificates")
+		}
+		tlsConfig.RootCAs = pool
+		tlsConfig.ClientCAs = pool
+	}
+
+	if c.ClientAuth {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-	tlsConfig.Certificates = []tls.Certificate{cert}
 
 	return tlsConfig, nil
 }
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/testutil"
+)
+
+// writeCert writes a self-signed certificate for the given DNS names to
+// '<dir>/<name>.crt' and '<dir>/<name>.key'.
+func writeCert(t *testing.T, dir string, name string, dnsNames ...string) {
+	certPEM, keyPEM, err := testutil.SelfSignedCert(dnsNames...)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600))
+}
+
+// serverName returns the first DNS name of the certificate the server
+// presents for the given SNI server name.
+func serverName(t *testing.T, tlsConfig *tls.Config, sni string) string {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		_ = tls.Server(serverConn, tlsConfig).Handshake()
+	}()
+
+	client := tls.Client(clientConn, &tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, client.Handshake())
+
+	certs := client.ConnectionState().PeerCertificates
+	require.NotEmpty(t, certs)
+	require.NotEmpty(t, certs[0].DNSNames)
+	return certs[0].DNSNames[0]
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Run("sni", func(t *testing.T) {
+		dir := t.TempDir()
+		writeCert(t, dir, "default", "default.example.com")
+
+		certsDir := filepath.Join(dir, "certs")
+		require.NoError(t, os.Mkdir(certsDir, 0o700))
+		writeCert(t, certsDir, "foo", "foo.example.com")
+		writeCert(t, certsDir, "wildcard", "*.bar.example.com")
+
+		writeCert(t, dir, "car", "car.example.com")
+
+		conf := TLSConfig{
+			Enabled: true,
+			Cert:    filepath.Join(dir, "default.crt"),
+			Key:     filepath.Join(dir, "default.key"),
+			Certs: []CertConfig{
+				{
+					Cert: filepath.Join(dir, "car.crt"),
+					Key:  filepath.Join(dir, "car.key"),
+				},
+			},
+			CertsDir: certsDir,
+		}
+		require.NoError(t, conf.Validate())
+
+		tlsConfig, err := conf.Load()
+		require.NoError(t, err)
+		assert.Len(t, tlsConfig.Certificates, 4)
+
+		assert.Equal(t, "foo.example.com", serverName(t, tlsConfig, "foo.example.com"))
+		assert.Equal(t, "*.bar.example.com", serverName(t, tlsConfig, "a.bar.example.com"))
+		assert.Equal(t, "car.example.com", serverName(t, tlsConfig, "car.example.com"))
+		// Unknown server names use the default certificate.
+		assert.Equal(t, "default.example.com", serverName(t, tlsConfig, "unknown.example.com"))
+	})
+
+	t.Run("missing key in certs dir", func(t *testing.T) {
+		dir := t.TempDir()
+		writeCert(t, dir, "foo", "foo.example.com")
+		require.NoError(t, os.Remove(filepath.Join(dir, "foo.key")))
+
+		conf := TLSConfig{
+			Enabled:  true,
+			CertsDir: dir,
+		}
+		_, err := conf.Load()
+		assert.Error(t, err)
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		// The default certificate is optional with additional certificates.
+		conf := TLSConfig{
+			Enabled:  true,
+			CertsDir: "/certs",
+		}
+		assert.NoError(t, conf.Validate())
+
+		conf = TLSConfig{
+			Enabled: true,
+		}
+		assert.EqualError(t, conf.Validate(), "missing cert")
+
+		conf = TLSConfig{
+			Enabled: true,
+			Cert:    "/cert.pem",
+			Certs:   []CertConfig{{Cert: "/foo.pem", Key: "/foo.key"}},
+		}
+		assert.EqualError(t, conf.Validate(), "missing key")
+
+		conf = TLSConfig{
+			Enabled: true,
+			Certs:   []CertConfig{{Cert: "/foo.pem"}},
+		}
+		assert.EqualError(t, conf.Validate(), "certs[0]: missing key")
+	})
+}
+
+func TestTLSConfig_ClientAuth(t *testing.T) {
+	t.Run("load", func(t *testing.T) {
+		dir := t.TempDir()
+		writeCert(t, dir, "server", "server.example.com")
+		writeCert(t, dir, "ca", "ca.example.com")
+
+		conf := TLSConfig{
+			Enabled:    true,
+			Cert:       filepath.Join(dir, "server.crt"),
+			Key:        filepath.Join(dir, "server.key"),
+			ClientCA:   filepath.Join(dir, "ca.crt"),
+			ClientAuth: ClientAuthRequest,
+		}
+		require.NoError(t, conf.Validate())
+
+		tlsConfig, err := conf.Load()
+		require.NoError(t, err)
+		assert.Equal(t, tls.VerifyClientCertIfGiven, tlsConfig.ClientAuth)
+		assert.NotNil(t, tlsConfig.ClientCAs)
+
+		conf.ClientAuth = ClientAuthRequire
+		tlsConfig, err = conf.Load()
+		require.NoError(t, err)
+		assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+		conf.ClientAuth = ClientAuthNone
+		tlsConfig, err = conf.Load()
+		require.NoError(t, err)
+		assert.Equal(t, tls.NoClientCert, tlsConfig.ClientAuth)
+		assert.Nil(t, tlsConfig.ClientCAs)
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		conf := TLSConfig{
+			Enabled:    true,
+			Cert:       "/cert.pem",
+			Key:        "/key.pem",
+			ClientAuth: ClientAuthRequire,
+		}
+		assert.EqualError(t, conf.Validate(), "client auth requires client ca")
+
+		conf.ClientAuth = "unknown"
+		assert.EqualError(t, conf.Validate(), "unknown client auth: unknown")
+	})
+}
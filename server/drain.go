@@ -0,0 +1,155 @@
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/server/admin"
+)
+
+const (
+	shutdownPhaseUpstreams = "closing upstreams"
+	shutdownPhaseProxy     = "draining proxy requests"
+	shutdownPhaseCluster   = "leaving cluster"
+	shutdownPhaseAdmin     = "closing admin server"
+)
+
+// ShutdownProgress returns the progress of the active shutdown, including the
+// remaining upstream connections and proxy requests to drain.
+func (s *Server) ShutdownProgress() *admin.ShutdownProgress {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+
+	if s.shutdownTimer == nil {
+		return &admin.ShutdownProgress{}
+	}
+
+	started := s.shutdownStarted
+	deadline := s.shutdownDeadline
+	progress := &admin.ShutdownProgress{
+		ShuttingDown:     true,
+		Phase:            s.shutdownPhase,
+		Started:          &started,
+		Deadline:         &deadline,
+		Upstreams:        s.localUpstreams(),
+		InflightRequests: s.proxyServer.Inflight(),
+		TCPConns:         s.proxyServer.TCPConns(),
+	}
+	progress.EstimatedCompletion = estimateCompletion(
+		s.shutdownInitial, drainRemaining(progress), started, time.Now(),
+	)
+	return progress
+}
+
+// setShutdownPhase updates the phase of the active shutdown and logs the
+// progress so far.
+func (s *Server) setShutdownPhase(phase string) {
+	s.shutdownMu.Lock()
+	s.shutdownPhase = phase
+	s.shutdownMu.Unlock()
+
+	progress := s.ShutdownProgress()
+	s.logger.Info(
+		"shutdown progress",
+		zap.String("phase", phase),
+		zap.Duration("elapsed", time.Since(*progress.Started)),
+		zap.Duration("remaining-grace", time.Until(*progress.Deadline)),
+		zap.Int("upstreams", progress.Upstreams),
+		zap.Int64("inflight-requests", progress.InflightRequests),
+		zap.Int64("tcp-conns", progress.TCPConns),
+	)
+}
+
+// localUpstreams returns the number of upstreams connected to the local node.
+func (s *Server) localUpstreams() int {
+	var upstreams int
+	for _, n := range s.clusterState.LocalNode().Endpoints {
+		upstreams += n
+	}
+	return upstreams
+}
+
+// registerShutdownMetrics registers metrics describing the progress of the
+// active shutdown.
+func (s *Server) registerShutdownMetrics(registry *prometheus.Registry) {
+	registry.MustRegister(
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "shutdown",
+				Name:      "in_progress",
+				Help:      "Whether the node is shutting down",
+			},
+			func() float64 {
+				if s.ShutdownProgress().ShuttingDown {
+					return 1
+				}
+				return 0
+			},
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "shutdown",
+				Name:      "remaining_grace_seconds",
+				Help:      "Seconds until the shutdown grace period expires",
+			},
+			func() float64 {
+				progress := s.ShutdownProgress()
+				if !progress.ShuttingDown {
+					return 0
+				}
+				return max(0, time.Until(*progress.Deadline).Seconds())
+			},
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "shutdown",
+				Name:      "estimated_remaining_seconds",
+				Help:      "Estimated seconds until the shutdown drain completes, or -1 if unknown",
+			},
+			func() float64 {
+				progress := s.ShutdownProgress()
+				if !progress.ShuttingDown {
+					return 0
+				}
+				if progress.EstimatedCompletion == nil {
+					return -1
+				}
+				return max(0, time.Until(*progress.EstimatedCompletion).Seconds())
+			},
+		),
+	)
+}
+
+// drainRemaining returns the number of upstreams, requests and connections
+// remaining to drain.
+func drainRemaining(progress *admin.ShutdownProgress) int64 {
+	return int64(progress.Upstreams) + progress.InflightRequests + progress.TCPConns
+}
+
+// estimateCompletion estimates when the remaining work will be drained,
+// assuming it continues to drain at the same rate since the shutdown started.
+// Returns nil if nothing has drained yet so the rate is unknown.
+func estimateCompletion(
+	initial int64,
+	remaining int64,
+	started time.Time,
+	now time.Time,
+) *time.Time {
+	if remaining == 0 {
+		return &now
+	}
+	drained := initial - remaining
+	if drained <= 0 {
+		return nil
+	}
+	elapsed := now.Sub(started)
+	completion := now.Add(
+		time.Duration(float64(elapsed) * float64(remaining) / float64(drained)),
+	)
+	return &completion
+}
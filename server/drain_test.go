@@ -0,0 +1,32 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateCompletion(t *testing.T) {
+	started := time.Unix(1000, 0)
+	now := started.Add(time.Second * 10)
+
+	t.Run("drained", func(t *testing.T) {
+		assert.Equal(t, now, *estimateCompletion(10, 0, started, now))
+	})
+
+	t.Run("nothing drained", func(t *testing.T) {
+		assert.Nil(t, estimateCompletion(10, 10, started, now))
+		// More work than when the shutdown started.
+		assert.Nil(t, estimateCompletion(10, 12, started, now))
+	})
+
+	t.Run("partially drained", func(t *testing.T) {
+		// Drained 8 in 10 seconds, so the remaining 2 take 2.5 seconds.
+		assert.Equal(
+			t,
+			now.Add(time.Millisecond*2500),
+			*estimateCompletion(10, 2, started, now),
+		)
+	})
+}
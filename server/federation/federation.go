@@ -0,0 +1,317 @@
+// Package federation forwards requests to independent Piko clusters, such as
+// clusters in other regions.
+//
+// Federated clusters don't share gossip membership. Instead each cluster
+// exports a subset of its endpoints, and polls the other clusters for which of
+// their exported endpoints have upstreams. A request for an endpoint with no
+// upstream in the local cluster is forwarded to the proxy tier of a federated
+// cluster that has an upstream for the endpoint.
+package federation
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+const (
+	// endpointsPath is the admin route federated clusters poll for the
+	// endpoints the cluster exports.
+	endpointsPath = "/_piko/v1/federation/endpoints"
+
+	// syncTimeout is the timeout to poll a federated cluster for its
+	// exported endpoints.
+	syncTimeout = time.Second * 5
+)
+
+// Federation exports endpoints to federated clusters, and forwards requests
+// for endpoints without a local upstream to federated clusters.
+type Federation struct {
+	conf config.FederationConfig
+
+	clusterState *cluster.State
+
+	// peers contains the federated clusters in the configured order, which
+	// is the order clusters are preferred when multiple clusters export the
+	// same endpoint.
+	peers []*peer
+
+	client *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	logger log.Logger
+}
+
+// NewFederation creates a federation from the given configuration. The
+// configuration must be validated.
+func NewFederation(
+	conf config.FederationConfig,
+	clusterState *cluster.State,
+	logger log.Logger,
+) (*Federation, error) {
+	logger = logger.WithSubsystem("federation")
+
+	var peers []*peer
+	for i, peerConf := range conf.Peers {
+		p, err := newPeer(peerConf, logger)
+		if err != nil {
+			return nil, fmt.Errorf("peers[%d]: %w", i, err)
+		}
+		peers = append(peers, p)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Federation{
+		conf:         conf,
+		clusterState: clusterState,
+		peers:        peers,
+		client: &http.Client{
+			Timeout: syncTimeout,
+		},
+		ctx:    ctx,
+		cancel: cancel,
+		logger: logger,
+	}, nil
+}
+
+// Authorized returns whether the request is from a federated cluster, which
+// authenticates with the shared federation secret.
+func (f *Federation) Authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(f.conf.Secret)) == 1
+}
+
+// ExportedEndpoints returns the IDs of the exported endpoints that have an
+// upstream connected to the local cluster, sorted by endpoint ID.
+//
+// Endpoints the cluster forwards to other federated clusters are never
+// exported, so requests are only forwarded one hop.
+func (f *Federation) ExportedEndpoints() []string {
+	endpointIDs := []string{}
+	for _, endpoint := range f.clusterState.Endpoints() {
+		if f.conf.Exported(endpoint.ID) {
+			endpointIDs = append(endpointIDs, endpoint.ID)
+		}
+	}
+	return endpointIDs
+}
+
+// Forward forwards the request to the first federated cluster that exports
+// the endpoint. Returns false without writing a response if no federated
+// cluster has an upstream for the endpoint.
+func (f *Federation) Forward(w http.ResponseWriter, r *http.Request, endpointID string) bool {
+	for _, p := range f.peers {
+		if !p.HasEndpoint(endpointID) {
+			continue
+		}
+
+		f.logger.Debug(
+			"forwarding to federated cluster",
+			zap.String("endpoint-id", endpointID),
+			zap.String("cluster", p.name),
+		)
+		p.proxy.ServeHTTP(w, r)
+		return true
+	}
+	return false
+}
+
+// Start polls the federated clusters for their exported endpoints until
+// stopped.
+func (f *Federation) Start() {
+	var wg sync.WaitGroup
+	for _, p := range f.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.syncPeer(f.ctx, p)
+		}()
+	}
+	wg.Wait()
+}
+
+func (f *Federation) Stop() {
+	f.cancel()
+}
+
+func (f *Federation) syncPeer(ctx context.Context, p *peer) {
+	ticker := time.NewTicker(f.conf.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		f.sync(ctx, p)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync polls the federated cluster for its exported endpoints.
+//
+// If the poll fails the cluster is treated as having no endpoints, so
+// requests aren't forwarded to a cluster that can't be reached.
+func (f *Federation) sync(ctx context.Context, p *peer) {
+	endpointIDs, err := f.fetchEndpoints(ctx, p)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		f.logger.Warn(
+			"failed to sync federated cluster",
+			zap.String("cluster", p.name),
+			zap.Error(err),
+		)
+	}
+	p.SetEndpoints(endpointIDs)
+}
+
+func (f *Federation) fetchEndpoints(ctx context.Context, p *peer) ([]string, error) {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, p.adminURL.JoinPath(endpointsPath).String(), nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+f.conf.Secret)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request: bad status: %d", resp.StatusCode)
+	}
+
+	var body endpointsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return body.Endpoints, nil
+}
+
+type endpointsResponse struct {
+	Endpoints []string `json:"endpoints"`
+}
+
+// peer is a federated cluster.
+type peer struct {
+	name     string
+	adminURL *url.URL
+
+	// proxy forwards requests to the proxy tier of the cluster.
+	proxy *httputil.ReverseProxy
+
+	// endpoints contains the IDs of the endpoints the cluster exports that
+	// have an upstream, as of the last sync.
+	endpoints map[string]struct{}
+
+	// mu protects the above fields.
+	mu sync.Mutex
+
+	logger log.Logger
+}
+
+func newPeer(conf config.FederationPeerConfig, logger log.Logger) (*peer, error) {
+	adminURL, err := conf.ParseAdminURL()
+	if err != nil {
+		return nil, fmt.Errorf("admin url: %w", err)
+	}
+	proxyURL, err := conf.ParseProxyURL()
+	if err != nil {
+		return nil, fmt.Errorf("proxy url: %w", err)
+	}
+
+	p := &peer{
+		name:      conf.Name,
+		adminURL:  adminURL,
+		endpoints: make(map[string]struct{}),
+		logger:    logger,
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(proxyURL)
+			// Keep the host the client requested, as the federated cluster
+			// forwards it to the upstream as is.
+			r.Out.Host = r.In.Host
+		},
+		ErrorLog:     logger.StdLogger(zapcore.WarnLevel),
+		ErrorHandler: p.errorHandler,
+	}
+	return p, nil
+}
+
+// HasEndpoint returns whether the cluster has an upstream for the endpoint.
+func (p *peer) HasEndpoint(endpointID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.endpoints[endpointID]
+	return ok
+}
+
+// SetEndpoints replaces the endpoints the cluster has upstreams for.
+func (p *peer) SetEndpoints(endpointIDs []string) {
+	endpoints := make(map[string]struct{}, len(endpointIDs))
+	for _, endpointID := range endpointIDs {
+		endpoints[endpointID] = struct{}{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.endpoints = endpoints
+}
+
+func (p *peer) errorHandler(w http.ResponseWriter, _ *http.Request, err error) {
+	p.logger.Warn(
+		"forward to federated cluster",
+		zap.String("cluster", p.name),
+		zap.Error(err),
+	)
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		_ = errorResponse(w, http.StatusGatewayTimeout, "upstream timeout")
+		return
+	}
+	_ = errorResponse(w, http.StatusBadGateway, "upstream unreachable")
+}
+
+type errorMessage struct {
+	Error string `json:"error"`
+}
+
+func errorResponse(w http.ResponseWriter, statusCode int, message string) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+
+	m := &errorMessage{
+		Error: message,
+	}
+	return json.NewEncoder(w).Encode(m)
+}
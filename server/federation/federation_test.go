@@ -0,0 +1,151 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestFederation_ExportedEndpoints(t *testing.T) {
+	clusterState := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	clusterState.AddLocalEndpoint("payments-api")
+	clusterState.AddLocalEndpoint("users")
+	clusterState.AddNode(&cluster.Node{
+		ID:     "remote",
+		Status: cluster.NodeStatusActive,
+	})
+	clusterState.UpdateRemoteEndpoint("remote", "orders", 1)
+
+	f, err := NewFederation(config.FederationConfig{
+		Export: []string{"payments-*", "orders", "inventory"},
+		Secret: "my-secret",
+	}, clusterState, log.NewNopLogger())
+	require.NoError(t, err)
+
+	// Only exported endpoints with upstreams are advertised.
+	assert.Equal(t, []string{"orders", "payments-api"}, f.ExportedEndpoints())
+}
+
+func TestFederation_Authorized(t *testing.T) {
+	f, err := NewFederation(config.FederationConfig{
+		Secret: "my-secret",
+	}, nil, log.NewNopLogger())
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.False(t, f.Authorized(r))
+
+	r.Header.Set("Authorization", "Bearer wrong-secret")
+	assert.False(t, f.Authorized(r))
+
+	r.Header.Set("Authorization", "Bearer my-secret")
+	assert.True(t, f.Authorized(r))
+}
+
+func TestFederation_Forward(t *testing.T) {
+	proxyServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/foo", r.URL.Path)
+			assert.Equal(t, "my-endpoint", r.Header.Get("x-piko-endpoint"))
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer proxyServer.Close()
+
+	exported := []string{"my-endpoint"}
+	adminServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, endpointsPath, r.URL.Path)
+			if r.Header.Get("Authorization") != "Bearer my-secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(endpointsResponse{
+				Endpoints: exported,
+			})
+		},
+	))
+	defer adminServer.Close()
+
+	f, err := NewFederation(config.FederationConfig{
+		Peers: []config.FederationPeerConfig{
+			{
+				Name:     "eu-west-1",
+				AdminURL: adminServer.URL,
+				ProxyURL: proxyServer.URL,
+			},
+		},
+		Secret: "my-secret",
+	}, nil, log.NewNopLogger())
+	require.NoError(t, err)
+
+	forward := func(endpointID string) (*httptest.ResponseRecorder, bool) {
+		r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		r.Header.Set("x-piko-endpoint", endpointID)
+		w := httptest.NewRecorder()
+		return w, f.Forward(w, r, endpointID)
+	}
+
+	// Not yet synced.
+	_, ok := forward("my-endpoint")
+	assert.False(t, ok)
+
+	f.sync(context.Background(), f.peers[0])
+
+	w, ok := forward("my-endpoint")
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	_, ok = forward("unknown")
+	assert.False(t, ok)
+
+	// Once the cluster stops exporting the endpoint, requests are no longer
+	// forwarded.
+	exported = nil
+	f.sync(context.Background(), f.peers[0])
+
+	_, ok = forward("my-endpoint")
+	assert.False(t, ok)
+}
+
+func TestFederation_SyncUnreachable(t *testing.T) {
+	adminServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			_ = json.NewEncoder(w).Encode(endpointsResponse{
+				Endpoints: []string{"my-endpoint"},
+			})
+		},
+	))
+
+	f, err := NewFederation(config.FederationConfig{
+		Peers: []config.FederationPeerConfig{
+			{
+				Name:     "eu-west-1",
+				AdminURL: adminServer.URL,
+				ProxyURL: "http://localhost:8000",
+			},
+		},
+		Secret: "my-secret",
+	}, nil, log.NewNopLogger())
+	require.NoError(t, err)
+
+	f.sync(context.Background(), f.peers[0])
+	assert.True(t, f.peers[0].HasEndpoint("my-endpoint"))
+
+	// If the cluster can't be reached, requests are no longer forwarded to
+	// the cluster.
+	adminServer.Close()
+	f.sync(context.Background(), f.peers[0])
+	assert.False(t, f.peers[0].HasEndpoint("my-endpoint"))
+}
@@ -23,10 +23,14 @@ import (
 type Gossip struct {
 	clusterState *cluster.State
 
+	syncer *syncer
+
 	// gossiper manages communicating with the other members to exchange state
 	// updates.
 	gossiper *gossip.Gossip
 
+	closeCh chan struct{}
+
 	logger log.Logger
 }
 
@@ -35,26 +39,34 @@ func NewGossip(
 	streamLn net.Listener,
 	packetLn net.PacketConn,
 	conf *gossip.Config,
+	logLevels *log.Levels,
 	logger log.Logger,
-) *Gossip {
+) (*Gossip, error) {
 	logger = logger.WithSubsystem("gossip")
 
-	syncer := newSyncer(clusterState, logger)
-	gossiper := gossip.New(
-		clusterState.LocalNode().ID,
-		conf,
-		streamLn,
-		packetLn,
-		syncer,
-		logger,
-	)
+	syncer := newSyncer(clusterState, logLevels, logger)
+	gossiper, err := gossip.New(gossip.Options{
+		NodeID:          clusterState.LocalNode().ID,
+		Config:          conf,
+		StreamTransport: gossip.NewTCPTransport(streamLn),
+		PacketTransport: gossip.NewUDPTransport(packetLn),
+		Watcher:         syncer,
+		Logger:          logger,
+	})
+	if err != nil {
+		return nil, err
+	}
 	syncer.Sync(gossiper)
 
-	return &Gossip{
+	g := &Gossip{
 		clusterState: clusterState,
+		syncer:       syncer,
 		gossiper:     gossiper,
+		closeCh:      make(chan struct{}),
 		logger:       logger,
 	}
+	go g.expirePending()
+	return g, nil
 }
 
 // JoinOnBoot attempts to join an existing cluster by syncronising with the
@@ -116,10 +128,94 @@ func (g *Gossip) NodeState(id string) (*gossip.NodeState, bool) {
 	return g.gossiper.Node(id)
 }
 
+// Conflicts returns the detected conflicts where multiple nodes are using the
+// same node ID.
+func (g *Gossip) Conflicts() []gossip.NodeConflict {
+	return g.gossiper.Conflicts()
+}
+
+// ClockSkew returns the estimated clock skew of each known node relative to
+// the local node.
+func (g *Gossip) ClockSkew() []gossip.NodeClockSkew {
+	return g.gossiper.ClockSkew()
+}
+
+// CompactLocal compacts the local node state to discard deleted entries.
+// Returns the number of discarded entries.
+func (g *Gossip) CompactLocal() int {
+	compacted := g.gossiper.CompactLocal()
+	g.logger.Info("compacted local state", zap.Int("discarded", compacted))
+	return compacted
+}
+
+// PropagateLogLevels propagates the given log levels to the rest of the
+// cluster.
+func (g *Gossip) PropagateLogLevels(state log.LevelsState) {
+	g.syncer.PropagateLogLevels(state)
+}
+
+// DrainZone drains all nodes in the given zone, including the local node if
+// it is in the zone.
+func (g *Gossip) DrainZone(zone string) {
+	g.syncer.DrainZone(zone)
+}
+
+// PendingNodes returns the nodes that have joined but haven't propagated the
+// state required to add them to the cluster.
+func (g *Gossip) PendingNodes() []PendingNode {
+	return g.syncer.PendingNodes()
+}
+
+// StartEndpointReconciler periodically reconciles the endpoints advertised
+// by the local node with the connected upstreams, to repair endpoints that
+// diverged such as ghost endpoints that are advertised without any upstreams.
+func (g *Gossip) StartEndpointReconciler(endpoints LocalEndpoints) {
+	go g.reconcileEndpoints(endpoints)
+}
+
 func (g *Gossip) Metrics() *gossip.Metrics {
 	return g.gossiper.Metrics()
 }
 
+func (g *Gossip) SyncerMetrics() *SyncerMetrics {
+	return g.syncer.metrics
+}
+
 func (g *Gossip) Close() error {
+	close(g.closeCh)
 	return g.gossiper.Close()
 }
+
+// expirePending periodically discards nodes that have been pending for too
+// long.
+func (g *Gossip) expirePending() {
+	ticker := time.NewTicker(pendingExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			g.syncer.ExpirePending(now)
+		case <-g.closeCh:
+			return
+		}
+	}
+}
+
+// reconcileEndpoints periodically reconciles the endpoints advertised by the
+// local node with the connected upstreams.
+func (g *Gossip) reconcileEndpoints(endpoints LocalEndpoints) {
+	ticker := time.NewTicker(endpointReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.syncer.ReconcileEndpoints(
+				endpoints.Endpoints(), g.gossiper.LocalNode().Entries,
+			)
+		case <-g.closeCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package gossip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// maxEndpointKeyLength is the maximum length of an endpoint ID that is
+	// included in gossip keys as is. Longer endpoint IDs are hashed to keep
+	// the keys small.
+	maxEndpointKeyLength = 64
+
+	// hashedEndpointPrefix is the prefix of hashed endpoint IDs in gossip
+	// keys.
+	hashedEndpointPrefix = "#"
+
+	// endpointNamePrefix is the prefix of the keys mapping hashed endpoint
+	// IDs to the original endpoint ID.
+	endpointNamePrefix = "endpoint_name:"
+)
+
+// encodeEndpointID returns the endpoint ID to use in gossip keys.
+//
+// Endpoint IDs that are too long, or contain characters that are reserved by
+// the key scheme, are replaced with a hash of the ID. The returned bool
+// indicates whether the ID was hashed, in which case the original ID must be
+// gossiped under an endpoint name key so other nodes can decode it.
+func encodeEndpointID(endpointID string) (string, bool) {
+	if len(endpointID) <= maxEndpointKeyLength &&
+		!strings.Contains(endpointID, ":") &&
+		!strings.HasPrefix(endpointID, hashedEndpointPrefix) {
+		return endpointID, false
+	}
+
+	sum := sha256.Sum256([]byte(endpointID))
+	return hashedEndpointPrefix + hex.EncodeToString(sum[:16]), true
+}
+
+// isHashedEndpointID returns whether the endpoint ID from a gossip key is a
+// hash of the original ID.
+func isHashedEndpointID(encoded string) bool {
+	return strings.HasPrefix(encoded, hashedEndpointPrefix)
+}
@@ -0,0 +1,74 @@
+package gossip
+
+import "github.com/prometheus/client_golang/prometheus"
+
+type SyncerMetrics struct {
+	// PendingNodes is the number of nodes that have joined but haven't
+	// propagated the state required to add them to the cluster.
+	PendingNodes prometheus.Gauge
+
+	// PendingNodeMaxAge is the number of seconds the oldest pending node has
+	// been pending.
+	PendingNodeMaxAge prometheus.Gauge
+
+	// PendingNodesExpiredTotal is the number of pending nodes discarded
+	// before their state was complete. Labelled by reason, where 'ttl' means
+	// the node was pending for too long and 'limit' means the maximum number
+	// of pending nodes was reached.
+	PendingNodesExpiredTotal *prometheus.CounterVec
+
+	// EndpointCorrectionsTotal is the number of local endpoint keys
+	// corrected by reconciling the advertised endpoints with the connected
+	// upstreams. Labelled by action, where 'upsert' means the advertised
+	// number of upstreams was wrong and 'delete' means an endpoint with no
+	// upstreams was advertised.
+	EndpointCorrectionsTotal *prometheus.CounterVec
+}
+
+func NewSyncerMetrics() *SyncerMetrics {
+	return &SyncerMetrics{
+		PendingNodes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "pending_nodes",
+				Help:      "Number of nodes waiting for their full state",
+			},
+		),
+		PendingNodeMaxAge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "pending_node_max_age_seconds",
+				Help:      "Seconds the oldest pending node has been pending",
+			},
+		),
+		PendingNodesExpiredTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "pending_nodes_expired_total",
+				Help:      "Number of pending nodes discarded before their state was complete",
+			},
+			[]string{"reason"},
+		),
+		EndpointCorrectionsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "endpoint_corrections_total",
+				Help:      "Number of advertised local endpoint keys corrected by reconciliation",
+			},
+			[]string{"action"},
+		),
+	}
+}
+
+func (m *SyncerMetrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.PendingNodes,
+		m.PendingNodeMaxAge,
+		m.PendingNodesExpiredTotal,
+		m.EndpointCorrectionsTotal,
+	)
+}
@@ -0,0 +1,113 @@
+package gossip
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/gossip"
+)
+
+const (
+	// endpointReconcileInterval is the interval to reconcile the endpoints
+	// advertised by the local node with the connected upstreams.
+	endpointReconcileInterval = time.Second * 30
+)
+
+// LocalEndpoints returns the number of upstreams connected to the local node
+// for each endpoint.
+type LocalEndpoints interface {
+	Endpoints() map[string]int
+}
+
+// endpointDivergence is an advertised endpoint that doesn't match the
+// connected upstreams.
+type endpointDivergence struct {
+	// endpointID is the ID of the endpoint to upsert. Unset if the key
+	// should be deleted.
+	endpointID string
+
+	// listeners is the number of connected upstreams, or zero if the key
+	// should be deleted.
+	listeners int
+}
+
+// ReconcileEndpoints cross-checks the endpoint keys advertised by the local
+// node against the given number of connected upstreams for each endpoint,
+// and repairs any divergence by re-upserting or deleting the keys. Returns
+// the number of corrected keys.
+//
+// Since the connected upstreams and advertised keys are read at different
+// times, a key is only corrected if it diverges in two consecutive sweeps,
+// so a key that is being updated concurrently isn't overwritten.
+func (s *syncer) ReconcileEndpoints(
+	endpoints map[string]int,
+	entries []gossip.Entry,
+) int {
+	advertised := make(map[string]string)
+	for _, entry := range entries {
+		if entry.Deleted || !strings.HasPrefix(entry.Key, "endpoint:") {
+			continue
+		}
+		advertised[entry.Key] = entry.Value
+	}
+
+	divergence := make(map[string]endpointDivergence)
+	for endpointID, listeners := range endpoints {
+		if listeners == 0 {
+			continue
+		}
+		encoded, _ := encodeEndpointID(endpointID)
+		key := "endpoint:" + encoded
+		value, ok := advertised[key]
+		delete(advertised, key)
+		if ok && value == strconv.Itoa(listeners) {
+			continue
+		}
+		divergence[key] = endpointDivergence{
+			endpointID: endpointID,
+			listeners:  listeners,
+		}
+	}
+	// Any remaining advertised keys have no connected upstreams.
+	for key := range advertised {
+		divergence[key] = endpointDivergence{}
+	}
+
+	s.mu.Lock()
+	previous := s.endpointDivergence
+	s.endpointDivergence = make(map[string]endpointDivergence)
+	for key, d := range divergence {
+		if p, ok := previous[key]; !ok || p != d {
+			// Wait for the next sweep to confirm the divergence.
+			s.endpointDivergence[key] = d
+			delete(divergence, key)
+		}
+	}
+	s.mu.Unlock()
+
+	for key, d := range divergence {
+		if d.listeners > 0 {
+			s.logger.Warn(
+				"reconcile endpoints: advertised listeners diverged; upserting",
+				zap.String("endpoint-id", d.endpointID),
+				zap.Int("listeners", d.listeners),
+			)
+			s.gossiper.UpsertLocal(
+				s.localEndpointKey("endpoint:", d.endpointID),
+				strconv.Itoa(d.listeners),
+			)
+			s.metrics.EndpointCorrectionsTotal.WithLabelValues("upsert").Inc()
+		} else {
+			s.logger.Warn(
+				"reconcile endpoints: advertised endpoint has no upstreams; deleting",
+				zap.String("key", key),
+			)
+			s.gossiper.DeleteLocal(key)
+			s.metrics.EndpointCorrectionsTotal.WithLabelValues("delete").Inc()
+		}
+	}
+	return len(divergence)
+}
@@ -0,0 +1,117 @@
+package gossip
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/pkg/gossip"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+func TestSyncer_ReconcileEndpoints(t *testing.T) {
+	newSyncerWithGossiper := func() (*syncer, *fakeGossiper) {
+		m := cluster.NewState(&cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+		gossiper.upserts = nil
+		return sync, gossiper
+	}
+
+	t.Run("converged", func(t *testing.T) {
+		sync, gossiper := newSyncerWithGossiper()
+
+		endpoints := map[string]int{"my-endpoint": 2}
+		entries := []gossip.Entry{
+			{Key: "endpoint:my-endpoint", Value: "2"},
+			{Key: "endpoint:deleted-endpoint", Value: "1", Deleted: true},
+			{Key: "load:other-endpoint", Value: "1"},
+		}
+		assert.Equal(t, 0, sync.ReconcileEndpoints(endpoints, entries))
+		assert.Equal(t, 0, sync.ReconcileEndpoints(endpoints, entries))
+
+		assert.Empty(t, gossiper.upserts)
+		assert.Empty(t, gossiper.deletes)
+	})
+
+	t.Run("diverged", func(t *testing.T) {
+		sync, gossiper := newSyncerWithGossiper()
+
+		endpoints := map[string]int{
+			"my-endpoint":      2,
+			"missing-endpoint": 1,
+		}
+		entries := []gossip.Entry{
+			{Key: "endpoint:my-endpoint", Value: "1"},
+			{Key: "endpoint:ghost-endpoint", Value: "3"},
+		}
+
+		// The first sweep only detects the divergence.
+		assert.Equal(t, 0, sync.ReconcileEndpoints(endpoints, entries))
+		assert.Empty(t, gossiper.upserts)
+		assert.Empty(t, gossiper.deletes)
+
+		assert.Equal(t, 3, sync.ReconcileEndpoints(endpoints, entries))
+		assert.ElementsMatch(t, []upsert{
+			{"endpoint:my-endpoint", "2"},
+			{"endpoint:missing-endpoint", "1"},
+		}, gossiper.upserts)
+		assert.Equal(t, []string{"endpoint:ghost-endpoint"}, gossiper.deletes)
+
+		assert.Equal(t, 2.0, testutil.ToFloat64(
+			sync.metrics.EndpointCorrectionsTotal.WithLabelValues("upsert"),
+		))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			sync.metrics.EndpointCorrectionsTotal.WithLabelValues("delete"),
+		))
+	})
+
+	t.Run("resolved", func(t *testing.T) {
+		sync, gossiper := newSyncerWithGossiper()
+
+		endpoints := map[string]int{"my-endpoint": 2}
+
+		// The divergence is resolved before the next sweep, such as the key
+		// being updated while reconciling, so isn't corrected.
+		assert.Equal(t, 0, sync.ReconcileEndpoints(endpoints, []gossip.Entry{
+			{Key: "endpoint:my-endpoint", Value: "1"},
+		}))
+		assert.Equal(t, 0, sync.ReconcileEndpoints(endpoints, []gossip.Entry{
+			{Key: "endpoint:my-endpoint", Value: "2"},
+		}))
+
+		// The number of upstreams changed between sweeps so the key must
+		// diverge again before it's corrected.
+		assert.Equal(t, 0, sync.ReconcileEndpoints(endpoints, nil))
+		assert.Equal(t, 0, sync.ReconcileEndpoints(
+			map[string]int{"my-endpoint": 3}, nil,
+		))
+
+		assert.Empty(t, gossiper.upserts)
+		assert.Empty(t, gossiper.deletes)
+	})
+
+	t.Run("hashed endpoint", func(t *testing.T) {
+		sync, gossiper := newSyncerWithGossiper()
+
+		endpointID := "my:endpoint"
+		encoded, _ := encodeEndpointID(endpointID)
+		endpoints := map[string]int{endpointID: 1}
+
+		sync.ReconcileEndpoints(endpoints, nil)
+		assert.Equal(t, 1, sync.ReconcileEndpoints(endpoints, nil))
+
+		// The endpoint name is propagated before the endpoint key.
+		assert.Equal(t, []upsert{
+			{endpointNamePrefix + encoded, endpointID},
+			{"endpoint:" + encoded, "1"},
+		}, gossiper.upserts)
+	})
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/andydunstall/piko/pkg/gossip"
 	"github.com/andydunstall/piko/server/status"
 )
 
@@ -22,6 +23,10 @@ func NewStatus(gossip *Gossip) *Status {
 func (s *Status) Register(group *gin.RouterGroup) {
 	group.GET("/nodes", s.listNodesRoute)
 	group.GET("/nodes/:id", s.getNodeRoute)
+	group.GET("/pending", s.listPendingRoute)
+	group.GET("/conflicts", s.listConflictsRoute)
+	group.GET("/skew", s.listClockSkewRoute)
+	group.POST("/compact", s.compactRoute)
 }
 
 func (s *Status) listNodesRoute(c *gin.Context) {
@@ -46,4 +51,31 @@ func (s *Status) getNodeRoute(c *gin.Context) {
 	c.JSON(http.StatusOK, state)
 }
 
+func (s *Status) listPendingRoute(c *gin.Context) {
+	c.JSON(http.StatusOK, s.gossip.PendingNodes())
+}
+
+func (s *Status) listConflictsRoute(c *gin.Context) {
+	conflicts := s.gossip.Conflicts()
+	if conflicts == nil {
+		conflicts = []gossip.NodeConflict{}
+	}
+	c.JSON(http.StatusOK, conflicts)
+}
+
+func (s *Status) listClockSkewRoute(c *gin.Context) {
+	c.JSON(http.StatusOK, s.gossip.ClockSkew())
+}
+
+type compactResponse struct {
+	Discarded int `json:"discarded"`
+}
+
+func (s *Status) compactRoute(c *gin.Context) {
+	discarded := s.gossip.CompactLocal()
+	c.JSON(http.StatusOK, compactResponse{
+		Discarded: discarded,
+	})
+}
+
 var _ status.Handler = &Status{}
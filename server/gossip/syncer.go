@@ -1,9 +1,13 @@
 package gossip
 
 import (
+	"encoding/json"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -12,6 +16,54 @@ import (
 	"github.com/andydunstall/piko/server/cluster"
 )
 
+const (
+	// pendingNodeTTL is the maximum duration a node may be pending before
+	// it is discarded, such as a node running an incompatible version that
+	// never propagates its full state.
+	pendingNodeTTL = time.Minute * 10
+
+	// maxPendingNodes is the maximum number of pending nodes. Once reached,
+	// the node that has been pending the longest is discarded.
+	maxPendingNodes = 1024
+
+	// pendingExpiryInterval is the interval to discard expired pending nodes.
+	pendingExpiryInterval = time.Second * 10
+)
+
+// pendingNode is a node that we haven't received the full state for.
+type pendingNode struct {
+	*cluster.Node
+
+	// joinedAt is when the node joined.
+	joinedAt time.Time
+}
+
+// missing returns the required fields the node hasn't propagated yet.
+func (n *pendingNode) missing() []string {
+	missing := []string{}
+	if n.ProxyAddr == "" {
+		missing = append(missing, "proxy_addr")
+	}
+	if n.AdminAddr == "" {
+		missing = append(missing, "admin_addr")
+	}
+	return missing
+}
+
+// PendingNode describes a node that has joined but hasn't propagated the
+// state required to add it to the cluster.
+type PendingNode struct {
+	ID string `json:"id"`
+
+	Status cluster.NodeStatus `json:"status,omitempty"`
+
+	// JoinedAt is when the node joined.
+	JoinedAt time.Time `json:"joined_at"`
+
+	// Missing contains the required fields the node hasn't propagated.
+	Missing []string `json:"missing"`
+}
+
 type gossiper interface {
 	UpsertLocal(key, value string)
 	DeleteLocal(key string)
@@ -26,23 +78,54 @@ type gossiper interface {
 type syncer struct {
 	// pendingNodes contains nodes that we haven't received the full state for
 	// yet so can't be added to the cluster.
-	pendingNodes map[string]*cluster.Node
+	pendingNodes map[string]*pendingNode
+
+	// localEndpointNames contains the hashed endpoint IDs the local node has
+	// propagated an endpoint name key for.
+	localEndpointNames map[string]struct{}
+
+	// endpointNames maps the hashed endpoint IDs propagated by each remote
+	// node to the original endpoint ID.
+	endpointNames map[string]map[string]string
+
+	// endpointDivergence contains the local endpoint keys that diverged from
+	// the connected upstreams in the last reconcile sweep.
+	endpointDivergence map[string]endpointDivergence
 
 	// mu protects the above fields.
 	mu sync.Mutex
 
 	clusterState *cluster.State
 
+	// logLevels is updated with log levels propagated by other nodes. May be
+	// nil.
+	logLevels *log.Levels
+
 	gossiper gossiper
 
+	// startedAt is when the local node started. Zone drains announced before
+	// the node started are ignored, so a restarted node isn't drained.
+	startedAt time.Time
+
+	metrics *SyncerMetrics
+
 	logger log.Logger
 }
 
-func newSyncer(clusterState *cluster.State, logger log.Logger) *syncer {
+func newSyncer(
+	clusterState *cluster.State,
+	logLevels *log.Levels,
+	logger log.Logger,
+) *syncer {
 	return &syncer{
-		pendingNodes: make(map[string]*cluster.Node),
-		clusterState: clusterState,
-		logger:       logger,
+		pendingNodes:       make(map[string]*pendingNode),
+		localEndpointNames: make(map[string]struct{}),
+		endpointNames:      make(map[string]map[string]string),
+		clusterState:       clusterState,
+		logLevels:          logLevels,
+		startedAt:          time.Now(),
+		metrics:            NewSyncerMetrics(),
+		logger:             logger,
 	}
 }
 
@@ -50,16 +133,34 @@ func (s *syncer) Sync(gossiper gossiper) {
 	s.gossiper = gossiper
 
 	s.clusterState.OnLocalEndpointUpdate(s.onLocalEndpointUpdate)
+	s.clusterState.OnLocalEndpointResume(s.onLocalEndpointResume)
+	s.clusterState.OnLocalLoadUpdate(s.onLocalLoadUpdate)
+	s.clusterState.OnLocalDrain(s.onLocalDrain)
 
 	localNode := s.clusterState.LocalNode()
-	// First add immutable fields.
+	// First add immutable fields. The forward address and zone are optional
+	// so are added before the required fields, so they're known when other
+	// nodes add this node to their cluster state.
+	if localNode.ForwardAddr != "" {
+		s.gossiper.UpsertLocal("forward_addr", localNode.ForwardAddr)
+	}
+	if localNode.Zone != "" {
+		s.gossiper.UpsertLocal("zone", localNode.Zone)
+	}
 	s.gossiper.UpsertLocal("proxy_addr", localNode.ProxyAddr)
 	s.gossiper.UpsertLocal("admin_addr", localNode.AdminAddr)
 	// Finally add mutable fields.
+	if localNode.Draining {
+		s.gossiper.UpsertLocal("draining", "true")
+	}
 	for endpointID, listeners := range localNode.Endpoints {
-		key := "endpoint:" + endpointID
+		key := s.localEndpointKey("endpoint:", endpointID)
 		s.gossiper.UpsertLocal(key, strconv.Itoa(listeners))
 	}
+	for endpointID, load := range localNode.Load {
+		key := s.localEndpointKey("load:", endpointID)
+		s.gossiper.UpsertLocal(key, encodeLoad(load))
+	}
 }
 
 func (s *syncer) OnJoin(nodeID string) {
@@ -90,11 +191,19 @@ func (s *syncer) OnJoin(nodeID string) {
 		return
 	}
 
+	if len(s.pendingNodes) >= maxPendingNodes {
+		s.evictOldestPendingLocked()
+	}
+
 	// Add as pending since we don't have enough information to add to the
 	// cluster.
-	s.pendingNodes[nodeID] = &cluster.Node{
-		ID: nodeID,
+	s.pendingNodes[nodeID] = &pendingNode{
+		Node: &cluster.Node{
+			ID: nodeID,
+		},
+		joinedAt: time.Now(),
 	}
+	s.metrics.PendingNodes.Set(float64(len(s.pendingNodes)))
 
 	s.logger.Info("node joined", zap.String("node-id", nodeID))
 }
@@ -122,7 +231,7 @@ func (s *syncer) OnLeave(nodeID string) {
 	// If a pending node has left it can be discarded.
 	_, ok := s.pendingNodes[nodeID]
 	if ok {
-		delete(s.pendingNodes, nodeID)
+		s.deletePendingLocked(nodeID)
 
 		s.logger.Info(
 			"node leave; removed from pending",
@@ -221,6 +330,10 @@ func (s *syncer) OnExpired(nodeID string) {
 		return
 	}
 
+	s.mu.Lock()
+	delete(s.endpointNames, nodeID)
+	s.mu.Unlock()
+
 	if removed := s.clusterState.RemoveNode(nodeID); removed {
 		s.logger.Info(
 			"node expired; removed from cluster",
@@ -234,7 +347,7 @@ func (s *syncer) OnExpired(nodeID string) {
 
 	_, ok := s.pendingNodes[nodeID]
 	if ok {
-		delete(s.pendingNodes, nodeID)
+		s.deletePendingLocked(nodeID)
 
 		s.logger.Info(
 			"node expired; removed from pending",
@@ -258,7 +371,47 @@ func (s *syncer) OnUpsertKey(nodeID, key, value string) {
 		return
 	}
 
-	if key == "proxy_addr" || key == "admin_addr" {
+	if strings.HasPrefix(key, endpointNamePrefix) {
+		s.upsertEndpointName(nodeID, key, value)
+		return
+	}
+	key, ok := s.decodeEndpointKey(nodeID, key)
+	if !ok {
+		return
+	}
+
+	// Resuming endpoints are independent of the node that announced them,
+	// since the node is expected to leave the cluster.
+	if strings.HasPrefix(key, "resume:") {
+		endpointID, _ := strings.CutPrefix(key, "resume:")
+		deadline, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			s.logger.Error(
+				"node upsert state; invalid resume deadline",
+				zap.String("node-id", nodeID),
+				zap.String("deadline", value),
+				zap.Error(err),
+			)
+			return
+		}
+		s.clusterState.AddResumingEndpoint(endpointID, time.UnixMilli(deadline))
+		return
+	}
+
+	// Log levels are also independent of the node that announced them.
+	if key == "log_levels" {
+		s.applyLogLevels(nodeID, value)
+		return
+	}
+
+	// Zone drains are also independent of the node that announced them.
+	if strings.HasPrefix(key, "drain:") {
+		s.applyDrain(nodeID, key, value)
+		return
+	}
+
+	if key == "proxy_addr" || key == "admin_addr" || key == "forward_addr" ||
+		key == "zone" {
 		// Ignore immutable fields if the node is in the cluster state. This
 		// may occur after a compaction so immutable fields are re-versioned.
 		if _, ok := s.clusterState.Node(nodeID); ok {
@@ -284,6 +437,27 @@ func (s *syncer) OnUpsertKey(nodeID, key, value string) {
 			return
 		}
 	}
+	if strings.HasPrefix(key, "load:") {
+		endpointID, _ := strings.CutPrefix(key, "load:")
+		load, err := decodeLoad(value)
+		if err != nil {
+			s.logger.Error(
+				"node upsert state; invalid endpoint load",
+				zap.String("node-id", nodeID),
+				zap.String("load", value),
+				zap.Error(err),
+			)
+			return
+		}
+		if s.clusterState.UpdateRemoteLoad(nodeID, endpointID, load) {
+			return
+		}
+	}
+	if key == "draining" {
+		if s.clusterState.UpdateRemoteDraining(nodeID, value == "true") {
+			return
+		}
+	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -301,6 +475,12 @@ func (s *syncer) OnUpsertKey(nodeID, key, value string) {
 		node.ProxyAddr = value
 	} else if key == "admin_addr" {
 		node.AdminAddr = value
+	} else if key == "forward_addr" {
+		node.ForwardAddr = value
+	} else if key == "zone" {
+		node.Zone = value
+	} else if key == "draining" {
+		node.Draining = value == "true"
 	} else if strings.HasPrefix(key, "endpoint:") {
 		endpointID, _ := strings.CutPrefix(key, "endpoint:")
 		listeners, err := strconv.Atoi(value)
@@ -317,6 +497,14 @@ func (s *syncer) OnUpsertKey(nodeID, key, value string) {
 			node.Endpoints = make(map[string]int)
 		}
 		node.Endpoints[endpointID] = listeners
+	} else if strings.HasPrefix(key, "load:") {
+		endpointID, _ := strings.CutPrefix(key, "load:")
+		// The load was already validated above.
+		load, _ := decodeLoad(value)
+		if node.Load == nil {
+			node.Load = make(map[string]cluster.EndpointLoad)
+		}
+		node.Load[endpointID] = load
 	} else {
 		s.logger.Error(
 			"node upsert state; unsupported key",
@@ -334,8 +522,8 @@ func (s *syncer) OnUpsertKey(nodeID, key, value string) {
 			node.Status = cluster.NodeStatusActive
 		}
 
-		delete(s.pendingNodes, node.ID)
-		s.clusterState.AddNode(node)
+		s.deletePendingLocked(node.ID)
+		s.clusterState.AddNode(node.Node)
 
 		s.logger.Debug(
 			"node upsert state; added to cluster",
@@ -363,6 +551,32 @@ func (s *syncer) OnDeleteKey(nodeID, key string) {
 		return
 	}
 
+	if strings.HasPrefix(key, endpointNamePrefix) {
+		s.deleteEndpointName(nodeID, key)
+		return
+	}
+	key, ok := s.decodeEndpointKey(nodeID, key)
+	if !ok {
+		return
+	}
+
+	// Resuming endpoints expire at their deadline so deletes can be
+	// ignored.
+	if strings.HasPrefix(key, "resume:") {
+		return
+	}
+
+	// Log levels and zone drains are only ever replaced, and nodes never
+	// stop draining, so deletes can be ignored.
+	if key == "log_levels" || key == "draining" || strings.HasPrefix(key, "drain:") {
+		return
+	}
+
+	if strings.HasPrefix(key, "load:") {
+		s.deleteLoad(nodeID, key)
+		return
+	}
+
 	// Only endpoint state can be deleted.
 	if !strings.HasPrefix(key, "endpoint:") {
 		s.logger.Error(
@@ -407,14 +621,346 @@ func (s *syncer) OnDeleteKey(nodeID, key string) {
 	)
 }
 
+// PendingNodes returns the nodes that have joined but haven't propagated the
+// state required to add them to the cluster, sorted by node ID.
+func (s *syncer) PendingNodes() []PendingNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodes := make([]PendingNode, 0, len(s.pendingNodes))
+	for _, node := range s.pendingNodes {
+		nodes = append(nodes, PendingNode{
+			ID:       node.ID,
+			Status:   node.Status,
+			JoinedAt: node.joinedAt,
+			Missing:  node.missing(),
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
+
+// ExpirePending discards nodes that have been pending for longer than the
+// pending TTL, and updates the pending node metrics.
+func (s *syncer) ExpirePending(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var maxAge time.Duration
+	for nodeID, node := range s.pendingNodes {
+		age := now.Sub(node.joinedAt)
+		if age <= pendingNodeTTL {
+			maxAge = max(maxAge, age)
+			continue
+		}
+
+		s.deletePendingLocked(nodeID)
+		s.metrics.PendingNodesExpiredTotal.WithLabelValues("ttl").Inc()
+
+		s.logger.Warn(
+			"pending node expired; state incomplete",
+			zap.String("node-id", nodeID),
+			zap.Duration("age", age),
+			zap.Strings("missing", node.missing()),
+		)
+	}
+	s.metrics.PendingNodeMaxAge.Set(maxAge.Seconds())
+}
+
+// evictOldestPendingLocked discards the node that has been pending the
+// longest, to make room for a new pending node.
+func (s *syncer) evictOldestPendingLocked() {
+	var oldest *pendingNode
+	for _, node := range s.pendingNodes {
+		if oldest == nil || node.joinedAt.Before(oldest.joinedAt) {
+			oldest = node
+		}
+	}
+	if oldest == nil {
+		return
+	}
+
+	s.deletePendingLocked(oldest.ID)
+	s.metrics.PendingNodesExpiredTotal.WithLabelValues("limit").Inc()
+
+	s.logger.Warn(
+		"pending node evicted; too many pending nodes",
+		zap.String("node-id", oldest.ID),
+		zap.Strings("missing", oldest.missing()),
+	)
+}
+
+func (s *syncer) deletePendingLocked(nodeID string) {
+	delete(s.pendingNodes, nodeID)
+	s.metrics.PendingNodes.Set(float64(len(s.pendingNodes)))
+}
+
 func (s *syncer) onLocalEndpointUpdate(endpointID string) {
-	key := "endpoint:" + endpointID
+	key := s.localEndpointKey("endpoint:", endpointID)
 	listeners := s.clusterState.LocalEndpointListeners(endpointID)
 	if listeners > 0 {
 		s.gossiper.UpsertLocal(key, strconv.Itoa(listeners))
 	} else {
 		s.gossiper.DeleteLocal(key)
+		if _, ok := s.clusterState.LocalEndpointLoad(endpointID); !ok {
+			s.deleteLocalEndpointName(endpointID)
+		}
+	}
+}
+
+func (s *syncer) onLocalLoadUpdate(endpointID string) {
+	key := s.localEndpointKey("load:", endpointID)
+	load, ok := s.clusterState.LocalEndpointLoad(endpointID)
+	if ok {
+		s.gossiper.UpsertLocal(key, encodeLoad(load))
+	} else {
+		s.gossiper.DeleteLocal(key)
+		if s.clusterState.LocalEndpointListeners(endpointID) == 0 {
+			s.deleteLocalEndpointName(endpointID)
+		}
+	}
+}
+
+func (s *syncer) onLocalEndpointResume(endpointID string, deadline time.Time) {
+	s.gossiper.UpsertLocal(
+		s.localEndpointKey("resume:", endpointID),
+		strconv.FormatInt(deadline.UnixMilli(), 10),
+	)
+}
+
+// localEndpointKey returns the gossip key with the given prefix for the
+// endpoint.
+//
+// If the endpoint ID must be hashed, the endpoint name key mapping the hash
+// to the endpoint ID is propagated first. Since gossip propagates state
+// updates in order, other nodes always receive the endpoint name before the
+// keys that use it.
+func (s *syncer) localEndpointKey(prefix string, endpointID string) string {
+	encoded, hashed := encodeEndpointID(endpointID)
+	if !hashed {
+		return prefix + encoded
+	}
+
+	s.mu.Lock()
+	_, ok := s.localEndpointNames[encoded]
+	s.localEndpointNames[encoded] = struct{}{}
+	s.mu.Unlock()
+
+	if !ok {
+		s.gossiper.UpsertLocal(endpointNamePrefix+encoded, endpointID)
+	}
+	return prefix + encoded
+}
+
+// deleteLocalEndpointName deletes the endpoint name key for the endpoint
+// once the local node has no other keys that use it.
+func (s *syncer) deleteLocalEndpointName(endpointID string) {
+	encoded, hashed := encodeEndpointID(endpointID)
+	if !hashed {
+		return
+	}
+
+	s.mu.Lock()
+	_, ok := s.localEndpointNames[encoded]
+	delete(s.localEndpointNames, encoded)
+	s.mu.Unlock()
+
+	if ok {
+		s.gossiper.DeleteLocal(endpointNamePrefix + encoded)
+	}
+}
+
+func (s *syncer) upsertEndpointName(nodeID, key, endpointID string) {
+	encoded, _ := strings.CutPrefix(key, endpointNamePrefix)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names, ok := s.endpointNames[nodeID]
+	if !ok {
+		names = make(map[string]string)
+		s.endpointNames[nodeID] = names
+	}
+	names[encoded] = endpointID
+}
+
+func (s *syncer) deleteEndpointName(nodeID, key string) {
+	encoded, _ := strings.CutPrefix(key, endpointNamePrefix)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names, ok := s.endpointNames[nodeID]
+	if !ok {
+		return
+	}
+	delete(names, encoded)
+	if len(names) == 0 {
+		delete(s.endpointNames, nodeID)
+	}
+}
+
+// decodeEndpointKey replaces a hashed endpoint ID in the key with the
+// original endpoint ID propagated by the node. Returns false if the endpoint
+// ID is unknown.
+func (s *syncer) decodeEndpointKey(nodeID, key string) (string, bool) {
+	prefix, encoded, ok := strings.Cut(key, ":")
+	if !ok || !isHashedEndpointID(encoded) {
+		return key, true
+	}
+	if prefix != "endpoint" && prefix != "load" && prefix != "resume" {
+		return key, true
+	}
+
+	s.mu.Lock()
+	endpointID, ok := s.endpointNames[nodeID][encoded]
+	s.mu.Unlock()
+
+	if !ok {
+		s.logger.Warn(
+			"node state; unknown hashed endpoint id",
+			zap.String("node-id", nodeID),
+			zap.String("key", key),
+		)
+		return "", false
+	}
+	return prefix + ":" + endpointID, true
+}
+
+func (s *syncer) onLocalDrain() {
+	s.gossiper.UpsertLocal("draining", "true")
+}
+
+func (s *syncer) deleteLoad(nodeID, key string) {
+	endpointID, _ := strings.CutPrefix(key, "load:")
+	if s.clusterState.RemoveRemoteLoad(nodeID, endpointID) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, ok := s.pendingNodes[nodeID]
+	if !ok {
+		s.logger.Warn(
+			"node delete state; unknown node",
+			zap.String("node-id", nodeID),
+			zap.String("key", key),
+		)
+		return
+	}
+
+	delete(node.Load, endpointID)
+}
+
+// encodeLoad encodes the endpoint load as a gossip value, formatted as
+// '<requests>,<ages>' where ages contains the count in each connection age
+// bucket, such as '12,1,0,3'.
+// PropagateLogLevels announces the given log levels to the cluster. Each
+// node applies the levels if they are newer than its own.
+func (s *syncer) PropagateLogLevels(state log.LevelsState) {
+	// Encoding a struct of strings can't fail.
+	value, _ := json.Marshal(state)
+	s.gossiper.UpsertLocal("log_levels", string(value))
+}
+
+// DrainZone announces that all nodes in the given zone should drain, and
+// drains the local node if it is in the zone.
+func (s *syncer) DrainZone(zone string) {
+	s.gossiper.UpsertLocal(
+		"drain:"+zone, strconv.FormatInt(time.Now().UnixMilli(), 10),
+	)
+	s.clusterState.DrainZone(zone)
+}
+
+// applyDrain drains the local node if a drain announced after the node
+// started targets the local node's zone.
+func (s *syncer) applyDrain(nodeID string, key string, value string) {
+	zone, _ := strings.CutPrefix(key, "drain:")
+	issuedAt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		s.logger.Error(
+			"node upsert state; invalid drain timestamp",
+			zap.String("node-id", nodeID),
+			zap.String("timestamp", value),
+			zap.Error(err),
+		)
+		return
+	}
+	if issuedAt < s.startedAt.UnixMilli() {
+		return
+	}
+	if s.clusterState.DrainZone(zone) {
+		s.logger.Info(
+			"draining local node",
+			zap.String("node-id", nodeID),
+			zap.String("zone", zone),
+		)
+	}
+}
+
+func (s *syncer) applyLogLevels(nodeID string, value string) {
+	if s.logLevels == nil {
+		return
+	}
+
+	var state log.LevelsState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		s.logger.Error(
+			"node upsert state; invalid log levels",
+			zap.String("node-id", nodeID),
+			zap.String("log-levels", value),
+			zap.Error(err),
+		)
+		return
+	}
+
+	updated, err := s.logLevels.Apply(state)
+	if err != nil {
+		s.logger.Error(
+			"node upsert state; invalid log levels",
+			zap.String("node-id", nodeID),
+			zap.String("log-levels", value),
+			zap.Error(err),
+		)
+		return
+	}
+	if updated {
+		s.logger.Info(
+			"updated log levels",
+			zap.String("node-id", nodeID),
+			zap.String("level", state.Level),
+			zap.Any("subsystems", state.Subsystems),
+		)
+	}
+}
+
+func encodeLoad(load cluster.EndpointLoad) string {
+	return fmt.Sprintf(
+		"%d,%d,%d,%d", load.Requests, load.Ages[0], load.Ages[1], load.Ages[2],
+	)
+}
+
+func decodeLoad(value string) (cluster.EndpointLoad, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != 4 {
+		return cluster.EndpointLoad{}, fmt.Errorf("invalid fields: %d", len(fields))
+	}
+
+	counts := make([]int, 0, len(fields))
+	for _, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return cluster.EndpointLoad{}, err
+		}
+		counts = append(counts, n)
 	}
+	return cluster.EndpointLoad{
+		Requests: counts[0],
+		Ages:     [3]int{counts[1], counts[2], counts[3]},
+	}, nil
 }
 
 var _ gossip.Watcher = &syncer{}
@@ -1,8 +1,13 @@
 package gossip
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/andydunstall/piko/pkg/log"
@@ -43,7 +48,7 @@ func TestSyncer_Sync(t *testing.T) {
 	m.AddLocalEndpoint("my-endpoint")
 	m.AddLocalEndpoint("my-endpoint")
 
-	sync := newSyncer(m, log.NewNopLogger())
+	sync := newSyncer(m, nil, log.NewNopLogger())
 
 	gossiper := &fakeGossiper{}
 	sync.Sync(gossiper)
@@ -67,7 +72,7 @@ func TestSyncer_OnLocalEndpointUpdate(t *testing.T) {
 	}
 	m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-	sync := newSyncer(m, log.NewNopLogger())
+	sync := newSyncer(m, nil, log.NewNopLogger())
 
 	gossiper := &fakeGossiper{}
 	sync.Sync(gossiper)
@@ -101,6 +106,186 @@ func TestSyncer_OnLocalEndpointUpdate(t *testing.T) {
 	)
 }
 
+func TestSyncer_OnLocalLoadUpdate(t *testing.T) {
+	localNode := &cluster.Node{
+		ID:        "local",
+		ProxyAddr: "10.26.104.56:8000",
+		AdminAddr: "10.26.104.56:8001",
+	}
+	m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+	sync := newSyncer(m, nil, log.NewNopLogger())
+
+	gossiper := &fakeGossiper{}
+	sync.Sync(gossiper)
+
+	m.UpdateLocalLoad(map[string]cluster.EndpointLoad{
+		"my-endpoint": {Requests: 12, Ages: [3]int{1, 0, 3}},
+	})
+	assert.Equal(
+		t,
+		upsert{"load:my-endpoint", "12,1,0,3"},
+		gossiper.upserts[len(gossiper.upserts)-1],
+	)
+
+	m.UpdateLocalLoad(map[string]cluster.EndpointLoad{})
+	assert.Equal(
+		t,
+		"load:my-endpoint",
+		gossiper.deletes[len(gossiper.deletes)-1],
+	)
+}
+
+func TestSyncer_Resume(t *testing.T) {
+	t.Run("local resume", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+		m.AddLocalEndpoint("my-endpoint")
+
+		sync := newSyncer(m, nil, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		deadline := time.UnixMilli(1700000000000)
+		m.ResumeLocalEndpoints(deadline)
+		assert.Equal(
+			t,
+			upsert{"resume:my-endpoint", "1700000000000"},
+			gossiper.upserts[len(gossiper.upserts)-1],
+		)
+	})
+
+	t.Run("remote resume", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, nil, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		// The resuming endpoint is recorded even if the node isn't known.
+		deadline := time.Now().Add(time.Minute).UnixMilli()
+		sync.OnUpsertKey(
+			"remote", "resume:my-endpoint", strconv.FormatInt(deadline, 10),
+		)
+
+		resumeDeadline, ok := m.ResumingEndpoint("my-endpoint")
+		assert.True(t, ok)
+		assert.Equal(t, deadline, resumeDeadline.UnixMilli())
+	})
+}
+
+func TestSyncer_Drain(t *testing.T) {
+	t.Run("local drain", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+			Zone:      "us-east-1a",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, nil, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+		assert.Equal(t, upsert{"zone", "us-east-1a"}, gossiper.upserts[0])
+
+		sync.DrainZone("us-east-1a")
+		assert.True(t, m.LocalDraining())
+
+		assert.Equal(t, "drain:us-east-1a", gossiper.upserts[len(gossiper.upserts)-2].Key)
+		assert.Equal(
+			t,
+			upsert{"draining", "true"},
+			gossiper.upserts[len(gossiper.upserts)-1],
+		)
+	})
+
+	t.Run("remote drain", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+			Zone:      "us-east-1a",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, nil, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		// Drains of other zones are ignored.
+		sync.OnUpsertKey(
+			"remote",
+			"drain:us-east-1b",
+			strconv.FormatInt(time.Now().UnixMilli(), 10),
+		)
+		assert.False(t, m.LocalDraining())
+
+		// Drains announced before the node started are ignored.
+		sync.OnUpsertKey(
+			"remote",
+			"drain:us-east-1a",
+			strconv.FormatInt(time.Now().Add(-time.Hour).UnixMilli(), 10),
+		)
+		assert.False(t, m.LocalDraining())
+
+		sync.OnUpsertKey(
+			"remote",
+			"drain:us-east-1a",
+			strconv.FormatInt(time.Now().UnixMilli(), 10),
+		)
+		assert.True(t, m.LocalDraining())
+		assert.Equal(
+			t,
+			upsert{"draining", "true"},
+			gossiper.upserts[len(gossiper.upserts)-1],
+		)
+	})
+
+	t.Run("remote node draining", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, nil, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		sync.OnJoin("remote")
+		sync.OnUpsertKey("remote", "zone", "us-east-1a")
+		sync.OnUpsertKey("remote", "proxy_addr", "10.26.104.98:8000")
+		sync.OnUpsertKey("remote", "admin_addr", "10.26.104.98:8001")
+
+		node, ok := m.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, "us-east-1a", node.Zone)
+		assert.False(t, node.Draining)
+
+		sync.OnUpsertKey("remote", "draining", "true")
+
+		node, ok = m.Node("remote")
+		assert.True(t, ok)
+		assert.True(t, node.Draining)
+	})
+}
+
 func TestSyncer_RemoteNodeUpdate(t *testing.T) {
 	t.Run("add node", func(t *testing.T) {
 		localNode := &cluster.Node{
@@ -110,7 +295,7 @@ func TestSyncer_RemoteNodeUpdate(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -133,6 +318,35 @@ func TestSyncer_RemoteNodeUpdate(t *testing.T) {
 		})
 	})
 
+	t.Run("add node with forward addr", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, nil, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		sync.OnJoin("remote")
+		sync.OnUpsertKey("remote", "forward_addr", "10.26.104.98:8006")
+		sync.OnUpsertKey("remote", "proxy_addr", "10.26.104.98:8000")
+		sync.OnUpsertKey("remote", "admin_addr", "10.26.104.98:8001")
+
+		node, ok := m.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, "10.26.104.98:8006", node.ForwardAddr)
+
+		// The forward address is immutable.
+		sync.OnUpsertKey("remote", "forward_addr", "10.26.104.99:8006")
+		node, ok = m.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, "10.26.104.98:8006", node.ForwardAddr)
+	})
+
 	t.Run("add node missing state", func(t *testing.T) {
 		localNode := &cluster.Node{
 			ID:        "local",
@@ -141,7 +355,7 @@ func TestSyncer_RemoteNodeUpdate(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -163,7 +377,7 @@ func TestSyncer_RemoteNodeUpdate(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -185,7 +399,7 @@ func TestSyncer_RemoteNodeUpdate(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -200,6 +414,11 @@ func TestSyncer_RemoteNodeUpdate(t *testing.T) {
 
 		sync.OnUpsertKey("remote", "endpoint:my-endpoint-2", "8")
 		sync.OnDeleteKey("remote", "endpoint:my-endpoint")
+		sync.OnUpsertKey("remote", "load:my-endpoint", "3,0,5,0")
+		sync.OnUpsertKey("remote", "load:my-endpoint-2", "4,8,0,0")
+		sync.OnDeleteKey("remote", "load:my-endpoint")
+		// Invalid load is discarded.
+		sync.OnUpsertKey("remote", "load:my-endpoint-3", "4,8")
 
 		node, ok := m.Node("remote")
 		assert.True(t, ok)
@@ -211,8 +430,38 @@ func TestSyncer_RemoteNodeUpdate(t *testing.T) {
 			Endpoints: map[string]int{
 				"my-endpoint-2": 8,
 			},
+			Load: map[string]cluster.EndpointLoad{
+				"my-endpoint-2": {Requests: 4, Ages: [3]int{8, 0, 0}},
+			},
 		})
 	})
+
+	t.Run("add node with load", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, nil, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		// Load received while the node is pending.
+		sync.OnJoin("remote")
+		sync.OnUpsertKey("remote", "endpoint:my-endpoint", "5")
+		sync.OnUpsertKey("remote", "load:my-endpoint", "2,5,0,0")
+		sync.OnUpsertKey("remote", "proxy_addr", "10.26.104.98:8000")
+		sync.OnUpsertKey("remote", "admin_addr", "10.26.104.98:8001")
+
+		node, ok := m.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, map[string]cluster.EndpointLoad{
+			"my-endpoint": {Requests: 2, Ages: [3]int{5, 0, 0}},
+		}, node.Load)
+	})
 }
 
 func TestSyncer_RemoteNodeLeave(t *testing.T) {
@@ -224,7 +473,7 @@ func TestSyncer_RemoteNodeLeave(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -265,7 +514,7 @@ func TestSyncer_RemoteNodeLeave(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -292,7 +541,7 @@ func TestSyncer_RemoteNodeLeave(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -313,7 +562,7 @@ func TestSyncer_RemoteNodeUnreachable(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -354,7 +603,7 @@ func TestSyncer_RemoteNodeUnreachable(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -392,7 +641,7 @@ func TestSyncer_RemoteNodeUnreachable(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -425,7 +674,7 @@ func TestSyncer_RemoteNodeUnreachable(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -453,7 +702,7 @@ func TestSyncer_RemoteNodeUnreachable(t *testing.T) {
 		}
 		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
 
-		sync := newSyncer(m, log.NewNopLogger())
+		sync := newSyncer(m, nil, log.NewNopLogger())
 
 		gossiper := &fakeGossiper{}
 		sync.Sync(gossiper)
@@ -463,4 +712,240 @@ func TestSyncer_RemoteNodeUnreachable(t *testing.T) {
 
 		assert.Equal(t, localNode, m.LocalNode())
 	})
+
+	t.Run("remote node log levels", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		levels, err := log.NewLevels("info", nil)
+		assert.NoError(t, err)
+
+		sync := newSyncer(m, levels, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		updatedAt := time.Now().Add(time.Minute).UnixMilli()
+		sync.OnUpsertKey(
+			"remote",
+			"log_levels",
+			fmt.Sprintf(`{"level":"debug","subsystems":{"gossip":"warn"},"updated_at":%d}`, updatedAt),
+		)
+		assert.Equal(t, log.LevelsState{
+			Level:      "debug",
+			Subsystems: map[string]string{"gossip": "warn"},
+			UpdatedAt:  updatedAt,
+		}, levels.State())
+
+		// Older levels should be ignored.
+		sync.OnUpsertKey(
+			"remote",
+			"log_levels",
+			fmt.Sprintf(`{"level":"error","updated_at":%d}`, updatedAt-1),
+		)
+		assert.Equal(t, "debug", levels.Level())
+	})
+}
+
+func TestSyncer_PropagateLogLevels(t *testing.T) {
+	localNode := &cluster.Node{
+		ID:        "local",
+		ProxyAddr: "10.26.104.56:8000",
+		AdminAddr: "10.26.104.56:8001",
+	}
+	m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+	sync := newSyncer(m, nil, log.NewNopLogger())
+
+	gossiper := &fakeGossiper{}
+	sync.Sync(gossiper)
+
+	sync.PropagateLogLevels(log.LevelsState{
+		Level:     "debug",
+		UpdatedAt: 1000,
+	})
+
+	assert.Equal(t, upsert{
+		"log_levels", `{"level":"debug","updated_at":1000}`,
+	}, gossiper.upserts[len(gossiper.upserts)-1])
+}
+
+func TestSyncer_PendingNodes(t *testing.T) {
+	t.Run("missing fields", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, nil, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		sync.OnJoin("remote-2")
+		sync.OnJoin("remote-1")
+		sync.OnUpsertKey("remote-1", "proxy_addr", "10.26.104.98:8000")
+
+		pending := sync.PendingNodes()
+		assert.Equal(t, 2, len(pending))
+		assert.Equal(t, "remote-1", pending[0].ID)
+		assert.Equal(t, []string{"admin_addr"}, pending[0].Missing)
+		assert.Equal(t, "remote-2", pending[1].ID)
+		assert.Equal(t, []string{"proxy_addr", "admin_addr"}, pending[1].Missing)
+		assert.Equal(t, 2.0, testutil.ToFloat64(sync.metrics.PendingNodes))
+
+		// Once the state is complete the node is no longer pending.
+		sync.OnUpsertKey("remote-1", "admin_addr", "10.26.104.98:8001")
+		pending = sync.PendingNodes()
+		assert.Equal(t, 1, len(pending))
+		assert.Equal(t, "remote-2", pending[0].ID)
+		assert.Equal(t, 1.0, testutil.ToFloat64(sync.metrics.PendingNodes))
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, nil, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		sync.OnJoin("remote")
+
+		sync.ExpirePending(time.Now().Add(time.Minute))
+		assert.Equal(t, 1, len(sync.PendingNodes()))
+		assert.InDelta(t, 60.0, testutil.ToFloat64(sync.metrics.PendingNodeMaxAge), 1)
+
+		sync.ExpirePending(time.Now().Add(pendingNodeTTL + time.Minute))
+		assert.Equal(t, 0, len(sync.PendingNodes()))
+		assert.Equal(t, 0.0, testutil.ToFloat64(sync.metrics.PendingNodeMaxAge))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			sync.metrics.PendingNodesExpiredTotal.WithLabelValues("ttl"),
+		))
+
+		// Updates from the expired node are ignored.
+		sync.OnUpsertKey("remote", "proxy_addr", "10.26.104.98:8000")
+		sync.OnUpsertKey("remote", "admin_addr", "10.26.104.98:8001")
+		_, ok := m.Node("remote")
+		assert.False(t, ok)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, nil, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		for i := 0; i != maxPendingNodes+1; i++ {
+			sync.OnJoin(fmt.Sprintf("remote-%d", i))
+		}
+
+		assert.Equal(t, maxPendingNodes, len(sync.PendingNodes()))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			sync.metrics.PendingNodesExpiredTotal.WithLabelValues("limit"),
+		))
+		// The oldest node was discarded.
+		for _, node := range sync.PendingNodes() {
+			assert.NotEqual(t, "remote-0", node.ID)
+		}
+	})
+}
+
+func TestSyncer_HashedEndpointID(t *testing.T) {
+	localNode := &cluster.Node{
+		ID:        "local",
+		ProxyAddr: "10.26.104.56:8000",
+		AdminAddr: "10.26.104.56:8001",
+	}
+	local := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+	localSync := newSyncer(local, nil, log.NewNopLogger())
+
+	gossiper := &fakeGossiper{}
+	localSync.Sync(gossiper)
+
+	endpointID := "my:endpoint:" + strings.Repeat("a", maxEndpointKeyLength)
+	local.AddLocalEndpoint(endpointID)
+
+	encoded, hashed := encodeEndpointID(endpointID)
+	assert.True(t, hashed)
+	assert.Equal(
+		t,
+		[]upsert{
+			{"proxy_addr", "10.26.104.56:8000"},
+			{"admin_addr", "10.26.104.56:8001"},
+			{"endpoint_name:" + encoded, endpointID},
+			{"endpoint:" + encoded, "1"},
+		},
+		gossiper.upserts,
+	)
+
+	remoteNode := &cluster.Node{
+		ID:        "remote",
+		ProxyAddr: "10.26.104.98:8000",
+		AdminAddr: "10.26.104.98:8001",
+	}
+	remote := cluster.NewState(remoteNode.Copy(), log.NewNopLogger())
+
+	remoteSync := newSyncer(remote, nil, log.NewNopLogger())
+	remoteSync.Sync(&fakeGossiper{})
+
+	// Apply the local state to the remote node in order.
+	remoteSync.OnJoin("local")
+	for _, u := range gossiper.upserts {
+		remoteSync.OnUpsertKey("local", u.Key, u.Value)
+	}
+
+	node, ok := remote.Node("local")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]int{endpointID: 1}, node.Endpoints)
+
+	local.RemoveLocalEndpoint(endpointID)
+	assert.Equal(
+		t,
+		[]string{"endpoint:" + encoded, "endpoint_name:" + encoded},
+		gossiper.deletes,
+	)
+	for _, key := range gossiper.deletes {
+		remoteSync.OnDeleteKey("local", key)
+	}
+
+	node, ok = remote.Node("local")
+	assert.True(t, ok)
+	assert.Empty(t, node.Endpoints)
+}
+
+func TestEncodeEndpointID(t *testing.T) {
+	encoded, hashed := encodeEndpointID("my-endpoint")
+	assert.False(t, hashed)
+	assert.Equal(t, "my-endpoint", encoded)
+
+	for _, endpointID := range []string{
+		"my:endpoint",
+		"#my-endpoint",
+		strings.Repeat("a", maxEndpointKeyLength+1),
+	} {
+		encoded, hashed := encodeEndpointID(endpointID)
+		assert.True(t, hashed)
+		assert.True(t, isHashedEndpointID(encoded))
+		assert.NotContains(t, encoded, ":")
+	}
 }
@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// FilterConfig configures a Lua filter that runs on proxy requests.
+type FilterConfig struct {
+	// Path is the path of the Lua script.
+	Path string `json:"path" yaml:"path"`
+
+	// Endpoints contains the IDs of the endpoints to run the filter on.
+	//
+	// If empty, the filter runs on requests to all endpoints.
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+}
+
+func (c *FilterConfig) Validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("missing path")
+	}
+	return nil
+}
+
+type Config struct {
+	// Filters contains the filters to run on proxy requests, in the order
+	// they run.
+	Filters []FilterConfig `json:"filters" yaml:"filters"`
+
+	// ReloadInterval is the interval to check the filter scripts for
+	// changes. If zero, scripts are not reloaded.
+	ReloadInterval time.Duration `json:"reload_interval" yaml:"reload_interval"`
+
+	// Timeout is the maximum duration a filter may run for each request or
+	// response.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func (c *Config) Enabled() bool {
+	return len(c.Filters) > 0
+}
+
+func (c *Config) Validate() error {
+	for i, filter := range c.Filters {
+		if err := filter.Validate(); err != nil {
+			return fmt.Errorf("filters[%d]: %w", i, err)
+		}
+	}
+	if c.ReloadInterval < 0 {
+		return fmt.Errorf("invalid reload interval: %s", c.ReloadInterval)
+	}
+	if c.Enabled() && c.Timeout <= 0 {
+		return fmt.Errorf("missing timeout")
+	}
+	return nil
+}
+
+func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(
+		&c.ReloadInterval,
+		"plugin.reload-interval",
+		c.ReloadInterval,
+		`
+Interval to check the plugin filter scripts for changes.
+
+When a script changes it is reloaded without restarting the server. If the
+updated script fails to load, the previous version of the script continues
+to be used.
+
+If zero, scripts are not reloaded.`,
+	)
+	fs.DurationVar(
+		&c.Timeout,
+		"plugin.timeout",
+		c.Timeout,
+		`
+Maximum duration a plugin filter may run for each request or response.
+
+If a filter exceeds the timeout, the request is rejected.`,
+	)
+}
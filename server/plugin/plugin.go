@@ -0,0 +1,202 @@
+// Package plugin runs Lua filters on proxy requests and responses, so the
+// proxy can be customised without forking Piko, such as to add headers,
+// reject unauthorized requests or rewrite paths.
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// filter is a configured filter script, which may be reloaded.
+type filter struct {
+	path string
+
+	// endpoints contains the endpoint IDs the filter runs on, or nil if
+	// the filter runs on all endpoints.
+	endpoints map[string]struct{}
+
+	mu     sync.Mutex
+	script *script
+}
+
+func (f *filter) Matches(endpointID string) bool {
+	if f.endpoints == nil {
+		return true
+	}
+	_, ok := f.endpoints[endpointID]
+	return ok
+}
+
+func (f *filter) Script() *script {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.script
+}
+
+func (f *filter) SetScript(s *script) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = s
+}
+
+// Plugins runs the configured filters on proxy requests and responses.
+//
+// Filters are reloaded when their script changes.
+type Plugins struct {
+	filters []*filter
+
+	reloadInterval time.Duration
+	timeout        time.Duration
+
+	ctx    context.Context
+	cancel func()
+
+	logger log.Logger
+}
+
+// New loads the configured filters.
+//
+// Returns an error if any filter fails to load.
+func New(conf Config, logger log.Logger) (*Plugins, error) {
+	var filters []*filter
+	for _, filterConf := range conf.Filters {
+		script, err := loadScript(filterConf.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		f := &filter{
+			path:   filterConf.Path,
+			script: script,
+		}
+		if len(filterConf.Endpoints) > 0 {
+			f.endpoints = make(map[string]struct{})
+			for _, endpointID := range filterConf.Endpoints {
+				// Endpoint IDs are case insensitive and the proxy matches
+				// filters using the normalized (lower case) endpoint ID.
+				f.endpoints[strings.ToLower(endpointID)] = struct{}{}
+			}
+		}
+		filters = append(filters, f)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Plugins{
+		filters:        filters,
+		reloadInterval: conf.ReloadInterval,
+		timeout:        conf.Timeout,
+		ctx:            ctx,
+		cancel:         cancel,
+		logger:         logger.WithSubsystem("plugin"),
+	}, nil
+}
+
+// OnRequest runs the filters for the endpoint on the request, in the
+// configured order.
+//
+// Filters may modify the request. If a filter returns a response, the
+// remaining filters are skipped and the response should be returned instead
+// of forwarding the request.
+func (p *Plugins) OnRequest(endpointID string, r *http.Request) (*Response, error) {
+	for _, f := range p.filters {
+		if !f.Matches(endpointID) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+		resp, err := f.Script().OnRequest(ctx, endpointID, r)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("filter: %s: %w", f.path, err)
+		}
+		if resp != nil {
+			return resp, nil
+		}
+	}
+	return nil, nil
+}
+
+// OnResponse runs the filters for the endpoint on the response, in the
+// configured order.
+func (p *Plugins) OnResponse(endpointID string, resp *http.Response) error {
+	for _, f := range p.filters {
+		if !f.Matches(endpointID) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(resp.Request.Context(), p.timeout)
+		err := f.Script().OnResponse(ctx, endpointID, resp)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("filter: %s: %w", f.path, err)
+		}
+	}
+	return nil
+}
+
+// Reload reloads any filters whose script has changed.
+//
+// If a script fails to load, the filter continues to use the previous
+// version of the script.
+func (p *Plugins) Reload() {
+	for _, f := range p.filters {
+		changed, err := f.Script().Changed()
+		if err != nil {
+			p.logger.Warn(
+				"failed to check filter",
+				zap.String("path", f.path),
+				zap.Error(err),
+			)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		script, err := loadScript(f.path)
+		if err != nil {
+			p.logger.Error(
+				"failed to reload filter; using previous version",
+				zap.String("path", f.path),
+				zap.Error(err),
+			)
+			continue
+		}
+		f.SetScript(script)
+
+		p.logger.Info("reloaded filter", zap.String("path", f.path))
+	}
+}
+
+// Start periodically reloads changed filters until stopped.
+func (p *Plugins) Start() {
+	if p.reloadInterval == 0 {
+		<-p.ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(p.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.Reload()
+		}
+	}
+}
+
+func (p *Plugins) Stop() {
+	p.cancel()
+}
@@ -0,0 +1,257 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func writeScript(t *testing.T, dir string, name string, script string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(script), 0o600))
+	return path
+}
+
+func newTestPlugins(t *testing.T, filters ...FilterConfig) *Plugins {
+	p, err := New(Config{
+		Filters: filters,
+		Timeout: time.Second,
+	}, log.NewNopLogger())
+	require.NoError(t, err)
+	return p
+}
+
+func TestPlugins_OnRequest(t *testing.T) {
+	t.Run("modify request", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), "filter.lua", `
+function on_request(req)
+	req.headers["x-endpoint"] = req.endpoint
+	req.headers["x-remove"] = nil
+	req.path = "/v2" .. req.path
+	req.query = "foo=bar"
+	req.method = "POST"
+end
+`)
+		p := newTestPlugins(t, FilterConfig{Path: path})
+
+		r := httptest.NewRequest(http.MethodGet, "/foo?a=b", nil)
+		r.Header.Set("x-remove", "1")
+		r.Header.Add("x-multi", "1")
+		r.Header.Add("x-multi", "2")
+
+		resp, err := p.OnRequest("my-endpoint", r)
+		require.NoError(t, err)
+		assert.Nil(t, resp)
+
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/v2/foo", r.URL.Path)
+		assert.Equal(t, "foo=bar", r.URL.RawQuery)
+		assert.Equal(t, "my-endpoint", r.Header.Get("x-endpoint"))
+		assert.Equal(t, "", r.Header.Get("x-remove"))
+		// Unmodified headers with multiple values are unchanged.
+		assert.Equal(t, []string{"1", "2"}, r.Header.Values("x-multi"))
+	})
+
+	t.Run("respond", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), "filter.lua", `
+function on_request(req)
+	if req.headers["x-api-key"] ~= "secret" then
+		return {
+			status = 401,
+			headers = {["content-type"] = "text/plain"},
+			body = "unauthorized",
+		}
+	end
+end
+`)
+		p := newTestPlugins(t, FilterConfig{Path: path})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		resp, err := p.OnRequest("my-endpoint", r)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Equal(t, "text/plain", resp.Header.Get("content-type"))
+		assert.Equal(t, "unauthorized", resp.Body)
+
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-api-key", "secret")
+		resp, err = p.OnRequest("my-endpoint", r)
+		require.NoError(t, err)
+		assert.Nil(t, resp)
+	})
+
+	t.Run("filter endpoints", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), "filter.lua", `
+function on_request(req)
+	req.headers["x-filtered"] = "true"
+end
+`)
+		p := newTestPlugins(t, FilterConfig{
+			Path:      path,
+			Endpoints: []string{"my-endpoint"},
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		_, err := p.OnRequest("my-endpoint", r)
+		require.NoError(t, err)
+		assert.Equal(t, "true", r.Header.Get("x-filtered"))
+
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		_, err = p.OnRequest("other-endpoint", r)
+		require.NoError(t, err)
+		assert.Equal(t, "", r.Header.Get("x-filtered"))
+	})
+
+	t.Run("filter endpoints mixed case", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), "filter.lua", `
+function on_request(req)
+	req.headers["x-filtered"] = "true"
+end
+`)
+		p := newTestPlugins(t, FilterConfig{
+			Path:      path,
+			Endpoints: []string{"My-Endpoint"},
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		_, err := p.OnRequest("my-endpoint", r)
+		require.NoError(t, err)
+		assert.Equal(t, "true", r.Header.Get("x-filtered"))
+	})
+
+	t.Run("runtime error", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), "filter.lua", `
+function on_request(req)
+	error("failed")
+end
+`)
+		p := newTestPlugins(t, FilterConfig{Path: path})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		_, err := p.OnRequest("my-endpoint", r)
+		assert.ErrorContains(t, err, "failed")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), "filter.lua", `
+function on_request(req)
+	while true do end
+end
+`)
+		p, err := New(Config{
+			Filters: []FilterConfig{{Path: path}},
+			Timeout: time.Millisecond * 10,
+		}, log.NewNopLogger())
+		require.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		_, err = p.OnRequest("my-endpoint", r)
+		assert.Error(t, err)
+	})
+}
+
+func TestPlugins_OnResponse(t *testing.T) {
+	path := writeScript(t, t.TempDir(), "filter.lua", `
+function on_response(resp)
+	resp.headers["x-endpoint"] = resp.endpoint
+	if resp.status == 500 then
+		resp.status = 503
+	end
+end
+`)
+	p := newTestPlugins(t, FilterConfig{Path: path})
+
+	resp := &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Header:     make(http.Header),
+		Request:    httptest.NewRequest(http.MethodGet, "/", nil),
+	}
+	require.NoError(t, p.OnResponse("my-endpoint", resp))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "503 Service Unavailable", resp.Status)
+	assert.Equal(t, "my-endpoint", resp.Header.Get("x-endpoint"))
+}
+
+func TestPlugins_Reload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeScript(t, dir, "filter.lua", `
+function on_request(req)
+	req.headers["x-version"] = "1"
+end
+`)
+	p := newTestPlugins(t, FilterConfig{Path: path})
+
+	// Update the script and ensure the modification time changes.
+	writeScript(t, dir, "filter.lua", `
+function on_request(req)
+	req.headers["x-version"] = "2"
+end
+`)
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	p.Reload()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err := p.OnRequest("my-endpoint", r)
+	require.NoError(t, err)
+	assert.Equal(t, "2", r.Header.Get("x-version"))
+
+	// An invalid script should keep the previous version.
+	writeScript(t, dir, "filter.lua", `function on_request(req`)
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute*2)))
+	p.Reload()
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err = p.OnRequest("my-endpoint", r)
+	require.NoError(t, err)
+	assert.Equal(t, "2", r.Header.Get("x-version"))
+}
+
+func TestNew(t *testing.T) {
+	t.Run("syntax error", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), "filter.lua", `function on_request(req`)
+		_, err := New(Config{
+			Filters: []FilterConfig{{Path: path}},
+			Timeout: time.Second,
+		}, log.NewNopLogger())
+		assert.Error(t, err)
+	})
+
+	t.Run("missing functions", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), "filter.lua", `x = 1`)
+		_, err := New(Config{
+			Filters: []FilterConfig{{Path: path}},
+			Timeout: time.Second,
+		}, log.NewNopLogger())
+		assert.ErrorContains(t, err, "missing on_request or on_response function")
+	})
+
+	t.Run("sandboxed", func(t *testing.T) {
+		// The io and os libraries are not available.
+		path := writeScript(t, t.TempDir(), "filter.lua", `
+local f = io.open("/etc/passwd")
+function on_request(req) end
+`)
+		_, err := New(Config{
+			Filters: []FilterConfig{{Path: path}},
+			Timeout: time.Second,
+		}, log.NewNopLogger())
+		assert.Error(t, err)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := New(Config{
+			Filters: []FilterConfig{{Path: "/does/not/exist.lua"}},
+			Timeout: time.Second,
+		}, log.NewNopLogger())
+		assert.Error(t, err)
+	})
+}
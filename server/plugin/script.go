@@ -0,0 +1,362 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	// onRequestFunc is the name of the Lua function called with each
+	// request.
+	onRequestFunc = "on_request"
+	// onResponseFunc is the name of the Lua function called with each
+	// response.
+	onResponseFunc = "on_response"
+
+	// maxIdleStates is the maximum number of idle Lua states to keep for
+	// each script.
+	maxIdleStates = 64
+)
+
+// Response is a response returned by a filter to respond to a request
+// directly, rather than forwarding the request to the upstream, such as to
+// reject an unauthorized request.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+}
+
+// script is a compiled Lua filter script.
+//
+// A Lua state can only be used by one goroutine at a time, so script keeps a
+// pool of states to run concurrent requests.
+type script struct {
+	path string
+
+	proto *lua.FunctionProto
+
+	// hasRequest and hasResponse indicate whether the script defines the
+	// request and response functions.
+	hasRequest  bool
+	hasResponse bool
+
+	// modTime and size are the modification time and size of the file when
+	// loaded, to detect changes.
+	modTime time.Time
+	size    int64
+
+	states chan *lua.LState
+}
+
+// loadScript loads and compiles the Lua script at the given path.
+//
+// Returns an error if the script can't be compiled, or fails when evaluated,
+// or doesn't define either of the 'on_request' or 'on_response' functions.
+func loadScript(path string) (*script, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat: %s: %w", path, err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read: %s: %w", path, err)
+	}
+
+	chunk, err := parse.Parse(bytes.NewReader(b), path)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %s: %w", path, err)
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, fmt.Errorf("compile: %s: %w", path, err)
+	}
+
+	s := &script{
+		path:    path,
+		proto:   proto,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		states:  make(chan *lua.LState, maxIdleStates),
+	}
+
+	// Evaluate the script to check it doesn't fail and see which functions
+	// it defines.
+	L, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	s.hasRequest = L.GetGlobal(onRequestFunc).Type() == lua.LTFunction
+	s.hasResponse = L.GetGlobal(onResponseFunc).Type() == lua.LTFunction
+	if !s.hasRequest && !s.hasResponse {
+		L.Close()
+		return nil, fmt.Errorf(
+			"%s: missing %s or %s function", path, onRequestFunc, onResponseFunc,
+		)
+	}
+	s.put(L)
+
+	return s, nil
+}
+
+// Changed returns whether the script file has been modified since it was
+// loaded.
+func (s *script) Changed() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, fmt.Errorf("stat: %s: %w", s.path, err)
+	}
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size, nil
+}
+
+// OnRequest calls the scripts 'on_request' function with the request.
+//
+// The function may modify the request method, path, query and headers, which
+// are applied to r. If the function returns a response, the request should
+// not be forwarded and the response is returned instead.
+func (s *script) OnRequest(
+	ctx context.Context,
+	endpointID string,
+	r *http.Request,
+) (*Response, error) {
+	if !s.hasRequest {
+		return nil, nil
+	}
+
+	L, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+
+	req := L.NewTable()
+	req.RawSetString("endpoint", lua.LString(endpointID))
+	req.RawSetString("method", lua.LString(r.Method))
+	req.RawSetString("host", lua.LString(r.Host))
+	req.RawSetString("path", lua.LString(r.URL.Path))
+	req.RawSetString("query", lua.LString(r.URL.RawQuery))
+	req.RawSetString("headers", headersToTable(L, r.Header))
+
+	ret, err := s.call(ctx, L, onRequestFunc, req)
+	if err != nil {
+		return nil, err
+	}
+	defer s.put(L)
+
+	if method := lua.LVAsString(req.RawGetString("method")); method != "" {
+		r.Method = method
+	}
+	if path := lua.LVAsString(req.RawGetString("path")); path != r.URL.Path {
+		r.URL.Path = path
+		r.URL.RawPath = ""
+	}
+	r.URL.RawQuery = lua.LVAsString(req.RawGetString("query"))
+	if err := applyHeaders(req.RawGetString("headers"), r.Header); err != nil {
+		return nil, fmt.Errorf("%s: request headers: %w", onRequestFunc, err)
+	}
+
+	respTable, ok := ret.(*lua.LTable)
+	if !ok {
+		return nil, nil
+	}
+	resp := &Response{
+		StatusCode: int(lua.LVAsNumber(respTable.RawGetString("status"))),
+		Header:     make(http.Header),
+		Body:       lua.LVAsString(respTable.RawGetString("body")),
+	}
+	if resp.StatusCode < 100 || resp.StatusCode > 999 {
+		return nil, fmt.Errorf(
+			"%s: invalid response status: %d", onRequestFunc, resp.StatusCode,
+		)
+	}
+	if err := applyHeaders(respTable.RawGetString("headers"), resp.Header); err != nil {
+		return nil, fmt.Errorf("%s: response headers: %w", onRequestFunc, err)
+	}
+	return resp, nil
+}
+
+// OnResponse calls the scripts 'on_response' function with the response.
+//
+// The function may modify the response status and headers, which are applied
+// to resp.
+func (s *script) OnResponse(
+	ctx context.Context,
+	endpointID string,
+	resp *http.Response,
+) error {
+	if !s.hasResponse {
+		return nil
+	}
+
+	L, err := s.get()
+	if err != nil {
+		return err
+	}
+
+	t := L.NewTable()
+	t.RawSetString("endpoint", lua.LString(endpointID))
+	t.RawSetString("status", lua.LNumber(resp.StatusCode))
+	t.RawSetString("headers", headersToTable(L, resp.Header))
+
+	if _, err := s.call(ctx, L, onResponseFunc, t); err != nil {
+		return err
+	}
+	defer s.put(L)
+
+	status := int(lua.LVAsNumber(t.RawGetString("status")))
+	if status < 100 || status > 999 {
+		return fmt.Errorf("%s: invalid status: %d", onResponseFunc, status)
+	}
+	if status != resp.StatusCode {
+		resp.StatusCode = status
+		resp.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	}
+	if err := applyHeaders(t.RawGetString("headers"), resp.Header); err != nil {
+		return fmt.Errorf("%s: headers: %w", onResponseFunc, err)
+	}
+	return nil
+}
+
+// call calls the global function with the given argument, and returns the
+// value returned by the function.
+//
+// If the call fails the state is closed, since the script may have been
+// interrupted leaving the state inconsistent, such as when it times out.
+func (s *script) call(
+	ctx context.Context,
+	L *lua.LState,
+	name string,
+	arg lua.LValue,
+) (lua.LValue, error) {
+	L.SetContext(ctx)
+	err := L.CallByParam(lua.P{
+		Fn:      L.GetGlobal(name),
+		NRet:    1,
+		Protect: true,
+	}, arg)
+	L.RemoveContext()
+	if err != nil {
+		L.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return ret, nil
+}
+
+func (s *script) get() (*lua.LState, error) {
+	select {
+	case L := <-s.states:
+		return L, nil
+	default:
+		return s.newState()
+	}
+}
+
+func (s *script) put(L *lua.LState) {
+	select {
+	case s.states <- L:
+	default:
+		L.Close()
+	}
+}
+
+// newState returns a Lua state which has evaluated the script.
+//
+// The state only includes the base, table, string and math libraries, and
+// excludes functions to load other files, so scripts can't access the
+// filesystem or run commands.
+func (s *script) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		if err := L.CallByParam(lua.P{
+			Fn:      L.NewFunction(lib.open),
+			NRet:    0,
+			Protect: true,
+		}, lua.LString(lib.name)); err != nil {
+			L.Close()
+			return nil, fmt.Errorf("%s: open %s: %w", s.path, lib.name, err)
+		}
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	return L, nil
+}
+
+// headersToTable returns a table containing the headers, keyed by lowercase
+// header name. Multiple values for a header are joined with a comma.
+func headersToTable(L *lua.LState, h http.Header) *lua.LTable {
+	t := L.NewTable()
+	for name, values := range h {
+		t.RawSetString(strings.ToLower(name), lua.LString(strings.Join(values, ", ")))
+	}
+	return t
+}
+
+// applyHeaders updates h to match the headers table returned by
+// headersToTable, after being modified by the script.
+//
+// Only headers whose value was changed are updated, so headers with multiple
+// values are left unchanged unless modified. Headers missing from the table
+// are removed.
+func applyHeaders(v lua.LValue, h http.Header) error {
+	if v == lua.LNil {
+		return nil
+	}
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("headers not a table")
+	}
+
+	updated := make(map[string]string)
+	var err error
+	t.ForEach(func(key lua.LValue, value lua.LValue) {
+		if key.Type() != lua.LTString {
+			err = fmt.Errorf("invalid header name: %s", key)
+			return
+		}
+		updated[http.CanonicalHeaderKey(key.String())] = lua.LVAsString(value)
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, values := range h {
+		value, ok := updated[http.CanonicalHeaderKey(name)]
+		if !ok {
+			delete(h, name)
+			continue
+		}
+		if strings.Join(values, ", ") != value {
+			delete(h, name)
+		}
+	}
+	for name, value := range updated {
+		if _, ok := h[name]; !ok {
+			h.Set(name, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+const (
+	// clientCertHeader contains the TLS client certificate of the request,
+	// using the format of Envoy's 'x-forwarded-client-cert' header.
+	clientCertHeader = "x-forwarded-client-cert"
+)
+
+// ClientCertHandler returns middleware that forwards the TLS client
+// certificate of the request to the upstream in the client cert header.
+//
+// The client cert header sent by clients is always replaced, so clients
+// can't impersonate another certificate. Other nodes forward requests to the
+// forward listener, which keeps the header added by the node that received
+// the request from the client.
+func (p *headerPolicy) ClientCertHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Header.Del(clientCertHeader)
+		if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+			return
+		}
+		c.Request.Header.Set(clientCertHeader, formatClientCert(
+			c.Request.TLS.PeerCertificates[0],
+			p.clientCert == config.ClientCertFull,
+		))
+	}
+}
+
+// formatClientCert formats the certificate as a client cert header value,
+// such as 'Hash=6bd7...;Subject="CN=client";URI=spiffe://example.com/client'.
+//
+// If includeCert is true, the URL encoded PEM certificate is included as
+// 'Cert'.
+func formatClientCert(cert *x509.Certificate, includeCert bool) string {
+	hash := sha256.Sum256(cert.Raw)
+
+	var b strings.Builder
+	b.WriteString("Hash=")
+	b.WriteString(hex.EncodeToString(hash[:]))
+	if includeCert {
+		certPEM := pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: cert.Raw,
+		})
+		b.WriteString(`;Cert="`)
+		b.WriteString(url.PathEscape(string(certPEM)))
+		b.WriteString(`"`)
+	}
+	b.WriteString(`;Subject="`)
+	b.WriteString(quoteClientCertValue(cert.Subject.String()))
+	b.WriteString(`"`)
+	for _, uri := range cert.URIs {
+		b.WriteString(";URI=")
+		b.WriteString(uri.String())
+	}
+	for _, dnsName := range cert.DNSNames {
+		b.WriteString(";DNS=")
+		b.WriteString(dnsName)
+	}
+	return b.String()
+}
+
+// quoteClientCertValue escapes quotes and backslashes in a quoted header
+// value.
+func quoteClientCertValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, `"`, `\"`)
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/testutil"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func clientCert(t *testing.T) *x509.Certificate {
+	certPEM, _, err := testutil.SelfSignedCert("client.example.com")
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(certPEM)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestHeaderPolicy_ClientCert(t *testing.T) {
+	cert := clientCert(t)
+	hash := sha256.Sum256(cert.Raw)
+
+	clientCertHeader := func(
+		mode string,
+		modify func(r *http.Request),
+	) string {
+		policy := newHeaderPolicy(config.HeadersConfig{ClientCert: mode})
+
+		var header string
+		router := gin.New()
+		router.Use(policy.ClientCertHandler())
+		router.GET("/", func(c *gin.Context) {
+			header = c.Request.Header.Get("x-forwarded-client-cert")
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+		}
+		r.Header.Set("x-forwarded-client-cert", "Hash=spoofed")
+		if modify != nil {
+			modify(r)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), r)
+		return header
+	}
+
+	t.Run("hash", func(t *testing.T) {
+		assert.Equal(
+			t,
+			"Hash="+hex.EncodeToString(hash[:])+
+				`;Subject="O=Piko";DNS=client.example.com`,
+			clientCertHeader(config.ClientCertHash, nil),
+		)
+	})
+
+	t.Run("cert", func(t *testing.T) {
+		header := clientCertHeader(config.ClientCertFull, nil)
+
+		_, certValue, ok := strings.Cut(header, `;Cert="`)
+		require.True(t, ok)
+		certValue, _, ok = strings.Cut(certValue, `"`)
+		require.True(t, ok)
+
+		certPEM, err := url.PathUnescape(certValue)
+		require.NoError(t, err)
+		block, _ := pem.Decode([]byte(certPEM))
+		require.NotNil(t, block)
+		assert.Equal(t, cert.Raw, block.Bytes)
+	})
+
+	t.Run("no client cert", func(t *testing.T) {
+		// The header sent by the client is removed.
+		assert.Equal(t, "", clientCertHeader(
+			config.ClientCertHash, func(r *http.Request) {
+				r.TLS = nil
+			},
+		))
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		// Nodes forward requests to the forward listener, so the header of
+		// requests marked as forwarded is still replaced.
+		assert.Equal(t, "", clientCertHeader(
+			config.ClientCertHash, func(r *http.Request) {
+				r.TLS = nil
+				r.Header.Set("x-piko-forward", "true")
+			},
+		))
+	})
+}
+
+func TestFormatClientCert(t *testing.T) {
+	cert := clientCert(t)
+	cert.Subject.CommonName = `my "client"`
+	cert.URIs = []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/client"}}
+	cert.DNSNames = nil
+
+	hash := sha256.Sum256(cert.Raw)
+	assert.Equal(
+		t,
+		// The subject escapes quotes itself, so both the backslash and quote
+		// are escaped.
+		"Hash="+hex.EncodeToString(hash[:])+
+			`;Subject="CN=my \\\"client\\\",O=Piko";URI=spiffe://example.com/client`,
+		formatClientCert(cert, false),
+	)
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// countingReadCloser counts the bytes read from the underlying reader.
+type countingReadCloser struct {
+	io.ReadCloser
+
+	bytesIn prometheus.Counter
+}
+
+func (r *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.bytesIn.Add(float64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes written to the underlying response
+// writer.
+//
+// If the connection is hijacked, such as to upgrade to a WebSocket, the
+// hijacked connection is also counted.
+type countingResponseWriter struct {
+	http.ResponseWriter
+
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytesOut.Add(float64(n))
+	return n, err
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{
+		Conn:     conn,
+		bytesIn:  w.bytesIn,
+		bytesOut: w.bytesOut,
+	}, brw, nil
+}
+
+// Unwrap returns the underlying response writer so http.ResponseController
+// can access its optional interfaces, such as http.Flusher.
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingConn counts the bytes read from and written to the underlying
+// connection.
+type countingConn struct {
+	net.Conn
+
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesIn.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesOut.Add(float64(n))
+	return n, err
+}
+
+// countRequest wraps the request body and response writer to count the bytes
+// sent to and received from the client.
+func countRequest(
+	w http.ResponseWriter,
+	r *http.Request,
+	bytesIn prometheus.Counter,
+	bytesOut prometheus.Counter,
+) (http.ResponseWriter, *http.Request) {
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingReadCloser{
+			ReadCloser: r.Body,
+			bytesIn:    bytesIn,
+		}
+	}
+	return &countingResponseWriter{
+		ResponseWriter: w,
+		bytesIn:        bytesIn,
+		bytesOut:       bytesOut,
+	}, r
+}
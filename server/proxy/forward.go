@@ -0,0 +1,495 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"golang.org/x/net/http2"
+
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+const (
+	// nodePoolExpiry is the duration after the last request to a node that
+	// its connection pool is removed, such as when the node has left the
+	// cluster.
+	nodePoolExpiry = time.Minute * 10
+
+	// http2ReadIdleTimeout is the duration without receiving any frames on
+	// an HTTP/2 connection to a node before sending a ping to check the
+	// connection is healthy.
+	http2ReadIdleTimeout = time.Second * 30
+
+	// nodeResolveInterval is the interval to re-resolve the advertised
+	// address of a node when it's a DNS name. If the IPs the name resolves
+	// to change, the idle connections to the node are closed so new requests
+	// connect to the new IPs.
+	nodeResolveInterval = time.Second * 30
+
+	// nodeResolveTimeout is the timeout to resolve the advertised address of
+	// a node.
+	nodeResolveTimeout = time.Second * 5
+)
+
+const (
+	// forwardSecretHeader contains the cluster secret in requests forwarded
+	// to the forward listener of another node.
+	forwardSecretHeader = "x-piko-forward-secret"
+)
+
+var (
+	// errCircuitOpen is returned when forwarding a request to a node whose
+	// circuit is open.
+	errCircuitOpen = errors.New("circuit open")
+)
+
+// circuitBreaker stops forwarding requests to a node after consecutive
+// failures.
+//
+// Once the cooldown has passed requests are allowed again, though the next
+// failure reopens the circuit until a request succeeds.
+type circuitBreaker struct {
+	conf config.CircuitBreakerConfig
+
+	failures  int
+	openUntil time.Time
+
+	mu sync.Mutex
+}
+
+// Allow returns whether a request may be forwarded.
+func (b *circuitBreaker) Allow() bool {
+	if !b.conf.Enabled() {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !time.Now().Before(b.openUntil)
+}
+
+// Failure records a failed request, and returns true if the circuit opened.
+func (b *circuitBreaker) Failure() bool {
+	if !b.conf.Enabled() {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures < b.conf.Threshold {
+		return false
+	}
+	b.openUntil = time.Now().Add(b.conf.Cooldown)
+	return true
+}
+
+// Success records a successful request, which closes the circuit.
+func (b *circuitBreaker) Success() {
+	if !b.conf.Enabled() {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+}
+
+// upstreamTransport sends requests to the upstream in the request context.
+//
+// Requests to upstreams connected to the local node use the local transport,
+// and requests forwarded to other nodes use the node transport.
+type upstreamTransport struct {
+	local http.RoundTripper
+	nodes *nodeTransport
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := req.Context().Value(upstreamContextKey).(upstream.Upstream)
+	if node, ok := upstream.RemoteNode(u); ok {
+		return t.nodes.RoundTrip(node, req)
+	}
+	return t.local.RoundTrip(req)
+}
+
+// nodePool contains the connections to a node.
+type nodePool struct {
+	// http1 forwards HTTP/1.1 requests, including WebSocket and TCP
+	// connections which can't be forwarded over HTTP/2.
+	http1 *http.Transport
+
+	// http2 forwards requests over HTTP/2, or is nil if HTTP/2 forwarding is
+	// disabled.
+	http2 *http2.Transport
+
+	breaker *circuitBreaker
+
+	// forwardListener indicates whether requests are forwarded to the nodes
+	// forward listener over TLS, rather than its proxy listener.
+	forwardListener bool
+
+	// conns is the number of open connections to the node.
+	conns *atomic.Int64
+
+	lastUsed time.Time
+
+	// nodeID is the ID of the node the pool connects to.
+	nodeID string
+
+	// addr is the advertised address of the node the pool connects to.
+	addr string
+
+	// resolvedAddrs are the IPs the host of addr resolved to when last
+	// resolved, or nil if not yet resolved or the host is an IP.
+	resolvedAddrs []string
+
+	// resolvedAt is the time addr was last resolved.
+	resolvedAt time.Time
+}
+
+func (p *nodePool) CloseIdleConnections() {
+	p.http1.CloseIdleConnections()
+	if p.http2 != nil {
+		p.http2.CloseIdleConnections()
+	}
+}
+
+// nodeTransport forwards requests to other nodes in the cluster.
+//
+// Rather than opening a new connection for each request, it keeps a pool of
+// connections to each node, and stops forwarding to nodes that are
+// consistently failing.
+type nodeTransport struct {
+	conf config.ForwardConfig
+
+	// tlsConfig is the TLS configuration to forward requests to nodes with
+	// a forward listener.
+	tlsConfig *tls.Config
+
+	// pools contains the connection pool for each node, keyed by node ID.
+	pools map[string]*nodePool
+
+	// lookupHost resolves the host of a node address.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu sync.Mutex
+
+	metrics *Metrics
+}
+
+func newNodeTransport(
+	conf config.ForwardConfig,
+	tlsConfig *tls.Config,
+	metrics *Metrics,
+) *nodeTransport {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	return &nodeTransport{
+		conf:       conf,
+		tlsConfig:  tlsConfig,
+		pools:      make(map[string]*nodePool),
+		lookupHost: net.DefaultResolver.LookupHost,
+		metrics:    metrics,
+	}
+}
+
+// RoundTrip forwards the request to the given node.
+func (t *nodeTransport) RoundTrip(node *cluster.Node, req *http.Request) (*http.Response, error) {
+	nodeID := node.ID
+	pool := t.pool(node)
+
+	if !pool.breaker.Allow() {
+		t.metrics.ForwardRejectedTotal.WithLabelValues(nodeID).Inc()
+		return nil, errCircuitOpen
+	}
+
+	resp, err := t.send(pool, req)
+	if err != nil {
+		// Ignore requests that were cancelled or timed out.
+		if req.Context().Err() == nil && pool.breaker.Failure() {
+			t.metrics.ForwardCircuitOpenedTotal.WithLabelValues(nodeID).Inc()
+		}
+		return nil, err
+	}
+	pool.breaker.Success()
+	return resp, nil
+}
+
+// Probe sends a health check request to the node, and returns an error if
+// the node couldn't be reached or didn't respond.
+//
+// The probe uses the same connection pool as forwarded requests, so also
+// keeps connections to the node open, though it bypasses the circuit
+// breaker.
+func (t *nodeTransport) Probe(ctx context.Context, node *cluster.Node) error {
+	pool := t.pool(node)
+
+	ctx = context.WithValue(ctx, upstreamContextKey, upstream.NewNodeUpstream("", node))
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodHead, "http://"+node.ID+healthPath, nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.send(pool, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// send sends the request to the node using the connections in the pool.
+func (t *nodeTransport) send(pool *nodePool, req *http.Request) (*http.Response, error) {
+	// Connections are pooled by host, so use the node ID as the host to
+	// share connections among all endpoints forwarded to the node. The
+	// request host is unchanged so the node can still route the request.
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	req = req.WithContext(req.Context())
+	url := *req.URL
+	url.Host = pool.nodeID
+	req.URL = &url
+	req.Host = host
+
+	if pool.forwardListener && t.conf.Secret != "" {
+		req.Header = req.Header.Clone()
+		req.Header.Set(forwardSecretHeader, t.conf.Secret)
+	}
+
+	var transport http.RoundTripper = pool.http1
+	if pool.http2 != nil && req.Header.Get("Upgrade") == "" {
+		transport = pool.http2
+	}
+
+	return transport.RoundTrip(req)
+}
+
+func (t *nodeTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, pool := range t.pools {
+		pool.CloseIdleConnections()
+	}
+}
+
+func (t *nodeTransport) pool(node *cluster.Node) *nodePool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	pool, ok := t.pools[node.ID]
+	if !ok {
+		t.removeExpiredLocked(now)
+
+		pool = t.newPool(node)
+		t.pools[node.ID] = pool
+	}
+	pool.lastUsed = now
+
+	// If the node advertises a new address, such as after restarting, close
+	// the idle connections to the old address.
+	if addr := nodeAddr(node); addr != pool.addr {
+		pool.addr = addr
+		pool.resolvedAddrs = nil
+		pool.resolvedAt = time.Time{}
+		pool.CloseIdleConnections()
+	}
+
+	host, _, _ := net.SplitHostPort(pool.addr)
+	if net.ParseIP(host) == nil && now.Sub(pool.resolvedAt) >= nodeResolveInterval {
+		pool.resolvedAt = now
+		go t.resolve(pool, pool.addr)
+	}
+
+	return pool
+}
+
+// resolve resolves the host of the given node address, and closes the idle
+// connections in the pool if the IPs the host resolves to have changed since
+// it was last resolved.
+func (t *nodeTransport) resolve(pool *nodePool, addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nodeResolveTimeout)
+	defer cancel()
+
+	resolved, err := t.lookupHost(ctx, host)
+	if err != nil || len(resolved) == 0 {
+		// Keep the existing connections, which may still be healthy, and
+		// retry after the resolve interval.
+		return
+	}
+	slices.Sort(resolved)
+
+	t.mu.Lock()
+	if pool.addr != addr {
+		// The node advertised a new address while resolving.
+		t.mu.Unlock()
+		return
+	}
+	changed := pool.resolvedAddrs != nil && !slices.Equal(pool.resolvedAddrs, resolved)
+	pool.resolvedAddrs = resolved
+	t.mu.Unlock()
+
+	if changed {
+		pool.CloseIdleConnections()
+	}
+}
+
+func (t *nodeTransport) newPool(node *cluster.Node) *nodePool {
+	pool := &nodePool{
+		nodeID:          node.ID,
+		forwardListener: node.ForwardAddr != "",
+		conns:           atomic.NewInt64(0),
+		addr:            nodeAddr(node),
+	}
+
+	// Nodes with a forward listener require TLS.
+	var tlsConfig *tls.Config
+	if pool.forwardListener {
+		tlsConfig = t.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			host, _, _ := net.SplitHostPort(node.ForwardAddr)
+			tlsConfig.ServerName = host
+		}
+	}
+	dial := func(ctx context.Context, nextProto string) (net.Conn, error) {
+		var connTLSConfig *tls.Config
+		if tlsConfig != nil {
+			connTLSConfig = tlsConfig.Clone()
+			connTLSConfig.NextProtos = []string{nextProto}
+		}
+		return t.dial(ctx, node.ID, pool, connTLSConfig)
+	}
+
+	pool.http1 = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx, "http/1.1")
+		},
+		DisableKeepAlives:   t.conf.MaxIdleConns == 0,
+		MaxIdleConnsPerHost: t.conf.MaxIdleConns,
+		IdleConnTimeout:     t.conf.IdleTimeout,
+	}
+	pool.breaker = &circuitBreaker{
+		conf: t.conf.CircuitBreaker,
+	}
+	if t.conf.HTTP2 {
+		pool.http2 = &http2.Transport{
+			// Nodes without a forward listener use cleartext HTTP/2 (h2c).
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, "h2")
+			},
+			IdleConnTimeout: t.conf.IdleTimeout,
+			ReadIdleTimeout: http2ReadIdleTimeout,
+		}
+	}
+	return pool
+}
+
+// dial opens a connection to the node using the upstream in the request
+// context. If tlsConfig is not nil, the connection uses TLS.
+func (t *nodeTransport) dial(
+	ctx context.Context,
+	nodeID string,
+	pool *nodePool,
+	tlsConfig *tls.Config,
+) (net.Conn, error) {
+	u := ctx.Value(upstreamContextKey).(upstream.Upstream)
+
+	if t.conf.DialTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.conf.DialTimeout)
+		defer cancel()
+	}
+
+	conn, err := upstream.DialContext(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	t.metrics.ForwardConnsOpenedTotal.WithLabelValues(nodeID).Inc()
+	gauge := t.metrics.ForwardConns.WithLabelValues(nodeID)
+	gauge.Inc()
+	pool.conns.Inc()
+	return &pooledConn{
+		Conn: conn,
+		onClose: func() {
+			gauge.Dec()
+			pool.conns.Dec()
+		},
+		closed: atomic.NewBool(false),
+	}, nil
+}
+
+// removeExpiredLocked removes the pools for nodes that haven't been used
+// within nodePoolExpiry. Pools with open connections are kept, such as a
+// long lived WebSocket connection.
+func (t *nodeTransport) removeExpiredLocked(now time.Time) {
+	for nodeID, pool := range t.pools {
+		if now.Sub(pool.lastUsed) < nodePoolExpiry {
+			continue
+		}
+		pool.CloseIdleConnections()
+		if pool.conns.Load() > 0 {
+			continue
+		}
+		delete(t.pools, nodeID)
+
+		t.metrics.ForwardConns.DeleteLabelValues(nodeID)
+	}
+}
+
+// nodeAddr returns the address requests to the node are forwarded to.
+func nodeAddr(node *cluster.Node) string {
+	if node.ForwardAddr != "" {
+		return node.ForwardAddr
+	}
+	return node.ProxyAddr
+}
+
+// pooledConn is a connection to a node that's kept in a pool.
+type pooledConn struct {
+	net.Conn
+
+	onClose func()
+	closed  *atomic.Bool
+}
+
+func (c *pooledConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.onClose()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,412 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/andydunstall/piko/pkg/log"
+	pikotestutil "github.com/andydunstall/piko/pkg/testutil"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func newForwardProxy(
+	addr string,
+	forward config.ForwardConfig,
+	metrics *Metrics,
+) *HTTPProxy {
+	return newForwardNodeProxy(&cluster.Node{
+		ID:        "node-1",
+		ProxyAddr: addr,
+	}, forward, nil, metrics)
+}
+
+func newForwardNodeProxy(
+	node *cluster.Node,
+	forward config.ForwardConfig,
+	tlsConfig *tls.Config,
+	metrics *Metrics,
+) *HTTPProxy {
+	return NewHTTPProxy(
+		&fakeManager{
+			handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+				return upstream.NewNodeUpstream(endpointID, node), true
+			},
+		},
+		time.Second,
+		config.RetryConfig{},
+		config.FailoverConfig{},
+		config.HeadersConfig{},
+		forward,
+		tlsConfig,
+		nil,
+		nil,
+		metrics,
+		log.NewNopLogger(),
+	)
+}
+
+func forwardRequest(proxy *HTTPProxy, endpointID string) int {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Add("x-piko-endpoint", endpointID)
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHTTPProxy_ForwardPool(t *testing.T) {
+	t.Run("http1", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, 1, r.ProtoMajor)
+			},
+		))
+		defer server.Close()
+
+		metrics := NewMetrics()
+		proxy := newForwardProxy(server.Listener.Addr().String(), config.ForwardConfig{
+			MaxIdleConns: 4,
+		}, metrics)
+		defer proxy.Close()
+
+		// Requests for different endpoints on the same node share
+		// connections.
+		for _, endpointID := range []string{"endpoint-1", "endpoint-2", "endpoint-1"} {
+			assert.Equal(t, http.StatusOK, forwardRequest(proxy, endpointID))
+		}
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ForwardConnsOpenedTotal.WithLabelValues("node-1"),
+		))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ForwardConns.WithLabelValues("node-1"),
+		))
+	})
+
+	t.Run("http1 no idle conns", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		defer server.Close()
+
+		metrics := NewMetrics()
+		proxy := newForwardProxy(
+			server.Listener.Addr().String(), config.ForwardConfig{}, metrics,
+		)
+		defer proxy.Close()
+
+		for i := 0; i != 3; i++ {
+			assert.Equal(t, http.StatusOK, forwardRequest(proxy, "my-endpoint"))
+		}
+
+		assert.Equal(t, 3.0, testutil.ToFloat64(
+			metrics.ForwardConnsOpenedTotal.WithLabelValues("node-1"),
+		))
+	})
+
+	t.Run("http2", func(t *testing.T) {
+		blockCh := make(chan struct{})
+		var requests sync.WaitGroup
+		requests.Add(5)
+		server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, 2, r.ProtoMajor)
+
+				requests.Done()
+				<-blockCh
+			},
+		), &http2.Server{}))
+		defer server.Close()
+
+		metrics := NewMetrics()
+		proxy := newForwardProxy(server.Listener.Addr().String(), config.ForwardConfig{
+			HTTP2: true,
+		}, metrics)
+		defer proxy.Close()
+
+		// Send concurrent requests which should be multiplexed over a single
+		// connection.
+		var wg sync.WaitGroup
+		for i := 0; i != 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.Equal(t, http.StatusOK, forwardRequest(proxy, "my-endpoint"))
+			}()
+		}
+		requests.Wait()
+		close(blockCh)
+		wg.Wait()
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ForwardConnsOpenedTotal.WithLabelValues("node-1"),
+		))
+	})
+
+	t.Run("circuit breaker", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := ln.Addr().String()
+		ln.Close()
+
+		metrics := NewMetrics()
+		proxy := newForwardProxy(addr, config.ForwardConfig{
+			CircuitBreaker: config.CircuitBreakerConfig{
+				Threshold: 2,
+				Cooldown:  time.Minute,
+			},
+		}, metrics)
+		defer proxy.Close()
+
+		for i := 0; i != 3; i++ {
+			assert.Equal(t, http.StatusBadGateway, forwardRequest(proxy, "my-endpoint"))
+		}
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ForwardCircuitOpenedTotal.WithLabelValues("node-1"),
+		))
+		// The third request isn't forwarded as the circuit is open.
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ForwardRejectedTotal.WithLabelValues("node-1"),
+		))
+	})
+
+	t.Run("re-resolve dns name", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		defer server.Close()
+
+		_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+		require.NoError(t, err)
+
+		metrics := NewMetrics()
+		proxy := newForwardProxy("localhost:"+port, config.ForwardConfig{
+			MaxIdleConns: 4,
+		}, metrics)
+		defer proxy.Close()
+
+		var mu sync.Mutex
+		resolved := []string{"10.26.104.1"}
+		proxy.nodes.lookupHost = func(_ context.Context, host string) ([]string, error) {
+			assert.Equal(t, "localhost", host)
+
+			mu.Lock()
+			defer mu.Unlock()
+			return resolved, nil
+		}
+
+		assert.Equal(t, http.StatusOK, forwardRequest(proxy, "my-endpoint"))
+
+		proxy.nodes.mu.Lock()
+		pool := proxy.nodes.pools["node-1"]
+		proxy.nodes.mu.Unlock()
+
+		// Wait for the initial resolve.
+		require.Eventually(t, func() bool {
+			proxy.nodes.mu.Lock()
+			defer proxy.nodes.mu.Unlock()
+			return pool.resolvedAddrs != nil
+		}, time.Second, time.Millisecond*10)
+
+		// Resolving to the same IPs keeps the idle connection.
+		proxy.nodes.resolve(pool, pool.addr)
+		assert.Equal(t, int64(1), pool.conns.Load())
+
+		mu.Lock()
+		resolved = []string{"10.26.104.2"}
+		mu.Unlock()
+
+		// Resolving to new IPs closes the idle connection.
+		proxy.nodes.resolve(pool, pool.addr)
+		assert.Equal(t, int64(0), pool.conns.Load())
+		assert.Equal(t, 0.0, testutil.ToFloat64(
+			metrics.ForwardConns.WithLabelValues("node-1"),
+		))
+	})
+}
+
+func TestHTTPProxy_ForwardTLS(t *testing.T) {
+	rootCAPool, cert, err := pikotestutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	okHandler := func(http.ResponseWriter, *http.Request) {}
+	newServer := func(
+		t *testing.T,
+		handler http.HandlerFunc,
+		clientAuth tls.ClientAuthType,
+	) *httptest.Server {
+		server := httptest.NewUnstartedServer(handler)
+		// Discard TLS handshake errors from failed forwards.
+		server.Config.ErrorLog = stdlog.New(io.Discard, "", 0)
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    rootCAPool,
+			ClientAuth:   clientAuth,
+		}
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	for _, http2 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("http2 %t", http2), func(t *testing.T) {
+			server := newServer(t, func(_ http.ResponseWriter, r *http.Request) {
+				if http2 {
+					assert.Equal(t, 2, r.ProtoMajor)
+				} else {
+					assert.Equal(t, 1, r.ProtoMajor)
+				}
+			}, tls.NoClientCert)
+
+			proxy := newForwardNodeProxy(&cluster.Node{
+				ID:          "node-1",
+				ForwardAddr: server.Listener.Addr().String(),
+			}, config.ForwardConfig{
+				HTTP2: http2,
+			}, &tls.Config{
+				RootCAs: rootCAPool,
+			}, NewMetrics())
+			defer proxy.Close()
+
+			assert.Equal(t, http.StatusOK, forwardRequest(proxy, "my-endpoint"))
+		})
+	}
+
+	t.Run("mtls", func(t *testing.T) {
+		server := newServer(t, okHandler, tls.RequireAndVerifyClientCert)
+
+		proxy := newForwardNodeProxy(&cluster.Node{
+			ID:          "node-1",
+			ForwardAddr: server.Listener.Addr().String(),
+		}, config.ForwardConfig{}, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      rootCAPool,
+		}, NewMetrics())
+		defer proxy.Close()
+
+		assert.Equal(t, http.StatusOK, forwardRequest(proxy, "my-endpoint"))
+	})
+
+	t.Run("secret", func(t *testing.T) {
+		server := newServer(t, func(_ http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "my-secret", r.Header.Get("x-piko-forward-secret"))
+		}, tls.NoClientCert)
+
+		proxy := newForwardNodeProxy(&cluster.Node{
+			ID:          "node-1",
+			ForwardAddr: server.Listener.Addr().String(),
+		}, config.ForwardConfig{
+			Secret: "my-secret",
+		}, &tls.Config{
+			RootCAs: rootCAPool,
+		}, NewMetrics())
+		defer proxy.Close()
+
+		assert.Equal(t, http.StatusOK, forwardRequest(proxy, "my-endpoint"))
+	})
+
+	t.Run("mtls missing client cert", func(t *testing.T) {
+		server := newServer(t, okHandler, tls.RequireAndVerifyClientCert)
+
+		proxy := newForwardNodeProxy(&cluster.Node{
+			ID:          "node-1",
+			ForwardAddr: server.Listener.Addr().String(),
+		}, config.ForwardConfig{}, &tls.Config{
+			RootCAs: rootCAPool,
+		}, NewMetrics())
+		defer proxy.Close()
+
+		assert.Equal(t, http.StatusBadGateway, forwardRequest(proxy, "my-endpoint"))
+	})
+
+	t.Run("untrusted cert", func(t *testing.T) {
+		server := newServer(t, okHandler, tls.NoClientCert)
+
+		proxy := newForwardNodeProxy(&cluster.Node{
+			ID:          "node-1",
+			ForwardAddr: server.Listener.Addr().String(),
+		}, config.ForwardConfig{}, nil, NewMetrics())
+		defer proxy.Close()
+
+		assert.Equal(t, http.StatusBadGateway, forwardRequest(proxy, "my-endpoint"))
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("open", func(t *testing.T) {
+		b := &circuitBreaker{
+			conf: config.CircuitBreakerConfig{
+				Threshold: 2,
+				Cooldown:  time.Minute,
+			},
+		}
+		assert.True(t, b.Allow())
+
+		assert.False(t, b.Failure())
+		assert.True(t, b.Allow())
+
+		assert.True(t, b.Failure())
+		assert.False(t, b.Allow())
+	})
+
+	t.Run("success resets failures", func(t *testing.T) {
+		b := &circuitBreaker{
+			conf: config.CircuitBreakerConfig{
+				Threshold: 2,
+				Cooldown:  time.Minute,
+			},
+		}
+		assert.False(t, b.Failure())
+		b.Success()
+		assert.False(t, b.Failure())
+		assert.True(t, b.Allow())
+	})
+
+	t.Run("cooldown", func(t *testing.T) {
+		b := &circuitBreaker{
+			conf: config.CircuitBreakerConfig{
+				Threshold: 1,
+				Cooldown:  time.Millisecond,
+			},
+		}
+		assert.True(t, b.Failure())
+		assert.False(t, b.Allow())
+
+		time.Sleep(time.Millisecond * 5)
+		assert.True(t, b.Allow())
+
+		// The next failure reopens the circuit.
+		assert.True(t, b.Failure())
+		assert.False(t, b.Allow())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		b := &circuitBreaker{}
+		for i := 0; i != 10; i++ {
+			assert.False(t, b.Failure())
+		}
+		assert.True(t, b.Allow())
+	})
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/pkg/provenance"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+const (
+	// internalHeaderPrefix is the prefix of the internal headers used by
+	// Piko.
+	internalHeaderPrefix = "x-piko-"
+
+	// servedByHeader identifies the node and upstream connection that
+	// served a request.
+	servedByHeader = "x-piko-served-by"
+
+	// federatedHeader marks a request forwarded from a federated cluster, so
+	// the cluster doesn't forward it to another federated cluster.
+	federatedHeader = "x-piko-federated"
+)
+
+var (
+	// nodeHeaders are the internal headers nodes add to requests forwarded
+	// to other nodes.
+	nodeHeaders = []string{
+		"x-piko-forward",
+		forwardSecretHeader,
+		timeoutHeader,
+		affinityKeyHeader,
+		provenance.NonceHeader,
+	}
+)
+
+// headerPolicy removes internal 'x-piko-*' headers from requests and
+// responses.
+//
+// Clients may only set the configured internal headers, so can't inject
+// headers that nodes use when forwarding requests to one another. Upstreams
+// only receive the configured internal headers, and can't set any internal
+// headers on their responses.
+type headerPolicy struct {
+	// client contains the internal headers clients may set.
+	client map[string]struct{}
+	// forwarded contains the internal headers clients may set when nodes
+	// forward requests to the proxy listener, which includes the node
+	// headers since the node can't distinguish forwarded requests from
+	// client requests.
+	forwarded map[string]struct{}
+	// upstream contains the internal headers forwarded to upstreams.
+	upstream map[string]struct{}
+	// response contains the internal headers kept on upstream responses.
+	response map[string]struct{}
+
+	// servedBy indicates whether to add the served by header to responses.
+	servedBy bool
+	// nodeID is the ID of the local node, used in the served by header.
+	nodeID string
+
+	// clientCert configures forwarding the client certificate to
+	// upstreams, or is empty if disabled.
+	clientCert string
+}
+
+func newHeaderPolicy(conf config.HeadersConfig) *headerPolicy {
+	// Federated clusters forward requests to the proxy listener like any
+	// other client, so clients may always set the federated header. A client
+	// setting the header only stops its request being forwarded to a
+	// federated cluster.
+	client := append(slices.Clone(conf.Client), federatedHeader)
+	// The agent always receives the provenance nonce to sign the response,
+	// and the signatures are kept on the response for the node that received
+	// the request to verify.
+	upstream := append(slices.Clone(conf.Upstream), provenance.NonceHeader)
+	response := []string{
+		provenance.SignatureHeader, provenance.BodySignatureHeader,
+	}
+	return &headerPolicy{
+		client:     headerSet(client),
+		forwarded:  headerSet(slices.Concat(client, nodeHeaders)),
+		upstream:   headerSet(upstream),
+		response:   headerSet(response),
+		servedBy:   conf.ServedBy,
+		clientCert: conf.ClientCert,
+	}
+}
+
+// ClientHandler returns middleware that removes the internal headers clients
+// may not set from requests.
+//
+// If allowForwarded is true, nodes forward requests to this listener so the
+// headers nodes add to forwarded requests are kept.
+func (p *headerPolicy) ClientHandler(allowForwarded bool) gin.HandlerFunc {
+	allowed := p.client
+	if allowForwarded {
+		allowed = p.forwarded
+	}
+	return func(c *gin.Context) {
+		removeInternalHeaders(c.Request.Header, allowed)
+	}
+}
+
+// RemoveUpstream removes the internal headers that aren't forwarded to
+// upstreams from the request. They are kept when forwarding to another node
+// so that node can authenticate and route the request.
+func (p *headerPolicy) RemoveUpstream(r *http.Request) {
+	removeInternalHeaders(r.Header, p.upstream)
+}
+
+// RemoveResponse removes all internal headers, except the provenance
+// signature, from an upstream response, so the upstream can't inject headers
+// such as reporting to the node that forwarded the request that there is no
+// upstream.
+func (p *headerPolicy) RemoveResponse(resp *http.Response) {
+	removeInternalHeaders(resp.Header, p.response)
+}
+
+// AddServedBy adds the served by header to a response from the upstream, if
+// enabled.
+//
+// The header contains the local node ID and the ID of the upstream
+// connection, such as 'node-1/8f14e45fceea167a', or only the node ID if the
+// upstream has no ID.
+func (p *headerPolicy) AddServedBy(resp *http.Response, u upstream.Upstream) {
+	if !p.servedBy || p.nodeID == "" {
+		return
+	}
+	servedBy := p.nodeID
+	if id := upstream.ID(u); id != "" {
+		servedBy += "/" + id
+	}
+	resp.Header.Set(servedByHeader, servedBy)
+}
+
+// removeInternalHeaders removes all internal headers that aren't in allowed.
+func removeInternalHeaders(h http.Header, allowed map[string]struct{}) {
+	for name := range h {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, internalHeaderPrefix) {
+			continue
+		}
+		if _, ok := allowed[name]; ok {
+			continue
+		}
+		h.Del(name)
+	}
+}
+
+func headerSet(headers []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(headers))
+	for _, header := range headers {
+		set[strings.ToLower(header)] = struct{}{}
+	}
+	return set
+}
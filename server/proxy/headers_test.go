@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func TestHeaderPolicy_Client(t *testing.T) {
+	policy := newHeaderPolicy(config.Default().Proxy.Headers)
+
+	clientHeaders := func(allowForwarded bool) http.Header {
+		var header http.Header
+		router := gin.New()
+		router.Use(policy.ClientHandler(allowForwarded))
+		router.GET("/", func(c *gin.Context) {
+			header = c.Request.Header
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		r.Header.Set("x-piko-authorization", "Bearer my-token")
+		r.Header.Set("x-piko-forward", "true")
+		r.Header.Set("x-piko-forward-secret", "my-secret")
+		r.Header.Set("x-piko-timeout", "60000")
+		r.Header.Set("x-piko-custom", "foo")
+		r.Header.Set("x-piko-federated", "true")
+		r.Header.Set("Authorization", "Bearer upstream-auth")
+		router.ServeHTTP(httptest.NewRecorder(), r)
+		return header
+	}
+
+	t.Run("proxy listener", func(t *testing.T) {
+		header := clientHeaders(false)
+		assert.Equal(t, "my-endpoint", header.Get("x-piko-endpoint"))
+		assert.Equal(t, "Bearer my-token", header.Get("x-piko-authorization"))
+		assert.Equal(t, "Bearer upstream-auth", header.Get("Authorization"))
+		// Federated clusters forward requests like any other client.
+		assert.Equal(t, "true", header.Get("x-piko-federated"))
+
+		// Clients can't inject headers added by nodes.
+		assert.Equal(t, "", header.Get("x-piko-forward"))
+		assert.Equal(t, "", header.Get("x-piko-forward-secret"))
+		assert.Equal(t, "", header.Get("x-piko-timeout"))
+		assert.Equal(t, "", header.Get("x-piko-custom"))
+	})
+
+	t.Run("allow forwarded", func(t *testing.T) {
+		header := clientHeaders(true)
+		assert.Equal(t, "my-endpoint", header.Get("x-piko-endpoint"))
+		assert.Equal(t, "true", header.Get("x-piko-forward"))
+		assert.Equal(t, "60000", header.Get("x-piko-timeout"))
+		assert.Equal(t, "", header.Get("x-piko-custom"))
+	})
+}
+
+func TestHeaderPolicy_Upstream(t *testing.T) {
+	policy := newHeaderPolicy(config.HeadersConfig{
+		Upstream: []string{"X-Piko-Timeout", "x-piko-custom"},
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("x-piko-endpoint", "my-endpoint")
+	r.Header.Set("x-piko-authorization", "Bearer my-token")
+	r.Header.Set("x-piko-forward", "true")
+	r.Header.Set("x-piko-timeout", "1000")
+	r.Header.Set("x-piko-custom", "foo")
+	r.Header.Set("Authorization", "Bearer upstream-auth")
+	policy.RemoveUpstream(r)
+
+	assert.Equal(t, http.Header{
+		"X-Piko-Timeout": []string{"1000"},
+		"X-Piko-Custom":  []string{"foo"},
+		"Authorization":  []string{"Bearer upstream-auth"},
+	}, r.Header)
+}
+
+func TestHTTPProxy_Headers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Only the configured internal headers are forwarded to the
+			// upstream.
+			assert.Equal(t, "", r.Header.Get("x-piko-endpoint"))
+			assert.Equal(t, "", r.Header.Get("x-piko-forward"))
+			assert.Equal(t, "", r.Header.Get("x-piko-retries"))
+			assert.NotEqual(t, "", r.Header.Get("x-piko-timeout"))
+
+			// The upstream can't inject internal headers into the
+			// response.
+			w.Header().Set("x-piko-upstream-miss", "true")
+			w.Header().Set("x-piko-custom", "foo")
+			w.Header().Set("x-custom", "bar")
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer server.Close()
+
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(string, bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: server.Listener.Addr().String(),
+				}, true
+			},
+		},
+		time.Second,
+		config.RetryConfig{},
+		config.FailoverConfig{},
+		config.Default().Proxy.Headers,
+		config.ForwardConfig{},
+		nil,
+		nil,
+		nil,
+		NewMetrics(),
+		log.NewNopLogger(),
+	)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Add("x-piko-endpoint", "my-endpoint")
+	r.Header.Add("x-piko-retries", "1")
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("x-piko-upstream-miss"))
+	assert.Equal(t, "", resp.Header.Get("x-piko-custom"))
+	assert.Equal(t, "bar", resp.Header.Get("x-custom"))
+}
+
+// idUpstream is an upstream with a connection ID.
+type idUpstream struct {
+	*tcpUpstream
+	id string
+}
+
+func (u *idUpstream) ID() string {
+	return u.id
+}
+
+func TestHTTPProxy_ServedBy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			// The upstream can't spoof the header.
+			w.Header().Set("x-piko-served-by", "spoofed")
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer server.Close()
+
+	servedBy := func(conf config.HeadersConfig, u upstream.Upstream) string {
+		// Use the load balanced manager, which wraps the selected upstream.
+		manager := upstream.NewLoadBalancedManager(
+			cluster.NewState(&cluster.Node{ID: "node-1"}, log.NewNopLogger()),
+			config.SLOConfig{},
+			config.HoldConfig{},
+			config.RoutingConfig{},
+			config.QueueConfig{},
+			config.SlowStartConfig{},
+			log.NewNopLogger(),
+		)
+		manager.AddConn(u)
+
+		proxy := NewHTTPProxy(
+			manager,
+			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			conf,
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+		proxy.headers.nodeID = "node-1"
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.Header.Get("x-piko-served-by")
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		u := &idUpstream{
+			tcpUpstream: &tcpUpstream{addr: server.Listener.Addr().String()},
+			id:          "8f14e45fceea167a",
+		}
+		assert.Equal(
+			t,
+			"node-1/8f14e45fceea167a",
+			servedBy(config.HeadersConfig{ServedBy: true}, u),
+		)
+	})
+
+	t.Run("upstream without id", func(t *testing.T) {
+		u := &tcpUpstream{addr: server.Listener.Addr().String()}
+		assert.Equal(t, "node-1", servedBy(config.HeadersConfig{ServedBy: true}, u))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		u := &idUpstream{
+			tcpUpstream: &tcpUpstream{addr: server.Listener.Addr().String()},
+			id:          "8f14e45fceea167a",
+		}
+		assert.Equal(t, "", servedBy(config.HeadersConfig{}, u))
+	})
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+const (
+	// endpointHealthHeader contains the health score of the endpoint on
+	// error responses.
+	endpointHealthHeader = "x-piko-endpoint-health"
+)
+
+// EndpointHealth contains the health score of an endpoint.
+type EndpointHealth struct {
+	EndpointID string `json:"endpoint_id"`
+
+	// Score is the health of the endpoint, from 0 when the endpoint has no
+	// upstreams to 100 when recent requests have no errors and are within
+	// the endpoint's target latency.
+	Score int `json:"score"`
+
+	// Upstreams is the number of upstreams connected for the endpoint
+	// across the cluster.
+	Upstreams int `json:"upstreams"`
+
+	// Requests is the number of recent requests the error rate and latency
+	// are calculated from.
+	Requests int `json:"requests"`
+
+	// ErrorRate is the fraction of recent requests that failed with a 5xx
+	// status.
+	ErrorRate float64 `json:"error_rate"`
+
+	// P99 is the p99 latency of recent requests.
+	P99 time.Duration `json:"p99"`
+
+	// Target is the endpoint's target latency, or zero if the endpoint has
+	// no latency SLO.
+	Target time.Duration `json:"target,omitempty"`
+}
+
+// ClusterEndpoints returns the upstreams connected for each endpoint across
+// the cluster.
+type ClusterEndpoints interface {
+	Endpoint(endpointID string) *cluster.Endpoint
+	Endpoints() []*cluster.Endpoint
+}
+
+// endpointHealth scores the health of each endpoint from the number of
+// upstreams connected for the endpoint and the error rate and latency of
+// recent requests.
+//
+// Scores are calculated when requested, either from the status API, when
+// collecting metrics, or when adding the health header to an error
+// response.
+type endpointHealth struct {
+	latency *endpointLatency
+
+	// endpoints is nil until set, in which case no endpoints are scored.
+	endpoints ClusterEndpoints
+	slo       config.SLOConfig
+
+	desc *prometheus.Desc
+
+	mu sync.Mutex
+}
+
+func newEndpointHealth(latency *endpointLatency) *endpointHealth {
+	return &endpointHealth{
+		latency: latency,
+		desc: prometheus.NewDesc(
+			"piko_proxy_endpoint_health_score",
+			"Health score of the endpoint, from 0 (no upstreams) to 100.",
+			[]string{"endpoint_id"},
+			nil,
+		),
+	}
+}
+
+// Set sets the cluster endpoints and latency SLO used to score endpoints.
+func (h *endpointHealth) Set(endpoints ClusterEndpoints, slo config.SLOConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.endpoints = endpoints
+	h.slo = slo
+}
+
+// Endpoint returns the health of the endpoint, or false if the endpoint has
+// no upstreams and no recent requests.
+func (h *endpointHealth) Endpoint(endpointID string) (EndpointHealth, bool) {
+	h.mu.Lock()
+	endpoints := h.endpoints
+	slo := h.slo
+	h.mu.Unlock()
+
+	if endpoints == nil {
+		return EndpointHealth{}, false
+	}
+
+	upstreams := endpoints.Endpoint(endpointID).Upstreams
+	latency, ok := h.latency.Endpoint(endpointID)
+	if !ok && upstreams == 0 {
+		return EndpointHealth{}, false
+	}
+	latency.EndpointID = endpointID
+	return newHealth(latency, upstreams, slo.Target(endpointID)), true
+}
+
+// Score returns the health score of the endpoint, including endpoints with
+// no upstreams and no recent requests, or false if the cluster endpoints
+// aren't set.
+func (h *endpointHealth) Score(endpointID string) (int, bool) {
+	h.mu.Lock()
+	endpoints := h.endpoints
+	slo := h.slo
+	h.mu.Unlock()
+
+	if endpoints == nil {
+		return 0, false
+	}
+
+	latency, _ := h.latency.Endpoint(endpointID)
+	upstreams := endpoints.Endpoint(endpointID).Upstreams
+	return newHealth(latency, upstreams, slo.Target(endpointID)).Score, true
+}
+
+// Endpoints returns the health of each endpoint with upstreams or recent
+// requests, sorted by endpoint ID.
+func (h *endpointHealth) Endpoints() []EndpointHealth {
+	h.mu.Lock()
+	endpoints := h.endpoints
+	slo := h.slo
+	h.mu.Unlock()
+
+	if endpoints == nil {
+		return nil
+	}
+
+	upstreams := make(map[string]int)
+	for _, endpoint := range endpoints.Endpoints() {
+		upstreams[endpoint.ID] = endpoint.Upstreams
+	}
+
+	var health []EndpointHealth
+	for _, latency := range h.latency.Endpoints() {
+		health = append(health, newHealth(
+			latency,
+			upstreams[latency.EndpointID],
+			slo.Target(latency.EndpointID),
+		))
+		delete(upstreams, latency.EndpointID)
+	}
+	// Endpoints with upstreams but no recent requests.
+	for endpointID, n := range upstreams {
+		health = append(health, newHealth(
+			EndpointLatency{EndpointID: endpointID},
+			n,
+			slo.Target(endpointID),
+		))
+	}
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].EndpointID < health[j].EndpointID
+	})
+	return health
+}
+
+// Handler adds the endpoint health header to error responses, so clients
+// can tell whether an error is from an unhealthy endpoint.
+//
+// Forwarded requests aren't labelled, since the node that forwarded the
+// request adds the header to the response returned to the client.
+func (h *endpointHealth) Handler(c *gin.Context) {
+	endpointID := EndpointIDFromRequest(c.Request)
+	forwarded := c.Request.Header.Get("x-piko-forward") == "true"
+	if endpointID == "" || forwarded {
+		return
+	}
+
+	c.Writer = &healthWriter{
+		ResponseWriter: c.Writer,
+		health:         h,
+		endpointID:     endpointID,
+	}
+}
+
+func (h *endpointHealth) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+func (h *endpointHealth) Collect(ch chan<- prometheus.Metric) {
+	for _, health := range h.Endpoints() {
+		ch <- prometheus.MustNewConstMetric(
+			h.desc,
+			prometheus.GaugeValue,
+			float64(health.Score),
+			health.EndpointID,
+		)
+	}
+}
+
+var _ prometheus.Collector = &endpointHealth{}
+
+// healthWriter adds the endpoint health header when the response status is
+// a 5xx.
+type healthWriter struct {
+	gin.ResponseWriter
+
+	health     *endpointHealth
+	endpointID string
+}
+
+func (w *healthWriter) WriteHeader(code int) {
+	if code >= http.StatusInternalServerError &&
+		!w.Written() &&
+		w.Header().Get(endpointHealthHeader) == "" {
+		if score, ok := w.health.Score(w.endpointID); ok {
+			w.Header().Set(endpointHealthHeader, strconv.Itoa(score))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// newHealth returns the health of the endpoint with the given recent
+// requests and upstreams.
+func newHealth(
+	latency EndpointLatency,
+	upstreams int,
+	target time.Duration,
+) EndpointHealth {
+	health := EndpointHealth{
+		EndpointID: latency.EndpointID,
+		Upstreams:  upstreams,
+		Requests:   latency.Requests,
+		P99:        latency.P99,
+		Target:     target,
+	}
+	if latency.Requests > 0 {
+		health.ErrorRate = float64(latency.Errors) / float64(latency.Requests)
+	}
+	health.Score = healthScore(health)
+	return health
+}
+
+// healthScore returns the score of the endpoint.
+//
+// An endpoint with no upstreams scores 0. Otherwise the score starts at 100,
+// is scaled by the fraction of recent requests that succeeded, and, if the
+// p99 latency exceeds the target latency, is scaled by the target latency
+// over the p99 latency.
+func healthScore(health EndpointHealth) int {
+	if health.Upstreams == 0 {
+		return 0
+	}
+	score := 1 - health.ErrorRate
+	if health.Target > 0 && health.P99 > health.Target {
+		score *= float64(health.Target) / float64(health.P99)
+	}
+	return int(math.Round(score * 100))
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+type fakeClusterEndpoints struct {
+	upstreams map[string]int
+}
+
+func (e *fakeClusterEndpoints) Endpoint(endpointID string) *cluster.Endpoint {
+	return &cluster.Endpoint{
+		ID:        endpointID,
+		Upstreams: e.upstreams[endpointID],
+	}
+}
+
+func (e *fakeClusterEndpoints) Endpoints() []*cluster.Endpoint {
+	var endpoints []*cluster.Endpoint
+	for endpointID, upstreams := range e.upstreams {
+		endpoints = append(endpoints, &cluster.Endpoint{
+			ID:        endpointID,
+			Upstreams: upstreams,
+		})
+	}
+	return endpoints
+}
+
+func TestEndpointHealth(t *testing.T) {
+	t.Run("score", func(t *testing.T) {
+		latency := newEndpointLatency(NewMetrics().RequestLatency)
+		health := newEndpointHealth(latency)
+		health.Set(&fakeClusterEndpoints{
+			upstreams: map[string]int{
+				"healthy": 2,
+				"errors":  1,
+				"slow":    1,
+				"idle":    1,
+			},
+		}, config.SLOConfig{
+			Endpoints: map[string]time.Duration{
+				"slow": time.Millisecond * 100,
+			},
+		})
+
+		for i := 0; i != 100; i++ {
+			latency.Observe("healthy", http.StatusOK, time.Millisecond, "")
+			latency.Observe("slow", http.StatusOK, time.Millisecond*400, "")
+			latency.Observe("offline", http.StatusBadGateway, time.Millisecond, "")
+
+			status := http.StatusOK
+			if i%4 == 0 {
+				status = http.StatusServiceUnavailable
+			}
+			latency.Observe("errors", status, time.Millisecond, "")
+		}
+
+		endpoint, ok := health.Endpoint("healthy")
+		require.True(t, ok)
+		assert.Equal(t, EndpointHealth{
+			EndpointID: "healthy",
+			Score:      100,
+			Upstreams:  2,
+			Requests:   100,
+			P99:        time.Millisecond,
+		}, endpoint)
+
+		endpoint, ok = health.Endpoint("errors")
+		require.True(t, ok)
+		assert.Equal(t, 75, endpoint.Score)
+		assert.Equal(t, 0.25, endpoint.ErrorRate)
+
+		endpoint, ok = health.Endpoint("slow")
+		require.True(t, ok)
+		assert.Equal(t, 25, endpoint.Score)
+		assert.Equal(t, time.Millisecond*100, endpoint.Target)
+
+		// Endpoints with no upstreams score 0.
+		endpoint, ok = health.Endpoint("offline")
+		require.True(t, ok)
+		assert.Equal(t, 0, endpoint.Score)
+
+		// Endpoints with upstreams but no requests are healthy.
+		endpoint, ok = health.Endpoint("idle")
+		require.True(t, ok)
+		assert.Equal(t, 100, endpoint.Score)
+
+		_, ok = health.Endpoint("unknown")
+		assert.False(t, ok)
+
+		var endpointIDs []string
+		for _, endpoint := range health.Endpoints() {
+			endpointIDs = append(endpointIDs, endpoint.EndpointID)
+		}
+		assert.Equal(
+			t,
+			[]string{"errors", "healthy", "idle", "offline", "slow"},
+			endpointIDs,
+		)
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		latency := newEndpointLatency(NewMetrics().RequestLatency)
+		health := newEndpointHealth(latency)
+		health.Set(&fakeClusterEndpoints{
+			upstreams: map[string]int{"my-endpoint": 1},
+		}, config.SLOConfig{})
+
+		latency.Observe("my-endpoint", http.StatusOK, time.Millisecond, "")
+		latency.Observe(
+			"my-endpoint", http.StatusInternalServerError, time.Millisecond, "",
+		)
+
+		assert.NoError(t, testutil.CollectAndCompare(health, strings.NewReader(`
+# HELP piko_proxy_endpoint_health_score Health score of the endpoint, from 0 (no upstreams) to 100.
+# TYPE piko_proxy_endpoint_health_score gauge
+piko_proxy_endpoint_health_score{endpoint_id="my-endpoint"} 50
+`)))
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		latency := newEndpointLatency(NewMetrics().RequestLatency)
+		health := newEndpointHealth(latency)
+		health.Set(&fakeClusterEndpoints{
+			upstreams: map[string]int{"my-endpoint": 1},
+		}, config.SLOConfig{})
+
+		status := http.StatusOK
+		router := gin.New()
+		router.Use(health.Handler)
+		router.NoRoute(func(c *gin.Context) {
+			c.Status(status)
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		// Successful responses aren't labelled.
+		assert.Equal(t, "", w.Header().Get("x-piko-endpoint-health"))
+
+		status = http.StatusBadGateway
+
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, "100", w.Header().Get("x-piko-endpoint-health"))
+
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "unknown")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, "0", w.Header().Get("x-piko-endpoint-health"))
+
+		// Forwarded requests are labelled by the node that forwarded the
+		// request.
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		r.Header.Set("x-piko-forward", "true")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, "", w.Header().Get("x-piko-endpoint-health"))
+	})
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+const (
+	// hedgeWindowSize is the number of recent forwarded request latencies
+	// used to estimate the hedge delay.
+	hedgeWindowSize = 1024
+
+	// hedgeMinSamples is the number of forwarded requests that must complete
+	// before requests are hedged.
+	hedgeMinSamples = 32
+
+	// hedgeUpdateInterval is the number of completed forwarded requests
+	// between recalculating the hedge delay, to avoid sorting the window on
+	// every request.
+	hedgeUpdateInterval = 32
+)
+
+// latencyWindow estimates a percentile of the latency of recent forwarded
+// requests.
+type latencyWindow struct {
+	percentile float64
+	minDelay   time.Duration
+
+	// samples is a ring buffer of the most recent latencies.
+	samples []time.Duration
+	next    int
+	count   int
+
+	mu sync.Mutex
+
+	// delay is the estimated percentile latency, or zero if there aren't
+	// enough samples.
+	delay *atomic.Duration
+}
+
+func newLatencyWindow(percentile float64, minDelay time.Duration) *latencyWindow {
+	return &latencyWindow{
+		percentile: percentile,
+		minDelay:   minDelay,
+		samples:    make([]time.Duration, hedgeWindowSize),
+		delay:      atomic.NewDuration(0),
+	}
+}
+
+// Observe records the latency of a forwarded request.
+func (w *latencyWindow) Observe(latency time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % len(w.samples)
+	w.count++
+
+	if w.count < hedgeMinSamples || w.count%hedgeUpdateInterval != 0 {
+		return
+	}
+
+	sorted := slices.Clone(w.samples[:min(w.count, len(w.samples))])
+	slices.Sort(sorted)
+	i := int(math.Ceil(w.percentile*float64(len(sorted)))) - 1
+	i = max(0, min(i, len(sorted)-1))
+	w.delay.Store(max(sorted[i], w.minDelay))
+}
+
+// Delay returns the duration to wait before hedging a request, or false if
+// there aren't enough samples to estimate the delay.
+func (w *latencyWindow) Delay() (time.Duration, bool) {
+	delay := w.delay.Load()
+	return delay, delay > 0
+}
+
+// hedgeResult is the result of an attempt to forward a request.
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+	hedge  bool
+}
+
+// failed returns whether the attempt failed, either as the node couldn't be
+// reached or it has no upstream for the endpoint.
+func (r *hedgeResult) failed() bool {
+	return r.err != nil || r.resp.Header.Get(missHeader) == "true"
+}
+
+// discard cancels the attempt and closes the response.
+func (r *hedgeResult) discard() {
+	r.cancel()
+	if r.resp != nil {
+		r.resp.Body.Close()
+	}
+}
+
+// hedgeTransport hedges requests forwarded to other nodes.
+//
+// If the node doesn't respond within the hedge delay, and another node has
+// an upstream for the endpoint, a second attempt is forwarded to that node
+// and the first successful response is used. The other attempt is
+// cancelled.
+type hedgeTransport struct {
+	transport http.RoundTripper
+	upstreams upstream.Manager
+	conf      config.HedgeConfig
+
+	latency *latencyWindow
+
+	metrics *Metrics
+}
+
+func newHedgeTransport(
+	transport http.RoundTripper,
+	upstreams upstream.Manager,
+	conf config.HedgeConfig,
+	metrics *Metrics,
+) *hedgeTransport {
+	return &hedgeTransport{
+		transport: transport,
+		upstreams: upstreams,
+		conf:      conf,
+		latency:   newLatencyWindow(conf.Percentile, conf.MinDelay),
+		metrics:   metrics,
+	}
+}
+
+func (t *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := req.Context().Value(upstreamContextKey).(upstream.Upstream)
+	node, ok := upstream.RemoteNode(u)
+	if !ok || !t.conf.Enabled {
+		return t.transport.RoundTrip(req)
+	}
+	if !hedgeable(req) {
+		return t.observe(req)
+	}
+	delay, ok := t.latency.Delay()
+	if !ok {
+		return t.observe(req)
+	}
+
+	resultCh := make(chan *hedgeResult, 2)
+	go t.attempt(req, false, resultCh)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case result := <-resultCh:
+		return result.response()
+	case <-timer.C:
+	}
+
+	endpointID := req.Context().Value(endpointContextKey).(string)
+	hedgeUpstream, ok := t.upstreams.SelectHedge(endpointID, node.ID)
+	if !ok {
+		result := <-resultCh
+		return result.response()
+	}
+
+	hedgeReq := req.Clone(
+		context.WithValue(req.Context(), upstreamContextKey, hedgeUpstream),
+	)
+	go t.attempt(hedgeReq, true, resultCh)
+
+	first := <-resultCh
+	if !first.failed() {
+		t.observeWinner(first)
+		// Cancel the other attempt once it completes.
+		go func() {
+			(<-resultCh).discard()
+		}()
+		return first.response()
+	}
+
+	second := <-resultCh
+	if !second.failed() || first.resp == nil {
+		first.discard()
+		t.observeWinner(second)
+		return second.response()
+	}
+	second.discard()
+	t.observeWinner(first)
+	return first.response()
+}
+
+// observe forwards the request without hedging and records its latency.
+func (t *hedgeTransport) observe(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+	if err == nil {
+		t.latency.Observe(time.Since(start))
+	}
+	return resp, err
+}
+
+// attempt forwards the request with its own context, so it can be cancelled
+// if the other attempt wins.
+func (t *hedgeTransport) attempt(
+	req *http.Request,
+	hedge bool,
+	resultCh chan<- *hedgeResult,
+) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := t.observe(req.WithContext(ctx))
+	resultCh <- &hedgeResult{
+		resp:   resp,
+		err:    err,
+		cancel: cancel,
+		hedge:  hedge,
+	}
+}
+
+func (t *hedgeTransport) observeWinner(result *hedgeResult) {
+	if result.hedge {
+		t.metrics.ForwardHedgedTotal.WithLabelValues("hedge").Inc()
+	} else {
+		t.metrics.ForwardHedgedTotal.WithLabelValues("primary").Inc()
+	}
+}
+
+// response returns the result of the attempt. The attempts context is
+// cancelled once the response body is closed.
+func (r *hedgeResult) response() (*http.Response, error) {
+	if r.err != nil {
+		r.cancel()
+		return nil, r.err
+	}
+	r.resp.Body = &cancelBody{
+		ReadCloser: r.resp.Body,
+		cancel:     r.cancel,
+	}
+	return r.resp, nil
+}
+
+// cancelBody cancels the request context when the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// hedgeable returns whether the request can be safely hedged, which requires
+// a safe method and no body since the upstream may receive the request
+// twice.
+func hedgeable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+	default:
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return req.Header.Get("Upgrade") == ""
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	t.Run("percentile", func(t *testing.T) {
+		w := newLatencyWindow(0.9, 0)
+
+		// No delay until there are enough samples.
+		for i := 0; i != hedgeMinSamples-1; i++ {
+			w.Observe(time.Millisecond)
+		}
+		_, ok := w.Delay()
+		assert.False(t, ok)
+
+		for i := 0; i != hedgeMinSamples*9; i++ {
+			w.Observe(time.Millisecond)
+		}
+		for i := 0; i != hedgeMinSamples+1; i++ {
+			w.Observe(time.Second)
+		}
+		delay, ok := w.Delay()
+		assert.True(t, ok)
+		assert.Equal(t, time.Millisecond, delay)
+
+		for i := 0; i != hedgeMinSamples*2; i++ {
+			w.Observe(time.Second)
+		}
+		delay, _ = w.Delay()
+		assert.Equal(t, time.Second, delay)
+	})
+
+	t.Run("min delay", func(t *testing.T) {
+		w := newLatencyWindow(0.9, time.Millisecond*10)
+		for i := 0; i != hedgeMinSamples; i++ {
+			w.Observe(time.Millisecond)
+		}
+		delay, ok := w.Delay()
+		assert.True(t, ok)
+		assert.Equal(t, time.Millisecond*10, delay)
+	})
+}
+
+func newHedgeProxy(
+	primary *cluster.Node,
+	hedge *cluster.Node,
+	hedged *int,
+	metrics *Metrics,
+) *HTTPProxy {
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+				return upstream.NewNodeUpstream(endpointID, primary), true
+			},
+			hedgeHandler: func(endpointID string, excludeNodeID string) (upstream.Upstream, bool) {
+				*hedged++
+				if hedge == nil || excludeNodeID == hedge.ID {
+					return nil, false
+				}
+				return upstream.NewNodeUpstream(endpointID, hedge), true
+			},
+		},
+		time.Second*5,
+		config.RetryConfig{},
+		config.FailoverConfig{},
+		config.HeadersConfig{},
+		config.ForwardConfig{
+			Hedge: config.HedgeConfig{
+				Enabled:    true,
+				Percentile: 0.95,
+			},
+		},
+		nil,
+		nil,
+		nil,
+		metrics,
+		log.NewNopLogger(),
+	)
+
+	// Record enough fast requests to estimate the hedge delay.
+	transport := proxy.proxy.Transport.(*retryTransport).transport.(*hedgeTransport)
+	for i := 0; i != hedgeMinSamples; i++ {
+		transport.latency.Observe(time.Millisecond * 5)
+	}
+	return proxy
+}
+
+func TestHTTPProxy_Hedge(t *testing.T) {
+	t.Run("hedge wins", func(t *testing.T) {
+		cancelledCh := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				close(cancelledCh)
+			},
+		))
+		defer slow.Close()
+
+		fast := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("fast"))
+			},
+		))
+		defer fast.Close()
+
+		metrics := NewMetrics()
+		hedged := 0
+		proxy := newHedgeProxy(
+			&cluster.Node{ID: "node-1", ProxyAddr: slow.Listener.Addr().String()},
+			&cluster.Node{ID: "node-2", ProxyAddr: fast.Listener.Addr().String()},
+			&hedged,
+			metrics,
+		)
+		defer proxy.Close()
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "fast", string(body))
+
+		assert.Equal(t, 1, hedged)
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ForwardHedgedTotal.WithLabelValues("hedge"),
+		))
+
+		// The slow attempt is cancelled.
+		select {
+		case <-cancelledCh:
+		case <-time.After(time.Second):
+			t.Fatal("slow request not cancelled")
+		}
+	})
+
+	t.Run("primary responds", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("primary"))
+			},
+		))
+		defer server.Close()
+
+		hedged := 0
+		proxy := newHedgeProxy(
+			&cluster.Node{ID: "node-1", ProxyAddr: server.Listener.Addr().String()},
+			nil,
+			&hedged,
+			NewMetrics(),
+		)
+		defer proxy.Close()
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "primary", string(body))
+		assert.Equal(t, 0, hedged)
+	})
+
+	t.Run("no hedge node", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				time.Sleep(time.Millisecond * 50)
+				_, _ = w.Write([]byte("primary"))
+			},
+		))
+		defer server.Close()
+
+		hedged := 0
+		proxy := newHedgeProxy(
+			&cluster.Node{ID: "node-1", ProxyAddr: server.Listener.Addr().String()},
+			nil,
+			&hedged,
+			NewMetrics(),
+		)
+		defer proxy.Close()
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "primary", string(body))
+		// Attempted to hedge but there was no other node.
+		assert.Equal(t, 1, hedged)
+	})
+
+	t.Run("unsafe method", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(time.Millisecond * 50)
+				body, _ := io.ReadAll(r.Body)
+				_, _ = w.Write(body)
+			},
+		))
+		defer server.Close()
+
+		hedged := 0
+		proxy := newHedgeProxy(
+			&cluster.Node{ID: "node-1", ProxyAddr: server.Listener.Addr().String()},
+			&cluster.Node{ID: "node-2", ProxyAddr: server.Listener.Addr().String()},
+			&hedged,
+			NewMetrics(),
+		)
+		defer proxy.Close()
+
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("foo"))
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "foo", string(body))
+		assert.Equal(t, 0, hedged)
+	})
+}
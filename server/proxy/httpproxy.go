@@ -2,18 +2,27 @@ package proxy
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"strings"
 	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/andydunstall/piko/pkg/bufpool"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/capture"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/plugin"
 	"github.com/andydunstall/piko/server/upstream"
 )
 
@@ -22,28 +31,116 @@ type contextKey int
 const (
 	endpointContextKey contextKey = iota
 	upstreamContextKey
+	startContextKey
+	retryContextKey
+	provenanceContextKey
 )
 
+const (
+	// timeoutHeader contains the remaining time in milliseconds before the
+	// request times out, so the agent, or the node a request is forwarded
+	// to, can cancel the request when the proxy times out.
+	//
+	// The remaining duration is used rather than an absolute deadline so
+	// the header isn't affected by clock skew.
+	timeoutHeader = "x-piko-timeout"
+)
+
+var (
+	// errPlugin is returned when a plugin filter fails.
+	errPlugin = errors.New("plugin")
+
+	// errProvenance is returned when a response isn't signed by an agent
+	// for the endpoint.
+	errProvenance = errors.New("invalid provenance")
+)
+
+// Federation forwards requests to federated clusters.
+type Federation interface {
+	// Forward forwards the request to a federated cluster with an upstream
+	// for the endpoint. Returns false without writing a response if no
+	// federated cluster has an upstream for the endpoint.
+	Forward(w http.ResponseWriter, r *http.Request, endpointID string) bool
+}
+
 // HTTPProxy proxies HTTP traffic to upsteam listeners.
 type HTTPProxy struct {
 	upstreams upstream.Manager
 
 	proxy *httputil.ReverseProxy
 
+	// nodes forwards requests to other nodes.
+	nodes *nodeTransport
+
+	healthCheck config.HealthCheckConfig
+
+	// ctx is cancelled when the proxy is closed to stop background
+	// goroutines.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	timeout time.Duration
 
+	retry config.RetryConfig
+
+	failover config.FailoverConfig
+
+	headers *headerPolicy
+
+	// federation forwards requests for endpoints without an upstream in the
+	// cluster to federated clusters, or is nil if federation is disabled.
+	federation Federation
+
+	// offline serves static content for endpoints with no upstreams, or is
+	// nil if no endpoints have offline content.
+	offline *offlinePages
+
+	// provenance contains the public keys used to verify responses were
+	// signed by an agent for the endpoint, keyed by endpoint ID. Responses
+	// for endpoints without a key aren't verified.
+	provenance map[string]ed25519.PublicKey
+
+	// plugins runs plugin filters on requests and responses, or is nil if
+	// there are no filters.
+	plugins *plugin.Plugins
+
+	// capture records requests to endpoints with capturing enabled, or is
+	// nil if capturing isn't supported.
+	capture *capture.Capture
+
+	metrics *Metrics
+
 	logger log.Logger
 }
 
 func NewHTTPProxy(
 	upstreams upstream.Manager,
 	timeout time.Duration,
+	retry config.RetryConfig,
+	failover config.FailoverConfig,
+	headers config.HeadersConfig,
+	forward config.ForwardConfig,
+	forwardTLSConfig *tls.Config,
+	plugins *plugin.Plugins,
+	capture *capture.Capture,
+	metrics *Metrics,
 	logger log.Logger,
 ) *HTTPProxy {
+	ctx, cancel := context.WithCancel(context.Background())
 	rp := &HTTPProxy{
-		upstreams: upstreams,
-		timeout:   timeout,
-		logger:    logger.WithSubsystem("proxy.http"),
+		upstreams:   upstreams,
+		nodes:       newNodeTransport(forward, forwardTLSConfig, metrics),
+		healthCheck: forward.HealthCheck,
+		ctx:         ctx,
+		cancel:      cancel,
+		timeout:     timeout,
+		retry:       retry,
+		failover:    failover,
+		headers:     newHeaderPolicy(headers),
+		plugins:     plugins,
+		capture:     capture,
+		metrics:     metrics,
+		logger:      logger.WithSubsystem("proxy.http"),
 	}
 
 	rp.proxy = &httputil.ReverseProxy{
@@ -51,20 +148,57 @@ func NewHTTPProxy(
 			req.URL.Scheme = "http"
 			req.URL.Host = req.Context().Value(endpointContextKey).(string)
 		},
-		Transport: &http.Transport{
-			DialContext: rp.dialUpstream,
-			// 'connections' to the upstream are multiplexed over a single TCP
-			// connection so theres no overhead to creating new connections,
-			// therefore it doesn't make sense to keep them alive.
-			DisableKeepAlives: true,
+		Transport: &retryTransport{
+			headers: rp.headers,
+			transport: newHedgeTransport(
+				&upstreamTransport{
+					local: &http.Transport{
+						DialContext: rp.dialUpstream,
+						// 'connections' to the upstream are multiplexed over
+						// a single TCP connection so theres no overhead to
+						// creating new connections, therefore it doesn't make
+						// sense to keep them alive.
+						DisableKeepAlives: true,
+					},
+					nodes: rp.nodes,
+				},
+				upstreams,
+				forward.Hedge,
+				metrics,
+			),
 		},
-		ErrorLog:     logger.StdLogger(zapcore.WarnLevel),
-		ErrorHandler: rp.errorHandler,
+		ModifyResponse: rp.modifyResponse,
+		ErrorLog:       logger.StdLogger(zapcore.WarnLevel),
+		ErrorHandler:   rp.errorHandler,
+		// Reuse buffers to copy response bodies rather than allocating a
+		// buffer for each request.
+		BufferPool: bufpool.Default(),
 	}
 
 	return rp
 }
 
+// ProbeNodes starts probing the other nodes in the cluster in the
+// background, to stop forwarding requests to nodes that can't be reached.
+// Does nothing if health checks are disabled.
+//
+// Probing stops when the proxy is closed.
+func (p *HTTPProxy) ProbeNodes(state *cluster.State) {
+	if !p.healthCheck.Enabled() {
+		return
+	}
+
+	prober := newNodeProber(state, p.nodes, p.healthCheck, p.metrics, p.logger)
+	go prober.Run(p.ctx)
+}
+
+// Close stops probing other nodes and closes any idle connections to other
+// nodes.
+func (p *HTTPProxy) Close() {
+	p.cancel()
+	p.nodes.Close()
+}
+
 func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	endpointID := EndpointIDFromRequest(r)
 	if endpointID == "" {
@@ -78,19 +212,37 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	forwarded := r.Header.Get("x-piko-forward") == "true"
 
 	// If there is a connected upstream, attempt to forward the request to one
-	// of those upstreams. Note this includes remote nodes that are reporting
-	// they have an available upstream. We don't allow multiple hops, so if
-	// forwarded is true we only select from local nodes.
-	upstream, ok := p.upstreams.Select(endpointID, !forwarded)
+	// of those upstreams, retrying if there are none.
+	retry := p.newRetry(r, endpointID)
+	upstream, ok := retry.Select(r.Context())
 	if !ok {
 		p.logger.Warn(
 			"no available upstreams",
 			zap.String("endpoint-id", endpointID),
 		)
 
+		if forwarded {
+			// Let the node that forwarded the request know it can retry.
+			w.Header().Set(missHeader, "true")
+		} else if p.forwardFederated(w, r, endpointID) {
+			return
+		} else if p.offline != nil && p.offline.Serve(w, r, endpointID) {
+			return
+		}
 		_ = errorResponse(w, http.StatusBadGateway, "no available upstreams")
 		return
 	}
+	endpointID = failoverEndpoint(r, retry, endpointID)
+	if !forwarded {
+		r = p.addProvenanceNonce(r, endpointID)
+	}
+
+	bytesIn, bytesOut := p.metrics.countersFor(endpointID, "http")
+	w, r = countRequest(w, r, bytesIn, bytesOut)
+
+	// Add the retry to the context so the transport can retry if a remote
+	// node responds it has no upstream.
+	r = r.WithContext(context.WithValue(r.Context(), retryContextKey, retry))
 
 	p.ServeHTTPWithUpstream(w, r, endpointID, upstream)
 }
@@ -101,8 +253,18 @@ func (p *HTTPProxy) ServeHTTPWithUpstream(
 	endpointID string,
 	upstream upstream.Upstream,
 ) {
-	if p.timeout != 0 {
-		ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+	timeout := p.timeout
+	// Requests forwarded from another node include the time remaining
+	// before the forwarding node times out.
+	if r.Header.Get("x-piko-forward") == "true" {
+		if t, ok := parseTimeoutHeader(r.Header.Get(timeoutHeader)); ok {
+			if timeout == 0 || t < timeout {
+				timeout = t
+			}
+		}
+	}
+	if timeout != 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
 		defer cancel()
 
 		r = r.WithContext(ctx)
@@ -110,14 +272,101 @@ func (p *HTTPProxy) ServeHTTPWithUpstream(
 
 	r.Header.Set("x-piko-forward", "true")
 
+	// Propagate the deadline to the upstream, or the node the request is
+	// forwarded to, so it can cancel the request once the proxy times out
+	// rather than continuing to process a request the client has already
+	// received an error for.
+	if deadline, ok := r.Context().Deadline(); ok {
+		r.Header.Set(timeoutHeader, formatTimeoutHeader(time.Until(deadline)))
+	} else {
+		r.Header.Del(timeoutHeader)
+	}
+
+	if !upstream.Forward() {
+		p.headers.RemoveUpstream(r)
+
+		// Only run plugin filters on the node connected to the upstream, so
+		// each request is filtered once even if it's forwarded.
+		if p.plugins != nil {
+			resp, err := p.plugins.OnRequest(endpointID, r)
+			if err != nil {
+				p.logger.Warn(
+					"plugin request filter",
+					zap.String("endpoint-id", endpointID),
+					zap.Error(err),
+				)
+				_ = errorResponse(w, http.StatusInternalServerError, "plugin error")
+				return
+			}
+			if resp != nil {
+				writePluginResponse(w, resp)
+				return
+			}
+		}
+
+		// Like plugins, only capture on the node connected to the upstream
+		// so the capture contains the request sent to the upstream.
+		if p.capture != nil {
+			var done func()
+			w, r, done = p.capture.Start(endpointID, w, r)
+			if done != nil {
+				defer done()
+			}
+		}
+	}
+
 	r = r.WithContext(context.WithValue(r.Context(), endpointContextKey, endpointID))
 
 	// Add the upstream to the context to pass to 'DialContext'.
 	r = r.WithContext(context.WithValue(r.Context(), upstreamContextKey, upstream))
 
+	// Add the start time to the context to measure the upstream latency.
+	r = r.WithContext(context.WithValue(r.Context(), startContextKey, time.Now()))
+
 	p.proxy.ServeHTTP(w, r)
 }
 
+// forwardFederated forwards a request for an endpoint without an upstream in
+// the cluster to a federated cluster. Returns false if the request wasn't
+// forwarded.
+//
+// Requests from federated clusters aren't forwarded again, so a request is
+// forwarded across at most one federation link.
+func (p *HTTPProxy) forwardFederated(
+	w http.ResponseWriter,
+	r *http.Request,
+	endpointID string,
+) bool {
+	if p.federation == nil || r.Header.Get(federatedHeader) != "" {
+		return false
+	}
+
+	if p.timeout != 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+		defer cancel()
+
+		r = r.WithContext(ctx)
+	}
+
+	// The federated cluster may route on a different host, so always
+	// include the endpoint ID.
+	r.Header.Set("x-piko-endpoint", endpointID)
+	r.Header.Set(federatedHeader, "true")
+
+	if !p.federation.Forward(w, r, endpointID) {
+		r.Header.Del(federatedHeader)
+		return false
+	}
+	p.metrics.FederatedRequestsTotal.WithLabelValues(endpointID).Inc()
+	return true
+}
+
+func (p *HTTPProxy) newRetry(r *http.Request, endpointID string) *retry {
+	retry := newRetry(r, endpointID, p.upstreams, p.retry, p.metrics)
+	retry.fallback = p.failover.Fallback(endpointID)
+	return retry
+}
+
 func (p *HTTPProxy) dialUpstream(ctx context.Context, _, _ string) (net.Conn, error) {
 	// As a bit of a hack to work with http.Transport, we add the upstream
 	// to the dial context.
@@ -125,16 +374,114 @@ func (p *HTTPProxy) dialUpstream(ctx context.Context, _, _ string) (net.Conn, er
 	return upstream.Dial()
 }
 
-func (p *HTTPProxy) errorHandler(w http.ResponseWriter, _ *http.Request, err error) {
+// modifyResponse records the latency until the upstream responded with the
+// response headers, and runs any plugin filters on the response.
+func (p *HTTPProxy) modifyResponse(resp *http.Response) error {
+	ctx := resp.Request.Context()
+	p.observeLatency(ctx)
+
+	upstream := ctx.Value(upstreamContextKey).(upstream.Upstream)
+	if upstream.Forward() {
+		// The node responded, so forwarding succeeded even if the node
+		// itself returned an error.
+		p.upstreams.ObserveForward(upstream, nil)
+	}
+	if err := p.verifyProvenance(resp); err != nil {
+		return err
+	}
+	if !upstream.Forward() {
+		p.headers.RemoveResponse(resp)
+		p.headers.AddServedBy(resp, upstream)
+	}
+	if p.plugins != nil && !upstream.Forward() {
+		endpointID := ctx.Value(endpointContextKey).(string)
+		if err := p.plugins.OnResponse(endpointID, resp); err != nil {
+			return fmt.Errorf("%w: %w", errPlugin, err)
+		}
+	}
+	return nil
+}
+
+func (p *HTTPProxy) observeLatency(ctx context.Context) {
+	upstream := ctx.Value(upstreamContextKey).(upstream.Upstream)
+	start := ctx.Value(startContextKey).(time.Time)
+	p.upstreams.ObserveLatency(upstream, time.Since(start))
+}
+
+func (p *HTTPProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
 	p.logger.Warn("proxy request", zap.Error(err))
 
+	if errors.Is(err, errPlugin) {
+		_ = errorResponse(w, http.StatusInternalServerError, "plugin error")
+		return
+	}
+	if errors.Is(err, errProvenance) {
+		_ = errorResponse(w, http.StatusBadGateway, "invalid response provenance")
+		return
+	}
+	// Record forwarding failures, ignoring requests that were cancelled or
+	// timed out since the node may be waiting on a slow upstream rather than
+	// being unreachable.
+	upstream := r.Context().Value(upstreamContextKey).(upstream.Upstream)
+	if upstream.Forward() && r.Context().Err() == nil {
+		p.upstreams.ObserveForward(upstream, err)
+	}
 	if errors.Is(err, context.DeadlineExceeded) {
+		// Record timeouts as the upstream exceeding its target latency.
+		p.observeLatency(r.Context())
+
 		_ = errorResponse(w, http.StatusGatewayTimeout, "upstream timeout")
 		return
 	}
 	_ = errorResponse(w, http.StatusBadGateway, "upstream unreachable")
 }
 
+// failoverEndpoint returns the ID of the endpoint the request is routed to.
+//
+// If the retry failed over to the fallback endpoint, the request is updated
+// to route to the fallback endpoint in case it's forwarded to another node.
+func failoverEndpoint(r *http.Request, retry *retry, endpointID string) string {
+	if !retry.failedOver {
+		return endpointID
+	}
+	r.Header.Set("x-piko-endpoint", retry.endpointID)
+	return retry.endpointID
+}
+
+// parseTimeoutHeader parses the timeout header, returning false if the header
+// is missing or invalid.
+func parseTimeoutHeader(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// formatTimeoutHeader formats the remaining timeout in milliseconds, rounding
+// up so a timeout that hasn't yet expired is never zero.
+func formatTimeoutHeader(d time.Duration) string {
+	ms := (d + time.Millisecond - 1) / time.Millisecond
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(int64(ms), 10)
+}
+
+// writePluginResponse writes a response returned by a plugin filter.
+func writePluginResponse(w http.ResponseWriter, resp *plugin.Response) {
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write([]byte(resp.Body))
+}
+
 type errorMessage struct {
 	Error string `json:"error"`
 }
@@ -154,11 +501,12 @@ func errorResponse(w http.ResponseWriter, statusCode int, message string) error
 // empty string if no endpoint ID is specified.
 //
 // This will check both the 'x-piko-endpoint' header and 'Host' header, where
-// x-piko-endpoint takes precedence.
+// x-piko-endpoint takes precedence. The endpoint ID is normalized to match
+// the endpoint IDs upstreams are registered with.
 func EndpointIDFromRequest(r *http.Request) string {
 	endpointID := r.Header.Get("x-piko-endpoint")
 	if endpointID != "" {
-		return endpointID
+		return upstream.NormalizeEndpointID(endpointID)
 	}
 
 	host := r.Host
@@ -168,7 +516,7 @@ func EndpointIDFromRequest(r *http.Request) string {
 		//
 		// Such as if the domain is 'xyz.piko.example.com', then 'xyz' is the
 		// endpoint ID.
-		return strings.Split(host, ".")[0]
+		return upstream.NormalizeEndpointID(strings.Split(host, ".")[0])
 	}
 
 	return ""
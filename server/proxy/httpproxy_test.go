@@ -2,23 +2,38 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/capture"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/plugin"
 	"github.com/andydunstall/piko/server/upstream"
 )
 
 type fakeManager struct {
-	handler func(endpointID string, allowForward bool) (upstream.Upstream, bool)
+	handler         func(endpointID string, allowForward bool) (upstream.Upstream, bool)
+	affinityHandler func(endpointID string, key string, allowForward bool) (upstream.Upstream, bool)
+	observeHandler  func(u upstream.Upstream, latency time.Duration)
+	forwardHandler  func(u upstream.Upstream, err error)
+	holdHandler     func(endpointID string) bool
+	queueHandler    func(endpointID string) bool
+	hedgeHandler    func(endpointID string, excludeNodeID string) (upstream.Upstream, bool)
 }
 
 func (m *fakeManager) Select(
@@ -28,12 +43,59 @@ func (m *fakeManager) Select(
 	return m.handler(endpointID, allowForward)
 }
 
+func (m *fakeManager) SelectAffinity(
+	endpointID string,
+	key string,
+	allowForward bool,
+) (upstream.Upstream, bool) {
+	if m.affinityHandler != nil {
+		return m.affinityHandler(endpointID, key, allowForward)
+	}
+	return m.handler(endpointID, allowForward)
+}
+
+func (m *fakeManager) SelectHedge(
+	endpointID string,
+	excludeNodeID string,
+) (upstream.Upstream, bool) {
+	if m.hedgeHandler != nil {
+		return m.hedgeHandler(endpointID, excludeNodeID)
+	}
+	return nil, false
+}
+
 func (m *fakeManager) AddConn(_ upstream.Upstream) {
 }
 
 func (m *fakeManager) RemoveConn(_ upstream.Upstream) {
 }
 
+func (m *fakeManager) ObserveLatency(u upstream.Upstream, latency time.Duration) {
+	if m.observeHandler != nil {
+		m.observeHandler(u, latency)
+	}
+}
+
+func (m *fakeManager) ObserveForward(u upstream.Upstream, err error) {
+	if m.forwardHandler != nil {
+		m.forwardHandler(u, err)
+	}
+}
+
+func (m *fakeManager) Hold(_ context.Context, endpointID string) bool {
+	if m.holdHandler != nil {
+		return m.holdHandler(endpointID)
+	}
+	return false
+}
+
+func (m *fakeManager) Queue(_ context.Context, endpointID string) bool {
+	if m.queueHandler != nil {
+		return m.queueHandler(endpointID)
+	}
+	return false
+}
+
 type tcpUpstream struct {
 	addr    string
 	forward bool
@@ -69,6 +131,8 @@ func TestHTTPProxy_Forward(t *testing.T) {
 		))
 		defer server.Close()
 
+		metrics := NewMetrics()
+		observed := 0
 		proxy := NewHTTPProxy(
 			&fakeManager{
 				handler: func(endpointID string, allowForward bool) (upstream.Upstream, bool) {
@@ -78,8 +142,21 @@ func TestHTTPProxy_Forward(t *testing.T) {
 						addr: server.Listener.Addr().String(),
 					}, true
 				},
+				observeHandler: func(u upstream.Upstream, latency time.Duration) {
+					assert.Equal(t, "my-endpoint", u.EndpointID())
+					assert.Greater(t, latency, time.Duration(0))
+					observed++
+				},
 			},
 			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			metrics,
 			log.NewNopLogger(),
 		)
 
@@ -99,6 +176,15 @@ func TestHTTPProxy_Forward(t *testing.T) {
 		// nolint
 		io.Copy(buf, resp.Body)
 		assert.Equal(t, "bar", buf.String())
+
+		assert.Equal(t, 3.0, testutil.ToFloat64(
+			metrics.BytesInTotal.WithLabelValues("my-endpoint", "http"),
+		))
+		assert.Equal(t, 3.0, testutil.ToFloat64(
+			metrics.BytesOutTotal.WithLabelValues("my-endpoint", "http"),
+		))
+
+		assert.Equal(t, 1, observed)
 	})
 
 	t.Run("timeout", func(t *testing.T) {
@@ -111,6 +197,7 @@ func TestHTTPProxy_Forward(t *testing.T) {
 		defer server.Close()
 		defer close(blockCh)
 
+		var observed time.Duration
 		proxy := NewHTTPProxy(
 			&fakeManager{
 				handler: func(endpointID string, allowForward bool) (upstream.Upstream, bool) {
@@ -120,8 +207,19 @@ func TestHTTPProxy_Forward(t *testing.T) {
 						addr: server.Listener.Addr().String(),
 					}, true
 				},
+				observeHandler: func(_ upstream.Upstream, latency time.Duration) {
+					observed = latency
+				},
 			},
 			time.Millisecond,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
 			log.NewNopLogger(),
 		)
 
@@ -139,6 +237,94 @@ func TestHTTPProxy_Forward(t *testing.T) {
 		m := errorMessage{}
 		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
 		assert.Equal(t, "upstream timeout", m.Error)
+
+		// Timeouts are recorded as the latency of the request.
+		assert.GreaterOrEqual(t, observed, time.Millisecond)
+	})
+
+	t.Run("propagate timeout", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				timeout, err := strconv.Atoi(r.Header.Get("x-piko-timeout"))
+				assert.NoError(t, err)
+				assert.Greater(t, timeout, 0)
+				assert.LessOrEqual(t, timeout, 1000)
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(string, bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{Upstream: []string{"x-piko-timeout"}},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		// Clients can't extend the timeout.
+		r.Header.Add("x-piko-timeout", "60000")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("forwarded timeout", func(t *testing.T) {
+		blockCh := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {
+				<-blockCh
+			},
+		))
+		defer server.Close()
+		defer close(blockCh)
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(string, bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			time.Minute,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+
+		// A request forwarded from another node uses the remaining timeout
+		// of the forwarding node if it's shorter.
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-piko-forward", "true")
+		r.Header.Add("x-piko-timeout", "5")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusGatewayTimeout, w.Result().StatusCode)
 	})
 
 	t.Run("upstream unreachable", func(t *testing.T) {
@@ -153,6 +339,14 @@ func TestHTTPProxy_Forward(t *testing.T) {
 				},
 			},
 			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
 			log.NewNopLogger(),
 		)
 
@@ -182,6 +376,14 @@ func TestHTTPProxy_Forward(t *testing.T) {
 				},
 			},
 			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
 			log.NewNopLogger(),
 		)
 
@@ -201,6 +403,55 @@ func TestHTTPProxy_Forward(t *testing.T) {
 		assert.Equal(t, "no available upstreams", m.Error)
 	})
 
+	t.Run("held until upstream reconnects", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			},
+		))
+		defer server.Close()
+
+		connected := false
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					if !connected {
+						return nil, false
+					}
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+				holdHandler: func(endpointID string) bool {
+					assert.Equal(t, "my-endpoint", endpointID)
+					connected = true
+					return true
+				},
+			},
+			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
 	t.Run("no available upstreams forwarded", func(t *testing.T) {
 		proxy := NewHTTPProxy(
 			&fakeManager{
@@ -211,6 +462,14 @@ func TestHTTPProxy_Forward(t *testing.T) {
 				},
 			},
 			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
 			log.NewNopLogger(),
 		)
 
@@ -225,6 +484,8 @@ func TestHTTPProxy_Forward(t *testing.T) {
 		defer resp.Body.Close()
 
 		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		// Marked as a miss so the forwarding node can retry.
+		assert.Equal(t, "true", resp.Header.Get("x-piko-upstream-miss"))
 
 		m := errorMessage{}
 		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
@@ -232,7 +493,9 @@ func TestHTTPProxy_Forward(t *testing.T) {
 	})
 
 	t.Run("missing endpoint id", func(t *testing.T) {
-		proxy := NewHTTPProxy(nil, time.Second, log.NewNopLogger())
+		proxy := NewHTTPProxy(
+			nil, time.Second, config.RetryConfig{}, config.FailoverConfig{}, config.HeadersConfig{}, config.ForwardConfig{}, nil, nil, nil, NewMetrics(), log.NewNopLogger(),
+		)
 
 		r := httptest.NewRequest(http.MethodGet, "/", nil)
 		// The host must have a '.' separator to be parsed as an endpoint ID.
@@ -272,6 +535,20 @@ func TestEndpointIDFromRequest(t *testing.T) {
 		assert.Equal(t, "my-endpoint", endpointID)
 	})
 
+	t.Run("normalize", func(t *testing.T) {
+		header := make(http.Header)
+		header.Add("x-piko-endpoint", "My-Endpoint")
+		endpointID := EndpointIDFromRequest(&http.Request{
+			Header: header,
+		})
+		assert.Equal(t, "my-endpoint", endpointID)
+
+		endpointID = EndpointIDFromRequest(&http.Request{
+			Host: "My-Endpoint.piko.com:9000",
+		})
+		assert.Equal(t, "my-endpoint", endpointID)
+	})
+
 	t.Run("no endpoint", func(t *testing.T) {
 		endpointID := EndpointIDFromRequest(&http.Request{
 			Host: "localhost:9000",
@@ -279,3 +556,411 @@ func TestEndpointIDFromRequest(t *testing.T) {
 		assert.Equal(t, "", endpointID)
 	})
 }
+
+func TestHTTPProxy_Plugins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.lua")
+	require.NoError(t, os.WriteFile(path, []byte(`
+function on_request(req)
+	if req.headers["x-api-key"] ~= "secret" then
+		return {status = 401, body = "unauthorized"}
+	end
+	req.headers["x-team"] = "payments"
+end
+
+function on_response(resp)
+	resp.headers["x-filtered"] = "true"
+end
+`), 0o600))
+	plugins, err := plugin.New(plugin.Config{
+		Filters: []plugin.FilterConfig{{Path: path}},
+		Timeout: time.Second,
+	}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "payments", r.Header.Get("x-team"))
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer server.Close()
+
+	newProxy := func(forward bool) *HTTPProxy {
+		return NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr:    server.Listener.Addr().String(),
+						forward: forward,
+					}, true
+				},
+			},
+			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			plugins,
+			nil,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+	}
+
+	t.Run("filter request", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-api-key", "secret")
+
+		w := httptest.NewRecorder()
+		newProxy(false).ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "true", resp.Header.Get("x-filtered"))
+	})
+
+	t.Run("reject request", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		newProxy(false).ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "unauthorized", string(b))
+	})
+
+	t.Run("forwarded request not filtered", func(t *testing.T) {
+		// Requests forwarded to another node are filtered by the node
+		// connected to the upstream.
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-team", "payments")
+
+		w := httptest.NewRecorder()
+		newProxy(true).ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("x-filtered"))
+	})
+}
+
+func TestHTTPProxy_Capture(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The upstream must still receive the full body.
+			b, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, "foo", string(b))
+
+			w.WriteHeader(http.StatusTeapot)
+			// nolint
+			w.Write([]byte("bar"))
+		},
+	))
+	defer server.Close()
+
+	c := capture.New()
+	_, err := c.Enable("my-endpoint", capture.Config{})
+	require.NoError(t, err)
+
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: server.Listener.Addr().String(),
+				}, true
+			},
+		},
+		time.Second,
+		config.RetryConfig{},
+		config.FailoverConfig{},
+		config.HeadersConfig{},
+		config.ForwardConfig{},
+		nil,
+		nil,
+		c,
+		NewMetrics(),
+		log.NewNopLogger(),
+	)
+
+	r := httptest.NewRequest(http.MethodPost, "/foo", bytes.NewReader([]byte("foo")))
+	r.Header.Add("x-piko-endpoint", "my-endpoint")
+	r.Header.Add("x-piko-authorization", "Bearer secret")
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, "bar", w.Body.String())
+
+	records, ok := c.Records("my-endpoint")
+	require.True(t, ok)
+	require.Len(t, records, 1)
+	assert.Equal(t, "/foo", records[0].URL)
+	assert.Equal(t, "foo", records[0].RequestBody)
+	assert.Equal(t, http.StatusTeapot, records[0].StatusCode)
+	assert.Equal(t, "bar", records[0].ResponseBody)
+	// The proxy headers are removed before forwarding to the upstream.
+	assert.Empty(t, records[0].RequestHeader.Get("x-piko-authorization"))
+}
+
+func TestHTTPProxy_ObserveForward(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				// Errors from the remote node are still successfully
+				// forwarded.
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		))
+		defer server.Close()
+
+		var results []error
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr:    server.Listener.Addr().String(),
+						forward: true,
+					}, true
+				},
+				forwardHandler: func(_ upstream.Upstream, err error) {
+					results = append(results, err)
+				},
+			},
+			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, []error{nil}, results)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := ln.Addr().String()
+		ln.Close()
+
+		var results []error
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr:    addr,
+						forward: true,
+					}, true
+				},
+				forwardHandler: func(_ upstream.Upstream, err error) {
+					results = append(results, err)
+				},
+			},
+			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		require.Len(t, results, 1)
+		assert.Error(t, results[0])
+	})
+
+	t.Run("local upstream", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		defer server.Close()
+
+		observed := false
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+				forwardHandler: func(_ upstream.Upstream, _ error) {
+					observed = true
+				},
+			},
+			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.False(t, observed)
+	})
+}
+
+type fakeFederation struct {
+	handler func(w http.ResponseWriter, r *http.Request, endpointID string) bool
+}
+
+func (f *fakeFederation) Forward(
+	w http.ResponseWriter,
+	r *http.Request,
+	endpointID string,
+) bool {
+	return f.handler(w, r, endpointID)
+}
+
+func TestHTTPProxy_Federation(t *testing.T) {
+	newProxy := func(federation Federation) *HTTPProxy {
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(string, bool) (upstream.Upstream, bool) {
+					return nil, false
+				},
+			},
+			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+		proxy.federation = federation
+		return proxy
+	}
+
+	t.Run("forward", func(t *testing.T) {
+		forwarded := 0
+		proxy := newProxy(&fakeFederation{
+			handler: func(w http.ResponseWriter, r *http.Request, endpointID string) bool {
+				assert.Equal(t, "my-endpoint", endpointID)
+				assert.Equal(t, "my-endpoint", r.Header.Get("x-piko-endpoint"))
+				assert.Equal(t, "true", r.Header.Get("x-piko-federated"))
+				_, ok := r.Context().Deadline()
+				assert.True(t, ok)
+
+				forwarded++
+				w.WriteHeader(http.StatusOK)
+				return true
+			},
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 1, forwarded)
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			proxy.metrics.FederatedRequestsTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("no federated upstream", func(t *testing.T) {
+		proxy := newProxy(&fakeFederation{
+			handler: func(http.ResponseWriter, *http.Request, string) bool {
+				return false
+			},
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+
+	t.Run("federated request not forwarded", func(t *testing.T) {
+		proxy := newProxy(&fakeFederation{
+			handler: func(http.ResponseWriter, *http.Request, string) bool {
+				assert.Fail(t, "request forwarded")
+				return true
+			},
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		r.Header.Set("x-piko-federated", "true")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+
+	t.Run("forwarded request not forwarded", func(t *testing.T) {
+		proxy := newProxy(&fakeFederation{
+			handler: func(http.ResponseWriter, *http.Request, string) bool {
+				assert.Fail(t, "request forwarded")
+				return true
+			},
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		r.Header.Set("x-piko-forward", "true")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+}
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// latencyWindowSize is the number of recent request latencies for each
+	// endpoint used to calculate the endpoint's latency percentiles.
+	latencyWindowSize = 1024
+
+	// traceparentHeader is the W3C trace context header, which contains the
+	// trace ID of the request used as an exemplar for the latency histogram.
+	traceparentHeader = "traceparent"
+)
+
+// EndpointLatency contains the latency percentiles of recent proxied requests
+// to an endpoint.
+type EndpointLatency struct {
+	EndpointID string `json:"endpoint_id"`
+
+	// Requests is the number of recent requests the percentiles are
+	// calculated from.
+	Requests int `json:"requests"`
+
+	// Errors is the number of recent requests that failed with a 5xx
+	// status.
+	Errors int `json:"errors"`
+
+	P50 time.Duration `json:"p50"`
+	P95 time.Duration `json:"p95"`
+	P99 time.Duration `json:"p99"`
+
+	// Target is the endpoint's target latency, or zero if the endpoint has
+	// no latency SLO.
+	Target time.Duration `json:"target,omitempty"`
+}
+
+// endpointLatency records the latency of proxied requests to each endpoint.
+//
+// Latencies are recorded in the request latency histogram, with the trace ID
+// of the request as an exemplar, and in a window of recent requests to each
+// endpoint to calculate the current latency percentiles.
+type endpointLatency struct {
+	histogram *prometheus.HistogramVec
+
+	// windows contains the recent request latencies for each endpoint,
+	// keyed by endpoint ID.
+	windows map[string]*requestWindow
+
+	mu sync.Mutex
+}
+
+func newEndpointLatency(histogram *prometheus.HistogramVec) *endpointLatency {
+	return &endpointLatency{
+		histogram: histogram,
+		windows:   make(map[string]*requestWindow),
+	}
+}
+
+// Handler records the latency of each proxied request.
+//
+// Requests forwarded from other nodes aren't recorded, since the node that
+// forwarded the request records the latency seen by the client, so each
+// request is only recorded once.
+func (l *endpointLatency) Handler(c *gin.Context) {
+	endpointID := EndpointIDFromRequest(c.Request)
+	forwarded := c.Request.Header.Get("x-piko-forward") == "true"
+	traceID := traceIDFromRequest(c.Request.Header.Get(traceparentHeader))
+
+	start := time.Now()
+
+	c.Next()
+
+	if endpointID == "" || forwarded {
+		return
+	}
+	l.Observe(endpointID, c.Writer.Status(), time.Since(start), traceID)
+}
+
+// Observe records the latency of a request to the endpoint. If the trace ID
+// isn't empty, it's added as an exemplar.
+func (l *endpointLatency) Observe(
+	endpointID string,
+	status int,
+	latency time.Duration,
+	traceID string,
+) {
+	observer := l.histogram.WithLabelValues(endpointID, strconv.Itoa(status))
+	if traceID != "" {
+		observer.(prometheus.ExemplarObserver).ObserveWithExemplar(
+			latency.Seconds(), prometheus.Labels{"trace_id": traceID},
+		)
+	} else {
+		observer.Observe(latency.Seconds())
+	}
+
+	l.mu.Lock()
+	window, ok := l.windows[endpointID]
+	if !ok {
+		window = &requestWindow{
+			samples: make([]time.Duration, latencyWindowSize),
+			failed:  make([]bool, latencyWindowSize),
+		}
+		l.windows[endpointID] = window
+	}
+	l.mu.Unlock()
+
+	window.Observe(latency, status >= http.StatusInternalServerError)
+}
+
+// Endpoint returns the latency percentiles of the endpoint, or false if no
+// requests to the endpoint have been recorded.
+func (l *endpointLatency) Endpoint(endpointID string) (EndpointLatency, bool) {
+	l.mu.Lock()
+	window, ok := l.windows[endpointID]
+	l.mu.Unlock()
+
+	if !ok {
+		return EndpointLatency{}, false
+	}
+	return window.Latency(endpointID), true
+}
+
+// Endpoints returns the latency percentiles of each endpoint with recorded
+// requests, sorted by endpoint ID.
+func (l *endpointLatency) Endpoints() []EndpointLatency {
+	l.mu.Lock()
+	windows := make(map[string]*requestWindow, len(l.windows))
+	for endpointID, window := range l.windows {
+		windows[endpointID] = window
+	}
+	l.mu.Unlock()
+
+	endpoints := make([]EndpointLatency, 0, len(windows))
+	for endpointID, window := range windows {
+		endpoints = append(endpoints, window.Latency(endpointID))
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].EndpointID < endpoints[j].EndpointID
+	})
+	return endpoints
+}
+
+// requestWindow contains the latencies of the most recent requests to an
+// endpoint.
+type requestWindow struct {
+	// samples is a ring buffer of the most recent latencies.
+	samples []time.Duration
+	// failed is a ring buffer, matching samples, of whether each request
+	// failed.
+	failed []bool
+	next   int
+	count  int
+
+	mu sync.Mutex
+}
+
+func (w *requestWindow) Observe(latency time.Duration, failed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.samples[w.next] = latency
+	w.failed[w.next] = failed
+	w.next = (w.next + 1) % len(w.samples)
+	w.count++
+}
+
+// Latency returns the latency percentiles of the requests in the window.
+//
+// The percentiles are calculated when requested rather than on each request,
+// since they're only needed when inspecting the endpoint.
+func (w *requestWindow) Latency(endpointID string) EndpointLatency {
+	w.mu.Lock()
+	n := min(w.count, len(w.samples))
+	sorted := slices.Clone(w.samples[:n])
+	errors := 0
+	for _, failed := range w.failed[:n] {
+		if failed {
+			errors++
+		}
+	}
+	w.mu.Unlock()
+
+	slices.Sort(sorted)
+	return EndpointLatency{
+		EndpointID: endpointID,
+		Requests:   len(sorted),
+		Errors:     errors,
+		P50:        percentile(sorted, 0.5),
+		P95:        percentile(sorted, 0.95),
+		P99:        percentile(sorted, 0.99),
+	}
+}
+
+// percentile returns the given percentile of the sorted latencies, or zero if
+// there are no latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	i = max(0, min(i, len(sorted)-1))
+	return sorted[i]
+}
+
+// traceIDFromRequest returns the trace ID from the W3C traceparent header,
+// such as '00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01', or an
+// empty string if the header is missing or invalid.
+func traceIDFromRequest(traceparent string) string {
+	// The header contains the version, trace ID, parent ID and flags,
+	// separated by '-'.
+	if len(traceparent) < 55 || traceparent[2] != '-' || traceparent[35] != '-' {
+		return ""
+	}
+	traceID := traceparent[3:35]
+	zero := true
+	for _, c := range traceID {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f':
+		default:
+			return ""
+		}
+		if c != '0' {
+			zero = false
+		}
+	}
+	// An all zero trace ID is invalid.
+	if zero {
+		return ""
+	}
+	return traceID
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointLatency(t *testing.T) {
+	t.Run("percentiles", func(t *testing.T) {
+		latency := newEndpointLatency(NewMetrics().RequestLatency)
+		for i := 1; i <= 100; i++ {
+			latency.Observe(
+				"my-endpoint", http.StatusOK, time.Duration(i)*time.Millisecond, "",
+			)
+		}
+
+		endpoint, ok := latency.Endpoint("my-endpoint")
+		require.True(t, ok)
+		assert.Equal(t, EndpointLatency{
+			EndpointID: "my-endpoint",
+			Requests:   100,
+			P50:        time.Millisecond * 50,
+			P95:        time.Millisecond * 95,
+			P99:        time.Millisecond * 99,
+		}, endpoint)
+
+		_, ok = latency.Endpoint("unknown")
+		assert.False(t, ok)
+	})
+
+	t.Run("window", func(t *testing.T) {
+		latency := newEndpointLatency(NewMetrics().RequestLatency)
+		for i := 0; i != latencyWindowSize; i++ {
+			latency.Observe("my-endpoint", http.StatusOK, time.Second, "")
+		}
+		// Once the window is full, the oldest requests are discarded.
+		for i := 0; i != latencyWindowSize; i++ {
+			latency.Observe("my-endpoint", http.StatusOK, time.Millisecond, "")
+		}
+
+		endpoint, ok := latency.Endpoint("my-endpoint")
+		require.True(t, ok)
+		assert.Equal(t, latencyWindowSize, endpoint.Requests)
+		assert.Equal(t, time.Millisecond, endpoint.P99)
+	})
+
+	t.Run("exemplar", func(t *testing.T) {
+		metrics := NewMetrics()
+		latency := newEndpointLatency(metrics.RequestLatency)
+		latency.Observe(
+			"my-endpoint",
+			http.StatusOK,
+			time.Millisecond,
+			"4bf92f3577b34da6a3ce929d0e0e4736",
+		)
+
+		var m dto.Metric
+		require.NoError(t, metrics.RequestLatency.WithLabelValues(
+			"my-endpoint", "200",
+		).(interface{ Write(*dto.Metric) error }).Write(&m))
+
+		var exemplars []*dto.Exemplar
+		for _, bucket := range m.GetHistogram().GetBucket() {
+			if bucket.GetExemplar() != nil {
+				exemplars = append(exemplars, bucket.GetExemplar())
+			}
+		}
+		require.Len(t, exemplars, 1)
+		assert.Equal(t, "trace_id", exemplars[0].GetLabel()[0].GetName())
+		assert.Equal(
+			t,
+			"4bf92f3577b34da6a3ce929d0e0e4736",
+			exemplars[0].GetLabel()[0].GetValue(),
+		)
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		metrics := NewMetrics()
+		latency := newEndpointLatency(metrics.RequestLatency)
+
+		router := gin.New()
+		router.Use(latency.Handler)
+		router.NoRoute(func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		router.ServeHTTP(httptest.NewRecorder(), r)
+
+		// Forwarded requests are recorded by the node that forwarded the
+		// request.
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		r.Header.Set("x-piko-forward", "true")
+		router.ServeHTTP(httptest.NewRecorder(), r)
+
+		endpoint, ok := latency.Endpoint("my-endpoint")
+		require.True(t, ok)
+		assert.Equal(t, 1, endpoint.Requests)
+		assert.Equal(t, 1, testutil.CollectAndCount(metrics.RequestLatency))
+	})
+}
+
+func TestTraceIDFromRequest(t *testing.T) {
+	tests := []struct {
+		traceparent string
+		traceID     string
+	}{
+		{
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			traceID:     "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			traceparent: "",
+			traceID:     "",
+		},
+		{
+			// Invalid trace ID.
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+			traceID:     "",
+		},
+		{
+			// Zero trace ID.
+			traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			traceID:     "",
+		},
+		{
+			// Truncated.
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736",
+			traceID:     "",
+		},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.traceID, traceIDFromRequest(tt.traceparent))
+	}
+}
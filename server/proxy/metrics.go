@@ -0,0 +1,288 @@
+package proxy
+
+import "github.com/prometheus/client_golang/prometheus"
+
+type Metrics struct {
+	// BytesInTotal is the number of bytes received from proxy clients.
+	// Labelled by endpoint ID and protocol (http or tcp).
+	BytesInTotal *prometheus.CounterVec
+
+	// BytesOutTotal is the number of bytes sent to proxy clients.
+	// Labelled by endpoint ID and protocol (http or tcp).
+	BytesOutTotal *prometheus.CounterVec
+
+	// UpstreamMissesTotal is the number of requests where the first attempt
+	// to find an upstream for the endpoint failed, either as the local node
+	// had no upstream or the remote node the request was forwarded to had
+	// no upstream.
+	UpstreamMissesTotal prometheus.Counter
+
+	// RetriesTotal is the number of requests that were retried after an
+	// upstream miss. Labelled by result, where 'succeeded' means a retry
+	// found an upstream and 'failed' means the retries were exhausted or
+	// the request was cancelled.
+	RetriesTotal *prometheus.CounterVec
+
+	// FailoversTotal is the number of requests routed to the fallback
+	// endpoint as the endpoint had no upstreams. Labelled by the ID of the
+	// endpoint that failed over.
+	FailoversTotal *prometheus.CounterVec
+
+	// FederatedRequestsTotal is the number of requests forwarded to a
+	// federated cluster as the endpoint had no upstreams in the cluster.
+	// Labelled by endpoint ID.
+	FederatedRequestsTotal *prometheus.CounterVec
+
+	// ProvenanceFailuresTotal is the number of responses rejected as they
+	// weren't signed by an agent for the endpoint. Labelled by endpoint ID.
+	ProvenanceFailuresTotal *prometheus.CounterVec
+
+	// ForwardConns is the number of open connections to other nodes used to
+	// forward requests. Labelled by target node ID.
+	ForwardConns *prometheus.GaugeVec
+
+	// ForwardConnsOpenedTotal is the number of connections opened to other
+	// nodes to forward requests. Labelled by target node ID.
+	ForwardConnsOpenedTotal *prometheus.CounterVec
+
+	// ForwardCircuitOpenedTotal is the number of times the circuit breaker
+	// for a node opened after consecutive failures. Labelled by target node
+	// ID.
+	ForwardCircuitOpenedTotal *prometheus.CounterVec
+
+	// ForwardRejectedTotal is the number of requests that weren't forwarded
+	// as the circuit breaker for the node was open. Labelled by target node
+	// ID.
+	ForwardRejectedTotal *prometheus.CounterVec
+
+	// ForwardHedgedTotal is the number of forwarded requests that were
+	// hedged to a second node. Labelled by the attempt that won ('primary'
+	// or 'hedge').
+	ForwardHedgedTotal *prometheus.CounterVec
+
+	// ForwardProbeFailuresTotal is the number of health check probes to
+	// other nodes that failed to reach the node. Labelled by target node ID.
+	ForwardProbeFailuresTotal *prometheus.CounterVec
+
+	// RequestLatency is the latency of proxied HTTP requests. Labelled by
+	// endpoint ID and response status code. Observations include the trace
+	// ID of the request as an exemplar when the request has a W3C
+	// 'traceparent' header.
+	RequestLatency *prometheus.HistogramVec
+
+	// InflightRequests is the number of in-flight proxy requests counted
+	// towards the shedding limit.
+	InflightRequests prometheus.Gauge
+
+	// ShedRequestsTotal is the number of requests shed as the node was
+	// overloaded. Labelled by endpoint priority and the exceeded limit
+	// ('inflight', 'heap' or 'queue_latency').
+	ShedRequestsTotal *prometheus.CounterVec
+
+	// TCPConns is the number of open proxied TCP connections.
+	TCPConns prometheus.Gauge
+
+	// TCPConnsRejectedTotal is the number of TCP connections rejected as the
+	// node had reached the maximum number of TCP connections.
+	TCPConnsRejectedTotal prometheus.Counter
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		BytesInTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "bytes_in_total",
+				Help:      "Number of bytes received from proxy clients",
+			},
+			[]string{"endpoint_id", "protocol"},
+		),
+		BytesOutTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "bytes_out_total",
+				Help:      "Number of bytes sent to proxy clients",
+			},
+			[]string{"endpoint_id", "protocol"},
+		),
+		UpstreamMissesTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "upstream_misses_total",
+				Help:      "Number of requests with no connected upstream on the first attempt",
+			},
+		),
+		RetriesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "retries_total",
+				Help:      "Number of requests retried after an upstream miss",
+			},
+			[]string{"result"},
+		),
+		FailoversTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "failovers_total",
+				Help:      "Number of requests routed to the fallback endpoint",
+			},
+			[]string{"endpoint_id"},
+		),
+		FederatedRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "federated_requests_total",
+				Help:      "Number of requests forwarded to a federated cluster",
+			},
+			[]string{"endpoint_id"},
+		),
+		ProvenanceFailuresTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "provenance_failures_total",
+				Help:      "Number of responses rejected with an invalid provenance signature",
+			},
+			[]string{"endpoint_id"},
+		),
+		ForwardConns: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "forward_conns",
+				Help:      "Number of open connections to other nodes used to forward requests",
+			},
+			[]string{"node_id"},
+		),
+		ForwardConnsOpenedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "forward_conns_opened_total",
+				Help:      "Number of connections opened to other nodes to forward requests",
+			},
+			[]string{"node_id"},
+		),
+		ForwardCircuitOpenedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "forward_circuit_opened_total",
+				Help:      "Number of times the circuit breaker for a node opened",
+			},
+			[]string{"node_id"},
+		),
+		ForwardRejectedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "forward_rejected_total",
+				Help:      "Number of requests not forwarded as the circuit breaker for the node was open",
+			},
+			[]string{"node_id"},
+		),
+		ForwardHedgedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "forward_hedged_total",
+				Help:      "Number of forwarded requests hedged to a second node",
+			},
+			[]string{"winner"},
+		),
+		ForwardProbeFailuresTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "forward_probe_failures_total",
+				Help:      "Number of health check probes that failed to reach a node",
+			},
+			[]string{"node_id"},
+		),
+		RequestLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "request_latency_seconds",
+				Help:      "Proxied request latency",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"endpoint_id", "status"},
+		),
+		InflightRequests: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "inflight_requests",
+				Help:      "Number of in-flight proxy requests",
+			},
+		),
+		ShedRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "shed_requests_total",
+				Help:      "Number of requests shed as the node was overloaded",
+			},
+			[]string{"priority", "reason"},
+		),
+		TCPConns: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "tcp_conns",
+				Help:      "Number of open proxied TCP connections",
+			},
+		),
+		TCPConnsRejectedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "tcp_conns_rejected_total",
+				Help:      "Number of TCP connections rejected as the node reached the connection limit",
+			},
+		),
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.BytesInTotal,
+		m.BytesOutTotal,
+		m.UpstreamMissesTotal,
+		m.RetriesTotal,
+		m.FailoversTotal,
+		m.FederatedRequestsTotal,
+		m.ProvenanceFailuresTotal,
+		m.ForwardConns,
+		m.ForwardConnsOpenedTotal,
+		m.ForwardCircuitOpenedTotal,
+		m.ForwardRejectedTotal,
+		m.ForwardHedgedTotal,
+		m.ForwardProbeFailuresTotal,
+		m.RequestLatency,
+		m.InflightRequests,
+		m.ShedRequestsTotal,
+		m.TCPConns,
+		m.TCPConnsRejectedTotal,
+	)
+}
+
+// countersFor returns the inbound and outbound byte counters for the given
+// endpoint and protocol.
+func (m *Metrics) countersFor(
+	endpointID string,
+	protocol string,
+) (prometheus.Counter, prometheus.Counter) {
+	labels := prometheus.Labels{
+		"endpoint_id": endpointID,
+		"protocol":    protocol,
+	}
+	return m.BytesInTotal.With(labels), m.BytesOutTotal.With(labels)
+}
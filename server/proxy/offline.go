@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+)
+
+const (
+	offlineContentType  = "text/html; charset=utf-8"
+	offlineCacheControl = "no-store"
+
+	// offlineIndex is the file served from an offline directory when the
+	// requested file doesn't exist.
+	offlineIndex = "index.html"
+)
+
+// offlineData is the data offline templates are rendered with.
+type offlineData struct {
+	EndpointID string
+}
+
+type offlineTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+type offlineEndpoint struct {
+	conf config.OfflineEndpointConfig
+
+	// body is the parsed body template, or nil if serving a directory.
+	body offlineTemplate
+}
+
+// offlinePages serves static content, such as a branded 'service offline'
+// page, for endpoints with no upstreams instead of an error.
+type offlinePages struct {
+	endpoints map[string]*offlineEndpoint
+
+	logger log.Logger
+}
+
+// newOfflinePages returns the offline pages for the configured endpoints.
+// The configuration must be validated.
+func newOfflinePages(conf config.OfflineConfig, logger log.Logger) *offlinePages {
+	endpoints := make(map[string]*offlineEndpoint, len(conf.Endpoints))
+	for _, endpointConf := range conf.Endpoints {
+		endpoint := &offlineEndpoint{
+			conf: endpointConf,
+		}
+		if endpointConf.Body != "" {
+			// The body was validated so can't fail to parse.
+			endpoint.body, _ = parseOfflineTemplate(
+				endpointConf.ID, endpointConf.Body, endpoint.contentType(),
+			)
+		}
+		endpoints[endpointConf.ID] = endpoint
+	}
+	return &offlinePages{
+		endpoints: endpoints,
+		logger:    logger,
+	}
+}
+
+// Serve writes the offline content for the endpoint. Returns false without
+// writing a response if the endpoint has no offline content, or the content
+// couldn't be rendered.
+func (p *offlinePages) Serve(
+	w http.ResponseWriter,
+	r *http.Request,
+	endpointID string,
+) bool {
+	endpoint, ok := p.endpoints[endpointID]
+	if !ok {
+		return false
+	}
+
+	if endpoint.conf.Dir != "" && p.serveFile(w, r, endpoint) {
+		return true
+	}
+
+	body, err := p.render(endpoint, endpointID)
+	if err != nil {
+		p.logger.Warn(
+			"failed to render offline content",
+			zap.String("endpoint-id", endpointID),
+			zap.Error(err),
+		)
+		return false
+	}
+
+	w.Header().Set("Content-Type", endpoint.contentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", endpoint.cacheControl())
+	w.WriteHeader(endpoint.conf.StatusCode())
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+	return true
+}
+
+// serveFile serves the requested file from the endpoint directory, such as
+// images and stylesheets referenced by the offline page. Returns false if
+// the file doesn't exist.
+func (p *offlinePages) serveFile(
+	w http.ResponseWriter,
+	r *http.Request,
+	endpoint *offlineEndpoint,
+) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if name == "/" || name == "/"+offlineIndex {
+		return false
+	}
+
+	// http.Dir prevents opening files outside the directory.
+	f, err := http.Dir(endpoint.conf.Dir).Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+
+	w.Header().Set("Cache-Control", endpoint.cacheControl())
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return true
+}
+
+// render renders the offline page for the endpoint.
+func (p *offlinePages) render(
+	endpoint *offlineEndpoint,
+	endpointID string,
+) ([]byte, error) {
+	tmpl := endpoint.body
+	if tmpl == nil {
+		// Read the index on each request so the page can be updated without
+		// restarting the server.
+		b, err := os.ReadFile(filepath.Join(endpoint.conf.Dir, offlineIndex))
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err = parseOfflineTemplate(
+			endpoint.conf.ID, string(b), offlineContentType,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, offlineData{
+		EndpointID: endpointID,
+	}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *offlineEndpoint) contentType() string {
+	if e.conf.Dir != "" || e.conf.ContentType == "" {
+		return offlineContentType
+	}
+	return e.conf.ContentType
+}
+
+func (e *offlineEndpoint) cacheControl() string {
+	if e.conf.CacheControl == "" {
+		return offlineCacheControl
+	}
+	return e.conf.CacheControl
+}
+
+// parseOfflineTemplate parses the template of an offline page. HTML pages
+// escape the rendered values.
+func parseOfflineTemplate(
+	name string,
+	text string,
+	contentType string,
+) (offlineTemplate, error) {
+	if strings.Contains(contentType, "html") {
+		return htmltemplate.New(name).Parse(text)
+	}
+	return texttemplate.New(name).Parse(text)
+}
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func newOfflineProxy(conf config.OfflineConfig) *HTTPProxy {
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return nil, false
+			},
+		},
+		time.Second,
+		config.RetryConfig{},
+		config.FailoverConfig{},
+		config.HeadersConfig{},
+		config.ForwardConfig{},
+		nil,
+		nil,
+		nil,
+		NewMetrics(),
+		log.NewNopLogger(),
+	)
+	proxy.offline = newOfflinePages(conf, log.NewNopLogger())
+	return proxy
+}
+
+func TestHTTPProxy_Offline(t *testing.T) {
+	t.Run("body", func(t *testing.T) {
+		proxy := newOfflineProxy(config.OfflineConfig{
+			Endpoints: []config.OfflineEndpointConfig{
+				{
+					ID:   "my-endpoint",
+					Body: "<h1>{{.EndpointID}} is offline</h1>",
+				},
+			},
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "<h1>my-endpoint is offline</h1>", string(body))
+	})
+
+	t.Run("body custom", func(t *testing.T) {
+		proxy := newOfflineProxy(config.OfflineConfig{
+			Endpoints: []config.OfflineEndpointConfig{
+				{
+					ID:           "my-endpoint",
+					Body:         `{"offline":"{{.EndpointID}}"}`,
+					Status:       http.StatusOK,
+					ContentType:  "application/json",
+					CacheControl: "max-age=60",
+				},
+			},
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "max-age=60", resp.Header.Get("Cache-Control"))
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"offline":"my-endpoint"}`, string(body))
+	})
+
+	t.Run("dir", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(
+			filepath.Join(dir, "index.html"),
+			[]byte(`<link href="/style.css">{{.EndpointID}} is offline`),
+			0o600,
+		))
+		require.NoError(t, os.WriteFile(
+			filepath.Join(dir, "style.css"),
+			[]byte("h1 {}"),
+			0o600,
+		))
+
+		proxy := newOfflineProxy(config.OfflineConfig{
+			Endpoints: []config.OfflineEndpointConfig{
+				{
+					ID:  "my-endpoint",
+					Dir: dir,
+				},
+			},
+		})
+
+		// Requests for files that don't exist serve the index.
+		r := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `<link href="/style.css">my-endpoint is offline`, string(body))
+
+		// Requests for files that exist serve the file.
+		r = httptest.NewRequest(http.MethodGet, "/style.css", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w = httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp = w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+		body, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "h1 {}", string(body))
+
+		// Requests can't escape the directory.
+		r = httptest.NewRequest(http.MethodGet, "/../../etc/passwd", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w = httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp = w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	})
+
+	t.Run("dir missing index", func(t *testing.T) {
+		proxy := newOfflineProxy(config.OfflineConfig{
+			Endpoints: []config.OfflineEndpointConfig{
+				{
+					ID:  "my-endpoint",
+					Dir: t.TempDir(),
+				},
+			},
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		// Falls back to the error response.
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+
+	t.Run("no offline content", func(t *testing.T) {
+		proxy := newOfflineProxy(config.OfflineConfig{
+			Endpoints: []config.OfflineEndpointConfig{
+				{
+					ID:   "my-endpoint",
+					Body: "offline",
+				},
+			},
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "another-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "no available upstreams", m.Error)
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		proxy := newOfflineProxy(config.OfflineConfig{
+			Endpoints: []config.OfflineEndpointConfig{
+				{
+					ID:   "my-endpoint",
+					Body: "offline",
+				},
+			},
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-piko-forward", "true")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		// The node that forwarded the request serves the offline content.
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, "true", resp.Header.Get(missHeader))
+	})
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+const (
+	// healthPath is the path other nodes probe to check the node can be
+	// reached.
+	healthPath = "/_piko/v1/health"
+)
+
+// nodeProber periodically probes the other active nodes in the cluster, and
+// marks nodes that can't be reached as unforwardable, so requests are routed
+// to other nodes rather than discovering the node is down by failing a
+// request.
+type nodeProber struct {
+	state     *cluster.State
+	transport *nodeTransport
+	conf      config.HealthCheckConfig
+
+	// failures contains the number of consecutive failed probes to each
+	// node.
+	failures map[string]int
+
+	metrics *Metrics
+
+	logger log.Logger
+}
+
+func newNodeProber(
+	state *cluster.State,
+	transport *nodeTransport,
+	conf config.HealthCheckConfig,
+	metrics *Metrics,
+	logger log.Logger,
+) *nodeProber {
+	return &nodeProber{
+		state:     state,
+		transport: transport,
+		conf:      conf,
+		failures:  make(map[string]int),
+		metrics:   metrics,
+		logger:    logger,
+	}
+}
+
+// Run probes the nodes every interval until the context is cancelled.
+func (p *nodeProber) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.conf.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.ProbeAll(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ProbeAll probes each active remote node concurrently, and updates whether
+// the nodes are forwardable.
+func (p *nodeProber) ProbeAll(ctx context.Context) {
+	var nodes []*cluster.Node
+	for _, node := range p.state.Nodes() {
+		if node.ID == p.state.LocalID() || node.Status != cluster.NodeStatusActive {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			probeCtx, cancel := context.WithTimeout(ctx, p.conf.Timeout)
+			defer cancel()
+			errs[i] = p.transport.Probe(probeCtx, node)
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		// Ignore probes cancelled by shutdown.
+		return
+	}
+
+	probed := make(map[string]struct{}, len(nodes))
+	for i, node := range nodes {
+		probed[node.ID] = struct{}{}
+		p.observe(node.ID, errs[i])
+	}
+	// Discard the failures of nodes that have left or are no longer active.
+	for nodeID := range p.failures {
+		if _, ok := probed[nodeID]; !ok {
+			delete(p.failures, nodeID)
+		}
+	}
+}
+
+func (p *nodeProber) observe(nodeID string, err error) {
+	if err == nil {
+		if p.failures[nodeID] >= p.conf.Threshold {
+			p.logger.Info(
+				"node health check recovered",
+				zap.String("node-id", nodeID),
+			)
+		}
+		delete(p.failures, nodeID)
+		p.state.SetForwardable(nodeID, true)
+		return
+	}
+
+	p.metrics.ForwardProbeFailuresTotal.WithLabelValues(nodeID).Inc()
+
+	p.failures[nodeID]++
+	if p.failures[nodeID] == p.conf.Threshold {
+		p.logger.Warn(
+			"node health check failed; stopped forwarding to node",
+			zap.String("node-id", nodeID),
+			zap.Error(err),
+		)
+		p.state.SetForwardable(nodeID, false)
+	}
+}
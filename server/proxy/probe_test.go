@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+// newProbedNode starts a proxy server that requires authentication, to check
+// probes bypass authentication.
+func newProbedNode(t *testing.T, ln net.Listener) *Server {
+	server := NewServer(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return nil, false
+			},
+		},
+		config.ProxyConfig{},
+		nil,
+		&fakeVerifier{
+			tokens: map[string]auth.EndpointToken{},
+		},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	go func() {
+		assert.NoError(t, server.Serve(ln))
+	}()
+	return server
+}
+
+func TestNodeProber(t *testing.T) {
+	healthyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	healthy := newProbedNode(t, healthyLn)
+	defer healthy.Shutdown(context.TODO())
+
+	// Get an address with nothing listening.
+	unhealthyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unhealthyAddr := unhealthyLn.Addr().String()
+	unhealthyLn.Close()
+
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	state.AddNode(&cluster.Node{
+		ID:        "healthy",
+		ProxyAddr: healthyLn.Addr().String(),
+		Status:    cluster.NodeStatusActive,
+	})
+	state.UpdateRemoteEndpoint("healthy", "my-endpoint", 1)
+	state.AddNode(&cluster.Node{
+		ID:        "unhealthy",
+		ProxyAddr: unhealthyAddr,
+		Status:    cluster.NodeStatusActive,
+	})
+	state.UpdateRemoteEndpoint("unhealthy", "my-endpoint", 1)
+
+	metrics := NewMetrics()
+	transport := newNodeTransport(config.ForwardConfig{}, nil, metrics)
+	defer transport.Close()
+
+	prober := newNodeProber(state, transport, config.HealthCheckConfig{
+		Interval:  time.Second,
+		Timeout:   time.Second,
+		Threshold: 2,
+	}, metrics, log.NewNopLogger())
+
+	// The node is still forwardable until the threshold is reached.
+	prober.ProbeAll(context.TODO())
+	assert.True(t, state.Forwardable("unhealthy"))
+	assert.Len(t, state.EndpointNodes("my-endpoint"), 2)
+
+	prober.ProbeAll(context.TODO())
+	assert.True(t, state.Forwardable("healthy"))
+	assert.False(t, state.Forwardable("unhealthy"))
+	nodes := state.EndpointNodes("my-endpoint")
+	require.Len(t, nodes, 1)
+	assert.Equal(t, "healthy", nodes[0].ID)
+
+	assert.Equal(t, 0.0, testutil.ToFloat64(
+		metrics.ForwardProbeFailuresTotal.WithLabelValues("healthy"),
+	))
+	assert.Equal(t, 2.0, testutil.ToFloat64(
+		metrics.ForwardProbeFailuresTotal.WithLabelValues("unhealthy"),
+	))
+
+	// Once the node can be reached it's forwardable again.
+	recoveredLn, err := net.Listen("tcp", unhealthyAddr)
+	require.NoError(t, err)
+	recovered := newProbedNode(t, recoveredLn)
+	defer recovered.Shutdown(context.TODO())
+
+	prober.ProbeAll(context.TODO())
+	assert.True(t, state.Forwardable("unhealthy"))
+	assert.Len(t, state.EndpointNodes("my-endpoint"), 2)
+}
+
+func TestServer_Health(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := newProbedNode(t, ln)
+	defer server.Shutdown(context.TODO())
+
+	// The health route doesn't require authentication.
+	resp, err := http.Head("http://" + ln.Addr().String() + healthPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
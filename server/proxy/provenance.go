@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"hash"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/provenance"
+)
+
+// addProvenanceNonce adds a random nonce to a request from a client to an
+// endpoint whose responses must be signed, which the agent includes in the
+// signature so a signed response can't be replayed for another request.
+//
+// Returns the request unchanged if the endpoint's responses aren't verified.
+func (p *HTTPProxy) addProvenanceNonce(
+	r *http.Request,
+	endpointID string,
+) *http.Request {
+	if _, ok := p.provenance[endpointID]; !ok {
+		return r
+	}
+
+	nonce := provenance.NewNonce()
+	r.Header.Set(provenance.NonceHeader, nonce)
+	if r.Header.Get("Accept-Encoding") == "" {
+		// Otherwise the transport requests a compressed response and
+		// decompresses it, so the body and headers wouldn't match the
+		// signed response.
+		r.Header.Set("Accept-Encoding", "identity")
+	}
+	return r.WithContext(
+		context.WithValue(r.Context(), provenanceContextKey, nonce),
+	)
+}
+
+// verifyProvenance verifies the response was signed by an agent for the
+// endpoint, if the request has a nonce added by this node.
+//
+// The status and headers are verified before the response is returned. The
+// body is verified once it has been read, so if the body doesn't match the
+// signature, the response is aborted after the body is written to the
+// client.
+//
+// Only the node that received the request from the client verifies the
+// response, since it's the node that generated the nonce.
+func (p *HTTPProxy) verifyProvenance(resp *http.Response) error {
+	ctx := resp.Request.Context()
+	nonce, ok := ctx.Value(provenanceContextKey).(string)
+	if !ok {
+		return nil
+	}
+	endpointID := ctx.Value(endpointContextKey).(string)
+	key := p.provenance[endpointID]
+
+	signature := resp.Header.Get(provenance.SignatureHeader)
+	bodySignature := resp.Header.Get(provenance.BodySignatureHeader)
+	// Don't return the signatures to the client.
+	resp.Header.Del(provenance.SignatureHeader)
+	resp.Header.Del(provenance.BodySignatureHeader)
+	resp.Trailer.Del(provenance.BodySignatureHeader)
+
+	if !provenance.Verify(
+		key, endpointID, nonce, resp.StatusCode, resp.Header, signature,
+	) {
+		p.provenanceFailed(endpointID, "invalid signature", signature != "")
+		return errProvenance
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The connection is upgraded so there is no body to verify.
+		return nil
+	}
+	resp.Body = &provenanceBody{
+		ReadCloser:      resp.Body,
+		resp:            resp,
+		hash:            provenance.NewBodyHash(),
+		key:             key,
+		endpointID:      endpointID,
+		nonce:           nonce,
+		headerSignature: bodySignature,
+		proxy:           p,
+	}
+	return nil
+}
+
+func (p *HTTPProxy) provenanceFailed(endpointID string, reason string, signed bool) {
+	p.logger.Warn(
+		"invalid response provenance",
+		zap.String("endpoint-id", endpointID),
+		zap.String("reason", reason),
+		zap.Bool("signed", signed),
+	)
+	p.metrics.ProvenanceFailuresTotal.WithLabelValues(endpointID).Inc()
+}
+
+// provenanceBody verifies the signature of a response body once the body has
+// been read.
+//
+// If the signature is invalid, the final read returns errProvenance, which
+// aborts the response to the client.
+type provenanceBody struct {
+	io.ReadCloser
+
+	resp *http.Response
+	hash hash.Hash
+
+	key        ed25519.PublicKey
+	endpointID string
+	nonce      string
+
+	// headerSignature is the body signature header, which is used when the
+	// response has no body so the signature isn't sent as a trailer.
+	headerSignature string
+
+	proxy *HTTPProxy
+
+	// verified indicates whether the body has been verified, and err is the
+	// result of the verification.
+	verified bool
+	err      error
+}
+
+func (b *provenanceBody) Read(p []byte) (int, error) {
+	if b.verified {
+		return 0, b.err
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+	b.verified = true
+
+	// Trailers are added to the response once the body has been read.
+	signature := b.resp.Trailer.Get(provenance.BodySignatureHeader)
+	b.resp.Trailer.Del(provenance.BodySignatureHeader)
+	if signature == "" {
+		signature = b.headerSignature
+	}
+	if !provenance.VerifyBody(
+		b.key, b.endpointID, b.nonce, b.hash.Sum(nil), signature,
+	) {
+		b.proxy.provenanceFailed(b.endpointID, "invalid body signature", signature != "")
+		b.err = errProvenance
+		return n, b.err
+	}
+	b.err = io.EOF
+	return n, b.err
+}
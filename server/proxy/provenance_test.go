@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/provenance"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func TestHTTPProxy_Provenance(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	newProxy := func(handler http.HandlerFunc) *HTTPProxy {
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(string, bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			time.Second,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+		proxy.provenance = map[string]ed25519.PublicKey{
+			"my-endpoint": publicKey,
+		}
+		return proxy
+	}
+
+	// sign signs responses like the agent, though writes the given body
+	// rather than the signed body.
+	sign := func(
+		key ed25519.PrivateKey,
+		status int,
+		signedBody string,
+		body string,
+	) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			nonce := r.Header.Get(provenance.NonceHeader)
+			if nonce == "" {
+				w.WriteHeader(status)
+				_, _ = w.Write([]byte(body))
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set(provenance.SignatureHeader, provenance.Sign(
+				key, "my-endpoint", nonce, status, w.Header(),
+			))
+			w.Header().Set("Trailer", provenance.BodySignatureHeader)
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+
+			digest := provenance.NewBodyHash()
+			digest.Write([]byte(signedBody))
+			w.Header().Set(provenance.BodySignatureHeader, provenance.SignBody(
+				key, "my-endpoint", nonce, digest.Sum(nil),
+			))
+		}
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		proxy := newProxy(sign(privateKey, http.StatusOK, "foo", "foo"))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "foo", w.Body.String())
+		// The signatures aren't returned to the client.
+		assert.Equal(t, "", resp.Header.Get(provenance.SignatureHeader))
+		assert.Equal(t, "", resp.Trailer.Get(provenance.BodySignatureHeader))
+		assert.Equal(t, 0.0, testutil.ToFloat64(
+			proxy.metrics.ProvenanceFailuresTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		proxy := newProxy(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			proxy.metrics.ProvenanceFailuresTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		proxy := newProxy(sign(otherKey, http.StatusOK, "foo", "foo"))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+
+	t.Run("tampered headers", func(t *testing.T) {
+		proxy := newProxy(func(w http.ResponseWriter, r *http.Request) {
+			nonce := r.Header.Get(provenance.NonceHeader)
+			w.Header().Set(provenance.SignatureHeader, provenance.Sign(
+				privateKey, "my-endpoint", nonce, http.StatusOK, http.Header{},
+			))
+			// Inject a header after the response was signed.
+			w.Header().Set("Location", "https://example.com")
+			w.WriteHeader(http.StatusOK)
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+		assert.Equal(t, "", w.Header().Get("Location"))
+	})
+
+	t.Run("tampered body", func(t *testing.T) {
+		// The status and headers are signed but the body was replaced, such
+		// as by a node relaying the response from the agent.
+		proxy := newProxy(sign(privateKey, http.StatusOK, "foo", "injected"))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		// The response is aborted, so the trailers are never written.
+		assert.Equal(t, "", resp.Trailer.Get(provenance.BodySignatureHeader))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			proxy.metrics.ProvenanceFailuresTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		signature := provenance.Sign(
+			privateKey, "my-endpoint", provenance.NewNonce(), http.StatusOK, nil,
+		)
+		proxy := newProxy(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set(provenance.SignatureHeader, signature)
+			w.WriteHeader(http.StatusOK)
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+
+	t.Run("endpoint not verified", func(t *testing.T) {
+		proxy := newProxy(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "", r.Header.Get(provenance.NonceHeader))
+			w.WriteHeader(http.StatusOK)
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "other-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		// Requests forwarded from another node are verified by that node, so
+		// the nonce is passed to the agent and the signatures returned.
+		proxy := newProxy(sign(privateKey, http.StatusOK, "foo", "foo"))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		r.Header.Set("x-piko-forward", "true")
+		r.Header.Set(provenance.NonceHeader, "my-nonce")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.True(t, provenance.Verify(
+			publicKey,
+			"my-endpoint",
+			"my-nonce",
+			http.StatusOK,
+			resp.Header,
+			resp.Header.Get(provenance.SignatureHeader),
+		))
+
+		digest := provenance.NewBodyHash()
+		digest.Write([]byte("foo"))
+		assert.True(t, provenance.VerifyBody(
+			publicKey,
+			"my-endpoint",
+			"my-nonce",
+			digest.Sum(nil),
+			resp.Trailer.Get(provenance.BodySignatureHeader),
+		))
+	})
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+const (
+	// retriesHeader overrides the configured number of retries for a
+	// request.
+	retriesHeader = "x-piko-retries"
+
+	// missHeader is set by a node responding to a forwarded request that it
+	// has no upstream for the endpoint, so the forwarding node knows it can
+	// retry.
+	missHeader = "x-piko-upstream-miss"
+
+	// affinityKeyHeader contains the key used to select an upstream when
+	// forwarding a connection with affinity to another node, so the node
+	// selects the upstream using the client's key rather than the address
+	// of the forwarding node.
+	affinityKeyHeader = "x-piko-affinity-key"
+
+	// maxRetries is the maximum number of retries a client can request with
+	// the retries header.
+	maxRetries = 10
+)
+
+// retry selects an upstream for a single request, retrying with backoff
+// when there is no connected upstream for the endpoint.
+type retry struct {
+	upstreams    upstream.Manager
+	endpointID   string
+	allowForward bool
+
+	// fallback is the endpoint to fail over to if no upstream is found for
+	// the endpoint, or empty if the endpoint has no fallback.
+	fallback string
+	// failedOver indicates whether the retry failed over to the fallback
+	// endpoint, in which case endpointID is the fallback endpoint.
+	failedOver bool
+
+	// affinityKey is the key to consistently select the same upstream, or
+	// empty to load balance among upstreams.
+	affinityKey string
+
+	retries    int
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	// missed indicates whether the first attempt to find an upstream failed.
+	missed bool
+	// done indicates whether the result of the retries has been recorded.
+	done bool
+
+	metrics *Metrics
+}
+
+func newRetry(
+	r *http.Request,
+	endpointID string,
+	upstreams upstream.Manager,
+	conf config.RetryConfig,
+	metrics *Metrics,
+) *retry {
+	// Whether the request was forwarded from another Piko node.
+	forwarded := r.Header.Get("x-piko-forward") == "true"
+
+	retries := conf.Retries
+	if forwarded {
+		// The node that forwarded the request is responsible for retrying,
+		// so the retries aren't multiplied across hops.
+		retries = 0
+	} else if s := r.Header.Get(retriesHeader); s != "" {
+		n, err := strconv.Atoi(s)
+		if err == nil && n >= 0 {
+			retries = min(n, maxRetries)
+		}
+	}
+
+	return &retry{
+		upstreams:  upstreams,
+		endpointID: endpointID,
+		// We don't allow multiple hops, so if forwarded is true we only
+		// select from local nodes.
+		allowForward: !forwarded,
+		retries:      retries,
+		backoff:      conf.Backoff,
+		maxBackoff:   conf.MaxBackoff,
+		metrics:      metrics,
+	}
+}
+
+// Select returns an upstream for the endpoint, retrying until an upstream is
+// found or the retries are exhausted.
+//
+// Note this includes remote nodes that are reporting they have an available
+// upstream.
+func (r *retry) Select(ctx context.Context) (upstream.Upstream, bool) {
+	for {
+		u, ok := r.selectOnce()
+		if !ok && !r.missed && r.upstreams.Hold(ctx, r.endpointID) {
+			// If the endpoint's upstream recently disconnected, wait for it
+			// to reconnect.
+			u, ok = r.selectOnce()
+		}
+		if !ok && r.upstreams.Queue(ctx, r.endpointID) {
+			// If all local upstreams are at their stream limit, wait for
+			// one to have capacity.
+			u, ok = r.selectOnce()
+		}
+		if ok {
+			// If the upstream is a remote node, the request may still miss
+			// so the result is recorded once the node responds.
+			if !u.Forward() {
+				r.finish(true)
+			}
+			return u, true
+		}
+
+		if !r.wait(ctx) {
+			return r.failover(ctx)
+		}
+	}
+}
+
+// failover selects an upstream for the fallback endpoint, once no upstream
+// was found for the endpoint after retrying. Returns false if the endpoint
+// has no fallback, or the fallback has no upstreams either.
+//
+// Only the node that received the request fails over, so a node a request
+// was forwarded to lets the forwarding node know it had no upstream instead.
+func (r *retry) failover(ctx context.Context) (upstream.Upstream, bool) {
+	if r.fallback == "" || r.failedOver || !r.allowForward || ctx.Err() != nil {
+		return nil, false
+	}
+	r.metrics.FailoversTotal.WithLabelValues(r.endpointID).Inc()
+
+	r.failedOver = true
+	r.endpointID = r.fallback
+	return r.selectOnce()
+}
+
+func (r *retry) selectOnce() (upstream.Upstream, bool) {
+	if r.affinityKey != "" {
+		return r.upstreams.SelectAffinity(r.endpointID, r.affinityKey, r.allowForward)
+	}
+	return r.upstreams.Select(r.endpointID, r.allowForward)
+}
+
+// wait records an upstream miss and waits for the backoff before the next
+// retry. Returns false if there are no retries remaining or the context is
+// cancelled.
+func (r *retry) wait(ctx context.Context) bool {
+	r.miss()
+
+	if r.attempts >= r.retries {
+		r.finish(false)
+		return false
+	}
+
+	backoff := r.backoff
+	for i := 0; i != r.attempts && backoff < r.maxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, r.maxBackoff)
+	r.attempts++
+
+	select {
+	case <-time.After(backoff):
+		return true
+	case <-ctx.Done():
+		r.finish(false)
+		return false
+	}
+}
+
+// miss records that the first attempt to find an upstream failed.
+func (r *retry) miss() {
+	if !r.missed {
+		r.missed = true
+		r.metrics.UpstreamMissesTotal.Inc()
+	}
+}
+
+// finish records the result of the request if it was retried.
+func (r *retry) finish(succeeded bool) {
+	if r.done || r.attempts == 0 {
+		return
+	}
+	r.done = true
+
+	if succeeded {
+		r.metrics.RetriesTotal.WithLabelValues("succeeded").Inc()
+	} else {
+		r.metrics.RetriesTotal.WithLabelValues("failed").Inc()
+	}
+}
+
+// retryTransport retries requests forwarded to a remote node when that node
+// responds it has no upstream for the endpoint, such as when the cluster
+// state is stale during a rolling restart.
+//
+// Only requests without a body are retried, since the request body may have
+// already been consumed.
+type retryTransport struct {
+	transport http.RoundTripper
+	headers   *headerPolicy
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := t.transport.RoundTrip(req)
+		rt, ok := req.Context().Value(retryContextKey).(*retry)
+		if !ok {
+			return resp, err
+		}
+		if err != nil {
+			// The upstream was found, so the retries succeeded even though
+			// the request itself failed.
+			rt.finish(true)
+			return nil, err
+		}
+		if resp.Header.Get(missHeader) != "true" {
+			rt.finish(true)
+			return resp, nil
+		}
+		resp.Header.Del(missHeader)
+
+		if req.Body != nil && req.Body != http.NoBody {
+			rt.miss()
+			rt.finish(false)
+			return resp, nil
+		}
+
+		var u upstream.Upstream
+		if rt.wait(req.Context()) {
+			u, ok = rt.Select(req.Context())
+		} else {
+			u, ok = rt.failover(req.Context())
+		}
+		if !ok {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		ctx := context.WithValue(req.Context(), upstreamContextKey, u)
+		ctx = context.WithValue(ctx, startContextKey, time.Now())
+		req = req.Clone(ctx)
+		if rt.failedOver {
+			// Route the request to the fallback endpoint if it's forwarded
+			// to another node.
+			req.Header.Set("x-piko-endpoint", rt.endpointID)
+		}
+		if !u.Forward() {
+			t.headers.RemoveUpstream(req)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func TestRetry(t *testing.T) {
+	conf := config.RetryConfig{
+		Retries:    3,
+		Backoff:    time.Millisecond,
+		MaxBackoff: time.Millisecond * 5,
+	}
+
+	t.Run("retry succeeded", func(t *testing.T) {
+		attempts := 0
+		manager := &fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				attempts++
+				if attempts < 3 {
+					return nil, false
+				}
+				return &tcpUpstream{}, true
+			},
+		}
+
+		metrics := NewMetrics()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		retry := newRetry(r, "my-endpoint", manager, conf, metrics)
+
+		_, ok := retry.Select(r.Context())
+		assert.True(t, ok)
+		assert.Equal(t, 3, attempts)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.UpstreamMissesTotal))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.RetriesTotal.WithLabelValues("succeeded"),
+		))
+		assert.Equal(t, 0.0, testutil.ToFloat64(
+			metrics.RetriesTotal.WithLabelValues("failed"),
+		))
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		attempts := 0
+		manager := &fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				attempts++
+				return nil, false
+			},
+		}
+
+		metrics := NewMetrics()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		retry := newRetry(r, "my-endpoint", manager, conf, metrics)
+
+		_, ok := retry.Select(r.Context())
+		assert.False(t, ok)
+		// The first attempt plus 3 retries.
+		assert.Equal(t, 4, attempts)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.UpstreamMissesTotal))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.RetriesTotal.WithLabelValues("failed"),
+		))
+	})
+
+	t.Run("queued", func(t *testing.T) {
+		queued := false
+		manager := &fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				if !queued {
+					return nil, false
+				}
+				return &tcpUpstream{}, true
+			},
+			queueHandler: func(endpointID string) bool {
+				assert.Equal(t, "my-endpoint", endpointID)
+				queued = true
+				return true
+			},
+		}
+
+		metrics := NewMetrics()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		retry := newRetry(r, "my-endpoint", manager, config.RetryConfig{}, metrics)
+
+		// Selects an upstream once queued, without retrying.
+		_, ok := retry.Select(r.Context())
+		assert.True(t, ok)
+		assert.True(t, queued)
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.UpstreamMissesTotal))
+	})
+
+	t.Run("first attempt succeeded", func(t *testing.T) {
+		manager := &fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{}, true
+			},
+		}
+
+		metrics := NewMetrics()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		retry := newRetry(r, "my-endpoint", manager, conf, metrics)
+
+		_, ok := retry.Select(r.Context())
+		assert.True(t, ok)
+
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.UpstreamMissesTotal))
+		assert.Equal(t, 0.0, testutil.ToFloat64(
+			metrics.RetriesTotal.WithLabelValues("succeeded"),
+		))
+	})
+
+	t.Run("header override", func(t *testing.T) {
+		attempts := 0
+		manager := &fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				attempts++
+				return nil, false
+			},
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-retries", "1")
+		retry := newRetry(r, "my-endpoint", manager, conf, NewMetrics())
+
+		_, ok := retry.Select(r.Context())
+		assert.False(t, ok)
+		assert.Equal(t, 2, attempts)
+
+		// The override is limited to the maximum retries.
+		r.Header.Set("x-piko-retries", "1000")
+		retry = newRetry(r, "my-endpoint", manager, conf, NewMetrics())
+		assert.Equal(t, maxRetries, retry.retries)
+
+		// Invalid overrides are ignored.
+		r.Header.Set("x-piko-retries", "foo")
+		retry = newRetry(r, "my-endpoint", manager, conf, NewMetrics())
+		assert.Equal(t, 3, retry.retries)
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		var endpoints []string
+		manager := &fakeManager{
+			handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+				endpoints = append(endpoints, endpointID)
+				return &tcpUpstream{}, endpointID == "fallback"
+			},
+		}
+
+		metrics := NewMetrics()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		retry := newRetry(r, "my-endpoint", manager, conf, metrics)
+		retry.fallback = "fallback"
+
+		_, ok := retry.Select(r.Context())
+		assert.True(t, ok)
+		assert.True(t, retry.failedOver)
+		assert.Equal(t, "fallback", retry.endpointID)
+		// The endpoint is retried before failing over.
+		assert.Equal(t, []string{
+			"my-endpoint", "my-endpoint", "my-endpoint", "my-endpoint", "fallback",
+		}, endpoints)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.FailoversTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("forwarded no failover", func(t *testing.T) {
+		manager := &fakeManager{
+			handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+				assert.Equal(t, "my-endpoint", endpointID)
+				return nil, false
+			},
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-forward", "true")
+		retry := newRetry(r, "my-endpoint", manager, conf, NewMetrics())
+		retry.fallback = "fallback"
+
+		_, ok := retry.Select(r.Context())
+		assert.False(t, ok)
+		assert.False(t, retry.failedOver)
+	})
+
+	t.Run("forwarded not retried", func(t *testing.T) {
+		attempts := 0
+		manager := &fakeManager{
+			handler: func(_ string, allowForward bool) (upstream.Upstream, bool) {
+				assert.False(t, allowForward)
+				attempts++
+				return nil, false
+			},
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-forward", "true")
+		r.Header.Set("x-piko-retries", "5")
+		retry := newRetry(r, "my-endpoint", manager, conf, NewMetrics())
+
+		_, ok := retry.Select(r.Context())
+		assert.False(t, ok)
+		assert.Equal(t, 1, attempts)
+	})
+}
+
+func TestHTTPProxy_RetryRemoteMiss(t *testing.T) {
+	// The remote node responds that it no longer has an upstream.
+	remote := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("x-piko-upstream-miss", "true")
+			_ = errorResponse(w, http.StatusBadGateway, "no available upstreams")
+		},
+	))
+	defer remote.Close()
+
+	local := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Proxy headers are removed before forwarding to the upstream.
+			assert.Equal(t, "", r.Header.Get("x-piko-retries"))
+
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer local.Close()
+
+	t.Run("retry succeeded", func(t *testing.T) {
+		attempts := 0
+		metrics := NewMetrics()
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					attempts++
+					if attempts == 1 {
+						return &tcpUpstream{
+							addr:    remote.Listener.Addr().String(),
+							forward: true,
+						}, true
+					}
+					return &tcpUpstream{
+						addr: local.Listener.Addr().String(),
+					}, true
+				},
+			},
+			time.Second,
+			config.RetryConfig{
+				Retries:    1,
+				Backoff:    time.Millisecond,
+				MaxBackoff: time.Millisecond,
+			},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			metrics,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-piko-retries", "1")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 2, attempts)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.UpstreamMissesTotal))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.RetriesTotal.WithLabelValues("succeeded"),
+		))
+	})
+
+	t.Run("request with body not retried", func(t *testing.T) {
+		attempts := 0
+		metrics := NewMetrics()
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					attempts++
+					return &tcpUpstream{
+						addr:    remote.Listener.Addr().String(),
+						forward: true,
+					}, true
+				},
+			},
+			time.Second,
+			config.RetryConfig{
+				Retries:    1,
+				Backoff:    time.Millisecond,
+				MaxBackoff: time.Millisecond,
+			},
+			config.FailoverConfig{},
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			metrics,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("foo"))
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("x-piko-upstream-miss"))
+		assert.Equal(t, 1, attempts)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.UpstreamMissesTotal))
+	})
+}
+
+func TestHTTPProxy_Failover(t *testing.T) {
+	failover := config.FailoverConfig{
+		Endpoints: []config.FailoverEndpointConfig{
+			{ID: "my-endpoint", Fallback: "maintenance"},
+		},
+	}
+
+	t.Run("local fallback", func(t *testing.T) {
+		fallback := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "maintenance", r.Header.Get("x-piko-endpoint"))
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		))
+		defer fallback.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+					if endpointID != "maintenance" {
+						return nil, false
+					}
+					return &tcpUpstream{
+						addr: fallback.Listener.Addr().String(),
+					}, true
+				},
+			},
+			time.Second,
+			config.RetryConfig{},
+			failover,
+			// Forward the endpoint header to check the request was routed
+			// to the fallback.
+			config.HeadersConfig{Upstream: []string{"x-piko-endpoint"}},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	})
+
+	t.Run("remote miss", func(t *testing.T) {
+		// The remote node responds that it no longer has an upstream for
+		// the endpoint, though has an upstream for the fallback.
+		remote := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("x-piko-endpoint") != "maintenance" {
+					w.Header().Set("x-piko-upstream-miss", "true")
+					_ = errorResponse(w, http.StatusBadGateway, "no available upstreams")
+					return
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		))
+		defer remote.Close()
+
+		metrics := NewMetrics()
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr:    remote.Listener.Addr().String(),
+						forward: true,
+					}, true
+				},
+			},
+			time.Second,
+			config.RetryConfig{},
+			failover,
+			config.HeadersConfig{},
+			config.ForwardConfig{},
+			nil,
+			nil,
+			nil,
+			metrics,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.FailoversTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+}
@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -9,12 +11,21 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/server/audit"
+	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/capture"
+	"github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/plugin"
 	"github.com/andydunstall/piko/server/upstream"
 )
 
@@ -24,6 +35,40 @@ type Server struct {
 
 	httpServer *http.Server
 
+	// http3Server serves HTTP/3 connections, or is nil if HTTP/3 is
+	// disabled.
+	http3Server *http3.Server
+
+	// forwardServer serves requests forwarded from other nodes over TLS, or
+	// is nil if the forward listener is disabled.
+	forwardServer *http.Server
+
+	// tcpServer serves TCP connections on a separate listener, or is nil if
+	// the TCP listener is disabled.
+	tcpServer *http.Server
+
+	// forwardSecret is the cluster secret required by the forward listener,
+	// or empty if only TLS client authentication is required.
+	forwardSecret string
+
+	// auditor records requests to the forward listener with an invalid
+	// secret. May be nil.
+	auditor audit.Auditor
+
+	// shedder sheds requests when the node is overloaded, or is nil if
+	// shedding is disabled.
+	shedder *loadShedder
+
+	// inflight is the number of in-flight HTTP requests, excluding
+	// upgraded connections.
+	inflight *atomic.Int64
+
+	// latency records the latency of proxied requests to each endpoint.
+	latency *endpointLatency
+
+	// health scores the health of each endpoint.
+	health *endpointHealth
+
 	logger log.Logger
 }
 
@@ -31,20 +76,76 @@ func NewServer(
 	upstreams upstream.Manager,
 	proxyConfig config.ProxyConfig,
 	registry *prometheus.Registry,
+	verifier auth.Verifier,
+	auditor audit.Auditor,
+	plugins *plugin.Plugins,
+	capture *capture.Capture,
 	tlsConfig *tls.Config,
+	forwardTLSConfig *tls.Config,
 	logger log.Logger,
 ) *Server {
 	logger = logger.WithSubsystem("proxy")
 
-	httpProxy := NewHTTPProxy(upstreams, proxyConfig.Timeout, logger)
+	proxyMetrics := NewMetrics()
+	if registry != nil {
+		proxyMetrics.Register(registry)
+	}
+
+	httpProxy := NewHTTPProxy(
+		upstreams,
+		proxyConfig.Timeout,
+		proxyConfig.Retry,
+		proxyConfig.Failover,
+		proxyConfig.Headers,
+		proxyConfig.Forward,
+		forwardTLSConfig,
+		plugins,
+		capture,
+		proxyMetrics,
+		logger,
+	)
+	if len(proxyConfig.Offline.Endpoints) > 0 {
+		httpProxy.offline = newOfflinePages(
+			proxyConfig.Offline, logger.WithSubsystem("proxy.offline"),
+		)
+	}
+	tcpProxy := NewTCPProxy(
+		upstreams,
+		httpProxy,
+		proxyConfig.Retry,
+		proxyConfig.Failover,
+		proxyConfig.TCPAffinity,
+		proxyConfig.TCP.MaxConns,
+		proxyMetrics,
+		logger,
+	)
+
+	h2Server := newHTTP2Server(proxyConfig.HTTP)
 
 	router := gin.New()
+	// Register the health route before adding middleware, so probes from
+	// other nodes skip authentication, access logs and metrics.
+	registerHealthRoute(router)
+
+	latency := newEndpointLatency(proxyMetrics.RequestLatency)
+	health := newEndpointHealth(latency)
+	if registry != nil {
+		registry.MustRegister(health)
+	}
+
 	s := &Server{
-		httpProxy: httpProxy,
-		tcpProxy:  NewTCPProxy(upstreams, httpProxy, logger),
+		httpProxy:     httpProxy,
+		tcpProxy:      tcpProxy,
+		forwardSecret: proxyConfig.Forward.Secret,
+		auditor:       auditor,
+		inflight:      atomic.NewInt64(0),
+		latency:       latency,
+		health:        health,
 		httpServer: &http.Server{
-			Handler:           router,
-			TLSConfig:         tlsConfig,
+			// Accept cleartext HTTP/2 (h2c) connections from other nodes
+			// forwarding requests.
+			Handler:           h2c.NewHandler(router, h2Server),
+			TLSConfig:         tlsConfig.Clone(),
 			ReadTimeout:       proxyConfig.HTTP.ReadTimeout,
 			ReadHeaderTimeout: proxyConfig.HTTP.ReadHeaderTimeout,
 			WriteTimeout:      proxyConfig.HTTP.WriteTimeout,
@@ -55,22 +156,183 @@ func NewServer(
 		logger: logger,
 	}
 
+	if proxyConfig.Forward.Enabled() && forwardTLSConfig != nil {
+		// Requests forwarded from other nodes use a separate router without
+		// the proxy middleware, since the request was already authenticated
+		// and logged by the node that forwarded it.
+		forwardRouter := gin.New()
+		registerHealthRoute(forwardRouter)
+		forwardRouter.Use(gin.CustomRecoveryWithWriter(nil, s.panicRoute))
+		forwardRouter.Use(s.countInflight)
+		if s.forwardSecret != "" {
+			forwardRouter.Use(s.verifyForwardSecret)
+		}
+		s.registerRoutes(forwardRouter)
+
+		s.forwardServer = &http.Server{
+			Handler:           forwardRouter,
+			TLSConfig:         forwardTLSConfig.Clone(),
+			ReadTimeout:       proxyConfig.HTTP.ReadTimeout,
+			ReadHeaderTimeout: proxyConfig.HTTP.ReadHeaderTimeout,
+			WriteTimeout:      proxyConfig.HTTP.WriteTimeout,
+			IdleTimeout:       proxyConfig.HTTP.IdleTimeout,
+			MaxHeaderBytes:    proxyConfig.HTTP.MaxHeaderBytes,
+			ErrorLog:          logger.StdLogger(zapcore.WarnLevel),
+		}
+		s.configureHTTP2(s.forwardServer, newHTTP2Server(proxyConfig.HTTP))
+	}
+
+	if s.httpServer.TLSConfig != nil {
+		s.configureHTTP2(s.httpServer, h2Server)
+	}
+
+	if proxyConfig.HTTP3 && tlsConfig != nil {
+		s.http3Server = &http3.Server{
+			Handler:        router,
+			TLSConfig:      tlsConfig,
+			IdleTimeout:    proxyConfig.HTTP.IdleTimeout,
+			MaxHeaderBytes: proxyConfig.HTTP.MaxHeaderBytes,
+		}
+	}
+
 	// Recover from panics.
 	router.Use(gin.CustomRecoveryWithWriter(nil, s.panicRoute))
+	router.Use(s.countInflight)
+
+	// If there is a forward listener, other nodes forward requests to that
+	// listener, so clients can't mark requests to the proxy listener as
+	// forwarded. Otherwise nodes forward requests to the proxy listener so
+	// the headers added by nodes must be kept.
+	router.Use(httpProxy.headers.ClientHandler(s.forwardServer == nil))
+	if proxyConfig.Headers.ClientCert != "" {
+		router.Use(httpProxy.headers.ClientCertHandler())
+	}
+
+	if s.http3Server != nil {
+		router.Use(s.advertiseHTTP3)
+	}
 
 	router.Use(middleware.NewLogger(proxyConfig.AccessLog, logger))
 
 	metrics := middleware.NewMetrics("proxy")
+	// Request latency is recorded per endpoint instead.
+	metrics.RequestLatency = nil
 	if registry != nil {
 		metrics.Register(registry)
 	}
 	router.Use(metrics.Handler())
 
+	router.Use(s.latency.Handler)
+	if proxyConfig.Headers.EndpointHealth {
+		router.Use(s.health.Handler)
+	}
+
+	// Shed requests before authenticating, since verifying tokens adds
+	// load to an overloaded node.
+	if proxyConfig.Shedding.Enabled() {
+		s.shedder = newLoadShedder(proxyConfig.Shedding, proxyMetrics, logger)
+		router.Use(s.shedder.Handler)
+	}
+
+	var authMiddleware *upstream.AuthMiddleware
+	if verifier != nil {
+		authMiddleware = upstream.NewAuthMiddleware(
+			verifier, auth.TokenTypeProxy, auditor, logger,
+		)
+		router.Use(authMiddleware.VerifyEndpointToken)
+	}
+
 	s.registerRoutes(router)
 
+	if proxyConfig.TCP.Enabled() {
+		// TCP connections on the TCP listener use a separate HTTP server and
+		// router, so long lived connections don't compete with HTTP
+		// requests on the proxy listener.
+		tcpRouter := gin.New()
+		tcpRouter.Use(gin.CustomRecoveryWithWriter(nil, s.panicRoute))
+		// Other nodes never forward connections to the TCP listener.
+		tcpRouter.Use(httpProxy.headers.ClientHandler(false))
+		tcpRouter.Use(middleware.NewLogger(proxyConfig.AccessLog, logger))
+
+		tcpMetrics := middleware.NewMetrics("proxy_tcp")
+		if registry != nil {
+			tcpMetrics.Register(registry)
+		}
+		tcpRouter.Use(tcpMetrics.Handler())
+
+		if s.shedder != nil {
+			tcpRouter.Use(s.shedder.Handler)
+		}
+		if authMiddleware != nil {
+			tcpRouter.Use(authMiddleware.VerifyEndpointToken)
+		}
+		s.registerTCPRoutes(tcpRouter)
+
+		s.tcpServer = &http.Server{
+			Handler:           tcpRouter,
+			TLSConfig:         tlsConfig.Clone(),
+			ReadTimeout:       proxyConfig.HTTP.ReadTimeout,
+			ReadHeaderTimeout: proxyConfig.HTTP.ReadHeaderTimeout,
+			WriteTimeout:      proxyConfig.HTTP.WriteTimeout,
+			IdleTimeout:       proxyConfig.HTTP.IdleTimeout,
+			MaxHeaderBytes:    proxyConfig.HTTP.MaxHeaderBytes,
+			ErrorLog:          logger.StdLogger(zapcore.WarnLevel),
+		}
+	}
+
 	return s
 }
 
+// SetNodeID sets the ID of the local node, which identifies the node in the
+// served by header. Must be called before serving requests.
+func (s *Server) SetNodeID(nodeID string) {
+	s.httpProxy.headers.nodeID = nodeID
+}
+
+// SetProvenance sets the public keys used to verify responses were signed by
+// an agent for the endpoint, keyed by endpoint ID. Must be called before
+// serving requests.
+func (s *Server) SetProvenance(keys map[string]ed25519.PublicKey) {
+	s.httpProxy.provenance = keys
+}
+
+// SetFederation sets the federation used to forward requests for endpoints
+// without an upstream in the cluster to federated clusters. Must be called
+// before serving requests.
+func (s *Server) SetFederation(federation Federation) {
+	s.httpProxy.federation = federation
+}
+
+// SetHealth sets the cluster endpoints and latency SLO used to score the
+// health of each endpoint. Must be called before serving requests.
+func (s *Server) SetHealth(endpoints ClusterEndpoints, slo config.SLOConfig) {
+	s.health.Set(endpoints, slo)
+}
+
+// Health returns the health of each endpoint with upstreams or recent
+// requests.
+func (s *Server) Health() []EndpointHealth {
+	return s.health.Endpoints()
+}
+
+// EndpointHealth returns the health of the endpoint, or false if the
+// endpoint has no upstreams and no recent requests.
+func (s *Server) EndpointHealth(endpointID string) (EndpointHealth, bool) {
+	return s.health.Endpoint(endpointID)
+}
+
+// Latency returns the latency percentiles of recent requests to each
+// endpoint.
+func (s *Server) Latency() []EndpointLatency {
+	return s.latency.Endpoints()
+}
+
+// EndpointLatency returns the latency percentiles of recent requests to the
+// endpoint, or false if there are no recent requests to the endpoint.
+func (s *Server) EndpointLatency(endpointID string) (EndpointLatency, bool) {
+	return s.latency.Endpoint(endpointID)
+}
+
 func (s *Server) Serve(ln net.Listener) error {
 	s.logger.Info(
 		"starting proxy server",
@@ -90,10 +352,125 @@ func (s *Server) Serve(ln net.Listener) error {
 	return nil
 }
 
+// configureHTTP2 configures the HTTP/2 server used by TLS connections.
+//
+// Note this modifies the server TLS configuration, so the configuration must
+// not be shared.
+func (s *Server) configureHTTP2(server *http.Server, h2Server *http2.Server) {
+	if err := http2.ConfigureServer(server, h2Server); err != nil {
+		// Only fails if the TLS configuration doesn't support HTTP/2, in
+		// which case use the default configuration.
+		s.logger.Warn("failed to configure http2", zap.Error(err))
+	}
+}
+
+func newHTTP2Server(conf config.HTTPConfig) *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams: conf.MaxConcurrentStreams,
+	}
+}
+
+// ServeHTTP3 serves HTTP/3 connections on the given UDP connection.
+//
+// Note the connection isn't closed when the server shuts down.
+func (s *Server) ServeHTTP3(conn net.PacketConn) error {
+	if s.http3Server == nil {
+		return fmt.Errorf("http3 disabled")
+	}
+
+	s.logger.Info(
+		"starting proxy http3 server",
+		zap.String("addr", conn.LocalAddr().String()),
+	)
+
+	if err := s.http3Server.Serve(conn); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("http3 serve: %w", err)
+	}
+	return nil
+}
+
+// ServeForward serves requests forwarded from other nodes over TLS on the
+// given listener.
+func (s *Server) ServeForward(ln net.Listener) error {
+	if s.forwardServer == nil {
+		return fmt.Errorf("forward listener disabled")
+	}
+
+	s.logger.Info(
+		"starting proxy forward server",
+		zap.String("addr", ln.Addr().String()),
+	)
+
+	if err := s.forwardServer.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("forward serve: %w", err)
+	}
+	return nil
+}
+
+// ServeTCP serves TCP connections on the given listener.
+func (s *Server) ServeTCP(ln net.Listener) error {
+	if s.tcpServer == nil {
+		return fmt.Errorf("tcp listener disabled")
+	}
+
+	s.logger.Info(
+		"starting proxy tcp server",
+		zap.String("addr", ln.Addr().String()),
+	)
+
+	var err error
+	if s.tcpServer.TLSConfig != nil {
+		err = s.tcpServer.ServeTLS(ln, "", "")
+	} else {
+		err = s.tcpServer.Serve(ln)
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("tcp serve: %w", err)
+	}
+	return nil
+}
+
+// Inflight returns the number of in-flight HTTP requests, excluding TCP and
+// WebSocket connections.
+func (s *Server) Inflight() int64 {
+	return s.inflight.Load()
+}
+
+// TCPConns returns the number of open TCP connections.
+func (s *Server) TCPConns() int64 {
+	return s.tcpProxy.conns.Load()
+}
+
+// ProbeNodes starts probing the other nodes in the cluster, to stop
+// forwarding requests to nodes that can't be reached.
+func (s *Server) ProbeNodes(state *cluster.State) {
+	s.httpProxy.ProbeNodes(state)
+}
+
 func (s *Server) Shutdown(ctx context.Context) error {
+	if s.tcpServer != nil {
+		if err := s.tcpServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if s.forwardServer != nil {
+		if err := s.forwardServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if s.http3Server != nil {
+		if err := s.http3Server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
 	if err := s.httpServer.Shutdown(ctx); err != nil {
 		return err
 	}
+	s.httpProxy.Close()
+	if s.shedder != nil {
+		s.shedder.Close()
+	}
 	return nil
 }
 
@@ -106,16 +483,123 @@ func (s *Server) registerRoutes(router *gin.Engine) {
 	router.NoRoute(s.proxyHTTPRoute)
 }
 
+// registerTCPRoutes registers the routes for the TCP listener, which only
+// accepts TCP connections.
+func (s *Server) registerTCPRoutes(router *gin.Engine) {
+	piko := router.Group("/_piko")
+	v1 := piko.Group("/v1")
+	v1.GET("/tcp/:endpointID", s.proxyTCPRoute)
+}
+
+// registerHealthRoute registers the route other nodes probe to check the
+// node can be reached.
+func registerHealthRoute(router *gin.Engine) {
+	health := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+	router.HEAD(healthPath, health)
+	router.GET(healthPath, health)
+}
+
 func (s *Server) proxyHTTPRoute(c *gin.Context) {
+	// If the endpoint ID is missing the HTTP proxy will reject the request.
+	endpointID := EndpointIDFromRequest(c.Request)
+	if endpointID != "" && !s.endpointPermitted(c, endpointID) {
+		return
+	}
+
 	s.httpProxy.ServeHTTP(c.Writer, c.Request)
 }
 
 func (s *Server) proxyTCPRoute(c *gin.Context) {
 	endpointID := c.Param("endpointID")
+	if !s.endpointPermitted(c, endpointID) {
+		return
+	}
+
 	s.tcpProxy.ServeHTTP(c.Writer, c.Request, endpointID)
 }
 
+// endpointPermitted checks whether the request token, if authenticated, is
+// permitted to access the endpoint. If not permitted, responds with 401.
+func (s *Server) endpointPermitted(c *gin.Context, endpointID string) bool {
+	token, ok := c.Get(upstream.TokenContextKey)
+	if !ok {
+		return true
+	}
+
+	endpointToken := token.(*auth.EndpointToken)
+	if endpointToken.EndpointPermitted(endpointID) {
+		return true
+	}
+
+	s.logger.Warn(
+		"endpoint not permitted",
+		zap.Strings("token-endpoints", endpointToken.Endpoints),
+		zap.String("endpoint-id", endpointID),
+	)
+	_ = errorResponse(c.Writer, http.StatusUnauthorized, "endpoint not permitted")
+	return false
+}
+
+// verifyForwardSecret rejects requests to the forward listener that don't
+// include the cluster secret.
+func (s *Server) verifyForwardSecret(c *gin.Context) {
+	secret := c.Request.Header.Get(forwardSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(s.forwardSecret)) != 1 {
+		s.logger.Warn(
+			"forwarded request invalid secret",
+			zap.String("remote-addr", c.Request.RemoteAddr),
+		)
+		if s.auditor != nil {
+			s.auditor.Record(audit.Event{
+				Type:       audit.EventTypeAuthFailure,
+				Listener:   "forward",
+				Action:     c.Request.Method + " " + c.Request.URL.Path,
+				RemoteAddr: c.Request.RemoteAddr,
+				Status:     http.StatusUnauthorized,
+				Reason:     "invalid forward secret",
+			})
+		}
+		c.AbortWithStatusJSON(
+			http.StatusUnauthorized,
+			gin.H{"error": "invalid forward secret"},
+		)
+		return
+	}
+	c.Request.Header.Del(forwardSecretHeader)
+}
+
+// countInflight counts in-flight HTTP requests. Upgraded connections are
+// long lived so aren't counted.
+func (s *Server) countInflight(c *gin.Context) {
+	if c.Request.Header.Get("Upgrade") != "" {
+		c.Next()
+		return
+	}
+
+	s.inflight.Inc()
+	defer s.inflight.Dec()
+
+	c.Next()
+}
+
+// advertiseHTTP3 adds the 'Alt-Svc' header to responses to non-HTTP/3
+// requests, which advertises to clients that they can connect using HTTP/3.
+func (s *Server) advertiseHTTP3(c *gin.Context) {
+	if c.Request.ProtoMajor < 3 {
+		// Only fails if the HTTP/3 server isn't listening yet.
+		_ = s.http3Server.SetQUICHeaders(c.Writer.Header())
+	}
+}
+
 func (s *Server) panicRoute(c *gin.Context, err any) {
+	if err == http.ErrAbortHandler {
+		// Propagate aborts to the HTTP server so the response is aborted,
+		// such as when a response body fails provenance verification after
+		// the headers were written.
+		panic(err)
+	}
 	s.logger.Error(
 		"handler panic",
 		zap.String("path", c.FullPath()),
@@ -0,0 +1,396 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/testutil"
+	"github.com/andydunstall/piko/server/audit"
+	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+type fakeVerifier struct {
+	tokens map[string]auth.EndpointToken
+}
+
+func (v *fakeVerifier) VerifyEndpointToken(
+	token string,
+	tokenType auth.TokenType,
+) (auth.EndpointToken, error) {
+	t, ok := v.tokens[token]
+	if !ok {
+		return auth.EndpointToken{}, auth.ErrInvalidToken
+	}
+	if t.Type != tokenType {
+		return auth.EndpointToken{}, auth.ErrInvalidTokenType
+	}
+	return t, nil
+}
+
+type fakeAuditor struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (a *fakeAuditor) Record(event audit.Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, event)
+}
+
+func (a *fakeAuditor) Events() []audit.Event {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.events
+}
+
+func (a *fakeAuditor) Close() error {
+	return nil
+}
+
+func TestServer_Auth(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The proxy token must not be forwarded to the upstream.
+			assert.Equal(t, "", r.Header.Get("x-piko-authorization"))
+			assert.Equal(t, "Bearer upstream-auth", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer upstreamServer.Close()
+
+	verifier := &fakeVerifier{
+		tokens: map[string]auth.EndpointToken{
+			"proxy-token": {
+				Type:      auth.TokenTypeProxy,
+				Endpoints: []string{"my-endpoint"},
+			},
+			"upstream-token": {
+				Type: auth.TokenTypeUpstream,
+			},
+		},
+	}
+
+	server := NewServer(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: upstreamServer.Listener.Addr().String(),
+				}, true
+			},
+		},
+		config.ProxyConfig{
+			Headers: config.Default().Proxy.Headers,
+		},
+		nil,
+		verifier,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// nolint
+	go server.Serve(ln)
+
+	request := func(endpointID string, token string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String(), nil)
+		require.NoError(t, err)
+		req.Header.Set("x-piko-endpoint", endpointID)
+		req.Header.Set("Authorization", "Bearer upstream-auth")
+		if token != "" {
+			req.Header.Set("x-piko-authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		m := errorMessage{}
+		_ = json.NewDecoder(resp.Body).Decode(&m)
+		return resp.StatusCode, m.Error
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		status, _ := request("my-endpoint", "proxy-token")
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("missing token", func(t *testing.T) {
+		status, message := request("my-endpoint", "")
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, "missing authorization", message)
+	})
+
+	t.Run("upstream token", func(t *testing.T) {
+		status, message := request("my-endpoint", "upstream-token")
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, "invalid token type", message)
+	})
+
+	t.Run("endpoint not permitted", func(t *testing.T) {
+		status, message := request("another-endpoint", "proxy-token")
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, "endpoint not permitted", message)
+	})
+}
+
+func TestServer_Forward(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The forward secret must not be forwarded to the upstream.
+			assert.Equal(t, "", r.Header.Get("x-piko-forward-secret"))
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer upstreamServer.Close()
+
+	verifier := &fakeVerifier{
+		tokens: map[string]auth.EndpointToken{
+			"proxy-token": {
+				Type: auth.TokenTypeProxy,
+			},
+		},
+	}
+
+	rootCAPool, cert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	auditor := &fakeAuditor{}
+
+	allowForwardCh := make(chan bool, 1)
+	server := NewServer(
+		&fakeManager{
+			handler: func(_ string, allowForward bool) (upstream.Upstream, bool) {
+				allowForwardCh <- allowForward
+				return &tcpUpstream{
+					addr: upstreamServer.Listener.Addr().String(),
+				}, true
+			},
+		},
+		config.ProxyConfig{
+			Forward: config.ForwardConfig{
+				BindAddr: "127.0.0.1:0",
+				Secret:   "my-secret",
+			},
+			Headers: config.Default().Proxy.Headers,
+		},
+		nil,
+		verifier,
+		auditor,
+		nil,
+		nil,
+		nil,
+		&tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		log.NewNopLogger(),
+	)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	forwardLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer forwardLn.Close()
+
+	// nolint
+	go server.Serve(ln)
+	// nolint
+	go server.ServeForward(forwardLn)
+	defer server.Shutdown(context.TODO())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: rootCAPool,
+			},
+		},
+	}
+	request := func(url string, header http.Header) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		req.Header = header
+		req.Header.Set("x-piko-endpoint", "my-endpoint")
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		m := errorMessage{}
+		_ = json.NewDecoder(resp.Body).Decode(&m)
+		return resp.StatusCode, m.Error
+	}
+
+	t.Run("forward listener", func(t *testing.T) {
+		// Forwarded requests don't require a proxy token.
+		status, _ := request("https://"+forwardLn.Addr().String(), http.Header{
+			"X-Piko-Forward":        []string{"true"},
+			"X-Piko-Forward-Secret": []string{"my-secret"},
+		})
+		assert.Equal(t, http.StatusOK, status)
+		assert.False(t, <-allowForwardCh)
+	})
+
+	t.Run("forward listener invalid secret", func(t *testing.T) {
+		status, message := request("https://"+forwardLn.Addr().String(), http.Header{
+			"X-Piko-Forward":        []string{"true"},
+			"X-Piko-Forward-Secret": []string{"invalid"},
+		})
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, "invalid forward secret", message)
+
+		// The failure is recorded in the audit log.
+		events := auditor.Events()
+		require.Equal(t, 1, len(events))
+		assert.Equal(t, audit.EventTypeAuthFailure, events[0].Type)
+		assert.Equal(t, "forward", events[0].Listener)
+		assert.Equal(t, "GET /", events[0].Action)
+		assert.Equal(t, http.StatusUnauthorized, events[0].Status)
+		assert.Equal(t, "invalid forward secret", events[0].Reason)
+	})
+
+	t.Run("proxy listener spoofed forward", func(t *testing.T) {
+		// Requests to the proxy listener can't be marked as forwarded.
+		status, _ := request("http://"+ln.Addr().String(), http.Header{
+			"X-Piko-Forward":        []string{"true"},
+			"X-Piko-Forward-Secret": []string{"my-secret"},
+			"X-Piko-Authorization":  []string{"Bearer proxy-token"},
+		})
+		assert.Equal(t, http.StatusOK, status)
+		assert.True(t, <-allowForwardCh)
+	})
+
+	t.Run("proxy listener missing token", func(t *testing.T) {
+		status, message := request("http://"+ln.Addr().String(), http.Header{
+			"X-Piko-Forward": []string{"true"},
+		})
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, "missing authorization", message)
+	})
+}
+
+func TestServer_HTTP3(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer upstreamServer.Close()
+
+	rootCAPool, cert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	tlsConfig := &tls.Config{}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	server := NewServer(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: upstreamServer.Listener.Addr().String(),
+				}, true
+			},
+		},
+		config.ProxyConfig{
+			HTTP3: true,
+		},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		tlsConfig,
+		nil,
+		log.NewNopLogger(),
+	)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	packetConn, err := net.ListenPacket("udp", ln.Addr().String())
+	require.NoError(t, err)
+	defer packetConn.Close()
+
+	go func() {
+		assert.NoError(t, server.Serve(ln))
+	}()
+	go func() {
+		assert.NoError(t, server.ServeHTTP3(packetConn))
+	}()
+	defer server.Shutdown(context.TODO())
+
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(t, err)
+
+	t.Run("alt-svc", func(t *testing.T) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: rootCAPool,
+				},
+			},
+		}
+
+		// The HTTP/3 server may not have started listening yet, in which
+		// case HTTP/3 isn't advertised.
+		require.Eventually(t, func() bool {
+			req, _ := http.NewRequest(http.MethodGet, "https://"+ln.Addr().String(), nil)
+			req.Header.Set("x-piko-endpoint", "my-endpoint")
+			resp, err := client.Do(req)
+			if err != nil {
+				return false
+			}
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			return strings.Contains(resp.Header.Get("Alt-Svc"), `h3=":`+port+`"`)
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("http3", func(t *testing.T) {
+		transport := &http3.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: rootCAPool,
+			},
+		}
+		defer transport.Close()
+		client := &http.Client{
+			Transport: transport,
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, "https://"+ln.Addr().String(), nil)
+		req.Header.Set("x-piko-endpoint", "my-endpoint")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 3, resp.ProtoMajor)
+		// HTTP/3 responses don't advertise HTTP/3.
+		assert.Equal(t, "", resp.Header.Get("Alt-Svc"))
+	})
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"runtime/metrics"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+const (
+	heapMetric         = "/memory/classes/heap/objects:bytes"
+	queueLatencyMetric = "/sched/latencies:seconds"
+
+	sampleInterval = time.Second
+)
+
+// loadShedder rejects proxy requests when the node is overloaded, which is
+// when the number of in-flight requests, the heap size or the scheduling
+// latency exceeds the configured limits.
+//
+// Requests to critical endpoints are never shed, and requests to best effort
+// endpoints are shed once the node exceeds the best effort threshold of a
+// limit, so they are shed before other endpoints.
+type loadShedder struct {
+	conf config.SheddingConfig
+
+	inflight *atomic.Int64
+
+	// heapBytes and queueLatency are the last sampled heap size and p99
+	// scheduling latency.
+	heapBytes    *atomic.Uint64
+	queueLatency *atomic.Duration
+
+	// queueLatencyCounts are the scheduling latency histogram counts from the
+	// last sample, used to calculate the latency since the last sample.
+	queueLatencyCounts []uint64
+
+	done chan struct{}
+
+	metrics *Metrics
+
+	logger log.Logger
+}
+
+func newLoadShedder(
+	conf config.SheddingConfig,
+	metrics *Metrics,
+	logger log.Logger,
+) *loadShedder {
+	s := &loadShedder{
+		conf:         conf,
+		inflight:     atomic.NewInt64(0),
+		heapBytes:    atomic.NewUint64(0),
+		queueLatency: atomic.NewDuration(0),
+		done:         make(chan struct{}),
+		metrics:      metrics,
+		logger:       logger,
+	}
+	if conf.MaxHeapBytes > 0 || conf.MaxQueueLatency > 0 {
+		s.sample()
+		go s.sampleLoop()
+	}
+	return s
+}
+
+// Handler is a middleware that sheds requests when the node is overloaded.
+//
+// Requests are shed before reading the request body.
+func (s *loadShedder) Handler(c *gin.Context) {
+	endpointID := upstream.NormalizeEndpointID(c.Param("endpointID"))
+	if endpointID == "" {
+		endpointID = EndpointIDFromRequest(c.Request)
+	}
+	priority := s.conf.EndpointPriority(endpointID)
+
+	if reason := s.shed(priority); reason != "" {
+		s.metrics.ShedRequestsTotal.WithLabelValues(
+			string(priority), reason,
+		).Inc()
+
+		s.logger.Debug(
+			"shed request",
+			zap.String("endpoint-id", endpointID),
+			zap.String("priority", string(priority)),
+			zap.String("reason", reason),
+		)
+
+		retryAfter := int(math.Ceil(s.conf.RetryAfter.Seconds()))
+		c.Writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		_ = errorResponse(c.Writer, http.StatusServiceUnavailable, "server overloaded")
+		c.Abort()
+		return
+	}
+
+	// Upgraded connections, such as TCP and WebSocket connections, are
+	// long lived so aren't counted as in-flight requests.
+	if c.Request.Header.Get("Upgrade") != "" {
+		c.Next()
+		return
+	}
+
+	s.inflight.Inc()
+	s.metrics.InflightRequests.Inc()
+	defer func() {
+		s.inflight.Dec()
+		s.metrics.InflightRequests.Dec()
+	}()
+
+	c.Next()
+}
+
+func (s *loadShedder) Close() {
+	close(s.done)
+}
+
+// shed returns the limit exceeded for a request with the given priority, or
+// an empty string if the request should be accepted.
+func (s *loadShedder) shed(priority config.SheddingPriority) string {
+	if priority == config.SheddingPriorityCritical {
+		return ""
+	}
+
+	threshold := 1.0
+	if priority == config.SheddingPriorityBestEffort {
+		threshold = s.conf.BestEffortThreshold
+	}
+
+	if s.conf.MaxInflight > 0 &&
+		float64(s.inflight.Load()) >= threshold*float64(s.conf.MaxInflight) {
+		return "inflight"
+	}
+	if s.conf.MaxHeapBytes > 0 &&
+		float64(s.heapBytes.Load()) >= threshold*float64(s.conf.MaxHeapBytes) {
+		return "heap"
+	}
+	if s.conf.MaxQueueLatency > 0 &&
+		float64(s.queueLatency.Load()) >= threshold*float64(s.conf.MaxQueueLatency) {
+		return "queue_latency"
+	}
+	return ""
+}
+
+func (s *loadShedder) sampleLoop() {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sample()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// sample updates the heap size and the p99 scheduling latency since the
+// last sample.
+func (s *loadShedder) sample() {
+	samples := []metrics.Sample{
+		{Name: heapMetric},
+		{Name: queueLatencyMetric},
+	}
+	metrics.Read(samples)
+
+	if samples[0].Value.Kind() == metrics.KindUint64 {
+		s.heapBytes.Store(samples[0].Value.Uint64())
+	}
+
+	if samples[1].Value.Kind() == metrics.KindFloat64Histogram {
+		hist := samples[1].Value.Float64Histogram()
+
+		// The histogram is cumulative, so subtract the counts from the last
+		// sample to get the latency since the last sample.
+		counts := make([]uint64, len(hist.Counts))
+		for i, count := range hist.Counts {
+			counts[i] = count
+			if len(s.queueLatencyCounts) == len(hist.Counts) {
+				counts[i] -= s.queueLatencyCounts[i]
+			}
+		}
+		s.queueLatencyCounts = append(s.queueLatencyCounts[:0], hist.Counts...)
+
+		s.queueLatency.Store(histogramQuantile(counts, hist.Buckets, 0.99))
+	}
+}
+
+// histogramQuantile returns the upper bound of the bucket containing the
+// given quantile, or zero if the histogram is empty.
+func histogramQuantile(counts []uint64, buckets []float64, q float64) time.Duration {
+	var total uint64
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(float64(total) * q))
+	var cumulative uint64
+	for i, count := range counts {
+		cumulative += count
+		if cumulative < target {
+			continue
+		}
+		bound := buckets[i+1]
+		if math.IsInf(bound, 1) {
+			bound = buckets[i]
+		}
+		return time.Duration(bound * float64(time.Second))
+	}
+	return 0
+}
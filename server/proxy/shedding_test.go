@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestLoadShedder(t *testing.T) {
+	conf := config.SheddingConfig{
+		MaxInflight:         10,
+		BestEffortThreshold: 0.5,
+		RetryAfter:          time.Millisecond * 1500,
+		Endpoints: []config.EndpointSheddingConfig{
+			{ID: "critical", Priority: config.SheddingPriorityCritical},
+			{ID: "best-effort", Priority: config.SheddingPriorityBestEffort},
+		},
+	}
+
+	newRouter := func(shedder *loadShedder) *gin.Engine {
+		router := gin.New()
+		router.Use(shedder.Handler)
+		router.NoRoute(func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		return router
+	}
+
+	request := func(router *gin.Engine, endpointID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-endpoint", endpointID)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("under limit", func(t *testing.T) {
+		metrics := NewMetrics()
+		shedder := newLoadShedder(conf, metrics, log.NewNopLogger())
+		defer shedder.Close()
+
+		router := newRouter(shedder)
+		for _, endpointID := range []string{"critical", "normal", "best-effort"} {
+			w := request(router, endpointID)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+
+		// In-flight requests are decremented when the request completes.
+		assert.Equal(t, int64(0), shedder.inflight.Load())
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.InflightRequests))
+	})
+
+	t.Run("best effort threshold", func(t *testing.T) {
+		metrics := NewMetrics()
+		shedder := newLoadShedder(conf, metrics, log.NewNopLogger())
+		defer shedder.Close()
+
+		shedder.inflight.Store(5)
+
+		router := newRouter(shedder)
+
+		w := request(router, "best-effort")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+		w = request(router, "normal")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ShedRequestsTotal.WithLabelValues("best_effort", "inflight"),
+		))
+	})
+
+	t.Run("over limit", func(t *testing.T) {
+		metrics := NewMetrics()
+		shedder := newLoadShedder(conf, metrics, log.NewNopLogger())
+		defer shedder.Close()
+
+		shedder.inflight.Store(10)
+
+		router := newRouter(shedder)
+
+		w := request(router, "normal")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		w = request(router, "best-effort")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		// Critical endpoints are never shed.
+		w = request(router, "critical")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ShedRequestsTotal.WithLabelValues("normal", "inflight"),
+		))
+	})
+
+	t.Run("mixed case", func(t *testing.T) {
+		conf := conf
+		conf.Endpoints = []config.EndpointSheddingConfig{
+			{ID: "Critical", Priority: config.SheddingPriorityCritical},
+		}
+		require.NoError(t, conf.Validate())
+
+		metrics := NewMetrics()
+		shedder := newLoadShedder(conf, metrics, log.NewNopLogger())
+		defer shedder.Close()
+
+		shedder.inflight.Store(10)
+
+		// Endpoint IDs are case insensitive, so the critical priority
+		// applies regardless of case in the config or request.
+		router := newRouter(shedder)
+		for _, endpointID := range []string{"critical", "CRITICAL"} {
+			w := request(router, endpointID)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+	})
+
+	t.Run("heap", func(t *testing.T) {
+		conf := config.SheddingConfig{
+			MaxHeapBytes:        1,
+			BestEffortThreshold: 1,
+			RetryAfter:          time.Second,
+		}
+		metrics := NewMetrics()
+		shedder := newLoadShedder(conf, metrics, log.NewNopLogger())
+		defer shedder.Close()
+
+		// The heap is sampled when the shedder is created, so will always
+		// exceed the limit.
+		w := request(newRouter(shedder), "my-endpoint")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ShedRequestsTotal.WithLabelValues("normal", "heap"),
+		))
+	})
+
+	t.Run("queue latency", func(t *testing.T) {
+		conf := config.SheddingConfig{
+			MaxQueueLatency:     time.Millisecond * 50,
+			BestEffortThreshold: 1,
+			RetryAfter:          time.Second,
+		}
+		metrics := NewMetrics()
+		shedder := newLoadShedder(conf, metrics, log.NewNopLogger())
+		defer shedder.Close()
+
+		shedder.queueLatency.Store(time.Millisecond * 100)
+
+		w := request(newRouter(shedder), "my-endpoint")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ShedRequestsTotal.WithLabelValues("normal", "queue_latency"),
+		))
+	})
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	buckets := []float64{0, 0.001, 0.01, 0.1, math.Inf(1)}
+
+	assert.Equal(t, time.Duration(0), histogramQuantile(
+		[]uint64{0, 0, 0, 0}, buckets, 0.99,
+	))
+	assert.Equal(t, time.Millisecond, histogramQuantile(
+		[]uint64{100, 0, 0, 0}, buckets, 0.99,
+	))
+	assert.Equal(t, time.Millisecond*10, histogramQuantile(
+		[]uint64{98, 2, 0, 0}, buckets, 0.99,
+	))
+	// Uses the lower bound of the last bucket if unbounded.
+	assert.Equal(t, time.Millisecond*100, histogramQuantile(
+		[]uint64{90, 0, 0, 10}, buckets, 0.99,
+	))
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/status"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+type Status struct {
+	server *Server
+	slo    config.SLOConfig
+}
+
+func NewStatus(server *Server, slo config.SLOConfig) *Status {
+	return &Status{
+		server: server,
+		slo:    slo,
+	}
+}
+
+func (s *Status) Register(group *gin.RouterGroup) {
+	group.GET("/latency", s.listLatencyRoute)
+	group.GET("/latency/:id", s.getLatencyRoute)
+	group.GET("/health", s.listHealthRoute)
+	group.GET("/health/:id", s.getHealthRoute)
+}
+
+func (s *Status) listLatencyRoute(c *gin.Context) {
+	endpoints := s.server.Latency()
+	for i := range endpoints {
+		endpoints[i].Target = s.slo.Target(endpoints[i].EndpointID)
+	}
+	c.JSON(http.StatusOK, endpoints)
+}
+
+func (s *Status) getLatencyRoute(c *gin.Context) {
+	endpointID := upstream.NormalizeEndpointID(c.Param("id"))
+	endpoint, ok := s.server.EndpointLatency(endpointID)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	endpoint.Target = s.slo.Target(endpoint.EndpointID)
+	c.JSON(http.StatusOK, endpoint)
+}
+
+func (s *Status) listHealthRoute(c *gin.Context) {
+	endpoints := s.server.Health()
+	if endpoints == nil {
+		endpoints = []EndpointHealth{}
+	}
+	c.JSON(http.StatusOK, endpoints)
+}
+
+func (s *Status) getHealthRoute(c *gin.Context) {
+	endpointID := upstream.NormalizeEndpointID(c.Param("id"))
+	endpoint, ok := s.server.EndpointHealth(endpointID)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, endpoint)
+}
+
+var _ status.Handler = &Status{}
@@ -1,16 +1,19 @@
 package proxy
 
 import (
-	"io"
+	"context"
 	"net"
 	"net/http"
 	"sync"
 
 	"github.com/gorilla/websocket"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 
+	"github.com/andydunstall/piko/pkg/bufpool"
 	"github.com/andydunstall/piko/pkg/log"
 	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/piko/server/config"
 	"github.com/andydunstall/piko/server/upstream"
 )
 
@@ -23,47 +26,95 @@ type TCPProxy struct {
 
 	httpProxy *HTTPProxy
 
+	retry config.RetryConfig
+
+	failover config.FailoverConfig
+
+	affinity config.AffinityConfig
+
+	// maxConns is the maximum number of concurrent connections, or zero if
+	// there is no limit.
+	maxConns int
+	conns    *atomic.Int64
+
 	websocketUpgrader *websocket.Upgrader
 
+	metrics *Metrics
+
 	logger log.Logger
 }
 
 func NewTCPProxy(
 	upstreams upstream.Manager,
 	httpProxy *HTTPProxy,
+	retry config.RetryConfig,
+	failover config.FailoverConfig,
+	affinity config.AffinityConfig,
+	maxConns int,
+	metrics *Metrics,
 	logger log.Logger,
 ) *TCPProxy {
 	return &TCPProxy{
 		upstreams:         upstreams,
 		httpProxy:         httpProxy,
+		retry:             retry,
+		failover:          failover,
+		affinity:          affinity,
+		maxConns:          maxConns,
+		conns:             atomic.NewInt64(0),
 		websocketUpgrader: &websocket.Upgrader{},
+		metrics:           metrics,
 		logger:            logger.WithSubsystem("proxy.tcp"),
 	}
 }
 
 func (p *TCPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID string) {
+	if !p.acquire() {
+		p.metrics.TCPConnsRejectedTotal.Inc()
+		p.logger.Warn(
+			"tcp connection limit reached",
+			zap.String("endpoint-id", endpointID),
+			zap.Int("max-conns", p.maxConns),
+		)
+		_ = errorResponse(w, http.StatusServiceUnavailable, "too many tcp connections")
+		return
+	}
+	defer p.release()
+
 	forwarded := r.Header.Get("x-piko-forward") == "true"
 
 	// If there is a connected upstream, attempt to forward the request to one
-	// of those upstreams. Note this includes remote nodes that are reporting
-	// they have an available upstream. We don't allow multiple hops, so if
-	// forwarded is true we only select from local nodes.
-	u, ok := p.upstreams.Select(endpointID, !forwarded)
+	// of those upstreams, retrying if there are none.
+	retry := newRetry(r, endpointID, p.upstreams, p.retry, p.metrics)
+	retry.fallback = p.failover.Fallback(endpointID)
+	if p.affinity.Endpoint(endpointID) {
+		retry.affinityKey = affinityKey(r, forwarded)
+	}
+	u, ok := retry.Select(r.Context())
 	if !ok {
 		p.logger.Warn(
 			"no available upstreams",
 			zap.String("endpoint-id", endpointID),
 		)
 
+		if forwarded {
+			// Let the node that forwarded the request know it can retry.
+			w.Header().Set(missHeader, "true")
+		}
 		_ = errorResponse(w, http.StatusBadGateway, "no available upstreams")
 		return
 	}
+	endpointID = failoverEndpoint(r, retry, endpointID)
+
+	bytesIn, bytesOut := p.metrics.countersFor(endpointID, "tcp")
 
 	// If the upstream is a remote node rather than a client listener, forward
 	// the connection via the HTTP reverse proxy. As it is a WebSocket
 	// connection the remote node can handle the connection and forward to an
 	// upstream listener.
 	if u.Forward() {
+		w, r = countRequest(w, r, bytesIn, bytesOut)
+		r = r.WithContext(context.WithValue(r.Context(), retryContextKey, retry))
 		p.httpProxy.ServeHTTPWithUpstream(w, r, endpointID, u)
 		return
 	}
@@ -81,12 +132,55 @@ func (p *TCPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID
 		p.logger.Warn("failed to upgrade websocket", zap.Error(err))
 		return
 	}
-	downstreamConn := pikowebsocket.New(wsConn)
+	downstreamConn := &countingConn{
+		Conn:     pikowebsocket.New(wsConn),
+		bytesIn:  bytesIn,
+		bytesOut: bytesOut,
+	}
 	defer downstreamConn.Close()
 
 	forward(upstreamConn, downstreamConn)
 }
 
+// acquire reserves a connection, or returns false if the proxy has reached
+// the maximum number of connections.
+func (p *TCPProxy) acquire() bool {
+	if n := p.conns.Inc(); p.maxConns > 0 && n > int64(p.maxConns) {
+		p.conns.Dec()
+		return false
+	}
+	p.metrics.TCPConns.Inc()
+	return true
+}
+
+func (p *TCPProxy) release() {
+	p.conns.Dec()
+	p.metrics.TCPConns.Dec()
+}
+
+// affinityKey returns the key to select an upstream for the connection, which
+// is the client IP.
+//
+// Forwarded connections use the key of the node that forwarded the
+// connection, which is also added to the request so the key is passed on if
+// the connection is forwarded to another node.
+func affinityKey(r *http.Request, forwarded bool) string {
+	if forwarded {
+		if key := r.Header.Get(affinityKeyHeader); key != "" {
+			return key
+		}
+	}
+
+	// Use the IP without the port, as the port changes when the client
+	// reconnects.
+	key, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		key = r.RemoteAddr
+	}
+	r.Header.Set(affinityKeyHeader, key)
+	return key
+}
+
 func forward(conn1 net.Conn, conn2 net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -94,13 +188,13 @@ func forward(conn1 net.Conn, conn2 net.Conn) {
 		defer wg.Done()
 		defer conn1.Close()
 		// nolint
-		io.Copy(conn1, conn2)
+		bufpool.Copy(conn1, conn2)
 	}()
 	go func() {
 		defer wg.Done()
 		defer conn2.Close()
 		// nolint
-		io.Copy(conn2, conn1)
+		bufpool.Copy(conn2, conn1)
 	}()
 	wg.Wait()
 }
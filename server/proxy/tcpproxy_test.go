@@ -9,7 +9,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/andydunstall/piko/pkg/log"
@@ -60,6 +62,11 @@ func TestTCPProxy_Forward(t *testing.T) {
 			config.ProxyConfig{},
 			nil,
 			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
 			log.NewNopLogger(),
 		)
 
@@ -88,6 +95,119 @@ func TestTCPProxy_Forward(t *testing.T) {
 			assert.NoError(t, err)
 			assert.Equal(t, 3, n)
 		}
+
+		// The counters are updated after each read or write completes so
+		// may lag the echoed bytes.
+		metrics := server.tcpProxy.metrics
+		assert.Eventually(t, func() bool {
+			in := testutil.ToFloat64(
+				metrics.BytesInTotal.WithLabelValues("my-endpoint", "tcp"),
+			)
+			out := testutil.ToFloat64(
+				metrics.BytesOutTotal.WithLabelValues("my-endpoint", "tcp"),
+			)
+			return in == 30 && out == 30
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("tcp listener", func(t *testing.T) {
+		echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer echoLn.Close()
+
+		go echoListener(echoLn)
+
+		server := NewServer(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: echoLn.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				TCP: config.ProxyTCPConfig{
+					BindAddr: "127.0.0.1:0",
+				},
+			},
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			log.NewNopLogger(),
+		)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer ln.Close()
+
+		// nolint
+		go server.ServeTCP(ln)
+
+		conn, err := websocket.Dial(
+			context.TODO(),
+			"ws://"+ln.Addr().String()+"/_piko/v1/tcp/my-endpoint",
+		)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("foo"))
+		assert.NoError(t, err)
+		buf := make([]byte, 512)
+		n, err := conn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", string(buf[:n]))
+
+		// HTTP requests aren't accepted on the TCP listener.
+		resp, err := http.Get("http://" + ln.Addr().String() + "/foo")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("max conns", func(t *testing.T) {
+		metrics := NewMetrics()
+		proxy := NewTCPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					assert.Fail(t, "expected connection to be rejected")
+					return nil, false
+				},
+			},
+			nil,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.AffinityConfig{},
+			1,
+			metrics,
+			log.NewNopLogger(),
+		)
+
+		// Reserve the only connection.
+		assert.True(t, proxy.acquire())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r, "my-endpoint")
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "too many tcp connections", m.Error)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.TCPConns))
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.TCPConnsRejectedTotal))
+
+		proxy.release()
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.TCPConns))
 	})
 
 	t.Run("upstream unreachable", func(t *testing.T) {
@@ -102,6 +222,11 @@ func TestTCPProxy_Forward(t *testing.T) {
 				},
 			},
 			nil,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.AffinityConfig{},
+			0,
+			NewMetrics(),
 			log.NewNopLogger(),
 		)
 
@@ -120,6 +245,51 @@ func TestTCPProxy_Forward(t *testing.T) {
 		assert.Equal(t, "upstream unreachable", m.Error)
 	})
 
+	t.Run("affinity", func(t *testing.T) {
+		var key string
+		proxy := NewTCPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					assert.Fail(t, "expected affinity")
+					return nil, false
+				},
+				affinityHandler: func(endpointID string, k string, _ bool) (upstream.Upstream, bool) {
+					assert.Equal(t, "my-endpoint", endpointID)
+					key = k
+					return nil, false
+				},
+			},
+			nil,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.AffinityConfig{
+				Endpoints: []string{"my-endpoint"},
+			},
+			0,
+			NewMetrics(),
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.26.104.56:52134"
+		// The affinity key header is ignored unless forwarded.
+		r.Header.Set("x-piko-affinity-key", "10.0.0.1")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r, "my-endpoint")
+		assert.Equal(t, "10.26.104.56", key)
+		// The key is added to the request in case it's forwarded.
+		assert.Equal(t, "10.26.104.56", r.Header.Get("x-piko-affinity-key"))
+
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-forward", "true")
+		r.Header.Set("x-piko-affinity-key", "10.0.0.1")
+
+		w = httptest.NewRecorder()
+		proxy.ServeHTTP(w, r, "my-endpoint")
+		assert.Equal(t, "10.0.0.1", key)
+	})
+
 	t.Run("no available upstreams", func(t *testing.T) {
 		proxy := NewTCPProxy(
 			&fakeManager{
@@ -130,6 +300,11 @@ func TestTCPProxy_Forward(t *testing.T) {
 				},
 			},
 			nil,
+			config.RetryConfig{},
+			config.FailoverConfig{},
+			config.AffinityConfig{},
+			0,
+			NewMetrics(),
 			log.NewNopLogger(),
 		)
 
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+const (
+	// readyHintInterval is the interval to persist the endpoints of the
+	// upstreams connected to the local node, so the hint is recent even if
+	// the node exits without shutting down gracefully.
+	readyHintInterval = time.Second * 10
+)
+
+type readyHintFile struct {
+	// Endpoints contains the IDs of the endpoints with upstreams connected
+	// to the node.
+	Endpoints []string `json:"endpoints"`
+}
+
+// readyHint persists the endpoints of the upstreams connected to the local
+// node, so after restarting the node can wait for those upstreams to
+// reconnect before marking itself as ready.
+type readyHint struct {
+	path string
+
+	clusterState *cluster.State
+
+	// started indicates whether the hint is being persisted, which is only
+	// once the node has waited for the upstreams in the previous hint.
+	started *atomic.Bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	logger log.Logger
+}
+
+func newReadyHint(
+	path string,
+	clusterState *cluster.State,
+	logger log.Logger,
+) *readyHint {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &readyHint{
+		path:         path,
+		clusterState: clusterState,
+		started:      atomic.NewBool(false),
+		ctx:          ctx,
+		cancel:       cancel,
+		logger:       logger,
+	}
+}
+
+// Load returns the endpoints in the persisted hint, or nil if there is no
+// hint, such as the first time the node starts.
+func (h *readyHint) Load() ([]string, error) {
+	b, err := os.ReadFile(h.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var hint readyHintFile
+	if err := json.Unmarshal(b, &hint); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return hint.Endpoints, nil
+}
+
+// Save persists the endpoints of the upstreams currently connected to the
+// local node.
+//
+// The hint is written to a temporary file then renamed, so a node that exits
+// while saving never leaves a partial hint.
+func (h *readyHint) Save() error {
+	endpointIDs := []string{}
+	for endpointID, listeners := range h.clusterState.LocalNode().Endpoints {
+		if listeners > 0 {
+			endpointIDs = append(endpointIDs, endpointID)
+		}
+	}
+	sort.Strings(endpointIDs)
+
+	b, err := json.Marshal(readyHintFile{
+		Endpoints: endpointIDs,
+	})
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(h.path), filepath.Base(h.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := os.Rename(f.Name(), h.path); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
+
+// Wait waits for an upstream to connect to the local node for each of the
+// given endpoints, or the context to be cancelled. Returns the endpoints
+// without an upstream.
+func (h *readyHint) Wait(ctx context.Context, endpointIDs []string) []string {
+	watch := h.clusterState.WatchEndpoints("")
+	defer watch.Close()
+
+	missing := endpointIDs
+	for {
+		var remaining []string
+		for _, endpointID := range missing {
+			if h.clusterState.LocalEndpointListeners(endpointID) == 0 {
+				remaining = append(remaining, endpointID)
+			}
+		}
+		missing = remaining
+		if len(missing) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return missing
+		case <-watch.Notify():
+			// Discard the updates, since LocalEndpointListeners returns the
+			// current number of upstreams.
+			watch.Updates()
+		}
+	}
+}
+
+// Start persists the hint periodically until stopped.
+func (h *readyHint) Start() {
+	h.started.Store(true)
+
+	ticker := time.NewTicker(readyHintInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.Save(); err != nil {
+				h.logger.Warn("failed to save ready hint", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Stop stops persisting the hint periodically, then persists the current
+// hint if started.
+//
+// Must be called before closing the local upstreams on shutdown, so the hint
+// contains the upstreams expected to reconnect once the node restarts.
+func (h *readyHint) Stop() {
+	h.cancel()
+	if !h.started.Load() {
+		// Keep the previous hint, since the node stopped before the
+		// upstreams in the hint reconnected.
+		return
+	}
+	if err := h.Save(); err != nil {
+		h.logger.Warn("failed to save ready hint", zap.Error(err))
+	}
+}
+
+// waitForUpstreams waits for the upstreams connected to the node before it
+// restarted to reconnect, up to the configured timeout. Does nothing if
+// waiting is disabled or there is no hint.
+func (s *Server) waitForUpstreams() {
+	if s.readyHint == nil {
+		return
+	}
+
+	endpointIDs, err := s.readyHint.Load()
+	if err != nil {
+		s.logger.Warn("failed to load ready hint", zap.Error(err))
+		return
+	}
+	if len(endpointIDs) == 0 {
+		return
+	}
+
+	timeout := s.conf.Upstream.ReadyWait.Timeout
+	s.logger.Info(
+		"waiting for upstreams to reconnect",
+		zap.Int("endpoints", len(endpointIDs)),
+		zap.Duration("timeout", timeout),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	missing := s.readyHint.Wait(ctx, endpointIDs)
+	if len(missing) > 0 {
+		s.logger.Warn(
+			"upstreams not reconnected; marking ready",
+			zap.Strings("endpoint-ids", missing),
+		)
+		return
+	}
+	s.logger.Info(
+		"upstreams reconnected",
+		zap.Duration("elapsed", time.Since(start)),
+	)
+}
+
+func (s *Server) startReadyHint() {
+	if s.readyHint == nil {
+		return
+	}
+	s.runGoroutine(func() {
+		s.readyHint.Start()
+	})
+}
+
+func (s *Server) shutdownReadyHint() {
+	if s.readyHint == nil {
+		return
+	}
+	s.readyHint.Stop()
+}
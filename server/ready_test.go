@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+func TestReadyHint_SaveLoad(t *testing.T) {
+	clusterState := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	hint := newReadyHint(
+		filepath.Join(t.TempDir(), "ready-hint.json"),
+		clusterState,
+		log.NewNopLogger(),
+	)
+
+	// There is no hint the first time the node starts.
+	endpointIDs, err := hint.Load()
+	require.NoError(t, err)
+	assert.Nil(t, endpointIDs)
+
+	clusterState.AddLocalEndpoint("endpoint-2")
+	clusterState.AddLocalEndpoint("endpoint-1")
+	require.NoError(t, hint.Save())
+
+	endpointIDs, err = hint.Load()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"endpoint-1", "endpoint-2"}, endpointIDs)
+}
+
+func TestReadyHint_Stop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ready-hint.json")
+
+	clusterState := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	clusterState.AddLocalEndpoint("my-endpoint")
+	require.NoError(t, newReadyHint(path, clusterState, log.NewNopLogger()).Save())
+
+	// Stopping before the hint is started, such as shutting down before the
+	// upstreams reconnect, keeps the previous hint.
+	restarted := newReadyHint(path, cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger()), log.NewNopLogger())
+	restarted.Stop()
+
+	endpointIDs, err := restarted.Load()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"my-endpoint"}, endpointIDs)
+}
+
+func TestReadyHint_Wait(t *testing.T) {
+	t.Run("reconnected", func(t *testing.T) {
+		clusterState := cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger())
+		hint := newReadyHint("", clusterState, log.NewNopLogger())
+
+		clusterState.AddLocalEndpoint("endpoint-1")
+		go func() {
+			time.Sleep(time.Millisecond * 10)
+			clusterState.AddLocalEndpoint("endpoint-2")
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		assert.Nil(t, hint.Wait(ctx, []string{"endpoint-1", "endpoint-2"}))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		clusterState := cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger())
+		hint := newReadyHint("", clusterState, log.NewNopLogger())
+
+		clusterState.AddLocalEndpoint("endpoint-1")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		defer cancel()
+		assert.Equal(
+			t,
+			[]string{"endpoint-2"},
+			hint.Wait(ctx, []string{"endpoint-1", "endpoint-2"}),
+		)
+	})
+}
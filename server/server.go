@@ -6,8 +6,8 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/hashicorp/go-sockaddr"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/atomic"
@@ -16,11 +16,17 @@ import (
 	"github.com/andydunstall/piko/pkg/build"
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/server/admin"
+	"github.com/andydunstall/piko/server/audit"
 	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/capture"
+	"github.com/andydunstall/piko/server/catalogue"
 	"github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/federation"
 	"github.com/andydunstall/piko/server/gossip"
+	"github.com/andydunstall/piko/server/plugin"
 	"github.com/andydunstall/piko/server/proxy"
+	"github.com/andydunstall/piko/server/storage"
 	"github.com/andydunstall/piko/server/upstream"
 	"github.com/andydunstall/piko/server/usage"
 )
@@ -32,16 +38,91 @@ type Server struct {
 	proxyLn     net.Listener
 	proxyServer *proxy.Server
 
+	// proxyPacketConn is the UDP connection for HTTP/3 proxy connections, or
+	// nil if HTTP/3 is disabled.
+	proxyPacketConn net.PacketConn
+
+	// proxyForwardLn is the listener for requests forwarded from other nodes
+	// over TLS, or nil if the forward listener is disabled.
+	proxyForwardLn net.Listener
+
+	// proxyTCPLn is the listener for proxied TCP connections, or nil if the
+	// TCP listener is disabled.
+	proxyTCPLn net.Listener
+
 	upstreamLn     net.Listener
 	upstreamServer *upstream.Server
 
+	upstreams upstream.Manager
+
+	// localEndpoints returns the endpoints of the upstreams connected to the
+	// local node, used to reconcile the endpoints advertised with gossip.
+	localEndpoints gossip.LocalEndpoints
+
+	// staticUpstreams contains the configured upstreams the server connects
+	// to directly.
+	staticUpstreams []upstream.Upstream
+
 	adminLn     net.Listener
 	adminServer *admin.Server
 
+	// adminGRPCLn and adminGRPCServer are nil if the gRPC admin API is
+	// disabled.
+	adminGRPCLn     net.Listener
+	adminGRPCServer *admin.GRPCServer
+
+	// healthLn and healthServer are nil if the health listener is
+	// disabled.
+	healthLn     net.Listener
+	healthServer *admin.HealthServer
+
+	// metricsLn and metricsServer are nil if the metrics listener is
+	// disabled.
+	metricsLn     net.Listener
+	metricsServer *admin.MetricsServer
+
 	gossiper *gossip.Gossip
 
 	reporter *usage.Reporter
 
+	loadReporter *upstream.LoadReporter
+
+	// readyHint persists the endpoints of the local upstreams, to wait for
+	// them to reconnect after restarting. May be nil if waiting is disabled.
+	readyHint *readyHint
+
+	// federation forwards requests to federated clusters. May be nil if
+	// federation is disabled.
+	federation *federation.Federation
+
+	// plugins runs plugin filters on proxy requests. May be nil if there
+	// are no filters.
+	plugins *plugin.Plugins
+
+	// capture records requests to endpoints with capturing enabled.
+	capture *capture.Capture
+
+	// auditor records audit events. May be nil if auditing is disabled.
+	auditor audit.Auditor
+
+	// store persists dynamic state that must be durable beyond gossip.
+	store storage.Store
+
+	// verifier verifies upstream, proxy and admin tokens. May be nil if auth
+	// is disabled.
+	verifier *auth.ReloadableVerifier
+
+	// authConf is the current auth configuration, which may differ from
+	// conf.Auth once reloaded.
+	authConf auth.Config
+
+	// loadConfig loads the configuration when reloading. May be nil if
+	// reloading isn't supported.
+	loadConfig func() (*config.Config, error)
+
+	// reloadMu serialises reloading the configuration.
+	reloadMu sync.Mutex
+
 	conf *config.Config
 
 	// fatalCh triggers a shutdown when a fatal error occurs.
@@ -52,6 +133,27 @@ type Server struct {
 	// shutdown indicates whether a server shutdown has been requested.
 	shutdown *atomic.Bool
 
+	// shutdownCh receives the grace period of shutdowns requested with
+	// RequestShutdown before the shutdown starts.
+	shutdownCh chan time.Duration
+
+	// shutdownTimer cancels the shutdown context once the grace period
+	// expires, or is nil if the shutdown hasn't started.
+	shutdownTimer *time.Timer
+	// shutdownDeadline is when the grace period of the active shutdown
+	// expires.
+	shutdownDeadline time.Time
+	// shutdownStarted is when the active shutdown started.
+	shutdownStarted time.Time
+	// shutdownPhase is the current step of the active shutdown.
+	shutdownPhase string
+	// shutdownInitial is the number of upstreams, proxy requests and TCP
+	// connections to drain when the shutdown started, used to estimate when
+	// the drain will complete.
+	shutdownInitial int64
+	// shutdownMu protects the above fields.
+	shutdownMu sync.Mutex
+
 	// wg waits for background goroutines to exit.
 	wg sync.WaitGroup
 
@@ -70,43 +172,44 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 	registry := prometheus.NewRegistry()
 
 	s := &Server{
-		fatalCh:  make(chan struct{}),
-		shutdown: atomic.NewBool(false),
-		conf:     conf,
-		registry: registry,
-		logger:   logger,
+		fatalCh:    make(chan struct{}),
+		shutdown:   atomic.NewBool(false),
+		shutdownCh: make(chan time.Duration, 1),
+		conf:       conf,
+		registry:   registry,
+		logger:     logger,
 	}
 
 	// Auth config.
 
+	jwtVerifier, err := conf.Auth.Load()
+	if err != nil {
+		return nil, err
+	}
+	// Wrap the verifier so the auth configuration can be reloaded without
+	// restarting.
 	var verifier auth.Verifier
-	if conf.Auth.AuthEnabled() {
-		verifierConf := auth.JWTVerifierConfig{
-			HMACSecretKey: []byte(conf.Auth.TokenHMACSecretKey),
-			Audience:      conf.Auth.TokenAudience,
-			Issuer:        conf.Auth.TokenIssuer,
-		}
+	if jwtVerifier != nil {
+		s.verifier = auth.NewReloadableVerifier(jwtVerifier)
+		verifier = s.verifier
+	}
+	s.authConf = conf.Auth
 
-		if conf.Auth.TokenRSAPublicKey != "" {
-			rsaPublicKey, err := jwt.ParseRSAPublicKeyFromPEM(
-				[]byte(conf.Auth.TokenRSAPublicKey),
-			)
-			if err != nil {
-				return nil, fmt.Errorf("parse rsa public key: %w", err)
-			}
-			verifierConf.RSAPublicKey = rsaPublicKey
-		}
-		if conf.Auth.TokenECDSAPublicKey != "" {
-			ecdsaPublicKey, err := jwt.ParseECPublicKeyFromPEM(
-				[]byte(conf.Auth.TokenECDSAPublicKey),
-			)
-			if err != nil {
-				return nil, fmt.Errorf("parse ecdsa public key: %w", err)
-			}
-			verifierConf.ECDSAPublicKey = ecdsaPublicKey
-		}
-		verifier = auth.NewJWTVerifier(verifierConf)
+	// Audit log.
+
+	auditor, err := audit.New(conf.Audit, conf.Cluster.NodeID, logger)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	s.auditor = auditor
+
+	// Storage.
+
+	store, err := storage.New(conf.Storage, logger)
+	if err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
 	}
+	s.store = store
 
 	// Proxy listener.
 
@@ -116,6 +219,37 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 	}
 	s.proxyLn = proxyLn
 
+	if conf.Proxy.HTTP3 {
+		// Listen on the same UDP port as the TCP listener. Note using the
+		// listen address rather than the configured bind address to
+		// support port 0.
+		proxyPacketConn, err := net.ListenPacket("udp", proxyLn.Addr().String())
+		if err != nil {
+			return nil, fmt.Errorf(
+				"proxy http3 listen: %s: %w", proxyLn.Addr().String(), err,
+			)
+		}
+		s.proxyPacketConn = proxyPacketConn
+	}
+
+	if conf.Proxy.Forward.Enabled() {
+		proxyForwardLn, err := s.proxyForwardListen()
+		if err != nil {
+			return nil, fmt.Errorf("proxy forward listen: %w", err)
+		}
+		s.proxyForwardLn = proxyForwardLn
+	}
+
+	if conf.Proxy.TCP.Enabled() {
+		proxyTCPLn, err := net.Listen("tcp", conf.Proxy.TCP.BindAddr)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"proxy tcp listen: %s: %w", conf.Proxy.TCP.BindAddr, err,
+			)
+		}
+		s.proxyTCPLn = proxyTCPLn
+	}
+
 	// Upstream listener.
 
 	upstreamLn, err := s.upstreamListen()
@@ -132,17 +266,79 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 	}
 	s.adminLn = adminLn
 
+	if conf.Admin.GRPCBindAddr != "" {
+		adminGRPCLn, err := net.Listen("tcp", conf.Admin.GRPCBindAddr)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"admin grpc listen: %s: %w", conf.Admin.GRPCBindAddr, err,
+			)
+		}
+		s.adminGRPCLn = adminGRPCLn
+	}
+
+	if conf.Admin.HealthBindAddr != "" {
+		healthLn, err := net.Listen("tcp", conf.Admin.HealthBindAddr)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"health listen: %s: %w", conf.Admin.HealthBindAddr, err,
+			)
+		}
+		s.healthLn = healthLn
+	}
+
+	if conf.Metrics.BindAddr != "" {
+		metricsLn, err := net.Listen("tcp", conf.Metrics.BindAddr)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"metrics listen: %s: %w", conf.Metrics.BindAddr, err,
+			)
+		}
+		s.metricsLn = metricsLn
+	}
+
 	// Cluster.
 
 	s.clusterState = cluster.NewState(&cluster.Node{
-		ID:        conf.Cluster.NodeID,
-		ProxyAddr: conf.Proxy.AdvertiseAddr,
-		AdminAddr: conf.Admin.AdvertiseAddr,
+		ID:          conf.Cluster.NodeID,
+		ProxyAddr:   conf.Proxy.AdvertiseAddr,
+		ForwardAddr: conf.Proxy.Forward.AdvertiseAddr,
+		AdminAddr:   conf.Admin.AdvertiseAddr,
+		Zone:        conf.Cluster.Zone,
 	}, logger)
 	s.clusterState.Metrics().Register(registry)
 
-	upstreams := upstream.NewLoadBalancedManager(s.clusterState)
+	upstreams := upstream.NewLoadBalancedManager(
+		s.clusterState,
+		conf.Upstream.SLO,
+		conf.Upstream.Hold,
+		conf.Upstream.Routing,
+		conf.Upstream.Queue,
+		conf.Upstream.SlowStart,
+		logger,
+	)
 	upstreams.Metrics().Register(registry)
+	s.loadReporter = upstream.NewLoadReporter(upstreams, s.clusterState)
+	if conf.Upstream.ReadyWait.Enabled() {
+		s.readyHint = newReadyHint(
+			conf.Upstream.ReadyWait.HintPath, s.clusterState, logger,
+		)
+	}
+	s.upstreams = upstreams
+	s.localEndpoints = upstreams
+
+	for i, staticConf := range conf.Upstream.Static {
+		if err := upstream.ValidateEndpointID(staticConf.EndpointID); err != nil {
+			return nil, fmt.Errorf("upstream: static[%d]: %w", i, err)
+		}
+		u, err := staticConf.ParseURL()
+		if err != nil {
+			return nil, fmt.Errorf("upstream: static[%d]: %w", i, err)
+		}
+		endpointID := upstream.NormalizeEndpointID(staticConf.EndpointID)
+		s.staticUpstreams = append(
+			s.staticUpstreams, upstream.NewStaticUpstream(endpointID, u),
+		)
+	}
 
 	// Proxy server.
 
@@ -150,13 +346,56 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("proxy tls: %w", err)
 	}
+	proxyForwardTLSConfig, err := conf.Proxy.Forward.TLS.Load()
+	if err != nil {
+		return nil, fmt.Errorf("proxy forward tls: %w", err)
+	}
+	if conf.Plugin.Enabled() {
+		plugins, err := plugin.New(conf.Plugin, logger)
+		if err != nil {
+			return nil, fmt.Errorf("plugin: %w", err)
+		}
+		s.plugins = plugins
+	}
+
+	s.capture = capture.New()
+
+	// Only authenticate proxy requests if enabled.
+	var proxyVerifier auth.Verifier
+	if conf.Auth.AuthenticateProxy {
+		proxyVerifier = verifier
+	}
 	s.proxyServer = proxy.NewServer(
 		upstreams,
 		conf.Proxy,
 		registry,
+		proxyVerifier,
+		auditor,
+		s.plugins,
+		s.capture,
 		proxyTLSConfig,
+		proxyForwardTLSConfig,
 		logger,
 	)
+	s.proxyServer.SetNodeID(conf.Cluster.NodeID)
+	s.proxyServer.SetHealth(s.clusterState, conf.Upstream.SLO)
+
+	provenanceKeys, err := conf.Proxy.Provenance.Load()
+	if err != nil {
+		return nil, fmt.Errorf("proxy provenance: %w", err)
+	}
+	s.proxyServer.SetProvenance(provenanceKeys)
+
+	if conf.Federation.Enabled() {
+		fed, err := federation.NewFederation(
+			conf.Federation, s.clusterState, logger,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("federation: %w", err)
+		}
+		s.federation = fed
+		s.proxyServer.SetFederation(fed)
+	}
 
 	// Upstream server.
 
@@ -164,12 +403,22 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("upstream: load tls: %w", err)
 	}
+	connHistory := upstream.NewConnHistory(s.clusterState.LocalID())
 	s.upstreamServer = upstream.NewServer(
 		upstreams,
 		verifier,
+		auditor,
 		upstreamTLSConfig,
+		conf.Upstream.Keepalive,
+		conf.Upstream.MaxStreams,
 		logger,
 	)
+	s.upstreamServer.SetDraining(s.clusterState.LocalDraining)
+	s.upstreamServer.SetHistory(connHistory)
+	if conf.Upstream.ResumeSecret != "" {
+		s.upstreamServer.SetResumeSecret(conf.Cluster.NodeID, conf.Upstream.ResumeSecret)
+	}
+	s.upstreamServer.SetAcceptLimit(conf.Upstream.AcceptLimit, upstreams.Metrics())
 
 	// Admin server.
 
@@ -180,15 +429,65 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 	s.adminServer = admin.NewServer(
 		s.clusterState,
 		registry,
+		verifier,
+		auditor,
 		adminTLSConfig,
 		logger,
 	)
+	s.adminServer.SetReloader(s)
+	s.adminServer.SetShutdowner(s)
+	s.registerShutdownMetrics(registry)
+	s.adminServer.SetRouteResolver(upstreams)
+	s.adminServer.SetConnHistory(connHistory)
+	if s.federation != nil {
+		s.adminServer.SetFederationGateway(s.federation)
+	}
 	s.adminServer.AddStatus("/upstream", upstream.NewStatus(upstreams))
+	s.adminServer.AddStatus("/proxy", proxy.NewStatus(
+		s.proxyServer, conf.Upstream.SLO,
+	))
 	s.adminServer.AddStatus("/cluster", cluster.NewStatus(s.clusterState))
+	s.adminServer.AddStatus("/capture", capture.NewStatus(s.capture))
+	endpointCatalogue := catalogue.New(conf.Catalogue, s.store)
+	s.adminServer.SetCatalogueEditor(endpointCatalogue)
+	s.adminServer.AddStatus("/catalogue", catalogue.NewStatus(
+		endpointCatalogue, s.clusterState,
+	))
+
+	if s.adminGRPCLn != nil {
+		s.adminGRPCServer = admin.NewGRPCServer(
+			s.clusterState,
+			conf,
+			adminTLSConfig,
+			logger,
+		)
+	}
+
+	if s.healthLn != nil {
+		s.healthServer = admin.NewHealthServer(s.adminServer.Ready, logger)
+	}
+
+	if s.metricsLn != nil {
+		metricsTLSConfig, err := conf.Metrics.TLS.Load()
+		if err != nil {
+			return nil, fmt.Errorf("metrics tls: %w", err)
+		}
+		s.metricsServer = admin.NewMetricsServer(
+			registry,
+			conf.Metrics.BasicAuth.Username,
+			conf.Metrics.BasicAuth.Password,
+			metricsTLSConfig,
+			logger,
+		)
+	}
 
 	// Usage reporting.
 
-	s.reporter = usage.NewReporter(upstreams.Usage(), logger)
+	reporter, err := usage.NewReporter(conf.Usage, upstreams.Usage(), logger)
+	if err != nil {
+		return nil, fmt.Errorf("usage: %w", err)
+	}
+	s.reporter = reporter
 
 	return s, nil
 }
@@ -208,7 +507,7 @@ func (s *Server) Start() error {
 
 	// Usage reporting.
 
-	if !s.conf.Usage.Disable {
+	if s.conf.Usage.Enabled() {
 		s.startUsageReporting()
 	}
 
@@ -242,11 +541,21 @@ func (s *Server) Start() error {
 	// Now we've attempted to join the cluster, we can start the upstream
 	// server and proxy server.
 	s.startUpstreamServer()
+	s.startStaticUpstreams()
 	s.startProxyServer()
+	s.startLoadReporting()
+	s.startPlugins()
+	s.startFederation()
+
+	// If the node restarted, wait for the upstreams that were connected
+	// before the restart to reconnect, so the load balancer doesn't route
+	// requests to the node until it can serve them locally.
+	s.waitForUpstreams()
 
 	// Now we've joined the cluster and started all servers, mark the server
 	// as ready to begin accepting requests.
 	s.adminServer.SetReady(true)
+	s.startReadyHint()
 
 	// If we couldn't join the cluster on the first attempt, now the node is
 	// ready we can retry.
@@ -271,22 +580,89 @@ func (s *Server) Start() error {
 	return nil
 }
 
-// Shutdown gracefully stops the server node.
+// Shutdown gracefully stops the server node, waiting up to the configured
+// grace period.
 func (s *Server) Shutdown() {
+	s.shutdownWithGrace(s.conf.GracePeriod)
+}
+
+// RequestShutdown requests the server node to gracefully shutdown with the
+// given grace period, which may differ from the configured grace period.
+// The shutdown is handled by Wait.
+//
+// If the node is already shutting down, the remaining grace period is
+// shortened to the given grace period, such as to expedite a stuck shutdown.
+// A grace period of zero forces an immediate shutdown.
+func (s *Server) RequestShutdown(grace time.Duration) {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+
+	if s.shutdownTimer != nil {
+		s.expediteShutdownLocked(grace)
+		return
+	}
+
+	select {
+	case s.shutdownCh <- grace:
+		return
+	default:
+	}
+
+	// A shutdown was already requested, so use the shortest grace period.
+	select {
+	case pending := <-s.shutdownCh:
+		grace = min(grace, pending)
+	default:
+		// Wait received the pending request, in which case the shutdown
+		// applies this request once it starts.
+	}
+	s.shutdownCh <- grace
+}
+
+func (s *Server) shutdownWithGrace(grace time.Duration) {
 	if !s.shutdown.CompareAndSwap(false, true) {
 		s.logger.Warn("server already being shutdown")
 	}
 
-	s.logger.Info("starting shutdown")
+	s.logger.Info("starting shutdown", zap.Duration("grace-period", grace))
 
-	ctx, cancel := context.WithTimeout(
-		context.Background(), s.conf.GracePeriod,
-	)
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	s.shutdownMu.Lock()
+	s.shutdownTimer = time.AfterFunc(grace, cancel)
+	s.shutdownStarted = time.Now()
+	s.shutdownDeadline = s.shutdownStarted.Add(grace)
+	s.shutdownInitial = int64(s.localUpstreams()) +
+		s.proxyServer.Inflight() +
+		s.proxyServer.TCPConns()
+	// Apply any shutdown requested after Wait returned but before the
+	// shutdown started.
+	select {
+	case pending := <-s.shutdownCh:
+		s.expediteShutdownLocked(pending)
+	default:
+	}
+	s.shutdownMu.Unlock()
+
+	defer s.shutdownTimer.Stop()
+
 	// Set the ready to false to stop incoming traffic.
 	s.adminServer.SetReady(false)
 
+	// Persist the local upstreams before closing them, so the node waits for
+	// them to reconnect once it restarts.
+	s.shutdownReadyHint()
+
+	// Announce the local upstreams are expected to resume before closing
+	// them, so other nodes hold requests while the upstreams reconnect rather
+	// than failing.
+	if s.conf.Upstream.ResumeWindow > 0 {
+		s.clusterState.ResumeLocalEndpoints(
+			time.Now().Add(s.conf.Upstream.ResumeWindow),
+		)
+	}
+
 	// Shutdown the upstream server and close active upstream connections.
 	//
 	// We close upstream connections first since as long as we have upstream
@@ -295,13 +671,20 @@ func (s *Server) Shutdown() {
 	//
 	// We could still get requests from the proxy server but they'll be routed
 	// to other nodes.
+	s.setShutdownPhase(shutdownPhaseUpstreams)
+	s.shutdownLoadReporting()
 	s.shutdownUpstreamServer(ctx)
+	s.shutdownStaticUpstreams()
 
 	// Now we no longer have any connected upstreams, we'll no longer get
 	// requests from other cluster nodes so can shut down the proxy server.
+	s.setShutdownPhase(shutdownPhaseProxy)
 	s.shutdownProxyServer(ctx)
+	s.shutdownPlugins()
+	s.shutdownFederation()
 
 	// Leave the cluster.
+	s.setShutdownPhase(shutdownPhaseCluster)
 	if err := s.gossiper.Leave(ctx); err != nil {
 		s.logger.Warn("failed to leave cluster", zap.Error(err))
 	} else {
@@ -311,10 +694,17 @@ func (s *Server) Shutdown() {
 	// Now we've left the cluster we can safely close the gossip listeners.
 	s.gossiper.Close()
 
+	s.setShutdownPhase(shutdownPhaseAdmin)
 	s.shutdownAdminServer(ctx)
 
 	s.shutdownUsageReporting()
 
+	// Close the auditor last since the servers may record events until
+	// they've shutdown.
+	s.shutdownAuditor()
+
+	s.shutdownStore()
+
 	s.wg.Wait()
 
 	s.logger.Info("shutdown complete")
@@ -328,18 +718,105 @@ func (s *Server) ClusterState() *cluster.State {
 	return s.clusterState
 }
 
+// SetConfigLoader sets the function used to load the configuration when
+// reloading, such as re-reading the configuration files.
+func (s *Server) SetConfigLoader(loadConfig func() (*config.Config, error)) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.loadConfig = loadConfig
+}
+
+// Reload loads the configuration and applies any changes that support
+// reloading without restarting the server.
+//
+// Currently only the auth configuration is reloaded.
+func (s *Server) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if s.loadConfig == nil {
+		return fmt.Errorf("no config loader")
+	}
+	conf, err := s.loadConfig()
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	return s.reloadAuthLocked(conf.Auth)
+}
+
+// ReloadAuth replaces the auth configuration, such as to rotate the token
+// keys.
+//
+// New connections and requests are verified with the new configuration,
+// while connected upstreams keep their verified token until it expires.
+// Enabling or disabling auth, or changing whether proxy requests are
+// authenticated, requires a restart.
+func (s *Server) ReloadAuth(conf auth.Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	return s.reloadAuthLocked(conf)
+}
+
+func (s *Server) reloadAuthLocked(conf auth.Config) error {
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+	if conf.AuthEnabled() != s.authConf.AuthEnabled() {
+		return fmt.Errorf("auth: cannot enable or disable auth without restarting")
+	}
+	if conf.AuthenticateProxy != s.authConf.AuthenticateProxy {
+		return fmt.Errorf("auth: cannot change authenticate proxy without restarting")
+	}
+
+	if conf == s.authConf {
+		s.logger.Info("auth config unchanged")
+		return nil
+	}
+
+	verifier, err := conf.Load()
+	if err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+	if verifier != nil {
+		s.verifier.Update(verifier)
+	}
+	s.authConf = conf
+
+	s.logger.Info("reloaded auth config")
+
+	return nil
+}
+
+// expediteShutdownLocked shortens the grace period of the active shutdown if
+// the given grace period expires before the remaining grace period.
+func (s *Server) expediteShutdownLocked(grace time.Duration) {
+	deadline := time.Now().Add(grace)
+	if !deadline.Before(s.shutdownDeadline) {
+		return
+	}
+
+	s.logger.Info("expediting shutdown", zap.Duration("grace-period", grace))
+
+	s.shutdownTimer.Reset(grace)
+	s.shutdownDeadline = deadline
+}
+
 // Wait waits for the server to be shutdown, either due to the given context
-// being cancelled or a fatal error in the server. Returns whether the server
-// exited due to being gracefully shutdown or a fatal error.
+// being cancelled, a shutdown being requested with RequestShutdown, or a fatal
+// error in the server. Returns whether the server exited due to being
+// gracefully shutdown or a fatal error.
 func (s *Server) Wait(ctx context.Context) bool {
 	ok := true
+	grace := s.conf.GracePeriod
 	select {
 	case <-ctx.Done():
+	case grace = <-s.shutdownCh:
 	case <-s.fatalCh:
 		ok = false
 	}
 
-	s.Shutdown()
+	s.shutdownWithGrace(grace)
 	return ok
 }
 
@@ -359,7 +836,7 @@ func (s *Server) startGossip() error {
 
 	if s.conf.Gossip.AdvertiseAddr == "" {
 		advertiseAddr, err := advertiseAddrFromListenAddr(
-			gossipStreamLn.Addr().String(),
+			gossipStreamLn.Addr().String(), s.conf.Cluster.AdvertiseHost,
 		)
 		if err != nil {
 			// Should never happen.
@@ -368,25 +845,62 @@ func (s *Server) startGossip() error {
 		s.conf.Gossip.AdvertiseAddr = advertiseAddr
 	}
 
-	s.gossiper = gossip.NewGossip(
+	s.gossiper, err = gossip.NewGossip(
 		s.clusterState,
 		gossipStreamLn,
 		gossipPacketLn,
 		&s.conf.Gossip,
+		s.logger.Levels(),
 		s.logger,
 	)
+	if err != nil {
+		gossipStreamLn.Close()
+		gossipPacketLn.Close()
+		return fmt.Errorf("gossip: %w", err)
+	}
 	s.gossiper.Metrics().Register(s.registry)
+	s.gossiper.SyncerMetrics().Register(s.registry)
+	s.gossiper.StartEndpointReconciler(s.localEndpoints)
+	s.adminServer.SetLogLevelPropagator(s.gossiper)
+	s.adminServer.SetZoneDrainer(s.gossiper)
+	s.adminServer.SetGossipState(s.gossiper)
 	s.adminServer.AddStatus("/gossip", gossip.NewStatus(s.gossiper))
 
 	return nil
 }
 
 func (s *Server) startProxyServer() {
+	s.proxyServer.ProbeNodes(s.clusterState)
+
 	s.runGoroutine(func() {
 		if err := s.proxyServer.Serve(s.proxyLn); err != nil {
 			s.logger.Error("failed to run proxy server", zap.Error(err))
 		}
 	})
+
+	if s.proxyPacketConn != nil {
+		s.runGoroutine(func() {
+			if err := s.proxyServer.ServeHTTP3(s.proxyPacketConn); err != nil {
+				s.logger.Error("failed to run proxy http3 server", zap.Error(err))
+			}
+		})
+	}
+
+	if s.proxyForwardLn != nil {
+		s.runGoroutine(func() {
+			if err := s.proxyServer.ServeForward(s.proxyForwardLn); err != nil {
+				s.logger.Error("failed to run proxy forward server", zap.Error(err))
+			}
+		})
+	}
+
+	if s.proxyTCPLn != nil {
+		s.runGoroutine(func() {
+			if err := s.proxyServer.ServeTCP(s.proxyTCPLn); err != nil {
+				s.logger.Error("failed to run proxy tcp server", zap.Error(err))
+			}
+		})
+	}
 }
 
 func (s *Server) startUpstreamServer() {
@@ -403,6 +917,30 @@ func (s *Server) startAdminServer() {
 			s.logger.Error("failed to run admin server", zap.Error(err))
 		}
 	})
+
+	if s.adminGRPCServer != nil {
+		s.runGoroutine(func() {
+			if err := s.adminGRPCServer.Serve(s.adminGRPCLn); err != nil {
+				s.logger.Error("failed to run grpc admin server", zap.Error(err))
+			}
+		})
+	}
+
+	if s.healthServer != nil {
+		s.runGoroutine(func() {
+			if err := s.healthServer.Serve(s.healthLn); err != nil {
+				s.logger.Error("failed to run health server", zap.Error(err))
+			}
+		})
+	}
+
+	if s.metricsServer != nil {
+		s.runGoroutine(func() {
+			if err := s.metricsServer.Serve(s.metricsLn); err != nil {
+				s.logger.Error("failed to run metrics server", zap.Error(err))
+			}
+		})
+	}
 }
 
 func (s *Server) startUsageReporting() {
@@ -411,10 +949,38 @@ func (s *Server) startUsageReporting() {
 	})
 }
 
+func (s *Server) startLoadReporting() {
+	s.runGoroutine(func() {
+		s.loadReporter.Start()
+	})
+}
+
+func (s *Server) startPlugins() {
+	if s.plugins == nil {
+		return
+	}
+	s.runGoroutine(func() {
+		s.plugins.Start()
+	})
+}
+
+func (s *Server) startFederation() {
+	if s.federation == nil {
+		return
+	}
+	s.runGoroutine(func() {
+		s.federation.Start()
+	})
+}
+
 func (s *Server) shutdownProxyServer(ctx context.Context) {
 	if err := s.proxyServer.Shutdown(ctx); err != nil {
 		s.logger.Error("failed to shutdown proxy server", zap.Error(err))
 	}
+	if s.proxyPacketConn != nil {
+		// The HTTP/3 server doesn't close the connection on shutdown.
+		s.proxyPacketConn.Close()
+	}
 	s.logger.Info("shutdown proxy server")
 }
 
@@ -422,6 +988,55 @@ func (s *Server) shutdownUsageReporting() {
 	s.reporter.Stop()
 }
 
+func (s *Server) shutdownLoadReporting() {
+	s.loadReporter.Stop()
+}
+
+func (s *Server) shutdownPlugins() {
+	if s.plugins == nil {
+		return
+	}
+	s.plugins.Stop()
+}
+
+func (s *Server) shutdownFederation() {
+	if s.federation == nil {
+		return
+	}
+	s.federation.Stop()
+}
+
+func (s *Server) shutdownAuditor() {
+	if s.auditor == nil {
+		return
+	}
+	if err := s.auditor.Close(); err != nil {
+		s.logger.Error("failed to close auditor", zap.Error(err))
+	}
+}
+
+func (s *Server) shutdownStore() {
+	if err := s.store.Close(); err != nil {
+		s.logger.Error("failed to close store", zap.Error(err))
+	}
+}
+
+// startStaticUpstreams adds the static upstreams to the upstream manager, so
+// they're load balanced alongside connected upstreams.
+func (s *Server) startStaticUpstreams() {
+	for _, u := range s.staticUpstreams {
+		s.upstreams.AddConn(u)
+	}
+}
+
+// shutdownStaticUpstreams removes the static upstreams, so other nodes no
+// longer forward requests to the node.
+func (s *Server) shutdownStaticUpstreams() {
+	for _, u := range s.staticUpstreams {
+		s.upstreams.RemoveConn(u)
+	}
+}
+
 func (s *Server) shutdownUpstreamServer(ctx context.Context) {
 	if err := s.upstreamServer.Shutdown(ctx); err != nil {
 		s.logger.Error("failed to shutdown upstream server", zap.Error(err))
@@ -433,6 +1048,25 @@ func (s *Server) shutdownAdminServer(ctx context.Context) {
 	if err := s.adminServer.Shutdown(ctx); err != nil {
 		s.logger.Error("failed to shutdown admin server", zap.Error(err))
 	}
+
+	if s.adminGRPCServer != nil {
+		if err := s.adminGRPCServer.Shutdown(ctx); err != nil {
+			s.logger.Error("failed to shutdown grpc admin server", zap.Error(err))
+		}
+	}
+
+	if s.healthServer != nil {
+		if err := s.healthServer.Shutdown(ctx); err != nil {
+			s.logger.Error("failed to shutdown health server", zap.Error(err))
+		}
+	}
+
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			s.logger.Error("failed to shutdown metrics server", zap.Error(err))
+		}
+	}
+
 	s.logger.Info("shutdown admin server")
 }
 
@@ -445,7 +1079,9 @@ func (s *Server) proxyListen() (net.Listener, error) {
 	// Note using listen address rather than the configured bind address to
 	// support port 0.
 	if s.conf.Proxy.AdvertiseAddr == "" {
-		advertiseAddr, err := advertiseAddrFromListenAddr(ln.Addr().String())
+		advertiseAddr, err := advertiseAddrFromListenAddr(
+			ln.Addr().String(), s.conf.Cluster.AdvertiseHost,
+		)
 		if err != nil {
 			// Should never happen.
 			panic("invalid listen address: " + err.Error())
@@ -456,6 +1092,26 @@ func (s *Server) proxyListen() (net.Listener, error) {
 	return ln, nil
 }
 
+func (s *Server) proxyForwardListen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", s.conf.Proxy.Forward.BindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %s: %w", s.conf.Proxy.Forward.BindAddr, err)
+	}
+	// If the advertise address is not set, infer it from the listen address.
+	if s.conf.Proxy.Forward.AdvertiseAddr == "" {
+		advertiseAddr, err := advertiseAddrFromListenAddr(
+			ln.Addr().String(), s.conf.Cluster.AdvertiseHost,
+		)
+		if err != nil {
+			// Should never happen.
+			panic("invalid listen address: " + err.Error())
+		}
+		s.conf.Proxy.Forward.AdvertiseAddr = advertiseAddr
+	}
+
+	return ln, nil
+}
+
 func (s *Server) upstreamListen() (net.Listener, error) {
 	ln, err := net.Listen("tcp", s.conf.Upstream.BindAddr)
 	if err != nil {
@@ -465,7 +1121,9 @@ func (s *Server) upstreamListen() (net.Listener, error) {
 	// Note using listen address rather than the configured bind address to
 	// support port 0.
 	if s.conf.Upstream.AdvertiseAddr == "" {
-		advertiseAddr, err := advertiseAddrFromListenAddr(ln.Addr().String())
+		advertiseAddr, err := advertiseAddrFromListenAddr(
+			ln.Addr().String(), s.conf.Cluster.AdvertiseHost,
+		)
 		if err != nil {
 			// Should never happen.
 			panic("invalid listen address: " + err.Error())
@@ -485,7 +1143,9 @@ func (s *Server) adminListen() (net.Listener, error) {
 	// Note using listen address rather than the configured bind address to
 	// support port 0.
 	if s.conf.Admin.AdvertiseAddr == "" {
-		advertiseAddr, err := advertiseAddrFromListenAddr(ln.Addr().String())
+		advertiseAddr, err := advertiseAddrFromListenAddr(
+			ln.Addr().String(), s.conf.Cluster.AdvertiseHost,
+		)
 		if err != nil {
 			// Should never happen.
 			panic("invalid listen address: " + err.Error())
@@ -516,7 +1176,11 @@ func (s *Server) runGoroutine(f func()) {
 	}()
 }
 
-func advertiseAddrFromListenAddr(bindAddr string) (string, error) {
+// advertiseAddrFromListenAddr infers the address to advertise to other nodes
+// from the listen address. If advertiseHost is set, it's advertised with the
+// listen port, otherwise the listen IP is advertised, or the nodes private IP
+// if listening on all interfaces.
+func advertiseAddrFromListenAddr(bindAddr string, advertiseHost string) (string, error) {
 	if strings.HasPrefix(bindAddr, ":") {
 		bindAddr = "0.0.0.0" + bindAddr
 	}
@@ -526,6 +1190,10 @@ func advertiseAddrFromListenAddr(bindAddr string) (string, error) {
 		return "", fmt.Errorf("invalid bind addr: %s: %w", bindAddr, err)
 	}
 
+	if advertiseHost != "" {
+		return net.JoinHostPort(advertiseHost, port), nil
+	}
+
 	if host == "0.0.0.0" || host == "::" {
 		ip, err := sockaddr.GetPrivateIP()
 		if err != nil {
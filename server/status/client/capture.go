@@ -0,0 +1,72 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/andydunstall/piko/server/capture"
+)
+
+type Capture struct {
+	client *Client
+}
+
+func NewCapture(client *Client) *Capture {
+	return &Capture{
+		client: client,
+	}
+}
+
+// Sessions returns the endpoints being captured.
+func (c *Capture) Sessions() ([]capture.Session, error) {
+	r, err := c.client.Request("/status/capture/endpoints")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var sessions []capture.Session
+	if err := json.NewDecoder(r).Decode(&sessions); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return sessions, nil
+}
+
+// Enable enables capturing requests to the endpoint.
+func (c *Capture) Enable(endpointID string, conf capture.Config) (*capture.Session, error) {
+	r, err := c.client.Put("/status/capture/endpoints/"+endpointID, conf)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var session capture.Session
+	if err := json.NewDecoder(r).Decode(&session); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &session, nil
+}
+
+// Disable disables capturing requests to the endpoint.
+func (c *Capture) Disable(endpointID string) error {
+	r, err := c.client.Delete("/status/capture/endpoints/" + endpointID)
+	if err != nil {
+		return err
+	}
+	return r.Close()
+}
+
+// Records returns the captured requests to the endpoint.
+func (c *Capture) Records(endpointID string) ([]capture.Record, error) {
+	r, err := c.client.Request("/status/capture/endpoints/" + endpointID + "/records")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var records []capture.Record
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return records, nil
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/andydunstall/piko/server/catalogue"
+)
+
+type Catalogue struct {
+	client *Client
+}
+
+func NewCatalogue(client *Client) *Catalogue {
+	return &Catalogue{
+		client: client,
+	}
+}
+
+func (c *Catalogue) Endpoints() ([]*catalogue.EndpointStatus, error) {
+	r, err := c.client.Request("/status/catalogue/endpoints")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var endpoints []*catalogue.EndpointStatus
+	if err := json.NewDecoder(r).Decode(&endpoints); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return endpoints, nil
+}
+
+func (c *Catalogue) Endpoint(endpointID string) (*catalogue.EndpointStatus, error) {
+	r, err := c.client.Request("/status/catalogue/endpoints/" + endpointID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var endpoint catalogue.EndpointStatus
+	if err := json.NewDecoder(r).Decode(&endpoint); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &endpoint, nil
+}
@@ -1,6 +1,8 @@
 package client
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -15,6 +17,8 @@ type Client struct {
 	url *url.URL
 
 	forward string
+
+	token string
 }
 
 func NewClient(url *url.URL) *Client {
@@ -34,7 +38,40 @@ func (c *Client) SetForward(forward string) {
 	c.forward = forward
 }
 
+// SetToken sets the admin token to authenticate requests, which is required
+// for mutating requests when the server has authentication enabled.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// Request sends a GET request to the given path and returns the response
+// body.
 func (c *Client) Request(path string) (io.ReadCloser, error) {
+	return c.request(http.MethodGet, path, nil)
+}
+
+// Post sends a POST request to the given path and returns the response body.
+func (c *Client) Post(path string) (io.ReadCloser, error) {
+	return c.request(http.MethodPost, path, nil)
+}
+
+// Put sends a PUT request to the given path with the given value encoded as
+// a JSON body and returns the response body.
+func (c *Client) Put(path string, v interface{}) (io.ReadCloser, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encode request: %w", err)
+	}
+	return c.request(http.MethodPut, path, bytes.NewReader(b))
+}
+
+// Delete sends a DELETE request to the given path and returns the response
+// body.
+func (c *Client) Delete(path string) (io.ReadCloser, error) {
+	return c.request(http.MethodDelete, path, nil)
+}
+
+func (c *Client) request(method string, path string, body io.Reader) (io.ReadCloser, error) {
 	url := new(url.URL)
 	*url = *c.url
 
@@ -44,10 +81,13 @@ func (c *Client) Request(path string) (io.ReadCloser, error) {
 
 	url.Path = fspath.Join(url.Path, path)
 
-	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	req, err := http.NewRequest(method, url.String(), body)
 	if err != nil {
 		return nil, fmt.Errorf("request: %w", err)
 	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/andydunstall/piko/pkg/gossip"
+	servergossip "github.com/andydunstall/piko/server/gossip"
 )
 
 type Gossip struct {
@@ -31,6 +32,69 @@ func (c *Gossip) Nodes() ([]gossip.NodeMetadata, error) {
 	return nodes, nil
 }
 
+// Conflicts returns the detected node ID conflicts.
+func (c *Gossip) Conflicts() ([]gossip.NodeConflict, error) {
+	r, err := c.client.Request("/status/gossip/conflicts")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var conflicts []gossip.NodeConflict
+	if err := json.NewDecoder(r).Decode(&conflicts); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return conflicts, nil
+}
+
+// ClockSkew returns the estimated clock skew of each known node relative to
+// the node.
+func (c *Gossip) ClockSkew() ([]gossip.NodeClockSkew, error) {
+	r, err := c.client.Request("/status/gossip/skew")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var skews []gossip.NodeClockSkew
+	if err := json.NewDecoder(r).Decode(&skews); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return skews, nil
+}
+
+// Compact triggers a compaction of the nodes local state and returns the
+// number of discarded entries.
+func (c *Gossip) Pending() ([]servergossip.PendingNode, error) {
+	r, err := c.client.Request("/status/gossip/pending")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var nodes []servergossip.PendingNode
+	if err := json.NewDecoder(r).Decode(&nodes); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return nodes, nil
+}
+
+func (c *Gossip) Compact() (int, error) {
+	r, err := c.client.Post("/status/gossip/compact")
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	var resp struct {
+		Discarded int `json:"discarded"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return 0, fmt.Errorf("decode response: %w", err)
+	}
+	return resp.Discarded, nil
+}
+
 func (c *Gossip) Node(nodeID string) (*gossip.NodeState, error) {
 	r, err := c.client.Request("/status/gossip/nodes/" + nodeID)
 	if err != nil {
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/andydunstall/piko/server/proxy"
+)
+
+type Proxy struct {
+	client *Client
+}
+
+func NewProxy(client *Client) *Proxy {
+	return &Proxy{
+		client: client,
+	}
+}
+
+func (c *Proxy) Latency() ([]proxy.EndpointLatency, error) {
+	r, err := c.client.Request("/status/proxy/latency")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var endpoints []proxy.EndpointLatency
+	if err := json.NewDecoder(r).Decode(&endpoints); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return endpoints, nil
+}
+
+func (c *Proxy) EndpointLatency(endpointID string) (*proxy.EndpointLatency, error) {
+	r, err := c.client.Request("/status/proxy/latency/" + endpointID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var endpoint proxy.EndpointLatency
+	if err := json.NewDecoder(r).Decode(&endpoint); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &endpoint, nil
+}
+
+func (c *Proxy) Health() ([]proxy.EndpointHealth, error) {
+	r, err := c.client.Request("/status/proxy/health")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var endpoints []proxy.EndpointHealth
+	if err := json.NewDecoder(r).Decode(&endpoints); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return endpoints, nil
+}
+
+func (c *Proxy) EndpointHealth(endpointID string) (*proxy.EndpointHealth, error) {
+	r, err := c.client.Request("/status/proxy/health/" + endpointID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var endpoint proxy.EndpointHealth
+	if err := json.NewDecoder(r).Decode(&endpoint); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &endpoint, nil
+}
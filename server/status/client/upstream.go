@@ -3,6 +3,8 @@ package client
 import (
 	"encoding/json"
 	"fmt"
+
+	"github.com/andydunstall/piko/server/upstream"
 )
 
 type Upstream struct {
@@ -28,3 +30,17 @@ func (c *Upstream) Endpoints() (map[string]int, error) {
 	}
 	return endpoints, nil
 }
+
+func (c *Upstream) Latency() ([]upstream.UpstreamLatency, error) {
+	r, err := c.client.Request("/status/upstream/latency")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var upstreams []upstream.UpstreamLatency
+	if err := json.NewDecoder(r).Decode(&upstreams); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return upstreams, nil
+}
@@ -10,6 +10,9 @@ import (
 type ServerConfig struct {
 	// URL is the server URL.
 	URL string `json:"url"`
+
+	// Token is the admin token to authenticate requests.
+	Token string `json:"token"`
 }
 
 func (c *ServerConfig) Validate() error {
@@ -45,6 +48,16 @@ Piko server URL. This URL should point to the server admin port.
 `,
 	)
 
+	fs.StringVar(
+		&c.Server.Token,
+		"server.token",
+		"",
+		`
+Admin token to authenticate requests. When the server has authentication
+enabled, mutating requests require a token with the 'admin' type.
+`,
+	)
+
 	fs.StringVar(
 		&c.Forward,
 		"forward",
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// boltOpenTimeout is the timeout to acquire the file lock when opening
+	// the bbolt file, such as if another node is using the same file.
+	boltOpenTimeout = time.Second * 5
+)
+
+var (
+	boltBucket = []byte("piko")
+)
+
+// BoltStore is a store that persists state to a local bbolt file, so state
+// survives restarts of single node deployments.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens the bbolt file at the given path, creating the file if
+// it doesn't exist.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{
+		Timeout: boltOpenTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open: %s: %w", path, err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create bucket: %w", err)
+	}
+
+	return &BoltStore{
+		db: db,
+	}, nil
+}
+
+func (s *BoltStore) Get(_ context.Context, key string) ([]byte, error) {
+	var value []byte
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		// The value is only valid for the lifetime of the transaction.
+		value = append([]byte(nil), v...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (s *BoltStore) Put(_ context.Context, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// bbolt treats a nil value as a missing key.
+		if value == nil {
+			value = []byte{}
+		}
+		return tx.Bucket(boltBucket).Put([]byte(key), value)
+	})
+}
+
+func (s *BoltStore) Delete(_ context.Context, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+func (s *BoltStore) List(_ context.Context, prefix string) ([]Entry, error) {
+	var entries []Entry
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		p := []byte(prefix)
+		// Keys are sorted, so iterate from the first key with the prefix
+		// until the first key without.
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			entries = append(entries, Entry{
+				Key:   string(k),
+				Value: append([]byte(nil), v...),
+			})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+var _ Store = &BoltStore{}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// BackendMemory keeps state in memory, so state is lost when the node
+	// restarts and isn't shared with other nodes.
+	BackendMemory = "memory"
+
+	// BackendBolt persists state to a local bbolt file, so state survives
+	// restarts of single node deployments.
+	BackendBolt = "bolt"
+
+	// BackendEtcd persists state to an external etcd cluster, which may be
+	// shared by all nodes.
+	BackendEtcd = "etcd"
+)
+
+type EtcdConfig struct {
+	// Endpoints contains the addresses of the etcd cluster members.
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+
+	// Prefix is prepended to all keys, so multiple Piko clusters can share
+	// an etcd cluster.
+	Prefix string `json:"prefix" yaml:"prefix"`
+
+	Username string `json:"username" yaml:"username"`
+
+	Password string `json:"password" yaml:"password"`
+
+	// DialTimeout is the timeout to connect to the etcd cluster.
+	DialTimeout time.Duration `json:"dial_timeout" yaml:"dial_timeout"`
+
+	// Timeout is the timeout for each request to the etcd cluster.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func (c *EtcdConfig) Validate() error {
+	if len(c.Endpoints) == 0 {
+		return fmt.Errorf("missing endpoints")
+	}
+	if c.DialTimeout == 0 {
+		return fmt.Errorf("missing dial timeout")
+	}
+	if c.Timeout == 0 {
+		return fmt.Errorf("missing timeout")
+	}
+	return nil
+}
+
+type Config struct {
+	// Backend is the storage backend, either 'memory', 'bolt' or 'etcd'.
+	Backend string `json:"backend" yaml:"backend"`
+
+	// Path is the path of the bbolt file when using the 'bolt' backend.
+	Path string `json:"path" yaml:"path"`
+
+	Etcd EtcdConfig `json:"etcd" yaml:"etcd"`
+}
+
+func (c *Config) Validate() error {
+	switch c.Backend {
+	case BackendMemory:
+	case BackendBolt:
+		if c.Path == "" {
+			return fmt.Errorf("missing path")
+		}
+	case BackendEtcd:
+		if err := c.Etcd.Validate(); err != nil {
+			return fmt.Errorf("etcd: %w", err)
+		}
+	case "":
+		return fmt.Errorf("missing backend")
+	default:
+		return fmt.Errorf("unsupported backend: %s", c.Backend)
+	}
+	return nil
+}
+
+func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.Backend,
+		"storage.backend",
+		c.Backend,
+		`
+Backend to store dynamic state that must survive beyond gossip, such as
+state added via the admin API.
+
+Supports:
+- memory: State is kept in memory, so is lost when the node restarts
+- bolt: State is persisted to a local file (see '--storage.path'), so
+survives restarts of single node deployments
+- etcd: State is persisted to an external etcd cluster (see
+'--storage.etcd.endpoints'), which can be shared by all nodes`,
+	)
+	fs.StringVar(
+		&c.Path,
+		"storage.path",
+		c.Path,
+		`
+Path of the file to persist state to when using the 'bolt' backend. The file
+is created if it doesn't exist.
+
+The file is locked while the server is running, so each node must use a
+different file.`,
+	)
+	fs.StringSliceVar(
+		&c.Etcd.Endpoints,
+		"storage.etcd.endpoints",
+		c.Etcd.Endpoints,
+		`
+Addresses of the etcd cluster members when using the 'etcd' backend, such
+as 'etcd-1:2379,etcd-2:2379'.`,
+	)
+	fs.StringVar(
+		&c.Etcd.Prefix,
+		"storage.etcd.prefix",
+		c.Etcd.Prefix,
+		`
+Prefix added to all etcd keys, so multiple Piko clusters can share an etcd
+cluster.`,
+	)
+	fs.StringVar(
+		&c.Etcd.Username,
+		"storage.etcd.username",
+		c.Etcd.Username,
+		`
+Username to authenticate with etcd. If empty, requests are not
+authenticated.`,
+	)
+	fs.StringVar(
+		&c.Etcd.Password,
+		"storage.etcd.password",
+		c.Etcd.Password,
+		`
+Password to authenticate with etcd.`,
+	)
+	fs.DurationVar(
+		&c.Etcd.DialTimeout,
+		"storage.etcd.dial-timeout",
+		c.Etcd.DialTimeout,
+		`
+Timeout to connect to the etcd cluster.`,
+	)
+	fs.DurationVar(
+		&c.Etcd.Timeout,
+		"storage.etcd.timeout",
+		c.Etcd.Timeout,
+		`
+Timeout for each request to the etcd cluster.`,
+	)
+}
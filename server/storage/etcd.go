@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// EtcdStore is a store that persists state to an external etcd cluster.
+//
+// Multiple nodes may share the same etcd cluster and prefix, so each node
+// sees the state written by the others.
+type EtcdStore struct {
+	client *clientv3.Client
+
+	conf EtcdConfig
+}
+
+// NewEtcdStore returns a store using the configured etcd cluster.
+//
+// The client connects to the cluster in the background, so this doesn't
+// fail if the cluster is unreachable.
+func NewEtcdStore(conf EtcdConfig, logger log.Logger) (*EtcdStore, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   conf.Endpoints,
+		DialTimeout: conf.DialTimeout,
+		Username:    conf.Username,
+		Password:    conf.Password,
+		// Disable the etcd client logs, which don't use the Piko log
+		// format.
+		Logger: zap.NewNop(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+
+	logger.Info(
+		"connecting to etcd",
+		zap.Strings("endpoints", conf.Endpoints),
+		zap.String("prefix", conf.Prefix),
+	)
+
+	return &EtcdStore{
+		client: client,
+		conf:   conf,
+	}, nil
+}
+
+func (s *EtcdStore) Get(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.conf.Timeout)
+	defer cancel()
+
+	resp, err := s.client.Get(ctx, s.conf.Prefix+key)
+	if err != nil {
+		return nil, fmt.Errorf("get: %w", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrNotFound
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (s *EtcdStore) Put(ctx context.Context, key string, value []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.conf.Timeout)
+	defer cancel()
+
+	if _, err := s.client.Put(ctx, s.conf.Prefix+key, string(value)); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	return nil
+}
+
+func (s *EtcdStore) Delete(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.conf.Timeout)
+	defer cancel()
+
+	if _, err := s.client.Delete(ctx, s.conf.Prefix+key); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	return nil
+}
+
+func (s *EtcdStore) List(ctx context.Context, prefix string) ([]Entry, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.conf.Timeout)
+	defer cancel()
+
+	resp, err := s.client.Get(
+		ctx,
+		s.conf.Prefix+prefix,
+		clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list: %w", err)
+	}
+
+	entries := make([]Entry, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		entries = append(entries, Entry{
+			Key:   strings.TrimPrefix(string(kv.Key), s.conf.Prefix),
+			Value: kv.Value,
+		})
+	}
+	return entries, nil
+}
+
+func (s *EtcdStore) Close() error {
+	return s.client.Close()
+}
+
+var _ Store = &EtcdStore{}
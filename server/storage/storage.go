@@ -0,0 +1,74 @@
+// Package storage persists dynamic state that must be durable beyond
+// gossip, such as state added via the admin API.
+//
+// Gossip only replicates state between the nodes that are running, so state
+// is lost when all nodes restart. A store instead persists state to a local
+// file, for single node deployments, or an external etcd cluster, for large
+// deployments.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+var (
+	// ErrNotFound is returned when the requested key doesn't exist.
+	ErrNotFound = errors.New("not found")
+)
+
+// Entry is a key-value pair in the store.
+type Entry struct {
+	Key   string
+	Value []byte
+}
+
+// Store is a key-value store of dynamic state.
+//
+// Features should namespace their keys with a prefix, such as
+// 'catalogue/', so they can list their own entries.
+type Store interface {
+	// Get returns the value of the given key, or ErrNotFound if the key
+	// doesn't exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Put sets the value of the given key, replacing any existing value.
+	Put(ctx context.Context, key string, value []byte) error
+
+	// Delete removes the given key. Deleting a key that doesn't exist is
+	// not an error.
+	Delete(ctx context.Context, key string) error
+
+	// List returns the entries whose key has the given prefix, sorted by
+	// key.
+	List(ctx context.Context, prefix string) ([]Entry, error)
+
+	// Close closes the store.
+	Close() error
+}
+
+// New returns the store for the configured backend. The configuration must
+// be validated.
+func New(conf Config, logger log.Logger) (Store, error) {
+	logger = logger.WithSubsystem("storage")
+
+	switch conf.Backend {
+	case BackendBolt:
+		store, err := NewBoltStore(conf.Path)
+		if err != nil {
+			return nil, fmt.Errorf("bolt: %w", err)
+		}
+		return store, nil
+	case BackendEtcd:
+		store, err := NewEtcdStore(conf.Etcd, logger)
+		if err != nil {
+			return nil, fmt.Errorf("etcd: %w", err)
+		}
+		return store, nil
+	default:
+		return NewMemoryStore(), nil
+	}
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	t.Run("get", func(t *testing.T) {
+		require.NoError(t, store.Put(ctx, "get/foo", []byte("bar")))
+
+		value, err := store.Get(ctx, "get/foo")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("bar"), value)
+
+		// Put replaces the existing value.
+		require.NoError(t, store.Put(ctx, "get/foo", []byte("car")))
+
+		value, err = store.Get(ctx, "get/foo")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("car"), value)
+	})
+
+	t.Run("get not found", func(t *testing.T) {
+		_, err := store.Get(ctx, "unknown")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, store.Put(ctx, "delete/foo", []byte("bar")))
+		require.NoError(t, store.Delete(ctx, "delete/foo"))
+
+		_, err := store.Get(ctx, "delete/foo")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		// Deleting a missing key is not an error.
+		assert.NoError(t, store.Delete(ctx, "delete/foo"))
+	})
+
+	t.Run("list", func(t *testing.T) {
+		require.NoError(t, store.Put(ctx, "list/b", []byte("2")))
+		require.NoError(t, store.Put(ctx, "list/a", []byte("1")))
+		require.NoError(t, store.Put(ctx, "list/c", []byte("3")))
+		require.NoError(t, store.Put(ctx, "listx", []byte("4")))
+
+		entries, err := store.List(ctx, "list/")
+		require.NoError(t, err)
+		assert.Equal(t, []Entry{
+			{Key: "list/a", Value: []byte("1")},
+			{Key: "list/b", Value: []byte("2")},
+			{Key: "list/c", Value: []byte("3")},
+		}, entries)
+
+		entries, err = store.List(ctx, "unknown/")
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	testStore(t, store)
+}
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "piko.db")
+
+	store, err := NewBoltStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	testStore(t, store)
+
+	t.Run("reopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "piko.db")
+
+		store, err := NewBoltStore(path)
+		require.NoError(t, err)
+		require.NoError(t, store.Put(context.Background(), "foo", []byte("bar")))
+		require.NoError(t, store.Close())
+
+		// Verify the state survives reopening the file.
+		store, err = NewBoltStore(path)
+		require.NoError(t, err)
+		defer store.Close()
+
+		value, err := store.Get(context.Background(), "foo")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("bar"), value)
+	})
+}
+
+func TestConfig(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		conf := Config{Backend: BackendMemory}
+		assert.NoError(t, conf.Validate())
+	})
+
+	t.Run("bolt missing path", func(t *testing.T) {
+		conf := Config{Backend: BackendBolt}
+		assert.EqualError(t, conf.Validate(), "missing path")
+	})
+
+	t.Run("etcd missing endpoints", func(t *testing.T) {
+		conf := Config{Backend: BackendEtcd}
+		assert.EqualError(t, conf.Validate(), "etcd: missing endpoints")
+	})
+
+	t.Run("unsupported backend", func(t *testing.T) {
+		conf := Config{Backend: "foo"}
+		assert.EqualError(t, conf.Validate(), "unsupported backend: foo")
+	})
+}
@@ -0,0 +1,111 @@
+package upstream
+
+import (
+	"strconv"
+
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+// affinityScore returns the rendezvous hashing score of the candidate for
+// the given key. The candidate with the highest score is selected, so when a
+// candidate is added or removed only the keys mapped to that candidate move.
+func affinityScore(key string, candidate string) uint64 {
+	// FNV-1a hash of the key and candidate, inlined to avoid allocating.
+	h := uint64(14695981039346656037)
+	for i := 0; i != len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	// Separate the key and candidate so different splits of the same string
+	// have different hashes.
+	h ^= 0xff
+	h *= 1099511628211
+	for i := 0; i != len(candidate); i++ {
+		h ^= uint64(candidate[i])
+		h *= 1099511628211
+	}
+
+	// FNV-1a doesn't mix the last bytes well, which biases candidates that
+	// only differ by a suffix (such as 'node-1/0' and 'node-1/1'), so add a
+	// finalizer to mix the bits.
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// affinityNode returns the node to select an upstream from for the key, or
+// nil to select a local upstream.
+//
+// local is the number of upstreams connected to the local node, and remote
+// contains the remote nodes with upstreams for the endpoint. Each node has a
+// candidate for each of its upstreams, so nodes are weighted by their number
+// of upstreams. Since all nodes know the number of upstreams on each node,
+// every node selects the same node for a key.
+func affinityNode(
+	key string,
+	endpointID string,
+	localID string,
+	local int,
+	remote []*cluster.Node,
+) *cluster.Node {
+	var best *cluster.Node
+	var bestScore uint64
+	found := false
+
+	score := func(nodeID string, upstreams int) (uint64, bool) {
+		var nodeBest uint64
+		for i := 0; i != upstreams; i++ {
+			if s := affinityScore(key, nodeID+"/"+strconv.Itoa(i)); s > nodeBest {
+				nodeBest = s
+			}
+		}
+		return nodeBest, upstreams > 0
+	}
+
+	if s, ok := score(localID, local); ok {
+		bestScore = s
+		found = true
+	}
+	for _, node := range remote {
+		s, ok := score(node.ID, node.Endpoints[endpointID])
+		if !ok {
+			continue
+		}
+		if !found || s > bestScore {
+			best = node
+			bestScore = s
+			found = true
+		}
+	}
+	return best
+}
+
+// affinityUpstream returns the upstream from the given upstreams for the
+// key, or nil if there are no upstreams.
+func affinityUpstream(key string, upstreams []Upstream) Upstream {
+	var best Upstream
+	var bestScore uint64
+	for i, u := range upstreams {
+		s := affinityScore(key, affinityID(u, i))
+		if best == nil || s > bestScore {
+			best = u
+			bestScore = s
+		}
+	}
+	return best
+}
+
+// affinityID returns the ID of the upstream used as a rendezvous hashing
+// candidate.
+//
+// Upstreams connected to the local node are identified by their address, so
+// an upstream keeps its keys when other upstreams connect or disconnect.
+func affinityID(u Upstream, index int) string {
+	if au, ok := u.(interface{ RemoteAddr() string }); ok {
+		return au.RemoteAddr()
+	}
+	return strconv.Itoa(index)
+}
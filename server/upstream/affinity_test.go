@@ -0,0 +1,128 @@
+package upstream
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+type addrUpstream struct {
+	fakeUpstream
+
+	addr string
+}
+
+func (u *addrUpstream) RemoteAddr() string {
+	return u.addr
+}
+
+func newAddrUpstreams(n int) []Upstream {
+	var upstreams []Upstream
+	for i := 0; i != n; i++ {
+		upstreams = append(upstreams, &addrUpstream{
+			fakeUpstream: fakeUpstream{endpointID: "my-endpoint"},
+			addr:         fmt.Sprintf("10.26.104.%d:5000", i),
+		})
+	}
+	return upstreams
+}
+
+func TestAffinityUpstream(t *testing.T) {
+	t.Run("consistent", func(t *testing.T) {
+		upstreams := newAddrUpstreams(5)
+		for i := 0; i != 100; i++ {
+			key := fmt.Sprintf("10.0.0.%d", i)
+			assert.Equal(t, affinityUpstream(key, upstreams), affinityUpstream(key, upstreams))
+		}
+	})
+
+	t.Run("distribution", func(t *testing.T) {
+		upstreams := newAddrUpstreams(4)
+
+		counts := make(map[Upstream]int)
+		for i := 0; i != 4000; i++ {
+			counts[affinityUpstream(fmt.Sprintf("10.0.%d.%d", i/256, i%256), upstreams)]++
+		}
+		for _, u := range upstreams {
+			assert.InDelta(t, 1000, counts[u], 200)
+		}
+	})
+
+	t.Run("remove upstream", func(t *testing.T) {
+		upstreams := newAddrUpstreams(5)
+		removed := upstreams[2]
+		remaining := append(append([]Upstream{}, upstreams[:2]...), upstreams[3:]...)
+
+		// Only keys mapped to the removed upstream should move.
+		for i := 0; i != 1000; i++ {
+			key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+			before := affinityUpstream(key, upstreams)
+			after := affinityUpstream(key, remaining)
+			if before != removed {
+				assert.Equal(t, before, after)
+			}
+		}
+	})
+
+	t.Run("no upstreams", func(t *testing.T) {
+		assert.Nil(t, affinityUpstream("10.0.0.1", nil))
+	})
+}
+
+func TestAffinityNode(t *testing.T) {
+	t.Run("consistent among nodes", func(t *testing.T) {
+		nodes := []*cluster.Node{
+			{ID: "node-1", Endpoints: map[string]int{"my-endpoint": 2}},
+			{ID: "node-2", Endpoints: map[string]int{"my-endpoint": 3}},
+			{ID: "node-3", Endpoints: map[string]int{"my-endpoint": 1}},
+		}
+
+		// Each node has a different view of the cluster, with itself as
+		// the local node, though they must all select the same node.
+		for i := 0; i != 100; i++ {
+			key := fmt.Sprintf("10.0.0.%d", i)
+
+			var selected []string
+			for _, local := range nodes {
+				var remote []*cluster.Node
+				for _, node := range nodes {
+					if node != local {
+						remote = append(remote, node)
+					}
+				}
+				node := affinityNode(
+					key, "my-endpoint", local.ID, local.Endpoints["my-endpoint"], remote,
+				)
+				if node == nil {
+					selected = append(selected, local.ID)
+				} else {
+					selected = append(selected, node.ID)
+				}
+			}
+			assert.Equal(t, selected[0], selected[1])
+			assert.Equal(t, selected[0], selected[2])
+		}
+	})
+
+	t.Run("weighted by upstreams", func(t *testing.T) {
+		remote := []*cluster.Node{
+			{ID: "node-2", Endpoints: map[string]int{"my-endpoint": 3}},
+		}
+
+		var local int
+		for i := 0; i != 4000; i++ {
+			key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+			if affinityNode(key, "my-endpoint", "node-1", 1, remote) == nil {
+				local++
+			}
+		}
+		assert.InDelta(t, 1000, local, 200)
+	})
+
+	t.Run("no remote upstreams", func(t *testing.T) {
+		assert.Nil(t, affinityNode("10.0.0.1", "my-endpoint", "node-1", 2, nil))
+	})
+}
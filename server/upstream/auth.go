@@ -9,6 +9,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/audit"
 	"github.com/andydunstall/piko/server/auth"
 )
 
@@ -17,15 +18,27 @@ const (
 )
 
 // AuthMiddleware verifies the request token.
+//
+// The middleware only accepts tokens that can be used as the configured token
+// type, such as an upstream listener only accepts upstream tokens.
 type AuthMiddleware struct {
-	verifier auth.Verifier
-	logger   log.Logger
+	verifier  auth.Verifier
+	tokenType auth.TokenType
+	auditor   audit.Auditor
+	logger    log.Logger
 }
 
-func NewAuthMiddleware(verifier auth.Verifier, logger log.Logger) *AuthMiddleware {
+func NewAuthMiddleware(
+	verifier auth.Verifier,
+	tokenType auth.TokenType,
+	auditor audit.Auditor,
+	logger log.Logger,
+) *AuthMiddleware {
 	return &AuthMiddleware{
-		verifier: verifier,
-		logger:   logger,
+		verifier:  verifier,
+		tokenType: tokenType,
+		auditor:   auditor,
+		logger:    logger,
 	}
 }
 
@@ -39,24 +52,38 @@ func (m *AuthMiddleware) VerifyEndpointToken(c *gin.Context) {
 		return
 	}
 
-	token, err := m.verifier.VerifyEndpointToken(tokenString)
+	token, err := m.verifier.VerifyEndpointToken(tokenString, m.tokenType)
 	if err != nil {
 		if errors.Is(err, auth.ErrInvalidToken) {
 			m.logger.Warn(
 				"auth invalid token",
 				zap.Error(err),
 			)
+			m.recordFailure(c, "invalid token")
 			c.AbortWithStatusJSON(
 				http.StatusUnauthorized,
 				gin.H{"error": "invalid token"},
 			)
 			return
 		}
+		if errors.Is(err, auth.ErrInvalidTokenType) {
+			m.logger.Warn(
+				"auth invalid token type",
+				zap.Error(err),
+			)
+			m.recordFailure(c, "invalid token type")
+			c.AbortWithStatusJSON(
+				http.StatusUnauthorized,
+				gin.H{"error": "invalid token type"},
+			)
+			return
+		}
 		if errors.Is(err, auth.ErrExpiredToken) {
 			m.logger.Warn(
 				"auth expired token",
 				zap.Error(err),
 			)
+			m.recordFailure(c, "expired token")
 			c.AbortWithStatusJSON(
 				http.StatusUnauthorized,
 				gin.H{"error": "expired token"},
@@ -77,10 +104,11 @@ func (m *AuthMiddleware) VerifyEndpointToken(c *gin.Context) {
 }
 
 func (m *AuthMiddleware) parseToken(c *gin.Context) (string, bool) {
-	authorization := c.Request.Header.Get("Authorization")
+	authorization := c.Request.Header.Get(m.header())
 	authType, tokenString, ok := strings.Cut(authorization, " ")
 	if !ok {
 		m.logger.Warn("missing authorization header")
+		m.recordFailure(c, "missing authorization")
 		c.AbortWithStatusJSON(
 			http.StatusUnauthorized,
 			gin.H{"error": "missing authorization"},
@@ -92,6 +120,7 @@ func (m *AuthMiddleware) parseToken(c *gin.Context) (string, bool) {
 			"unsupported auth type",
 			zap.String("auth-type", authType),
 		)
+		m.recordFailure(c, "unsupported auth type")
 		c.AbortWithStatusJSON(
 			http.StatusUnauthorized,
 			gin.H{"error": "unsupported auth type"},
@@ -101,3 +130,29 @@ func (m *AuthMiddleware) parseToken(c *gin.Context) (string, bool) {
 
 	return tokenString, true
 }
+
+// recordFailure records an audit event for a failed authentication.
+func (m *AuthMiddleware) recordFailure(c *gin.Context, reason string) {
+	if m.auditor == nil {
+		return
+	}
+	m.auditor.Record(audit.Event{
+		Type:       audit.EventTypeAuthFailure,
+		Listener:   string(m.tokenType),
+		Action:     c.Request.Method + " " + c.Request.URL.Path,
+		RemoteAddr: c.Request.RemoteAddr,
+		Status:     http.StatusUnauthorized,
+		Reason:     reason,
+	})
+}
+
+// header returns the header containing the token.
+//
+// Proxy tokens use the 'x-piko-authorization' header to avoid conflicting
+// with the 'Authorization' header of proxied requests.
+func (m *AuthMiddleware) header() string {
+	if m.tokenType == auth.TokenTypeProxy {
+		return "x-piko-authorization"
+	}
+	return "Authorization"
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/audit"
 	"github.com/andydunstall/piko/server/auth"
 )
 
@@ -19,12 +20,29 @@ type fakeVerifier struct {
 	handler func(token string) (auth.EndpointToken, error)
 }
 
-func (v *fakeVerifier) VerifyEndpointToken(token string) (auth.EndpointToken, error) {
+func (v *fakeVerifier) VerifyEndpointToken(
+	token string,
+	_ auth.TokenType,
+) (auth.EndpointToken, error) {
 	return v.handler(token)
 }
 
 var _ auth.Verifier = &fakeVerifier{}
 
+type fakeAuditor struct {
+	events []audit.Event
+}
+
+func (a *fakeAuditor) Record(event audit.Event) {
+	a.events = append(a.events, event)
+}
+
+func (a *fakeAuditor) Close() error {
+	return nil
+}
+
+var _ audit.Auditor = &fakeAuditor{}
+
 type errorMessage struct {
 	Error string `json:"error"`
 }
@@ -40,7 +58,7 @@ func TestAuthMiddleware(t *testing.T) {
 				}, nil
 			},
 		}
-		m := NewAuthMiddleware(verifier, log.NewNopLogger())
+		m := NewAuthMiddleware(verifier, auth.TokenTypeUpstream, nil, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -65,7 +83,7 @@ func TestAuthMiddleware(t *testing.T) {
 				return auth.EndpointToken{}, fmt.Errorf("foo: %w", auth.ErrInvalidToken)
 			},
 		}
-		m := NewAuthMiddleware(verifier, log.NewNopLogger())
+		m := NewAuthMiddleware(verifier, auth.TokenTypeUpstream, nil, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -82,6 +100,36 @@ func TestAuthMiddleware(t *testing.T) {
 		assert.Equal(t, "invalid token", errMessage.Error)
 	})
 
+	t.Run("invalid token audited", func(t *testing.T) {
+		verifier := &fakeVerifier{
+			handler: func(_ string) (auth.EndpointToken, error) {
+				return auth.EndpointToken{}, auth.ErrInvalidToken
+			},
+		}
+		auditor := &fakeAuditor{}
+		m := NewAuthMiddleware(verifier, auth.TokenTypeUpstream, auditor, log.NewNopLogger())
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "http://example.com/foo", nil)
+		c.Request.Header.Add("Authorization", "Bearer 123")
+
+		m.VerifyEndpointToken(c)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+		assert.Equal(t, []audit.Event{
+			{
+				Type:       audit.EventTypeAuthFailure,
+				Listener:   "upstream",
+				Action:     "GET /foo",
+				RemoteAddr: c.Request.RemoteAddr,
+				Status:     http.StatusUnauthorized,
+				Reason:     "invalid token",
+			},
+		}, auditor.events)
+	})
+
 	t.Run("expired token", func(t *testing.T) {
 		verifier := &fakeVerifier{
 			handler: func(token string) (auth.EndpointToken, error) {
@@ -89,7 +137,7 @@ func TestAuthMiddleware(t *testing.T) {
 				return auth.EndpointToken{}, fmt.Errorf("foo: %w", auth.ErrExpiredToken)
 			},
 		}
-		m := NewAuthMiddleware(verifier, log.NewNopLogger())
+		m := NewAuthMiddleware(verifier, auth.TokenTypeUpstream, nil, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -113,7 +161,7 @@ func TestAuthMiddleware(t *testing.T) {
 				return auth.EndpointToken{}, fmt.Errorf("unknown")
 			},
 		}
-		m := NewAuthMiddleware(verifier, log.NewNopLogger())
+		m := NewAuthMiddleware(verifier, auth.TokenTypeUpstream, nil, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -127,7 +175,7 @@ func TestAuthMiddleware(t *testing.T) {
 	})
 
 	t.Run("unsupported auth type", func(t *testing.T) {
-		m := NewAuthMiddleware(nil, log.NewNopLogger())
+		m := NewAuthMiddleware(nil, auth.TokenTypeUpstream, nil, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -145,7 +193,7 @@ func TestAuthMiddleware(t *testing.T) {
 	})
 
 	t.Run("missing authorization header", func(t *testing.T) {
-		m := NewAuthMiddleware(nil, log.NewNopLogger())
+		m := NewAuthMiddleware(nil, auth.TokenTypeUpstream, nil, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -0,0 +1,55 @@
+package upstream
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// MaxEndpointIDLength is the maximum length of an endpoint ID in bytes.
+	MaxEndpointIDLength = 256
+)
+
+// NormalizeEndpointID returns the canonical form of the endpoint ID.
+//
+// Endpoint IDs are case insensitive, since they may be taken from the Host
+// header, so are normalized to lower case.
+func NormalizeEndpointID(endpointID string) string {
+	return strings.ToLower(endpointID)
+}
+
+// ValidateEndpointID returns an error if the endpoint ID can't be registered.
+//
+// Endpoint IDs are used in Host-header routing, metric labels and gossip
+// keys, so may only contain ASCII letters, digits, '-', '_' and '.', and are
+// limited in length.
+func ValidateEndpointID(endpointID string) error {
+	if endpointID == "" {
+		return fmt.Errorf("missing endpoint id")
+	}
+	if len(endpointID) > MaxEndpointIDLength {
+		return fmt.Errorf(
+			"endpoint id exceeds maximum length of %d", MaxEndpointIDLength,
+		)
+	}
+	for i := 0; i != len(endpointID); i++ {
+		if !validEndpointIDChar(endpointID[i]) {
+			return fmt.Errorf(
+				"endpoint id contains invalid character %q; must only contain letters, digits, '-', '_' and '.'",
+				endpointID[i],
+			)
+		}
+	}
+	return nil
+}
+
+func validEndpointIDChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case c == '-' || c == '_' || c == '.':
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,42 @@
+package upstream
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateEndpointID(t *testing.T) {
+	tests := []struct {
+		endpointID string
+		valid      bool
+	}{
+		{endpointID: "my-endpoint", valid: true},
+		{endpointID: "My_Endpoint.v1", valid: true},
+		{endpointID: strings.Repeat("a", MaxEndpointIDLength), valid: true},
+		{endpointID: "", valid: false},
+		{endpointID: strings.Repeat("a", MaxEndpointIDLength+1), valid: false},
+		{endpointID: "my:endpoint", valid: false},
+		{endpointID: "my/endpoint", valid: false},
+		{endpointID: "my endpoint", valid: false},
+		{endpointID: "my\nendpoint", valid: false},
+		{endpointID: "my\x00endpoint", valid: false},
+		{endpointID: "my-endpöint", valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpointID, func(t *testing.T) {
+			err := ValidateEndpointID(tt.endpointID)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestNormalizeEndpointID(t *testing.T) {
+	assert.Equal(t, "my-endpoint", NormalizeEndpointID("My-Endpoint"))
+	assert.Equal(t, "my-endpoint", NormalizeEndpointID("my-endpoint"))
+}
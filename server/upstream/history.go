@@ -0,0 +1,131 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// historyEndpointEvents is the maximum number of events kept for each
+	// endpoint. Once reached, the oldest events are discarded.
+	historyEndpointEvents = 64
+
+	// historyMaxEndpoints is the maximum number of endpoints with events.
+	// Once reached, the endpoint whose last event is oldest is discarded.
+	historyMaxEndpoints = 4096
+)
+
+type ConnEventType string
+
+const (
+	ConnEventTypeConnected    ConnEventType = "connected"
+	ConnEventTypeDisconnected ConnEventType = "disconnected"
+)
+
+// Reasons an upstream disconnected, in addition to the tunnel disconnect
+// reasons sent to the upstream.
+const (
+	// DisconnectReasonClosed indicates the upstream closed the connection.
+	DisconnectReasonClosed = "closed"
+	// DisconnectReasonKeepalive indicates the upstream stopped responding to
+	// pings.
+	DisconnectReasonKeepalive = "keepalive_timeout"
+	// DisconnectReasonUnregistered indicates a multiplexed upstream
+	// unregistered the endpoint.
+	DisconnectReasonUnregistered = "unregistered"
+	// DisconnectReasonError indicates the connection failed unexpectedly.
+	DisconnectReasonError = "error"
+)
+
+// ConnEvent is an upstream connecting to or disconnecting from a node.
+type ConnEvent struct {
+	Time time.Time     `json:"time"`
+	Type ConnEventType `json:"type"`
+
+	// UpstreamID identifies the upstream connection.
+	UpstreamID string `json:"upstream_id"`
+
+	ClientIP string `json:"client_ip"`
+
+	// NodeID is the ID of the node the upstream connected to.
+	NodeID string `json:"node_id"`
+
+	// Reason is the reason the upstream disconnected. Only set for
+	// disconnect events.
+	Reason string `json:"reason,omitempty"`
+}
+
+// ConnHistory records the most recent upstream connect and disconnect
+// events for each endpoint on the local node, so flapping upstreams can
+// be diagnosed without searching the logs.
+//
+// History is kept in memory, so only covers the time since the node
+// started.
+type ConnHistory struct {
+	nodeID string
+
+	// endpoints contains the events for each endpoint, oldest first, keyed
+	// by endpoint ID.
+	endpoints map[string][]ConnEvent
+
+	mu sync.Mutex
+}
+
+func NewConnHistory(nodeID string) *ConnHistory {
+	return &ConnHistory{
+		nodeID:    nodeID,
+		endpoints: make(map[string][]ConnEvent),
+	}
+}
+
+// Record adds an event for the endpoint. The event time and node ID are set
+// if not already set.
+func (h *ConnHistory) Record(endpointID string, event ConnEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.NodeID == "" {
+		event.NodeID = h.nodeID
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events, ok := h.endpoints[endpointID]
+	if !ok && len(h.endpoints) >= historyMaxEndpoints {
+		h.evictOldest()
+	}
+
+	events = append(events, event)
+	if len(events) > historyEndpointEvents {
+		// Copy rather than reslice so the discarded events can be garbage
+		// collected.
+		events = append(
+			[]ConnEvent(nil), events[len(events)-historyEndpointEvents:]...,
+		)
+	}
+	h.endpoints[endpointID] = events
+}
+
+// Events returns the recorded events for the endpoint, oldest first.
+func (h *ConnHistory) Events(endpointID string) []ConnEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]ConnEvent(nil), h.endpoints[endpointID]...)
+}
+
+// evictOldest discards the events of the endpoint whose last event is
+// oldest.
+func (h *ConnHistory) evictOldest() {
+	var oldestID string
+	var oldest time.Time
+	for endpointID, events := range h.endpoints {
+		last := events[len(events)-1].Time
+		if oldestID == "" || last.Before(oldest) {
+			oldestID = endpointID
+			oldest = last
+		}
+	}
+	delete(h.endpoints, oldestID)
+}
@@ -0,0 +1,71 @@
+package upstream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnHistory(t *testing.T) {
+	t.Run("record", func(t *testing.T) {
+		history := NewConnHistory("local")
+
+		history.Record("my-endpoint", ConnEvent{
+			Type:       ConnEventTypeConnected,
+			UpstreamID: "upstream-1",
+			ClientIP:   "10.26.104.56",
+		})
+		history.Record("my-endpoint", ConnEvent{
+			Type:       ConnEventTypeDisconnected,
+			UpstreamID: "upstream-1",
+			ClientIP:   "10.26.104.56",
+			Reason:     DisconnectReasonClosed,
+		})
+
+		events := history.Events("my-endpoint")
+		require.Len(t, events, 2)
+		assert.Equal(t, ConnEventTypeConnected, events[0].Type)
+		assert.Equal(t, ConnEventTypeDisconnected, events[1].Type)
+		assert.Equal(t, DisconnectReasonClosed, events[1].Reason)
+		for _, event := range events {
+			assert.Equal(t, "local", event.NodeID)
+			assert.False(t, event.Time.IsZero())
+		}
+
+		assert.Empty(t, history.Events("unknown"))
+	})
+
+	t.Run("discard oldest events", func(t *testing.T) {
+		history := NewConnHistory("local")
+		for i := 0; i != historyEndpointEvents+10; i++ {
+			history.Record("my-endpoint", ConnEvent{
+				Type:       ConnEventTypeConnected,
+				UpstreamID: fmt.Sprintf("upstream-%d", i),
+			})
+		}
+
+		events := history.Events("my-endpoint")
+		require.Len(t, events, historyEndpointEvents)
+		assert.Equal(t, "upstream-10", events[0].UpstreamID)
+	})
+
+	t.Run("discard oldest endpoint", func(t *testing.T) {
+		history := NewConnHistory("local")
+		start := time.Now()
+		for i := 0; i != historyMaxEndpoints+1; i++ {
+			history.Record(fmt.Sprintf("endpoint-%d", i), ConnEvent{
+				Time: start.Add(time.Duration(i) * time.Second),
+				Type: ConnEventTypeConnected,
+			})
+		}
+
+		assert.Empty(t, history.Events("endpoint-0"))
+		assert.Len(t, history.Events("endpoint-1"), 1)
+		assert.Len(t, history.Events(
+			fmt.Sprintf("endpoint-%d", historyMaxEndpoints),
+		), 1)
+	})
+}
@@ -0,0 +1,88 @@
+package upstream
+
+import (
+	"time"
+)
+
+// UpstreamLatency describes the latency of an upstream connection compared to
+// its target latency.
+type UpstreamLatency struct {
+	EndpointID string `json:"endpoint_id"`
+	Addr       string `json:"addr"`
+
+	// Target is the target latency for the upstream.
+	Target time.Duration `json:"target"`
+
+	// Latency is the latency of the last request to the upstream.
+	Latency time.Duration `json:"latency"`
+
+	// Degraded indicates whether the upstream is consistently exceeding the
+	// target latency.
+	Degraded bool `json:"degraded"`
+
+	// DegradedSince is the time the upstream was marked as degraded.
+	DegradedSince *time.Time `json:"degraded_since,omitempty"`
+}
+
+// latencyTracker tracks whether an upstream connection is consistently
+// exceeding its target latency.
+//
+// The upstream is marked as degraded after 'threshold' consecutive requests
+// exceed the target, and recovers after 'threshold' consecutive requests
+// within the target.
+type latencyTracker struct {
+	endpointID string
+	addr       string
+
+	target    time.Duration
+	threshold int
+
+	// consecutive is the number of consecutive requests that disagree with
+	// the current state, such as requests within the target while degraded.
+	consecutive int
+
+	latency       time.Duration
+	degraded      bool
+	degradedSince time.Time
+}
+
+// Observe records the latency of a request to the upstream. Returns true if
+// the upstream changed between healthy and degraded.
+func (t *latencyTracker) Observe(latency time.Duration) bool {
+	t.latency = latency
+
+	slow := latency > t.target
+	if slow == t.degraded {
+		t.consecutive = 0
+		return false
+	}
+
+	t.consecutive++
+	if t.consecutive < t.threshold {
+		return false
+	}
+
+	t.consecutive = 0
+	t.degraded = !t.degraded
+	if t.degraded {
+		t.degradedSince = time.Now()
+	} else {
+		t.degradedSince = time.Time{}
+	}
+	return true
+}
+
+func (t *latencyTracker) Status() UpstreamLatency {
+	status := UpstreamLatency{
+		EndpointID: t.endpointID,
+		Addr:       t.addr,
+		Target:     t.target,
+		Latency:    t.latency,
+		Degraded:   t.degraded,
+	}
+	if t.degraded {
+		since := t.degradedSince
+		status.DegradedSince = &since
+	}
+	return status
+}
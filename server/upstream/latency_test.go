@@ -0,0 +1,35 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	tracker := &latencyTracker{
+		target:    time.Millisecond * 100,
+		threshold: 3,
+	}
+
+	// Slow requests that aren't consecutive don't mark the upstream as
+	// degraded.
+	assert.False(t, tracker.Observe(time.Millisecond*200))
+	assert.False(t, tracker.Observe(time.Millisecond*200))
+	assert.False(t, tracker.Observe(time.Millisecond*10))
+	assert.False(t, tracker.Observe(time.Millisecond*200))
+	assert.False(t, tracker.Observe(time.Millisecond*200))
+	assert.False(t, tracker.degraded)
+
+	assert.True(t, tracker.Observe(time.Millisecond*200))
+	assert.True(t, tracker.degraded)
+	assert.True(t, tracker.Status().Degraded)
+
+	// Recovers after consecutive requests within the target.
+	assert.False(t, tracker.Observe(time.Millisecond*10))
+	assert.False(t, tracker.Observe(time.Millisecond*10))
+	assert.True(t, tracker.Observe(time.Millisecond*10))
+	assert.False(t, tracker.degraded)
+	assert.Nil(t, tracker.Status().DegradedSince)
+}
@@ -0,0 +1,105 @@
+package upstream
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+// acceptLimiter rate limits new upstream connections using a token bucket.
+type acceptLimiter struct {
+	// rate is the number of tokens added per second.
+	rate  float64
+	burst float64
+
+	// tokens is the number of tokens available as of last.
+	tokens float64
+	last   time.Time
+
+	mu sync.Mutex
+}
+
+// newAcceptLimiter returns a limiter for the given configuration, which
+// must be enabled and validated.
+func newAcceptLimiter(conf config.AcceptLimitConfig) *acceptLimiter {
+	return &acceptLimiter{
+		rate:   conf.Rate,
+		burst:  float64(conf.Burst),
+		tokens: float64(conf.Burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow returns whether a new connection can be accepted. If not, returns
+// the duration until a connection can be accepted.
+func (l *acceptLimiter) Allow() (bool, time.Duration) {
+	return l.allowAt(time.Now())
+}
+
+func (l *acceptLimiter) allowAt(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+elapsed.Seconds()*l.rate)
+		l.last = now
+	}
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// SetAcceptLimit rate limits new upstream connections. Connections that
+// exceed the limit are rejected with '429 Too Many Requests' before the
+// connection is authenticated, to protect the node when many upstreams
+// reconnect at once.
+//
+// Must be called before Serve.
+func (s *Server) SetAcceptLimit(conf config.AcceptLimitConfig, metrics *Metrics) {
+	if !conf.Enabled() {
+		return
+	}
+	s.acceptLimiter = newAcceptLimiter(conf)
+	s.metrics = metrics
+}
+
+// limitAccept is a middleware that rejects new upstream connections that
+// exceed the accept limit.
+func (s *Server) limitAccept(c *gin.Context) {
+	if s.acceptLimiter == nil {
+		return
+	}
+
+	ok, wait := s.acceptLimiter.Allow()
+	if ok {
+		return
+	}
+
+	s.metrics.AcceptLimitedTotal.Inc()
+
+	s.logger.Debug(
+		"upstream rejected; accept limit exceeded",
+		zap.String("client-ip", c.ClientIP()),
+		zap.Duration("retry-after", wait),
+	)
+
+	// Round up to the nearest second so the upstream doesn't retry before
+	// a connection can be accepted.
+	retryAfter := max(int(math.Ceil(wait.Seconds())), 1)
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(
+		http.StatusTooManyRequests,
+		gin.H{"error": "too many connections"},
+	)
+}
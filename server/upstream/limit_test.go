@@ -0,0 +1,86 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/keepalive"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestAcceptLimiter(t *testing.T) {
+	l := newAcceptLimiter(config.AcceptLimitConfig{
+		Rate:  2,
+		Burst: 3,
+	})
+	now := l.last
+
+	// Accepts the burst.
+	for i := 0; i != 3; i++ {
+		ok, _ := l.allowAt(now)
+		assert.True(t, ok)
+	}
+
+	// Rejects once the burst is exhausted, until the next token is added.
+	ok, wait := l.allowAt(now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Millisecond*500, wait)
+
+	ok, _ = l.allowAt(now.Add(time.Millisecond * 500))
+	assert.True(t, ok)
+
+	// Tokens don't exceed the burst.
+	for i := 0; i != 3; i++ {
+		ok, _ := l.allowAt(now.Add(time.Minute))
+		assert.True(t, ok)
+	}
+	ok, _ = l.allowAt(now.Add(time.Minute))
+	assert.False(t, ok)
+}
+
+func TestServer_AcceptLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	manager := newFakeManager()
+	metrics := NewMetrics()
+
+	s := NewServer(manager, nil, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
+	s.SetAcceptLimit(config.AcceptLimitConfig{
+		Rate:  0.1,
+		Burst: 1,
+	}, metrics)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf(
+		"ws://%s/piko/v1/upstream/my-endpoint",
+		ln.Addr().String(),
+	)
+	conn, err := websocket.Dial(context.TODO(), url)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	<-manager.addConnCh
+
+	// The second connection exceeds the limit.
+	_, err = websocket.Dial(context.TODO(), url)
+	var retryableErr *websocket.RetryableError
+	require.True(t, errors.As(err, &retryableErr))
+	assert.ErrorContains(t, err, "429: too many connections")
+	assert.Equal(t, time.Second*10, retryableErr.RetryAfter)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.AcceptLimitedTotal))
+}
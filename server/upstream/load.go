@@ -0,0 +1,56 @@
+package upstream
+
+import (
+	"context"
+	"time"
+
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+const (
+	// loadReportInterval is the interval to update the load on the local
+	// upstreams in the cluster state.
+	//
+	// The load is propagated to other nodes using gossip, so the interval
+	// limits how often each endpoints load is gossiped.
+	loadReportInterval = time.Second
+)
+
+// LoadReporter periodically updates the cluster state with the load on the
+// local upstreams, so other nodes can prefer forwarding to nodes with idle
+// capacity.
+type LoadReporter struct {
+	manager *LoadBalancedManager
+	cluster *cluster.State
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewLoadReporter(manager *LoadBalancedManager, cluster *cluster.State) *LoadReporter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &LoadReporter{
+		manager: manager,
+		cluster: cluster,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (r *LoadReporter) Start() {
+	ticker := time.NewTicker(loadReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.cluster.UpdateLocalLoad(r.manager.Load())
+		}
+	}
+}
+
+func (r *LoadReporter) Stop() {
+	r.cancel()
+}
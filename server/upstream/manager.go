@@ -1,12 +1,19 @@
 package upstream
 
 import (
+	"context"
+	"math/rand"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/atomic"
+	"go.uber.org/zap"
 
+	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
 )
 
 // Manager manages the upstream routes for each endpoint.
@@ -22,13 +29,61 @@ type Manager interface {
 	// If there are no upstreams connected for the endpoint, and 'allowForward'
 	// is true, it will look for another node in the cluster that has an
 	// upstream connection for the endpoint and use that node as the upstream.
+	//
+	// If the endpoint uses the 'spread' routing policy and 'allowForward' is
+	// true, the upstream is instead selected among the upstreams connected to
+	// all nodes in the cluster.
 	Select(endpointID string, allowForward bool) (Upstream, bool)
 
+	// SelectAffinity looks up an upstream for the given endpoint ID like
+	// Select, though rather than load balancing, consistently selects the
+	// same upstream for the same key, such as the client address.
+	//
+	// The upstream is selected among the upstreams connected to all nodes
+	// in the cluster, so the key maps to the same upstream whichever node
+	// the request arrives at. When upstreams connect or disconnect, only the
+	// keys of the affected upstreams move.
+	SelectAffinity(endpointID string, key string, allowForward bool) (Upstream, bool)
+
+	// SelectHedge looks up a remote node, other than the node with the given
+	// ID, with an upstream for the endpoint, to send a hedged request to.
+	//
+	// Returns false if no other node has an upstream for the endpoint.
+	SelectHedge(endpointID string, excludeNodeID string) (Upstream, bool)
+
 	// AddConn adds a local upstream connection.
 	AddConn(u Upstream)
 
 	// RemoveConn removes a local upstream connection.
 	RemoveConn(u Upstream)
+
+	// ObserveLatency records the latency of a request to an upstream
+	// returned by Select.
+	ObserveLatency(u Upstream, latency time.Duration)
+
+	// ObserveForward records the result of a request forwarded to another
+	// node via an upstream returned by Select. err is nil if the node
+	// responded, or the error if the node couldn't be reached.
+	ObserveForward(u Upstream, err error)
+
+	// Hold waits for an upstream to connect for the given endpoint ID, if
+	// the endpoint's last local upstream disconnected within the hold
+	// window, or the endpoint is resuming after the node its upstreams were
+	// connected to restarted.
+	//
+	// Returns true if an upstream connected, or false if the endpoint
+	// didn't recently have an upstream, too many requests are already held,
+	// or no upstream connected within the window.
+	Hold(ctx context.Context, endpointID string) bool
+
+	// Queue waits for an upstream for the given endpoint ID connected to the
+	// local node to have capacity, if all local upstreams are at their
+	// stream limit.
+	//
+	// Returns true if an upstream has capacity, or false if the endpoint
+	// has no local upstreams, queueing is disabled, too many requests are
+	// already queued, or no upstream had capacity within the timeout.
+	Queue(ctx context.Context, endpointID string) bool
 }
 
 // loadBalancer load balances requests among upstreams in a round-robin
@@ -36,6 +91,9 @@ type Manager interface {
 type loadBalancer struct {
 	upstreams []Upstream
 	nextIndex int
+
+	// requests is the number of active requests to the upstreams.
+	requests atomic.Int64
 }
 
 func (lb *loadBalancer) Add(u Upstream) {
@@ -68,43 +126,208 @@ func (lb *loadBalancer) Next() Upstream {
 	return u
 }
 
+// hasCapacity returns whether any upstream in the load balancer isn't at its
+// stream limit.
+func hasCapacity(lb *loadBalancer) bool {
+	for _, u := range lb.upstreams {
+		if !Saturated(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextHealthy returns the next upstream that isn't degraded. If all upstreams
+// are degraded, falls back to the next upstream.
+func (lb *loadBalancer) NextHealthy(degraded func(u Upstream) bool) Upstream {
+	for i := 0; i != len(lb.upstreams); i++ {
+		u := lb.Next()
+		if !degraded(u) {
+			return u
+		}
+	}
+	return lb.Next()
+}
+
 type Usage struct {
 	Requests  *atomic.Uint64
 	Upstreams *atomic.Uint64
 }
 
-type LoadBalancedManager struct {
+// hold contains the requests held waiting for an upstream to connect for an
+// endpoint.
+type hold struct {
+	// connectedCh is closed when an upstream connects.
+	connectedCh chan struct{}
+	requests    int
+}
+
+// queue contains the requests queued waiting for a local upstream to have
+// capacity for an endpoint.
+type queue struct {
+	// releasedCh is closed when a local upstream for the endpoint may have
+	// capacity, such as when a request completes. It is then replaced, so
+	// waiters must get the latest channel each time they wait.
+	releasedCh chan struct{}
+	requests   int
+}
+
+// managerShards is the number of shards the local upstreams are split
+// among.
+const managerShards = 64
+
+// managerShard contains the local upstreams for a subset of endpoints, so
+// requests to different endpoints don't contend on the same mutex.
+type managerShard struct {
 	localUpstreams map[string]*loadBalancer
 
+	// latency tracks the latency of local upstreams with a latency SLO.
+	latency map[Upstream]*latencyTracker
+
+	// disconnected contains the time the last local upstream disconnected
+	// for endpoints within the hold window.
+	disconnected map[string]time.Time
+
+	// holds contains the held requests for each endpoint.
+	holds map[string]*hold
+
+	// queues contains the queued requests for each endpoint.
+	queues map[string]*queue
+
+	// warming contains the local upstreams within their slow start window.
+	warming map[Upstream]*warmingUpstream
+
 	mu sync.Mutex
+}
+
+func newManagerShard() *managerShard {
+	return &managerShard{
+		localUpstreams: make(map[string]*loadBalancer),
+		latency:        make(map[Upstream]*latencyTracker),
+		disconnected:   make(map[string]time.Time),
+		holds:          make(map[string]*hold),
+		queues:         make(map[string]*queue),
+		warming:        make(map[Upstream]*warmingUpstream),
+	}
+}
+
+// degraded returns whether the given local upstream is degraded. The caller
+// must hold the mutex.
+func (s *managerShard) degraded(u Upstream) bool {
+	tracker, ok := s.latency[u]
+	return ok && tracker.degraded
+}
+
+// warmingWeight returns the weight of the given local upstream if it's
+// within its slow start window, or false if the upstream has warmed up. The
+// caller must hold the mutex.
+func (s *managerShard) warmingWeight(u Upstream, now time.Time) (float64, bool) {
+	w, ok := s.warming[u]
+	if !ok {
+		return 0, false
+	}
+	weight, ok := w.Weight(now)
+	if !ok {
+		delete(s.warming, u)
+	}
+	return weight, ok
+}
+
+// skipWarming returns whether to skip the given local upstream for this
+// request as it's warming up. A warming upstream is selected with a
+// probability of its weight. The caller must hold the mutex.
+func (s *managerShard) skipWarming(u Upstream, now time.Time) bool {
+	weight, ok := s.warmingWeight(u, now)
+	return ok && rand.Float64() >= weight
+}
+
+// release notifies the requests queued for the endpoint that a local
+// upstream may have capacity. The caller must hold the mutex.
+func (s *managerShard) release(endpointID string) {
+	q, ok := s.queues[endpointID]
+	if !ok {
+		return
+	}
+	close(q.releasedCh)
+	q.releasedCh = make(chan struct{})
+}
+
+// removeExpiredDisconnected discards disconnected endpoints that are outside
+// the hold window. The caller must hold the mutex.
+func (s *managerShard) removeExpiredDisconnected(window time.Duration) {
+	for endpointID, disconnectedAt := range s.disconnected {
+		if time.Since(disconnectedAt) > window {
+			delete(s.disconnected, endpointID)
+		}
+	}
+}
+
+type LoadBalancedManager struct {
+	// shards contains the local upstreams, sharded by endpoint ID.
+	shards [managerShards]*managerShard
 
 	usage *Usage
 
+	slo config.SLOConfig
+
+	holdConf config.HoldConfig
+
+	routing config.RoutingConfig
+
+	queueConf config.QueueConfig
+
+	slowStart config.SlowStartConfig
+
 	cluster *cluster.State
 
 	metrics *Metrics
+
+	logger log.Logger
 }
 
-func NewLoadBalancedManager(cluster *cluster.State) *LoadBalancedManager {
-	return &LoadBalancedManager{
-		localUpstreams: make(map[string]*loadBalancer),
-		cluster:        cluster,
+func NewLoadBalancedManager(
+	cluster *cluster.State,
+	slo config.SLOConfig,
+	holdConf config.HoldConfig,
+	routing config.RoutingConfig,
+	queueConf config.QueueConfig,
+	slowStart config.SlowStartConfig,
+	logger log.Logger,
+) *LoadBalancedManager {
+	m := &LoadBalancedManager{
+		cluster: cluster,
 		usage: &Usage{
 			Requests:  atomic.NewUint64(0),
 			Upstreams: atomic.NewUint64(0),
 		},
-		metrics: NewMetrics(),
+		slo:       slo,
+		holdConf:  holdConf,
+		routing:   routing,
+		queueConf: queueConf,
+		slowStart: slowStart,
+		metrics:   NewMetrics(),
+		logger:    logger.WithSubsystem("upstream"),
+	}
+	for i := range m.shards {
+		m.shards[i] = newManagerShard()
 	}
+	return m
 }
 
 func (m *LoadBalancedManager) Select(endpointID string, allowRemote bool) (Upstream, bool) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	if allowRemote && m.routing.EndpointPolicy(endpointID) == config.RoutingPolicySpread {
+		node := spreadNode(
+			endpointID,
+			m.localUpstreams(endpointID),
+			m.cluster.EndpointNodes(endpointID),
+		)
+		if node != nil {
+			return m.remoteUpstream(endpointID, node), true
+		}
+	}
 
-	lb, ok := m.localUpstreams[endpointID]
-	if ok {
-		m.metrics.UpstreamRequestsTotal.Inc()
-		return lb.Next(), true
+	if u, ok := m.selectLocal(endpointID); ok {
+		return u, true
 	}
 	if !allowRemote {
 		return nil, false
@@ -114,18 +337,170 @@ func (m *LoadBalancedManager) Select(endpointID string, allowRemote bool) (Upstr
 	if !ok {
 		return nil, false
 	}
-	m.metrics.RemoteRequestsTotal.With(prometheus.Labels{
-		"node_id": node.ID,
-	}).Inc()
+	return m.remoteUpstream(endpointID, node), true
+}
+
+func (m *LoadBalancedManager) SelectAffinity(
+	endpointID string,
+	key string,
+	allowRemote bool,
+) (Upstream, bool) {
+	shard := m.shard(endpointID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	lb, ok := shard.localUpstreams[endpointID]
+	if allowRemote {
+		var local int
+		if ok {
+			local = len(lb.upstreams)
+		}
+		node := affinityNode(
+			key,
+			endpointID,
+			m.cluster.LocalID(),
+			local,
+			m.cluster.EndpointNodes(endpointID),
+		)
+		if node != nil {
+			return m.remoteUpstream(endpointID, node), true
+		}
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	u := affinityUpstream(key, lb.upstreams)
+	if Saturated(u) {
+		// Spill over to another local upstream rather than failing.
+		u = lb.NextHealthy(Saturated)
+	}
+	return m.localUpstream(endpointID, lb, u), true
+}
+
+func (m *LoadBalancedManager) SelectHedge(
+	endpointID string,
+	excludeNodeID string,
+) (Upstream, bool) {
+	nodes := m.cluster.EndpointNodes(endpointID)
+	candidates := make([]*cluster.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.ID != excludeNodeID {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	node := candidates[rand.Intn(len(candidates))]
+	return m.remoteUpstream(endpointID, node), true
+}
+
+func (m *LoadBalancedManager) selectLocal(endpointID string) (Upstream, bool) {
+	shard := m.shard(endpointID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	lb, ok := shard.localUpstreams[endpointID]
+	if !ok {
+		return nil, false
+	}
+
+	u, ok := m.nextLocal(shard, lb)
+	if !ok {
+		// All local upstreams are at their stream limit, so spill over to
+		// other nodes.
+		m.metrics.SaturatedTotal.With(prometheus.Labels{
+			"endpoint_id": endpointID,
+		}).Inc()
+		return nil, false
+	}
+	return m.localUpstream(endpointID, lb, u), true
+}
+
+// nextLocal returns the next local upstream in the load balancer, preferring
+// upstreams that aren't degraded if biasing by latency, and ramping up
+// requests to upstreams within their slow start window. Returns false if all
+// upstreams are saturated. The caller must hold the shard mutex.
+func (m *LoadBalancedManager) nextLocal(shard *managerShard, lb *loadBalancer) (Upstream, bool) {
+	now := time.Now()
+	var u Upstream
+	if m.slo.Bias {
+		u = lb.NextHealthy(func(u Upstream) bool {
+			return shard.degraded(u) || Saturated(u) || shard.skipWarming(u, now)
+		})
+	}
+	if u == nil || Saturated(u) {
+		u = lb.NextHealthy(func(u Upstream) bool {
+			return Saturated(u) || shard.skipWarming(u, now)
+		})
+	}
+	if Saturated(u) {
+		return nil, false
+	}
+	return u, true
+}
+
+// localUpstreams returns the number of upstreams for the endpoint connected
+// to the local node.
+func (m *LoadBalancedManager) localUpstreams(endpointID string) int {
+	shard := m.shard(endpointID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	lb, ok := shard.localUpstreams[endpointID]
+	if !ok {
+		return 0
+	}
+	return len(lb.upstreams)
+}
+
+// localUpstream returns the selected local upstream, metered to record the
+// request. The caller must hold the shard mutex.
+func (m *LoadBalancedManager) localUpstream(
+	endpointID string,
+	lb *loadBalancer,
+	u Upstream,
+) Upstream {
+	m.metrics.UpstreamRequestsTotal.Inc()
+
+	labels := prometheus.Labels{"endpoint_id": endpointID}
+	metered := &meteredUpstream{
+		Upstream: u,
+		bytesIn:  m.metrics.UpstreamBytesInTotal.With(labels),
+		bytesOut: m.metrics.UpstreamBytesOutTotal.With(labels),
+		requests: &lb.requests,
+	}
+	if m.queueConf.Enabled() {
+		// Notify queued requests once the request completes, as the
+		// upstream may have capacity.
+		metered.onClose = func() {
+			m.release(endpointID)
+		}
+	}
+	return metered
+}
+
+// remoteUpstream returns an upstream forwarding to the given node, metered to
+// record the request.
+func (m *LoadBalancedManager) remoteUpstream(endpointID string, node *cluster.Node) Upstream {
+	labels := prometheus.Labels{"node_id": node.ID}
+	m.metrics.RemoteRequestsTotal.With(labels).Inc()
 	m.usage.Requests.Inc()
-	return NewNodeUpstream(endpointID, node), true
+	return &meteredUpstream{
+		Upstream: NewNodeUpstream(endpointID, node),
+		bytesIn:  m.metrics.RemoteBytesInTotal.With(labels),
+		bytesOut: m.metrics.RemoteBytesOutTotal.With(labels),
+	}
 }
 
 func (m *LoadBalancedManager) AddConn(u Upstream) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	shard := m.shard(u.EndpointID())
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	lb, ok := m.localUpstreams[u.EndpointID()]
+	lb, ok := shard.localUpstreams[u.EndpointID()]
 	if !ok {
 		lb = &loadBalancer{}
 
@@ -133,24 +508,78 @@ func (m *LoadBalancedManager) AddConn(u Upstream) {
 	}
 
 	lb.Add(u)
-	m.localUpstreams[u.EndpointID()] = lb
+	shard.localUpstreams[u.EndpointID()] = lb
+
+	// The new upstream has capacity for queued requests.
+	shard.release(u.EndpointID())
+
+	// Complete any requests held waiting for the upstream to connect.
+	delete(shard.disconnected, u.EndpointID())
+	if h, ok := shard.holds[u.EndpointID()]; ok {
+		close(h.connectedCh)
+		delete(shard.holds, u.EndpointID())
+	}
+
+	// Only ramp up requests to the upstream if the endpoint already has
+	// upstreams to handle the remaining requests.
+	if window := m.slowStart.EndpointWindow(u.EndpointID()); window > 0 && ok {
+		shard.warming[u] = &warmingUpstream{
+			connectedAt: time.Now(),
+			window:      window,
+		}
+	}
+
+	if target := m.slo.Target(u.EndpointID()); target > 0 {
+		var addr string
+		if cu, ok := u.(*ConnUpstream); ok {
+			addr = cu.RemoteAddr()
+		}
+		shard.latency[u] = &latencyTracker{
+			endpointID: u.EndpointID(),
+			addr:       addr,
+			target:     target,
+			threshold:  m.slo.Threshold,
+		}
+	}
 
 	m.cluster.AddLocalEndpoint(u.EndpointID())
 
+	if cu, ok := u.(*ConnUpstream); ok && cu.Resumed() {
+		m.metrics.ResumedUpstreamsTotal.Inc()
+	}
+
 	m.metrics.ConnectedUpstreams.Inc()
 	m.usage.Upstreams.Inc()
 }
 
 func (m *LoadBalancedManager) RemoveConn(u Upstream) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	shard := m.shard(u.EndpointID())
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	lb, ok := m.localUpstreams[u.EndpointID()]
+	lb, ok := shard.localUpstreams[u.EndpointID()]
 	if !ok {
 		return
 	}
+
+	if tracker, ok := shard.latency[u]; ok {
+		if tracker.degraded {
+			m.metrics.DegradedUpstreams.Dec()
+		}
+		delete(shard.latency, u)
+	}
+	delete(shard.warming, u)
+
 	if lb.Remove(u) {
-		delete(m.localUpstreams, u.EndpointID())
+		delete(shard.localUpstreams, u.EndpointID())
+
+		// Stop waiting for queued requests as there are no upstreams left.
+		shard.release(u.EndpointID())
+
+		if m.holdConf.Enabled() {
+			shard.removeExpiredDisconnected(m.holdConf.Window)
+			shard.disconnected[u.EndpointID()] = time.Now()
+		}
 
 		m.metrics.RegisteredEndpoints.Dec()
 	}
@@ -160,17 +589,317 @@ func (m *LoadBalancedManager) RemoveConn(u Upstream) {
 	m.metrics.ConnectedUpstreams.Dec()
 }
 
-func (m *LoadBalancedManager) Endpoints() map[string]int {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+func (m *LoadBalancedManager) ObserveLatency(u Upstream, latency time.Duration) {
+	// Only upstreams connected to the local node are tracked. Forwarded
+	// requests are tracked by the node the upstream is connected to.
+	lu, ok := u.(*meteredUpstream)
+	if !ok {
+		return
+	}
+
+	shard := m.shard(lu.EndpointID())
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	tracker, ok := shard.latency[lu.Upstream]
+	if !ok {
+		return
+	}
+	if !tracker.Observe(latency) {
+		return
+	}
+
+	if tracker.degraded {
+		m.logger.Warn(
+			"upstream degraded; exceeding target latency",
+			zap.String("endpoint-id", tracker.endpointID),
+			zap.String("addr", tracker.addr),
+			zap.Duration("latency", latency),
+			zap.Duration("target", tracker.target),
+		)
+
+		m.metrics.DegradedUpstreams.Inc()
+		m.metrics.UpstreamDegradedTotal.With(prometheus.Labels{
+			"endpoint_id": tracker.endpointID,
+		}).Inc()
+	} else {
+		m.logger.Info(
+			"upstream recovered; within target latency",
+			zap.String("endpoint-id", tracker.endpointID),
+			zap.String("addr", tracker.addr),
+			zap.Duration("latency", latency),
+			zap.Duration("target", tracker.target),
+		)
+
+		m.metrics.DegradedUpstreams.Dec()
+	}
+}
+
+func (m *LoadBalancedManager) ObserveForward(u Upstream, err error) {
+	node, ok := RemoteNode(u)
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		m.metrics.RemoteRequestErrorsTotal.With(prometheus.Labels{
+			"node_id": node.ID,
+		}).Inc()
+	}
+	m.cluster.ObserveForward(node.ID, err == nil)
+}
+
+func (m *LoadBalancedManager) Hold(ctx context.Context, endpointID string) bool {
+	shard := m.shard(endpointID)
+	shard.mu.Lock()
+
+	if _, ok := shard.localUpstreams[endpointID]; ok {
+		// An upstream has already connected.
+		shard.mu.Unlock()
+		return true
+	}
+
+	deadline, resuming, ok := m.holdDeadline(shard, endpointID)
+	if !ok {
+		shard.mu.Unlock()
+		return false
+	}
+
+	h, ok := shard.holds[endpointID]
+	if !ok {
+		h = &hold{
+			connectedCh: make(chan struct{}),
+		}
+		shard.holds[endpointID] = h
+	}
+	if h.requests >= m.holdConf.MaxRequests {
+		shard.mu.Unlock()
+
+		m.metrics.HeldRequestsTotal.With(prometheus.Labels{
+			"result": "rejected",
+		}).Inc()
+		return false
+	}
+	h.requests++
+
+	shard.mu.Unlock()
+
+	m.metrics.HeldRequests.Inc()
+	defer m.metrics.HeldRequests.Dec()
+
+	// If the endpoint is resuming, its upstreams may reconnect to any node
+	// in the cluster, so also watch the cluster for the endpoint becoming
+	// available.
+	var resumedCh <-chan struct{}
+	if resuming {
+		w := m.cluster.WatchEndpoints(endpointID)
+		defer w.Close()
+		resumedCh = w.Notify()
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	result := "reconnected"
+	// Check if the endpoint resumed before the watch started.
+	if !resuming || !m.cluster.Endpoint(endpointID).Available() {
+	wait:
+		for {
+			select {
+			case <-h.connectedCh:
+				break wait
+			case <-resumedCh:
+				if m.cluster.Endpoint(endpointID).Available() {
+					break wait
+				}
+			case <-timer.C:
+				result = "expired"
+				break wait
+			case <-ctx.Done():
+				result = "cancelled"
+				break wait
+			}
+		}
+	}
+
+	m.metrics.HeldRequestsTotal.With(prometheus.Labels{
+		"result": result,
+	}).Inc()
+
+	// Release the held request. If a local upstream connected the hold has
+	// already been removed so this has no effect.
+	shard.mu.Lock()
+	h.requests--
+	shard.mu.Unlock()
+
+	return result == "reconnected"
+}
+
+func (m *LoadBalancedManager) Queue(ctx context.Context, endpointID string) bool {
+	if !m.queueConf.Enabled() {
+		return false
+	}
 
+	shard := m.shard(endpointID)
+	shard.mu.Lock()
+
+	lb, ok := shard.localUpstreams[endpointID]
+	if !ok {
+		// There are no local upstreams to wait for.
+		shard.mu.Unlock()
+		return false
+	}
+	if hasCapacity(lb) {
+		shard.mu.Unlock()
+		return true
+	}
+
+	q, ok := shard.queues[endpointID]
+	if !ok {
+		q = &queue{
+			releasedCh: make(chan struct{}),
+		}
+		shard.queues[endpointID] = q
+	}
+	if q.requests >= m.queueConf.MaxRequests {
+		shard.mu.Unlock()
+
+		m.metrics.QueuedRequestsTotal.With(prometheus.Labels{
+			"result": "rejected",
+		}).Inc()
+		return false
+	}
+	q.requests++
+	releasedCh := q.releasedCh
+
+	shard.mu.Unlock()
+
+	m.metrics.QueuedRequests.Inc()
+	defer m.metrics.QueuedRequests.Dec()
+
+	timer := time.NewTimer(m.queueConf.Timeout)
+	defer timer.Stop()
+
+	var result string
+	for result == "" {
+		select {
+		case <-releasedCh:
+			shard.mu.Lock()
+			lb, ok := shard.localUpstreams[endpointID]
+			if !ok {
+				// The last local upstream disconnected.
+				result = "expired"
+			} else if hasCapacity(lb) {
+				result = "dequeued"
+			} else {
+				// Another request took the capacity, so keep waiting.
+				releasedCh = q.releasedCh
+			}
+			shard.mu.Unlock()
+		case <-timer.C:
+			result = "expired"
+		case <-ctx.Done():
+			result = "cancelled"
+		}
+	}
+
+	m.metrics.QueuedRequestsTotal.With(prometheus.Labels{
+		"result": result,
+	}).Inc()
+
+	shard.mu.Lock()
+	q.requests--
+	if q.requests == 0 {
+		delete(shard.queues, endpointID)
+	}
+	shard.mu.Unlock()
+
+	return result == "dequeued"
+}
+
+// release notifies the requests queued for the endpoint that a local
+// upstream may have capacity.
+func (m *LoadBalancedManager) release(endpointID string) {
+	shard := m.shard(endpointID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.release(endpointID)
+}
+
+// Latency returns the latency status of the local upstreams with a latency
+// SLO.
+func (m *LoadBalancedManager) Latency() []UpstreamLatency {
+	var upstreams []UpstreamLatency
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for _, tracker := range shard.latency {
+			upstreams = append(upstreams, tracker.Status())
+		}
+		shard.mu.Unlock()
+	}
+	sort.Slice(upstreams, func(i, j int) bool {
+		if upstreams[i].EndpointID != upstreams[j].EndpointID {
+			return upstreams[i].EndpointID < upstreams[j].EndpointID
+		}
+		return upstreams[i].Addr < upstreams[j].Addr
+	})
+	return upstreams
+}
+
+func (m *LoadBalancedManager) Endpoints() map[string]int {
 	endpoints := make(map[string]int)
-	for endpointID, lb := range m.localUpstreams {
-		endpoints[endpointID] = len(lb.upstreams)
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for endpointID, lb := range shard.localUpstreams {
+			endpoints[endpointID] = len(lb.upstreams)
+		}
+		shard.mu.Unlock()
 	}
 	return endpoints
 }
 
+// Load returns the load on the local upstreams for each endpoint.
+func (m *LoadBalancedManager) Load() map[string]cluster.EndpointLoad {
+	now := time.Now()
+	load := make(map[string]cluster.EndpointLoad)
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		m.shardLoad(shard, now, load)
+		shard.mu.Unlock()
+	}
+	return load
+}
+
+// shardLoad adds the load on the local upstreams in the shard to load. The
+// caller must hold the shard mutex.
+func (m *LoadBalancedManager) shardLoad(
+	shard *managerShard,
+	now time.Time,
+	load map[string]cluster.EndpointLoad,
+) {
+	for endpointID, lb := range shard.localUpstreams {
+		endpointLoad := cluster.EndpointLoad{
+			Requests: int(lb.requests.Load()),
+		}
+		for _, u := range lb.upstreams {
+			cu, ok := u.(*ConnUpstream)
+			if !ok {
+				continue
+			}
+			switch age := now.Sub(cu.ConnectedAt()); {
+			case age < time.Minute:
+				endpointLoad.Ages[0]++
+			case age < time.Hour:
+				endpointLoad.Ages[1]++
+			default:
+				endpointLoad.Ages[2]++
+			}
+		}
+		load[endpointID] = endpointLoad
+	}
+}
+
 func (m *LoadBalancedManager) Usage() *Usage {
 	return m.usage
 }
@@ -178,3 +907,68 @@ func (m *LoadBalancedManager) Usage() *Usage {
 func (m *LoadBalancedManager) Metrics() *Metrics {
 	return m.metrics
 }
+
+// holdDeadline returns the deadline to hold requests for the endpoint with
+// the given ID waiting for an upstream to connect, and whether the endpoint
+// is resuming after the node its upstreams were connected to restarted.
+//
+// Returns false if requests to the endpoint shouldn't be held. The caller
+// must hold the shard mutex.
+func (m *LoadBalancedManager) holdDeadline(
+	shard *managerShard,
+	endpointID string,
+) (time.Time, bool, bool) {
+	if disconnectedAt, ok := shard.disconnected[endpointID]; ok {
+		deadline := disconnectedAt.Add(m.holdConf.Window)
+		if time.Now().Before(deadline) {
+			return deadline, false, true
+		}
+		delete(shard.disconnected, endpointID)
+	}
+
+	if deadline, ok := m.cluster.ResumingEndpoint(endpointID); ok {
+		return deadline, true, true
+	}
+	return time.Time{}, false, false
+}
+
+// shard returns the shard containing the endpoint with the given ID.
+func (m *LoadBalancedManager) shard(endpointID string) *managerShard {
+	// FNV-1a hash of the endpoint ID, inlined to avoid allocating on every
+	// request.
+	h := uint32(2166136261)
+	for i := 0; i != len(endpointID); i++ {
+		h ^= uint32(endpointID[i])
+		h *= 16777619
+	}
+	return m.shards[h%managerShards]
+}
+
+// spreadNode returns a random node to select an upstream from, weighted by
+// the number of upstreams connected to each node, or nil to select a local
+// upstream.
+//
+// local is the number of upstreams connected to the local node, and remote
+// contains the remote nodes with upstreams for the endpoint.
+func spreadNode(endpointID string, local int, remote []*cluster.Node) *cluster.Node {
+	total := local
+	for _, node := range remote {
+		total += node.Endpoints[endpointID]
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.Intn(total)
+	if n < local {
+		return nil
+	}
+	n -= local
+	for _, node := range remote {
+		n -= node.Endpoints[endpointID]
+		if n < 0 {
+			return node
+		}
+	}
+	return nil
+}
@@ -1,14 +1,27 @@
 package upstream
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
 )
 
 type fakeUpstream struct {
 	endpointID string
+	conn       net.Conn
 }
 
 func (u *fakeUpstream) EndpointID() string {
@@ -16,13 +29,23 @@ func (u *fakeUpstream) EndpointID() string {
 }
 
 func (u *fakeUpstream) Dial() (net.Conn, error) {
-	return nil, nil
+	return u.conn, nil
 }
 
 func (u *fakeUpstream) Forward() bool {
 	return false
 }
 
+type fakeSaturatedUpstream struct {
+	fakeUpstream
+
+	saturated bool
+}
+
+func (u *fakeSaturatedUpstream) Saturated() bool {
+	return u.saturated
+}
+
 func TestLocalLoadBalancer(t *testing.T) {
 	lb := &loadBalancer{}
 
@@ -58,3 +81,844 @@ func TestLocalLoadBalancer(t *testing.T) {
 
 	assert.Nil(t, lb.Next())
 }
+
+func TestLoadBalancedManager_BytesMetrics(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	m := NewLoadBalancedManager(cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger()), config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger())
+	m.AddConn(&fakeUpstream{endpointID: "my-endpoint", conn: local})
+
+	u, ok := m.Select("my-endpoint", true)
+	assert.True(t, ok)
+
+	conn, err := u.Dial()
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 3)
+		_, _ = remote.Read(buf)
+		_, _ = remote.Write([]byte("hello"))
+	}()
+
+	_, err = conn.Write([]byte("foo"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 5.0, testutil.ToFloat64(
+		m.Metrics().UpstreamBytesInTotal.WithLabelValues("my-endpoint"),
+	))
+	assert.Equal(t, 3.0, testutil.ToFloat64(
+		m.Metrics().UpstreamBytesOutTotal.WithLabelValues("my-endpoint"),
+	))
+}
+
+func TestLoadBalancedManager_SlowStart(t *testing.T) {
+	newManager := func() *LoadBalancedManager {
+		return NewLoadBalancedManager(cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger()), config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{
+			Window: time.Minute,
+			Endpoints: map[string]time.Duration{
+				"disabled-endpoint": 0,
+			},
+		}, log.NewNopLogger())
+	}
+
+	t.Run("warming", func(t *testing.T) {
+		m := newManager()
+
+		existing := &fakeUpstream{endpointID: "my-endpoint"}
+		m.AddConn(existing)
+		warming := &fakeUpstream{endpointID: "my-endpoint"}
+		m.AddConn(warming)
+
+		// The new upstream is selected with a probability of 10% at the start
+		// of the window, so receives roughly 10% of the requests rather than
+		// 50%.
+		selected := 0
+		for i := 0; i != 1000; i++ {
+			u, ok := m.Select("my-endpoint", true)
+			require.True(t, ok)
+			if u.(*meteredUpstream).Upstream == warming {
+				selected++
+			}
+		}
+		assert.Greater(t, selected, 0)
+		assert.Less(t, selected, 250)
+
+		route := m.Resolve("my-endpoint")
+		require.Len(t, route.Local, 2)
+		warmingCount := 0
+		for _, u := range route.Local {
+			if u.Warming {
+				warmingCount++
+			}
+		}
+		assert.Equal(t, 1, warmingCount)
+	})
+
+	t.Run("first upstream", func(t *testing.T) {
+		m := newManager()
+
+		// The first upstream for an endpoint receives all requests so isn't
+		// warmed up.
+		u := &fakeUpstream{endpointID: "my-endpoint"}
+		m.AddConn(u)
+
+		shard := m.shard("my-endpoint")
+		_, warming := shard.warmingWeight(u, time.Now())
+		assert.False(t, warming)
+	})
+
+	t.Run("endpoint disabled", func(t *testing.T) {
+		m := newManager()
+
+		m.AddConn(&fakeUpstream{endpointID: "disabled-endpoint"})
+		u := &fakeUpstream{endpointID: "disabled-endpoint"}
+		m.AddConn(u)
+
+		shard := m.shard("disabled-endpoint")
+		_, warming := shard.warmingWeight(u, time.Now())
+		assert.False(t, warming)
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		m := newManager()
+
+		m.AddConn(&fakeUpstream{endpointID: "my-endpoint"})
+		u := &fakeUpstream{endpointID: "my-endpoint"}
+		m.AddConn(u)
+		m.RemoveConn(u)
+
+		assert.Empty(t, m.shard("my-endpoint").warming)
+	})
+}
+
+func TestWarmingUpstream_Weight(t *testing.T) {
+	start := time.Now()
+	w := &warmingUpstream{
+		connectedAt: start,
+		window:      time.Second * 10,
+	}
+
+	weight, ok := w.Weight(start)
+	assert.True(t, ok)
+	assert.Equal(t, slowStartMinWeight, weight)
+
+	weight, ok = w.Weight(start.Add(time.Second * 5))
+	assert.True(t, ok)
+	assert.InDelta(t, 0.5, weight, 0.001)
+
+	// Warmed up once the window elapses.
+	_, ok = w.Weight(start.Add(time.Second * 10))
+	assert.False(t, ok)
+}
+
+func TestLoadBalancedManager_ObserveForward(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	state.AddNode(&cluster.Node{
+		ID:     "remote",
+		Status: cluster.NodeStatusActive,
+	})
+	state.UpdateRemoteEndpoint("remote", "my-endpoint", 1)
+
+	m := NewLoadBalancedManager(
+		state, config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger(),
+	)
+
+	u, ok := m.Select("my-endpoint", true)
+	require.True(t, ok)
+	require.True(t, u.Forward())
+
+	m.ObserveForward(u, nil)
+	m.ObserveForward(u, errors.New("unreachable"))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(
+		m.Metrics().RemoteRequestErrorsTotal.WithLabelValues("remote"),
+	))
+
+	for _, node := range state.NodesMetadata() {
+		if node.ID != "remote" {
+			continue
+		}
+		require.NotNil(t, node.Forwarded)
+		assert.Equal(t, uint64(2), node.Forwarded.Requests)
+		assert.Equal(t, uint64(1), node.Forwarded.Errors)
+	}
+}
+
+func TestLoadBalancedManager_SelectHedge(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	state.AddNode(&cluster.Node{
+		ID:     "remote-1",
+		Status: cluster.NodeStatusActive,
+	})
+	state.UpdateRemoteEndpoint("remote-1", "my-endpoint", 1)
+	state.AddNode(&cluster.Node{
+		ID:     "remote-2",
+		Status: cluster.NodeStatusActive,
+	})
+	state.UpdateRemoteEndpoint("remote-2", "my-endpoint", 1)
+
+	m := NewLoadBalancedManager(
+		state, config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger(),
+	)
+
+	// Never selects the excluded node.
+	for i := 0; i != 10; i++ {
+		u, ok := m.SelectHedge("my-endpoint", "remote-1")
+		require.True(t, ok)
+		node, ok := RemoteNode(u)
+		require.True(t, ok)
+		assert.Equal(t, "remote-2", node.ID)
+	}
+
+	state.RemoveNode("remote-2")
+	_, ok := m.SelectHedge("my-endpoint", "remote-1")
+	assert.False(t, ok)
+}
+
+func TestLoadBalancedManager_Load(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	m := NewLoadBalancedManager(cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger()), config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger())
+	m.AddConn(&fakeUpstream{endpointID: "my-endpoint", conn: local})
+	m.AddConn(&ConnUpstream{
+		endpointID:  "my-endpoint",
+		connectedAt: time.Now().Add(-time.Minute * 5),
+	})
+	m.AddConn(&ConnUpstream{
+		endpointID:  "my-endpoint",
+		connectedAt: time.Now().Add(-time.Hour * 2),
+	})
+
+	// Select the fake upstream.
+	u, ok := m.Select("my-endpoint", true)
+	require.True(t, ok)
+	conn, err := u.Dial()
+	require.NoError(t, err)
+
+	// The active request is counted, and the fake upstream has no connected
+	// time so isn't included in the ages.
+	assert.Equal(t, map[string]cluster.EndpointLoad{
+		"my-endpoint": {Requests: 1, Ages: [3]int{0, 1, 1}},
+	}, m.Load())
+
+	// Closing multiple times must only count once.
+	conn.Close()
+	conn.Close()
+	assert.Equal(t, map[string]cluster.EndpointLoad{
+		"my-endpoint": {Requests: 0, Ages: [3]int{0, 1, 1}},
+	}, m.Load())
+}
+
+func TestLoadBalancedManager_Latency(t *testing.T) {
+	newManager := func(bias bool) *LoadBalancedManager {
+		return NewLoadBalancedManager(cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger()), config.SLOConfig{
+			Latency:   time.Millisecond * 100,
+			Threshold: 2,
+			Bias:      bias,
+		}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger())
+	}
+
+	t.Run("degraded", func(t *testing.T) {
+		m := newManager(false)
+
+		m.AddConn(&fakeUpstream{endpointID: "my-endpoint"})
+
+		u, ok := m.Select("my-endpoint", false)
+		assert.True(t, ok)
+
+		m.ObserveLatency(u, time.Millisecond*200)
+		assert.False(t, m.Latency()[0].Degraded)
+		m.ObserveLatency(u, time.Millisecond*200)
+		assert.True(t, m.Latency()[0].Degraded)
+		assert.NotNil(t, m.Latency()[0].DegradedSince)
+		assert.Equal(t, 1.0, testutil.ToFloat64(m.Metrics().DegradedUpstreams))
+
+		m.ObserveLatency(u, time.Millisecond*10)
+		m.ObserveLatency(u, time.Millisecond*10)
+		assert.False(t, m.Latency()[0].Degraded)
+		assert.Equal(t, 0.0, testutil.ToFloat64(m.Metrics().DegradedUpstreams))
+	})
+
+	t.Run("bias", func(t *testing.T) {
+		m := newManager(true)
+
+		slow := &fakeUpstream{endpointID: "my-endpoint"}
+		m.AddConn(slow)
+		m.AddConn(&fakeUpstream{endpointID: "my-endpoint"})
+
+		for i := 0; i != 2; i++ {
+			m.ObserveLatency(&meteredUpstream{Upstream: slow}, time.Second)
+		}
+
+		// Requests must only be routed to the healthy upstream.
+		for i := 0; i != 4; i++ {
+			u, ok := m.Select("my-endpoint", false)
+			assert.True(t, ok)
+			assert.NotSame(t, slow, u.(*meteredUpstream).Upstream)
+		}
+
+		// Once the healthy upstream is removed, falls back to the degraded
+		// upstream.
+		m.RemoveConn(m.shard("my-endpoint").localUpstreams["my-endpoint"].upstreams[1])
+		u, ok := m.Select("my-endpoint", false)
+		assert.True(t, ok)
+		assert.Same(t, slow, u.(*meteredUpstream).Upstream)
+	})
+}
+
+func TestLoadBalancedManager_StreamLimit(t *testing.T) {
+	t.Run("spill to local upstream", func(t *testing.T) {
+		m := NewLoadBalancedManager(cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger()), config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger())
+
+		saturated := &fakeSaturatedUpstream{
+			fakeUpstream: fakeUpstream{endpointID: "my-endpoint"},
+			saturated:    true,
+		}
+		m.AddConn(saturated)
+		m.AddConn(&fakeSaturatedUpstream{
+			fakeUpstream: fakeUpstream{endpointID: "my-endpoint"},
+		})
+
+		// Requests must only be routed to the upstream with capacity.
+		for i := 0; i != 4; i++ {
+			u, ok := m.Select("my-endpoint", false)
+			assert.True(t, ok)
+			assert.NotSame(t, saturated, u.(*meteredUpstream).Upstream)
+		}
+	})
+
+	t.Run("spill to remote node", func(t *testing.T) {
+		clusterState := cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger())
+		clusterState.AddNode(&cluster.Node{
+			ID:        "remote",
+			Status:    cluster.NodeStatusActive,
+			ProxyAddr: "10.26.104.98:8000",
+			Endpoints: map[string]int{"my-endpoint": 1},
+		})
+		m := NewLoadBalancedManager(
+			clusterState, config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger(),
+		)
+
+		m.AddConn(&fakeSaturatedUpstream{
+			fakeUpstream: fakeUpstream{endpointID: "my-endpoint"},
+			saturated:    true,
+		})
+
+		_, ok := m.Select("my-endpoint", false)
+		assert.False(t, ok)
+
+		u, ok := m.Select("my-endpoint", true)
+		assert.True(t, ok)
+		assert.True(t, u.Forward())
+
+		assert.Equal(t, 2.0, testutil.ToFloat64(
+			m.Metrics().SaturatedTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+}
+
+func TestLoadBalancedManager_Routing(t *testing.T) {
+	newManager := func(routing config.RoutingConfig) *LoadBalancedManager {
+		clusterState := cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger())
+		clusterState.AddNode(&cluster.Node{
+			ID:        "remote",
+			Status:    cluster.NodeStatusActive,
+			ProxyAddr: "10.26.104.98:8000",
+			Endpoints: map[string]int{"my-endpoint": 3},
+		})
+		m := NewLoadBalancedManager(
+			clusterState, config.SLOConfig{}, config.HoldConfig{}, routing, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger(),
+		)
+		m.AddConn(&fakeUpstream{endpointID: "my-endpoint"})
+		return m
+	}
+
+	t.Run("local", func(t *testing.T) {
+		m := newManager(config.RoutingConfig{})
+
+		// Requests must only be routed to the local upstream.
+		for i := 0; i != 100; i++ {
+			u, ok := m.Select("my-endpoint", true)
+			assert.True(t, ok)
+			assert.False(t, u.Forward())
+		}
+	})
+
+	t.Run("spread", func(t *testing.T) {
+		m := newManager(config.RoutingConfig{
+			Endpoints: []config.EndpointRoutingConfig{
+				{ID: "my-endpoint", Policy: config.RoutingPolicySpread},
+			},
+		})
+
+		// Requests must be spread among the local and remote upstreams.
+		forwarded := 0
+		for i := 0; i != 1000; i++ {
+			u, ok := m.Select("my-endpoint", true)
+			assert.True(t, ok)
+			if u.Forward() {
+				forwarded++
+			}
+		}
+		// The remote node has 3 of the 4 upstreams, so expect ~750 forwarded
+		// requests.
+		assert.Greater(t, forwarded, 600)
+		assert.Less(t, forwarded, 900)
+	})
+
+	t.Run("spread disallow remote", func(t *testing.T) {
+		m := newManager(config.RoutingConfig{
+			Policy: config.RoutingPolicySpread,
+		})
+
+		for i := 0; i != 100; i++ {
+			u, ok := m.Select("my-endpoint", false)
+			assert.True(t, ok)
+			assert.False(t, u.Forward())
+		}
+	})
+}
+
+func TestLoadBalancedManager_Hold(t *testing.T) {
+	newManager := func(window time.Duration, maxRequests int) *LoadBalancedManager {
+		return NewLoadBalancedManager(cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger()), config.SLOConfig{}, config.HoldConfig{
+			Window:      window,
+			MaxRequests: maxRequests,
+		}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger())
+	}
+
+	t.Run("reconnect", func(t *testing.T) {
+		m := newManager(time.Minute, 10)
+
+		u := &fakeUpstream{endpointID: "my-endpoint"}
+		m.AddConn(u)
+		m.RemoveConn(u)
+
+		heldCh := make(chan bool)
+		go func() {
+			heldCh <- m.Hold(context.Background(), "my-endpoint")
+		}()
+
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(m.Metrics().HeldRequests) == 1
+		}, time.Second, time.Millisecond)
+
+		m.AddConn(&fakeUpstream{endpointID: "my-endpoint"})
+		assert.True(t, <-heldCh)
+
+		_, ok := m.Select("my-endpoint", false)
+		assert.True(t, ok)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			m.Metrics().HeldRequestsTotal.WithLabelValues("reconnected"),
+		))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		m := newManager(time.Millisecond*10, 10)
+
+		u := &fakeUpstream{endpointID: "my-endpoint"}
+		m.AddConn(u)
+		m.RemoveConn(u)
+
+		assert.False(t, m.Hold(context.Background(), "my-endpoint"))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			m.Metrics().HeldRequestsTotal.WithLabelValues("expired"),
+		))
+
+		// Once the window expires requests are no longer held.
+		assert.False(t, m.Hold(context.Background(), "my-endpoint"))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			m.Metrics().HeldRequestsTotal.WithLabelValues("expired"),
+		))
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		m := newManager(time.Minute, 10)
+
+		u := &fakeUpstream{endpointID: "my-endpoint"}
+		m.AddConn(u)
+		m.RemoveConn(u)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		defer cancel()
+		assert.False(t, m.Hold(ctx, "my-endpoint"))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			m.Metrics().HeldRequestsTotal.WithLabelValues("cancelled"),
+		))
+	})
+
+	t.Run("max requests", func(t *testing.T) {
+		m := newManager(time.Minute, 1)
+
+		u := &fakeUpstream{endpointID: "my-endpoint"}
+		m.AddConn(u)
+		m.RemoveConn(u)
+
+		heldCh := make(chan bool)
+		go func() {
+			heldCh <- m.Hold(context.Background(), "my-endpoint")
+		}()
+
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(m.Metrics().HeldRequests) == 1
+		}, time.Second, time.Millisecond)
+
+		// The hold is full so the request should be rejected.
+		assert.False(t, m.Hold(context.Background(), "my-endpoint"))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			m.Metrics().HeldRequestsTotal.WithLabelValues("rejected"),
+		))
+
+		m.AddConn(&fakeUpstream{endpointID: "my-endpoint"})
+		assert.True(t, <-heldCh)
+	})
+
+	// Tests requests are held while an endpoint resumes after its node
+	// restarts, and released once an upstream reconnects to another node.
+	t.Run("resuming", func(t *testing.T) {
+		m := newManager(0, 10)
+		m.cluster.AddNode(&cluster.Node{
+			ID:     "remote",
+			Status: cluster.NodeStatusActive,
+		})
+		m.cluster.AddResumingEndpoint("my-endpoint", time.Now().Add(time.Minute))
+
+		heldCh := make(chan bool)
+		go func() {
+			heldCh <- m.Hold(context.Background(), "my-endpoint")
+		}()
+
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(m.Metrics().HeldRequests) == 1
+		}, time.Second, time.Millisecond)
+
+		m.cluster.UpdateRemoteEndpoint("remote", "my-endpoint", 1)
+		assert.True(t, <-heldCh)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			m.Metrics().HeldRequestsTotal.WithLabelValues("reconnected"),
+		))
+	})
+
+	t.Run("unknown endpoint", func(t *testing.T) {
+		m := newManager(time.Minute, 10)
+		assert.False(t, m.Hold(context.Background(), "my-endpoint"))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		m := newManager(0, 0)
+
+		u := &fakeUpstream{endpointID: "my-endpoint"}
+		m.AddConn(u)
+		m.RemoveConn(u)
+
+		assert.False(t, m.Hold(context.Background(), "my-endpoint"))
+	})
+}
+
+func TestLoadBalancedManager_Queue(t *testing.T) {
+	newManager := func(timeout time.Duration, maxRequests int) *LoadBalancedManager {
+		return NewLoadBalancedManager(cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger()), config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{
+			Timeout:     timeout,
+			MaxRequests: maxRequests,
+		}, config.SlowStartConfig{}, log.NewNopLogger())
+	}
+
+	t.Run("released", func(t *testing.T) {
+		m := newManager(time.Minute, 10)
+
+		local, remote := net.Pipe()
+		defer remote.Close()
+
+		u := &fakeSaturatedUpstream{
+			fakeUpstream: fakeUpstream{endpointID: "my-endpoint", conn: local},
+		}
+		m.AddConn(u)
+
+		selected, ok := m.Select("my-endpoint", false)
+		require.True(t, ok)
+		conn, err := selected.Dial()
+		require.NoError(t, err)
+
+		// Mark the upstream as saturated with the active request.
+		u.saturated = true
+
+		queuedCh := make(chan bool)
+		go func() {
+			queuedCh <- m.Queue(context.Background(), "my-endpoint")
+		}()
+
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(m.Metrics().QueuedRequests) == 1
+		}, time.Second, time.Millisecond)
+
+		// Completing the request releases the queued request.
+		u.saturated = false
+		conn.Close()
+		assert.True(t, <-queuedCh)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			m.Metrics().QueuedRequestsTotal.WithLabelValues("dequeued"),
+		))
+	})
+
+	t.Run("upstream connected", func(t *testing.T) {
+		m := newManager(time.Minute, 10)
+
+		m.AddConn(&fakeSaturatedUpstream{
+			fakeUpstream: fakeUpstream{endpointID: "my-endpoint"},
+			saturated:    true,
+		})
+
+		queuedCh := make(chan bool)
+		go func() {
+			queuedCh <- m.Queue(context.Background(), "my-endpoint")
+		}()
+
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(m.Metrics().QueuedRequests) == 1
+		}, time.Second, time.Millisecond)
+
+		// A new upstream with capacity releases the queued request.
+		m.AddConn(&fakeUpstream{endpointID: "my-endpoint"})
+		assert.True(t, <-queuedCh)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		m := newManager(time.Millisecond*10, 10)
+
+		m.AddConn(&fakeSaturatedUpstream{
+			fakeUpstream: fakeUpstream{endpointID: "my-endpoint"},
+			saturated:    true,
+		})
+
+		assert.False(t, m.Queue(context.Background(), "my-endpoint"))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			m.Metrics().QueuedRequestsTotal.WithLabelValues("expired"),
+		))
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		m := newManager(time.Minute, 1)
+
+		m.AddConn(&fakeSaturatedUpstream{
+			fakeUpstream: fakeUpstream{endpointID: "my-endpoint"},
+			saturated:    true,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		queuedCh := make(chan bool)
+		go func() {
+			queuedCh <- m.Queue(ctx, "my-endpoint")
+		}()
+
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(m.Metrics().QueuedRequests) == 1
+		}, time.Second, time.Millisecond)
+
+		// The queue is full.
+		assert.False(t, m.Queue(context.Background(), "my-endpoint"))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			m.Metrics().QueuedRequestsTotal.WithLabelValues("rejected"),
+		))
+
+		cancel()
+		assert.False(t, <-queuedCh)
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			m.Metrics().QueuedRequestsTotal.WithLabelValues("cancelled"),
+		))
+	})
+
+	t.Run("no upstreams", func(t *testing.T) {
+		m := newManager(time.Minute, 10)
+
+		assert.False(t, m.Queue(context.Background(), "my-endpoint"))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		m := newManager(0, 0)
+
+		m.AddConn(&fakeSaturatedUpstream{
+			fakeUpstream: fakeUpstream{endpointID: "my-endpoint"},
+			saturated:    true,
+		})
+
+		assert.False(t, m.Queue(context.Background(), "my-endpoint"))
+	})
+}
+
+func TestLoadBalancedManager_SelectAffinity(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	state.AddNode(&cluster.Node{
+		ID:     "remote",
+		Status: cluster.NodeStatusActive,
+	})
+	state.UpdateRemoteEndpoint("remote", "my-endpoint", 2)
+
+	m := NewLoadBalancedManager(
+		state, config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger(),
+	)
+	for _, u := range newAddrUpstreams(2) {
+		m.AddConn(u)
+	}
+
+	var local, remote int
+	for i := 0; i != 100; i++ {
+		key := fmt.Sprintf("10.0.0.%d", i)
+
+		u, ok := m.SelectAffinity("my-endpoint", key, true)
+		require.True(t, ok)
+
+		// The same key always selects the same upstream.
+		for j := 0; j != 3; j++ {
+			next, ok := m.SelectAffinity("my-endpoint", key, true)
+			require.True(t, ok)
+			assert.Equal(t, u.Forward(), next.Forward())
+			if !u.Forward() {
+				assert.Equal(t, u.(*meteredUpstream).Upstream, next.(*meteredUpstream).Upstream)
+			}
+		}
+
+		if u.Forward() {
+			remote++
+		} else {
+			local++
+		}
+
+		// If forwarding is disabled, selects a local upstream.
+		u, ok = m.SelectAffinity("my-endpoint", key, false)
+		require.True(t, ok)
+		assert.False(t, u.Forward())
+	}
+	assert.Greater(t, local, 0)
+	assert.Greater(t, remote, 0)
+
+	_, ok := m.SelectAffinity("unknown", "10.0.0.1", true)
+	assert.False(t, ok)
+}
+
+func TestLoadBalancedManager_Endpoints(t *testing.T) {
+	m := NewLoadBalancedManager(cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger()), config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger())
+
+	// Add endpoints across multiple shards.
+	expected := make(map[string]int)
+	for i := 0; i != 100; i++ {
+		endpointID := fmt.Sprintf("endpoint-%d", i)
+		for j := 0; j <= i%3; j++ {
+			m.AddConn(&fakeUpstream{endpointID: endpointID})
+		}
+		expected[endpointID] = i%3 + 1
+	}
+	assert.Equal(t, expected, m.Endpoints())
+	assert.Len(t, m.Load(), 100)
+
+	for i := 0; i != 100; i++ {
+		endpointID := fmt.Sprintf("endpoint-%d", i)
+		u, ok := m.Select(endpointID, false)
+		assert.True(t, ok)
+		assert.Equal(t, endpointID, u.EndpointID())
+	}
+}
+
+// BenchmarkLoadBalancedManager_Select benchmarks selecting upstreams for
+// many endpoints concurrently while upstreams connect and disconnect, and
+// reports the p99 selection latency.
+func BenchmarkLoadBalancedManager_Select(b *testing.B) {
+	for _, endpoints := range []int{1, 1000, 10000} {
+		b.Run(fmt.Sprintf("endpoints %d", endpoints), func(b *testing.B) {
+			m := NewLoadBalancedManager(cluster.NewState(&cluster.Node{
+				ID: "local",
+			}, log.NewNopLogger()), config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger())
+
+			endpointIDs := make([]string, endpoints)
+			for i := range endpointIDs {
+				endpointIDs[i] = fmt.Sprintf("endpoint-%d", i)
+				for j := 0; j != 3; j++ {
+					m.AddConn(&fakeUpstream{endpointID: endpointIDs[i]})
+				}
+			}
+
+			// Add and remove upstreams in the background to contend with
+			// the selects.
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					u := &fakeUpstream{endpointID: endpointIDs[i%endpoints]}
+					m.AddConn(u)
+					m.RemoveConn(u)
+				}
+			}()
+
+			var mu sync.Mutex
+			var latencies []time.Duration
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var local []time.Duration
+				for i := 0; pb.Next(); i++ {
+					start := time.Now()
+					_, ok := m.Select(endpointIDs[i%endpoints], false)
+					local = append(local, time.Since(start))
+					if !ok {
+						b.Error("no upstream")
+					}
+				}
+
+				mu.Lock()
+				latencies = append(latencies, local...)
+				mu.Unlock()
+			})
+			b.StopTimer()
+
+			close(done)
+			wg.Wait()
+
+			sort.Slice(latencies, func(i, j int) bool {
+				return latencies[i] < latencies[j]
+			})
+			p99 := latencies[len(latencies)*99/100]
+			b.ReportMetric(float64(p99.Nanoseconds()), "p99-ns/op")
+		})
+	}
+}
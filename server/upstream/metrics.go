@@ -16,6 +16,66 @@ type Metrics struct {
 	// RemoteRequestsTotal is the number of requests sent to another node.
 	// Labelled by target node ID.
 	RemoteRequestsTotal *prometheus.CounterVec
+
+	// RemoteRequestErrorsTotal is the number of requests sent to another
+	// node that failed since the node couldn't be reached or didn't respond.
+	// Labelled by target node ID.
+	RemoteRequestErrorsTotal *prometheus.CounterVec
+
+	// UpstreamBytesInTotal is the number of bytes received from upstreams
+	// connected to the local node. Labelled by endpoint ID.
+	UpstreamBytesInTotal *prometheus.CounterVec
+
+	// UpstreamBytesOutTotal is the number of bytes sent to upstreams
+	// connected to the local node. Labelled by endpoint ID.
+	UpstreamBytesOutTotal *prometheus.CounterVec
+
+	// RemoteBytesInTotal is the number of bytes received from other nodes
+	// when forwarding traffic. Labelled by target node ID.
+	RemoteBytesInTotal *prometheus.CounterVec
+
+	// RemoteBytesOutTotal is the number of bytes sent to other nodes when
+	// forwarding traffic. Labelled by target node ID.
+	RemoteBytesOutTotal *prometheus.CounterVec
+
+	// DegradedUpstreams is the number of upstreams connected to this node
+	// that are exceeding their target latency.
+	DegradedUpstreams prometheus.Gauge
+
+	// UpstreamDegradedTotal is the number of times an upstream was marked
+	// as degraded. Labelled by endpoint ID.
+	UpstreamDegradedTotal *prometheus.CounterVec
+
+	// HeldRequests is the number of requests currently held waiting for an
+	// upstream to reconnect.
+	HeldRequests prometheus.Gauge
+
+	// HeldRequestsTotal is the number of requests that were held waiting
+	// for an upstream to reconnect. Labelled by result, which is one of
+	// 'reconnected', 'expired', 'cancelled' or 'rejected'.
+	HeldRequestsTotal *prometheus.CounterVec
+
+	// QueuedRequests is the number of requests currently queued waiting for
+	// an upstream to have capacity.
+	QueuedRequests prometheus.Gauge
+
+	// QueuedRequestsTotal is the number of requests that were queued
+	// waiting for an upstream to have capacity. Labelled by result, which is
+	// one of 'dequeued', 'expired', 'cancelled' or 'rejected'.
+	QueuedRequestsTotal *prometheus.CounterVec
+
+	// AcceptLimitedTotal is the number of upstream connections rejected as
+	// the accept limit was exceeded.
+	AcceptLimitedTotal prometheus.Counter
+
+	// ResumedUpstreamsTotal is the number of upstreams that connected with a
+	// resume token from a previous connection.
+	ResumedUpstreamsTotal prometheus.Counter
+
+	// SaturatedTotal is the number of requests where all upstreams for the
+	// endpoint connected to the local node reached their stream limit.
+	// Labelled by endpoint ID.
+	SaturatedTotal *prometheus.CounterVec
 }
 
 func NewMetrics() *Metrics {
@@ -53,6 +113,127 @@ func NewMetrics() *Metrics {
 			},
 			[]string{"node_id"},
 		),
+		RemoteRequestErrorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "remote_request_errors_total",
+				Help:      "Number of requests sent to a remote node that failed",
+			},
+			[]string{"node_id"},
+		),
+		UpstreamBytesInTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "upstream_bytes_in_total",
+				Help:      "Number of bytes received from upstreams connected to the local node",
+			},
+			[]string{"endpoint_id"},
+		),
+		UpstreamBytesOutTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "upstream_bytes_out_total",
+				Help:      "Number of bytes sent to upstreams connected to the local node",
+			},
+			[]string{"endpoint_id"},
+		),
+		RemoteBytesInTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "remote_bytes_in_total",
+				Help:      "Number of bytes received from remote nodes",
+			},
+			[]string{"node_id"},
+		),
+		RemoteBytesOutTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "remote_bytes_out_total",
+				Help:      "Number of bytes sent to remote nodes",
+			},
+			[]string{"node_id"},
+		),
+		DegradedUpstreams: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "degraded_upstreams",
+				Help:      "Number of upstreams connected to this node exceeding their target latency",
+			},
+		),
+		UpstreamDegradedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "upstream_degraded_total",
+				Help:      "Number of times an upstream was marked as degraded",
+			},
+			[]string{"endpoint_id"},
+		),
+		HeldRequests: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "held_requests",
+				Help:      "Number of requests held waiting for an upstream to reconnect",
+			},
+		),
+		HeldRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "held_requests_total",
+				Help:      "Number of requests held waiting for an upstream to reconnect",
+			},
+			[]string{"result"},
+		),
+		QueuedRequests: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "queued_requests",
+				Help:      "Number of requests queued waiting for an upstream to have capacity",
+			},
+		),
+		QueuedRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "queued_requests_total",
+				Help:      "Number of requests queued waiting for an upstream to have capacity",
+			},
+			[]string{"result"},
+		),
+		AcceptLimitedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "accept_limited_total",
+				Help:      "Number of upstream connections rejected as the accept limit was exceeded",
+			},
+		),
+		ResumedUpstreamsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "resumed_upstreams_total",
+				Help:      "Number of upstreams that connected with a resume token",
+			},
+		),
+		SaturatedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "saturated_total",
+				Help:      "Number of requests where all local upstreams reached their stream limit",
+			},
+			[]string{"endpoint_id"},
+		),
 	}
 }
 
@@ -62,5 +243,19 @@ func (m *Metrics) Register(registry *prometheus.Registry) {
 		m.RegisteredEndpoints,
 		m.UpstreamRequestsTotal,
 		m.RemoteRequestsTotal,
+		m.RemoteRequestErrorsTotal,
+		m.UpstreamBytesInTotal,
+		m.UpstreamBytesOutTotal,
+		m.RemoteBytesInTotal,
+		m.RemoteBytesOutTotal,
+		m.DegradedUpstreams,
+		m.UpstreamDegradedTotal,
+		m.HeldRequests,
+		m.HeldRequestsTotal,
+		m.QueuedRequests,
+		m.QueuedRequestsTotal,
+		m.AcceptLimitedTotal,
+		m.ResumedUpstreamsTotal,
+		m.SaturatedTotal,
 	)
 }
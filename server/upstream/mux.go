@@ -0,0 +1,298 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/yamux"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/tunnel"
+	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/piko/server/auth"
+)
+
+// muxSession contains the endpoints registered on a multiplexed upstream
+// session.
+type muxSession struct {
+	sess *yamux.Session
+
+	// token is the token the upstream authenticated with, or nil if
+	// authentication is disabled. The token is replaced when the upstream
+	// refreshes its token.
+	token *auth.EndpointToken
+
+	// id identifies the connection, which is shared by the upstreams of
+	// all registered endpoints.
+	id string
+
+	resumed    bool
+	maxStreams int
+
+	clientIP string
+
+	// upstreams contains the upstream for each registered endpoint, keyed by
+	// endpoint ID.
+	upstreams map[string]*ConnUpstream
+
+	// closed indicates the session has closed so endpoints can no longer be
+	// registered.
+	closed bool
+
+	mu sync.Mutex
+}
+
+// endpointIDs returns the IDs of the registered endpoints, sorted by ID. The
+// caller must hold the session mutex.
+func (m *muxSession) endpointIDs() []string {
+	endpointIDs := make([]string, 0, len(m.upstreams))
+	for endpointID := range m.upstreams {
+		endpointIDs = append(endpointIDs, endpointID)
+	}
+	sort.Strings(endpointIDs)
+	return endpointIDs
+}
+
+// muxUpstreamRoute handles multiplexed WebSocket connections from upstream
+// services, which register multiple endpoints over a single connection.
+//
+// Unlike upstreamRoute, the upstream registers endpoints after connecting
+// by sending register requests over the session.
+func (s *Server) muxUpstreamRoute(c *gin.Context) {
+	if s.draining != nil && s.draining() {
+		s.logger.Info(
+			"upstream rejected; node draining",
+			zap.String("client-ip", c.ClientIP()),
+		)
+		c.JSON(
+			http.StatusServiceUnavailable,
+			gin.H{"error": "node draining"},
+		)
+		return
+	}
+
+	maxStreams, ok := s.parseMaxStreams(c)
+	if !ok {
+		return
+	}
+
+	mux := &muxSession{
+		id:         newUpstreamID(),
+		resumed:    s.verifyResumeToken(c, ""),
+		maxStreams: maxStreams,
+		clientIP:   c.ClientIP(),
+		upstreams:  make(map[string]*ConnUpstream),
+	}
+	if token, ok := c.Get(TokenContextKey); ok {
+		mux.token = token.(*auth.EndpointToken)
+	}
+
+	header := make(http.Header)
+	if s.resumeTokens != nil {
+		header.Set(resumeTokenHeader, s.resumeTokens.Issue(""))
+	}
+	wsConn, err := s.websocketUpgrader.Upgrade(c.Writer, c.Request, header)
+	if err != nil {
+		// Upgrade replies to the client so nothing else to do.
+		s.logger.Warn("failed to upgrade websocket", zap.Error(err))
+		return
+	}
+	conn := pikowebsocket.New(wsConn)
+	defer conn.Close()
+
+	s.logger.Info(
+		"multiplexed upstream connected",
+		zap.String("upstream-id", mux.id),
+		zap.String("client-ip", c.ClientIP()),
+		zap.Bool("resumed", mux.resumed),
+	)
+	defer s.logger.Info(
+		"multiplexed upstream disconnected",
+		zap.String("upstream-id", mux.id),
+		zap.String("client-ip", c.ClientIP()),
+	)
+
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	defer cancel(nil)
+
+	var expiryTime time.Time
+	if mux.token != nil {
+		expiryTime = mux.token.Expiry
+	}
+	expiry := newTokenExpiry(expiryTime, func() {
+		cancel(errTokenExpired)
+	})
+	defer expiry.Stop()
+
+	mux.sess = s.newSession(conn)
+	defer mux.sess.Close()
+
+	monitorErrCh := make(chan error, 1)
+	go func() {
+		monitorErrCh <- s.monitor(ctx, mux.sess, "", c.ClientIP())
+	}()
+
+	reason := DisconnectReasonError
+	defer func() {
+		s.closeMuxSession(mux, reason)
+	}()
+
+	reason = s.serveStreams(ctx, conn, mux.sess, "", func(stream net.Conn) {
+		s.handleMuxRequest(stream, mux, expiry)
+	})
+	reason = s.monitorReason(mux.sess, monitorErrCh, reason)
+}
+
+// handleMuxRequest handles a control request from the upstream on a
+// multiplexed session.
+func (s *Server) handleMuxRequest(
+	stream net.Conn,
+	mux *muxSession,
+	expiry *tokenExpiry,
+) {
+	defer stream.Close()
+
+	if err := stream.SetDeadline(time.Now().Add(tokenRefreshTimeout)); err != nil {
+		return
+	}
+
+	var req tunnel.Request
+	if err := json.NewDecoder(stream).Decode(&req); err != nil {
+		s.logger.Warn("failed to read upstream request", zap.Error(err))
+		return
+	}
+
+	var resp any
+	switch {
+	case req.Register != nil:
+		resp = s.register(mux, req.Register.EndpointID)
+	case req.Unregister != nil:
+		resp = s.unregister(mux, req.Unregister.EndpointID)
+	case req.TokenRefresh != nil:
+		resp = s.refreshMuxToken(mux, req.TokenRefresh.Token, expiry)
+	default:
+		s.logger.Warn("unknown upstream request")
+		return
+	}
+
+	if err := json.NewEncoder(stream).Encode(resp); err != nil {
+		s.logger.Warn("failed to write upstream response", zap.Error(err))
+	}
+}
+
+func (s *Server) register(mux *muxSession, endpointID string) tunnel.RegisterResponse {
+	if err := ValidateEndpointID(endpointID); err != nil {
+		s.logger.Warn(
+			"register rejected; invalid endpoint id",
+			zap.String("endpoint-id", endpointID),
+			zap.Error(err),
+		)
+		return tunnel.RegisterResponse{Error: err.Error()}
+	}
+	endpointID = NormalizeEndpointID(endpointID)
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if mux.token != nil && !mux.token.EndpointPermitted(endpointID) {
+		s.logger.Warn(
+			"endpoint not permitted",
+			zap.Strings("token-endpoints", mux.token.Endpoints),
+			zap.String("endpoint-id", endpointID),
+		)
+		return tunnel.RegisterResponse{Error: "endpoint not permitted"}
+	}
+
+	if mux.closed {
+		return tunnel.RegisterResponse{Error: "session closed"}
+	}
+	if _, ok := mux.upstreams[endpointID]; ok {
+		// Already registered, such as the upstream retrying a request.
+		return tunnel.RegisterResponse{}
+	}
+
+	upstream := NewConnUpstream(endpointID, mux.sess)
+	upstream.id = mux.id
+	upstream.multiplexed = true
+	upstream.resumed = mux.resumed
+	upstream.maxStreams = mux.maxStreams
+	mux.upstreams[endpointID] = upstream
+
+	s.upstreams.AddConn(upstream)
+	s.recordConnected(endpointID, mux.id, mux.clientIP)
+
+	s.logger.Info(
+		"endpoint registered",
+		zap.String("endpoint-id", endpointID),
+		zap.String("upstream-id", mux.id),
+	)
+	return tunnel.RegisterResponse{}
+}
+
+// refreshMuxToken refreshes the token of a multiplexed session. The new token
+// replaces the session token, so endpoints registered after the refresh must
+// be permitted by the new token.
+//
+// The session mutex is held while verifying the token, so an endpoint can't
+// be registered concurrently with the old token.
+func (s *Server) refreshMuxToken(
+	mux *muxSession,
+	token string,
+	expiry *tokenExpiry,
+) tunnel.TokenRefreshResponse {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	endpointToken, resp := s.refreshToken(token, mux.endpointIDs(), expiry)
+	if endpointToken != nil {
+		mux.token = endpointToken
+	}
+	return resp
+}
+
+func (s *Server) unregister(mux *muxSession, endpointID string) tunnel.UnregisterResponse {
+	endpointID = NormalizeEndpointID(endpointID)
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	upstream, ok := mux.upstreams[endpointID]
+	if !ok {
+		return tunnel.UnregisterResponse{
+			Error: fmt.Sprintf("endpoint not registered: %s", endpointID),
+		}
+	}
+	delete(mux.upstreams, endpointID)
+
+	s.upstreams.RemoveConn(upstream)
+	s.recordDisconnected(
+		endpointID, mux.id, mux.clientIP, DisconnectReasonUnregistered,
+	)
+
+	s.logger.Info(
+		"endpoint unregistered",
+		zap.String("endpoint-id", endpointID),
+	)
+	return tunnel.UnregisterResponse{}
+}
+
+// closeMuxSession removes the upstreams for all endpoints registered on the
+// session, given the reason the session disconnected.
+func (s *Server) closeMuxSession(mux *muxSession, reason string) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	mux.closed = true
+	for endpointID, upstream := range mux.upstreams {
+		s.upstreams.RemoveConn(upstream)
+		s.recordDisconnected(endpointID, mux.id, mux.clientIP, reason)
+		delete(mux.upstreams, endpointID)
+	}
+}
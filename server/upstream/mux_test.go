@@ -0,0 +1,194 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/keepalive"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/tunnel"
+	"github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/piko/server/auth"
+)
+
+func muxRequest(t *testing.T, sess *yamux.Session, req tunnel.Request, resp any) {
+	stream, err := sess.OpenStream()
+	require.NoError(t, err)
+	defer stream.Close()
+
+	require.NoError(t, json.NewEncoder(stream).Encode(req))
+	require.NoError(t, json.NewDecoder(stream).Decode(resp))
+}
+
+func register(t *testing.T, sess *yamux.Session, endpointID string) tunnel.RegisterResponse {
+	var resp tunnel.RegisterResponse
+	muxRequest(t, sess, tunnel.Request{
+		Register: &tunnel.RegisterRequest{EndpointID: endpointID},
+	}, &resp)
+	return resp
+}
+
+func TestServer_Multiplexed(t *testing.T) {
+	connect := func(
+		t *testing.T,
+		manager *fakeManager,
+		verifier auth.Verifier,
+	) *yamux.Session {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(manager, verifier, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		t.Cleanup(func() {
+			s.Shutdown(context.TODO())
+		})
+
+		url := fmt.Sprintf("ws://%s/piko/v1/upstream", ln.Addr().String())
+		conn, err := websocket.Dial(
+			context.TODO(), url, websocket.WithToken("my-token"),
+		)
+		require.NoError(t, err)
+
+		sess, err := yamux.Client(conn, yamux.DefaultConfig())
+		require.NoError(t, err)
+		return sess
+	}
+
+	// Tests registering multiple endpoints on the same connection, where
+	// connections to each endpoint identify the endpoint.
+	t.Run("register", func(t *testing.T) {
+		manager := newFakeManager()
+		sess := connect(t, manager, nil)
+
+		var upstreams []Upstream
+		for _, endpointID := range []string{"endpoint-1", "endpoint-2"} {
+			respCh := make(chan tunnel.RegisterResponse)
+			go func() {
+				respCh <- register(t, sess, endpointID)
+			}()
+			upstreams = append(upstreams, <-manager.addConnCh)
+			assert.Equal(t, "", (<-respCh).Error)
+		}
+		assert.Equal(t, "endpoint-1", upstreams[0].EndpointID())
+		assert.Equal(t, "endpoint-2", upstreams[1].EndpointID())
+
+		for _, u := range upstreams {
+			go func() {
+				conn, err := u.Dial()
+				assert.NoError(t, err)
+				_, _ = conn.Write([]byte("foo"))
+				conn.Close()
+			}()
+
+			stream, err := sess.AcceptStream()
+			require.NoError(t, err)
+
+			endpointID, err := tunnel.ReadStreamHeader(stream)
+			require.NoError(t, err)
+			assert.Equal(t, u.EndpointID(), endpointID)
+
+			b, err := io.ReadAll(stream)
+			require.NoError(t, err)
+			assert.Equal(t, "foo", string(b))
+		}
+
+		// Unregister the first endpoint.
+		respCh := make(chan tunnel.UnregisterResponse)
+		go func() {
+			var resp tunnel.UnregisterResponse
+			muxRequest(t, sess, tunnel.Request{
+				Unregister: &tunnel.UnregisterRequest{EndpointID: "endpoint-1"},
+			}, &resp)
+			respCh <- resp
+		}()
+		assert.Equal(t, "endpoint-1", (<-manager.removeConnCh).EndpointID())
+		assert.Equal(t, "", (<-respCh).Error)
+
+		// Closing the connection removes the remaining endpoints.
+		sess.Close()
+		assert.Equal(t, "endpoint-2", (<-manager.removeConnCh).EndpointID())
+	})
+
+	t.Run("invalid endpoint id", func(t *testing.T) {
+		manager := newFakeManager()
+		sess := connect(t, manager, nil)
+		defer sess.Close()
+
+		assert.NotEqual(t, "", register(t, sess, "my:endpoint").Error)
+	})
+
+	t.Run("endpoint not permitted", func(t *testing.T) {
+		verifier := &fakeVerifier{
+			handler: func(_ string) (auth.EndpointToken, error) {
+				return auth.EndpointToken{
+					Endpoints: []string{"my-endpoint"},
+				}, nil
+			},
+		}
+
+		manager := newFakeManager()
+		sess := connect(t, manager, verifier)
+		defer sess.Close()
+
+		assert.Equal(t, "endpoint not permitted", register(t, sess, "other-endpoint").Error)
+
+		respCh := make(chan tunnel.RegisterResponse)
+		go func() {
+			respCh <- register(t, sess, "my-endpoint")
+		}()
+		assert.Equal(t, "my-endpoint", (<-manager.addConnCh).EndpointID())
+		assert.Equal(t, "", (<-respCh).Error)
+
+		sess.Close()
+		<-manager.removeConnCh
+	})
+
+	// Tests endpoints registered after refreshing the token must be
+	// permitted by the new token.
+	t.Run("endpoint not permitted after refresh", func(t *testing.T) {
+		verifier := &fakeVerifier{
+			handler: func(token string) (auth.EndpointToken, error) {
+				if token == "narrow-token" {
+					return auth.EndpointToken{
+						Endpoints: []string{"endpoint-1"},
+					}, nil
+				}
+				return auth.EndpointToken{
+					Endpoints: []string{"endpoint-1", "endpoint-2"},
+				}, nil
+			},
+		}
+
+		manager := newFakeManager()
+		sess := connect(t, manager, verifier)
+		defer sess.Close()
+
+		respCh := make(chan tunnel.RegisterResponse)
+		go func() {
+			respCh <- register(t, sess, "endpoint-1")
+		}()
+		assert.Equal(t, "endpoint-1", (<-manager.addConnCh).EndpointID())
+		assert.Equal(t, "", (<-respCh).Error)
+
+		var refreshResp tunnel.TokenRefreshResponse
+		muxRequest(t, sess, tunnel.Request{
+			TokenRefresh: &tunnel.TokenRefreshRequest{Token: "narrow-token"},
+		}, &refreshResp)
+		assert.Equal(t, "", refreshResp.Error)
+
+		assert.Equal(t, "endpoint not permitted", register(t, sess, "endpoint-2").Error)
+
+		sess.Close()
+		<-manager.removeConnCh
+	})
+}
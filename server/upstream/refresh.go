@@ -0,0 +1,173 @@
+package upstream
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/tunnel"
+	"github.com/andydunstall/piko/server/auth"
+)
+
+const (
+	// tokenRefreshTimeout is the timeout to read a token refresh request and
+	// write the response.
+	tokenRefreshTimeout = time.Second * 10
+)
+
+var (
+	errTokenExpired = errors.New("token expired")
+)
+
+// tokenExpiry closes an upstream connection when its token expires.
+//
+// The expiry is extended when the upstream refreshes its token.
+type tokenExpiry struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired bool
+
+	onExpired func()
+}
+
+// newTokenExpiry calls onExpired when the expiry is reached. If the expiry
+// is zero the token never expires.
+func newTokenExpiry(expiry time.Time, onExpired func()) *tokenExpiry {
+	e := &tokenExpiry{
+		onExpired: onExpired,
+	}
+	e.Extend(expiry)
+	return e
+}
+
+// Extend replaces the expiry. Returns false if the token has already
+// expired.
+func (e *tokenExpiry) Extend(expiry time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.expired {
+		return false
+	}
+	if e.timer != nil && !e.timer.Stop() {
+		// The timer has already fired.
+		return false
+	}
+	e.timer = nil
+
+	if !expiry.IsZero() {
+		e.timer = time.AfterFunc(time.Until(expiry), e.expire)
+	}
+	return true
+}
+
+func (e *tokenExpiry) Stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+}
+
+func (e *tokenExpiry) expire() {
+	e.mu.Lock()
+	e.expired = true
+	e.mu.Unlock()
+
+	e.onExpired()
+}
+
+// handleTokenRefresh handles a token refresh request from the upstream on the
+// given stream.
+//
+// If the new token is valid and permits the endpoints registered on the
+// connection, the connection expiry is extended to the expiry of the new
+// token.
+func (s *Server) handleTokenRefresh(
+	stream net.Conn,
+	endpointIDs []string,
+	expiry *tokenExpiry,
+) {
+	defer stream.Close()
+
+	if err := stream.SetDeadline(time.Now().Add(tokenRefreshTimeout)); err != nil {
+		return
+	}
+
+	var req tunnel.TokenRefreshRequest
+	if err := json.NewDecoder(stream).Decode(&req); err != nil {
+		s.logger.Warn("failed to read token refresh", zap.Error(err))
+		return
+	}
+
+	_, resp := s.refreshToken(req.Token, endpointIDs, expiry)
+	if err := json.NewEncoder(stream).Encode(resp); err != nil {
+		s.logger.Warn("failed to write token refresh", zap.Error(err))
+	}
+}
+
+// refreshToken verifies the refreshed token permits the given endpoints and
+// extends the expiry. Returns the verified token, or nil if the refresh was
+// rejected or authentication is disabled.
+func (s *Server) refreshToken(
+	token string,
+	endpointIDs []string,
+	expiry *tokenExpiry,
+) (*auth.EndpointToken, tunnel.TokenRefreshResponse) {
+	endpointToken, resp := s.verifyRefresh(token, endpointIDs, expiry)
+	if resp.Error != "" {
+		s.logger.Warn(
+			"token refresh rejected",
+			zap.Strings("endpoint-ids", endpointIDs),
+			zap.String("reason", resp.Error),
+		)
+	} else {
+		s.logger.Debug(
+			"token refreshed",
+			zap.Strings("endpoint-ids", endpointIDs),
+			zap.Time("expiry", resp.Expiry),
+		)
+	}
+	return endpointToken, resp
+}
+
+func (s *Server) verifyRefresh(
+	token string,
+	endpointIDs []string,
+	expiry *tokenExpiry,
+) (*auth.EndpointToken, tunnel.TokenRefreshResponse) {
+	if s.verifier == nil {
+		// Authentication is disabled so the connection never expires.
+		return nil, tunnel.TokenRefreshResponse{}
+	}
+
+	endpointToken, err := s.verifier.VerifyEndpointToken(
+		token, auth.TokenTypeUpstream,
+	)
+	if err != nil {
+		return nil, tunnel.TokenRefreshResponse{
+			Error: err.Error(),
+		}
+	}
+	for _, endpointID := range endpointIDs {
+		if !endpointToken.EndpointPermitted(endpointID) {
+			return nil, tunnel.TokenRefreshResponse{
+				Error: "endpoint not permitted",
+			}
+		}
+	}
+
+	if !expiry.Extend(endpointToken.Expiry) {
+		return nil, tunnel.TokenRefreshResponse{
+			Error: errTokenExpired.Error(),
+		}
+	}
+	return &endpointToken, tunnel.TokenRefreshResponse{
+		Expiry: endpointToken.Expiry,
+	}
+}
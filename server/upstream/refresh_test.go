@@ -0,0 +1,156 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/keepalive"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/tunnel"
+	"github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/piko/server/auth"
+)
+
+func refreshToken(t *testing.T, sess *yamux.Session, token string) tunnel.TokenRefreshResponse {
+	stream, err := sess.OpenStream()
+	require.NoError(t, err)
+	defer stream.Close()
+
+	require.NoError(t, json.NewEncoder(stream).Encode(tunnel.TokenRefreshRequest{
+		Token: token,
+	}))
+	var resp tunnel.TokenRefreshResponse
+	require.NoError(t, json.NewDecoder(stream).Decode(&resp))
+	return resp
+}
+
+func TestServer_TokenRefresh(t *testing.T) {
+	verifier := &fakeVerifier{
+		handler: func(token string) (auth.EndpointToken, error) {
+			switch token {
+			case "short-lived":
+				return auth.EndpointToken{
+					Expiry: time.Now().Add(time.Millisecond * 100),
+				}, nil
+			case "long-lived":
+				return auth.EndpointToken{
+					Expiry: time.Now().Add(time.Hour),
+				}, nil
+			case "other-endpoint":
+				return auth.EndpointToken{
+					Endpoints: []string{"other-endpoint"},
+				}, nil
+			default:
+				return auth.EndpointToken{}, auth.ErrInvalidToken
+			}
+		},
+	}
+
+	connect := func(t *testing.T, manager *fakeManager) *yamux.Session {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(manager, verifier, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		t.Cleanup(func() {
+			s.Shutdown(context.TODO())
+		})
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		conn, err := websocket.Dial(
+			context.TODO(), url, websocket.WithToken("short-lived"),
+		)
+		require.NoError(t, err)
+
+		sess, err := yamux.Client(conn, yamux.DefaultConfig())
+		require.NoError(t, err)
+		return sess
+	}
+
+	// Tests refreshing the token extends the connection expiry.
+	t.Run("ok", func(t *testing.T) {
+		manager := newFakeManager()
+		sess := connect(t, manager)
+		defer sess.Close()
+
+		<-manager.addConnCh
+
+		resp := refreshToken(t, sess, "long-lived")
+		assert.Equal(t, "", resp.Error)
+		assert.False(t, resp.Expiry.IsZero())
+
+		select {
+		case <-manager.removeConnCh:
+			t.Fatal("upstream removed after token refreshed")
+		case <-time.After(time.Millisecond * 200):
+		}
+
+		sess.Close()
+		<-manager.removeConnCh
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		manager := newFakeManager()
+		sess := connect(t, manager)
+		defer sess.Close()
+
+		<-manager.addConnCh
+
+		resp := refreshToken(t, sess, "invalid")
+		assert.Equal(t, auth.ErrInvalidToken.Error(), resp.Error)
+
+		resp = refreshToken(t, sess, "other-endpoint")
+		assert.Equal(t, "endpoint not permitted", resp.Error)
+
+		// The connection is closed once the original token expires.
+		<-manager.removeConnCh
+	})
+}
+
+func TestTokenExpiry(t *testing.T) {
+	t.Run("expired", func(t *testing.T) {
+		expiredCh := make(chan struct{})
+		expiry := newTokenExpiry(time.Now().Add(time.Millisecond), func() {
+			close(expiredCh)
+		})
+		<-expiredCh
+
+		assert.False(t, expiry.Extend(time.Now().Add(time.Hour)))
+	})
+
+	t.Run("extend", func(t *testing.T) {
+		expiredCh := make(chan struct{})
+		expiry := newTokenExpiry(time.Now().Add(time.Millisecond*50), func() {
+			close(expiredCh)
+		})
+		defer expiry.Stop()
+
+		assert.True(t, expiry.Extend(time.Now().Add(time.Hour)))
+
+		select {
+		case <-expiredCh:
+			t.Fatal("expired after extending")
+		case <-time.After(time.Millisecond * 100):
+		}
+	})
+
+	t.Run("no expiry", func(t *testing.T) {
+		expiry := newTokenExpiry(time.Time{}, func() {
+			t.Fatal("expired without an expiry")
+		})
+		assert.True(t, expiry.Extend(time.Time{}))
+	})
+}
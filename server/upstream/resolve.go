@@ -0,0 +1,217 @@
+package upstream
+
+import (
+	"sort"
+	"time"
+
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+// Route describes the upstream that would be selected for a request to an
+// endpoint, along with the candidates that were considered.
+type Route struct {
+	EndpointID string `json:"endpoint_id"`
+
+	// Policy is the routing policy of the endpoint.
+	Policy config.RoutingPolicy `json:"policy"`
+
+	// Reason describes why the upstream was selected, or why no upstream
+	// was found.
+	Reason string `json:"reason"`
+
+	// Local contains the upstreams connected to the local node, in the
+	// order they are load balanced.
+	Local []RouteUpstream `json:"local"`
+
+	// Remote contains the other nodes in the cluster with an upstream for
+	// the endpoint.
+	Remote []RouteNode `json:"remote"`
+}
+
+// RouteUpstream is an upstream connected to the local node.
+type RouteUpstream struct {
+	// Addr is the remote address of the upstream.
+	Addr string `json:"addr"`
+
+	// Saturated indicates the upstream has reached its limit of concurrent
+	// streams.
+	Saturated bool `json:"saturated,omitempty"`
+
+	// Degraded indicates the upstream is exceeding its latency SLO.
+	Degraded bool `json:"degraded,omitempty"`
+
+	// Warming indicates the upstream is within its slow start window, so
+	// only receives a share of its requests.
+	Warming bool `json:"warming,omitempty"`
+
+	Selected bool `json:"selected"`
+}
+
+// RouteNode is a remote node with an upstream for the endpoint.
+type RouteNode struct {
+	NodeID string `json:"node_id"`
+
+	// Upstreams is the number of upstreams connected to the node.
+	Upstreams int `json:"upstreams"`
+
+	// Requests is the number of active requests to the node's upstreams, as
+	// last reported by the node.
+	Requests int `json:"requests"`
+
+	Selected bool `json:"selected"`
+
+	// Excluded is the reason requests aren't forwarded to the node, or empty
+	// if the node is a candidate.
+	Excluded string `json:"excluded,omitempty"`
+}
+
+// Resolve returns the upstream Select would select for a request to the
+// endpoint right now, without sending a request or affecting load balancing.
+//
+// Selecting among remote nodes, and whether a warming local upstream is
+// selected, is randomised, so the selected upstream may differ between
+// calls.
+func (m *LoadBalancedManager) Resolve(endpointID string) *Route {
+	route := &Route{
+		EndpointID: endpointID,
+		Policy:     m.routing.EndpointPolicy(endpointID),
+		Local:      []RouteUpstream{},
+		Remote:     m.routeNodes(endpointID),
+	}
+
+	localIndex, localOK := m.resolveLocal(endpointID, route)
+
+	if route.Policy == config.RoutingPolicySpread {
+		node := spreadNode(
+			endpointID,
+			len(route.Local),
+			m.cluster.EndpointNodes(endpointID),
+		)
+		if node != nil {
+			route.selectNode(node.ID)
+			route.Reason = "spread routing selected remote node"
+			return route
+		}
+	}
+
+	if localOK {
+		route.Local[localIndex].Selected = true
+		route.Reason = "local upstream available"
+		return route
+	}
+
+	node, ok := m.cluster.LookupEndpoint(endpointID)
+	if !ok {
+		route.Reason = "no upstream available"
+		return route
+	}
+	route.selectNode(node.ID)
+	if len(route.Local) > 0 {
+		route.Reason = "local upstreams saturated; forwarding to remote node"
+	} else {
+		route.Reason = "no local upstream; forwarding to remote node"
+	}
+	return route
+}
+
+// resolveLocal adds the local upstreams for the endpoint to the route, and
+// returns the index of the upstream that would be selected, or false if all
+// local upstreams are saturated.
+func (m *LoadBalancedManager) resolveLocal(endpointID string, route *Route) (int, bool) {
+	shard := m.shard(endpointID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	lb, ok := shard.localUpstreams[endpointID]
+	if !ok {
+		return 0, false
+	}
+
+	now := time.Now()
+	// Order the upstreams from the next upstream to be load balanced.
+	for i := 0; i != len(lb.upstreams); i++ {
+		u := lb.upstreams[(lb.nextIndex+i)%len(lb.upstreams)]
+		var addr string
+		if au, ok := u.(interface{ RemoteAddr() string }); ok {
+			addr = au.RemoteAddr()
+		}
+		_, warming := shard.warmingWeight(u, now)
+		route.Local = append(route.Local, RouteUpstream{
+			Addr:      addr,
+			Saturated: Saturated(u),
+			Degraded:  shard.degraded(u),
+			Warming:   warming,
+		})
+	}
+
+	// Select from a copy of the load balancer to avoid affecting the next
+	// selected upstream.
+	sim := &loadBalancer{
+		upstreams: lb.upstreams,
+		nextIndex: lb.nextIndex,
+	}
+	u, ok := m.nextLocal(shard, sim)
+	if !ok {
+		return 0, false
+	}
+	for i := 0; i != len(lb.upstreams); i++ {
+		if lb.upstreams[(lb.nextIndex+i)%len(lb.upstreams)] == u {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// routeNodes returns the remote nodes with an upstream for the endpoint,
+// including why nodes are excluded from routing, sorted by node ID.
+func (m *LoadBalancedManager) routeNodes(endpointID string) []RouteNode {
+	candidates := make(map[string]struct{})
+	for _, node := range m.cluster.EndpointNodes(endpointID) {
+		candidates[node.ID] = struct{}{}
+	}
+
+	nodes := []RouteNode{}
+	for _, node := range m.cluster.Nodes() {
+		if node.ID == m.cluster.LocalID() || node.Endpoints[endpointID] == 0 {
+			continue
+		}
+
+		routeNode := RouteNode{
+			NodeID:    node.ID,
+			Upstreams: node.Endpoints[endpointID],
+			Requests:  node.Load[endpointID].Requests,
+		}
+		if _, ok := candidates[node.ID]; !ok {
+			routeNode.Excluded = nodeExcludedReason(node, m.cluster.Forwardable(node.ID))
+		}
+		nodes = append(nodes, routeNode)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].NodeID < nodes[j].NodeID
+	})
+	return nodes
+}
+
+func (r *Route) selectNode(nodeID string) {
+	for i := range r.Remote {
+		if r.Remote[i].NodeID == nodeID {
+			r.Remote[i].Selected = true
+		}
+	}
+}
+
+// nodeExcludedReason returns why a node with an upstream for the endpoint
+// isn't a candidate to forward requests to.
+func nodeExcludedReason(node *cluster.Node, forwardable bool) string {
+	switch {
+	case node.Status != cluster.NodeStatusActive:
+		return "node " + string(node.Status)
+	case !forwardable:
+		return "node failing health checks"
+	case node.Draining:
+		return "node draining"
+	default:
+		return "unknown"
+	}
+}
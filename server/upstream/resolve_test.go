@@ -0,0 +1,110 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestLoadBalancedManager_Resolve(t *testing.T) {
+	newState := func() *cluster.State {
+		state := cluster.NewState(&cluster.Node{
+			ID: "local",
+		}, log.NewNopLogger())
+		state.AddNode(&cluster.Node{
+			ID:     "remote-1",
+			Status: cluster.NodeStatusActive,
+		})
+		state.UpdateRemoteEndpoint("remote-1", "my-endpoint", 2)
+		state.AddNode(&cluster.Node{
+			ID:     "remote-2",
+			Status: cluster.NodeStatusUnreachable,
+		})
+		state.UpdateRemoteEndpoint("remote-2", "my-endpoint", 1)
+		state.AddNode(&cluster.Node{
+			ID:     "remote-3",
+			Status: cluster.NodeStatusActive,
+		})
+		state.UpdateRemoteEndpoint("remote-3", "my-endpoint", 1)
+		state.SetForwardable("remote-3", false)
+		return state
+	}
+
+	t.Run("local", func(t *testing.T) {
+		m := NewLoadBalancedManager(
+			newState(), config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger(),
+		)
+		u1 := &fakeSaturatedUpstream{
+			fakeUpstream: fakeUpstream{endpointID: "my-endpoint"},
+			saturated:    true,
+		}
+		u2 := &fakeUpstream{endpointID: "my-endpoint"}
+		m.AddConn(u1)
+		m.AddConn(u2)
+
+		route := m.Resolve("my-endpoint")
+		assert.Equal(t, config.RoutingPolicyLocal, route.Policy)
+		assert.Equal(t, "local upstream available", route.Reason)
+		assert.Equal(t, []RouteUpstream{
+			{Saturated: true},
+			{Selected: true},
+		}, route.Local)
+		assert.Equal(t, []RouteNode{
+			{NodeID: "remote-1", Upstreams: 2},
+			{NodeID: "remote-2", Upstreams: 1, Excluded: "node unreachable"},
+			{NodeID: "remote-3", Upstreams: 1, Excluded: "node failing health checks"},
+		}, route.Remote)
+
+		// Resolving doesn't affect load balancing.
+		for i := 0; i != 3; i++ {
+			u, ok := m.Select("my-endpoint", true)
+			require.True(t, ok)
+			assert.Equal(t, u2, u.(*meteredUpstream).Upstream)
+		}
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		m := NewLoadBalancedManager(
+			newState(), config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger(),
+		)
+
+		route := m.Resolve("my-endpoint")
+		assert.Equal(t, "no local upstream; forwarding to remote node", route.Reason)
+		assert.Empty(t, route.Local)
+		require.Len(t, route.Remote, 3)
+		assert.True(t, route.Remote[0].Selected)
+		assert.False(t, route.Remote[1].Selected)
+		assert.False(t, route.Remote[2].Selected)
+	})
+
+	t.Run("saturated", func(t *testing.T) {
+		m := NewLoadBalancedManager(
+			newState(), config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger(),
+		)
+		m.AddConn(&fakeSaturatedUpstream{
+			fakeUpstream: fakeUpstream{endpointID: "my-endpoint"},
+			saturated:    true,
+		})
+
+		route := m.Resolve("my-endpoint")
+		assert.Equal(t, "local upstreams saturated; forwarding to remote node", route.Reason)
+		assert.False(t, route.Local[0].Selected)
+		assert.True(t, route.Remote[0].Selected)
+	})
+
+	t.Run("no upstream", func(t *testing.T) {
+		m := NewLoadBalancedManager(
+			newState(), config.SLOConfig{}, config.HoldConfig{}, config.RoutingConfig{}, config.QueueConfig{}, config.SlowStartConfig{}, log.NewNopLogger(),
+		)
+
+		route := m.Resolve("unknown")
+		assert.Equal(t, "no upstream available", route.Reason)
+		assert.Empty(t, route.Local)
+		assert.Empty(t, route.Remote)
+	})
+}
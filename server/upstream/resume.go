@@ -0,0 +1,53 @@
+package upstream
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// resumeTokens issues and verifies the resume tokens returned to upstreams
+// when they connect, which upstreams send when they reconnect to identify
+// them as resuming a previous connection.
+//
+// A token contains the ID of the node that issued it and an HMAC of the
+// endpoint ID and issuing node, keyed by a secret shared by all nodes. So any
+// node can verify tokens issued by other nodes, though upstreams can't forge
+// tokens or reuse a token for another endpoint.
+type resumeTokens struct {
+	nodeID string
+	secret []byte
+}
+
+func newResumeTokens(nodeID string, secret string) *resumeTokens {
+	return &resumeTokens{
+		nodeID: nodeID,
+		secret: []byte(secret),
+	}
+}
+
+// Issue returns a token for the given endpoint ID. Multiplexed connections
+// use an empty endpoint ID, since the connection isn't for a single
+// endpoint.
+func (t *resumeTokens) Issue(endpointID string) string {
+	return t.nodeID + "." + t.mac(endpointID, t.nodeID)
+}
+
+// Verify returns whether the token was issued for the given endpoint ID by a
+// node with the same secret.
+func (t *resumeTokens) Verify(endpointID string, token string) bool {
+	// Node IDs may contain dots, so split on the last dot.
+	i := strings.LastIndex(token, ".")
+	if i == -1 {
+		return false
+	}
+	nodeID, mac := token[:i], token[i+1:]
+	return hmac.Equal([]byte(mac), []byte(t.mac(endpointID, nodeID)))
+}
+
+func (t *resumeTokens) mac(endpointID string, nodeID string) string {
+	h := hmac.New(sha256.New, t.secret)
+	h.Write([]byte("piko-resume-v1\n" + nodeID + "\n" + endpointID))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
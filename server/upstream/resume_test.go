@@ -0,0 +1,49 @@
+package upstream
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeTokens(t *testing.T) {
+	tokens := newResumeTokens("node-1", "my-secret")
+
+	t.Run("verify", func(t *testing.T) {
+		token := tokens.Issue("my-endpoint")
+		assert.True(t, tokens.Verify("my-endpoint", token))
+
+		// Tokens issued by another node with the same secret are valid.
+		other := newResumeTokens("node.2", "my-secret")
+		assert.True(t, tokens.Verify("my-endpoint", other.Issue("my-endpoint")))
+	})
+
+	t.Run("multiplexed", func(t *testing.T) {
+		token := tokens.Issue("")
+		assert.True(t, tokens.Verify("", token))
+		assert.False(t, tokens.Verify("my-endpoint", token))
+	})
+
+	t.Run("wrong endpoint", func(t *testing.T) {
+		token := tokens.Issue("my-endpoint")
+		assert.False(t, tokens.Verify("other-endpoint", token))
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		other := newResumeTokens("node-1", "other-secret")
+		assert.False(t, tokens.Verify("my-endpoint", other.Issue("my-endpoint")))
+	})
+
+	t.Run("forged node", func(t *testing.T) {
+		token := tokens.Issue("my-endpoint")
+		mac := token[strings.LastIndex(token, ".")+1:]
+		assert.False(t, tokens.Verify("my-endpoint", "node-2."+mac))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		assert.False(t, tokens.Verify("my-endpoint", ""))
+		assert.False(t, tokens.Verify("my-endpoint", "foo"))
+		assert.False(t, tokens.Verify("my-endpoint", "node-1.foo"))
+	})
+}
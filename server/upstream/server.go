@@ -2,11 +2,15 @@ package upstream
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -14,19 +18,66 @@ import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/andydunstall/piko/pkg/keepalive"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/tunnel"
 	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/piko/server/audit"
 	"github.com/andydunstall/piko/server/auth"
 )
 
+const (
+	// resumeTokenHeader contains the resume token for the upstream
+	// connection.
+	//
+	// If a resume secret is configured, the server returns a token when the
+	// upstream connects, which the upstream sends when it reconnects, such
+	// as after the server node restarts, to identify it as resuming a
+	// previous connection.
+	resumeTokenHeader = "x-piko-resume-token"
+
+	// maxStreamsHeader contains the maximum number of concurrent streams the
+	// upstream accepts on the connection.
+	maxStreamsHeader = "x-piko-max-streams"
+)
+
 // Server accepts connections from upstream services.
 type Server struct {
 	upstreams Manager
 
+	// verifier verifies refreshed upstream tokens, or is nil if
+	// authentication is disabled.
+	verifier auth.Verifier
+
 	httpServer *http.Server
 
 	websocketUpgrader *websocket.Upgrader
 
+	keepalive keepalive.Config
+
+	// maxStreams is the maximum number of concurrent streams to each
+	// upstream connection. If zero there is no limit.
+	maxStreams int
+
+	// draining returns whether the local node is draining, in which case
+	// new upstream connections are rejected. May be nil.
+	draining func() bool
+
+	// history records upstream connect and disconnect events. May be nil.
+	history *ConnHistory
+
+	// resumeTokens issues and verifies resume tokens, or is nil if no resume
+	// secret is configured.
+	resumeTokens *resumeTokens
+
+	// acceptLimiter rate limits new upstream connections, or is nil if
+	// there is no limit.
+	acceptLimiter *acceptLimiter
+
+	// metrics records rejected connections. Only set if there is an accept
+	// limit.
+	metrics *Metrics
+
 	ctx    context.Context
 	cancel func()
 
@@ -36,7 +87,10 @@ type Server struct {
 func NewServer(
 	upstreams Manager,
 	verifier auth.Verifier,
+	auditor audit.Auditor,
 	tlsConfig *tls.Config,
+	keepalive keepalive.Config,
+	maxStreams int,
 	logger log.Logger,
 ) *Server {
 	logger = logger.WithSubsystem("admin")
@@ -45,12 +99,15 @@ func NewServer(
 	ctx, cancel := context.WithCancel(context.Background())
 	server := &Server{
 		upstreams: upstreams,
+		verifier:  verifier,
 		httpServer: &http.Server{
 			Handler:   router,
 			TLSConfig: tlsConfig,
 			ErrorLog:  logger.StdLogger(zapcore.WarnLevel),
 		},
 		websocketUpgrader: &websocket.Upgrader{},
+		keepalive:         keepalive,
+		maxStreams:        maxStreams,
 		ctx:               ctx,
 		cancel:            cancel,
 		logger:            logger,
@@ -59,8 +116,14 @@ func NewServer(
 	// Recover from panics.
 	router.Use(gin.CustomRecoveryWithWriter(nil, server.panicRoute))
 
+	// Limit new connections before authenticating, since verifying tokens
+	// is expensive when many upstreams reconnect at once.
+	router.Use(server.limitAccept)
+
 	if verifier != nil {
-		authMiddleware := NewAuthMiddleware(verifier, logger)
+		authMiddleware := NewAuthMiddleware(
+			verifier, auth.TokenTypeUpstream, auditor, logger,
+		)
 		router.Use(authMiddleware.VerifyEndpointToken)
 	}
 
@@ -69,6 +132,32 @@ func NewServer(
 	return server
 }
 
+// SetDraining sets the function used to check whether the local node is
+// draining. While draining, new upstream connections are rejected with a
+// retryable status so upstreams connect to another node.
+//
+// Must be called before Serve.
+func (s *Server) SetDraining(draining func() bool) {
+	s.draining = draining
+}
+
+// SetHistory sets the history used to record upstream connect and
+// disconnect events.
+//
+// Must be called before Serve.
+func (s *Server) SetHistory(history *ConnHistory) {
+	s.history = history
+}
+
+// SetResumeSecret sets the secret used to sign and verify resume tokens,
+// which must be shared by all nodes in the cluster so upstreams can resume
+// on any node. nodeID is the ID of the local node that issues the tokens.
+//
+// Must be called before Serve.
+func (s *Server) SetResumeSecret(nodeID string, secret string) {
+	s.resumeTokens = newResumeTokens(nodeID, secret)
+}
+
 func (s *Server) Serve(ln net.Listener) error {
 	s.logger.Info(
 		"starting upstream server",
@@ -100,6 +189,19 @@ func (s *Server) Shutdown(ctx context.Context) error {
 // upstreamRoute handles WebSocket connections from upstream services.
 func (s *Server) upstreamRoute(c *gin.Context) {
 	endpointID := c.Param("endpointID")
+	if err := ValidateEndpointID(endpointID); err != nil {
+		s.logger.Warn(
+			"upstream rejected; invalid endpoint id",
+			zap.String("endpoint-id", endpointID),
+			zap.Error(err),
+		)
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"error": err.Error()},
+		)
+		return
+	}
+	endpointID = NormalizeEndpointID(endpointID)
 
 	token, ok := c.Get(TokenContextKey)
 	if ok {
@@ -118,7 +220,32 @@ func (s *Server) upstreamRoute(c *gin.Context) {
 		}
 	}
 
-	wsConn, err := s.websocketUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if s.draining != nil && s.draining() {
+		s.logger.Info(
+			"upstream rejected; node draining",
+			zap.String("endpoint-id", endpointID),
+			zap.String("client-ip", c.ClientIP()),
+		)
+		c.JSON(
+			http.StatusServiceUnavailable,
+			gin.H{"error": "node draining"},
+		)
+		return
+	}
+
+	resumed := s.verifyResumeToken(c, endpointID)
+	upstreamID := newUpstreamID()
+
+	maxStreams, valid := s.parseMaxStreams(c)
+	if !valid {
+		return
+	}
+
+	header := make(http.Header)
+	if s.resumeTokens != nil {
+		header.Set(resumeTokenHeader, s.resumeTokens.Issue(endpointID))
+	}
+	wsConn, err := s.websocketUpgrader.Upgrade(c.Writer, c.Request, header)
 	if err != nil {
 		// Upgrade replies to the client so nothing else to do.
 		s.logger.Warn("failed to upgrade websocket", zap.Error(err))
@@ -130,64 +257,225 @@ func (s *Server) upstreamRoute(c *gin.Context) {
 	s.logger.Info(
 		"upstream connected",
 		zap.String("endpoint-id", endpointID),
+		zap.String("upstream-id", upstreamID),
 		zap.String("client-ip", c.ClientIP()),
+		zap.Bool("resumed", resumed),
 	)
 	defer s.logger.Info(
 		"upstream disconnected",
 		zap.String("endpoint-id", endpointID),
+		zap.String("upstream-id", upstreamID),
 		zap.String("client-ip", c.ClientIP()),
 	)
 
-	ctx := s.ctx
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	defer cancel(nil)
+
+	// If the token has an expiry, then we ensure we close the connection
+	// to the endpoint once the token expires, unless the upstream refreshes
+	// its token first.
+	var expiryTime time.Time
 	if ok {
-		// If the token has an expiry, then we ensure we close the connection
-		// to the endpoint once the token expires.
-		endpointToken := token.(*auth.EndpointToken)
-		if !endpointToken.Expiry.IsZero() {
-			var cancel func()
-			ctx, cancel = context.WithDeadline(ctx, endpointToken.Expiry)
-			defer cancel()
+		expiryTime = token.(*auth.EndpointToken).Expiry
+	}
+	expiry := newTokenExpiry(expiryTime, func() {
+		cancel(errTokenExpired)
+	})
+	defer expiry.Stop()
+
+	sess := s.newSession(conn)
+	defer sess.Close()
+
+	// Close the session if the upstream stops responding to pings, which
+	// removes the upstream below.
+	monitorErrCh := make(chan error, 1)
+	go func() {
+		monitorErrCh <- s.monitor(ctx, sess, endpointID, c.ClientIP())
+	}()
+
+	upstream := NewConnUpstream(endpointID, sess)
+	upstream.id = upstreamID
+	upstream.resumed = resumed
+	upstream.maxStreams = maxStreams
+
+	reason := DisconnectReasonError
+
+	s.upstreams.AddConn(upstream)
+	s.recordConnected(endpointID, upstreamID, c.ClientIP())
+	defer func() {
+		s.upstreams.RemoveConn(upstream)
+		s.recordDisconnected(endpointID, upstreamID, c.ClientIP(), reason)
+	}()
+
+	// The client only opens streams to refresh its token, otherwise blocks
+	// on accept to wait for close or an error.
+	reason = s.serveStreams(ctx, conn, sess, endpointID, func(stream net.Conn) {
+		s.handleTokenRefresh(stream, []string{endpointID}, expiry)
+	})
+	reason = s.monitorReason(sess, monitorErrCh, reason)
+}
+
+// parseMaxStreams returns the maximum number of concurrent streams to the
+// upstream, which is the lowest of the server and upstream limits.
+//
+// If the upstream limit is invalid, replies with 400 and returns false.
+func (s *Server) parseMaxStreams(c *gin.Context) (int, bool) {
+	maxStreams := s.maxStreams
+	if v := c.GetHeader(maxStreamsHeader); v != "" {
+		upstreamMaxStreams, err := strconv.Atoi(v)
+		if err != nil || upstreamMaxStreams < 0 {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"error": "invalid max streams"},
+			)
+			return 0, false
+		}
+		// Use the lowest of the server and upstream limits.
+		if upstreamMaxStreams > 0 && (maxStreams == 0 || upstreamMaxStreams < maxStreams) {
+			maxStreams = upstreamMaxStreams
 		}
 	}
+	return maxStreams, true
+}
 
+// newSession returns a multiplexed session over the upstream connection.
+func (s *Server) newSession(conn *pikowebsocket.Conn) *yamux.Session {
 	muxConfig := yamux.DefaultConfig()
 	muxConfig.Logger = s.logger.StdLogger(zap.WarnLevel)
 	muxConfig.LogOutput = nil
+	if s.keepalive.Enabled() {
+		// Replace the yamux keepalive with our own which supports
+		// configuring the number of missed pings.
+		muxConfig.EnableKeepAlive = false
+	}
 	sess, err := yamux.Server(conn, muxConfig)
 	if err != nil {
 		// Will not happen.
 		panic("yamux server: " + err.Error())
 	}
-	defer sess.Close()
+	return sess
+}
 
-	upstream := NewConnUpstream(endpointID, sess)
+// monitor closes the session if the upstream stops responding to pings.
+func (s *Server) monitor(
+	ctx context.Context,
+	sess *yamux.Session,
+	endpointID string,
+	clientIP string,
+) error {
+	err := keepalive.Monitor(ctx, sess, s.keepalive)
+	if err != nil {
+		s.logger.Warn(
+			"upstream keepalive failed; closing",
+			zap.String("endpoint-id", endpointID),
+			zap.String("client-ip", clientIP),
+			zap.Error(err),
+		)
+	}
+	return err
+}
 
-	s.upstreams.AddConn(upstream)
-	defer s.upstreams.RemoveConn(upstream)
+// monitorReason returns the reason the upstream disconnected, given the
+// reason returned by serveStreams.
+//
+// Since the keepalive monitor closes the session when the upstream stops
+// responding to pings, serveStreams can't distinguish it from the upstream
+// closing the connection. So this closes the session and waits for the
+// monitor to exit to check whether it closed the session.
+func (s *Server) monitorReason(
+	sess *yamux.Session,
+	monitorErrCh <-chan error,
+	reason string,
+) string {
+	sess.Close()
+	if err := <-monitorErrCh; errors.Is(err, keepalive.ErrDeadPeer) {
+		return DisconnectReasonKeepalive
+	}
+	return reason
+}
 
+// serveStreams accepts control streams opened by the upstream and handles
+// each with the given handler, until the session is closed. If the context
+// is cancelled, the connection is closed with the disconnect reason.
+//
+// Returns the reason the upstream disconnected.
+func (s *Server) serveStreams(
+	ctx context.Context,
+	conn *pikowebsocket.Conn,
+	sess *yamux.Session,
+	endpointID string,
+	handler func(stream net.Conn),
+) string {
 	for {
-		// The client will never open streams but block on accept to wait for
-		// close or an error.
-		if _, err := sess.AcceptStreamWithContext(ctx); err != nil {
+		stream, err := sess.AcceptStreamWithContext(ctx)
+		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				return
+				return DisconnectReasonClosed
+			}
+			if errors.Is(context.Cause(ctx), errTokenExpired) {
+				s.logger.Info("upstream token expired")
+				s.disconnect(conn, endpointID, tunnel.DisconnectReasonTokenExpired)
+				return tunnel.DisconnectReasonTokenExpired.String()
 			}
 			if errors.Is(err, context.Canceled) {
 				// Server shutdown.
-				return
-			}
-			if errors.Is(err, context.DeadlineExceeded) {
-				s.logger.Info("upstream token expired")
-				return
+				s.disconnect(conn, endpointID, tunnel.DisconnectReasonShutdown)
+				return tunnel.DisconnectReasonShutdown.String()
 			}
 			s.logger.Warn("session closed unexpectedly", zap.Error(err))
-			return
+			return DisconnectReasonError
 		}
+
+		go handler(stream)
+	}
+}
+
+// disconnect closes the upstream connection, sending the reason to the
+// upstream so it can decide whether to reconnect.
+func (s *Server) disconnect(
+	conn *pikowebsocket.Conn,
+	endpointID string,
+	reason tunnel.DisconnectReason,
+) {
+	s.logger.Debug(
+		"disconnecting upstream",
+		zap.String("endpoint-id", endpointID),
+		zap.String("reason", reason.String()),
+	)
+	_ = conn.CloseWithFrame(int(reason), reason.String())
+}
+
+func (s *Server) recordConnected(endpointID, upstreamID, clientIP string) {
+	if s.history == nil {
+		return
+	}
+	s.history.Record(endpointID, ConnEvent{
+		Type:       ConnEventTypeConnected,
+		UpstreamID: upstreamID,
+		ClientIP:   clientIP,
+	})
+}
+
+func (s *Server) recordDisconnected(
+	endpointID string,
+	upstreamID string,
+	clientIP string,
+	reason string,
+) {
+	if s.history == nil {
+		return
 	}
+	s.history.Record(endpointID, ConnEvent{
+		Type:       ConnEventTypeDisconnected,
+		UpstreamID: upstreamID,
+		ClientIP:   clientIP,
+		Reason:     reason,
+	})
 }
 
 func (s *Server) registerRoutes(router *gin.Engine) {
 	piko := router.Group("/piko/v1")
+	piko.GET("/upstream", s.muxUpstreamRoute)
 	piko.GET("/upstream/:endpointID", s.upstreamRoute)
 }
 
@@ -200,6 +488,36 @@ func (s *Server) panicRoute(c *gin.Context, err any) {
 	c.AbortWithStatus(http.StatusInternalServerError)
 }
 
+// verifyResumeToken returns whether the request includes a valid resume
+// token for the endpoint. Multiplexed connections use an empty endpoint ID.
+//
+// Upstreams with an invalid token are still accepted, though aren't marked
+// as resumed.
+func (s *Server) verifyResumeToken(c *gin.Context, endpointID string) bool {
+	token := c.GetHeader(resumeTokenHeader)
+	if token == "" || s.resumeTokens == nil {
+		return false
+	}
+	if !s.resumeTokens.Verify(endpointID, token) {
+		s.logger.Warn(
+			"invalid resume token",
+			zap.String("endpoint-id", endpointID),
+			zap.String("client-ip", c.ClientIP()),
+		)
+		return false
+	}
+	return true
+}
+
+// newUpstreamID returns a random ID for an upstream connection.
+func newUpstreamID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic("rand: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
 func init() {
 	// Disable Gin debug logs.
 	gin.SetMode(gin.ReleaseMode)
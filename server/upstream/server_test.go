@@ -3,7 +3,9 @@ package upstream
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -11,8 +13,10 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/andydunstall/piko/pkg/keepalive"
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/testutil"
+	"github.com/andydunstall/piko/pkg/tunnel"
 	"github.com/andydunstall/piko/pkg/websocket"
 	"github.com/andydunstall/piko/server/auth"
 )
@@ -33,6 +37,14 @@ func (m *fakeManager) Select(_ string, _ bool) (Upstream, bool) {
 	return nil, false
 }
 
+func (m *fakeManager) SelectAffinity(_ string, _ string, _ bool) (Upstream, bool) {
+	return nil, false
+}
+
+func (m *fakeManager) SelectHedge(_ string, _ string) (Upstream, bool) {
+	return nil, false
+}
+
 func (m *fakeManager) AddConn(u Upstream) {
 	m.addConnCh <- u
 }
@@ -41,6 +53,20 @@ func (m *fakeManager) RemoveConn(u Upstream) {
 	m.removeConnCh <- u
 }
 
+func (m *fakeManager) ObserveLatency(_ Upstream, _ time.Duration) {
+}
+
+func (m *fakeManager) ObserveForward(_ Upstream, _ error) {
+}
+
+func (m *fakeManager) Hold(_ context.Context, _ string) bool {
+	return false
+}
+
+func (m *fakeManager) Queue(_ context.Context, _ string) bool {
+	return false
+}
+
 func TestServer_Register(t *testing.T) {
 	t.Run("ok", func(t *testing.T) {
 		ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -48,7 +74,7 @@ func TestServer_Register(t *testing.T) {
 
 		manager := newFakeManager()
 
-		s := NewServer(manager, nil, nil, log.NewNopLogger())
+		s := NewServer(manager, nil, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
 		go func() {
 			require.NoError(t, s.Serve(ln))
 		}()
@@ -70,6 +96,216 @@ func TestServer_Register(t *testing.T) {
 		assert.Equal(t, "my-endpoint", removedUpstream.EndpointID())
 	})
 
+	t.Run("normalize endpoint id", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		s := NewServer(manager, nil, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/My-Endpoint",
+			ln.Addr().String(),
+		)
+		conn, err := websocket.Dial(context.TODO(), url)
+		require.NoError(t, err)
+
+		addedUpstream := <-manager.addConnCh
+		assert.Equal(t, "my-endpoint", addedUpstream.EndpointID())
+
+		conn.Close()
+
+		<-manager.removeConnCh
+	})
+
+	t.Run("invalid endpoint id", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		s := NewServer(manager, nil, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my%%3Aendpoint",
+			ln.Addr().String(),
+		)
+		_, err = websocket.Dial(context.TODO(), url)
+		assert.Error(t, err)
+		var retryableError *websocket.RetryableError
+		assert.False(t, errors.As(err, &retryableError))
+	})
+
+	// Tests new upstreams are rejected with a retryable error while the node
+	// is draining.
+	t.Run("draining", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		s := NewServer(manager, nil, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
+		s.SetDraining(func() bool {
+			return true
+		})
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		_, err = websocket.Dial(context.TODO(), url)
+		var retryableError *websocket.RetryableError
+		assert.ErrorAs(t, err, &retryableError)
+	})
+
+	// Tests the server returns a resume token, and upstreams that reconnect
+	// with the token are marked as resumed.
+	t.Run("resume", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		s := NewServer(manager, nil, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
+		s.SetResumeSecret("node-1", "my-secret")
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		conn, err := websocket.Dial(context.TODO(), url)
+		require.NoError(t, err)
+
+		token := conn.ResponseHeader().Get("x-piko-resume-token")
+		assert.NotEqual(t, "", token)
+
+		addedUpstream := <-manager.addConnCh
+		assert.False(t, addedUpstream.(*ConnUpstream).Resumed())
+
+		conn.Close()
+		<-manager.removeConnCh
+
+		// Upstreams with an invalid token aren't marked as resumed.
+		conn, err = websocket.Dial(
+			context.TODO(), url, websocket.WithHeader("x-piko-resume-token", "node-1.invalid"),
+		)
+		require.NoError(t, err)
+
+		addedUpstream = <-manager.addConnCh
+		assert.False(t, addedUpstream.(*ConnUpstream).Resumed())
+
+		conn.Close()
+		<-manager.removeConnCh
+
+		conn, err = websocket.Dial(
+			context.TODO(), url, websocket.WithHeader("x-piko-resume-token", token),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		addedUpstream = <-manager.addConnCh
+		assert.True(t, addedUpstream.(*ConnUpstream).Resumed())
+
+		s.Shutdown(context.TODO())
+		<-manager.removeConnCh
+	})
+
+	// Tests the server doesn't return a resume token without a resume
+	// secret.
+	t.Run("resume disabled", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		s := NewServer(manager, nil, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		conn, err := websocket.Dial(
+			context.TODO(), url, websocket.WithHeader("x-piko-resume-token", "node-1.foo"),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		assert.Equal(t, "", conn.ResponseHeader().Get("x-piko-resume-token"))
+
+		addedUpstream := <-manager.addConnCh
+		assert.False(t, addedUpstream.(*ConnUpstream).Resumed())
+
+		s.Shutdown(context.TODO())
+		<-manager.removeConnCh
+	})
+
+	// Tests the upstream stream limit uses the lower of the server and
+	// upstream limits.
+	t.Run("max streams", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		s := NewServer(manager, nil, nil, nil, keepalive.Config{}, 10, log.NewNopLogger())
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+
+		// Server limit.
+		conn, err := websocket.Dial(context.TODO(), url)
+		require.NoError(t, err)
+		addedUpstream := <-manager.addConnCh
+		assert.Equal(t, 10, addedUpstream.(*ConnUpstream).maxStreams)
+		conn.Close()
+		<-manager.removeConnCh
+
+		// Lower upstream limit.
+		conn, err = websocket.Dial(
+			context.TODO(), url, websocket.WithHeader("x-piko-max-streams", "5"),
+		)
+		require.NoError(t, err)
+		addedUpstream = <-manager.addConnCh
+		assert.Equal(t, 5, addedUpstream.(*ConnUpstream).maxStreams)
+		conn.Close()
+		<-manager.removeConnCh
+
+		// Higher upstream limit.
+		conn, err = websocket.Dial(
+			context.TODO(), url, websocket.WithHeader("x-piko-max-streams", "20"),
+		)
+		require.NoError(t, err)
+		addedUpstream = <-manager.addConnCh
+		assert.Equal(t, 10, addedUpstream.(*ConnUpstream).maxStreams)
+		conn.Close()
+		<-manager.removeConnCh
+	})
+
 	// Tests the server closes upstream connections when it is shutdown.
 	t.Run("close on shutdown", func(t *testing.T) {
 		ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -77,7 +313,7 @@ func TestServer_Register(t *testing.T) {
 
 		manager := newFakeManager()
 
-		s := NewServer(manager, nil, nil, log.NewNopLogger())
+		s := NewServer(manager, nil, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
 		go func() {
 			require.NoError(t, s.Serve(ln))
 		}()
@@ -98,6 +334,125 @@ func TestServer_Register(t *testing.T) {
 
 		removedUpstream := <-manager.removeConnCh
 		assert.Equal(t, "my-endpoint", removedUpstream.EndpointID())
+
+		// The server should send the disconnect reason.
+		_, err = io.ReadAll(conn)
+		assert.ErrorIs(t, err, net.ErrClosed)
+		frame, ok := conn.RemoteClose()
+		assert.True(t, ok)
+		assert.Equal(t, int(tunnel.DisconnectReasonShutdown), frame.Code)
+	})
+
+	// Tests the server closes upstream connections that don't respond to
+	// keepalive pings.
+	t.Run("keepalive dead peer", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		s := NewServer(manager, nil, nil, nil, keepalive.Config{
+			Interval:  time.Millisecond * 10,
+			MaxMissed: 3,
+		}, 0, log.NewNopLogger())
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		// Connect without a yamux session so pings are never answered.
+		conn, err := websocket.Dial(context.TODO(), url)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		addedUpstream := <-manager.addConnCh
+		assert.Equal(t, "my-endpoint", addedUpstream.EndpointID())
+
+		removedUpstream := <-manager.removeConnCh
+		assert.Equal(t, "my-endpoint", removedUpstream.EndpointID())
+	})
+}
+
+func TestServer_History(t *testing.T) {
+	t.Run("closed", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+		history := NewConnHistory("local")
+
+		s := NewServer(manager, nil, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
+		s.SetHistory(history)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		conn, err := websocket.Dial(context.TODO(), url)
+		require.NoError(t, err)
+
+		addedUpstream := <-manager.addConnCh
+
+		conn.Close()
+
+		<-manager.removeConnCh
+
+		// The disconnect event is recorded after removing the upstream.
+		require.Eventually(t, func() bool {
+			return len(history.Events("my-endpoint")) == 2
+		}, time.Second, time.Millisecond*10)
+
+		events := history.Events("my-endpoint")
+		assert.Equal(t, ConnEventTypeConnected, events[0].Type)
+		assert.Equal(t, addedUpstream.(*ConnUpstream).id, events[0].UpstreamID)
+		assert.Equal(t, "127.0.0.1", events[0].ClientIP)
+		assert.Equal(t, ConnEventTypeDisconnected, events[1].Type)
+		assert.Equal(t, DisconnectReasonClosed, events[1].Reason)
+	})
+
+	t.Run("keepalive dead peer", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+		history := NewConnHistory("local")
+
+		s := NewServer(manager, nil, nil, nil, keepalive.Config{
+			Interval:  time.Millisecond * 10,
+			MaxMissed: 3,
+		}, 0, log.NewNopLogger())
+		s.SetHistory(history)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		// Connect without a yamux session so pings are never answered.
+		conn, err := websocket.Dial(context.TODO(), url)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		<-manager.addConnCh
+		<-manager.removeConnCh
+
+		require.Eventually(t, func() bool {
+			return len(history.Events("my-endpoint")) == 2
+		}, time.Second, time.Millisecond*10)
+
+		events := history.Events("my-endpoint")
+		assert.Equal(t, DisconnectReasonKeepalive, events[1].Reason)
 	})
 }
 
@@ -118,7 +473,7 @@ func TestServer_Authentication(t *testing.T) {
 			},
 		}
 
-		s := NewServer(manager, verifier, nil, log.NewNopLogger())
+		s := NewServer(manager, verifier, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
 		go func() {
 			require.NoError(t, s.Serve(ln))
 		}()
@@ -157,7 +512,7 @@ func TestServer_Authentication(t *testing.T) {
 			},
 		}
 
-		s := NewServer(manager, verifier, nil, log.NewNopLogger())
+		s := NewServer(manager, verifier, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
 		go func() {
 			require.NoError(t, s.Serve(ln))
 		}()
@@ -196,7 +551,7 @@ func TestServer_Authentication(t *testing.T) {
 			},
 		}
 
-		s := NewServer(manager, verifier, nil, log.NewNopLogger())
+		s := NewServer(manager, verifier, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
 		go func() {
 			require.NoError(t, s.Serve(ln))
 		}()
@@ -223,7 +578,7 @@ func TestServer_Authentication(t *testing.T) {
 			},
 		}
 
-		s := NewServer(manager, verifier, nil, log.NewNopLogger())
+		s := NewServer(manager, verifier, nil, nil, keepalive.Config{}, 0, log.NewNopLogger())
 		go func() {
 			require.NoError(t, s.Serve(ln))
 		}()
@@ -250,7 +605,7 @@ func TestServer_TLS(t *testing.T) {
 
 	manager := newFakeManager()
 
-	s := NewServer(manager, nil, tlsConfig, log.NewNopLogger())
+	s := NewServer(manager, nil, nil, tlsConfig, keepalive.Config{}, 0, log.NewNopLogger())
 	go func() {
 		require.NoError(t, s.Serve(ln))
 	}()
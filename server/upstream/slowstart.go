@@ -0,0 +1,32 @@
+package upstream
+
+import (
+	"time"
+)
+
+const (
+	// slowStartMinWeight is the weight of an upstream at the start of its
+	// slow start window, so a new upstream always receives some requests.
+	slowStartMinWeight = 0.1
+)
+
+// warmingUpstream tracks a local upstream within its slow start window.
+type warmingUpstream struct {
+	connectedAt time.Time
+	window      time.Duration
+}
+
+// Weight returns the share of its full share of requests the upstream should
+// receive, which increases linearly from slowStartMinWeight to 1 over the
+// window. Returns false once the window has elapsed.
+func (w *warmingUpstream) Weight(now time.Time) (float64, bool) {
+	elapsed := now.Sub(w.connectedAt)
+	if elapsed >= w.window {
+		return 1, false
+	}
+	weight := float64(elapsed) / float64(w.window)
+	if weight < slowStartMinWeight {
+		weight = slowStartMinWeight
+	}
+	return weight, true
+}
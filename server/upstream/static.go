@@ -0,0 +1,89 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	// staticDialTimeout is the timeout to connect to a static upstream,
+	// including the TLS handshake.
+	staticDialTimeout = time.Second * 5
+)
+
+// StaticUpstream is an upstream service the server connects to directly,
+// such as a backend that's routable from the server so doesn't need to
+// connect using the Piko agent.
+type StaticUpstream struct {
+	endpointID string
+
+	// addr is the host and port of the upstream.
+	addr string
+
+	// tlsConfig is the TLS configuration to connect to the upstream, or nil
+	// if the upstream doesn't use TLS.
+	tlsConfig *tls.Config
+}
+
+// NewStaticUpstream returns an upstream for the endpoint that connects to
+// the given URL. Connects using TLS if the URL scheme is 'https'.
+func NewStaticUpstream(endpointID string, u *url.URL) *StaticUpstream {
+	upstream := &StaticUpstream{
+		endpointID: endpointID,
+	}
+
+	port := u.Port()
+	if u.Scheme == "https" {
+		upstream.tlsConfig = &tls.Config{
+			ServerName: u.Hostname(),
+		}
+		if port == "" {
+			port = "443"
+		}
+	} else if port == "" {
+		port = "80"
+	}
+	upstream.addr = net.JoinHostPort(u.Hostname(), port)
+
+	return upstream
+}
+
+func (u *StaticUpstream) EndpointID() string {
+	return u.endpointID
+}
+
+func (u *StaticUpstream) Dial() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), staticDialTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.tlsConfig == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, u.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// RemoteAddr returns the address of the upstream.
+func (u *StaticUpstream) RemoteAddr() string {
+	return u.addr
+}
+
+func (u *StaticUpstream) Forward() bool {
+	return false
+}
+
+var _ Upstream = &StaticUpstream{}
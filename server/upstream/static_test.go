@@ -0,0 +1,68 @@
+package upstream
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticUpstream(t *testing.T) {
+	t.Run("default port", func(t *testing.T) {
+		u, _ := url.Parse("http://10.26.104.56")
+		upstream := NewStaticUpstream("my-endpoint", u)
+		assert.Equal(t, "10.26.104.56:80", upstream.RemoteAddr())
+		assert.Nil(t, upstream.tlsConfig)
+
+		u, _ = url.Parse("https://backend.example.com")
+		upstream = NewStaticUpstream("my-endpoint", u)
+		assert.Equal(t, "backend.example.com:443", upstream.RemoteAddr())
+		assert.Equal(t, "backend.example.com", upstream.tlsConfig.ServerName)
+	})
+
+	t.Run("port", func(t *testing.T) {
+		u, _ := url.Parse("http://10.26.104.56:8080")
+		upstream := NewStaticUpstream("my-endpoint", u)
+		assert.Equal(t, "my-endpoint", upstream.EndpointID())
+		assert.Equal(t, "10.26.104.56:8080", upstream.RemoteAddr())
+		assert.False(t, upstream.Forward())
+	})
+
+	t.Run("dial", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("foo"))
+			conn.Close()
+		}()
+
+		u, _ := url.Parse("http://" + ln.Addr().String())
+		conn, err := NewStaticUpstream("my-endpoint", u).Dial()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		buf := make([]byte, 3)
+		_, err = conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("foo"), buf)
+	})
+
+	t.Run("dial refused", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := ln.Addr().String()
+		ln.Close()
+
+		u, _ := url.Parse("http://" + addr)
+		_, err = NewStaticUpstream("my-endpoint", u).Dial()
+		assert.Error(t, err)
+	})
+}
@@ -20,6 +20,7 @@ func NewStatus(manager *LoadBalancedManager) *Status {
 
 func (s *Status) Register(group *gin.RouterGroup) {
 	group.GET("/endpoints", s.listEndpointsRoute)
+	group.GET("/latency", s.listLatencyRoute)
 }
 
 func (s *Status) listEndpointsRoute(c *gin.Context) {
@@ -27,4 +28,12 @@ func (s *Status) listEndpointsRoute(c *gin.Context) {
 	c.JSON(http.StatusOK, endpoints)
 }
 
+func (s *Status) listLatencyRoute(c *gin.Context) {
+	upstreams := s.manager.Latency()
+	if upstreams == nil {
+		upstreams = []UpstreamLatency{}
+	}
+	c.JSON(http.StatusOK, upstreams)
+}
+
 var _ status.Handler = &Status{}
@@ -1,10 +1,17 @@
 package upstream
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/hashicorp/yamux"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
 
+	"github.com/andydunstall/piko/pkg/tunnel"
 	"github.com/andydunstall/piko/server/cluster"
 )
 
@@ -20,17 +27,43 @@ type Upstream interface {
 	Forward() bool
 }
 
+// ErrStreamLimit is returned when dialing an upstream that already has the
+// maximum number of concurrent streams.
+var ErrStreamLimit = errors.New("upstream stream limit reached")
+
 // ConnUpstream represents a connection to an upstream service thats connected
 // to the local node.
 type ConnUpstream struct {
 	endpointID string
 	sess       *yamux.Session
+
+	// id identifies the upstream connection, or is empty if the connection
+	// has no ID. Multiplexed upstreams share the ID of their connection.
+	id string
+
+	// maxStreams is the maximum number of concurrent streams to the
+	// upstream. If zero there is no limit.
+	maxStreams int
+
+	// streams is the number of active streams to the upstream.
+	streams atomic.Int64
+
+	// resumed indicates whether the upstream connected with a resume token
+	// from a previous connection.
+	resumed bool
+
+	// multiplexed indicates the session is shared by multiple endpoints, so
+	// each stream starts with a header identifying the endpoint.
+	multiplexed bool
+
+	connectedAt time.Time
 }
 
 func NewConnUpstream(endpointID string, sess *yamux.Session) *ConnUpstream {
 	return &ConnUpstream{
-		endpointID: endpointID,
-		sess:       sess,
+		endpointID:  endpointID,
+		sess:        sess,
+		connectedAt: time.Now(),
 	}
 }
 
@@ -39,13 +72,88 @@ func (u *ConnUpstream) EndpointID() string {
 }
 
 func (u *ConnUpstream) Dial() (net.Conn, error) {
-	return u.sess.OpenStream()
+	if u.maxStreams == 0 {
+		return u.openStream()
+	}
+
+	if u.streams.Inc() > int64(u.maxStreams) {
+		u.streams.Dec()
+		return nil, ErrStreamLimit
+	}
+	stream, err := u.openStream()
+	if err != nil {
+		u.streams.Dec()
+		return nil, err
+	}
+	return &streamConn{
+		Conn:    stream,
+		streams: &u.streams,
+		closed:  atomic.NewBool(false),
+	}, nil
+}
+
+func (u *ConnUpstream) openStream() (net.Conn, error) {
+	stream, err := u.sess.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if u.multiplexed {
+		if err := tunnel.WriteStreamHeader(stream, u.endpointID); err != nil {
+			stream.Close()
+			return nil, fmt.Errorf("write stream header: %w", err)
+		}
+	}
+	return stream, nil
+}
+
+// ID returns the ID of the upstream connection, which is included in the
+// upstream connected logs.
+func (u *ConnUpstream) ID() string {
+	return u.id
+}
+
+// Saturated returns whether the upstream has the maximum number of
+// concurrent streams.
+func (u *ConnUpstream) Saturated() bool {
+	return u.maxStreams > 0 && u.streams.Load() >= int64(u.maxStreams)
+}
+
+// Resumed returns whether the upstream connected with a resume token from a
+// previous connection.
+func (u *ConnUpstream) Resumed() bool {
+	return u.resumed
+}
+
+// ConnectedAt returns the time the upstream connected.
+func (u *ConnUpstream) ConnectedAt() time.Time {
+	return u.connectedAt
+}
+
+// RemoteAddr returns the address of the connected upstream.
+func (u *ConnUpstream) RemoteAddr() string {
+	return u.sess.RemoteAddr().String()
 }
 
 func (u *ConnUpstream) Forward() bool {
 	return false
 }
 
+// streamConn is a stream to an upstream with a stream limit, which releases
+// the stream when closed.
+type streamConn struct {
+	net.Conn
+
+	streams *atomic.Int64
+	closed  *atomic.Bool
+}
+
+func (c *streamConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.streams.Dec()
+	}
+	return c.Conn.Close()
+}
+
 // NodeUpstream represents a remote Piko server node.
 type NodeUpstream struct {
 	endpointID string
@@ -63,10 +171,152 @@ func (u *NodeUpstream) EndpointID() string {
 	return u.endpointID
 }
 
+// Node returns the node the upstream forwards to.
+func (u *NodeUpstream) Node() *cluster.Node {
+	return u.node
+}
+
 func (u *NodeUpstream) Dial() (net.Conn, error) {
-	return net.Dial("tcp", u.node.ProxyAddr)
+	return u.DialContext(context.Background())
+}
+
+// DialContext dials the node. If the node has a forward address the
+// connection is to the forward listener, which requires TLS.
+func (u *NodeUpstream) DialContext(ctx context.Context) (net.Conn, error) {
+	addr := u.node.ProxyAddr
+	if u.node.ForwardAddr != "" {
+		addr = u.node.ForwardAddr
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
 }
 
 func (u *NodeUpstream) Forward() bool {
 	return true
 }
+
+// DialContext dials the upstream, using the context if the upstream supports
+// it, such as to apply a dial timeout.
+func DialContext(ctx context.Context, u Upstream) (net.Conn, error) {
+	if d, ok := u.(interface {
+		DialContext(ctx context.Context) (net.Conn, error)
+	}); ok {
+		return d.DialContext(ctx)
+	}
+	return u.Dial()
+}
+
+// Saturated returns whether the upstream has reached its limit of concurrent
+// streams. Upstreams without a limit are never saturated.
+func Saturated(u Upstream) bool {
+	if mu, ok := u.(*meteredUpstream); ok {
+		u = mu.Upstream
+	}
+	su, ok := u.(interface {
+		Saturated() bool
+	})
+	return ok && su.Saturated()
+}
+
+// RemoteNode returns the node the upstream forwards to, or false if the
+// upstream doesn't forward to another node.
+func RemoteNode(u Upstream) (*cluster.Node, bool) {
+	if mu, ok := u.(*meteredUpstream); ok {
+		u = mu.Upstream
+	}
+	nu, ok := u.(*NodeUpstream)
+	if !ok {
+		return nil, false
+	}
+	return nu.Node(), true
+}
+
+// ID returns the ID of the upstream connection, or an empty string if the
+// upstream has no ID, such as an upstream forwarding to another node.
+func ID(u Upstream) string {
+	if mu, ok := u.(*meteredUpstream); ok {
+		u = mu.Upstream
+	}
+	iu, ok := u.(interface{ ID() string })
+	if !ok {
+		return ""
+	}
+	return iu.ID()
+}
+
+// meteredUpstream wraps an upstream to count the bytes sent and received on
+// each connection dialed to the upstream.
+type meteredUpstream struct {
+	Upstream
+
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+
+	// requests counts the active connections dialed to the upstream. May be
+	// nil.
+	requests *atomic.Int64
+
+	// onClose is called when a connection dialed to the upstream is closed.
+	// May be nil.
+	onClose func()
+}
+
+func (u *meteredUpstream) Dial() (net.Conn, error) {
+	return u.DialContext(context.Background())
+}
+
+func (u *meteredUpstream) DialContext(ctx context.Context) (net.Conn, error) {
+	conn, err := DialContext(ctx, u.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	if u.requests != nil {
+		u.requests.Inc()
+	}
+	return &meteredConn{
+		Conn:     conn,
+		bytesIn:  u.bytesIn,
+		bytesOut: u.bytesOut,
+		requests: u.requests,
+		onClose:  u.onClose,
+		closed:   atomic.NewBool(false),
+	}, nil
+}
+
+type meteredConn struct {
+	net.Conn
+
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+
+	requests *atomic.Int64
+	onClose  func()
+	closed   *atomic.Bool
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesIn.Add(float64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesOut.Add(float64(n))
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	// Close the underlying connection first so the upstream's stream is
+	// released before onClose is called.
+	err := c.Conn.Close()
+	if c.closed.CompareAndSwap(false, true) {
+		if c.requests != nil {
+			c.requests.Dec()
+		}
+		if c.onClose != nil {
+			c.onClose()
+		}
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnUpstream_StreamLimit(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+
+	serverSess, err := yamux.Server(serverConn, nil)
+	require.NoError(t, err)
+	defer serverSess.Close()
+	clientSess, err := yamux.Client(clientConn, nil)
+	require.NoError(t, err)
+	defer clientSess.Close()
+
+	go func() {
+		for {
+			if _, err := clientSess.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	u := NewConnUpstream("my-endpoint", serverSess)
+	u.maxStreams = 2
+
+	conn1, err := u.Dial()
+	require.NoError(t, err)
+	conn2, err := u.Dial()
+	require.NoError(t, err)
+	assert.True(t, u.Saturated())
+
+	_, err = u.Dial()
+	assert.ErrorIs(t, err, ErrStreamLimit)
+
+	// Closing a stream should release it, even if closed multiple times.
+	assert.NoError(t, conn1.Close())
+	conn1.Close()
+	assert.False(t, u.Saturated())
+
+	conn3, err := u.Dial()
+	require.NoError(t, err)
+	assert.True(t, u.Saturated())
+
+	conn2.Close()
+	conn3.Close()
+}
@@ -0,0 +1,42 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// file appends usage reports to a file, where each report is a JSON encoded
+// line.
+type file struct {
+	f *os.File
+}
+
+func newFile(path string) (*file, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	return &file{
+		f: f,
+	}, nil
+}
+
+func (f *file) Write(report *Report) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	b = append(b, '\n')
+
+	// Each report is written in a single write, so a failed write won't
+	// corrupt other reports.
+	if _, err := f.f.Write(b); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
+
+func (f *file) Close() error {
+	return f.f.Close()
+}
@@ -1,11 +1,8 @@
 package usage
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"runtime"
 	"time"
 
@@ -14,38 +11,60 @@ import (
 
 	"github.com/andydunstall/piko/pkg/build"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
 	"github.com/andydunstall/piko/server/upstream"
 )
 
 const (
 	reportInterval = time.Hour
+
+	anonymousReportURL     = "http://report.pikoproxy.com/v1"
+	anonymousReportTimeout = time.Second * 5
 )
 
 type Report struct {
-	ID        string `json:"id"`
-	OS        string `json:"os"`
-	Arch      string `json:"arch"`
-	Version   string `json:"version"`
-	Uptime    int64  `json:"uptime"`
-	Requests  uint64 `json:"requests"`
-	Upstreams uint64 `json:"upstreams"`
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	Version   string    `json:"version"`
+	Uptime    int64     `json:"uptime"`
+	Requests  uint64    `json:"requests"`
+	Upstreams uint64    `json:"upstreams"`
 }
 
 // Reporter sends a periodic usage report.
+//
+// The report is sent to the anonymous usage endpoint unless disabled, and
+// to the configured file and webhook.
 type Reporter struct {
 	id    string
 	start time.Time
 	usage *upstream.Usage
 
+	// anonymous sends the anonymous usage report, or is nil if disabled.
+	anonymous *webhook
+
+	// file appends reports to a local file, or is nil if disabled.
+	file *file
+
+	// webhook sends reports to the configured webhook, or is nil if
+	// disabled.
+	webhook *webhook
+
 	ctx    context.Context
 	cancel context.CancelFunc
 
 	logger log.Logger
 }
 
-func NewReporter(usage *upstream.Usage, logger log.Logger) *Reporter {
+func NewReporter(
+	conf config.UsageConfig,
+	usage *upstream.Usage,
+	logger log.Logger,
+) (*Reporter, error) {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Reporter{
+	r := &Reporter{
 		id:     uuid.New().String(),
 		start:  time.Now(),
 		usage:  usage,
@@ -53,6 +72,21 @@ func NewReporter(usage *upstream.Usage, logger log.Logger) *Reporter {
 		cancel: cancel,
 		logger: logger.WithSubsystem("reporter"),
 	}
+	if !conf.Disable {
+		r.anonymous = newWebhook(anonymousReportURL, anonymousReportTimeout)
+	}
+	if conf.Path != "" {
+		f, err := newFile(conf.Path)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("file: %w", err)
+		}
+		r.file = f
+	}
+	if conf.WebhookURL != "" {
+		r.webhook = newWebhook(conf.WebhookURL, conf.WebhookTimeout)
+	}
+	return r, nil
 }
 
 func (r *Reporter) Start() {
@@ -64,6 +98,10 @@ func (r *Reporter) Stop() {
 }
 
 func (r *Reporter) run(ctx context.Context) {
+	if r.file != nil {
+		defer r.file.Close()
+	}
+
 	// Report on startup.
 	r.report()
 
@@ -86,6 +124,7 @@ func (r *Reporter) run(ctx context.Context) {
 func (r *Reporter) report() {
 	report := &Report{
 		ID:        r.id,
+		Time:      time.Now().UTC(),
 		OS:        runtime.GOOS,
 		Arch:      runtime.GOARCH,
 		Version:   build.Version,
@@ -93,32 +132,22 @@ func (r *Reporter) report() {
 		Requests:  r.usage.Requests.Load(),
 		Upstreams: r.usage.Upstreams.Load(),
 	}
-	if err := r.send(report); err != nil {
-		// Debug only as theres no user impact.
-		r.logger.Debug("failed to send usage report", zap.Error(err))
-	}
-}
-
-func (r *Reporter) send(report *Report) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-
-	body, err := json.Marshal(report)
-	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+	if r.anonymous != nil {
+		if err := r.anonymous.Send(report); err != nil {
+			// Debug only as theres no user impact.
+			r.logger.Debug("failed to send usage report", zap.Error(err))
+		}
 	}
-	req, err := http.NewRequestWithContext(
-		ctx, http.MethodPost, "http://report.pikoproxy.com/v1", bytes.NewBuffer(body),
-	)
-	if err != nil {
-		return fmt.Errorf("request: %w", err)
+	if r.file != nil {
+		if err := r.file.Write(report); err != nil {
+			r.logger.Warn("failed to write usage report", zap.Error(err))
+		}
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("request: %w", err)
+	if r.webhook != nil {
+		if err := r.webhook.Send(report); err != nil {
+			r.logger.Warn(
+				"failed to send usage report to webhook", zap.Error(err),
+			)
+		}
 	}
-	defer resp.Body.Close()
-
-	return nil
 }
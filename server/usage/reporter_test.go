@@ -0,0 +1,82 @@
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func TestReporter(t *testing.T) {
+	var mu sync.Mutex
+	var webhookReports []Report
+	server := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, r *http.Request) {
+			var report Report
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&report))
+
+			mu.Lock()
+			defer mu.Unlock()
+			webhookReports = append(webhookReports, report)
+		},
+	))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+
+	usage := &upstream.Usage{
+		Requests:  atomic.NewUint64(10),
+		Upstreams: atomic.NewUint64(2),
+	}
+	reporter, err := NewReporter(config.UsageConfig{
+		Disable:        true,
+		Path:           path,
+		WebhookURL:     server.URL,
+		WebhookTimeout: time.Second,
+	}, usage, log.NewNopLogger())
+	require.NoError(t, err)
+	assert.Nil(t, reporter.anonymous)
+
+	doneCh := make(chan struct{})
+	go func() {
+		reporter.Start()
+		close(doneCh)
+	}()
+	// Reports on startup and shutdown.
+	reporter.Stop()
+	<-doneCh
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var fileReports []Report
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var report Report
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &report))
+		fileReports = append(fileReports, report)
+	}
+	require.Len(t, fileReports, 2)
+	assert.Equal(t, uint64(10), fileReports[0].Requests)
+	assert.Equal(t, uint64(2), fileReports[0].Upstreams)
+	assert.Equal(t, reporter.id, fileReports[0].ID)
+	assert.False(t, fileReports[0].Time.IsZero())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, fileReports, webhookReports)
+}
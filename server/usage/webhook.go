@@ -0,0 +1,50 @@
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhook sends usage reports as JSON encoded POST requests.
+type webhook struct {
+	url     string
+	timeout time.Duration
+}
+
+func newWebhook(url string, timeout time.Duration) *webhook {
+	return &webhook{
+		url:     url,
+		timeout: timeout,
+	}
+}
+
+func (w *webhook) Send(report *Report) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, w.url, bytes.NewBuffer(body),
+	)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -5,6 +5,8 @@ package tests
 import (
 	"context"
 	"crypto/rand"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -59,6 +61,32 @@ func TestAuth_Upstream(t *testing.T) {
 		defer ln.Close()
 	})
 
+	// Tests an upstream authenticating with a token loaded from a file.
+	t.Run("token file", func(t *testing.T) {
+		secretKey := generateTestHSKey()
+		node := cluster.NewNode(cluster.WithAuthConfig(auth.Config{
+			TokenHMACSecretKey: string(secretKey),
+		}))
+		node.Start()
+		defer node.Stop()
+
+		token := jwt.NewWithClaims(jwt.SigningMethodHS512, endpointClaims)
+		tokenString, err := token.SignedString([]byte(secretKey))
+		assert.NoError(t, err)
+
+		tokenPath := filepath.Join(t.TempDir(), "token")
+		assert.NoError(t, os.WriteFile(tokenPath, []byte(tokenString), 0o600))
+
+		upstreamURL := "http://" + node.UpstreamAddr()
+		pikoClient := client.New(
+			client.WithUpstreamURL(upstreamURL),
+			client.WithTokenFile(tokenPath),
+		)
+		ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+		assert.NoError(t, err)
+		defer ln.Close()
+	})
+
 	// Tests an upstream authenticating with an invalid token (signed by
 	// the wrong key).
 	t.Run("invalid", func(t *testing.T) {
@@ -82,6 +110,54 @@ func TestAuth_Upstream(t *testing.T) {
 		assert.ErrorContains(t, err, "connect: 401: invalid token")
 	})
 
+	// Tests rotating the token key at runtime, where new upstreams must use
+	// the new key and connected upstreams remain connected.
+	t.Run("reload", func(t *testing.T) {
+		secretKey := generateTestHSKey()
+		node := cluster.NewNode(cluster.WithAuthConfig(auth.Config{
+			TokenHMACSecretKey: string(secretKey),
+		}))
+		node.Start()
+		defer node.Stop()
+
+		token := jwt.NewWithClaims(jwt.SigningMethodHS512, endpointClaims)
+		tokenString, err := token.SignedString([]byte(secretKey))
+		assert.NoError(t, err)
+
+		upstreamURL := "http://" + node.UpstreamAddr()
+		pikoClient := client.New(
+			client.WithUpstreamURL(upstreamURL),
+			client.WithToken(tokenString),
+		)
+		ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+		assert.NoError(t, err)
+		defer ln.Close()
+
+		rotatedKey := generateTestHSKey()
+		assert.NoError(t, node.ReloadAuth(auth.Config{
+			TokenHMACSecretKey: string(rotatedKey),
+		}))
+
+		// Tokens signed with the old key must be rejected.
+		_, err = pikoClient.Listen(context.TODO(), "my-endpoint")
+		assert.ErrorContains(t, err, "connect: 401: invalid token")
+
+		rotatedTokenString, err := token.SignedString([]byte(rotatedKey))
+		assert.NoError(t, err)
+		rotatedClient := client.New(
+			client.WithUpstreamURL(upstreamURL),
+			client.WithToken(rotatedTokenString),
+		)
+		rotatedLn, err := rotatedClient.Listen(context.TODO(), "my-endpoint")
+		assert.NoError(t, err)
+		defer rotatedLn.Close()
+
+		// The upstream connected with the old key must remain connected.
+		assert.Eventually(t, func() bool {
+			return node.ClusterState().LocalEndpointListeners("my-endpoint") == 2
+		}, time.Second, time.Millisecond*10)
+	})
+
 	// Tests an unauthenticated upstream attempting to connect.
 	t.Run("unauthenticated", func(t *testing.T) {
 		node := cluster.NewNode(cluster.WithAuthConfig(auth.Config{
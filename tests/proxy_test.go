@@ -188,6 +188,54 @@ func TestProxy_HTTP(t *testing.T) {
 	})
 
 	// Tests sending a request to an endpoint with no listeners.
+	// Tests multiple listeners sharing a single multiplexed connection.
+	t.Run("multiplexed", func(t *testing.T) {
+		node := cluster.NewNode()
+		node.Start()
+		defer node.Stop()
+
+		upstreamURL := "http://" + node.UpstreamAddr()
+		pikoClient := client.New(
+			client.WithUpstreamURL(upstreamURL),
+			client.WithMultiplex(true),
+		)
+
+		// Add a listener for each endpoint with a HTTP server returning the
+		// endpoint ID.
+		for _, endpointID := range []string{"endpoint-1", "endpoint-2"} {
+			ln, err := pikoClient.Listen(context.TODO(), endpointID)
+			assert.NoError(t, err)
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(
+				func(w http.ResponseWriter, _ *http.Request) {
+					_, _ = w.Write([]byte(endpointID))
+				},
+			))
+			server.Listener = ln
+			go server.Start()
+			defer server.Close()
+		}
+
+		for _, endpointID := range []string{"endpoint-1", "endpoint-2"} {
+			req, _ := http.NewRequest(
+				http.MethodGet,
+				"http://"+node.ProxyAddr(),
+				nil,
+			)
+			req.Header.Add("x-piko-endpoint", endpointID)
+			httpClient := &http.Client{}
+			resp, err := httpClient.Do(req)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			respBody, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, endpointID, string(respBody))
+		}
+	})
+
 	t.Run("no listeners", func(t *testing.T) {
 		node := cluster.NewNode()
 		node.Start()
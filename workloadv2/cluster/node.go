@@ -12,6 +12,7 @@ import (
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/testutil"
 	"github.com/andydunstall/piko/server"
+	"github.com/andydunstall/piko/server/auth"
 	"github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/server/config"
 )
@@ -128,6 +129,11 @@ func (n *Node) ClusterState() *cluster.State {
 	return n.server.ClusterState()
 }
 
+// ReloadAuth replaces the node's auth configuration.
+func (n *Node) ReloadAuth(conf auth.Config) error {
+	return n.server.ReloadAuth(conf)
+}
+
 func (n *Node) RootCAPool() *x509.CertPool {
 	return n.rootCAPool
 }